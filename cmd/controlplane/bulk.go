@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/envoyage/envoyage/internal/registry"
+	"github.com/envoyage/envoyage/internal/xds"
+)
+
+// Export and import
+//
+// GET /services/export returns every service as a list of definitions in
+// the format of POST /services, ordered by name: YAML by default, JSON
+// with ?format=json. ?source=api (or docker, kube, file) limits it to the
+// services of one source. A list of API services is also a valid services
+// file for the file provider.
+//
+// POST /services/import takes such a list, as YAML or JSON, as the full
+// desired state of the API's services and applies it as one registry
+// change: services are added or replaced, and API services the list
+// leaves out are removed. Services of other sources are only touched if
+// the list names them, and then only if cfg.Sources lets the API take them
+// over. If any service is invalid nothing changes. ?dry_run=true returns
+// the changes without making them, e.g. to review in CI before applying,
+// with how each node's snapshot would change (see dryrun.go).
+// As with PUT, maintenance mode, share links and canaries aren't part of a
+// definition and are kept.
+
+// maxImportBytes bounds an import body.
+const maxImportBytes = 16 << 20
+
+func handleExportServices(reg *registry.Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		source := r.URL.Query().Get("source")
+		services, _ := reg.Snapshot()
+		defs := make([]*serviceRequest, 0, len(services))
+		for _, svc := range services {
+			if source == "" || registry.SourceOf(svc) == source {
+				defs = append(defs, serviceRequestFrom(svc))
+			}
+		}
+
+		// Through JSON, so the keys are the API's field names, leaving out
+		// unset fields to keep the files short.
+		data, err := json.Marshal(defs)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		var doc []map[string]any
+		if err := json.Unmarshal(data, &doc); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		for _, def := range doc {
+			prune(def)
+		}
+
+		switch r.URL.Query().Get("format") {
+		case "", "yaml":
+			out, err := yaml.Marshal(doc)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			w.Header().Set("Content-Type", "application/yaml")
+			w.Write(out)
+		case "json":
+			w.Header().Set("Content-Type", "application/json")
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "  ")
+			enc.Encode(doc)
+		default:
+			writeError(w, http.StatusBadRequest, "format must be yaml or json")
+		}
+	}
+}
+
+// prune deletes the members of a decoded JSON object that are zero values,
+// objects recursively, and reports whether anything is left.
+func prune(m map[string]any) bool {
+	for k, v := range m {
+		if unset(v) {
+			delete(m, k)
+		}
+	}
+	return len(m) > 0
+}
+
+// unset reports whether a decoded JSON value is its field's zero value, an
+// object once pruned included.
+func unset(v any) bool {
+	switch v := v.(type) {
+	case map[string]any:
+		return !prune(v)
+	case nil:
+		return true
+	case bool:
+		return !v
+	case float64:
+		return v == 0
+	case string:
+		return v == ""
+	case []any:
+		return len(v) == 0
+	}
+	return false
+}
+
+func handleImportServices(reg *registry.Registry, xdsServer *xds.Server, log *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		dryRun, err := dryRunOf(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxImportBytes))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "reading body: "+err.Error())
+			return
+		}
+		services, err := parseImport(data)
+		if err != nil {
+			writeRequestError(w, err)
+			return
+		}
+
+		ctx := registry.WithComment(r.Context(), q.Get("comment"))
+		changes, err := reg.Apply(ctx, registry.Desired{
+			Source:   registry.SourceAPI,
+			Services: services,
+			Keep:     keepUndefined,
+			DryRun:   dryRun,
+		})
+		if err != nil {
+			writeRegistryError(w, err)
+			return
+		}
+		if changes == nil {
+			changes = []registry.Change{}
+		}
+		if !dryRun && len(changes) > 0 {
+			log.Info("services imported via API", "services", len(services), "changes", len(changes))
+		}
+		resp := map[string]any{
+			"dry_run": dryRun,
+			"changes": changes,
+		}
+		if dryRun {
+			resp["nodes"] = xdsServer.Preview(importedState(reg, services))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// keepUndefined carries over what a definition doesn't describe from the
+// stored service to its replacement.
+func keepUndefined(old, next *registry.Service) {
+	next.Maintenance = old.Maintenance
+	next.MaintenancePage = old.MaintenancePage
+	next.ShareLinks = old.ShareLinks
+	next.Canary = old.Canary
+	next.Switch = old.Switch
+	next.Mirror = old.Mirror
+	next.Waiting = old.Waiting
+}
+
+// parseImport decodes an import body like the file provider does a file:
+// a list of definitions or a single one, YAML or JSON. Invalid fields are
+// reported together, prefixed with the definition's index, e.g.
+// "services[2].domain".
+func parseImport(data []byte) ([]*registry.Service, error) {
+	var doc any
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("invalid yaml or json: %w", err)
+	}
+	var defs []any
+	switch v := doc.(type) {
+	case nil:
+		// Most likely a mistake; an empty list does remove everything.
+		return nil, errors.New("empty body: send [] to remove every API service")
+	case []any:
+		defs = v
+	default:
+		defs = []any{v}
+	}
+
+	var services []*registry.Service
+	var errs fieldErrors
+	for i, def := range defs {
+		raw, err := json.Marshal(def)
+		if err != nil {
+			return nil, fmt.Errorf("services[%d]: %w", i, err)
+		}
+		svc, err := decodeServiceFile(raw)
+		var fe fieldErrors
+		switch {
+		case errors.As(err, &fe):
+			for _, f := range fe {
+				errs = append(errs, fieldError{Field: fmt.Sprintf("services[%d].%s", i, f.Field), Message: f.Message})
+			}
+		case err != nil:
+			return nil, fmt.Errorf("services[%d]: %w", i, err)
+		default:
+			services = append(services, svc)
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return services, nil
+}
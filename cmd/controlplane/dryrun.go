@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/envoyage/envoyage/internal/registry"
+	"github.com/envoyage/envoyage/internal/xds"
+)
+
+// Dry runs
+//
+// POST /services, PUT, PATCH and DELETE /services/{name} and POST
+// /services/import take ?dry_run=true to check the change, as they would
+// before making it, and answer what it would do instead of doing it:
+//
+//	{
+//	  "dry_run": true,
+//	  "op": "update",
+//	  "service": {...},
+//	  "nodes": [
+//	    {"node": "envoyage-envoy-home", "added": [], "changed": [{"type": "cluster", "name": "cluster_web", "diff": "..."}], "removed": []},
+//	    ...
+//	  ]
+//	}
+//
+// op is as in the change history ("" for a PUT that changes nothing),
+// service the service as it would be stored (left out for a removal), and
+// nodes how each node's snapshot would change; see xds.Preview. An
+// invalid change is answered as without ?dry_run.
+
+// dryRunOf reads the request's ?dry_run.
+func dryRunOf(r *http.Request) (bool, error) {
+	s := r.URL.Query().Get("dry_run")
+	if s == "" {
+		return false, nil
+	}
+	dry, err := strconv.ParseBool(s)
+	if err != nil {
+		return false, errors.New("dry_run must be true or false")
+	}
+	return dry, nil
+}
+
+// writeDryRun answers a dry run of op on the named service: next is the
+// service as it would be stored, nil if it would be removed.
+func writeDryRun(w http.ResponseWriter, reg *registry.Registry, xdsServer *xds.Server, op, name string, next *registry.Service) {
+	current, _ := reg.Snapshot()
+	services := slices.DeleteFunc(current, func(svc *registry.Service) bool { return svc.Name == name })
+	if next != nil {
+		services = append(services, next)
+	}
+
+	resp := map[string]any{
+		"dry_run": true,
+		"op":      op,
+		"nodes":   xdsServer.Preview(services),
+	}
+	if next != nil {
+		resp["service"] = next
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/envoyage/envoyage/internal/xds"
+)
+
+// Envoy admin proxy
+//
+// GET /nodes/{id}/envoy/{path} forwards to the node's Envoy admin interface
+// (its configured admin address), with the query string, e.g.
+//
+//	curl controlplane:8080/nodes/envoyage-envoy-vps/envoy/clusters?format=json
+//	curl controlplane:8080/nodes/envoyage-envoy-home/envoy/stats?filter=cluster_web
+//
+// so the admin ports only need to be reachable from the control plane. Only
+// the read-only endpoints in envoyAdminPaths are forwarded: the admin
+// interface also has endpoints that change the Envoy (POST /quitquitquit,
+// /runtime_modify, /drain_listeners), and those stay out of the API's
+// reach. config_dump shows private keys redacted, as Envoy does.
+
+// envoyAdminPaths are the admin endpoints forwarded.
+var envoyAdminPaths = []string{
+	"certs",
+	"clusters",
+	"config_dump",
+	"listeners",
+	"ready",
+	"runtime",
+	"server_info",
+	"stats",
+	"stats/prometheus",
+}
+
+// envoyAdminTimeout bounds a forwarded request; a full config_dump of a
+// large config takes a moment.
+const envoyAdminTimeout = 10 * time.Second
+
+func handleEnvoyAdmin(xdsServer *xds.Server) http.HandlerFunc {
+	client := &http.Client{Timeout: envoyAdminTimeout}
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, path := r.PathValue("id"), r.PathValue("path")
+		nodes := xdsServer.Nodes()
+		i := slices.IndexFunc(nodes, func(n xds.Node) bool { return n.ID == id })
+		if i < 0 {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("node %q not found", id))
+			return
+		}
+		if !slices.Contains(envoyAdminPaths, path) {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("admin endpoint %q is not forwarded (one of %s)", path, strings.Join(envoyAdminPaths, ", ")))
+			return
+		}
+		admin := nodes[i].Admin
+		if admin == "" {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("node %q has no admin address", id))
+			return
+		}
+
+		target := url.URL{Scheme: "http", Host: admin, Path: "/" + path, RawQuery: r.URL.RawQuery}
+		ctx, cancel := context.WithTimeout(r.Context(), envoyAdminTimeout)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			writeError(w, http.StatusBadGateway, fmt.Sprintf("node %q admin: %v", id, err))
+			return
+		}
+		defer resp.Body.Close()
+
+		for _, h := range []string{"Content-Type", "Content-Length"} {
+			if v := resp.Header.Get(h); v != "" {
+				w.Header().Set(h, v)
+			}
+		}
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/envoyage/envoyage/internal/ha"
+	"github.com/envoyage/envoyage/internal/registry"
+)
+
+// Every error response of the management API has the same JSON body:
+//
+//	{"error": {"code": "validation_failed", "message": "invalid service",
+//	           "fields": [{"field": "domain", "message": "invalid domain \"a..b\""}]}}
+//
+// code is stable for clients to switch on and follows the status: 400
+// bad_request for a body or query that doesn't parse, 404 not_found, 409
+// conflict for a name that is taken or owned by another source, 412
+// precondition_failed for an If-Match that no longer matches, and 422
+// validation_failed for a well-formed request with invalid values, which
+// fields lists by JSON field when it can.
+const (
+	codeBadRequest   = "bad_request"
+	codeNotFound     = "not_found"
+	codeConflict     = "conflict"
+	codePrecondition = "precondition_failed"
+	codeValidation   = "validation_failed"
+)
+
+type apiError struct {
+	Code    string       `json:"code"`
+	Message string       `json:"message"`
+	Fields  []fieldError `json:"fields,omitempty"`
+}
+
+// fieldError is one invalid field of a request.
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// fieldErrors collects the invalid fields of a request. As an error it
+// reads like the messages joined, for callers outside the API (the file
+// provider).
+type fieldErrors []fieldError
+
+func (fe *fieldErrors) add(field string, err error) {
+	*fe = append(*fe, fieldError{Field: field, Message: err.Error()})
+}
+
+func (fe fieldErrors) Error() string {
+	msgs := make([]string, len(fe))
+	for i, f := range fe {
+		msgs[i] = f.Field + ": " + f.Message
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// writeError sends an error response with the code for status.
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeAPIError(w, status, apiError{Code: statusCode(status), Message: message})
+}
+
+// writeRequestError answers a request that failed validation: 422 with
+// its fields if err is a fieldErrors, 400 otherwise.
+func writeRequestError(w http.ResponseWriter, err error) {
+	var fe fieldErrors
+	if errors.As(err, &fe) {
+		writeAPIError(w, http.StatusUnprocessableEntity, apiError{Code: codeValidation, Message: "invalid request", Fields: fe})
+		return
+	}
+	writeError(w, http.StatusBadRequest, err.Error())
+}
+
+// writeRegistryError answers a failed registry change with the status for
+// its cause.
+func writeRegistryError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, registry.ErrInvalid):
+		status = http.StatusUnprocessableEntity
+	case errors.Is(err, registry.ErrExists), errors.Is(err, registry.ErrConflict):
+		status = http.StatusConflict
+	case errors.Is(err, registry.ErrNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, errPrecondition):
+		status = http.StatusPreconditionFailed
+	case errors.Is(err, ha.ErrStandby):
+		status = http.StatusServiceUnavailable
+	}
+	writeError(w, status, err.Error())
+}
+
+func writeAPIError(w http.ResponseWriter, status int, e apiError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]apiError{"error": e})
+}
+
+// statusCode is the error code for an HTTP status: the ones above, or the
+// status text in snake case, e.g. "unauthorized".
+func statusCode(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return codeBadRequest
+	case http.StatusNotFound:
+		return codeNotFound
+	case http.StatusConflict:
+		return codeConflict
+	case http.StatusPreconditionFailed:
+		return codePrecondition
+	case http.StatusUnprocessableEntity:
+		return codeValidation
+	}
+	return strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+}
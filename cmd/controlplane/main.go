@@ -1,17 +1,59 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
+	"regexp"
+	"runtime/debug"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"google.golang.org/protobuf/encoding/protojson"
+	"gopkg.in/yaml.v3"
+
+	"github.com/envoyage/envoyage/internal/canary"
+	"github.com/envoyage/envoyage/internal/challenge"
+	"github.com/envoyage/envoyage/internal/config"
+	"github.com/envoyage/envoyage/internal/dashboard"
+	"github.com/envoyage/envoyage/internal/depends"
+	"github.com/envoyage/envoyage/internal/dnscheck"
 	"github.com/envoyage/envoyage/internal/docker"
+	"github.com/envoyage/envoyage/internal/fileprovider"
+	"github.com/envoyage/envoyage/internal/ha"
+	"github.com/envoyage/envoyage/internal/hooks"
+	"github.com/envoyage/envoyage/internal/kube"
+	"github.com/envoyage/envoyage/internal/lint"
+	"github.com/envoyage/envoyage/internal/metrics"
+	"github.com/envoyage/envoyage/internal/notify"
+	"github.com/envoyage/envoyage/internal/policy"
+	"github.com/envoyage/envoyage/internal/portal"
 	"github.com/envoyage/envoyage/internal/registry"
+	"github.com/envoyage/envoyage/internal/schedule"
+	"github.com/envoyage/envoyage/internal/stats"
+	"github.com/envoyage/envoyage/internal/store"
+	"github.com/envoyage/envoyage/internal/supervisor"
+	"github.com/envoyage/envoyage/internal/support"
+	"github.com/envoyage/envoyage/internal/tracing"
+	"github.com/envoyage/envoyage/internal/tsdb"
+	"github.com/envoyage/envoyage/internal/usage"
+	"github.com/envoyage/envoyage/internal/wasm"
+	"github.com/envoyage/envoyage/internal/webhook"
 	"github.com/envoyage/envoyage/internal/xds"
 )
 
@@ -20,48 +62,322 @@ const (
 	apiAddr = ":8080" // HTTP — management API (debug / manual override)
 )
 
-// nodeIDs lists every Envoy instance this control plane manages.
-// Each gets a tailored snapshot: home Envoy routes to local containers,
-// VPS Envoy routes everything to the home Envoy (simulating the WireGuard
-// tunnel in production).
-var nodeIDs = []string{
-	"envoyage-envoy-home",
-	"envoyage-envoy-vps",
-}
-
 func main() {
-	log := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	// Recent lines are also kept in memory for support bundles.
+	logRing := support.NewLogRing(2000)
+	log := slog.New(slog.NewTextHandler(io.MultiWriter(os.Stdout, logRing), &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+	// --- Config ---
+	// Optional YAML file; without one we run the docker-compose home/VPS pair.
+	cfg, err := config.Load(os.Getenv("ENVOYAGE_CONFIG"))
+	if err != nil {
+		log.Error("failed to load config", "error", err)
+		os.Exit(1)
+	}
+
+	// --- Tracing ---
+	// No-op unless tracing.endpoint is set.
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing.Endpoint)
+	if err != nil {
+		log.Error("failed to set up tracing", "error", err)
+		os.Exit(1)
+	}
+	defer shutdownTracing(context.Background())
+
+	// Every Envoy instance this control plane manages.
+	// Each gets a tailored snapshot: home Envoy routes to local containers,
+	// VPS Envoy routes everything to the home Envoy (simulating the WireGuard
+	// tunnel in production).
+	nodes, err := xdsNodes(cfg)
+	if err != nil {
+		log.Error("invalid node config", "error", err)
+		os.Exit(1)
+	}
 
 	// --- Registry ---
 	// Central in-memory store for all known services.
-	// Populated by two sources in parallel:
-	//   1. Docker Watcher (automatic, label-based)
-	//   2. Management API (manual, for testing and overrides)
+	// Populated by several sources in parallel, each service owned by one:
+	//   1. Docker and Kubernetes watchers (automatic, label-based)
+	//   2. File provider (declared in a directory)
+	//   3. Management API (manual, for testing and overrides)
+	// cfg.Sources decides which one keeps a name they both register.
 	reg := registry.New()
+	// Namespace bounds are enforced on the way in, so a service that asks
+	// for more than its namespace allows is rejected rather than built;
+	// so is raw Envoy config that doesn't parse, from any source.
+	resolver := policy.NewResolver(cfg)
+	reg.SetValidator(func(svc *registry.Service) error {
+		if err := resolver.Check(svc); err != nil {
+			return err
+		}
+		return xds.ValidatePassthrough(svc)
+	})
+	reg.SetOwnership(registry.Ownership{Policy: cfg.Sources.Conflict, Precedence: cfg.Sources.Precedence})
+	if cfg.Store.Path != "" {
+		storeCfg := cfg.Store
+		if cfg.HA != nil {
+			// Migrating the shared file would pull it from under an older
+			// leader; migrate with every instance stopped instead.
+			storeCfg.AutoMigrate = false
+		}
+		if err := openStore(reg, storeCfg, log); err != nil {
+			log.Error("failed to open store", "path", cfg.Store.Path, "error", err)
+			os.Exit(1)
+		}
+	}
+
+	// --- High availability ---
+	// With ha, this instance starts as a standby that follows the shared
+	// store and refuses changes until it holds the leader lock.
+	var haInstance *ha.Instance
+	if cfg.HA != nil {
+		haInstance = ha.New(cfg.HA, store.Open(cfg.Store.Path), reg, log)
+		reg.SetPersister(haInstance)
+	}
+
+	// Wasm filter modules uploaded through the API.
+	wasmStore, err := wasm.Open(cfg.Wasm.Directory)
+	if err != nil {
+		log.Error("failed to open wasm modules", "directory", cfg.Wasm.Directory, "error", err)
+		os.Exit(1)
+	}
+
+	// Startup lint: only the config and stored services are known yet, so
+	// live checks wait for GET /lint.
+	services, _ := reg.Snapshot()
+	for _, f := range lint.Run(cfg, services, nil, nil, wasmStore.Has) {
+		level := map[lint.Severity]slog.Level{lint.Error: slog.LevelError, lint.Warning: slog.LevelWarn}[f.Severity]
+		log.Log(context.Background(), level, "lint: "+f.Message, "code", f.Code, "service", f.Service, "node", f.Node, "fix", f.Fix)
+	}
 
 	// --- xDS Server ---
-	xdsServer := xds.NewServer(reg, nodeIDs, log)
+	xdsServer := xds.NewServer(reg, nodes, cfg, log)
+	xdsServer.UseWasm(wasmStore)
 
 	if err := xdsServer.Seed(); err != nil {
 		log.Error("failed to seed xDS", "error", err)
 		os.Exit(1)
 	}
 
+	// --- Anti-abuse challenge ---
+	// Served to the edge Envoys over ext_authz on the xDS port.
+	var challengeSvc *challenge.Service
+	if cfg.Challenge != nil {
+		challengeSvc, err = challenge.NewService(cfg.Challenge)
+		if err != nil {
+			log.Error("failed to set up challenge", "error", err)
+			os.Exit(1)
+		}
+		xdsServer.AddGRPCService(challengeSvc.Register)
+	}
+
+	// --- Trace exemplars ---
+	// With Envoy tracing on, every Envoy streams its slow and failed requests
+	// to the xDS port; the recent ones are listed per service with links
+	// into the tracing backend, scrubbed for services in privacy mode.
+	var exemplars *tracing.Exemplars
+	if cfg.Tracing.Envoy != nil {
+		privacy, err := tracing.NewPrivacy(cfg.Privacy, func(service string) bool {
+			svc, ok := reg.Get(service)
+			return ok && svc.Privacy
+		})
+		if err != nil {
+			log.Error("failed to set up privacy mode", "error", err)
+			os.Exit(1)
+		}
+		exemplars = tracing.NewExemplars(cfg.Tracing.Envoy, privacy)
+		xdsServer.AddGRPCService(exemplars.Register)
+	}
+
+	// --- Metrics ---
+	// Control plane metrics plus per-service traffic counters pulled from
+	// each Envoy's admin API, or streamed by the Envoys to the xDS port,
+	// all exposed on GET /metrics.
+	metricsReg := metrics.NewRegistry()
+	xdsServer.ExposeMetrics(metricsReg)
+	scraper := stats.NewScraper(func() map[string]string {
+		targets := make(map[string]string)
+		for _, n := range xdsServer.Nodes() {
+			if n.Admin != "" {
+				targets[n.ID] = n.Admin
+			}
+		}
+		return targets
+	}, cfg.Stats.Interval, cfg.Stats.Series, metricsReg, log)
+	if cfg.Stats.Source == config.StatsSourceMetricsService {
+		xdsServer.AddGRPCService(scraper.Register)
+	}
+
+	// Restarts background loops that fail or wedge; see the end of main.
+	sup := supervisor.New(metricsReg, log)
+
+	// Host CPU, memory, disk and tunnel traffic, reported by envoyage-agent
+	// on each node.
+	usageStore := usage.NewStore(metricsReg)
+
+	// Requests, errors and latency per service over the last days, for the
+	// dashboard's charts.
+	history, err := tsdb.Open(cfg.History.Directory, cfg.History.Retention)
+	if err != nil {
+		log.Error("failed to open history", "directory", cfg.History.Directory, "error", err)
+		os.Exit(1)
+	}
+	defer history.Close()
+
+	// Public domains that don't resolve to the edges.
+	var dnsChecker *dnscheck.Checker
+	if cfg.DNSCheck != nil {
+		dnsChecker = dnscheck.NewChecker(cfg, reg, metricsReg, log)
+	}
+
 	// --- Docker Watcher ---
 	// Watches the Docker socket for containers with envoyage.* labels.
 	// Optional: if the socket is not mounted, we fall back to manual API only.
-	watcher, err := docker.NewWatcher(reg, log)
+	watcher, err := docker.NewWatcher(reg, cfg.Docker, metricsReg, log)
 	if err != nil {
 		log.Warn("docker watcher unavailable, falling back to manual API only",
 			"error", err)
 	}
+	// And one for each engine on another machine.
+	var hostWatchers []*docker.Watcher
+	for _, h := range cfg.Docker.Hosts {
+		hw, err := docker.NewHostWatcher(reg, cfg.Docker, h, metricsReg, log)
+		if err != nil {
+			log.Warn("docker host watcher unavailable", "host", h.Name, "error", err)
+			continue
+		}
+		hostWatchers = append(hostWatchers, hw)
+	}
+
+	// --- File Provider ---
+	// Services defined in a directory of files, for the ones that aren't
+	// containers.
+	var fileProvider *fileprovider.Provider
+	if cfg.Files != nil {
+		fileProvider = fileprovider.NewProvider(reg, cfg.Files, decodeServiceFile, log)
+	}
+
+	// --- Kubernetes Watcher ---
+	// Registers opted-in Ingresses of a cluster, alongside Docker.
+	var kubeWatcher *kube.Watcher
+	if cfg.Kubernetes != nil {
+		if kubeWatcher, err = kube.NewWatcher(reg, cfg.Kubernetes, log); err != nil {
+			log.Warn("kubernetes watcher unavailable", "error", err)
+		}
+	}
+
+	// Changes queued for a quiet hour; run by the leader.
+	sched, err := schedule.New(cfg.Store.Schedule, applyScheduled(reg), log)
+	if err != nil {
+		log.Error("failed to open scheduled changes", "path", cfg.Store.Schedule, "error", err)
+		os.Exit(1)
+	}
+	// Each node's latest NACK, for the hooks.
+	nodeErrors := func() map[string]string {
+		out := make(map[string]string)
+		for _, n := range xdsServer.Nodes() {
+			out[n.ID] = xdsServer.Sync(n.ID).Error
+		}
+		return out
+	}
+	// The user's event hook script; run by the leader.
+	var hookEngine *hooks.Engine
+	if cfg.Hooks != nil {
+		hookEngine, err = hooks.New(cfg.Hooks, reg, hooks.Env{
+			Patch: func(ctx context.Context, name string, patch []byte) error {
+				return reg.Modify(ctx, name, func(svc *registry.Service) error {
+					return patchService(svc, patch)
+				})
+			},
+			Health:     scraper.Health,
+			NodeErrors: nodeErrors,
+		}, log)
+		if err != nil {
+			log.Error("failed to load hooks", "script", cfg.Hooks.Script, "error", err)
+			os.Exit(1)
+		}
+		reg.OnChange(hookEngine.Poke)
+	}
+	// Webhooks, ntfy, Gotify and e-mail notified of events; run by the
+	// leader.
+	var notifier *webhook.Notifier
+	if len(cfg.Webhooks) > 0 || cfg.Notify != nil {
+		notifier = webhook.New(cfg, reg, webhook.Env{
+			Nodes: func() map[string]webhook.NodeState {
+				out := make(map[string]webhook.NodeState)
+				for _, n := range xdsServer.Nodes() {
+					st := xdsServer.Sync(n.ID)
+					out[n.ID] = webhook.NodeState{Connected: st.Connected, Error: st.Error}
+				}
+				return out
+			},
+			Health: scraper.Health,
+		}, log, notify.Targets(cfg.Notify)...)
+		reg.OnChange(notifier.Poke)
+	}
+
+	var leaderOnly func() error
+	if haInstance != nil {
+		leaderOnly = haInstance.CheckLeader
+	}
 
 	// --- Management API ---
 	// Stays active alongside the Docker watcher for debugging and overrides.
 	mux := http.NewServeMux()
-	mux.HandleFunc("POST /services", handleAddService(reg, log))
-	mux.HandleFunc("DELETE /services/{name}", handleRemoveService(reg, log))
+	mux.HandleFunc("POST /services", handleAddService(reg, xdsServer, log))
+	mux.HandleFunc("GET /services/export", handleExportServices(reg))
+	mux.HandleFunc("POST /services/import", handleImportServices(reg, xdsServer, log))
+	mux.HandleFunc("GET /services/{name}", handleGetService(reg))
+	mux.HandleFunc("PUT /services/{name}", handlePutService(reg, xdsServer, log))
+	mux.HandleFunc("PATCH /services/{name}", handlePatchService(reg, xdsServer, log))
+	mux.HandleFunc("DELETE /services/{name}", handleRemoveService(reg, xdsServer, log))
 	mux.HandleFunc("GET /services", handleListServices(reg))
+	mux.HandleFunc("GET /services/{name}/health", handleServiceHealth(reg, scraper))
+	mux.HandleFunc("GET /services/{name}/stats", handleServiceStats(reg, scraper))
+	mux.HandleFunc("GET /services/{name}/traces", handleServiceTraces(reg, exemplars))
+	mux.HandleFunc("GET /services/{name}/history", handleServiceHistory(reg, history, cfg.History))
+	mux.HandleFunc("POST /services/{name}/maintenance", handleStartMaintenance(reg, log))
+	mux.HandleFunc("DELETE /services/{name}/maintenance", handleEndMaintenance(reg, log))
+	mux.HandleFunc("PUT /services/{name}/canary", handleSetCanary(reg, log))
+	mux.HandleFunc("DELETE /services/{name}/canary", handleRemoveCanary(reg, log))
+	mux.HandleFunc("POST /services/{name}/switch", handleSwitch(reg, cfg.Stats.Interval, log))
+	mux.HandleFunc("PUT /services/{name}/mirror", handleSetMirror(reg, log))
+	mux.HandleFunc("DELETE /services/{name}/mirror", handleRemoveMirror(reg, log))
+	mux.HandleFunc("GET /changes", handleListChanges(reg))
+	mux.HandleFunc("GET /scheduled", handleListScheduled(sched))
+	mux.HandleFunc("POST /scheduled", handleAddScheduled(sched, leaderOnly, log))
+	mux.HandleFunc("DELETE /scheduled/{id}", handleCancelScheduled(sched, leaderOnly, log))
+	mux.HandleFunc("GET /wasm", handleListWasm(cfg, reg, wasmStore))
+	mux.HandleFunc("GET /wasm/{name}", handleGetWasm(cfg, reg, wasmStore))
+	mux.HandleFunc("PUT /wasm/{name}", handlePutWasm(wasmStore, log))
+	mux.HandleFunc("DELETE /wasm/{name}", handleRemoveWasm(cfg, reg, wasmStore, log))
+	mux.HandleFunc("GET /wasm/modules/{sha256}", handleWasmCode(wasmStore))
+	mux.HandleFunc("GET /lint", handleLint(cfg, reg, scraper, dnsChecker, wasmStore))
+	mux.HandleFunc("GET /diagnostics", handleDiagnostics(watcher, hostWatchers, cfg.Docker))
+	mux.HandleFunc("POST /validate", handleValidate(cfg, reg, xdsServer, wasmStore))
+	mux.HandleFunc("GET /dns-check", handleDNSCheck(dnsChecker))
+	mux.HandleFunc("GET /nodes", handleListNodes(xdsServer, usageStore, scraper))
+	mux.HandleFunc("POST /nodes", handleAddNode(xdsServer))
+	mux.HandleFunc("DELETE /nodes/{id}", handleRemoveNode(xdsServer, usageStore))
+	mux.HandleFunc("POST /nodes/{id}/usage", handleReportUsage(xdsServer, usageStore))
+	mux.HandleFunc("GET /nodes/{id}/static", handleStaticConfig(xdsServer))
+	mux.HandleFunc("GET /nodes/{id}/snapshot", handleExportSnapshot(cfg, reg, xdsServer))
+	mux.HandleFunc("PUT /nodes/{id}/snapshot", handleImportSnapshot(xdsServer, log))
+	mux.HandleFunc("DELETE /nodes/{id}/snapshot", handleReleaseSnapshot(xdsServer))
+	mux.HandleFunc("GET /nodes/{id}/bootstrap", handleBootstrap(xdsServer, cfg.Bootstrap, cfg.Stats))
+	mux.HandleFunc("GET /nodes/{id}/envoy/{path...}", handleEnvoyAdmin(xdsServer))
+	mux.Handle("GET /metrics", metricsReg.Handler())
+	mux.HandleFunc("GET /support/bundle", handleSupportBundle(cfg, reg, xdsServer, mux, logRing))
+	if cfg.Portal != nil {
+		p := portal.New(cfg.Portal, reg, scraper, log)
+		if exemplars != nil {
+			p.ShowTraces(exemplars)
+		}
+		p.Register(mux)
+	}
+	dashboard.Register(mux)
+	mux.HandleFunc("GET /healthz", handleHealthz)
+	mux.HandleFunc("GET /readyz", handleReadyz(xdsServer, watcher, kubeWatcher, sup, haInstance))
 
 	// --- Startup ---
 	ctx, cancel := context.WithCancel(context.Background())
@@ -75,17 +391,55 @@ func main() {
 		cancel()
 	}()
 
-	if watcher != nil {
-		go func() {
-			if err := watcher.Run(ctx); err != nil {
-				log.Error("docker watcher error", "error", err)
-			}
-		}()
+	// Every background loop runs under the supervisor, which restarts one
+	// that exits, panics or stops making progress. The stall timeouts are
+	// a few of each loop's own intervals.
+	if cfg.Stats.Source == config.StatsSourceAdmin {
+		sup.Go(ctx, "stats", max(10*cfg.Stats.Interval, 5*time.Minute), loop(scraper.Run))
+	}
+	sup.Go(ctx, "history", 5*cfg.History.Step, loop(tsdb.NewRecorder(history, reg, scraper, cfg.History.Step, log).Run))
+	if challengeSvc != nil {
+		sup.Go(ctx, "challenge", 5*time.Minute, loop(challengeSvc.Run))
+	}
+	if dnsChecker != nil {
+		sup.Go(ctx, "dns_check", 3*cfg.DNSCheck.Interval, loop(dnsChecker.Run))
+	}
+	// The loops that change the registry run on the leader only.
+	startLeader := func() {
+		sup.Go(ctx, "canary", 5*time.Minute, loop(canary.NewAnalyzer(reg, scraper, log).Run))
+		sup.Go(ctx, "switch", 5*time.Minute, loop(canary.NewSwitcher(reg, scraper, cfg.Stats.Interval, log).Run))
+		sup.Go(ctx, "depends", 5*time.Minute, loop(depends.NewGate(reg, scraper, log).Run))
+		sup.Go(ctx, "schedule", 5*time.Minute, sched.Run)
+		if watcher != nil {
+			sup.Go(ctx, "docker", 3*cfg.Docker.ReconcileInterval, watcher.Run)
+		}
+		for _, hw := range hostWatchers {
+			sup.Go(ctx, "docker@"+hw.Host(), 3*cfg.Docker.ReconcileInterval, hw.Run)
+		}
+		if fileProvider != nil {
+			sup.Go(ctx, "files", max(10*cfg.Files.PollInterval, 5*time.Minute), loop(fileProvider.Run))
+		}
+		if kubeWatcher != nil {
+			sup.Go(ctx, "kubernetes", 3*cfg.Kubernetes.ResyncInterval, kubeWatcher.Run)
+		}
+		if hookEngine != nil {
+			sup.Go(ctx, "hooks", 5*time.Minute, hookEngine.Run)
+		}
+		if notifier != nil {
+			sup.Go(ctx, "webhooks", 5*time.Minute, notifier.Run)
+		}
+	}
+	if haInstance != nil {
+		haInstance.OnElected(startLeader)
+		sup.Go(ctx, "ha", max(10*cfg.HA.PollInterval, time.Minute), haInstance.Run)
+	} else {
+		startLeader()
 	}
 
 	go func() {
 		log.Info("management API listening", "addr", apiAddr)
-		if err := http.ListenAndServe(apiAddr, mux); err != nil {
+		srv := newAPIServer(apiAddr, mux, traceAPI(mux, requireToken(cfg.API, mux)), log)
+		if err := srv.ListenAndServe(); err != nil {
 			log.Error("management API failed", "error", err)
 		}
 	}()
@@ -96,59 +450,1956 @@ func main() {
 	}
 }
 
+// loop adapts a Run method that stops only when ctx is canceled to
+// supervisor.Supervisor.Go.
+func loop(run func(context.Context)) func(context.Context) error {
+	return func(ctx context.Context) error {
+		run(ctx)
+		return nil
+	}
+}
+
+// traceAPI wraps the management API in a span per request, named after the
+// matched route pattern so traces group by endpoint rather than by URL.
+func traceAPI(mux *http.ServeMux, h http.Handler) http.Handler {
+	return otelhttp.NewHandler(h, "api", otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+		if _, pattern := mux.Handler(r); pattern != "" {
+			return pattern
+		}
+		return r.Method + " (unmatched)"
+	}))
+}
+
+// requireToken rejects management API requests without the admin token.
+// Probes, the portal, the dashboard page and Wasm module code are let
+// through: the portal checks its own users, the dashboard page asks for the
+// token itself, and Envoy fetches modules by hash with no token to send.
+func requireToken(cfg *config.API, next http.Handler) http.Handler {
+	if cfg == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" || r.URL.Path == "/readyz" || r.URL.Path == dashboard.Path || strings.HasPrefix(r.URL.Path, "/portal/") ||
+			strings.HasPrefix(r.URL.Path, "/wasm/modules/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		sum := sha256.Sum256([]byte(token))
+		if !ok || token == "" || subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(cfg.TokenSHA256)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, "missing or invalid admin token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// xdsNodes resolves each configured node's profile name.
+func xdsNodes(cfg *config.Config) ([]xds.Node, error) {
+	nodes := make([]xds.Node, 0, len(cfg.Nodes))
+	for _, n := range cfg.Nodes {
+		p, err := xds.LookupProfile(n.Profile)
+		if err != nil {
+			return nil, fmt.Errorf("node %q: %w", n.ID, err)
+		}
+		nodes = append(nodes, xds.Node{
+			ID:        n.ID,
+			Profile:   p,
+			Admin:     n.Admin,
+			Staging:   n.Role == config.NodeRoleStaging,
+			HTTPPort:  n.HTTPPort,
+			HTTPSPort: n.HTTPSPort,
+			IPFamily:  n.IPFamily,
+		})
+	}
+	return nodes, nil
+}
+
 // --- HTTP Handlers ---
 
 type serviceRequest struct {
 	Name     string `json:"name"`
 	Domain   string `json:"domain"`
 	Upstream string `json:"upstream"`
+	ExtAuthz bool   `json:"ext_authz"`
+
+	// Challenge enables the edge anti-abuse challenge.
+	Challenge bool `json:"challenge"`
+
+	// Namespace policy; zero values inherit the namespace defaults.
+	Namespace    string `json:"namespace"`
+	RateLimit    int    `json:"rate_limit"`
+	MaxBodyBytes int64  `json:"max_body_bytes"`
+	Exposure     string `json:"exposure"`
+
+	// Failover is a second upstream the edges send requests to while
+	// home is unreachable, e.g. a cloud replica at "10.8.0.20:8080"; see
+	// registry.Service.Failover.
+	Failover string `json:"failover,omitempty"`
+
+	// Origins are copies of the service on edges, by node ID, e.g.
+	// {"envoyage-envoy-vps": "status:8080"}: that edge serves its copy and
+	// only goes through the tunnel while it is down.
+	Origins map[string]string `json:"origins,omitempty"`
+
+	// Nodes limits the service to some nodes, e.g.
+	// ["envoyage-envoy-vps"] for edge-only; see registry.Service.Nodes.
+	Nodes []string `json:"nodes,omitempty"`
+
+	// Streaming passes large uploads straight through instead of
+	// buffering them; see registry.Service.Streaming.
+	Streaming bool `json:"streaming"`
+
+	// Privacy keeps visitors' addresses and identities out of stored
+	// request data; see config.Privacy.
+	Privacy bool `json:"privacy"`
+
+	// Cache lets the edges cache responses, e.g.
+	// {"bypass_cookies": ["sessionid"]}; see registry.Cache.
+	Cache *cacheRequest `json:"cache,omitempty"`
+
+	// BasicAuth holds htpasswd entries, e.g. ["alice:{SHA}…"].
+	BasicAuth []string `json:"basic_auth"`
+
+	// VirtualClusters are named path groups for per-endpoint stats, e.g.
+	// [{"name":"api","pattern":"/api/*"}]. First match wins.
+	VirtualClusters []registry.VirtualCluster `json:"virtual_clusters"`
+
+	// Aliases serve the upstream under more domains, each mapped to a path
+	// and Host, e.g. [{"domain": "photos.example.com", "path_prefix": "/photos"}].
+	Aliases []aliasRequest `json:"aliases"`
+
+	// Mount serves the service under a path of its domain, e.g.
+	// {"path_prefix": "/grafana"} for an app that only works at "/".
+	Mount *mountRequest `json:"mount,omitempty"`
+
+	JWT *jwtRequest `json:"jwt,omitempty"`
+
+	// Headers holds header rules, e.g.
+	// {"response": {"set": {"Strict-Transport-Security": "max-age=31536000"}}}.
+	Headers *headerRulesRequest `json:"headers,omitempty"`
+
+	// HostRewrite replaces the Host header sent to the upstream: "auto"
+	// for the upstream's host, or a host such as "admin.internal". Edges
+	// pass it unchanged; home rewrites it.
+	HostRewrite string `json:"host_rewrite,omitempty"`
+
+	// ForwardProxy makes the service a forward proxy to the listed
+	// destinations, e.g. {"allow": ["*.lan", "192.168.1.10:8080"]}.
+	// upstream is not needed then.
+	ForwardProxy *forwardProxyRequest `json:"forward_proxy,omitempty"`
+
+	// Redirect makes the service redirect every request instead, e.g.
+	// {"url": "https://new.example.com", "status": 301,
+	// "preserve_path": true}. upstream is not needed then. The status is
+	// 301, 302 (the default), 307 or 308.
+	Redirect *redirectRequest `json:"redirect,omitempty"`
+
+	// Static makes the service answer with fixed content instead, e.g.
+	// {"body": "<h1>Coming soon</h1>", "files": [{"path": "/robots.txt",
+	// "body": "User-agent: *\nDisallow: /\n"}]}. upstream is not needed
+	// then. Files answer their exact path with a 200, body every other.
+	Static *staticRequest `json:"static,omitempty"`
+
+	// TCP makes the service a TCP forward of a port range through the
+	// edges instead, e.g. {"ports": "27015-27020"} with upstream
+	// "game:27015" and no domain; see registry.TCPForward.
+	TCP *tcpRequest `json:"tcp,omitempty"`
+
+	// HealthCheck probes the upstream over TCP on the home node, e.g.
+	// {"send": "PING\r\n", "expect": "+PONG", "interval": "10s"}. {} only
+	// checks that the port accepts connections.
+	HealthCheck *healthCheckRequest `json:"health_check,omitempty"`
+
+	// Concurrency caps the requests in flight to the upstream, queueing
+	// the next ones, e.g. {"max": 1, "queue": 20} for an app that handles
+	// one at a time. Requests past the queue get a 503.
+	Concurrency *concurrencyRequest `json:"concurrency,omitempty"`
+
+	// Affinity keeps each client on one of the upstream's hosts, e.g.
+	// {"mode": "cookie", "ttl": "12h"} or
+	// {"mode": "header", "header": "X-User-ID"}.
+	Affinity *affinityRequest `json:"affinity,omitempty"`
+
+	// LBPolicy is how requests are balanced over the hosts the upstream
+	// resolves to: round_robin (the default), least_request, random or
+	// ring_hash.
+	LBPolicy string `json:"lb_policy,omitempty"`
+
+	// DNS overrides how the home node resolves the upstream, e.g.
+	// {"type": "logical_dns"} or {"refresh_rate": "5m"}. By default an IP
+	// address is used as it is and a hostname is re-resolved every
+	// dns.refresh_rate.
+	DNS *dnsRequest `json:"dns,omitempty"`
+
+	// Shadow copies a share of the requests to another service, whose
+	// replies are dropped, e.g. {"service": "web-next", "percent": 10}.
+	// The percent defaults to 100.
+	Shadow *shadowRequest `json:"shadow,omitempty"`
+
+	// ClientCert passes the identity of a verified client certificate to
+	// the upstream, e.g. {"xfcc": true} or
+	// {"headers": {"X-Client-Subject": "subject"}}. Needs tls.client_ca.
+	ClientCert *clientCertRequest `json:"client_cert,omitempty"`
+
+	// TLS gives the domain its own TLS settings on the edges, e.g.
+	// {"min_version": "1.3", "client_cert": "required"}.
+	TLS *tlsRequest `json:"tls,omitempty"`
+
+	// Schedule puts the service into maintenance or LAN-only exposure at
+	// set times, e.g. [{"cron": "0 2 * * *", "duration": "4h",
+	// "action": "maintenance"}]; see registry.ScheduleRule.
+	Schedule []scheduleRuleRequest `json:"schedule,omitempty"`
+
+	// DependsOn names services this one is only served after, once they
+	// are registered and have a healthy host, e.g. ["app-api"].
+	DependsOn []string `json:"depends_on,omitempty"`
+
+	// Wasm runs uploaded Wasm modules (PUT /wasm/{name}) as HTTP filters
+	// for the service, in order, e.g. [{"module": "geoblock", "config":
+	// {"allow": ["DE"]}, "edge": true}]. config is handed to the plugin as
+	// text: a JSON string as is, anything else as JSON.
+	Wasm []wasmFilterRequest `json:"wasm,omitempty"`
+
+	// FilterConfig and RouteMetadata pass raw Envoy config through, for
+	// features the control plane doesn't model: typed_per_filter_config of
+	// the virtual host by filter name, e.g. {"envoy.filters.http.lua":
+	// {"@type": "type.googleapis.com/...LuaPerRoute", "name": "x.lua"}},
+	// and filter_metadata of its routes by namespace.
+	FilterConfig  map[string]json.RawMessage `json:"filter_config,omitempty"`
+	RouteMetadata map[string]json.RawMessage `json:"route_metadata,omitempty"`
+
+	// Comment says why the change was made; it is kept in the change
+	// history (GET /changes), not on the service.
+	Comment string `json:"comment"`
 }
 
-func handleAddService(reg *registry.Registry, log *slog.Logger) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		var req serviceRequest
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "invalid json", http.StatusBadRequest)
-			return
+type wasmFilterRequest struct {
+	Module   string          `json:"module"`
+	RootID   string          `json:"root_id,omitempty"`
+	Config   json.RawMessage `json:"config,omitempty"`
+	Edge     bool            `json:"edge,omitempty"`
+	FailOpen bool            `json:"fail_open,omitempty"`
+}
+
+func (f wasmFilterRequest) toRegistry() (registry.WasmFilter, error) {
+	config, err := registry.WasmConfig(f.Config)
+	if err != nil {
+		return registry.WasmFilter{}, err
+	}
+	return registry.WasmFilter{Module: f.Module, RootID: f.RootID, Config: config, Edge: f.Edge, FailOpen: f.FailOpen}, nil
+}
+
+// wasmFilterRequestFrom is the API form of a stored filter: config as
+// JSON if it is, else as a string.
+func wasmFilterRequestFrom(f registry.WasmFilter) wasmFilterRequest {
+	req := wasmFilterRequest{Module: f.Module, RootID: f.RootID, Edge: f.Edge, FailOpen: f.FailOpen}
+	switch {
+	case f.Config == "":
+	case json.Valid([]byte(f.Config)) && strings.ContainsAny(f.Config[:1], "{["):
+		req.Config = json.RawMessage(f.Config)
+	default:
+		req.Config, _ = json.Marshal(f.Config)
+	}
+	return req
+}
+
+type concurrencyRequest struct {
+	Max   int `json:"max"`
+	Queue int `json:"queue"`
+}
+
+type affinityRequest struct {
+	Mode   string `json:"mode"`
+	Cookie string `json:"cookie,omitempty"`
+	TTL    string `json:"ttl,omitempty"`
+	Header string `json:"header,omitempty"`
+	Maglev bool   `json:"maglev,omitempty"`
+}
+
+// toRegistry parses the TTL and validates the result.
+func (a *affinityRequest) toRegistry() (*registry.Affinity, error) {
+	aff := &registry.Affinity{Mode: a.Mode, Cookie: a.Cookie, Header: a.Header, Maglev: a.Maglev}
+	if a.TTL != "" {
+		ttl, err := time.ParseDuration(a.TTL)
+		if err != nil {
+			return nil, fmt.Errorf("affinity: invalid ttl: %w", err)
 		}
-		if req.Name == "" || req.Domain == "" || req.Upstream == "" {
-			http.Error(w, "name, domain, and upstream are required", http.StatusBadRequest)
-			return
+		aff.TTL = ttl
+	}
+	if err := registry.ValidateAffinity(aff); err != nil {
+		return nil, err
+	}
+	return aff, nil
+}
+
+type dnsRequest struct {
+	Type        string `json:"type,omitempty"`
+	RefreshRate string `json:"refresh_rate,omitempty"`
+}
+
+// toRegistry parses the refresh rate and validates the result against the
+// upstream.
+func (d *dnsRequest) toRegistry(upstream string) (*registry.DNS, error) {
+	dns := &registry.DNS{Type: d.Type}
+	if d.RefreshRate != "" {
+		rate, err := time.ParseDuration(d.RefreshRate)
+		if err != nil {
+			return nil, fmt.Errorf("dns: invalid refresh_rate: %w", err)
 		}
-		svc := &registry.Service{
-			Name:     req.Name,
-			Domain:   req.Domain,
-			Upstream: req.Upstream,
+		dns.RefreshRate = rate
+	}
+	if err := registry.ValidateDNS(dns, upstream); err != nil {
+		return nil, err
+	}
+	return dns, nil
+}
+
+type scheduleRuleRequest struct {
+	Cron     string `json:"cron"`
+	Duration string `json:"duration"`
+	Action   string `json:"action"`
+}
+
+// scheduleRules parses the durations and validates the rules of a service,
+// a TCP forward if tcp is set.
+func scheduleRules(reqs []scheduleRuleRequest, tcp bool) ([]registry.ScheduleRule, error) {
+	var rules []registry.ScheduleRule
+	for i, r := range reqs {
+		d, err := time.ParseDuration(r.Duration)
+		if err != nil {
+			return nil, fmt.Errorf("schedule[%d]: invalid duration: %w", i, err)
 		}
-		if err := reg.Add(svc); err != nil {
-			http.Error(w, err.Error(), http.StatusConflict)
-			return
+		rules = append(rules, registry.ScheduleRule{Cron: r.Cron, Duration: d, Action: r.Action})
+	}
+	if err := registry.ValidateSchedule(rules, tcp); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+type shadowRequest struct {
+	Service string  `json:"service"`
+	Percent float64 `json:"percent,omitempty"`
+}
+
+type healthCheckRequest struct {
+	Send     string `json:"send"`
+	Expect   string `json:"expect"`
+	Interval string `json:"interval"`
+	Timeout  string `json:"timeout"`
+}
+
+// toRegistry parses the durations and validates the result.
+func (h *healthCheckRequest) toRegistry() (*registry.HealthCheck, error) {
+	hc := &registry.HealthCheck{Send: h.Send, Expect: h.Expect}
+	for _, d := range []struct {
+		name  string
+		value string
+		dst   *time.Duration
+	}{{"interval", h.Interval, &hc.Interval}, {"timeout", h.Timeout, &hc.Timeout}} {
+		if d.value == "" {
+			continue
 		}
-		log.Info("service added via API", "name", svc.Name, "domain", svc.Domain, "upstream", svc.Upstream)
-		w.WriteHeader(http.StatusCreated)
-		fmt.Fprintf(w, "added %s → %s\n", svc.Domain, svc.Upstream)
+		v, err := time.ParseDuration(d.value)
+		if err != nil {
+			return nil, fmt.Errorf("health_check: invalid %s: %w", d.name, err)
+		}
+		*d.dst = v
+	}
+	if err := registry.ValidateHealthCheck(hc); err != nil {
+		return nil, err
 	}
+	return hc, nil
 }
 
-func handleRemoveService(reg *registry.Registry, log *slog.Logger) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		name := r.PathValue("name")
-		if err := reg.Remove(name); err != nil {
-			http.Error(w, err.Error(), http.StatusNotFound)
-			return
+type aliasRequest struct {
+	Domain     string `json:"domain"`
+	PathPrefix string `json:"path_prefix"`
+	Host       string `json:"host"`
+}
+
+type cacheRequest struct {
+	BypassCookies  []string `json:"bypass_cookies"`
+	BypassHeaders  []string `json:"bypass_headers"`
+	PrivateHeaders []string `json:"private_headers"`
+	Authenticated  bool     `json:"authenticated"`
+}
+
+type mountRequest struct {
+	PathPrefix   string `json:"path_prefix"`
+	UpstreamPath string `json:"upstream_path"`
+}
+
+type tlsRequest struct {
+	MinVersion string `json:"min_version"`
+	ClientCert string `json:"client_cert"` // none, optional or required
+	CertChain  string `json:"cert_chain"`
+	PrivateKey string `json:"private_key"`
+}
+
+func (t *tlsRequest) toRegistry() (*registry.TLSPolicy, error) {
+	policy := &registry.TLSPolicy{
+		MinVersion: t.MinVersion,
+		ClientCert: t.ClientCert,
+		CertChain:  t.CertChain,
+		PrivateKey: t.PrivateKey,
+	}
+	if err := registry.ValidateTLSPolicy(policy); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+type clientCertRequest struct {
+	XFCC    bool              `json:"xfcc"`
+	Headers map[string]string `json:"headers"` // header name → certificate field
+}
+
+// toRegistry orders the headers by name, since JSON objects are unordered,
+// and validates the result.
+func (c *clientCertRequest) toRegistry() (*registry.ClientCert, error) {
+	cc := &registry.ClientCert{XFCC: c.XFCC}
+	for name, field := range c.Headers {
+		cc.Headers = append(cc.Headers, registry.ClientCertHeader{Name: name, Field: field})
+	}
+	sort.Slice(cc.Headers, func(i, j int) bool { return cc.Headers[i].Name < cc.Headers[j].Name })
+	if err := registry.ValidateClientCert(cc); err != nil {
+		return nil, err
+	}
+	return cc, nil
+}
+
+type forwardProxyRequest struct {
+	Allow []string `json:"allow"`
+}
+
+type redirectRequest struct {
+	URL          string `json:"url"`
+	Status       int    `json:"status,omitempty"`
+	PreservePath bool   `json:"preserve_path,omitempty"`
+}
+
+type staticRequest struct {
+	Status      int                 `json:"status,omitempty"`
+	ContentType string              `json:"content_type,omitempty"`
+	Body        string              `json:"body,omitempty"`
+	Files       []staticFileRequest `json:"files,omitempty"`
+}
+
+type staticFileRequest struct {
+	Path        string `json:"path"`
+	ContentType string `json:"content_type,omitempty"`
+	Body        string `json:"body"`
+}
+
+type tcpRequest struct {
+	Ports string `json:"ports"`
+}
+
+type headerRulesRequest struct {
+	Request  headerOpsRequest `json:"request"`
+	Response headerOpsRequest `json:"response"`
+}
+
+type headerOpsRequest struct {
+	Set    map[string]string `json:"set"`
+	Add    map[string]string `json:"add"`
+	Remove []string          `json:"remove"`
+}
+
+// toRegistry converts the JSON form, ordering headers by name since JSON
+// objects are unordered.
+func (h headerOpsRequest) toRegistry() registry.HeaderOps {
+	sorted := func(m map[string]string) []registry.Header {
+		out := make([]registry.Header, 0, len(m))
+		for k, v := range m {
+			out = append(out, registry.Header{Name: k, Value: v})
 		}
-		log.Info("service removed via API", "name", name)
-		fmt.Fprintf(w, "removed %s\n", name)
+		sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+		return out
 	}
+	return registry.HeaderOps{Set: sorted(h.Set), Add: sorted(h.Add), Remove: h.Remove}
 }
 
-func handleListServices(reg *registry.Registry) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		services, version := reg.Snapshot()
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]any{
-			"version":  version,
-			"services": services,
-		})
+type jwtRequest struct {
+	Issuer    string   `json:"issuer"`
+	JWKSURI   string   `json:"jwks_uri"`
+	Audiences []string `json:"audiences"`
+}
+
+// serviceName is what a service may be called: its name ends up in Envoy
+// cluster and stat names, where dots and slashes would be ambiguous.
+var serviceName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*$`)
+
+// toRegistry validates the request and builds the service it describes.
+// Invalid values are reported together, as fieldErrors.
+func (req *serviceRequest) toRegistry() (*registry.Service, error) {
+	var errs fieldErrors
+	switch {
+	case req.Name == "":
+		errs.add("name", errors.New("is required"))
+	case !serviceName.MatchString(req.Name):
+		errs.add("name", fmt.Errorf("%q must be letters, digits, - and _", req.Name))
+	}
+	switch {
+	case req.Domain == "" && req.TCP == nil:
+		errs.add("domain", errors.New("is required"))
+	case req.Domain != "" && req.TCP == nil:
+		if err := registry.ValidateDomain(req.Domain, true); err != nil {
+			errs.add("domain", err)
+		}
+	}
+	switch {
+	case req.Upstream == "" && req.ForwardProxy == nil && req.Redirect == nil && req.Static == nil:
+		errs.add("upstream", errors.New("is required (or forward_proxy, redirect or static)"))
+	case req.Upstream != "":
+		if err := registry.ValidateUpstream(req.Upstream); err != nil {
+			errs.add("upstream", err)
+		}
+	}
+	if req.Failover != "" {
+		if req.ForwardProxy != nil {
+			errs.add("failover", errors.New("forward proxies have no upstream to fail over from"))
+		} else if err := registry.ValidateUpstream(req.Failover); err != nil {
+			errs.add("failover", err)
+		}
+	}
+	users, err := registry.ParseBasicAuth(strings.Join(req.BasicAuth, "\n"))
+	if err != nil {
+		errs.add("basic_auth", err)
+	}
+	if err := registry.ValidateVirtualClusters(req.VirtualClusters); err != nil {
+		errs.add("virtual_clusters", err)
+	}
+	if err := registry.ValidateNodes(req.Nodes); err != nil {
+		errs.add("nodes", err)
+	}
+	// Ordered by node, since JSON objects are unordered.
+	var origins []registry.Origin
+	for node, upstream := range req.Origins {
+		origins = append(origins, registry.Origin{Node: node, Upstream: upstream})
+	}
+	sort.Slice(origins, func(i, j int) bool { return origins[i].Node < origins[j].Node })
+	switch {
+	case len(origins) > 0 && req.ForwardProxy != nil:
+		errs.add("origins", errors.New("forward proxies have no upstream to copy"))
+	case req.Origins[config.HomeNodeID] != "":
+		errs.add("origins", errors.New("the home node serves the upstream itself"))
+	default:
+		if err := registry.ValidateOrigins(origins); err != nil {
+			errs.add("origins", err)
+		}
+	}
+	var jwt *registry.JWT
+	if req.JWT != nil {
+		jwt = &registry.JWT{Issuer: req.JWT.Issuer, JWKSURI: req.JWT.JWKSURI, Audiences: req.JWT.Audiences}
+		if err := registry.ValidateJWT(jwt); err != nil {
+			errs.add("jwt", err)
+		}
+	}
+	var aliases []registry.Alias
+	for _, a := range req.Aliases {
+		aliases = append(aliases, registry.Alias{Domain: a.Domain, PathPrefix: a.PathPrefix, Host: a.Host})
+	}
+	if len(aliases) > 0 && req.ForwardProxy != nil {
+		errs.add("aliases", errors.New("forward proxies have no upstream to map them to"))
+	} else if err := registry.ValidateAliases(req.Domain, aliases); err != nil {
+		errs.add("aliases", err)
+	}
+	var mount *registry.Mount
+	if req.Mount != nil {
+		mount = &registry.Mount{PathPrefix: req.Mount.PathPrefix, UpstreamPath: req.Mount.UpstreamPath}
+		if req.ForwardProxy != nil {
+			errs.add("mount", errors.New("forward proxies have no upstream to mount"))
+		} else if err := registry.ValidateMount(mount, aliases); err != nil {
+			errs.add("mount", err)
+		}
+	}
+	var cache *registry.Cache
+	if req.Cache != nil {
+		cache = &registry.Cache{
+			BypassCookies:  req.Cache.BypassCookies,
+			BypassHeaders:  req.Cache.BypassHeaders,
+			PrivateHeaders: req.Cache.PrivateHeaders,
+			Authenticated:  req.Cache.Authenticated,
+		}
+		if err := registry.ValidateCache(cache); err != nil {
+			errs.add("cache", err)
+		}
+	}
+	var headers *registry.HeaderRules
+	if req.Headers != nil {
+		headers = &registry.HeaderRules{
+			Request:  req.Headers.Request.toRegistry(),
+			Response: req.Headers.Response.toRegistry(),
+		}
+		if err := registry.ValidateHeaderRules(headers); err != nil {
+			errs.add("headers", err)
+		}
+	}
+	var redirect *registry.Redirect
+	if r := req.Redirect; r != nil {
+		redirect = &registry.Redirect{URL: r.URL, Status: r.Status, PreservePath: r.PreservePath}
+	}
+	var static *registry.Static
+	if st := req.Static; st != nil {
+		static = &registry.Static{Status: st.Status, ContentType: st.ContentType, Body: st.Body}
+		for _, f := range st.Files {
+			static.Files = append(static.Files, registry.StaticFile{Path: f.Path, ContentType: f.ContentType, Body: f.Body})
+		}
+	}
+	var forwardProxy *registry.ForwardProxy
+	if req.ForwardProxy != nil {
+		forwardProxy = &registry.ForwardProxy{Allow: req.ForwardProxy.Allow}
+		if err := registry.ValidateForwardProxy(forwardProxy); err != nil {
+			errs.add("forward_proxy", err)
+		}
+	}
+	var healthCheck *registry.HealthCheck
+	if req.HealthCheck != nil {
+		if req.ForwardProxy != nil {
+			errs.add("health_check", errors.New("forward proxies have no upstream to probe"))
+		} else if healthCheck, err = req.HealthCheck.toRegistry(); err != nil {
+			errs.add("health_check", err)
+		}
+	}
+	var concurrency *registry.Concurrency
+	if req.Concurrency != nil {
+		concurrency = &registry.Concurrency{Max: req.Concurrency.Max, Queue: req.Concurrency.Queue}
+		if req.ForwardProxy != nil {
+			errs.add("concurrency", errors.New("forward proxies have no upstream to limit"))
+		} else if err := registry.ValidateConcurrency(concurrency); err != nil {
+			errs.add("concurrency", err)
+		}
+	}
+	var affinity *registry.Affinity
+	if req.Affinity != nil {
+		if req.ForwardProxy != nil {
+			errs.add("affinity", errors.New("forward proxies have no upstream to balance"))
+		} else if affinity, err = req.Affinity.toRegistry(); err != nil {
+			errs.add("affinity", err)
+		}
+	}
+	if req.LBPolicy != "" {
+		if req.ForwardProxy != nil {
+			errs.add("lb_policy", errors.New("forward proxies have no upstream to balance"))
+		} else if err := registry.ValidateLBPolicy(req.LBPolicy, affinity); err != nil {
+			errs.add("lb_policy", err)
+		}
 	}
-}
\ No newline at end of file
+	var dns *registry.DNS
+	if req.DNS != nil {
+		if req.ForwardProxy != nil {
+			errs.add("dns", errors.New("forward proxies resolve the hosts they are asked for"))
+		} else if dns, err = req.DNS.toRegistry(req.Upstream); err != nil {
+			errs.add("dns", err)
+		}
+	}
+	var shadow *registry.Shadow
+	if req.Shadow != nil {
+		shadow = &registry.Shadow{Service: req.Shadow.Service, Percent: req.Shadow.Percent}
+		if shadow.Percent == 0 {
+			shadow.Percent = 100
+		}
+		if req.ForwardProxy != nil {
+			errs.add("shadow", errors.New("forward proxies have no requests to copy"))
+		} else if err := registry.ValidateShadow(req.Name, shadow); err != nil {
+			errs.add("shadow", err)
+		}
+	}
+	var clientCert *registry.ClientCert
+	if req.ClientCert != nil {
+		if clientCert, err = req.ClientCert.toRegistry(); err != nil {
+			errs.add("client_cert", err)
+		}
+	}
+	var tlsPolicy *registry.TLSPolicy
+	if req.TLS != nil {
+		if tlsPolicy, err = req.TLS.toRegistry(); err != nil {
+			errs.add("tls", err)
+		}
+	}
+	var tcp *registry.TCPForward
+	if req.TCP != nil {
+		if tcp, err = registry.ParsePortRange(req.TCP.Ports); err != nil {
+			errs.add("tcp", err)
+		}
+	}
+	if err := registry.ValidateDependsOn(req.Name, req.DependsOn); err != nil {
+		errs.add("depends_on", err)
+	}
+	var wasmFilters []registry.WasmFilter
+	for _, f := range req.Wasm {
+		wf, err := f.toRegistry()
+		if err != nil {
+			errs.add("wasm", err)
+			break
+		}
+		wasmFilters = append(wasmFilters, wf)
+	}
+	if err := registry.ValidateWasm(wasmFilters); err != nil {
+		errs.add("wasm", err)
+	}
+	if err := xds.ValidatePassthrough(&registry.Service{FilterConfig: req.FilterConfig}); err != nil {
+		errs.add("filter_config", err)
+	}
+	if err := xds.ValidatePassthrough(&registry.Service{RouteMetadata: req.RouteMetadata}); err != nil {
+		errs.add("route_metadata", err)
+	}
+	schedule, err := scheduleRules(req.Schedule, req.TCP != nil)
+	if err != nil {
+		errs.add("schedule", err)
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	svc := &registry.Service{
+		Name:            req.Name,
+		Domain:          req.Domain,
+		Upstream:        req.Upstream,
+		Aliases:         aliases,
+		Mount:           mount,
+		Source:          registry.SourceAPI,
+		ExtAuthz:        req.ExtAuthz,
+		BasicAuth:       users,
+		VirtualClusters: req.VirtualClusters,
+		JWT:             jwt,
+		Challenge:       req.Challenge,
+		Headers:         headers,
+		HostRewrite:     req.HostRewrite,
+		ForwardProxy:    forwardProxy,
+		Redirect:        redirect,
+		Static:          static,
+		Namespace:       req.Namespace,
+		RateLimit:       req.RateLimit,
+		MaxBodyBytes:    req.MaxBodyBytes,
+		Streaming:       req.Streaming,
+		Privacy:         req.Privacy,
+		Cache:           cache,
+		Exposure:        req.Exposure,
+		Failover:        req.Failover,
+		Origins:         origins,
+		Nodes:           req.Nodes,
+		HealthCheck:     healthCheck,
+		Concurrency:     concurrency,
+		Affinity:        affinity,
+		LBPolicy:        req.LBPolicy,
+		DNS:             dns,
+		Shadow:          shadow,
+		ClientCert:      clientCert,
+		TLS:             tlsPolicy,
+		TCP:             tcp,
+		Schedule:        schedule,
+		DependsOn:       req.DependsOn,
+		Wasm:            wasmFilters,
+		FilterConfig:    req.FilterConfig,
+		RouteMetadata:   req.RouteMetadata,
+	}
+	if err := registry.ValidateTCP(svc); err != nil {
+		return nil, fieldErrors{{Field: "tcp", Message: err.Error()}}
+	}
+	if err := registry.ValidateRedirect(svc); err != nil {
+		return nil, fieldErrors{{Field: "redirect", Message: err.Error()}}
+	}
+	if err := registry.ValidateStatic(svc); err != nil {
+		return nil, fieldErrors{{Field: "static", Message: err.Error()}}
+	}
+	if err := registry.ValidateHostRewrite(svc); err != nil {
+		return nil, fieldErrors{{Field: "host_rewrite", Message: err.Error()}}
+	}
+	return svc, nil
+}
+
+// decodeServiceFile reads a service definition of the file provider: the
+// body of POST /services, with unknown fields rejected to catch typos.
+func decodeServiceFile(data []byte) (*registry.Service, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	var req serviceRequest
+	if err := dec.Decode(&req); err != nil {
+		return nil, err
+	}
+	return req.toRegistry()
+}
+
+func handleAddService(reg *registry.Registry, xdsServer *xds.Server, log *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dryRun, err := dryRunOf(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		var req serviceRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid json: "+err.Error())
+			return
+		}
+		svc, err := req.toRegistry()
+		if err != nil {
+			writeRequestError(w, err)
+			return
+		}
+		ctx := registry.WithComment(r.Context(), req.Comment)
+		if dryRun {
+			ctx = registry.WithDryRun(ctx)
+		}
+		if err := reg.Add(ctx, svc); err != nil {
+			writeRegistryError(w, err)
+			return
+		}
+		if dryRun {
+			writeDryRun(w, reg, xdsServer, "add", svc.Name, svc)
+			return
+		}
+		log.Info("service added via API", "name", svc.Name, "domain", svc.Domain, "upstream", svc.Upstream)
+		w.WriteHeader(http.StatusCreated)
+		switch {
+		case svc.TCP != nil:
+			fmt.Fprintf(w, "added tcp %s → %s\n", svc.TCP, svc.Upstream)
+		case svc.Redirect != nil:
+			fmt.Fprintf(w, "added %s → redirect to %s\n", svc.Domain, svc.Redirect.URL)
+		case svc.Static != nil:
+			fmt.Fprintf(w, "added %s → static content\n", svc.Domain)
+		default:
+			fmt.Fprintf(w, "added %s → %s\n", svc.Domain, svc.Upstream)
+		}
+	}
+}
+
+// handlePutService creates or replaces a service with the one in the body,
+// which has the same form as POST /services; the name may be left out. It
+// answers 201 or 200 with the stored service, the same for the same body
+// whatever existed before, so provisioning tools can apply desired state
+// without looking first. Maintenance mode, share links, the canary, a
+// switch and the mirror are managed by their own endpoints and kept.
+// Replacing a service another source registered takes it over if
+// cfg.Sources allows it, and answers 409 otherwise.
+func handlePutService(reg *registry.Registry, xdsServer *xds.Server, log *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		dryRun, err := dryRunOf(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		var req serviceRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid json: "+err.Error())
+			return
+		}
+		if req.Name == "" {
+			req.Name = name
+		}
+		if req.Name != name {
+			writeRequestError(w, fieldErrors{{Field: "name", Message: fmt.Sprintf("%q does not match %q in the path", req.Name, name)}})
+			return
+		}
+		svc, err := req.toRegistry()
+		if err != nil {
+			writeRequestError(w, err)
+			return
+		}
+		ctx := registry.WithComment(r.Context(), req.Comment)
+		if dryRun {
+			ctx = registry.WithDryRun(ctx)
+		}
+		var stored registry.Service
+		op, err := reg.Upsert(ctx, name, func(existing *registry.Service) error {
+			// Upsert hands over a zero Service when there is none.
+			cur := existing
+			if existing.Name == "" {
+				cur = nil
+			}
+			if err := checkIfMatch(r, cur); err != nil {
+				return err
+			}
+			svc.Maintenance = existing.Maintenance
+			svc.MaintenancePage = existing.MaintenancePage
+			svc.ShareLinks = existing.ShareLinks
+			svc.Canary = existing.Canary
+			svc.Switch = existing.Switch
+			svc.Mirror = existing.Mirror
+			svc.Waiting = existing.Waiting
+			*existing = *svc
+			stored = *svc
+			return nil
+		})
+		if err != nil {
+			writeRegistryError(w, err)
+			return
+		}
+		if dryRun {
+			writeDryRun(w, reg, xdsServer, op, name, &stored)
+			return
+		}
+		status := http.StatusOK
+		switch op {
+		case "add":
+			status = http.StatusCreated
+			log.Info("service added via API", "name", name, "domain", svc.Domain, "upstream", svc.Upstream)
+		case "update":
+			log.Info("service replaced via API", "name", name, "domain", svc.Domain, "upstream", svc.Upstream)
+		}
+		writeService(w, status, &stored)
+	}
+}
+
+// handlePatchService applies a JSON merge patch to a service; see patch.go.
+// Maintenance, share links, the canary, a switch and the mirror are kept,
+// as with PUT.
+func handlePatchService(reg *registry.Registry, xdsServer *xds.Server, log *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		dryRun, err := dryRunOf(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		patch, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "reading body: "+err.Error())
+			return
+		}
+		var meta struct {
+			Comment string `json:"comment"`
+		}
+		if err := json.Unmarshal(patch, &meta); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid json: "+err.Error())
+			return
+		}
+
+		ctx := registry.WithComment(r.Context(), meta.Comment)
+		if dryRun {
+			ctx = registry.WithDryRun(ctx)
+		}
+		var stored registry.Service
+		err = reg.Modify(ctx, name, func(svc *registry.Service) error {
+			if err := checkIfMatch(r, svc); err != nil {
+				return err
+			}
+			if err := patchService(svc, patch); err != nil {
+				return err
+			}
+			stored = *svc
+			return nil
+		})
+		if err != nil {
+			var fe fieldErrors
+			if errors.As(err, &fe) || errors.Is(err, errBadPatch) {
+				writeRequestError(w, err)
+			} else {
+				writeRegistryError(w, err)
+			}
+			return
+		}
+		if dryRun {
+			writeDryRun(w, reg, xdsServer, "update", name, &stored)
+			return
+		}
+		log.Info("service patched via API", "name", name, "domain", stored.Domain, "upstream", stored.Upstream)
+		writeService(w, http.StatusOK, &stored)
+	}
+}
+
+// handleGetService returns one service, with its ETag for If-Match.
+func handleGetService(reg *registry.Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		svc, ok := reg.Get(name)
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("service %q not found", name))
+			return
+		}
+		writeService(w, http.StatusOK, svc)
+	}
+}
+
+// writeService sends {"service": svc} with the service's ETag.
+func writeService(w http.ResponseWriter, status int, svc *registry.Service) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", serviceETag(svc))
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{"service": svc})
+}
+
+func handleRemoveService(reg *registry.Registry, xdsServer *xds.Server, log *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		dryRun, err := dryRunOf(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		ctx := registry.WithComment(r.Context(), r.URL.Query().Get("comment"))
+		if dryRun {
+			ctx = registry.WithDryRun(ctx)
+		}
+		if err := reg.Remove(ctx, name); err != nil {
+			writeRegistryError(w, err)
+			return
+		}
+		if dryRun {
+			writeDryRun(w, reg, xdsServer, "remove", name, nil)
+			return
+		}
+		log.Info("service removed via API", "name", name)
+		fmt.Fprintf(w, "removed %s\n", name)
+	}
+}
+
+type maintenanceRequest struct {
+	// Page replaces the maintenance page, as HTML, and RetryAfter its
+	// Retry-After, e.g. "15m". Left out, the previous ones are kept.
+	Page       *string `json:"page"`
+	RetryAfter string  `json:"retry_after"`
+	Comment    string  `json:"comment"`
+}
+
+// handleStartMaintenance puts a service in maintenance mode: every node
+// answers its requests with a 503 page, but it stays registered. The body
+// is optional.
+func handleStartMaintenance(reg *registry.Registry, log *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		var req maintenanceRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			writeError(w, http.StatusBadRequest, "invalid json: "+err.Error())
+			return
+		}
+		var retryAfter time.Duration
+		if req.RetryAfter != "" {
+			d, err := time.ParseDuration(req.RetryAfter)
+			if err != nil {
+				writeRequestError(w, fieldErrors{{Field: "retry_after", Message: "must be a duration such as \"15m\""}})
+				return
+			}
+			retryAfter = d
+		}
+
+		err := reg.Modify(registry.WithComment(r.Context(), req.Comment), name, func(svc *registry.Service) error {
+			if svc.TCP != nil {
+				return fmt.Errorf("%w: TCP forwards have no page to show", registry.ErrInvalid)
+			}
+			var page registry.MaintenancePage
+			if svc.MaintenancePage != nil {
+				page = *svc.MaintenancePage
+			}
+			if req.Page != nil {
+				page.Body = *req.Page
+			}
+			if req.RetryAfter != "" {
+				page.RetryAfter = retryAfter
+			}
+			if err := registry.ValidateMaintenancePage(&page); err != nil {
+				return fmt.Errorf("%w: %w", registry.ErrInvalid, err)
+			}
+			svc.Maintenance = true
+			svc.MaintenancePage = nil
+			if page != (registry.MaintenancePage{}) {
+				svc.MaintenancePage = &page
+			}
+			return nil
+		})
+		if err != nil {
+			writeRegistryError(w, err)
+			return
+		}
+		log.Info("maintenance mode on via API", "name", name)
+		fmt.Fprintf(w, "%s: maintenance mode on\n", name)
+	}
+}
+
+// handleEndMaintenance takes a service out of maintenance mode.
+func handleEndMaintenance(reg *registry.Registry, log *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		ctx := registry.WithComment(r.Context(), r.URL.Query().Get("comment"))
+		if err := reg.Modify(ctx, name, func(svc *registry.Service) error {
+			svc.Maintenance = false
+			return nil
+		}); err != nil {
+			writeRegistryError(w, err)
+			return
+		}
+		log.Info("maintenance mode off via API", "name", name)
+		fmt.Fprintf(w, "%s: maintenance mode off\n", name)
+	}
+}
+
+type switchRequest struct {
+	Upstream string `json:"upstream"`
+
+	// From, if set, must be the current upstream, or nothing is switched:
+	// a deploy script's guard against switching from the wrong color.
+	From string `json:"from,omitempty"`
+
+	// RollbackAfter, e.g. "2m", watches the service that long and
+	// switches back if it turns unhealthy. Empty switches for good.
+	RollbackAfter string `json:"rollback_after,omitempty"`
+
+	Comment string `json:"comment"`
+}
+
+// errSwitchFrom refuses a switch whose from is no longer the upstream.
+var errSwitchFrom = errors.New("upstream is not the one to switch from")
+
+// handleSwitch repoints a service at another upstream in one change, for a
+// blue/green deploy: start green next to blue, then switch. With
+// rollback_after, the switch is watched (see canary.Switcher) and undone if
+// the service turns unhealthy in time. A service with a canary can't be
+// switched; finish or remove the canary first.
+func handleSwitch(reg *registry.Registry, statsInterval time.Duration, log *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		var req switchRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid json: "+err.Error())
+			return
+		}
+		var errs fieldErrors
+		if err := registry.ValidateUpstream(req.Upstream); err != nil {
+			errs.add("upstream", err)
+		}
+		var window time.Duration
+		if req.RollbackAfter != "" {
+			d, err := time.ParseDuration(req.RollbackAfter)
+			minWindow := (canary.SettleScrapes + 1) * statsInterval
+			switch {
+			case err != nil:
+				errs.add("rollback_after", errors.New("must be a duration such as \"2m\""))
+			case d < minWindow:
+				errs.add("rollback_after", fmt.Errorf("must be at least %s, %d stats intervals", minWindow, canary.SettleScrapes+1))
+			}
+			window = d
+		}
+		if len(errs) > 0 {
+			writeRequestError(w, errs)
+			return
+		}
+
+		var from string
+		now := time.Now().UTC()
+		ctx := registry.WithComment(r.Context(), req.Comment)
+		err := reg.Modify(ctx, name, func(svc *registry.Service) error {
+			switch {
+			case svc.ForwardProxy != nil:
+				return fmt.Errorf("%w: forward proxy services have no upstream to switch", registry.ErrInvalid)
+			case svc.AnsweredByEnvoy():
+				return fmt.Errorf("%w: redirect and static services have no upstream to switch", registry.ErrInvalid)
+			case svc.Canary != nil:
+				return fmt.Errorf("%w: the service has a canary; remove or promote it first", registry.ErrInvalid)
+			case svc.Upstream == req.Upstream:
+				return fmt.Errorf("%w: upstream is %s already", registry.ErrInvalid, req.Upstream)
+			case req.From != "" && svc.Upstream != req.From:
+				return fmt.Errorf("%w: it is %s", errSwitchFrom, svc.Upstream)
+			}
+			from = svc.Upstream
+			svc.Upstream = req.Upstream
+			svc.Switch = nil
+			if window > 0 {
+				svc.Switch = &registry.Switch{From: from, To: req.Upstream, At: now, Until: now.Add(window)}
+			}
+			return nil
+		})
+		if errors.Is(err, errSwitchFrom) {
+			writeError(w, http.StatusConflict, err.Error())
+			return
+		}
+		if err != nil {
+			writeRegistryError(w, err)
+			return
+		}
+		log.Info("upstream switched via API", "name", name, "from", from, "to", req.Upstream, "rollback_after", window)
+		if window > 0 {
+			fmt.Fprintf(w, "%s: %s → %s, switched back if unhealthy until %s\n", name, from, req.Upstream, now.Add(window).Format(time.RFC3339))
+			return
+		}
+		fmt.Fprintf(w, "%s: %s → %s\n", name, from, req.Upstream)
+	}
+}
+
+type canaryRequest struct {
+	Upstream string `json:"upstream"`
+	Weight   int    `json:"weight"`
+
+	// Analysis, if set, moves the weight automatically, e.g.
+	// {"step": 10, "interval": "5m", "min_requests": 50,
+	//  "max_error_rate_increase": 0.01, "max_latency_ratio": 1.5}.
+	Analysis *struct {
+		Step                 int     `json:"step"`
+		Interval             string  `json:"interval"`
+		MinRequests          uint64  `json:"min_requests"`
+		MaxErrorRateIncrease float64 `json:"max_error_rate_increase"`
+		MaxLatencyRatio      float64 `json:"max_latency_ratio"`
+	} `json:"analysis,omitempty"`
+
+	Comment string `json:"comment"`
+}
+
+// handleSetCanary starts a canary or changes its weight or thresholds.
+func handleSetCanary(reg *registry.Registry, log *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		var req canaryRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid json: "+err.Error())
+			return
+		}
+		canary := &registry.Canary{Upstream: req.Upstream, Weight: req.Weight}
+		if a := req.Analysis; a != nil {
+			interval, err := time.ParseDuration(a.Interval)
+			if err != nil {
+				writeRequestError(w, fieldErrors{{Field: "analysis.interval", Message: "must be a duration such as \"5m\""}})
+				return
+			}
+			canary.Analysis = &registry.CanaryAnalysis{
+				Step:                 a.Step,
+				Interval:             interval,
+				MinRequests:          a.MinRequests,
+				MaxErrorRateIncrease: a.MaxErrorRateIncrease,
+				MaxLatencyRatio:      a.MaxLatencyRatio,
+			}
+		}
+		if err := registry.ValidateCanary(canary); err != nil {
+			writeRequestError(w, fieldErrors{{Field: "canary", Message: err.Error()}})
+			return
+		}
+
+		err := reg.Modify(registry.WithComment(r.Context(), req.Comment), name, func(svc *registry.Service) error {
+			switch {
+			case svc.ForwardProxy != nil:
+				return fmt.Errorf("%w: forward proxy services have no upstream to canary", registry.ErrInvalid)
+			case svc.AnsweredByEnvoy():
+				return fmt.Errorf("%w: redirect and static services have no upstream to canary", registry.ErrInvalid)
+			}
+			svc.Canary = canary
+			return nil
+		})
+		if err != nil {
+			writeRegistryError(w, err)
+			return
+		}
+		log.Info("canary set via API", "name", name, "upstream", canary.Upstream, "weight", canary.Weight)
+		fmt.Fprintf(w, "%s: %d%% → %s\n", name, canary.Weight, canary.Upstream)
+	}
+}
+
+// handleRemoveCanary ends a canary, sending all traffic back to the stable
+// upstream.
+func handleRemoveCanary(reg *registry.Registry, log *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		ctx := registry.WithComment(r.Context(), r.URL.Query().Get("comment"))
+		if err := reg.Modify(ctx, name, func(svc *registry.Service) error {
+			svc.Canary = nil
+			return nil
+		}); err != nil {
+			writeRegistryError(w, err)
+			return
+		}
+		log.Info("canary removed via API", "name", name)
+		fmt.Fprintf(w, "removed canary of %s\n", name)
+	}
+}
+
+type mirrorRequest struct {
+	Target  string  `json:"target"`
+	Percent float64 `json:"percent"` // defaults to 100
+	For     string  `json:"for"`     // how long to mirror, e.g. "2h"; defaults to 1h
+	Comment string  `json:"comment"`
+}
+
+// handleSetMirror starts copying a service's requests to an analysis tool,
+// or changes the copy, until it expires.
+func handleSetMirror(reg *registry.Registry, log *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		var req mirrorRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid json: "+err.Error())
+			return
+		}
+		duration := time.Hour
+		if req.For != "" {
+			d, err := time.ParseDuration(req.For)
+			if err != nil || d <= 0 {
+				writeRequestError(w, fieldErrors{{Field: "for", Message: "must be a positive duration such as \"2h\""}})
+				return
+			}
+			duration = d
+		}
+		mirror := &registry.Mirror{Target: req.Target, Percent: req.Percent, Expires: time.Now().Add(duration).UTC().Truncate(time.Second)}
+		if mirror.Percent == 0 {
+			mirror.Percent = 100
+		}
+		if err := registry.ValidateMirror(mirror); err != nil {
+			writeRequestError(w, fieldErrors{{Field: "mirror", Message: err.Error()}})
+			return
+		}
+
+		err := reg.Modify(registry.WithComment(r.Context(), req.Comment), name, func(svc *registry.Service) error {
+			switch {
+			case svc.TCP != nil:
+				return fmt.Errorf("%w: TCP forwards can't be mirrored", registry.ErrInvalid)
+			case svc.ForwardProxy != nil:
+				return fmt.Errorf("%w: forward proxy services can't be mirrored", registry.ErrInvalid)
+			case svc.AnsweredByEnvoy():
+				return fmt.Errorf("%w: redirect and static services can't be mirrored", registry.ErrInvalid)
+			}
+			svc.Mirror = mirror
+			return nil
+		})
+		if err != nil {
+			writeRegistryError(w, err)
+			return
+		}
+		log.Info("mirror set via API", "name", name, "target", mirror.Target, "percent", mirror.Percent, "expires", mirror.Expires)
+		fmt.Fprintf(w, "%s: %g%% → %s until %s\n", name, mirror.Percent, mirror.Target, mirror.Expires.Format(time.RFC3339))
+	}
+}
+
+// handleRemoveMirror stops mirroring a service before its mirror expires.
+func handleRemoveMirror(reg *registry.Registry, log *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		ctx := registry.WithComment(r.Context(), r.URL.Query().Get("comment"))
+		if err := reg.Modify(ctx, name, func(svc *registry.Service) error {
+			svc.Mirror = nil
+			return nil
+		}); err != nil {
+			writeRegistryError(w, err)
+			return
+		}
+		log.Info("mirror removed via API", "name", name)
+		fmt.Fprintf(w, "removed mirror of %s\n", name)
+	}
+}
+
+// handleServiceHealth reports why a service's upstream is failing, per node,
+// based on the failure counters pulled from each Envoy.
+func handleServiceHealth(reg *registry.Registry, scraper *stats.Scraper) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		if _, ok := reg.Get(name); !ok {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("service %q not found", name))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"service": name,
+			"nodes":   scraper.Health(name),
+		})
+	}
+}
+
+// handleServiceStats returns a service's traffic per node and, in total,
+// the busiest node's; see stats.Busiest. ?series=true adds the recent
+// samples of its counters per node, oldest first, stats.series of them.
+func handleServiceStats(reg *registry.Registry, scraper *stats.Scraper) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		if _, ok := reg.Get(name); !ok {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("service %q not found", name))
+			return
+		}
+		series, _ := strconv.ParseBool(r.URL.Query().Get("series"))
+		nodes := scraper.Traffic(name)
+		resp := map[string]any{
+			"service": name,
+			"total":   stats.Busiest(nodes),
+			"nodes":   nodes,
+		}
+		if series {
+			resp["series"] = scraper.Series(name)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// handleServiceTraces lists a service's recent slow and failed requests,
+// newest first. Without Envoy tracing the list is always empty.
+func handleServiceTraces(reg *registry.Registry, exemplars *tracing.Exemplars) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		if _, ok := reg.Get(name); !ok {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("service %q not found", name))
+			return
+		}
+		traces := []tracing.Exemplar{}
+		if exemplars != nil {
+			traces = exemplars.Recent(name)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"service": name,
+			"enabled": exemplars != nil,
+			"traces":  traces,
+		})
+	}
+}
+
+// historyPoints is about how many points a history query returns when it
+// doesn't ask for a step.
+const historyPoints = 240
+
+// handleServiceHistory returns a service's traffic history over
+// ?range=DURATION (default 24h) in buckets of ?step=DURATION, which is
+// rounded up to a multiple of history.step and defaults to about
+// historyPoints buckets.
+func handleServiceHistory(reg *registry.Registry, history *tsdb.DB, cfg config.History) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		if _, ok := reg.Get(name); !ok {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("service %q not found", name))
+			return
+		}
+		span := 24 * time.Hour
+		if s := r.URL.Query().Get("range"); s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil || d <= 0 {
+				writeError(w, http.StatusBadRequest, "range must be a positive duration, e.g. 6h")
+				return
+			}
+			span = min(d, cfg.Retention)
+		}
+		step := span / historyPoints
+		if s := r.URL.Query().Get("step"); s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil || d <= 0 {
+				writeError(w, http.StatusBadRequest, "step must be a positive duration, e.g. 5m")
+				return
+			}
+			step = d
+		}
+		step = max(cfg.Step, (step+cfg.Step-1)/cfg.Step*cfg.Step)
+
+		to := time.Now()
+		from := to.Add(-span)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"service":      name,
+			"from":         from,
+			"to":           to,
+			"step_seconds": step.Seconds(),
+			"points":       history.Query(name, from, to, step),
+		})
+	}
+}
+
+func handleListServices(reg *registry.Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		services, version := reg.Snapshot()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"version":  version,
+			"services": services,
+		})
+	}
+}
+
+// handleListChanges returns the change history, oldest first, optionally
+// filtered with ?service=NAME.
+func handleListChanges(reg *registry.Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"changes": reg.History(r.URL.Query().Get("service")),
+		})
+	}
+}
+
+// handleLint runs the lint pass on the live registry, including upstream
+// health from the latest stats and the DNS check, if on.
+func handleLint(cfg *config.Config, reg *registry.Registry, scraper *stats.Scraper, dnsChecker *dnscheck.Checker, wasmStore *wasm.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		services, _ := reg.Snapshot()
+		var dns lint.DNS
+		if dnsChecker != nil {
+			dns = dnsChecker.Result
+		}
+		findings := lint.Run(cfg, services, scraper.Health, dns, wasmStore.Has)
+		if findings == nil {
+			findings = []lint.Finding{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"findings": findings,
+		})
+	}
+}
+
+// handleDNSCheck lists the last DNS check of every public service, or
+// answers 404 if dns_check is not configured.
+func handleDNSCheck(dnsChecker *dnscheck.Checker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if dnsChecker == nil {
+			writeError(w, http.StatusNotFound, "dns_check is not configured")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"results": dnsChecker.Results(),
+		})
+	}
+}
+
+func handleListNodes(xdsServer *xds.Server, usageStore *usage.Store, scraper *stats.Scraper) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		type nodeInfo struct {
+			ID      string         `json:"id"`
+			Profile string         `json:"profile"`
+			Dynamic bool           `json:"dynamic"`
+			Staging bool           `json:"staging,omitempty"`
+			Sync    xds.SyncStatus `json:"sync"`
+			Usage   *usage.Report  `json:"usage,omitempty"` // nil until its agent reports
+
+			// HomeReachable is whether an edge's probes reach home; nil
+			// without fallback probing or before the first scrape.
+			HomeReachable *bool `json:"home_reachable,omitempty"`
+		}
+		var out []nodeInfo
+		for _, n := range xdsServer.Nodes() {
+			info := nodeInfo{ID: n.ID, Profile: n.Profile.Name, Dynamic: n.Dynamic, Staging: n.Staging, Sync: xdsServer.Sync(n.ID)}
+			if u, ok := usageStore.Latest(n.ID); ok {
+				info.Usage = &u
+			}
+			if reachable, known := scraper.HomeReachable(n.ID); known {
+				info.HomeReachable = &reachable
+			}
+			out = append(out, info)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"nodes": out,
+		})
+	}
+}
+
+// handleAddNode registers an Envoy at runtime, e.g.
+// {"id": "envoyage-envoy-vps-fra", "profile": "envoy-1.32", "admin": "10.8.0.3:9901"}.
+// It is served as an edge node unless the ID is the home node's. "role":
+// "staging", "http_port"/"https_port" and "ip_family" work as in the config
+// file.
+func handleAddNode(xdsServer *xds.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID        string `json:"id"`
+			Profile   string `json:"profile"`
+			Admin     string `json:"admin"`
+			Role      string `json:"role"`
+			HTTPPort  uint32 `json:"http_port"`
+			HTTPSPort uint32 `json:"https_port"`
+			IPFamily  string `json:"ip_family"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid json: "+err.Error())
+			return
+		}
+		var errs fieldErrors
+		if req.ID == "" {
+			errs.add("id", errors.New("is required"))
+		}
+		if req.Role != "" && req.Role != config.NodeRoleStaging {
+			errs.add("role", errors.New("must be empty or "+config.NodeRoleStaging))
+		}
+		if req.IPFamily != "" && !slices.Contains(config.IPFamilies, req.IPFamily) {
+			errs.add("ip_family", errors.New("must be one of "+strings.Join(config.IPFamilies, ", ")))
+		}
+		p, err := xds.LookupProfile(req.Profile)
+		if err != nil {
+			errs.add("profile", err)
+		}
+		if len(errs) > 0 {
+			writeRequestError(w, errs)
+			return
+		}
+		node := xds.Node{
+			ID:        req.ID,
+			Profile:   p,
+			Admin:     req.Admin,
+			Staging:   req.Role == config.NodeRoleStaging,
+			HTTPPort:  req.HTTPPort,
+			HTTPSPort: req.HTTPSPort,
+			IPFamily:  req.IPFamily,
+		}
+		if err := xdsServer.AddNode(r.Context(), node); err != nil {
+			status := http.StatusUnprocessableEntity
+			if errors.Is(err, xds.ErrNodeExists) {
+				status = http.StatusConflict
+			}
+			writeError(w, status, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "added node %s (profile %s)\n", req.ID, p.Name)
+	}
+}
+
+// handleRemoveNode stops serving a node registered with POST /nodes.
+func handleRemoveNode(xdsServer *xds.Server, usageStore *usage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		if err := xdsServer.RemoveNode(id); err != nil {
+			status := http.StatusNotFound
+			if errors.Is(err, xds.ErrStaticNode) {
+				status = http.StatusConflict
+			}
+			writeError(w, status, err.Error())
+			return
+		}
+		usageStore.Forget(id)
+		fmt.Fprintf(w, "removed node %s\n", id)
+	}
+}
+
+// handleReportUsage receives a sample from a node's envoyage-agent.
+func handleReportUsage(xdsServer *xds.Server, usageStore *usage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		if !slices.ContainsFunc(xdsServer.Nodes(), func(n xds.Node) bool { return n.ID == id }) {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("node %q not found", id))
+			return
+		}
+		var report usage.Report
+		if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid json: "+err.Error())
+			return
+		}
+		if err := report.Validate(); err != nil {
+			writeError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		usageStore.Record(id, report)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleStaticConfig serves the break-glass static bootstrap for one node.
+// Fetch these while the control plane is healthy (envoyagectl export-static)
+// so they are on hand when it is not.
+func handleStaticConfig(xdsServer *xds.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		out, err := xdsServer.StaticConfig(r.PathValue("id"))
+		if err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/yaml")
+		w.Write(out)
+	}
+}
+
+// handleExportSnapshot returns the snapshot a node is being served, for
+// offline inspection or a later PUT. ?redact=true replaces secrets, as in a
+// support bundle, for sharing; a redacted export can't be imported.
+func handleExportSnapshot(cfg *config.Config, reg *registry.Registry, xdsServer *xds.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		f, err := xdsServer.ExportSnapshot(id)
+		if err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		redact, _ := strconv.ParseBool(r.URL.Query().Get("redact"))
+		f.Redacted = redact
+
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(f); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		out := buf.String()
+		if redact {
+			services, _ := reg.Snapshot()
+			out = support.Redactor(support.Secrets(cfg, services, reg.History(""))).Replace(out)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", id+"-"+f.Version+".json"))
+		io.WriteString(w, out)
+	}
+}
+
+// handleImportSnapshot pins a node to a snapshot exported with GET, until
+// DELETE releases it; see xds.ImportSnapshot.
+func handleImportSnapshot(xdsServer *xds.Server, log *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		var f xds.SnapshotFile
+		if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid json: "+err.Error())
+			return
+		}
+		version, err := xdsServer.ImportSnapshot(r.Context(), id, &f)
+		if err != nil {
+			status := http.StatusUnprocessableEntity
+			if errors.Is(err, xds.ErrNodeNotFound) {
+				status = http.StatusNotFound
+			}
+			writeError(w, status, err.Error())
+			return
+		}
+		log.Warn("snapshot imported via API", "node", id, "exported", f.Exported, "version", version)
+		fmt.Fprintf(w, "node %s pinned to snapshot %s; DELETE /nodes/%s/snapshot to release it\n", id, version, id)
+	}
+}
+
+// handleReleaseSnapshot sends a pinned node the live snapshot again.
+func handleReleaseSnapshot(xdsServer *xds.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		if err := xdsServer.ReleaseSnapshot(r.Context(), id); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, xds.ErrNotPinned) {
+				status = http.StatusConflict
+			}
+			writeError(w, status, err.Error())
+			return
+		}
+		fmt.Fprintf(w, "released node %s\n", id)
+	}
+}
+
+// handleBootstrap serves the bootstrap a node starts Envoy with, so adding an
+// edge is POST /nodes followed by
+//
+//	curl -o bootstrap.yaml http://controlplane:8080/nodes/<id>/bootstrap
+//
+// ?xds=host:port overrides config.Bootstrap.XDSAddress, ?admin_port= the
+// admin port, and ?format=json returns JSON instead of YAML.
+func handleBootstrap(xdsServer *xds.Server, cfg config.Bootstrap, st config.Stats) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		opts := xds.BootstrapOptions{XDSAddress: cfg.XDSAddress}
+		if st.Source == config.StatsSourceMetricsService {
+			opts.MetricsInterval = st.Interval
+		}
+		if v := q.Get("xds"); v != "" {
+			opts.XDSAddress = v
+		}
+		if v := q.Get("admin_port"); v != "" {
+			port, err := strconv.ParseUint(v, 10, 16)
+			if err != nil || port == 0 {
+				writeError(w, http.StatusBadRequest, "admin_port must be a port number")
+				return
+			}
+			opts.AdminPort = uint32(port)
+		}
+
+		bs, err := xdsServer.Bootstrap(r.PathValue("id"), opts)
+		if errors.Is(err, xds.ErrNodeNotFound) {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		switch q.Get("format") {
+		case "", "yaml":
+			out, err := xds.MarshalYAML(bs)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			w.Header().Set("Content-Type", "application/yaml")
+			w.Write(out)
+		case "json":
+			out, err := protojson.MarshalOptions{UseProtoNames: true, Multiline: true}.Marshal(bs)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(out)
+		default:
+			writeError(w, http.StatusBadRequest, "format must be yaml or json")
+		}
+	}
+}
+
+// handleDiagnostics reports problems with what the watchers read, which
+// lint can't see since the services never registered: the envoyage.*
+// labels docker.strict_labels flags on running containers, and whether
+// each of docker.hosts is reachable.
+func handleDiagnostics(watcher *docker.Watcher, hostWatchers []*docker.Watcher, cfg config.Docker) http.HandlerFunc {
+	type labels struct {
+		Strict   bool                  `json:"strict"`
+		Schema   int                   `json:"schema"`
+		Problems []docker.LabelProblem `json:"problems"`
+	}
+	type dockerHost struct {
+		Name      string `json:"name"`
+		Connected bool   `json:"connected"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp := struct {
+			Labels      labels       `json:"labels"`
+			DockerHosts []dockerHost `json:"docker_hosts"`
+		}{labels{Strict: cfg.StrictLabels, Schema: docker.LabelSchema, Problems: []docker.LabelProblem{}}, []dockerHost{}}
+		if watcher != nil {
+			resp.Labels.Problems = append(resp.Labels.Problems, watcher.LabelProblems()...)
+		}
+		for _, hw := range hostWatchers {
+			resp.Labels.Problems = append(resp.Labels.Problems, hw.LabelProblems()...)
+			resp.DockerHosts = append(resp.DockerHosts, dockerHost{Name: hw.Host(), Connected: hw.Connected()})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// handleHealthz is the liveness probe: the process is up and serving HTTP.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// handleReadyz is the readiness probe. It answers 503 until every check
+// passes, with the failing checks in the body:
+//
+//   - seed:   the initial snapshots were built
+//   - xds:    the gRPC listener is accepting Envoy connections
+//   - docker: the watcher reached the daemon (skipped when running without
+//     a watcher, i.e. manual API only)
+//   - kubernetes: the Ingress watcher's last list succeeded (skipped
+//     without one)
+//   - subsystems: every background loop is running, not waiting to be
+//     restarted by the supervisor (details under "subsystems")
+//
+// A standby of an HA group is ready once it serves xDS; the watchers only
+// run on the leader, so their checks are skipped. "ha" tells the two apart.
+func handleReadyz(xdsServer *xds.Server, watcher *docker.Watcher, kubeWatcher *kube.Watcher, sup *supervisor.Supervisor, haInstance *ha.Instance) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		checks := map[string]string{"seed": "ok", "xds": "ok", "docker": "ok", "kubernetes": "ok", "subsystems": "ok"}
+		if !xdsServer.Seeded() {
+			checks["seed"] = "initial snapshot not built"
+		}
+		if !xdsServer.Listening() {
+			checks["xds"] = "gRPC listener not up"
+		}
+		standby := haInstance != nil && !haInstance.IsLeader()
+		switch {
+		case watcher == nil, standby:
+			checks["docker"] = "skipped"
+		case !watcher.Connected():
+			checks["docker"] = "not connected to the Docker daemon"
+		}
+		switch {
+		case kubeWatcher == nil, standby:
+			checks["kubernetes"] = "skipped"
+		case !kubeWatcher.Connected():
+			checks["kubernetes"] = "cannot list ingresses"
+		}
+		subsystems := sup.Status()
+		var down []string
+		for name, st := range subsystems {
+			if !st.Up {
+				down = append(down, name)
+			}
+		}
+		if len(down) > 0 {
+			sort.Strings(down)
+			checks["subsystems"] = "restarting: " + strings.Join(down, ", ")
+		}
+
+		status := http.StatusOK
+		for _, v := range checks {
+			if v != "ok" && v != "skipped" {
+				status = http.StatusServiceUnavailable
+			}
+		}
+		resp := map[string]any{
+			"ready":      status == http.StatusOK,
+			"checks":     checks,
+			"subsystems": subsystems,
+		}
+		if haInstance != nil {
+			resp["ha"] = map[string]any{
+				"id":        haInstance.ID(),
+				"leader":    haInstance.IsLeader(),
+				"leader_id": haInstance.Leader(),
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// handleSupportBundle returns a gzipped tarball of everything worth
+// attaching to a bug report, with secrets redacted:
+//
+//   - config.yaml:            the effective config, defaults filled in
+//   - services.json:          the registry, as GET /services
+//   - changes.json:           the change history, as GET /changes
+//   - nodes.json:             node status, sync and usage, as GET /nodes
+//   - snapshots/<node>.yaml:  each node's current snapshot as a bootstrap
+//   - lint.json, readyz.json,
+//     diagnostics.json:       diagnostics
+//   - metrics.txt:            GET /metrics
+//   - control-plane.log:      the most recent log lines
+//   - build.txt:              the control plane's build info
+func handleSupportBundle(cfg *config.Config, reg *registry.Registry, xdsServer *xds.Server, api http.Handler, logs *support.LogRing) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		services, _ := reg.Snapshot()
+		b := support.NewBundle(support.Secrets(cfg, services, reg.History("")))
+
+		b.Add("build.txt", func() ([]byte, error) {
+			info, ok := debug.ReadBuildInfo()
+			if !ok {
+				return nil, errors.New("no build info")
+			}
+			return []byte(info.String()), nil
+		})
+		b.Add("config.yaml", func() ([]byte, error) { return yaml.Marshal(cfg) })
+		b.Add("services.json", support.API(api, "/services"))
+		b.Add("changes.json", support.API(api, "/changes"))
+		b.Add("nodes.json", support.API(api, "/nodes"))
+		for _, n := range xdsServer.Nodes() {
+			b.Add("snapshots/"+n.ID+".yaml", func() ([]byte, error) { return xdsServer.StaticConfig(n.ID) })
+		}
+		b.Add("lint.json", support.API(api, "/lint"))
+		b.Add("readyz.json", support.API(api, "/readyz"))
+		b.Add("diagnostics.json", support.API(api, "/diagnostics"))
+		b.Add("metrics.txt", support.API(api, "/metrics"))
+		b.Add("control-plane.log", func() ([]byte, error) { return logs.Bytes(), nil })
+
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", b.Name()))
+		b.WriteTo(w)
+	}
+}
+
+// openStore restores the registry from disk and persists later changes.
+// An older schema is migrated (with a backup) if auto_migrate allows it; a
+// newer one always stops startup, since this release would drop what it
+// doesn't understand on the next save.
+func openStore(reg *registry.Registry, cfg config.Store, log *slog.Logger) error {
+	st := store.Open(cfg.Path)
+	services, history, err := st.Load()
+	if errors.Is(err, store.ErrNeedsMigration) && cfg.AutoMigrate {
+		backup, applied, merr := st.Migrate()
+		if merr != nil {
+			return fmt.Errorf("migrating: %w", merr)
+		}
+		log.Info("migrated store", "path", cfg.Path, "backup", backup, "migrations", len(applied))
+		services, history, err = st.Load()
+	}
+	if errors.Is(err, store.ErrNeedsMigration) {
+		return fmt.Errorf("%w (run \"envoyagectl db migrate -path %s\")", err, cfg.Path)
+	}
+	if err != nil {
+		return err
+	}
+
+	reg.Restore(services, history)
+	reg.SetPersister(st)
+	log.Info("restored services from store", "path", cfg.Path, "count", len(services))
+	return nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"runtime/debug"
+	"time"
+
+	"github.com/envoyage/envoyage/internal/registry"
+)
+
+// API middleware
+//
+// Every management API request gets an ID: the caller's X-Request-ID if it
+// sends a sane one, so a deploy script can pick its own, or a random one.
+// The ID is echoed in the response's X-Request-ID, logged with the request,
+// recorded with the registry changes the request makes (Change.RequestID in
+// GET /changes) and logged with the snapshot rebuild they cause, so
+//
+//	grep 3f2a9c0d1e7b4a65 controlplane.log
+//
+// shows an API call, what it changed and the snapshot version it pushed.
+// A panicking handler is logged with its stack and answered 500 rather than
+// taking the connection down, and requests are bounded in time.
+
+const (
+	// apiRequestTimeout bounds a handler: its context is canceled after it.
+	apiRequestTimeout = time.Minute
+
+	// The server's own timeouts. The write timeout leaves a handler that
+	// ran into apiRequestTimeout time to answer.
+	apiReadHeaderTimeout = 10 * time.Second
+	apiReadTimeout       = time.Minute
+	apiWriteTimeout      = apiRequestTimeout + 30*time.Second
+	apiIdleTimeout       = 2 * time.Minute
+)
+
+// requestIDHeader carries the request ID both ways.
+const requestIDHeader = "X-Request-ID"
+
+// validRequestID is what is taken from a caller: short, and safe to log.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,64}$`)
+
+// newAPIServer returns the management API's server, with h wrapped in the
+// middleware.
+func newAPIServer(addr string, mux *http.ServeMux, h http.Handler, log *slog.Logger) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           logRequests(mux, log, recoverPanics(log, withTimeout(h))),
+		ReadHeaderTimeout: apiReadHeaderTimeout,
+		ReadTimeout:       apiReadTimeout,
+		WriteTimeout:      apiWriteTimeout,
+		IdleTimeout:       apiIdleTimeout,
+		ErrorLog:          slog.NewLogLogger(log.Handler(), slog.LevelWarn),
+	}
+}
+
+// logRequests assigns the request ID and logs each request once it is
+// answered, named by its route pattern as in the traces. Probes and metric
+// scrapes are logged at debug level, so they don't drown the rest.
+func logRequests(mux *http.ServeMux, log *slog.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		r = r.WithContext(registry.WithRequestID(r.Context(), id))
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		_, pattern := mux.Handler(r)
+		level := slog.LevelInfo
+		switch pattern {
+		case "GET /healthz", "GET /readyz", "GET /metrics":
+			level = slog.LevelDebug
+		}
+		log.Log(r.Context(), level, "api request",
+			"request_id", id,
+			"method", r.Method,
+			"path", r.URL.Path,
+			"route", pattern,
+			"status", rec.status(),
+			"bytes", rec.bytes,
+			"duration", time.Since(start),
+			"remote", r.RemoteAddr,
+		)
+	})
+}
+
+// recoverPanics answers a handler's panic with a 500, if nothing was
+// written yet, and logs it with the stack.
+func recoverPanics(log *slog.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			log.Error("api handler panicked",
+				"request_id", registry.RequestIDFrom(r.Context()),
+				"method", r.Method,
+				"path", r.URL.Path,
+				"panic", fmt.Sprint(v),
+				"stack", string(debug.Stack()),
+			)
+			if rec, ok := w.(*statusRecorder); !ok || rec.code == 0 {
+				writeError(w, http.StatusInternalServerError, "internal error")
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withTimeout cancels the request's context after apiRequestTimeout.
+func withTimeout(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), apiRequestTimeout)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// statusRecorder remembers the status and size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	code  int
+	bytes int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.code == 0 {
+		r.code = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.code == 0 {
+		r.code = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// status is the response's status, 200 if the handler wrote nothing.
+func (r *statusRecorder) status() int {
+	if r.code == 0 {
+		return http.StatusOK
+	}
+	return r.code
+}
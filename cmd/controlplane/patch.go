@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/envoyage/envoyage/internal/registry"
+)
+
+// Updates and optimistic concurrency
+//
+// PUT /services/{name} replaces a service with the body, PATCH applies a
+// JSON merge patch (RFC 7396) to its current definition, e.g.
+// {"upstream": "web-b:80", "jwt": null}. Either swaps the service in one
+// registry change, so routing never sees it missing.
+//
+// Every response carrying a service has an ETag, a hash of its stored
+// form. Sending it back in If-Match makes the change conditional: if the
+// service changed in between, nothing is written and the answer is 412.
+
+// errPrecondition is returned when If-Match doesn't match the service.
+var errPrecondition = errors.New("service does not match If-Match")
+
+// errBadPatch wraps a patch that isn't a JSON object or doesn't produce a
+// service definition.
+var errBadPatch = errors.New("invalid patch")
+
+// serviceETag is the entity tag of a service's current state.
+func serviceETag(svc *registry.Service) string {
+	b, _ := json.Marshal(svc)
+	sum := sha256.Sum256(b)
+	return `"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+// checkIfMatch returns errPrecondition unless the If-Match header of r, if
+// any, matches svc. svc is nil for a service that doesn't exist, which
+// matches nothing, not even "*".
+func checkIfMatch(r *http.Request, svc *registry.Service) error {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return nil
+	}
+	if svc != nil {
+		etag := serviceETag(svc)
+		for _, tag := range strings.Split(header, ",") {
+			if tag = strings.TrimSpace(tag); tag == "*" || tag == etag {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%w: %s", errPrecondition, header)
+}
+
+// serviceRequestFrom is the API form of a stored service, the document
+// PATCH applies its patch to.
+func serviceRequestFrom(svc *registry.Service) *serviceRequest {
+	req := &serviceRequest{
+		Name:            svc.Name,
+		Domain:          svc.Domain,
+		Upstream:        svc.Upstream,
+		ExtAuthz:        svc.ExtAuthz,
+		Challenge:       svc.Challenge,
+		Namespace:       svc.Namespace,
+		RateLimit:       svc.RateLimit,
+		MaxBodyBytes:    svc.MaxBodyBytes,
+		Exposure:        svc.Exposure,
+		Nodes:           svc.Nodes,
+		Streaming:       svc.Streaming,
+		Privacy:         svc.Privacy,
+		BasicAuth:       svc.BasicAuth,
+		VirtualClusters: svc.VirtualClusters,
+		HostRewrite:     svc.HostRewrite,
+		LBPolicy:        svc.LBPolicy,
+		Failover:        svc.Failover,
+		DependsOn:       svc.DependsOn,
+		FilterConfig:    svc.FilterConfig,
+		RouteMetadata:   svc.RouteMetadata,
+	}
+	if c := svc.Cache; c != nil {
+		req.Cache = &cacheRequest{
+			BypassCookies:  c.BypassCookies,
+			BypassHeaders:  c.BypassHeaders,
+			PrivateHeaders: c.PrivateHeaders,
+			Authenticated:  c.Authenticated,
+		}
+	}
+	for _, f := range svc.Wasm {
+		req.Wasm = append(req.Wasm, wasmFilterRequestFrom(f))
+	}
+	for _, a := range svc.Aliases {
+		req.Aliases = append(req.Aliases, aliasRequest{Domain: a.Domain, PathPrefix: a.PathPrefix, Host: a.Host})
+	}
+	if m := svc.Mount; m != nil {
+		req.Mount = &mountRequest{PathPrefix: m.PathPrefix, UpstreamPath: m.UpstreamPath}
+	}
+	if j := svc.JWT; j != nil {
+		req.JWT = &jwtRequest{Issuer: j.Issuer, JWKSURI: j.JWKSURI, Audiences: j.Audiences}
+	}
+	if h := svc.Headers; h != nil {
+		req.Headers = &headerRulesRequest{Request: headerOpsFrom(h.Request), Response: headerOpsFrom(h.Response)}
+	}
+	if fp := svc.ForwardProxy; fp != nil {
+		req.ForwardProxy = &forwardProxyRequest{Allow: fp.Allow}
+	}
+	if rd := svc.Redirect; rd != nil {
+		req.Redirect = &redirectRequest{URL: rd.URL, Status: rd.Status, PreservePath: rd.PreservePath}
+	}
+	if st := svc.Static; st != nil {
+		req.Static = &staticRequest{Status: st.Status, ContentType: st.ContentType, Body: st.Body}
+		for _, f := range st.Files {
+			req.Static.Files = append(req.Static.Files, staticFileRequest{Path: f.Path, ContentType: f.ContentType, Body: f.Body})
+		}
+	}
+	if hc := svc.HealthCheck; hc != nil {
+		req.HealthCheck = &healthCheckRequest{Send: hc.Send, Expect: hc.Expect}
+		if hc.Interval > 0 {
+			req.HealthCheck.Interval = hc.Interval.String()
+		}
+		if hc.Timeout > 0 {
+			req.HealthCheck.Timeout = hc.Timeout.String()
+		}
+	}
+	if c := svc.Concurrency; c != nil {
+		req.Concurrency = &concurrencyRequest{Max: c.Max, Queue: c.Queue}
+	}
+	if a := svc.Affinity; a != nil {
+		req.Affinity = &affinityRequest{Mode: a.Mode, Cookie: a.Cookie, Header: a.Header, Maglev: a.Maglev}
+		if a.TTL > 0 {
+			req.Affinity.TTL = a.TTL.String()
+		}
+	}
+	if d := svc.DNS; d != nil {
+		req.DNS = &dnsRequest{Type: d.Type}
+		if d.RefreshRate > 0 {
+			req.DNS.RefreshRate = d.RefreshRate.String()
+		}
+	}
+	if sh := svc.Shadow; sh != nil {
+		req.Shadow = &shadowRequest{Service: sh.Service, Percent: sh.Percent}
+	}
+	for _, o := range svc.Origins {
+		if req.Origins == nil {
+			req.Origins = make(map[string]string)
+		}
+		req.Origins[o.Node] = o.Upstream
+	}
+	for _, r := range svc.Schedule {
+		req.Schedule = append(req.Schedule, scheduleRuleRequest{Cron: r.Cron, Duration: r.Duration.String(), Action: r.Action})
+	}
+	if cc := svc.ClientCert; cc != nil {
+		req.ClientCert = &clientCertRequest{XFCC: cc.XFCC}
+		for _, h := range cc.Headers {
+			if req.ClientCert.Headers == nil {
+				req.ClientCert.Headers = make(map[string]string)
+			}
+			req.ClientCert.Headers[h.Name] = h.Field
+		}
+	}
+	if t := svc.TCP; t != nil {
+		req.TCP = &tcpRequest{Ports: t.String()}
+	}
+	if t := svc.TLS; t != nil {
+		req.TLS = &tlsRequest{MinVersion: t.MinVersion, ClientCert: t.ClientCert, CertChain: t.CertChain, PrivateKey: t.PrivateKey}
+	}
+	return req
+}
+
+func headerOpsFrom(ops registry.HeaderOps) headerOpsRequest {
+	byName := func(headers []registry.Header) map[string]string {
+		if len(headers) == 0 {
+			return nil
+		}
+		out := make(map[string]string, len(headers))
+		for _, h := range headers {
+			out[h.Name] = h.Value
+		}
+		return out
+	}
+	return headerOpsRequest{Set: byName(ops.Set), Add: byName(ops.Add), Remove: ops.Remove}
+}
+
+// patchService applies a merge patch to svc in place, keeping maintenance,
+// share links and the canary.
+func patchService(svc *registry.Service, patch []byte) error {
+	req, err := applyMergePatch(svc, patch)
+	if err != nil {
+		return err
+	}
+	if req.Name != svc.Name {
+		return fieldErrors{{Field: "name", Message: "can't be changed; add the service under the new name and remove this one"}}
+	}
+	next, err := req.toRegistry()
+	if err != nil {
+		return err
+	}
+	next.Maintenance = svc.Maintenance
+	next.MaintenancePage = svc.MaintenancePage
+	next.ShareLinks = svc.ShareLinks
+	next.Canary = svc.Canary
+	next.Switch = svc.Switch
+	next.Mirror = svc.Mirror
+	next.Waiting = svc.Waiting
+	*svc = *next
+	return nil
+}
+
+// applyMergePatch applies an RFC 7396 merge patch to a service's API form
+// and decodes the result, rejecting unknown fields as the file provider
+// does.
+func applyMergePatch(svc *registry.Service, patch []byte) (*serviceRequest, error) {
+	var p any
+	if err := json.Unmarshal(patch, &p); err != nil {
+		return nil, fmt.Errorf("%w: invalid json: %v", errBadPatch, err)
+	}
+	if _, ok := p.(map[string]any); !ok {
+		return nil, fmt.Errorf("%w: a merge patch must be a JSON object", errBadPatch)
+	}
+	cur, err := json.Marshal(serviceRequestFrom(svc))
+	if err != nil {
+		return nil, err
+	}
+	var doc any
+	if err := json.Unmarshal(cur, &doc); err != nil {
+		return nil, err
+	}
+	merged, err := json.Marshal(mergePatch(doc, p))
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(merged))
+	dec.DisallowUnknownFields()
+	var req serviceRequest
+	if err := dec.Decode(&req); err != nil {
+		return nil, fmt.Errorf("%w: %v", errBadPatch, err)
+	}
+	return &req, nil
+}
+
+// mergePatch merges patch into doc: objects recursively, null removes a
+// member, anything else replaces it.
+func mergePatch(doc, patch any) any {
+	p, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	d, ok := doc.(map[string]any)
+	if !ok {
+		d = make(map[string]any)
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(d, k)
+			continue
+		}
+		d[k] = mergePatch(d[k], v)
+	}
+	return d
+}
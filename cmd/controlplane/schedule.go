@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/envoyage/envoyage/internal/registry"
+	"github.com/envoyage/envoyage/internal/schedule"
+)
+
+// Scheduled changes
+//
+// POST /scheduled queues a change to one service for later, e.g.
+//
+//	{"at": "03:00", "op": "patch", "service": "jellyfin",
+//	 "body": {"upstream": "media-b:8096"}, "comment": "new box"}
+//
+// "at" is a time (RFC 3339) or a time of day (HH:MM, the next one in the
+// control plane's time zone). "op" is put (body is a full definition, as
+// for PUT /services/{name}), patch (body is a merge patch, as for PATCH) or
+// delete. The body is checked when the change is queued, but against the
+// registry only when it is made: a failure is recorded on the job. A job
+// more than "window" late (default 1h), e.g. after an outage, is skipped.
+//
+// GET /scheduled lists pending jobs, next first, then finished ones, and
+// DELETE /scheduled/{id} cancels a pending one.
+
+type scheduleRequest struct {
+	At      string          `json:"at"`
+	Op      string          `json:"op"`
+	Service string          `json:"service"`
+	Body    json.RawMessage `json:"body,omitempty"`
+	Comment string          `json:"comment,omitempty"`
+	Window  string          `json:"window,omitempty"`
+}
+
+// scheduledJob is the API form of a job, with its window as a duration
+// string.
+type scheduledJob struct {
+	schedule.Job
+	Window string `json:"window"`
+}
+
+func scheduledJobFrom(job schedule.Job) scheduledJob {
+	return scheduledJob{Job: job, Window: job.Window.String()}
+}
+
+// toJob checks the request and converts it, reporting invalid fields
+// together.
+func (req *scheduleRequest) toJob(now time.Time) (schedule.Job, error) {
+	job := schedule.Job{Op: req.Op, Service: req.Service, Comment: req.Comment}
+	var errs fieldErrors
+	if req.Service == "" {
+		errs = append(errs, fieldError{Field: "service", Message: "is required"})
+	}
+
+	at, err := parseScheduleTime(req.At, now)
+	switch {
+	case err != nil:
+		errs = append(errs, fieldError{Field: "at", Message: err.Error()})
+	case !at.After(now):
+		errs = append(errs, fieldError{Field: "at", Message: "is in the past"})
+	}
+	job.At = at
+
+	if req.Window != "" {
+		if job.Window, err = time.ParseDuration(req.Window); err != nil || job.Window <= 0 {
+			errs = append(errs, fieldError{Field: "window", Message: "must be a positive duration, e.g. 30m"})
+		}
+	}
+
+	switch req.Op {
+	case schedule.OpPut:
+		if len(req.Body) == 0 {
+			errs = append(errs, fieldError{Field: "body", Message: "put needs the service definition"})
+			break
+		}
+		// Named after the job's service unless it names it itself.
+		var def map[string]any
+		if err := json.Unmarshal(req.Body, &def); err != nil {
+			errs = append(errs, fieldError{Field: "body", Message: "must be a JSON object"})
+			break
+		}
+		if def["name"] == nil {
+			def["name"] = req.Service
+		}
+		job.Body, _ = json.Marshal(def)
+		svc, err := decodeServiceFile(job.Body)
+		var fe fieldErrors
+		switch {
+		case errors.As(err, &fe):
+			for _, f := range fe {
+				errs = append(errs, fieldError{Field: "body." + f.Field, Message: f.Message})
+			}
+		case err != nil:
+			errs = append(errs, fieldError{Field: "body", Message: err.Error()})
+		case svc.Name != req.Service:
+			errs = append(errs, fieldError{Field: "body.name", Message: fmt.Sprintf("%q does not match service %q", svc.Name, req.Service)})
+		}
+	case schedule.OpPatch:
+		var patch any
+		if err := json.Unmarshal(req.Body, &patch); err != nil {
+			errs = append(errs, fieldError{Field: "body", Message: "patch needs a JSON merge patch"})
+		} else if _, ok := patch.(map[string]any); !ok {
+			errs = append(errs, fieldError{Field: "body", Message: "a merge patch must be a JSON object"})
+		}
+		job.Body = req.Body
+	case schedule.OpDelete:
+		if len(req.Body) > 0 && !bytes.Equal(bytes.TrimSpace(req.Body), []byte("null")) {
+			errs = append(errs, fieldError{Field: "body", Message: "delete takes no body"})
+		}
+	default:
+		errs = append(errs, fieldError{Field: "op", Message: "must be put, patch or delete"})
+	}
+	if len(errs) > 0 {
+		return schedule.Job{}, errs
+	}
+	return job, nil
+}
+
+// parseScheduleTime parses an RFC 3339 time, or a time of day (HH:MM) as
+// the next one after now in now's location.
+func parseScheduleTime(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, errors.New("is required")
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	clock, err := time.Parse("15:04", s)
+	if err != nil {
+		return time.Time{}, errors.New("must be an RFC 3339 time or HH:MM")
+	}
+	t := time.Date(now.Year(), now.Month(), now.Day(), clock.Hour(), clock.Minute(), 0, 0, now.Location())
+	if !t.After(now) {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// applyScheduled makes a job's change the way the API would have.
+func applyScheduled(reg *registry.Registry) schedule.ApplyFunc {
+	return func(ctx context.Context, job schedule.Job) error {
+		comment := "scheduled " + job.ID
+		if job.Comment != "" {
+			comment += ": " + job.Comment
+		}
+		ctx = registry.WithComment(ctx, comment)
+
+		switch job.Op {
+		case schedule.OpPut:
+			svc, err := decodeServiceFile(job.Body)
+			if err != nil {
+				return err
+			}
+			_, err = reg.Upsert(ctx, job.Service, func(existing *registry.Service) error {
+				svc.Maintenance = existing.Maintenance
+				svc.MaintenancePage = existing.MaintenancePage
+				svc.ShareLinks = existing.ShareLinks
+				svc.Canary = existing.Canary
+				svc.Switch = existing.Switch
+				svc.Mirror = existing.Mirror
+				svc.Waiting = existing.Waiting
+				*existing = *svc
+				return nil
+			})
+			return err
+		case schedule.OpPatch:
+			return reg.Modify(ctx, job.Service, func(svc *registry.Service) error {
+				return patchService(svc, job.Body)
+			})
+		case schedule.OpDelete:
+			return reg.Remove(ctx, job.Service)
+		}
+		return fmt.Errorf("unknown op %q", job.Op)
+	}
+}
+
+func handleListScheduled(sched *schedule.Scheduler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		jobs, err := sched.List()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		out := make([]scheduledJob, len(jobs))
+		for i, job := range jobs {
+			out[i] = scheduledJobFrom(job)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"jobs": out})
+	}
+}
+
+// handleAddScheduled queues a job. leader, if set, refuses it on an HA
+// standby, whose scheduler doesn't run.
+func handleAddScheduled(sched *schedule.Scheduler, leader func() error, log *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if leader != nil {
+			if err := leader(); err != nil {
+				writeRegistryError(w, err)
+				return
+			}
+		}
+		var req scheduleRequest
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid json: "+err.Error())
+			return
+		}
+		job, err := req.toJob(time.Now())
+		if err != nil {
+			writeRequestError(w, err)
+			return
+		}
+		if job, err = sched.Add(job); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		log.Info("change scheduled via API", "id", job.ID, "op", job.Op, "service", job.Service, "at", job.At)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]any{"job": scheduledJobFrom(job)})
+	}
+}
+
+func handleCancelScheduled(sched *schedule.Scheduler, leader func() error, log *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if leader != nil {
+			if err := leader(); err != nil {
+				writeRegistryError(w, err)
+				return
+			}
+		}
+		id := r.PathValue("id")
+		if err := sched.Cancel(id); err != nil {
+			switch {
+			case errors.Is(err, schedule.ErrNotFound):
+				writeError(w, http.StatusNotFound, err.Error())
+			case errors.Is(err, schedule.ErrFinished):
+				writeError(w, http.StatusConflict, err.Error())
+			default:
+				writeError(w, http.StatusInternalServerError, err.Error())
+			}
+			return
+		}
+		log.Info("scheduled change cancelled via API", "id", id)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
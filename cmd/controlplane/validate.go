@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/envoyage/envoyage/internal/config"
+	"github.com/envoyage/envoyage/internal/lint"
+	"github.com/envoyage/envoyage/internal/registry"
+	"github.com/envoyage/envoyage/internal/wasm"
+	"github.com/envoyage/envoyage/internal/xds"
+)
+
+// Validation
+//
+// POST /validate takes the body of POST /services/import, a list of
+// definitions as YAML or JSON, and checks it without applying anything:
+// the definitions are validated and checked against the ownership policy
+// as the import would, then every node's snapshot is built from the state
+// the import would leave, with the consistency check and, if configured,
+// the pre-flight Envoy, and the result linted. It answers
+//
+//	{
+//	  "valid": false,
+//	  "changes": [...],
+//	  "nodes": [{"node": "envoyage-envoy-vps", "error": "..."}, ...],
+//	  "findings": [...]
+//	}
+//
+// where valid is whether every node's snapshot built. Lint findings don't
+// make a proposal invalid; envoyagectl validate -strict fails on them too.
+// Invalid definitions are answered as the import answers them, 422 with
+// the fields. For a CI pipeline that keeps its routing in a services file:
+//
+//	envoyagectl validate services.yaml && curl -X POST --data-binary @services.yaml .../services/import
+
+// nodeCheck is a node's result in a validation.
+type nodeCheck struct {
+	Node  string `json:"node"`
+	Error string `json:"error,omitempty"`
+}
+
+func handleValidate(cfg *config.Config, reg *registry.Registry, xdsServer *xds.Server, wasmStore *wasm.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxImportBytes))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "reading body: "+err.Error())
+			return
+		}
+		proposed, err := parseImport(data)
+		if err != nil {
+			writeRequestError(w, err)
+			return
+		}
+		changes, err := reg.Apply(r.Context(), registry.Desired{
+			Source:   registry.SourceAPI,
+			Services: proposed,
+			Keep:     keepUndefined,
+			DryRun:   true,
+		})
+		if err != nil {
+			writeRegistryError(w, err)
+			return
+		}
+		if changes == nil {
+			changes = []registry.Change{}
+		}
+
+		services := importedState(reg, proposed)
+		valid := true
+		var nodes []nodeCheck
+		for _, c := range xdsServer.Validate(r.Context(), services) {
+			nc := nodeCheck{Node: c.Node}
+			if c.Err != nil {
+				valid = false
+				nc.Error = c.Err.Error()
+			}
+			nodes = append(nodes, nc)
+		}
+		findings := lint.Run(cfg, services, nil, nil, wasmStore.Has)
+		if findings == nil {
+			findings = []lint.Finding{}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"valid":    valid,
+			"changes":  changes,
+			"nodes":    nodes,
+			"findings": findings,
+		})
+	}
+}
+
+// importedState returns the services the registry would hold after
+// importing proposed: the proposed ones, and those of other sources the
+// list doesn't name.
+func importedState(reg *registry.Registry, proposed []*registry.Service) []*registry.Service {
+	named := make(map[string]bool, len(proposed))
+	for _, svc := range proposed {
+		named[svc.Name] = true
+	}
+	current, _ := reg.Snapshot()
+	var out []*registry.Service
+	for _, svc := range current {
+		if !named[svc.Name] && registry.SourceOf(svc) != registry.SourceAPI {
+			out = append(out, svc)
+		}
+	}
+	out = append(out, proposed...)
+	slices.SortFunc(out, func(a, b *registry.Service) int { return strings.Compare(a.Name, b.Name) })
+	return out
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/envoyage/envoyage/internal/config"
+	"github.com/envoyage/envoyage/internal/registry"
+	"github.com/envoyage/envoyage/internal/wasm"
+)
+
+// Wasm modules
+//
+// PUT /wasm/{name} uploads a Wasm filter module, the binary as the body:
+//
+//	curl -X PUT --data-binary @filter.wasm http://controlplane:8080/wasm/geoblock
+//
+// Uploading under an existing name replaces the module everywhere it runs.
+// Services run it by listing it in "wasm", e.g. [{"module": "geoblock",
+// "config": "{\"allow\": [\"DE\"]}"}], and wasm.filters in the config runs
+// it for every service; see xds/wasm.go.
+//
+// GET /wasm lists the modules and what runs them, and DELETE /wasm/{name}
+// removes one that nothing runs. GET /wasm/modules/{sha256} serves a
+// module's code to the Envoys that fetch it (wasm.url); it needs no token,
+// since Envoy sends none, and only answers for a known hash.
+
+// maxWasmBytes bounds an uploaded module.
+const maxWasmBytes = 64 << 20
+
+// wasmModule is a module in the API, with what runs it.
+type wasmModule struct {
+	wasm.Module
+	Services []string `json:"services"`
+	Global   bool     `json:"global"`
+}
+
+// wasmUsers returns the services running the module called name, and
+// whether the config runs it for all.
+func wasmUsers(cfg *config.Config, services []*registry.Service, name string) ([]string, bool) {
+	users := []string{}
+	for _, svc := range services {
+		if slices.ContainsFunc(svc.Wasm, func(f registry.WasmFilter) bool { return f.Module == name }) {
+			users = append(users, svc.Name)
+		}
+	}
+	slices.Sort(users)
+	global := slices.ContainsFunc(cfg.Wasm.Filters, func(f config.WasmFilter) bool { return f.Module == name })
+	return users, global
+}
+
+func handleListWasm(cfg *config.Config, reg *registry.Registry, st *wasm.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		services, _ := reg.Snapshot()
+		out := []wasmModule{}
+		for _, m := range st.List() {
+			users, global := wasmUsers(cfg, services, m.Name)
+			out = append(out, wasmModule{Module: m, Services: users, Global: global})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"modules": out})
+	}
+}
+
+func handleGetWasm(cfg *config.Config, reg *registry.Registry, st *wasm.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		m, ok := st.Get(r.PathValue("name"))
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("%s: %s", wasm.ErrNotFound, r.PathValue("name")))
+			return
+		}
+		services, _ := reg.Snapshot()
+		users, global := wasmUsers(cfg, services, m.Name)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(wasmModule{Module: m, Services: users, Global: global})
+	}
+}
+
+func handlePutWasm(st *wasm.Store, log *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		code, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWasmBytes))
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("module larger than %d bytes", maxWasmBytes))
+				return
+			}
+			writeError(w, http.StatusBadRequest, "reading body: "+err.Error())
+			return
+		}
+		name := r.PathValue("name")
+		_, replaced := st.Get(name)
+		m, err := st.Put(r.Context(), name, code)
+		if err != nil {
+			if errors.Is(err, wasm.ErrInvalid) {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		log.Info("wasm module uploaded via API", "name", m.Name, "sha256", m.SHA256, "size", m.Size)
+		w.Header().Set("Content-Type", "application/json")
+		if !replaced {
+			w.WriteHeader(http.StatusCreated)
+		}
+		json.NewEncoder(w).Encode(m)
+	}
+}
+
+// handleRemoveWasm removes a module, unless something still runs it:
+// removing it would silently drop the filter from them.
+func handleRemoveWasm(cfg *config.Config, reg *registry.Registry, st *wasm.Store, log *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		services, _ := reg.Snapshot()
+		users, global := wasmUsers(cfg, services, name)
+		switch {
+		case global:
+			writeError(w, http.StatusConflict, fmt.Sprintf("wasm module %s is in wasm.filters of the config", name))
+			return
+		case len(users) > 0:
+			writeError(w, http.StatusConflict, fmt.Sprintf("wasm module %s is used by %s", name, strings.Join(users, ", ")))
+			return
+		}
+		if err := st.Delete(r.Context(), name); err != nil {
+			if errors.Is(err, wasm.ErrNotFound) {
+				writeError(w, http.StatusNotFound, err.Error())
+				return
+			}
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		log.Info("wasm module removed via API", "name", name)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleWasmCode serves a module's code by its SHA-256, for the Envoys
+// fetching it.
+func handleWasmCode(st *wasm.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		code, ok := st.CodeBySum(r.PathValue("sha256"))
+		if !ok {
+			writeError(w, http.StatusNotFound, wasm.ErrNotFound.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/wasm")
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		w.Write(code)
+	}
+}
@@ -0,0 +1,120 @@
+// Command envoyage-agent reports a node's host resources to the control plane.
+//
+// Run one on every node host (home and edge), next to its Envoy:
+//
+//	envoyage-agent -api http://controlplane:8080 -node envoyage-envoy-vps -tunnel wg0
+//
+// Every -interval it samples CPU, memory, disk and the tunnel interface and
+// posts them to POST /nodes/{id}/usage. It keeps nothing itself; if the
+// control plane is unreachable the sample is dropped and the next one sent.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/envoyage/envoyage/internal/usage"
+)
+
+func main() {
+	apiURL := flag.String("api", envOr("ENVOYAGE_API", "http://localhost:8080"), "management API base URL")
+	token := flag.String("token", os.Getenv("ENVOYAGE_TOKEN"), "management API admin token")
+	node := flag.String("node", os.Getenv("ENVOYAGE_NODE"), "node ID, as in the control plane config")
+	interval := flag.Duration("interval", 15*time.Second, "how often to report")
+	proc := flag.String("proc", "/proc", "procfs of the host (e.g. /host/proc in a container)")
+	disk := flag.String("disk", "/", "a path on the filesystem to report (e.g. /host in a container)")
+	tunnel := flag.String("tunnel", "", "tunnel interface to report, e.g. wg0 or tailscale0")
+	flag.Parse()
+
+	log := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	if *node == "" {
+		log.Error("-node is required")
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	a := &agent{
+		url:       *apiURL + "/nodes/" + url.PathEscape(*node) + "/usage",
+		token:     *token,
+		http:      &http.Client{Timeout: 10 * time.Second},
+		collector: &usage.Collector{Proc: *proc, Disk: *disk, Tunnel: *tunnel},
+		log:       log,
+	}
+	log.Info("reporting host usage", "node", *node, "api", *apiURL, "interval", *interval)
+
+	// The first sample only primes the CPU counters.
+	if _, err := a.collector.Collect(); err != nil {
+		log.Error("collecting host usage", "error", err)
+		os.Exit(1)
+	}
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := a.report(ctx); err != nil {
+				log.Warn("usage report failed", "error", err)
+			}
+		}
+	}
+}
+
+type agent struct {
+	url       string
+	token     string
+	http      *http.Client
+	collector *usage.Collector
+	log       *slog.Logger
+}
+
+// report sends one sample.
+func (a *agent) report(ctx context.Context) error {
+	r, err := a.collector.Collect()
+	if err != nil {
+		return fmt.Errorf("collecting: %w", err)
+	}
+	body, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if a.token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	}
+	resp, err := a.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("POST %s: %s: %s", a.url, resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// runChanges prints the change history with per-field diffs, e.g.
+//
+//	#42  2026-03-01 18:04  update jellyfin  "switching Jellyfin to new box"
+//	     Upstream: "10.0.0.5:8096" → "10.0.0.9:8096"
+func runChanges(c *client, args []string) error {
+	fs := flag.NewFlagSet("changes", flag.ExitOnError)
+	service := fs.String("service", "", "only show changes to this service")
+	fs.Parse(args)
+
+	path := "/changes"
+	if *service != "" {
+		path += "?service=" + url.QueryEscape(*service)
+	}
+	var resp struct {
+		Changes []struct {
+			Version uint64
+			Time    time.Time
+			Op      string
+			Service string
+			Comment string
+			Diff    []struct {
+				Field    string
+				From, To any
+			}
+		} `json:"changes"`
+	}
+	if err := c.getJSON(path, &resp); err != nil {
+		return err
+	}
+
+	for _, ch := range resp.Changes {
+		fmt.Printf("#%d  %s  %s %s", ch.Version, ch.Time.Local().Format("2006-01-02 15:04"), ch.Op, ch.Service)
+		if ch.Comment != "" {
+			fmt.Printf("  %q", ch.Comment)
+		}
+		fmt.Println()
+		for _, d := range ch.Diff {
+			fmt.Printf("     %s: %s → %s\n", d.Field, diffValue(d.From), diffValue(d.To))
+		}
+	}
+	return nil
+}
+
+func diffValue(v any) string {
+	if v == nil {
+		return "-"
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/envoyage/envoyage/internal/store"
+)
+
+// runDB dispatches the db subcommands, which work on the store file
+// directly rather than through the API.
+func runDB(args []string) error {
+	if len(args) < 1 {
+		return errors.New("usage: envoyagectl db <status|migrate> [-path FILE]")
+	}
+
+	fs := flag.NewFlagSet("db "+args[0], flag.ExitOnError)
+	path := fs.String("path", os.Getenv("ENVOYAGE_STORE"), "store file (the control plane's store.path)")
+	fs.Parse(args[1:])
+	if *path == "" {
+		return errors.New("-path or ENVOYAGE_STORE is required")
+	}
+	st := store.Open(*path)
+
+	switch args[0] {
+	case "status":
+		return runDBStatus(st)
+	case "migrate":
+		return runDBMigrate(st)
+	default:
+		return fmt.Errorf("unknown db command %q", args[0])
+	}
+}
+
+func runDBStatus(st *store.File) error {
+	s, err := st.Status()
+	if err != nil {
+		return err
+	}
+	if !s.Exists {
+		fmt.Printf("%s: does not exist (will be created at version %d)\n", s.Path, s.Latest)
+		return nil
+	}
+	fmt.Printf("%s: schema version %d, latest %d\n", s.Path, s.Version, s.Latest)
+	switch {
+	case s.Version > s.Latest:
+		fmt.Println("written by a newer release; upgrade envoyagectl and the control plane")
+	case len(s.Pending) == 0:
+		fmt.Println("up to date")
+	default:
+		fmt.Println("pending migrations:")
+		for _, m := range s.Pending {
+			fmt.Printf("  %d  %s\n", m.Version, m.Description)
+		}
+	}
+	return nil
+}
+
+func runDBMigrate(st *store.File) error {
+	backup, applied, err := st.Migrate()
+	if backup != "" {
+		fmt.Printf("backed up %s to %s\n", st.Path(), backup)
+	}
+	for _, m := range applied {
+		fmt.Printf("applied %d  %s\n", m.Version, m.Description)
+	}
+	if err != nil {
+		return err
+	}
+	if len(applied) == 0 {
+		fmt.Printf("%s is up to date (version %d)\n", st.Path(), store.LatestVersion())
+	}
+	return nil
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/envoyage/envoyage/internal/config"
+	"github.com/envoyage/envoyage/internal/xds"
+)
+
+// homeNodeID is the node ID the control plane treats as the home Envoy.
+const homeNodeID = "envoyage-envoy-home"
+
+// setup is what init asks for. Everything else it writes is derived.
+type setup struct {
+	Tunnel    string // none, wireguard or tailscale
+	HomeAddr  string // home node's address on the tunnel
+	HomeAdmin string // home Envoy admin as the control plane reaches it
+	HomeXDS   string // control plane as the home Envoy reaches it
+	Edges     []edge
+	StorePath string
+}
+
+type edge struct {
+	ID    string
+	Admin string
+}
+
+// runInit writes a starter config, an admin token and one bootstrap per
+// node into -out, asking for anything not given as a flag:
+//
+//	envoyagectl init -tunnel wireguard -home-addr 10.8.0.1 -edges vps-fra=10.8.0.2:9901
+//
+// The admin token is printed once and only its hash is stored.
+func runInit(args []string) error {
+	fset := flag.NewFlagSet("init", flag.ExitOnError)
+	out := fset.String("out", ".", "directory to write envoyage.yaml and the bootstraps into")
+	tunnel := fset.String("tunnel", "none", "how edges reach home: none (Docker Compose), wireguard or tailscale")
+	homeAddr := fset.String("home-addr", "", "home node's WireGuard IP or Tailscale name")
+	homeAdmin := fset.String("home-admin", "envoy-home:9901", "home Envoy admin address, as the control plane reaches it")
+	homeXDS := fset.String("home-xds", "controlplane:9090", "control plane xDS address, as the home Envoy reaches it")
+	edges := fset.String("edges", "envoyage-envoy-vps=envoy-vps:9902", "edge nodes as id[=admin-host:port], comma-separated")
+	storePath := fset.String("store", "/var/lib/envoyage/services.json", "where the control plane keeps registered services")
+	yes := fset.Bool("yes", false, "don't ask; use flags and defaults")
+	force := fset.Bool("force", false, "overwrite existing files")
+	fset.Parse(args)
+
+	set := make(map[string]bool)
+	fset.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	p := &prompter{in: bufio.NewReader(os.Stdin), enabled: !*yes}
+
+	var s setup
+	s.Tunnel = p.ask(set, "tunnel", "Tunnel between edge and home (none, wireguard, tailscale)", *tunnel)
+	switch s.Tunnel {
+	case "none":
+	case "wireguard", "tailscale":
+		s.HomeAddr = p.ask(set, "home-addr", "Home node's "+s.Tunnel+" address", *homeAddr)
+		if s.HomeAddr == "" {
+			return errors.New("-home-addr is required with a tunnel")
+		}
+	default:
+		return fmt.Errorf("unknown tunnel %q", s.Tunnel)
+	}
+	s.HomeAdmin = p.ask(set, "home-admin", "Home Envoy admin address", *homeAdmin)
+	s.HomeXDS = p.ask(set, "home-xds", "Control plane address from the home Envoy", *homeXDS)
+	edgeList := p.ask(set, "edges", "Edge nodes (id[=admin], comma-separated)", *edges)
+	s.StorePath = p.ask(set, "store", "Service store path", *storePath)
+	if p.err != nil {
+		return p.err
+	}
+
+	for _, e := range strings.Split(edgeList, ",") {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		id, admin, _ := strings.Cut(e, "=")
+		if id == homeNodeID {
+			return fmt.Errorf("edge %q: that ID is reserved for the home node", id)
+		}
+		s.Edges = append(s.Edges, edge{ID: id, Admin: admin})
+	}
+	if len(s.Edges) == 0 {
+		return errors.New("at least one edge node is required")
+	}
+
+	token, err := newToken()
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256([]byte(token))
+
+	files, err := s.render(hex.EncodeToString(sum[:]))
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(*out, 0o755); err != nil {
+		return fmt.Errorf("creating %s: %w", *out, err)
+	}
+	for _, f := range files {
+		path := filepath.Join(*out, f.name)
+		if !*force {
+			if _, err := os.Stat(path); err == nil {
+				return fmt.Errorf("%s already exists (use -force to overwrite)", path)
+			} else if !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+		}
+	}
+	for _, f := range files {
+		path := filepath.Join(*out, f.name)
+		if err := os.WriteFile(path, f.data, 0o644); err != nil {
+			return fmt.Errorf("writing %s: %w", path, err)
+		}
+		fmt.Printf("wrote %s\n", path)
+	}
+
+	// The config must load as written; anything else is a bug here.
+	if _, err := config.Load(filepath.Join(*out, "envoyage.yaml")); err != nil {
+		return err
+	}
+
+	fmt.Printf(`
+Admin token (shown only once; envoyage.yaml keeps its hash):
+
+  %s
+
+Next:
+  - start the control plane with ENVOYAGE_CONFIG=%s
+  - start each Envoy with its bootstrap-<node>.yaml
+  - export ENVOYAGE_TOKEN=<token> for envoyagectl
+`, token, filepath.Join(*out, "envoyage.yaml"))
+	return nil
+}
+
+type outFile struct {
+	name string
+	data []byte
+}
+
+// render produces envoyage.yaml and every node's bootstrap.
+func (s *setup) render(tokenHash string) ([]outFile, error) {
+	homeIngress, edgeXDS := "envoy-home:10000", "controlplane:9090"
+	if s.Tunnel != "none" {
+		homeIngress = net.JoinHostPort(s.HomeAddr, "10000")
+		edgeXDS = net.JoinHostPort(s.HomeAddr, "9090")
+	}
+
+	var cfg strings.Builder
+	err := configTemplate.Execute(&cfg, map[string]any{
+		"Setup":       s,
+		"HomeID":      homeNodeID,
+		"HomeIngress": homeIngress,
+		"EdgeXDS":     edgeXDS,
+		"TokenHash":   tokenHash,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("rendering config: %w", err)
+	}
+	files := []outFile{{name: "envoyage.yaml", data: []byte(cfg.String())}}
+
+	bootstrap := func(n xds.Node, xdsAddr string) error {
+		bs, err := xds.DynamicBootstrap(n, xds.BootstrapOptions{XDSAddress: xdsAddr})
+		if err != nil {
+			return fmt.Errorf("node %q: %w", n.ID, err)
+		}
+		data, err := xds.MarshalYAML(bs)
+		if err != nil {
+			return fmt.Errorf("node %q: %w", n.ID, err)
+		}
+		files = append(files, outFile{name: "bootstrap-" + n.ID + ".yaml", data: data})
+		return nil
+	}
+	if err := bootstrap(xds.Node{ID: homeNodeID, Admin: s.HomeAdmin}, s.HomeXDS); err != nil {
+		return nil, err
+	}
+	for _, e := range s.Edges {
+		if err := bootstrap(xds.Node{ID: e.ID, Admin: e.Admin}, edgeXDS); err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+var configTemplate = template.Must(template.New("config").Parse(`# Generated by envoyagectl init. See config.example.yaml for every option.
+{{- if ne .Setup.Tunnel "none"}}
+#
+# Edges reach home over {{.Setup.Tunnel}} at {{.Setup.HomeAddr}}.
+{{- end}}
+
+nodes:
+  - id: {{.HomeID}}
+    admin: {{.Setup.HomeAdmin}}
+{{- range .Setup.Edges}}
+  - id: {{.ID}}
+{{- if .Admin}}
+    admin: {{.Admin}}
+{{- end}}
+{{- end}}
+
+home_ingress: {{.HomeIngress}}
+
+api:
+  token_sha256: {{.TokenHash}}
+
+bootstrap:
+  xds_address: {{.EdgeXDS}}
+
+store:
+  path: {{.Setup.StorePath}}
+`))
+
+// prompter asks for flag values on stdin, unless the flag was given or
+// prompting is off.
+type prompter struct {
+	in      *bufio.Reader
+	enabled bool
+	err     error
+}
+
+func (p *prompter) ask(set map[string]bool, name, question, def string) string {
+	if !p.enabled || set[name] || p.err != nil {
+		return def
+	}
+	fmt.Printf("%s [%s]: ", question, def)
+	line, err := p.in.ReadString('\n')
+	if err != nil && line == "" {
+		p.err = fmt.Errorf("reading answer for -%s: %w (use -yes to run without prompts)", name, err)
+		return def
+	}
+	if line = strings.TrimSpace(line); line != "" {
+		return line
+	}
+	return def
+}
+
+func newToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generating admin token: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
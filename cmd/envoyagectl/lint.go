@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// runLint prints the control plane's lint findings, e.g.
+//
+//	warning  public-no-auth  service whoami  whoami.example.com is public with no authentication
+//	         fix: add basic_auth, jwt or ext_authz, or set exposure to lan if it is only for home use
+//
+// It exits non-zero if any finding is an error or warning, so it can gate a
+// deploy script.
+func runLint(c *client, args []string) error {
+	fs := flag.NewFlagSet("lint", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the findings as JSON")
+	fs.Parse(args)
+
+	var resp struct {
+		Findings []struct {
+			Code     string `json:"code"`
+			Severity string `json:"severity"`
+			Service  string `json:"service"`
+			Node     string `json:"node"`
+			Message  string `json:"message"`
+			Fix      string `json:"fix"`
+		} `json:"findings"`
+	}
+	if err := c.getJSON("/lint", &resp); err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(resp.Findings); err != nil {
+			return err
+		}
+	} else {
+		for _, f := range resp.Findings {
+			subject := ""
+			switch {
+			case f.Service != "" && f.Node != "":
+				subject = "service " + f.Service + " on " + f.Node
+			case f.Service != "":
+				subject = "service " + f.Service
+			case f.Node != "":
+				subject = "node " + f.Node
+			}
+			fmt.Printf("%-8s %s  %s  %s\n", f.Severity, f.Code, subject, f.Message)
+			if f.Fix != "" {
+				fmt.Printf("         fix: %s\n", f.Fix)
+			}
+		}
+	}
+
+	failing := 0
+	for _, f := range resp.Findings {
+		if f.Severity != "info" {
+			failing++
+		}
+	}
+	if failing > 0 {
+		return fmt.Errorf("%d finding(s) need attention", failing)
+	}
+	return nil
+}
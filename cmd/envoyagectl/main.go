@@ -0,0 +1,217 @@
+// Command envoyagectl is the operator CLI for an Envoyage control plane.
+//
+// Most commands talk to the management API over HTTP and never touch the
+// registry or the Envoys directly, so they are safe to run from any machine
+// that can reach the API. The db commands are the exception: they work on
+// the store file itself and are meant to be run on the control plane host,
+// typically while it is stopped for an upgrade. init talks to nothing at all;
+// it writes the files a new installation starts from.
+//
+// Usage:
+//
+//	envoyagectl [-api URL] [-token TOKEN] <command> [flags]
+//
+// Commands:
+//
+//	init            generate the config, admin token and node bootstraps
+//	export-static   write a break-glass static bootstrap for every node
+//	snapshot        export a node's snapshot, or pin a node to an exported one
+//	changes         show the change history with comments and diffs
+//	lint            report risky configuration, e.g. public services without auth
+//	validate        check a services file builds for every node, without applying it
+//	support-bundle  download a redacted archive of state and logs for bug reports
+//	db status       show the store's schema version and pending migrations
+//	db migrate      back up the store and migrate it to the latest schema
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// client is a thin wrapper around the management API.
+type client struct {
+	base  string
+	token string // admin token, if the API requires one
+	http  *http.Client
+}
+
+func main() {
+	apiURL := flag.String("api", envOr("ENVOYAGE_API", "http://localhost:8080"), "management API base URL")
+	token := flag.String("token", os.Getenv("ENVOYAGE_TOKEN"), "management API admin token")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	c := &client{base: *apiURL, token: *token, http: &http.Client{Timeout: 30 * time.Second}}
+
+	var err error
+	switch cmd, args := flag.Arg(0), flag.Args()[1:]; cmd {
+	case "export-static":
+		err = runExportStatic(c, args)
+	case "snapshot":
+		err = runSnapshot(c, args)
+	case "changes":
+		err = runChanges(c, args)
+	case "lint":
+		err = runLint(c, args)
+	case "validate":
+		err = runValidate(c, args)
+	case "support-bundle":
+		err = runSupportBundle(c, args)
+	case "db":
+		err = runDB(args)
+	case "init":
+		err = runInit(args)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", cmd)
+		usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprint(os.Stderr, `Usage: envoyagectl [-api URL] [-token TOKEN] <command> [flags]
+
+Commands:
+  init            generate the config, admin token and node bootstraps
+  export-static   write a break-glass static bootstrap for every node
+  snapshot        export a node's snapshot, or pin a node to an exported one
+  changes         show the change history with comments and diffs
+  lint            report risky configuration, e.g. public services without auth
+  validate        check a services file builds for every node, without applying it
+  support-bundle  download a redacted archive of state and logs for bug reports
+  db status       show the store's schema version and pending migrations
+  db migrate      back up the store and migrate it to the latest schema
+
+Global flags:
+`)
+	flag.PrintDefaults()
+}
+
+// runExportStatic writes one <node-id>.yaml per managed node into -out.
+//
+// The files are plain Envoy bootstraps with no xDS dependency. Run this
+// regularly (cron, or after every routing change) so that if the control
+// plane is ever down, the latest files can be mounted in place of
+// envoy/bootstrap-*.yaml and the Envoys restarted on static config.
+func runExportStatic(c *client, args []string) error {
+	fs := flag.NewFlagSet("export-static", flag.ExitOnError)
+	out := fs.String("out", "break-glass", "directory to write <node-id>.yaml files into")
+	fs.Parse(args)
+
+	var nodes struct {
+		Nodes []struct {
+			ID string `json:"id"`
+		} `json:"nodes"`
+	}
+	if err := c.getJSON("/nodes", &nodes); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(*out, 0o755); err != nil {
+		return fmt.Errorf("creating %s: %w", *out, err)
+	}
+
+	for _, n := range nodes.Nodes {
+		id := n.ID
+		body, err := c.get("/nodes/" + id + "/static")
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(*out, id+".yaml")
+		if err := os.WriteFile(path, body, 0o644); err != nil {
+			return fmt.Errorf("writing %s: %w", path, err)
+		}
+		fmt.Printf("wrote %s\n", path)
+	}
+	return nil
+}
+
+// get fetches path from the API and returns the body, treating any non-2xx
+// status as an error carrying the server's message.
+func (c *client) get(path string) ([]byte, error) {
+	return c.do(http.MethodGet, path, nil)
+}
+
+// do sends a request to the API and returns the response body, treating
+// any non-2xx status as an error carrying the server's message.
+func (c *client) do(method, path string, body io.Reader) ([]byte, error) {
+	req, err := http.NewRequest(method, c.base+path, body)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %w", method, path, err)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %w", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	out, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: reading body: %w", method, path, err)
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, apiMessage(out))
+	}
+	return out, nil
+}
+
+// apiMessage extracts the message (and invalid fields) from an error
+// response of the API, or returns the body as is if it isn't one.
+func apiMessage(body []byte) string {
+	var resp struct {
+		Error *struct {
+			Message string `json:"message"`
+			Fields  []struct {
+				Field   string `json:"field"`
+				Message string `json:"message"`
+			} `json:"fields"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &resp) != nil || resp.Error == nil {
+		return strings.TrimSpace(string(body))
+	}
+	msg := resp.Error.Message
+	for _, f := range resp.Error.Fields {
+		msg += "; " + f.Field + ": " + f.Message
+	}
+	return msg
+}
+
+func (c *client) getJSON(path string, v any) error {
+	body, err := c.get(path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("GET %s: decoding response: %w", path, err)
+	}
+	return nil
+}
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
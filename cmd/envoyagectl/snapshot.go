@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+// runSnapshot dispatches the snapshot subcommands:
+//
+//	envoyagectl snapshot export -node ID [-redact] [-out FILE]
+//	envoyagectl snapshot import -node ID FILE
+//	envoyagectl snapshot release -node ID
+//
+// An export is the node's xDS resources as it is being served them. Import
+// pushes one back and pins the node to it, ignoring registry changes, until
+// release; use it to replay a known-good config during an incident.
+func runSnapshot(c *client, args []string) error {
+	if len(args) < 1 {
+		return errors.New("usage: envoyagectl snapshot <export|import|release> -node ID")
+	}
+
+	fs := flag.NewFlagSet("snapshot "+args[0], flag.ExitOnError)
+	node := fs.String("node", "", "node ID")
+	out := fs.String("out", "", "file to write (default <node>.json); export only")
+	redact := fs.Bool("redact", false, "replace secrets, for sharing; the file can't be imported then")
+	fs.Parse(args[1:])
+	if *node == "" {
+		return errors.New("-node is required")
+	}
+	path := "/nodes/" + url.PathEscape(*node) + "/snapshot"
+
+	switch args[0] {
+	case "export":
+		if *redact {
+			path += "?redact=true"
+		}
+		body, err := c.get(path)
+		if err != nil {
+			return err
+		}
+		file := *out
+		if file == "" {
+			file = *node + ".json"
+		}
+		if err := os.WriteFile(file, body, 0o600); err != nil {
+			return fmt.Errorf("writing %s: %w", file, err)
+		}
+		fmt.Printf("wrote %s\n", file)
+		if !*redact {
+			fmt.Println("it holds secrets (password hashes, share links); export with -redact to share it")
+		}
+		return nil
+	case "import":
+		if fs.NArg() != 1 {
+			return errors.New("usage: envoyagectl snapshot import -node ID FILE")
+		}
+		data, err := os.ReadFile(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		body, err := c.do(http.MethodPut, path, bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		fmt.Print(string(body))
+		return nil
+	case "release":
+		body, err := c.do(http.MethodDelete, path, nil)
+		if err != nil {
+			return err
+		}
+		fmt.Print(string(body))
+		return nil
+	default:
+		return fmt.Errorf("unknown snapshot command %q", args[0])
+	}
+}
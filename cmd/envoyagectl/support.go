@@ -0,0 +1,33 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// runSupportBundle downloads a support bundle: config, registry, node
+// status, snapshots, diagnostics and recent logs in one tarball, with
+// secrets redacted by the control plane. Attach it to bug reports.
+func runSupportBundle(c *client, args []string) error {
+	fs := flag.NewFlagSet("support-bundle", flag.ExitOnError)
+	out := fs.String("out", "", "file to write (default envoyage-support-<time>.tar.gz)")
+	fs.Parse(args)
+
+	// Snapshots of many nodes can take a while to render.
+	c.http.Timeout = 2 * time.Minute
+	body, err := c.get("/support/bundle")
+	if err != nil {
+		return err
+	}
+	path := *out
+	if path == "" {
+		path = "envoyage-support-" + time.Now().UTC().Format("20060102-150405") + ".tar.gz"
+	}
+	if err := os.WriteFile(path, body, 0o600); err != nil {
+		return fmt.Errorf("writing %s: %w", path, err)
+	}
+	fmt.Printf("wrote %s (%d bytes); secrets are redacted, but check it before sharing\n", path, len(body))
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+)
+
+// runValidate checks a services file, in the format of export and import,
+// against the control plane without applying it, e.g.
+//
+//	envoyagectl validate services.yaml
+//	ok       envoyage-envoy-home
+//	FAILED   envoyage-envoy-vps  building snapshot ...: ...
+//	update   whoami
+//
+// It exits non-zero if any node's snapshot fails to build or, with -strict,
+// if a lint finding is an error or warning. "-" reads the file from stdin.
+func runValidate(c *client, args []string) error {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	strict := fs.Bool("strict", false, "also fail on lint errors and warnings")
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: envoyagectl validate [-strict] [-json] FILE")
+	}
+
+	var data []byte
+	var err error
+	if path := fs.Arg(0); path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return err
+	}
+	body, err := c.do(http.MethodPost, "/validate", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	var resp struct {
+		Valid   bool `json:"valid"`
+		Changes []struct {
+			Op      string
+			Service string
+		} `json:"changes"`
+		Nodes []struct {
+			Node  string `json:"node"`
+			Error string `json:"error"`
+		} `json:"nodes"`
+		Findings []struct {
+			Code     string `json:"code"`
+			Severity string `json:"severity"`
+			Service  string `json:"service"`
+			Node     string `json:"node"`
+			Message  string `json:"message"`
+		} `json:"findings"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return fmt.Errorf("POST /validate: decoding response: %w", err)
+	}
+
+	if *asJSON {
+		os.Stdout.Write(body)
+	} else {
+		for _, n := range resp.Nodes {
+			if n.Error == "" {
+				fmt.Printf("%-8s %s\n", "ok", n.Node)
+			} else {
+				fmt.Printf("%-8s %s  %s\n", "FAILED", n.Node, n.Error)
+			}
+		}
+		for _, ch := range resp.Changes {
+			fmt.Printf("%-8s %s\n", ch.Op, ch.Service)
+		}
+		for _, f := range resp.Findings {
+			subject := ""
+			switch {
+			case f.Service != "":
+				subject = "service " + f.Service + "  "
+			case f.Node != "":
+				subject = "node " + f.Node + "  "
+			}
+			fmt.Printf("%-8s %s  %s%s\n", f.Severity, f.Code, subject, f.Message)
+		}
+	}
+
+	if !resp.Valid {
+		return errors.New("the services don't build for every node")
+	}
+	if *strict {
+		failing := 0
+		for _, f := range resp.Findings {
+			if f.Severity != "info" {
+				failing++
+			}
+		}
+		if failing > 0 {
+			return fmt.Errorf("%d finding(s) need attention", failing)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,214 @@
+// Package canary automates canary rollouts.
+//
+// A service with a registry.Canary gets its traffic split between its stable
+// upstream and the canary on the home node (see xds). When the canary has an
+// Analysis, the Analyzer watches both halves through the stats scraper and
+// moves the split: each window in which the canary's error rate and latency
+// stay within the thresholds adds Step percent, reaching 100 promotes the
+// canary to the service's upstream, and a failing window rolls back to 0 and
+// removes the canary. Every move is a normal registry change, so it shows up
+// in the change history with the numbers that caused it.
+//
+// The Switcher does the same for blue/green switches, which move all the
+// traffic at once: see switch.go.
+package canary
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/envoyage/envoyage/internal/registry"
+	"github.com/envoyage/envoyage/internal/stats"
+	"github.com/envoyage/envoyage/internal/supervisor"
+)
+
+// tick is how often the Analyzer checks whether a window is over. Windows
+// themselves are CanaryAnalysis.Interval long.
+const tick = 5 * time.Second
+
+// Stats is the part of stats.Scraper the Analyzer reads.
+type Stats interface {
+	Service(name string) map[string]map[string]uint64
+}
+
+// Analyzer drives canaries with an Analysis set.
+type Analyzer struct {
+	reg   *registry.Registry
+	stats Stats
+	log   *slog.Logger
+	now   func() time.Time
+
+	windows map[string]*window // by service name; only touched by Run
+}
+
+// window is one comparison period for one service.
+type window struct {
+	upstream string // canary upstream and weight the window was opened
+	weight   int    // for; a change by hand starts a new one
+	start    time.Time
+	stable   counts
+	canary   counts
+}
+
+// counts are request totals summed over every node.
+type counts struct {
+	completed, errors uint64
+	p95               uint64 // ms; the highest node's, 0 if unknown
+}
+
+// NewAnalyzer creates an Analyzer. Call Run to start it.
+func NewAnalyzer(reg *registry.Registry, st Stats, log *slog.Logger) *Analyzer {
+	return &Analyzer{
+		reg:     reg,
+		stats:   st,
+		log:     log,
+		now:     time.Now,
+		windows: make(map[string]*window),
+	}
+}
+
+// Run analyzes until ctx is canceled. Call it in a goroutine.
+func (a *Analyzer) Run(ctx context.Context) {
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.analyze(ctx)
+			supervisor.Beat(ctx)
+		}
+	}
+}
+
+func (a *Analyzer) analyze(ctx context.Context) {
+	services, _ := a.reg.Snapshot()
+	seen := make(map[string]bool)
+	for _, svc := range services {
+		c := svc.Canary
+		if c == nil || c.Analysis == nil || c.Weight == 0 {
+			continue
+		}
+		seen[svc.Name] = true
+
+		stable, canary := a.read(svc.Name)
+		w := a.windows[svc.Name]
+		if w == nil || w.upstream != c.Upstream || w.weight != c.Weight ||
+			stable.completed < w.stable.completed || canary.completed < w.canary.completed {
+			// New canary, a change by hand, or an Envoy restart reset the
+			// counters: start over.
+			a.windows[svc.Name] = &window{upstream: c.Upstream, weight: c.Weight, start: a.now(), stable: stable, canary: canary}
+			continue
+		}
+		if a.now().Sub(w.start) < c.Analysis.Interval {
+			continue
+		}
+		canaryRq := canary.completed - w.canary.completed
+		if canaryRq < c.Analysis.MinRequests {
+			a.log.Debug("canary window extended: not enough requests", "service", svc.Name, "requests", canaryRq)
+			continue
+		}
+
+		verdict := judge(c.Analysis, w, stable, canary)
+		delete(a.windows, svc.Name)
+		if err := a.apply(ctx, svc.Name, c, verdict); err != nil {
+			a.log.Error("canary: failed to apply verdict", "service", svc.Name, "error", err)
+		}
+	}
+	for name := range a.windows {
+		if !seen[name] {
+			delete(a.windows, name)
+		}
+	}
+}
+
+// read sums the stable and canary clusters' stats over every node.
+func (a *Analyzer) read(service string) (stable, canary counts) {
+	sum := func(name string) counts {
+		var c counts
+		for _, st := range a.stats.Service(name) {
+			c.completed += st[stats.StatRqCompleted]
+			c.errors += st[stats.StatRq5xx]
+			c.p95 = max(c.p95, st[stats.StatRqTimeP95])
+		}
+		return c
+	}
+	return sum(service), sum(service + stats.CanarySuffix)
+}
+
+type verdict struct {
+	pass   bool
+	reason string
+}
+
+// judge compares the canary with stable over one window.
+func judge(an *registry.CanaryAnalysis, w *window, stable, canary counts) verdict {
+	rate := func(now, then counts) float64 {
+		n := now.completed - then.completed
+		if n == 0 {
+			return 0
+		}
+		return float64(now.errors-then.errors) / float64(n)
+	}
+	stableRate, canaryRate := rate(stable, w.stable), rate(canary, w.canary)
+	if canaryRate-stableRate > an.MaxErrorRateIncrease {
+		return verdict{reason: fmt.Sprintf("error rate %.2f%% vs stable %.2f%%", canaryRate*100, stableRate*100)}
+	}
+	if an.MaxLatencyRatio > 0 && stable.p95 > 0 && canary.p95 > 0 &&
+		float64(canary.p95) > an.MaxLatencyRatio*float64(stable.p95) {
+		return verdict{reason: fmt.Sprintf("p95 latency %dms vs stable %dms", canary.p95, stable.p95)}
+	}
+	return verdict{pass: true, reason: fmt.Sprintf("error rate %.2f%% vs stable %.2f%%", canaryRate*100, stableRate*100)}
+}
+
+// errCanaryChanged aborts a verdict when the canary was changed by hand
+// while it was being judged.
+var errCanaryChanged = errors.New("canary changed during analysis")
+
+// apply moves the canary forward, promotes it or rolls it back.
+func (a *Analyzer) apply(ctx context.Context, name string, judged *registry.Canary, v verdict) error {
+	var comment string
+	switch next := judged.Weight + judged.Analysis.Step; {
+	case !v.pass:
+		comment = fmt.Sprintf("canary: rolled back %s at %d%%: %s", judged.Upstream, judged.Weight, v.reason)
+	case next >= 100:
+		comment = fmt.Sprintf("canary: promoted %s: %s", judged.Upstream, v.reason)
+	default:
+		comment = fmt.Sprintf("canary: %s to %d%%: %s", judged.Upstream, next, v.reason)
+	}
+
+	err := a.reg.Modify(registry.WithComment(ctx, comment), name, func(svc *registry.Service) error {
+		c := svc.Canary
+		if c == nil || c.Upstream != judged.Upstream || c.Weight != judged.Weight {
+			return errCanaryChanged
+		}
+		switch next := c.Weight + c.Analysis.Step; {
+		case !v.pass:
+			svc.Canary = nil
+		case next >= 100:
+			svc.Upstream = c.Upstream
+			svc.Canary = nil
+		default:
+			cp := *c
+			cp.Weight = next
+			svc.Canary = &cp
+		}
+		return nil
+	})
+	if errors.Is(err, errCanaryChanged) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if v.pass {
+		a.log.Info(comment, "service", name)
+	} else {
+		a.log.Warn(comment, "service", name)
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package canary
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+
+	"github.com/envoyage/envoyage/internal/registry"
+	"github.com/envoyage/envoyage/internal/stats"
+	"github.com/envoyage/envoyage/internal/supervisor"
+)
+
+// Blue/green switches
+//
+// POST /services/{name}/switch repoints a service's Upstream in one change
+// and, with a rollback window, records a registry.Switch. The Switcher
+// watches the service's health (see stats.NodeHealth) until the window
+// ends: a node reporting a failure cause or no healthy host switches the
+// upstream back and ends the watch, a quiet window just ends it. Health
+// scraped less than settle after the switch is ignored, since its recent
+// failures may be the old upstream's, and the Envoys may not have the new
+// one yet.
+
+// Health is the part of stats.Scraper the Switcher reads.
+type Health interface {
+	Health(name string) map[string]stats.NodeHealth
+}
+
+// SettleScrapes is how many scrape intervals after a switch its health
+// starts to count. A rollback window must be longer.
+const SettleScrapes = 2
+
+// Switcher rolls back switches whose new upstream turns unhealthy.
+type Switcher struct {
+	reg    *registry.Registry
+	health Health
+	settle time.Duration
+	log    *slog.Logger
+	now    func() time.Time
+}
+
+// NewSwitcher creates a Switcher for stats scraped every interval. Call Run
+// to start it.
+func NewSwitcher(reg *registry.Registry, h Health, interval time.Duration, log *slog.Logger) *Switcher {
+	return &Switcher{reg: reg, health: h, settle: SettleScrapes * interval, log: log, now: time.Now}
+}
+
+// Run watches until ctx is canceled. Call it in a goroutine.
+func (s *Switcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.check(ctx)
+			supervisor.Beat(ctx)
+		}
+	}
+}
+
+func (s *Switcher) check(ctx context.Context) {
+	services, _ := s.reg.Snapshot()
+	for _, svc := range services {
+		sw := svc.Switch
+		if sw == nil {
+			continue
+		}
+		var comment string
+		rollback := false
+		switch {
+		case svc.Upstream != sw.To:
+			comment = fmt.Sprintf("switch: stopped watching %s: upstream changed to %s", sw.To, svc.Upstream)
+		case s.now().After(sw.Until):
+			comment = fmt.Sprintf("switch: kept %s, healthy for %s", sw.To, sw.Until.Sub(sw.At).Round(time.Second))
+		default:
+			reason := s.unhealthy(svc.Name, sw)
+			if reason == "" {
+				continue
+			}
+			comment = fmt.Sprintf("switch: rolled back %s to %s: %s", sw.To, sw.From, reason)
+			rollback = true
+		}
+		if err := s.end(ctx, svc.Name, sw, rollback, comment); err != nil {
+			s.log.Error("switch: failed to end watch", "service", svc.Name, "error", err)
+		}
+	}
+}
+
+// unhealthy is why the service fails since the switch settled, or "".
+func (s *Switcher) unhealthy(name string, sw *registry.Switch) string {
+	nodes := s.health.Health(name)
+	ids := make([]string, 0, len(nodes))
+	for id := range nodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		h := nodes[id]
+		if h.ScrapedAt.Before(sw.At.Add(s.settle)) {
+			continue
+		}
+		switch {
+		case h.Cause != "":
+			return fmt.Sprintf("%s on %s", h.Cause, id)
+		case h.HealthyHosts == 0:
+			return fmt.Sprintf("no healthy host on %s", id)
+		}
+	}
+	return ""
+}
+
+// errSwitchChanged aborts ending a watch when the switch was replaced
+// meanwhile.
+var errSwitchChanged = errors.New("switch changed")
+
+// end clears the service's switch, first restoring its old upstream if
+// rollback is set.
+func (s *Switcher) end(ctx context.Context, name string, judged *registry.Switch, rollback bool, comment string) error {
+	err := s.reg.Modify(registry.WithComment(ctx, comment), name, func(svc *registry.Service) error {
+		if c := svc.Switch; c == nil || c.To != judged.To || !c.At.Equal(judged.At) {
+			return errSwitchChanged
+		}
+		if rollback {
+			svc.Upstream = judged.From
+		}
+		svc.Switch = nil
+		return nil
+	})
+	if errors.Is(err, errSwitchChanged) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if rollback {
+		s.log.Warn(comment, "service", name)
+	} else {
+		s.log.Info(comment, "service", name)
+	}
+	return nil
+}
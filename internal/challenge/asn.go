@@ -0,0 +1,71 @@
+package challenge
+
+import (
+	"bufio"
+	"fmt"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// asnTable maps IP ranges to autonomous system numbers.
+type asnTable struct {
+	ranges []asnRange // sorted by start, non-overlapping
+}
+
+type asnRange struct {
+	start, end netip.Addr
+	asn        uint32
+}
+
+// loadASNTable reads the iptoasn.com TSV format:
+//
+//	range_start<TAB>range_end<TAB>AS_number<TAB>country<TAB>description
+//
+// Ranges with AS number 0 (not routed) are skipped.
+func loadASNTable(path string) (*asnTable, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening asn database: %w", err)
+	}
+	defer f.Close()
+
+	t := &asnTable{}
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		fields := strings.Split(sc.Text(), "\t")
+		if len(fields) < 3 {
+			continue
+		}
+		start, err1 := netip.ParseAddr(fields[0])
+		end, err2 := netip.ParseAddr(fields[1])
+		asn, err3 := strconv.ParseUint(fields[2], 10, 32)
+		if err1 != nil || err2 != nil || err3 != nil {
+			return nil, fmt.Errorf("asn database %s:%d: malformed line", path, line)
+		}
+		if asn == 0 {
+			continue
+		}
+		t.ranges = append(t.ranges, asnRange{start: start, end: end, asn: uint32(asn)})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("reading asn database: %w", err)
+	}
+	sort.Slice(t.ranges, func(i, j int) bool { return t.ranges[i].start.Less(t.ranges[j].start) })
+	return t, nil
+}
+
+func (t *asnTable) lookup(ip netip.Addr) (uint32, bool) {
+	// First range starting after ip; the candidate is the one before it.
+	i := sort.Search(len(t.ranges), func(i int) bool { return ip.Less(t.ranges[i].start) })
+	if i == 0 {
+		return 0, false
+	}
+	r := t.ranges[i-1]
+	if ip.Compare(r.end) > 0 || ip.Is4() != r.start.Is4() {
+		return 0, false
+	}
+	return r.asn, true
+}
@@ -0,0 +1,281 @@
+// Package challenge implements the edge anti-abuse check.
+//
+// Small home servers fall over long before a scraper flood is big enough to
+// notice on the VPS. For services that opt in, the edge Envoy asks this
+// package — over gRPC ext_authz on the control plane's xDS port — whether to
+// let each request through. Suspicious clients (too many requests, a listed
+// ASN, or a matching rule) instead get a page that makes the browser solve a
+// small proof-of-work puzzle and store the answer in a cookie. Browsers pass
+// after a second or two; dumb scrapers never do.
+//
+// Cookies are stateless: the puzzle is an HMAC of the client IP and an
+// expiry time, so any control plane instance with the same secret can verify
+// them and nothing needs to be stored per client except the rate counters.
+package challenge
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/bits"
+	"net/netip"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"github.com/envoyage/envoyage/internal/config"
+	"github.com/envoyage/envoyage/internal/supervisor"
+)
+
+// CookieName holds the solved challenge, as "<expiry unix>.<nonce>".
+const CookieName = "envoyage_challenge"
+
+// Service is the ext_authz Authorization service that decides who gets
+// challenged.
+type Service struct {
+	authv3.UnimplementedAuthorizationServer
+
+	cfg    *config.Challenge
+	secret []byte
+	rules  []rule
+	asns   map[uint32]bool
+	asnDB  *asnTable
+	now    func() time.Time
+
+	mu      sync.Mutex
+	windows map[netip.Addr]*window
+}
+
+type rule struct {
+	prefix     netip.Prefix
+	userAgent  *regexp.Regexp
+	pathPrefix string
+}
+
+// window counts one client's requests in the current minute.
+type window struct {
+	start time.Time
+	count int
+}
+
+// NewService creates the challenge service from validated config.
+func NewService(cfg *config.Challenge) (*Service, error) {
+	s := &Service{
+		cfg:     cfg,
+		secret:  []byte(cfg.Secret),
+		asns:    make(map[uint32]bool),
+		now:     time.Now,
+		windows: make(map[netip.Addr]*window),
+	}
+	if len(s.secret) == 0 {
+		s.secret = make([]byte, 32)
+		if _, err := rand.Read(s.secret); err != nil {
+			return nil, fmt.Errorf("generating challenge secret: %w", err)
+		}
+	}
+	for _, r := range cfg.Rules {
+		var cr rule
+		if r.CIDR != "" {
+			cr.prefix = netip.MustParsePrefix(r.CIDR)
+		}
+		if r.UserAgent != "" {
+			cr.userAgent = regexp.MustCompile(r.UserAgent)
+		}
+		cr.pathPrefix = r.PathPrefix
+		s.rules = append(s.rules, cr)
+	}
+	for _, asn := range cfg.ASNs {
+		s.asns[asn] = true
+	}
+	if cfg.ASNDatabase != "" {
+		t, err := loadASNTable(cfg.ASNDatabase)
+		if err != nil {
+			return nil, err
+		}
+		s.asnDB = t
+	}
+	return s, nil
+}
+
+// Register adds the service to a gRPC server.
+func (s *Service) Register(g *grpc.Server) {
+	authv3.RegisterAuthorizationServer(g, s)
+}
+
+// Run drops idle rate windows until ctx is canceled.
+func (s *Service) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		cutoff := s.now().Add(-time.Minute)
+		s.mu.Lock()
+		for ip, w := range s.windows {
+			if w.start.Before(cutoff) {
+				delete(s.windows, ip)
+			}
+		}
+		s.mu.Unlock()
+		supervisor.Beat(ctx)
+	}
+}
+
+// Check implements authv3.AuthorizationServer.
+func (s *Service) Check(_ context.Context, req *authv3.CheckRequest) (*authv3.CheckResponse, error) {
+	ip, ok := clientIP(req)
+	if !ok {
+		return allow(), nil // nothing to key on; don't break the site
+	}
+	httpReq := req.GetAttributes().GetRequest().GetHttp()
+	headers := httpReq.GetHeaders()
+
+	suspicious := s.overRate(ip) || s.fromListedASN(ip) || s.matchesRule(ip, headers["user-agent"], httpReq.GetPath())
+	if !suspicious && !s.alwaysChallenge() {
+		return allow(), nil
+	}
+	if s.validCookie(ip, headers["cookie"]) {
+		return allow(), nil
+	}
+	return s.deny(ip), nil
+}
+
+// alwaysChallenge is true when no criteria are configured, so opting in
+// means "challenge everyone once".
+func (s *Service) alwaysChallenge() bool {
+	return s.cfg.Rate == 0 && len(s.asns) == 0 && len(s.rules) == 0
+}
+
+func (s *Service) overRate(ip netip.Addr) bool {
+	if s.cfg.Rate == 0 {
+		return false
+	}
+	now := s.now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w := s.windows[ip]
+	if w == nil || now.Sub(w.start) >= time.Minute {
+		w = &window{start: now}
+		s.windows[ip] = w
+	}
+	w.count++
+	return w.count > s.cfg.Rate
+}
+
+func (s *Service) fromListedASN(ip netip.Addr) bool {
+	if s.asnDB == nil || len(s.asns) == 0 {
+		return false
+	}
+	asn, ok := s.asnDB.lookup(ip)
+	return ok && s.asns[asn]
+}
+
+func (s *Service) matchesRule(ip netip.Addr, userAgent, path string) bool {
+	for _, r := range s.rules {
+		if r.prefix.IsValid() && !r.prefix.Contains(ip) {
+			continue
+		}
+		if r.userAgent != nil && !r.userAgent.MatchString(userAgent) {
+			continue
+		}
+		if r.pathPrefix != "" && !strings.HasPrefix(path, r.pathPrefix) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// puzzle returns the string the client must extend with a nonce.
+func (s *Service) puzzle(ip netip.Addr, expiry int64) string {
+	mac := hmac.New(sha256.New, s.secret)
+	fmt.Fprintf(mac, "%s|%d", ip, expiry)
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// validCookie checks a solved puzzle from the Cookie header.
+func (s *Service) validCookie(ip netip.Addr, cookieHeader string) bool {
+	value, ok := findCookie(cookieHeader, CookieName)
+	if !ok {
+		return false
+	}
+	expStr, nonce, ok := strings.Cut(value, ".")
+	if !ok {
+		return false
+	}
+	expiry, err := strconv.ParseInt(expStr, 10, 64)
+	if err != nil || s.now().Unix() > expiry || expiry > s.now().Add(s.cfg.CookieTTL).Unix() {
+		return false
+	}
+	return leadingZeroBits(sha256.Sum256([]byte(s.puzzle(ip, expiry)+nonce))) >= s.cfg.Difficulty
+}
+
+func (s *Service) deny(ip netip.Addr) *authv3.CheckResponse {
+	expiry := s.now().Add(s.cfg.CookieTTL).Unix()
+	return &authv3.CheckResponse{
+		Status: &rpcstatus.Status{Code: int32(codes.PermissionDenied)},
+		HttpResponse: &authv3.CheckResponse_DeniedResponse{
+			DeniedResponse: &authv3.DeniedHttpResponse{
+				Status: &typev3.HttpStatus{Code: typev3.StatusCode_Forbidden},
+				Headers: []*core.HeaderValueOption{
+					{Header: &core.HeaderValue{Key: "content-type", Value: "text/html; charset=utf-8"}},
+					{Header: &core.HeaderValue{Key: "cache-control", Value: "no-store"}},
+				},
+				Body: renderPage(s.puzzle(ip, expiry), expiry, s.cfg.Difficulty, s.cfg.CookieTTL),
+			},
+		},
+	}
+}
+
+func allow() *authv3.CheckResponse {
+	return &authv3.CheckResponse{
+		Status:       &rpcstatus.Status{Code: int32(codes.OK)},
+		HttpResponse: &authv3.CheckResponse_OkResponse{OkResponse: &authv3.OkHttpResponse{}},
+	}
+}
+
+// clientIP returns the downstream address the edge Envoy saw.
+func clientIP(req *authv3.CheckRequest) (netip.Addr, bool) {
+	addr, err := netip.ParseAddr(req.GetAttributes().GetSource().GetAddress().GetSocketAddress().GetAddress())
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+func findCookie(header, name string) (string, bool) {
+	for _, part := range strings.Split(header, ";") {
+		k, v, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if ok && k == name {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+func leadingZeroBits(sum [sha256.Size]byte) int {
+	n := 0
+	for _, b := range sum {
+		if b != 0 {
+			return n + bits.LeadingZeros8(b)
+		}
+		n += 8
+	}
+	return n
+}
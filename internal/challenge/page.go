@@ -0,0 +1,72 @@
+package challenge
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// renderPage returns the challenge page for one puzzle.
+//
+// The script brute-forces a nonce so that SHA-256(puzzle + nonce) starts with
+// the required number of zero bits, stores it in the cookie and reloads. It
+// carries its own SHA-256 because crypto.subtle is unavailable on plain-HTTP
+// origins, and it yields between batches so the tab stays responsive.
+func renderPage(puzzle string, expiry int64, difficulty int, ttl time.Duration) string {
+	return strings.NewReplacer(
+		"{{PUZZLE}}", puzzle,
+		"{{EXPIRY}}", strconv.FormatInt(expiry, 10),
+		"{{DIFFICULTY}}", strconv.Itoa(difficulty),
+		"{{MAXAGE}}", strconv.Itoa(int(ttl.Seconds())),
+		"{{COOKIE}}", CookieName,
+	).Replace(pageTemplate)
+}
+
+const pageTemplate = `<!doctype html>
+<html><head><meta charset="utf-8"><meta name="viewport" content="width=device-width,initial-scale=1">
+<title>Checking your browser…</title>
+<style>body{font-family:system-ui,sans-serif;max-width:32em;margin:4em auto;padding:0 1em;color:#333}</style>
+</head><body>
+<h1>One moment…</h1>
+<p id="msg">Checking your browser before accessing this site. This takes a second or two.</p>
+<noscript><p>Please enable JavaScript to continue.</p></noscript>
+<script>
+(function(){
+var P="{{PUZZLE}}",E="{{EXPIRY}}",D={{DIFFICULTY}};
+var K=[0x428a2f98,0x71374491,0xb5c0fbcf,0xe9b5dba5,0x3956c25b,0x59f111f1,0x923f82a4,0xab1c5ed5,
+0xd807aa98,0x12835b01,0x243185be,0x550c7dc3,0x72be5d74,0x80deb1fe,0x9bdc06a7,0xc19bf174,
+0xe49b69c1,0xefbe4786,0x0fc19dc6,0x240ca1cc,0x2de92c6f,0x4a7484aa,0x5cb0a9dc,0x76f988da,
+0x983e5152,0xa831c66d,0xb00327c8,0xbf597fc7,0xc6e00bf3,0xd5a79147,0x06ca6351,0x14292967,
+0x27b70a85,0x2e1b2138,0x4d2c6dfc,0x53380d13,0x650a7354,0x766a0abb,0x81c2c92e,0x92722c85,
+0xa2bfe8a1,0xa81a664b,0xc24b8b70,0xc76c51a3,0xd192e819,0xd6990624,0xf40e3585,0x106aa070,
+0x19a4c116,0x1e376c08,0x2748774c,0x34b0bcb5,0x391c0cb3,0x4ed8aa4a,0x5b9cca4f,0x682e6ff3,
+0x748f82ee,0x78a5636f,0x84c87814,0x8cc70208,0x90befffa,0xa4506ceb,0xbef9a3f7,0xc67178f2];
+function sha256(s){
+var H=[0x6a09e667,0xbb67ae85,0x3c6ef372,0xa54ff53a,0x510e527f,0x9b05688c,0x1f83d9ab,0x5be0cd19];
+var m=[],l=s.length*8,i,j;
+for(i=0;i<s.length;i++)m[i>>2]|=s.charCodeAt(i)<<(24-(i%4)*8);
+m[l>>5]|=0x80<<(24-l%32);m[((l+64>>9)<<4)+15]=l;
+for(i=0;i<m.length;i+=16){
+var a=H.slice(0),w=[];
+for(j=0;j<64;j++){
+if(j<16)w[j]=m[i+j]|0;else{var x=w[j-15],y=w[j-2];
+w[j]=(((x>>>7|x<<25)^(x>>>18|x<<14)^(x>>>3))+w[j-7]+((y>>>17|y<<15)^(y>>>19|y<<13)^(y>>>10))+w[j-16])|0;}
+var e=a[4],b=a[0];
+var t1=(a[7]+((e>>>6|e<<26)^(e>>>11|e<<21)^(e>>>25|e<<7))+((e&a[5])^(~e&a[6]))+K[j]+w[j])|0;
+var t2=(((b>>>2|b<<30)^(b>>>13|b<<19)^(b>>>22|b<<10))+((b&a[1])^(b&a[2])^(a[1]&a[2])))|0;
+a=[(t1+t2)|0,a[0],a[1],a[2],(a[3]+t1)|0,a[4],a[5],a[6]];}
+for(j=0;j<8;j++)H[j]=(H[j]+a[j])|0;}
+return H;}
+function zeros(h){var n=0;for(var i=0;i<8;i++){var w=h[i]>>>0;if(w){return n+Math.clz32(w);}n+=32;}return n;}
+var nonce=0;
+function work(){
+for(var end=nonce+5000;nonce<end;nonce++){
+if(zeros(sha256(P+nonce))>=D){
+document.cookie="{{COOKIE}}="+E+"."+nonce+"; path=/; max-age={{MAXAGE}}; SameSite=Lax";
+location.reload();return;}}
+setTimeout(work,0);}
+work();
+})();
+</script>
+</body></html>
+`
@@ -0,0 +1,1716 @@
+// Package config loads the control plane's static configuration.
+//
+// Configuration is a single YAML file (JSON works too — it is valid YAML)
+// whose path is given by the ENVOYAGE_CONFIG environment variable. Every field
+// is optional: with no file at all the control plane runs the two-node
+// home/VPS setup from docker-compose.yml.
+//
+// Example:
+//
+//	nodes:
+//	  - id: envoyage-envoy-home
+//	    profile: envoy-1.28   # old Envoy on the ARM NAS
+//	  - id: envoyage-envoy-vps
+package config
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the root of the configuration file.
+type Config struct {
+	// Nodes lists the Envoy instances this control plane manages from startup.
+	// More can be registered at runtime with POST /nodes.
+	// Each gets a tailored snapshot; see xds.SnapshotBuilder.
+	Nodes []Node `yaml:"nodes"`
+
+	// HomeIngress is the address (host:port) edge nodes send all traffic
+	// to: the home Envoy's listener, over the WireGuard or Tailscale tunnel
+	// in production. Defaults to envoy-home:10000 for Docker Compose.
+	HomeIngress string `yaml:"home_ingress"`
+
+	// Fallback makes edge nodes answer with a static page while home is
+	// unreachable, instead of letting requests hang until they time out.
+	// Nil disables it.
+	Fallback *Fallback `yaml:"fallback,omitempty"`
+
+	// CatchAll answers requests for hosts no service has, on every node.
+	// Nil leaves them to Envoy, which answers a bare 404.
+	CatchAll *CatchAll `yaml:"catch_all,omitempty"`
+
+	// ErrorPages replaces the bodies of the errors Envoy answers itself,
+	// on every node. Nil keeps Envoy's terse defaults.
+	ErrorPages *ErrorPages `yaml:"error_pages,omitempty"`
+
+	// TLS terminates HTTPS on the edge nodes, optionally checking client
+	// certificates. Nil leaves TLS to whatever sits in front of them.
+	TLS *TLS `yaml:"tls,omitempty"`
+
+	// Privacy configures privacy mode, which keeps personal data of
+	// visitors out of stored request data. Nil leaves it to the services
+	// that set privacy, with the defaults.
+	Privacy *Privacy `yaml:"privacy,omitempty"`
+
+	// Cache lets the edges cache responses of the services that opt in, on
+	// disk. Nil disables it.
+	Cache *Cache `yaml:"cache,omitempty"`
+
+	// Wasm configures Wasm filter modules, uploaded with PUT /wasm/{name}
+	// and run for every service or for the services that list them.
+	Wasm Wasm `yaml:"wasm,omitempty"`
+
+	// API protects the management API with an admin token. Nil leaves it
+	// open, which is only safe while it listens on a trusted network.
+	API *API `yaml:"api,omitempty"`
+
+	// Stats configures how per-service stats are collected from the Envoys.
+	Stats Stats `yaml:"stats"`
+
+	// History keeps each service's request, error and latency history for
+	// the dashboard, so there is some without Prometheus.
+	History History `yaml:"history"`
+
+	// Docker configures discovery of services from container labels.
+	Docker Docker `yaml:"docker,omitempty"`
+
+	// Kubernetes configures discovery of services from Ingresses in a
+	// cluster. Nil disables it.
+	Kubernetes *Kubernetes `yaml:"kubernetes,omitempty"`
+
+	// Files configures loading services from a directory of definition
+	// files. Nil disables it.
+	Files *Files `yaml:"files,omitempty"`
+
+	// DNSCheck periodically checks that public services' domains point at
+	// the edges. Nil disables it.
+	DNSCheck *DNSCheck `yaml:"dns_check,omitempty"`
+
+	// ExtAuthz configures the external authorization service (Authelia,
+	// oauth2-proxy, ...) used by services that set ext_authz. Nil disables it.
+	ExtAuthz *ExtAuthz `yaml:"ext_authz,omitempty"`
+
+	// Challenge configures the edge anti-abuse challenge used by services
+	// that set challenge. Nil disables it.
+	Challenge *Challenge `yaml:"challenge,omitempty"`
+
+	// Namespaces define shared defaults and bounds for groups of services,
+	// keyed by namespace name.
+	Namespaces map[string]Namespace `yaml:"namespaces,omitempty"`
+
+	// Validation enables pre-flight checks of every snapshot against a
+	// throwaway Envoy before production nodes see it. Nil disables it.
+	Validation *Validation `yaml:"validation,omitempty"`
+
+	// Tracing configures OpenTelemetry tracing of the control plane and of
+	// requests through the managed Envoys.
+	Tracing Tracing `yaml:"tracing,omitempty"`
+
+	// Store persists registered services across restarts.
+	Store Store `yaml:"store,omitempty"`
+
+	// HA runs this instance as one of two (or more) sharing the store,
+	// for a control plane that survives one of them going down. Nil runs
+	// it alone.
+	HA *HA `yaml:"ha,omitempty"`
+
+	// Sources decides which source keeps a service name that more than one
+	// registers: the API, the file provider, Kubernetes or Docker.
+	Sources Sources `yaml:"sources,omitempty"`
+
+	// Drain controls how removed services are taken out of the Envoys.
+	Drain Drain `yaml:"drain,omitempty"`
+
+	// DNS tunes how the home node resolves upstream hostnames. Nil keeps
+	// Envoy's defaults and the host's resolv.conf.
+	DNS *DNS `yaml:"dns,omitempty"`
+
+	// Portal enables the self-service portal for namespace members at
+	// /portal/ on the management API. Nil disables it.
+	Portal *Portal `yaml:"portal,omitempty"`
+
+	// Bootstrap sets defaults for bootstraps generated by
+	// GET /nodes/{id}/bootstrap.
+	Bootstrap Bootstrap `yaml:"bootstrap,omitempty"`
+
+	// Hooks runs a Starlark script on control plane events, for
+	// notifications and automation. Nil disables it.
+	Hooks *Hooks `yaml:"hooks,omitempty"`
+
+	// Webhooks are POSTed a notice of registry changes, NACKs,
+	// disconnected nodes, unhealthy upstreams and certificates; see
+	// package webhook.
+	Webhooks []Webhook `yaml:"webhooks,omitempty"`
+
+	// Notify sends notices of the same events to ntfy, Gotify and e-mail;
+	// see package notify. Nil sends none.
+	Notify *Notify `yaml:"notify,omitempty"`
+}
+
+// Client address treatments of privacy mode.
+const (
+	ClientIPTruncate = "truncate"
+	ClientIPHash     = "hash"
+)
+
+// Privacy keeps personal data of visitors out of what the control plane
+// stores about requests, its trace exemplars: client addresses are
+// truncated or hashed, authenticated user names dropped and query strings,
+// where apps put tokens and e-mail addresses, cut from paths. Metrics are
+// labeled by service and node only, so they hold none to begin with.
+type Privacy struct {
+	// All puts every service in privacy mode, not just those that set
+	// privacy.
+	All bool `yaml:"all,omitempty"`
+
+	// ClientIP is ClientIPTruncate (the default), keeping the /24 (IPv4)
+	// or /48 (IPv6) network, or ClientIPHash, replacing the address with
+	// a hash that is the same for the same client until the control plane
+	// restarts.
+	ClientIP string `yaml:"client_ip,omitempty"`
+}
+
+// Cache is the edges' response cache, shared by every service that sets
+// cache. Responses are stored as far as their Cache-Control allows.
+type Cache struct {
+	// Directory holds the cache on the edge hosts (or in their
+	// containers). It must exist and be writable by Envoy. Defaults to
+	// /var/cache/envoyage.
+	Directory string `yaml:"directory,omitempty"`
+
+	// MaxSize caps the cache, in bytes. Defaults to 1 GiB.
+	MaxSize int64 `yaml:"max_size,omitempty"`
+}
+
+// Wasm configures how uploaded Wasm filter modules are kept and delivered
+// to the nodes.
+type Wasm struct {
+	// Directory holds the uploaded modules. Defaults to "wasm" next to
+	// store.path; empty (no store either) keeps them in memory only, so
+	// they have to be uploaded again after a restart.
+	Directory string `yaml:"directory,omitempty"`
+
+	// URL is the management API as the nodes reach it, e.g.
+	// http://10.8.0.1:8080. Modules larger than InlineMax are fetched by
+	// Envoy from there, checked against their SHA-256, rather than sent
+	// inline with every config update. Empty inlines every module.
+	URL string `yaml:"url,omitempty"`
+
+	// InlineMax is the largest module sent inline when URL is set, in
+	// bytes. Defaults to 1 MiB.
+	InlineMax int64 `yaml:"inline_max,omitempty"`
+
+	// Filters run for every service, in order, before the services' own.
+	Filters []WasmFilter `yaml:"filters,omitempty"`
+}
+
+// WasmFilter runs an uploaded Wasm module as an HTTP filter.
+type WasmFilter struct {
+	// Module is the name the module was uploaded under.
+	Module string `yaml:"module"`
+
+	// RootID selects the plugin's root context, for modules with several.
+	RootID string `yaml:"root_id,omitempty"`
+
+	// Config is handed to the plugin as its configuration, as is.
+	Config string `yaml:"config,omitempty"`
+
+	// Edge runs the filter on the edges instead of the home node.
+	Edge bool `yaml:"edge,omitempty"`
+
+	// FailOpen lets requests through while the plugin is broken, rather
+	// than answering 503.
+	FailOpen bool `yaml:"fail_open,omitempty"`
+}
+
+// Fallback is the edges' answer while home (the tunnel or the home Envoy)
+// is down. Each edge probes home_ingress itself and switches on its own:
+// xDS runs over the same tunnel, so the control plane could not switch the
+// edges over once it is down.
+type Fallback struct {
+	// Status of the fallback response. Defaults to 503.
+	Status int `yaml:"status,omitempty"`
+
+	// Body of the fallback response, as HTML. Defaults to a short notice.
+	Body string `yaml:"body,omitempty"`
+
+	// ProbeInterval is how often each edge checks that home accepts
+	// connections. Two failed probes switch to the fallback, one passing
+	// probe switches back. Defaults to 5s.
+	ProbeInterval time.Duration `yaml:"probe_interval,omitempty"`
+}
+
+// CatchAll actions.
+const (
+	CatchAllNotFound = "not_found"
+	CatchAllRedirect = "redirect"
+	CatchAllService  = "service"
+)
+
+// CatchAll is the answer to a request whose Host matches no service's
+// domain, alias or wildcard.
+type CatchAll struct {
+	// Action is CatchAllNotFound (the default), answering 404 with Body;
+	// CatchAllRedirect, sending visitors to Redirect, e.g. a landing page;
+	// or CatchAllService, serving them Service as if they had asked for
+	// its domain, with its access rules and placement.
+	Action string `yaml:"action,omitempty"`
+
+	// Body of the not_found response, as HTML. Defaults to
+	// error_pages.not_found, or a short notice.
+	Body string `yaml:"body,omitempty"`
+
+	// Redirect is the http(s) URL of the redirect action.
+	Redirect string `yaml:"redirect,omitempty"`
+
+	// Service is the name of the service action's service.
+	Service string `yaml:"service,omitempty"`
+}
+
+// ErrorPages are HTML bodies for the errors Envoy answers itself. Empty
+// ones keep Envoy's. The status codes stay as they are.
+type ErrorPages struct {
+	// NotFound is the body of a 404 for a path or host no route matches.
+	NotFound string `yaml:"not_found,omitempty"`
+
+	// Unavailable is the body of a 503 or 504 for an upstream that can't
+	// be reached, is at its concurrency limit or times out.
+	Unavailable string `yaml:"unavailable,omitempty"`
+}
+
+// TLS is the edges' HTTPS listener. The files are read by Envoy, so the
+// paths are on the edge hosts (or in their containers), and on the
+// validation Envoy if there is one.
+type TLS struct {
+	// Port of the HTTPS listener. Defaults to 10443.
+	Port uint32 `yaml:"port,omitempty"`
+
+	// CertChain and PrivateKey are the PEM files of the server certificate.
+	CertChain  string `yaml:"cert_chain"`
+	PrivateKey string `yaml:"private_key"`
+
+	// ClientCA, if set, is a PEM bundle of CAs that client certificates
+	// are verified against, enabling mutual TLS. Services choose whether
+	// the verified identity reaches them (see registry.ClientCert).
+	ClientCA string `yaml:"client_ca,omitempty"`
+
+	// RequireClientCert rejects clients without a valid certificate.
+	// Without it a certificate is optional. Requires ClientCA.
+	RequireClientCert bool `yaml:"require_client_cert,omitempty"`
+
+	// EdgeSecret is sent by the edges with the client identity so the home
+	// node can tell it from a LAN client's forgery. If empty a random one
+	// is generated at startup, which HA rules out: every instance must send
+	// the same.
+	EdgeSecret string `yaml:"edge_secret,omitempty"`
+
+	// HTTP3 also serves HTTPS over QUIC, on the same port number but UDP,
+	// and advertises it to clients. Nil serves HTTP/1.1 and HTTP/2 only.
+	HTTP3 *HTTP3 `yaml:"http3,omitempty"`
+}
+
+// HTTP3 is the edges' QUIC listener. Envoy doesn't check client
+// certificates over QUIC, so it can't be combined with ClientCA; services
+// whose TLS policy asks for client certificates aren't offered it.
+type HTTP3 struct {
+	// AdvertisedPort is the UDP port clients reach the listener on, for
+	// the Alt-Svc header. Defaults to 443, for Port published as 443.
+	AdvertisedPort uint32 `yaml:"advertised_port,omitempty"`
+
+	// MaxAge is how long clients may remember that HTTP/3 is available.
+	// Defaults to 24h.
+	MaxAge time.Duration `yaml:"max_age,omitempty"`
+}
+
+// API configures access to the management API.
+type API struct {
+	// TokenSHA256 is the hex SHA-256 of the admin token that requests must
+	// carry as "Authorization: Bearer <token>". /healthz, /readyz and the
+	// portal, which has its own users, are exempt.
+	TokenSHA256 string `yaml:"token_sha256"`
+}
+
+// Bootstrap configures generated node bootstraps.
+type Bootstrap struct {
+	// XDSAddress is the control plane's xDS address (host:port) as new
+	// nodes reach it, e.g. its WireGuard IP. Defaults to controlplane:9090,
+	// the Docker Compose service.
+	XDSAddress string `yaml:"xds_address"`
+}
+
+// Portal lets non-admin users manage the services in their namespaces:
+// toggle maintenance mode, see traffic and hand out share links. Nothing
+// else of the management API is reachable with a portal token.
+type Portal struct {
+	Users []PortalUser `yaml:"users"`
+
+	// MaxShareTTL caps how long a share link may be valid. Defaults to 7
+	// days.
+	MaxShareTTL time.Duration `yaml:"max_share_ttl,omitempty"`
+}
+
+// PortalUser is one portal login.
+type PortalUser struct {
+	Name string `yaml:"name"`
+
+	// TokenSHA256 is the hex SHA-256 of the user's access token, so the
+	// config never holds the token itself. Generate a pair with
+	//
+	//	t=$(openssl rand -hex 24); echo "$t"; printf %s "$t" | sha256sum
+	TokenSHA256 string `yaml:"token_sha256"`
+
+	// Namespaces whose services the user may manage.
+	Namespaces []string `yaml:"namespaces"`
+}
+
+// DNS configures resolution of upstream hostnames on the home node.
+//
+// Each upstream cluster resolves its hostname in the background and serves
+// requests from the last answer, so a slow or failing DNS server never adds
+// latency to a request; these settings decide how fresh that answer is.
+type DNS struct {
+	// Resolvers are DNS servers (ip:port, or ip for port 53) to use instead
+	// of the system's, e.g. the LAN router that knows local hostnames.
+	Resolvers []string `yaml:"resolvers,omitempty"`
+
+	// RefreshRate is how often each hostname is re-resolved. Defaults to 30s.
+	RefreshRate time.Duration `yaml:"refresh_rate,omitempty"`
+
+	// RespectTTL re-resolves when the record's TTL expires instead of at
+	// RefreshRate.
+	RespectTTL bool `yaml:"respect_ttl,omitempty"`
+
+	// FailureRefreshBase and FailureRefreshMax bound the backoff between retries after a failed
+	// resolution. Default 1s to 30s.
+	FailureRefreshBase time.Duration `yaml:"failure_refresh_base,omitempty"`
+	FailureRefreshMax  time.Duration `yaml:"failure_refresh_max,omitempty"`
+
+	// LookupFamily is one of auto, v4_only, v6_only, v4_preferred or all.
+	// Defaults to v4_preferred, which suits most home LANs.
+	LookupFamily string `yaml:"lookup_family,omitempty"`
+}
+
+// DNSLookupFamilies are the accepted DNS.LookupFamily values.
+var DNSLookupFamilies = []string{"auto", "v4_only", "v6_only", "v4_preferred", "all"}
+
+// Service sources, in their default precedence.
+var ServiceSources = []string{"file", "api", "kubernetes", "docker"}
+
+// Sources controls conflicts between service sources.
+type Sources struct {
+	// Conflict is the policy for a service name another source already
+	// registered: "precedence" (the default) lets a source take it over
+	// from the sources after it in Precedence, "first" keeps it with the
+	// source that registered it, and "last" lets any source replace it.
+	// A refused registration is logged, or answered 409 by the API.
+	Conflict string `yaml:"conflict,omitempty"`
+
+	// Precedence lists sources strongest first. Sources left out come
+	// last. Defaults to ServiceSources: files are declared state, the API
+	// overrides discovery, and Kubernetes is more deliberate than a
+	// container label.
+	Precedence []string `yaml:"precedence,omitempty"`
+}
+
+// Drain configures graceful removal of services.
+type Drain struct {
+	// Grace is how long a removed service's cluster is kept, without a
+	// route, so requests in flight can finish. 0 removes it immediately.
+	// Defaults to 30s.
+	Grace time.Duration `yaml:"grace"`
+}
+
+// HA configures high availability. Every instance runs with the same
+// config and store.path on storage they share (one host's volume, or NFSv4
+// with locking), and serves xDS. One, the leader, holds a lock next to the
+// store and makes all changes: it alone runs the Docker and Kubernetes
+// watchers, the file provider and canary analysis, and accepts changes
+// through the API. The others, standbys, reload the store as the leader
+// writes it, answer changes with 503, and take over the lock if the leader
+// dies. Snapshot versions are hashes of their contents, so a node that
+// fails over to another instance finds itself in sync; that needs the
+// instances to render the same snapshots, so nothing in them may be made
+// up per instance (tls.edge_secret must be set).
+type HA struct {
+	// ID names this instance in logs and in the lock. Defaults to the
+	// hostname.
+	ID string `yaml:"id,omitempty"`
+
+	// PollInterval is how often a standby tries the lock and reloads the
+	// store. Defaults to 2s.
+	PollInterval time.Duration `yaml:"poll_interval,omitempty"`
+}
+
+// Store configures the on-disk service store.
+type Store struct {
+	// Path of the JSON store file. Empty keeps services in memory only, so
+	// API registrations are lost on restart.
+	Path string `yaml:"path,omitempty"`
+
+	// AutoMigrate upgrades an older store on startup, after backing it up.
+	// When false the control plane refuses to start until
+	// "envoyagectl db migrate" has been run. Defaults to true.
+	AutoMigrate bool `yaml:"auto_migrate"`
+
+	// Schedule is the file holding changes scheduled for later (POST
+	// /scheduled). Defaults to "scheduled.json" next to Path; empty (no
+	// store either) keeps them in memory only.
+	Schedule string `yaml:"schedule,omitempty"`
+}
+
+// Tracing configures OpenTelemetry. Both halves are independent and off by
+// default.
+type Tracing struct {
+	// Endpoint is the OTLP/HTTP collector (host:port) the control plane
+	// exports its own spans to: API calls, registry mutations and snapshot
+	// builds. Empty disables control plane tracing.
+	Endpoint string `yaml:"endpoint,omitempty"`
+
+	// Envoy enables request tracing in every managed Envoy. Nil disables it.
+	Envoy *EnvoyTracing `yaml:"envoy,omitempty"`
+}
+
+// EnvoyTracing makes each Envoy export request spans over OTLP/gRPC. Trace
+// context is propagated with W3C traceparent headers, so one trace covers
+// edge → home → app (if the app propagates it further).
+type EnvoyTracing struct {
+	// Collector is the OTLP/gRPC collector (host:port), reachable from
+	// every node.
+	Collector string `yaml:"collector"`
+
+	// SamplePercent of requests that start a new trace. Defaults to 100.
+	SamplePercent float64 `yaml:"sample_percent,omitempty"`
+
+	// TraceURL links a trace ID to the tracing backend's UI, with
+	// {trace_id} replaced, e.g. http://jaeger:16686/trace/{trace_id}.
+	// Empty lists exemplars without links.
+	TraceURL string `yaml:"trace_url,omitempty"`
+
+	// SlowThreshold is the request duration from which a traced request is
+	// kept as a slow exemplar. Failed (5xx) requests are kept regardless.
+	// Defaults to 1s.
+	SlowThreshold time.Duration `yaml:"slow_threshold,omitempty"`
+}
+
+// Validation points at a spare Envoy that receives each candidate snapshot
+// first. A snapshot it rejects (NACK) or fails to load within Timeout is
+// never pushed to the real nodes.
+type Validation struct {
+	// NodeID is the node.id in the validation Envoy's bootstrap. It must not
+	// be one of Nodes.
+	NodeID string `yaml:"node_id"`
+
+	// Timeout bounds how long to wait for the validation Envoy to accept one
+	// snapshot. Defaults to 10s.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+
+	// Required rejects every change while the validation Envoy is not
+	// connected. By default changes go through unvalidated (with a warning).
+	Required bool `yaml:"required,omitempty"`
+}
+
+// Namespace is a group of services — typically one person's or one
+// project's apps — managed under common limits. Services inherit Defaults
+// and may override them only within Bounds.
+type Namespace struct {
+	Defaults ServiceDefaults `yaml:"defaults,omitempty"`
+	Bounds   ServiceBounds   `yaml:"bounds,omitempty"`
+}
+
+// ServiceDefaults are inherited by services that leave a setting unset.
+type ServiceDefaults struct {
+	RateLimit    int    `yaml:"rate_limit,omitempty"`     // requests/second per node; 0 = unlimited
+	MaxBodyBytes int64  `yaml:"max_body_bytes,omitempty"` // 0 = unlimited
+	Exposure     string `yaml:"exposure,omitempty"`       // "public" (default) or "lan"
+}
+
+// ServiceBounds limit what a service may set. Zero values impose no bound.
+type ServiceBounds struct {
+	MaxRateLimit    int      `yaml:"max_rate_limit,omitempty"`
+	MaxBodyBytes    int64    `yaml:"max_body_bytes,omitempty"`
+	AllowedExposure []string `yaml:"allowed_exposure,omitempty"`
+}
+
+// Challenge configures the proof-of-work page the edge serves to suspicious
+// clients. The check runs in the control plane; see package challenge.
+//
+// A client is suspicious if it exceeds Rate, comes from one of ASNs, or
+// matches any of Rules. With none of those set, every client of an opted-in
+// service is challenged once.
+type Challenge struct {
+	// Difficulty is the number of leading zero bits the client must find in
+	// a SHA-256 hash. Each extra bit doubles the work. Defaults to 16.
+	Difficulty int `yaml:"difficulty,omitempty"`
+
+	// CookieTTL is how long a solved challenge is honored. Defaults to 24h.
+	CookieTTL time.Duration `yaml:"cookie_ttl,omitempty"`
+
+	// Secret signs challenges. If empty a random one is generated at
+	// startup, which invalidates all cookies on restart.
+	Secret string `yaml:"secret,omitempty"`
+
+	// Rate is the number of requests per minute a client IP may make before
+	// it is challenged. 0 disables rate-based challenges.
+	Rate int `yaml:"rate,omitempty"`
+
+	// ASNs lists networks whose clients are always challenged. Requires
+	// ASNDatabase.
+	ASNs []uint32 `yaml:"asns,omitempty"`
+
+	// ASNDatabase is an IP-to-ASN table in the iptoasn.com TSV format
+	// (range_start, range_end, asn, ...).
+	ASNDatabase string `yaml:"asn_database,omitempty"`
+
+	// Rules challenge clients matching any rule.
+	Rules []ChallengeRule `yaml:"rules,omitempty"`
+
+	// Timeout bounds each check call from Envoy. If the control plane does
+	// not answer in time the request is let through. Defaults to 250ms.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+}
+
+// ChallengeRule matches requests on every field that is set.
+type ChallengeRule struct {
+	CIDR       string `yaml:"cidr,omitempty"`        // client address range
+	UserAgent  string `yaml:"user_agent,omitempty"`  // RE2 regex
+	PathPrefix string `yaml:"path_prefix,omitempty"` // request path prefix
+}
+
+// ExtAuthz points Envoy's ext_authz filter at an HTTP auth service.
+//
+// Authelia:      upstream: authelia:9091, path_prefix: /api/authz/ext-authz
+// oauth2-proxy:  upstream: oauth2-proxy:4180, path_prefix: /oauth2/auth
+type ExtAuthz struct {
+	// Upstream is the auth service as host:port, reachable from the home node.
+	Upstream string `yaml:"upstream"`
+
+	// PathPrefix is prepended to the original request path in check requests.
+	PathPrefix string `yaml:"path_prefix,omitempty"`
+
+	// Timeout bounds each check request. Defaults to 1s.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+}
+
+// HomeNodeID is the ID of the home node, the one next to the apps. Every
+// other node is an edge.
+const HomeNodeID = "envoyage-envoy-home"
+
+// OnEdges reports whether a service placed on nodes (registry.Service.Nodes;
+// empty for all) is served by any edge.
+func OnEdges(nodes []string) bool {
+	return len(nodes) == 0 || slices.ContainsFunc(nodes, func(id string) bool { return id != HomeNodeID })
+}
+
+// Node describes one managed Envoy.
+type Node struct {
+	// ID must match node.id in the Envoy's bootstrap config.
+	ID string `yaml:"id"`
+
+	// Profile selects the resource generation profile for this node's Envoy
+	// version (see xds.Profiles). Empty means the newest profile.
+	Profile string `yaml:"profile,omitempty"`
+
+	// Admin is the host:port of this Envoy's admin interface, as reachable
+	// from the control plane. Used to pull stats. Empty disables polling.
+	Admin string `yaml:"admin,omitempty"`
+
+	// Role is empty for the home node and the edges, which are told apart
+	// by ID, or "staging": a shadow edge that gets the same snapshot as the
+	// edges on test ports, for trying changes through a hosts-file
+	// override before they reach real users.
+	Role string `yaml:"role,omitempty"`
+
+	// HTTPPort and HTTPSPort move the node's listeners. They default to
+	// 10000 and tls.port, or 18000 and 18443 for a staging node, so it can
+	// share a host with an edge.
+	HTTPPort  uint32 `yaml:"http_port,omitempty"`
+	HTTPSPort uint32 `yaml:"https_port,omitempty"`
+
+	// IPFamily is what the node's listeners bind: ipv4 (the default),
+	// ipv6, or dual for both, e.g. for an edge on a VPS with a public IPv6
+	// address. The host must have the family, or Envoy rejects the
+	// listeners.
+	IPFamily string `yaml:"ip_family,omitempty"`
+}
+
+// NodeRoleStaging is Node.Role of a staging edge.
+const NodeRoleStaging = "staging"
+
+// Node.IPFamily values.
+const (
+	IPFamilyIPv4 = "ipv4"
+	IPFamilyIPv6 = "ipv6"
+	IPFamilyDual = "dual"
+)
+
+// IPFamilies are the accepted Node.IPFamily values.
+var IPFamilies = []string{IPFamilyIPv4, IPFamilyIPv6, IPFamilyDual}
+
+// Where per-service Envoy stats come from.
+const (
+	// StatsSourceAdmin polls every node's admin /stats.
+	StatsSourceAdmin = "admin"
+	// StatsSourceMetricsService has every Envoy stream its stats to the
+	// control plane's xDS port, with Envoy's metrics service sink, so the
+	// admin interfaces needn't be reachable from the control plane.
+	StatsSourceMetricsService = "metrics_service"
+)
+
+// Stats controls how Envoy stats are collected.
+type Stats struct {
+	// Source is admin (the default) or metrics_service. Bootstraps the
+	// control plane generates stream at the interval with metrics_service;
+	// hand-written ones need the stats_sinks in envoy/bootstrap-*.yaml.
+	Source string `yaml:"source,omitempty"`
+
+	// Interval between polls of every node's admin /stats, or between the
+	// samples kept of a metrics service stream. Defaults to 15s.
+	Interval time.Duration `yaml:"interval,omitempty"`
+
+	// Series is how many recent samples of every service's counters are
+	// kept per node, in memory. Defaults to 240: an hour at the default
+	// interval.
+	Series int `yaml:"series,omitempty"`
+}
+
+// History controls the built-in metrics history.
+type History struct {
+	// Directory holds the history, one file per day. Defaults to "history"
+	// next to store.path; empty (no store either) keeps it in memory only,
+	// so it starts over on restart.
+	Directory string `yaml:"directory,omitempty"`
+
+	// Step is the resolution: how often each service's counters are
+	// sampled. At least stats.interval. Defaults to 1m.
+	Step time.Duration `yaml:"step,omitempty"`
+
+	// Retention is how long samples are kept. Defaults to 7 days.
+	Retention time.Duration `yaml:"retention,omitempty"`
+}
+
+// Container engines the watcher can discover services from.
+const (
+	EngineDocker = "docker"
+	EnginePodman = "podman"
+)
+
+// Docker controls the Docker watcher.
+type Docker struct {
+	// Engine is "docker" (the default) or "podman". Podman is talked to
+	// through its Docker-compatible API; see Host and PublishedHost.
+	Engine string `yaml:"engine,omitempty"`
+
+	// Host is the engine's API address, e.g.
+	// unix:///run/user/1000/podman/podman.sock. Empty uses DOCKER_HOST, or
+	// for Podman CONTAINER_HOST or the first of the rootless and rootful
+	// sockets that exists.
+	Host string `yaml:"host,omitempty"`
+
+	// PublishedHost is where the home Envoy reaches ports a container
+	// published on a wildcard address: with UseHostPort, and for Podman,
+	// whose rootless containers on the default network have no IP
+	// reachable from outside, only published ports. Defaults to 127.0.0.1.
+	PublishedHost string `yaml:"published_host,omitempty"`
+
+	// ReconcileInterval is how often the watcher lists running containers
+	// and corrects the registry, in case events were missed (the watcher
+	// was disconnected, or a container changed while the control plane was
+	// down). Defaults to 5m.
+	ReconcileInterval time.Duration `yaml:"reconcile_interval,omitempty"`
+
+	// StrictLabels reports envoyage.* labels the watcher doesn't know,
+	// e.g. a typoed envoyage.domian, in the log, the
+	// envoyage_docker_label_problems metric and GET /diagnostics, instead
+	// of ignoring them.
+	StrictLabels bool `yaml:"strict_labels,omitempty"`
+
+	// IgnoreHealth registers containers whatever their Docker healthcheck
+	// reports. By default a container with a healthcheck is registered
+	// once it is healthy, and its services are removed while it is
+	// unhealthy.
+	IgnoreHealth bool `yaml:"ignore_health,omitempty"`
+
+	// UseHostPort registers containers at the ports they publish on
+	// PublishedHost rather than at their IPs, for a home Envoy on the host
+	// network that can't reach container networks. A container's
+	// envoyage.use_host_port label overrides it.
+	UseHostPort bool `yaml:"use_host_port,omitempty"`
+
+	// Network is the network whose address containers are registered
+	// with, unless their envoyage.network label names another. Empty
+	// prefers a network whose name contains "envoyage", then any.
+	Network string `yaml:"network,omitempty"`
+
+	// Projects, if set, limits discovery to containers of these Docker
+	// Compose projects (their com.docker.compose.project label), and
+	// ExcludeProjects leaves those out: on a shared host, an unrelated
+	// project's envoyage.enable label then publishes nothing.
+	Projects        []string `yaml:"projects,omitempty"`
+	ExcludeProjects []string `yaml:"exclude_projects,omitempty"`
+
+	// Networks, if set, limits discovery to containers attached to one of
+	// these networks, and routes to their address on it. ExcludeNetworks
+	// leaves out containers attached to any of those.
+	Networks        []string `yaml:"networks,omitempty"`
+	ExcludeNetworks []string `yaml:"exclude_networks,omitempty"`
+
+	// Hosts are engines on other machines to discover containers on too,
+	// each by its own watcher, without running a control plane or agent
+	// there. The settings above apply to them unless overridden.
+	Hosts []DockerHost `yaml:"hosts,omitempty"`
+}
+
+// DockerHost is a remote Docker or Podman engine.
+type DockerHost struct {
+	// Name identifies the host in the change history, logs and metrics,
+	// e.g. "nas". Lowercase letters, digits and hyphens.
+	Name string `yaml:"name"`
+
+	// Host is the engine's API address: tcp://nas.lan:2376, or
+	// ssh://user@nas.lan to run "docker system dial-stdio" there over ssh,
+	// authenticating with the control plane's ssh keys and agent.
+	Host string `yaml:"host"`
+
+	// Engine is "docker" or "podman". Defaults to docker.engine.
+	Engine string `yaml:"engine,omitempty"`
+
+	// CertPath is a directory with ca.pem, cert.pem and key.pem to talk
+	// TLS to a tcp:// host, as DOCKER_CERT_PATH.
+	CertPath string `yaml:"cert_path,omitempty"`
+
+	// Address is where the home Envoy reaches the machine. Set, services
+	// go to the ports containers published on it, since their own IPs are
+	// only reachable from that machine; empty uses the container IPs, for
+	// a network routed to the home Envoy.
+	Address string `yaml:"address,omitempty"`
+
+	// Nodes limits the host's services to these nodes, unless their
+	// envoyage.nodes label says otherwise.
+	Nodes []string `yaml:"nodes,omitempty"`
+}
+
+// Kubernetes controls the Ingress watcher.
+type Kubernetes struct {
+	// APIServer is the API server's URL. Empty uses the in-cluster address
+	// (KUBERNETES_SERVICE_HOST) and service account.
+	APIServer string `yaml:"api_server,omitempty"`
+
+	// TokenFile and CAFile authenticate to the API server. They default to
+	// the service account's token and CA.
+	TokenFile string `yaml:"token_file,omitempty"`
+	CAFile    string `yaml:"ca_file,omitempty"`
+
+	// Namespace limits discovery to one namespace. Empty watches all.
+	Namespace string `yaml:"namespace,omitempty"`
+
+	// ResyncInterval is how often the watcher re-lists Ingresses, like
+	// Docker.ReconcileInterval. Defaults to 5m.
+	ResyncInterval time.Duration `yaml:"resync_interval,omitempty"`
+}
+
+// Files controls the file provider.
+type Files struct {
+	// Directory holds the definitions: *.yaml, *.yml and *.json files,
+	// each with one service or a list of them in the format of
+	// POST /services. Subdirectories are not read.
+	Directory string `yaml:"directory"`
+
+	// PollInterval is how often the directory is checked for changes.
+	// Defaults to 5s.
+	PollInterval time.Duration `yaml:"poll_interval,omitempty"`
+}
+
+// Hooks is the event hook script; see package hooks for what it can do.
+type Hooks struct {
+	// Script is the path of the Starlark file defining the handlers. It is
+	// read once, at startup.
+	Script string `yaml:"script"`
+
+	// Timeout bounds each handler call, HTTP requests included. Defaults
+	// to 5s.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+}
+
+// Webhook events, also sent to ntfy, Gotify and e-mail.
+const (
+	WebhookServiceAdded      = "service_added"
+	WebhookServiceChanged    = "service_changed"
+	WebhookServiceRemoved    = "service_removed"
+	WebhookNACK              = "nack"
+	WebhookNodeDisconnected  = "node_disconnected"
+	WebhookNodeConnected     = "node_connected"
+	WebhookUpstreamUnhealthy = "upstream_unhealthy"
+	WebhookUpstreamHealthy   = "upstream_healthy"
+	WebhookCertRenewed       = "cert_renewed"
+	WebhookCertExpiring      = "cert_expiring"
+)
+
+// WebhookEvents lists the events a webhook can subscribe to.
+var WebhookEvents = []string{
+	WebhookServiceAdded, WebhookServiceChanged, WebhookServiceRemoved,
+	WebhookNACK, WebhookNodeDisconnected, WebhookNodeConnected,
+	WebhookUpstreamUnhealthy, WebhookUpstreamHealthy,
+	WebhookCertRenewed, WebhookCertExpiring,
+}
+
+// AlertEvents are the events that need someone's attention, which ntfy,
+// Gotify and e-mail get by default.
+var AlertEvents = []string{WebhookNACK, WebhookNodeDisconnected, WebhookUpstreamUnhealthy, WebhookCertExpiring}
+
+// Webhook body formats.
+const (
+	WebhookFormatJSON  = "json"
+	WebhookFormatSlack = "slack"
+	WebhookFormatText  = "text"
+)
+
+// Webhook is a URL notified of events.
+type Webhook struct {
+	URL string `yaml:"url"`
+
+	// Events are the events sent; empty sends all of WebhookEvents.
+	Events []string `yaml:"events,omitempty"`
+
+	// Format of the body: json (the default) for the event as an object,
+	// slack for {"text": ...} as Slack and Mattermost take it, or text for
+	// the summary line alone, as ntfy takes it.
+	Format string `yaml:"format,omitempty"`
+
+	// Secret, if set, signs each delivery with HMAC-SHA256 in the
+	// X-Envoyage-Signature header.
+	Secret string `yaml:"secret,omitempty"`
+
+	// Headers are added to each delivery, e.g. an Authorization.
+	Headers map[string]string `yaml:"headers,omitempty"`
+
+	// Attempts is how often a delivery is tried before it is given up,
+	// backing off between tries. Defaults to 5.
+	Attempts int `yaml:"attempts,omitempty"`
+
+	// Timeout bounds each try. Defaults to 10s.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+}
+
+// DefaultCertExpiry is Notify.CertExpiry's default, also used with
+// webhooks and no notify section.
+const DefaultCertExpiry = 14 * 24 * time.Hour
+
+// Notify lists where notices go besides the webhooks.
+type Notify struct {
+	Ntfy   []Ntfy   `yaml:"ntfy,omitempty"`
+	Gotify []Gotify `yaml:"gotify,omitempty"`
+	Email  []Email  `yaml:"email,omitempty"`
+
+	// CertExpiry is how long before a certificate expires cert_expiring
+	// is sent. Defaults to 14 days.
+	CertExpiry time.Duration `yaml:"cert_expiry,omitempty"`
+}
+
+// Delivery is what ntfy, Gotify and e-mail have in common with a
+// webhook: the events they are sent, and how hard a notice is tried.
+type Delivery struct {
+	// Events are the events sent; empty sends AlertEvents.
+	Events []string `yaml:"events,omitempty"`
+
+	// Attempts is how often a notice is tried before it is given up,
+	// backing off between tries. Defaults to 5.
+	Attempts int `yaml:"attempts,omitempty"`
+
+	// Timeout bounds each try. Defaults to 10s.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+}
+
+// Ntfy publishes to an ntfy topic.
+type Ntfy struct {
+	// URL is the ntfy server. Defaults to https://ntfy.sh.
+	URL   string `yaml:"url,omitempty"`
+	Topic string `yaml:"topic"`
+
+	// Token is an access token for a protected topic.
+	Token string `yaml:"token,omitempty"`
+
+	// Priority, 1 to 5, overrides the default: high for alerts, default
+	// for the rest.
+	Priority int `yaml:"priority,omitempty"`
+
+	Delivery `yaml:",inline"`
+}
+
+// Gotify sends to a Gotify server as an application.
+type Gotify struct {
+	URL   string `yaml:"url"`
+	Token string `yaml:"token"` // the application's token
+
+	// Priority, 1 to 10, overrides the default: 8 for alerts, 4 for the
+	// rest.
+	Priority int `yaml:"priority,omitempty"`
+
+	Delivery `yaml:",inline"`
+}
+
+// Email sends notices through an SMTP server, with STARTTLS when the
+// server offers it.
+type Email struct {
+	Host string `yaml:"host"`
+	Port int    `yaml:"port,omitempty"` // defaults to 587
+
+	// Username and Password log in with PLAIN auth, if set. Go refuses to
+	// send them unencrypted to anything but localhost.
+	Username string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"`
+
+	From string   `yaml:"from"`
+	To   []string `yaml:"to"`
+
+	Delivery `yaml:",inline"`
+}
+
+// DNSCheck controls the public DNS check.
+type DNSCheck struct {
+	// EdgeAddresses are the edges' public IPs, or hostnames resolving to
+	// them. A public domain must resolve to these only.
+	EdgeAddresses []string `yaml:"edge_addresses"`
+
+	// Resolver is the DNS server to ask, host:port. Use a public one when
+	// the LAN's DNS answers with home addresses for the same names. Empty
+	// uses the system resolver.
+	Resolver string `yaml:"resolver,omitempty"`
+
+	// Interval between checks. Defaults to 10m.
+	Interval time.Duration `yaml:"interval,omitempty"`
+
+	// Webhook, if set, is POSTed a JSON notice whenever a domain starts or
+	// stops pointing at the edges.
+	Webhook string `yaml:"webhook,omitempty"`
+}
+
+// Default returns the configuration used when no file is given: the home and
+// VPS Envoys from docker-compose.yml, both on the newest profile.
+func Default() *Config {
+	return &Config{
+		Nodes: []Node{
+			{ID: "envoyage-envoy-home", Admin: "envoy-home:9901"},
+			{ID: "envoyage-envoy-vps", Admin: "envoy-vps:9902"},
+		},
+		HomeIngress: "envoy-home:10000",
+		Stats:       Stats{Source: StatsSourceAdmin, Interval: 15 * time.Second, Series: 240},
+		History:     History{Step: time.Minute, Retention: 7 * 24 * time.Hour},
+		Docker:      Docker{Engine: EngineDocker, PublishedHost: "127.0.0.1", ReconcileInterval: 5 * time.Minute},
+		Store:       Store{AutoMigrate: true},
+		Sources:     Sources{Conflict: "precedence", Precedence: ServiceSources},
+		Drain:       Drain{Grace: 30 * time.Second},
+		Bootstrap:   Bootstrap{XDSAddress: "controlplane:9090"},
+	}
+}
+
+// Load reads the configuration file at path. An empty path returns Default().
+// Fields missing from the file keep their default values.
+func Load(path string) (*Config, error) {
+	cfg := Default()
+	if path == "" {
+		return cfg, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config: %w", err)
+	}
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("parsing config %s: %w", path, err)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// validate checks the config and fills in defaults for optional fields.
+func (c *Config) validate() error {
+	if len(c.Nodes) == 0 {
+		return fmt.Errorf("at least one node is required")
+	}
+	seen := make(map[string]bool, len(c.Nodes))
+	for _, n := range c.Nodes {
+		if n.ID == "" {
+			return fmt.Errorf("node with empty id")
+		}
+		if seen[n.ID] {
+			return fmt.Errorf("duplicate node id %q", n.ID)
+		}
+		if n.Role != "" && n.Role != NodeRoleStaging {
+			return fmt.Errorf("node %q: role must be empty or %s", n.ID, NodeRoleStaging)
+		}
+		if n.IPFamily != "" && !slices.Contains(IPFamilies, n.IPFamily) {
+			return fmt.Errorf("node %q: ip_family must be one of %s", n.ID, strings.Join(IPFamilies, ", "))
+		}
+		seen[n.ID] = true
+	}
+	switch c.Stats.Source {
+	case "":
+		c.Stats.Source = StatsSourceAdmin
+	case StatsSourceAdmin, StatsSourceMetricsService:
+	default:
+		return fmt.Errorf("stats.source must be %s or %s", StatsSourceAdmin, StatsSourceMetricsService)
+	}
+	if c.Stats.Interval <= 0 {
+		c.Stats.Interval = 15 * time.Second
+	}
+	if c.Stats.Series < 0 {
+		return fmt.Errorf("stats.series must not be negative")
+	}
+	if c.Stats.Series == 0 {
+		c.Stats.Series = 240
+	}
+	switch c.Sources.Conflict {
+	case "":
+		c.Sources.Conflict = "precedence"
+	case "precedence", "first", "last":
+	default:
+		return fmt.Errorf("sources.conflict must be precedence, first or last")
+	}
+	for i, s := range c.Sources.Precedence {
+		if !slices.Contains(ServiceSources, s) {
+			return fmt.Errorf("sources.precedence: unknown source %q (want one of %s)", s, strings.Join(ServiceSources, ", "))
+		}
+		if slices.Contains(c.Sources.Precedence[:i], s) {
+			return fmt.Errorf("sources.precedence: %q listed twice", s)
+		}
+	}
+	if len(c.Sources.Precedence) == 0 {
+		c.Sources.Precedence = ServiceSources
+	}
+	if c.History.Directory == "" && c.Store.Path != "" {
+		c.History.Directory = filepath.Join(filepath.Dir(c.Store.Path), "history")
+	}
+	if c.Store.Schedule == "" && c.Store.Path != "" {
+		c.Store.Schedule = filepath.Join(filepath.Dir(c.Store.Path), "scheduled.json")
+	}
+	if c.Wasm.Directory == "" && c.Store.Path != "" {
+		c.Wasm.Directory = filepath.Join(filepath.Dir(c.Store.Path), "wasm")
+	}
+	if c.Wasm.URL != "" {
+		if u, err := url.Parse(c.Wasm.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("wasm.url must be an http:// or https:// URL")
+		}
+	}
+	if c.Wasm.InlineMax == 0 {
+		c.Wasm.InlineMax = 1 << 20
+	}
+	for i, f := range c.Wasm.Filters {
+		if f.Module == "" {
+			return fmt.Errorf("wasm.filters[%d]: module is required", i)
+		}
+	}
+	if c.History.Step == 0 {
+		c.History.Step = time.Minute
+	}
+	if c.History.Step < c.Stats.Interval {
+		return fmt.Errorf("history.step must be at least stats.interval (%s)", c.Stats.Interval)
+	}
+	if c.History.Retention == 0 {
+		c.History.Retention = 7 * 24 * time.Hour
+	}
+	if c.History.Retention < c.History.Step {
+		return fmt.Errorf("history.retention must be at least history.step")
+	}
+	switch c.Docker.Engine {
+	case "":
+		c.Docker.Engine = EngineDocker
+	case EngineDocker, EnginePodman:
+	default:
+		return fmt.Errorf("docker.engine must be %s or %s", EngineDocker, EnginePodman)
+	}
+	if c.Docker.PublishedHost == "" {
+		c.Docker.PublishedHost = "127.0.0.1"
+	}
+	if c.Docker.ReconcileInterval == 0 {
+		c.Docker.ReconcileInterval = 5 * time.Minute
+	}
+	if c.Docker.ReconcileInterval < 10*time.Second {
+		return fmt.Errorf("docker.reconcile_interval must be at least 10s")
+	}
+	for _, p := range c.Docker.Projects {
+		if slices.Contains(c.Docker.ExcludeProjects, p) {
+			return fmt.Errorf("docker: project %q is both in projects and exclude_projects", p)
+		}
+	}
+	if n := c.Docker.Network; n != "" && len(c.Docker.Networks) > 0 && !slices.Contains(c.Docker.Networks, n) {
+		return fmt.Errorf("docker.network %q must be one of docker.networks", n)
+	}
+	for _, n := range c.Docker.Networks {
+		if slices.Contains(c.Docker.ExcludeNetworks, n) {
+			return fmt.Errorf("docker: network %q is both in networks and exclude_networks", n)
+		}
+	}
+	hosts := make(map[string]bool, len(c.Docker.Hosts))
+	for i := range c.Docker.Hosts {
+		h := &c.Docker.Hosts[i]
+		if !dockerHostNameRe.MatchString(h.Name) {
+			return fmt.Errorf("docker.hosts[%d]: name must be lowercase letters, digits and hyphens", i)
+		}
+		if hosts[h.Name] {
+			return fmt.Errorf("duplicate docker host %q", h.Name)
+		}
+		hosts[h.Name] = true
+		scheme, _, _ := strings.Cut(h.Host, "://")
+		switch scheme {
+		case "tcp":
+		case "ssh", "unix":
+			if h.CertPath != "" {
+				return fmt.Errorf("docker host %q: cert_path is for tcp:// hosts", h.Name)
+			}
+		default:
+			return fmt.Errorf("docker host %q: host must be a tcp://, ssh:// or unix:// address", h.Name)
+		}
+		switch h.Engine {
+		case "":
+			h.Engine = c.Docker.Engine
+		case EngineDocker, EnginePodman:
+		default:
+			return fmt.Errorf("docker host %q: engine must be %s or %s", h.Name, EngineDocker, EnginePodman)
+		}
+	}
+	if k := c.Kubernetes; k != nil {
+		if k.TokenFile == "" {
+			k.TokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+		}
+		if k.CAFile == "" && k.APIServer == "" {
+			k.CAFile = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+		}
+		if k.ResyncInterval == 0 {
+			k.ResyncInterval = 5 * time.Minute
+		}
+		if k.ResyncInterval < 10*time.Second {
+			return fmt.Errorf("kubernetes.resync_interval must be at least 10s")
+		}
+	}
+	if d := c.DNSCheck; d != nil {
+		if len(d.EdgeAddresses) == 0 {
+			return fmt.Errorf("dns_check.edge_addresses is required")
+		}
+		if d.Resolver != "" {
+			if _, _, err := net.SplitHostPort(d.Resolver); err != nil {
+				return fmt.Errorf("dns_check.resolver: %w", err)
+			}
+		}
+		if d.Interval == 0 {
+			d.Interval = 10 * time.Minute
+		}
+		if d.Interval < 10*time.Second {
+			return fmt.Errorf("dns_check.interval must be at least 10s")
+		}
+	}
+	if f := c.Files; f != nil {
+		if f.Directory == "" {
+			return fmt.Errorf("files.directory is required")
+		}
+		if f.PollInterval == 0 {
+			f.PollInterval = 5 * time.Second
+		}
+		if f.PollInterval < time.Second {
+			return fmt.Errorf("files.poll_interval must be at least 1s")
+		}
+	}
+	if c.ExtAuthz != nil {
+		if c.ExtAuthz.Upstream == "" {
+			return fmt.Errorf("ext_authz.upstream is required")
+		}
+		if c.ExtAuthz.Timeout == 0 {
+			c.ExtAuthz.Timeout = time.Second
+		}
+	}
+	if c.TLS != nil {
+		if c.HA != nil && c.TLS.EdgeSecret == "" {
+			return fmt.Errorf("ha needs tls.edge_secret: each instance would generate its own, and edges and home on different instances wouldn't match")
+		}
+		if err := c.TLS.validate(); err != nil {
+			return fmt.Errorf("tls: %w", err)
+		}
+	}
+	if c.Challenge != nil {
+		if err := c.Challenge.validate(); err != nil {
+			return fmt.Errorf("challenge: %w", err)
+		}
+	}
+	if v := c.Validation; v != nil {
+		if v.NodeID == "" {
+			return fmt.Errorf("validation.node_id is required")
+		}
+		if seen[v.NodeID] {
+			return fmt.Errorf("validation.node_id %q is also a managed node", v.NodeID)
+		}
+		if v.Timeout == 0 {
+			v.Timeout = 10 * time.Second
+		}
+	}
+	if t := c.Tracing.Envoy; t != nil {
+		if t.Collector == "" {
+			return fmt.Errorf("tracing.envoy.collector is required")
+		}
+		if t.SamplePercent == 0 {
+			t.SamplePercent = 100
+		}
+		if t.SamplePercent < 0 || t.SamplePercent > 100 {
+			return fmt.Errorf("tracing.envoy.sample_percent must be between 0 and 100")
+		}
+		if t.SlowThreshold == 0 {
+			t.SlowThreshold = time.Second
+		}
+		if t.SlowThreshold < time.Millisecond {
+			return fmt.Errorf("tracing.envoy.slow_threshold must be at least 1ms")
+		}
+		if t.TraceURL != "" && !strings.Contains(t.TraceURL, "{trace_id}") {
+			return fmt.Errorf("tracing.envoy.trace_url must contain {trace_id}")
+		}
+	}
+	if c.DNS != nil {
+		if err := c.DNS.validate(); err != nil {
+			return fmt.Errorf("dns: %w", err)
+		}
+	}
+	if c.Portal != nil {
+		if err := c.Portal.validate(c.Namespaces); err != nil {
+			return fmt.Errorf("portal: %w", err)
+		}
+	}
+	if _, _, err := net.SplitHostPort(c.HomeIngress); err != nil {
+		return fmt.Errorf("home_ingress: %w", err)
+	}
+	if f := c.Fallback; f != nil {
+		if f.Status == 0 {
+			f.Status = 503
+		}
+		if f.Status < 200 || f.Status > 599 {
+			return fmt.Errorf("fallback.status must be between 200 and 599")
+		}
+		if f.ProbeInterval == 0 {
+			f.ProbeInterval = 5 * time.Second
+		}
+		if f.ProbeInterval < time.Second {
+			return fmt.Errorf("fallback.probe_interval must be at least 1s")
+		}
+	}
+	if ca := c.CatchAll; ca != nil {
+		if ca.Action == "" {
+			ca.Action = CatchAllNotFound
+		}
+		switch ca.Action {
+		case CatchAllNotFound:
+			// Envoy's direct response limit; see registry.MaxPageBytes.
+			if len(ca.Body) > 64<<10 {
+				return fmt.Errorf("catch_all.body is over 64 KiB")
+			}
+		case CatchAllRedirect:
+			u, err := url.Parse(ca.Redirect)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("catch_all.redirect must be an http or https URL")
+			}
+		case CatchAllService:
+			if ca.Service == "" {
+				return fmt.Errorf("catch_all.service is required for the service action")
+			}
+		default:
+			return fmt.Errorf("catch_all.action must be %s, %s or %s", CatchAllNotFound, CatchAllRedirect, CatchAllService)
+		}
+	}
+	if h := c.Hooks; h != nil {
+		if h.Script == "" {
+			return fmt.Errorf("hooks.script is required")
+		}
+		if h.Timeout == 0 {
+			h.Timeout = 5 * time.Second
+		}
+		if h.Timeout < 0 {
+			return fmt.Errorf("hooks.timeout must be positive")
+		}
+	}
+	for i := range c.Webhooks {
+		if err := c.Webhooks[i].validate(); err != nil {
+			return fmt.Errorf("webhooks[%d]: %w", i, err)
+		}
+	}
+	if n := c.Notify; n != nil {
+		if err := n.validate(); err != nil {
+			return fmt.Errorf("notify.%w", err)
+		}
+	}
+	if h := c.HA; h != nil {
+		if c.Store.Path == "" {
+			return fmt.Errorf("ha needs store.path, on storage shared by the instances")
+		}
+		if h.ID == "" {
+			h.ID, _ = os.Hostname()
+		}
+		if h.PollInterval == 0 {
+			h.PollInterval = 2 * time.Second
+		}
+		if h.PollInterval < 100*time.Millisecond {
+			return fmt.Errorf("ha.poll_interval must be at least 100ms")
+		}
+	}
+	if p := c.Privacy; p != nil {
+		switch p.ClientIP {
+		case "":
+			p.ClientIP = ClientIPTruncate
+		case ClientIPTruncate, ClientIPHash:
+		default:
+			return fmt.Errorf("privacy.client_ip must be %s or %s", ClientIPTruncate, ClientIPHash)
+		}
+	}
+	if ca := c.Cache; ca != nil {
+		if ca.Directory == "" {
+			ca.Directory = "/var/cache/envoyage"
+		}
+		if !strings.HasPrefix(ca.Directory, "/") {
+			return fmt.Errorf("cache.directory must be an absolute path")
+		}
+		if ca.MaxSize == 0 {
+			ca.MaxSize = 1 << 30
+		}
+		if ca.MaxSize < 0 {
+			return fmt.Errorf("cache.max_size must be positive")
+		}
+	}
+	if c.API != nil && !sha256HexRe.MatchString(c.API.TokenSHA256) {
+		return fmt.Errorf("api.token_sha256 must be 64 lowercase hex digits")
+	}
+	if _, _, err := net.SplitHostPort(c.Bootstrap.XDSAddress); err != nil {
+		return fmt.Errorf("bootstrap.xds_address: %w", err)
+	}
+	if c.Drain.Grace < 0 {
+		return fmt.Errorf("drain.grace must not be negative")
+	}
+	for name, ns := range c.Namespaces {
+		if err := ns.validate(); err != nil {
+			return fmt.Errorf("namespace %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+var sha256HexRe = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+var dockerHostNameRe = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+func (p *Portal) validate(namespaces map[string]Namespace) error {
+	if p.MaxShareTTL == 0 {
+		p.MaxShareTTL = 7 * 24 * time.Hour
+	}
+	if p.MaxShareTTL < 0 {
+		return fmt.Errorf("max_share_ttl must be positive")
+	}
+	names := make(map[string]bool)
+	hashes := make(map[string]bool)
+	for _, u := range p.Users {
+		if u.Name == "" {
+			return fmt.Errorf("user with empty name")
+		}
+		if names[u.Name] {
+			return fmt.Errorf("duplicate user %q", u.Name)
+		}
+		names[u.Name] = true
+		if !sha256HexRe.MatchString(u.TokenSHA256) {
+			return fmt.Errorf("user %q: token_sha256 must be 64 lowercase hex digits", u.Name)
+		}
+		if hashes[u.TokenSHA256] {
+			return fmt.Errorf("user %q: token_sha256 is shared with another user", u.Name)
+		}
+		hashes[u.TokenSHA256] = true
+		if len(u.Namespaces) == 0 {
+			return fmt.Errorf("user %q: at least one namespace is required", u.Name)
+		}
+		for _, ns := range u.Namespaces {
+			if _, ok := namespaces[ns]; !ok {
+				return fmt.Errorf("user %q: unknown namespace %q", u.Name, ns)
+			}
+		}
+	}
+	return nil
+}
+
+func (d *DNS) validate() error {
+	for _, r := range d.Resolvers {
+		if _, err := netip.ParseAddrPort(r); err == nil {
+			continue
+		}
+		if _, err := netip.ParseAddr(r); err != nil {
+			return fmt.Errorf("resolver %q must be an IP address, optionally with a port", r)
+		}
+	}
+	if d.RefreshRate == 0 {
+		d.RefreshRate = 30 * time.Second
+	}
+	if d.FailureRefreshBase == 0 {
+		d.FailureRefreshBase = time.Second
+	}
+	if d.FailureRefreshMax == 0 {
+		d.FailureRefreshMax = 30 * time.Second
+	}
+	if d.RefreshRate < time.Millisecond || d.FailureRefreshBase < time.Millisecond {
+		return fmt.Errorf("refresh rates must be at least 1ms")
+	}
+	if d.FailureRefreshMax < d.FailureRefreshBase {
+		return fmt.Errorf("failure_refresh_max must not be below failure_refresh_base")
+	}
+	if d.LookupFamily == "" {
+		d.LookupFamily = "v4_preferred"
+	}
+	if !slices.Contains(DNSLookupFamilies, d.LookupFamily) {
+		return fmt.Errorf("lookup_family must be one of %v", DNSLookupFamilies)
+	}
+	return nil
+}
+
+func (t *TLS) validate() error {
+	if t.Port == 0 {
+		t.Port = 10443
+	}
+	if t.CertChain == "" || t.PrivateKey == "" {
+		return fmt.Errorf("cert_chain and private_key are required")
+	}
+	if t.RequireClientCert && t.ClientCA == "" {
+		return fmt.Errorf("require_client_cert requires client_ca")
+	}
+	if h := t.HTTP3; h != nil {
+		if t.ClientCA != "" {
+			return fmt.Errorf("http3 can't be used with client_ca: client certificates aren't checked over QUIC")
+		}
+		if h.AdvertisedPort == 0 {
+			h.AdvertisedPort = 443
+		}
+		if h.AdvertisedPort > 65535 {
+			return fmt.Errorf("http3.advertised_port must be at most 65535")
+		}
+		if h.MaxAge == 0 {
+			h.MaxAge = 24 * time.Hour
+		}
+		if h.MaxAge < time.Second {
+			return fmt.Errorf("http3.max_age must be at least 1s")
+		}
+	}
+	if t.EdgeSecret == "" {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return fmt.Errorf("generating edge_secret: %w", err)
+		}
+		t.EdgeSecret = hex.EncodeToString(b)
+	}
+	return nil
+}
+
+func (w *Webhook) validate() error {
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url must be an http or https URL")
+	}
+	for _, e := range w.Events {
+		if !slices.Contains(WebhookEvents, e) {
+			return fmt.Errorf("unknown event %q (one of %v)", e, WebhookEvents)
+		}
+	}
+	switch w.Format {
+	case "":
+		w.Format = WebhookFormatJSON
+	case WebhookFormatJSON, WebhookFormatSlack, WebhookFormatText:
+	default:
+		return fmt.Errorf("format must be %s, %s or %s", WebhookFormatJSON, WebhookFormatSlack, WebhookFormatText)
+	}
+	if w.Attempts == 0 {
+		w.Attempts = 5
+	}
+	if w.Attempts < 1 {
+		return fmt.Errorf("attempts must be at least 1")
+	}
+	if w.Timeout == 0 {
+		w.Timeout = 10 * time.Second
+	}
+	if w.Timeout < 0 {
+		return fmt.Errorf("timeout must be positive")
+	}
+	return nil
+}
+
+func (n *Notify) validate() error {
+	if n.CertExpiry == 0 {
+		n.CertExpiry = DefaultCertExpiry
+	}
+	if n.CertExpiry < 0 {
+		return fmt.Errorf("cert_expiry must be positive")
+	}
+	for i := range n.Ntfy {
+		if err := n.Ntfy[i].validate(); err != nil {
+			return fmt.Errorf("ntfy[%d]: %w", i, err)
+		}
+	}
+	for i := range n.Gotify {
+		if err := n.Gotify[i].validate(); err != nil {
+			return fmt.Errorf("gotify[%d]: %w", i, err)
+		}
+	}
+	for i := range n.Email {
+		if err := n.Email[i].validate(); err != nil {
+			return fmt.Errorf("email[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// validate fills in defaults, as Webhook.validate does.
+func (d *Delivery) validate() error {
+	for _, e := range d.Events {
+		if !slices.Contains(WebhookEvents, e) {
+			return fmt.Errorf("unknown event %q (one of %v)", e, WebhookEvents)
+		}
+	}
+	if len(d.Events) == 0 {
+		d.Events = AlertEvents
+	}
+	if d.Attempts == 0 {
+		d.Attempts = 5
+	}
+	if d.Attempts < 1 {
+		return fmt.Errorf("attempts must be at least 1")
+	}
+	if d.Timeout == 0 {
+		d.Timeout = 10 * time.Second
+	}
+	if d.Timeout < 0 {
+		return fmt.Errorf("timeout must be positive")
+	}
+	return nil
+}
+
+// validHTTPURL reports whether s is an absolute http or https URL.
+func validHTTPURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+func (n *Ntfy) validate() error {
+	if n.URL == "" {
+		n.URL = "https://ntfy.sh"
+	}
+	if !validHTTPURL(n.URL) {
+		return fmt.Errorf("url must be an http or https URL")
+	}
+	if n.Topic == "" || strings.ContainsAny(n.Topic, "/?#") {
+		return fmt.Errorf("topic is required, without / ? or #")
+	}
+	if n.Priority < 0 || n.Priority > 5 {
+		return fmt.Errorf("priority must be between 1 and 5")
+	}
+	return n.Delivery.validate()
+}
+
+func (g *Gotify) validate() error {
+	if !validHTTPURL(g.URL) {
+		return fmt.Errorf("url must be an http or https URL")
+	}
+	if g.Token == "" {
+		return fmt.Errorf("token is required")
+	}
+	if g.Priority < 0 || g.Priority > 10 {
+		return fmt.Errorf("priority must be between 1 and 10")
+	}
+	return g.Delivery.validate()
+}
+
+func (e *Email) validate() error {
+	if e.Host == "" {
+		return fmt.Errorf("host is required")
+	}
+	if e.Port == 0 {
+		e.Port = 587
+	}
+	if e.Port < 1 || e.Port > 65535 {
+		return fmt.Errorf("port must be between 1 and 65535")
+	}
+	if e.From == "" || len(e.To) == 0 {
+		return fmt.Errorf("from and to are required")
+	}
+	for _, addr := range append([]string{e.From}, e.To...) {
+		if _, err := mail.ParseAddress(addr); err != nil {
+			return fmt.Errorf("invalid address %q", addr)
+		}
+	}
+	return e.Delivery.validate()
+}
+
+func (c *Challenge) validate() error {
+	if c.Difficulty == 0 {
+		c.Difficulty = 16
+	}
+	if c.Difficulty < 1 || c.Difficulty > 32 {
+		return fmt.Errorf("difficulty must be between 1 and 32")
+	}
+	if c.CookieTTL == 0 {
+		c.CookieTTL = 24 * time.Hour
+	}
+	if c.Timeout == 0 {
+		c.Timeout = 250 * time.Millisecond
+	}
+	if c.Rate < 0 {
+		return fmt.Errorf("rate must not be negative")
+	}
+	if len(c.ASNs) > 0 && c.ASNDatabase == "" {
+		return fmt.Errorf("asns requires asn_database")
+	}
+	for i, r := range c.Rules {
+		if r.CIDR == "" && r.UserAgent == "" && r.PathPrefix == "" {
+			return fmt.Errorf("rule %d matches nothing", i)
+		}
+		if r.CIDR != "" {
+			if _, err := netip.ParsePrefix(r.CIDR); err != nil {
+				return fmt.Errorf("rule %d: %w", i, err)
+			}
+		}
+		if r.UserAgent != "" {
+			if _, err := regexp.Compile(r.UserAgent); err != nil {
+				return fmt.Errorf("rule %d: user_agent: %w", i, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (n Namespace) validate() error {
+	d, b := n.Defaults, n.Bounds
+	for _, e := range append([]string{d.Exposure}, b.AllowedExposure...) {
+		if e != "" && e != "public" && e != "lan" {
+			return fmt.Errorf("unknown exposure %q (want public or lan)", e)
+		}
+	}
+	if d.RateLimit < 0 || d.MaxBodyBytes < 0 || b.MaxRateLimit < 0 || b.MaxBodyBytes < 0 {
+		return fmt.Errorf("limits must not be negative")
+	}
+	// The defaults must themselves be something a service could choose.
+	if b.MaxRateLimit > 0 && (d.RateLimit == 0 || d.RateLimit > b.MaxRateLimit) {
+		return fmt.Errorf("defaults.rate_limit must be between 1 and bounds.max_rate_limit")
+	}
+	if b.MaxBodyBytes > 0 && (d.MaxBodyBytes == 0 || d.MaxBodyBytes > b.MaxBodyBytes) {
+		return fmt.Errorf("defaults.max_body_bytes must be between 1 and bounds.max_body_bytes")
+	}
+	if len(b.AllowedExposure) > 0 {
+		exp := d.Exposure
+		if exp == "" {
+			exp = "public"
+		}
+		if !slices.Contains(b.AllowedExposure, exp) {
+			return fmt.Errorf("default exposure %q is not in bounds.allowed_exposure", exp)
+		}
+	}
+	return nil
+}
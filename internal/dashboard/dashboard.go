@@ -0,0 +1,23 @@
+// Package dashboard is the admin's read-only view of the control plane.
+//
+// It is a single page served at /ui/ on the management API. The page holds
+// no state of its own: it polls the same endpoints envoyagectl uses
+// (GET /services, /services/{name}/health, /services/{name}/stats,
+// /services/{name}/history, /nodes and /changes) with the
+// admin token, so it needs no API of its own and shows nothing the token
+// couldn't already read.
+package dashboard
+
+import "net/http"
+
+// Path is where the dashboard is mounted. The page itself is served without
+// the admin token; it asks for one when the API does.
+const Path = "/ui/"
+
+// Register adds the dashboard page to mux.
+func Register(mux *http.ServeMux) {
+	mux.HandleFunc("GET "+Path+"{$}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(page))
+	})
+}
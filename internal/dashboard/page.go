@@ -0,0 +1,208 @@
+package dashboard
+
+// page is the dashboard UI. It keeps the admin token (if the API needs one)
+// in localStorage and refreshes every few seconds.
+const page = `<!doctype html>
+<html><head><meta charset="utf-8"><meta name="viewport" content="width=device-width,initial-scale=1">
+<title>Envoyage</title>
+<style>
+body{font-family:system-ui,sans-serif;max-width:72em;margin:2em auto;padding:0 1em;color:#333}
+h2{font-size:1.1em;margin-top:1.5em}
+table{border-collapse:collapse;width:100%}td,th{padding:.3em .8em .3em 0;text-align:left;vertical-align:top;border-bottom:1px solid #eee}
+.muted{color:#888;font-size:.9em}
+.ok{color:#080}.warn{color:#b60}.bad{color:#b00}
+.spark{display:block}.spark path{fill:none;stroke-width:1.5}
+.tag{display:inline-block;font-size:.8em;padding:0 .4em;border-radius:3px;background:#eee;margin-left:.3em}
+</style>
+</head><body>
+<h1>Envoyage</h1>
+<div id="login" hidden>
+  <p>The management API needs the admin token (printed by <code>envoyagectl init</code>).</p>
+  <input id="token" type="password" autocomplete="off"> <button onclick="login()">Sign in</button>
+</div>
+<p id="error" class="bad"></p>
+<div id="main" hidden>
+  <p class="muted">Updated <span id="updated"></span> · <a href="#" onclick="logout()">sign out</a></p>
+  <h2>Nodes</h2>
+  <table><thead><tr><th>node</th><th>profile</th><th>xDS</th><th>version</th><th>last seen</th><th>host</th></tr></thead><tbody id="nodes"></tbody></table>
+  <h2>Services</h2>
+  <table><thead><tr><th>service</th><th>domain</th><th>upstream</th><th>health</th><th>traffic</th><th>last 24h</th></tr></thead><tbody id="services"></tbody></table>
+  <h2>Recent changes</h2>
+  <table><thead><tr><th>time</th><th>version</th><th>change</th></tr></thead><tbody id="changes"></tbody></table>
+</div>
+<script>
+let token = localStorage.getItem("envoyage_admin_token") || "";
+
+async function api(path) {
+  const headers = token ? {"Authorization": "Bearer " + token} : {};
+  const r = await fetch(path, {headers});
+  if (r.status === 401) { showLogin(); throw new Error("not signed in"); }
+  if (!r.ok) {
+    const body = await r.text();
+    let msg = body;
+    try { msg = JSON.parse(body).error.message; } catch (e) {}
+    throw new Error(path + ": " + msg);
+  }
+  return r.json();
+}
+
+function showLogin() {
+  document.getElementById("login").hidden = false;
+  document.getElementById("main").hidden = true;
+}
+
+function login() {
+  token = document.getElementById("token").value.trim();
+  localStorage.setItem("envoyage_admin_token", token);
+  document.getElementById("login").hidden = true;
+  load();
+}
+
+function logout() {
+  token = "";
+  localStorage.removeItem("envoyage_admin_token");
+  showLogin();
+}
+
+function esc(s) {
+  const d = document.createElement("div");
+  d.textContent = s == null ? "" : String(s);
+  return d.innerHTML;
+}
+
+function ago(t) {
+  if (!t) return "never";
+  const s = Math.round((Date.now() - new Date(t)) / 1000);
+  if (s < 60) return s + "s ago";
+  if (s < 3600) return Math.round(s / 60) + "m ago";
+  return new Date(t).toLocaleString();
+}
+
+function bytes(n) {
+  const u = ["B", "KiB", "MiB", "GiB", "TiB"];
+  let i = 0;
+  while (n >= 1024 && i < u.length - 1) { n /= 1024; i++; }
+  return n.toFixed(i ? 1 : 0) + " " + u[i];
+}
+
+function pct(used, total) {
+  const p = total ? Math.round(used / total * 100) : 0;
+  return "<span class=" + (p >= 90 ? "bad" : p >= 75 ? "warn" : "ok") + ">" + p + "%</span>";
+}
+
+function usageCell(u) {
+  if (!u) return "<span class=muted>no agent</span>";
+  let out = "cpu " + pct(u.cpu, 1) + " · mem " + pct(u.memory_used_bytes, u.memory_total_bytes) +
+    " · disk " + pct(u.disk_used_bytes, u.disk_total_bytes);
+  if (u.tunnel) out += "<br><span class=muted>" + esc(u.tunnel.interface) + " ↓" + bytes(u.tunnel.rx_bytes) + " ↑" + bytes(u.tunnel.tx_bytes) + "</span>";
+  return out + "<br><span class=muted>" + ago(u.time) + "</span>";
+}
+
+function nodeRow(n) {
+  const s = n.sync;
+  let state;
+  if (!s.connected) state = "<span class=bad>disconnected</span>";
+  else if (s.error) state = "<span class=bad>rejected: " + esc(s.error) + "</span>";
+  else if (s.in_sync) state = "<span class=ok>in sync</span>";
+  else state = "<span class=warn>syncing</span>";
+  if (n.home_reachable === false) state += "<br><span class=bad>home unreachable: serving fallback</span>";
+  if (s.build_error) state += "<br><span class=bad title=\"" + esc(s.build_error) + "\">" + esc(s.failed_version) + " failed to build, retrying</span>";
+  const version = esc(s.acked || "-") + (s.pushed && s.acked !== s.pushed ? " <span class=muted>→ " + esc(s.pushed) + "</span>" : "");
+  return "<tr><td>" + esc(n.id) + (n.dynamic ? "<span class=tag>dynamic</span>" : "") + (n.staging ? "<span class=tag>staging</span>" : "") + "</td><td>" + esc(n.profile) +
+    "</td><td>" + state + "</td><td>" + version + "</td><td>" + ago(s.last_seen) + "</td><td>" + usageCell(n.usage) + "</td></tr>";
+}
+
+function healthCell(nodes) {
+  const ids = Object.keys(nodes || {}).sort();
+  if (!ids.length) return "<span class=muted>no stats yet</span>";
+  return ids.map(id => {
+    const h = nodes[id];
+    if (h.cause) return "<div class=bad title=\"" + esc(h.hint) + "\">" + esc(id) + ": " + esc(h.cause) + "</div>";
+    if (!h.healthy_hosts) return "<div class=warn>" + esc(id) + ": no healthy hosts</div>";
+    const probe = h.probe ? " <span class=muted>(probe " + (h.probe.recent_attempts - h.probe.recent_failures) + "/" + h.probe.recent_attempts + " passing)</span>" : "";
+    return "<div class=ok>" + esc(id) + ": ok" + probe + "</div>";
+  }).join("");
+}
+
+// trafficCell shows the busiest node's bandwidth now and since its Envoy
+// started, down (responses) and up (requests).
+function trafficCell(st) {
+  const t = st && st.total;
+  if (!t || !t.scraped_at) return "<span class=muted>no stats yet</span>";
+  return "↓" + bytes(t.rx_bytes_rate) + "/s ↑" + bytes(t.tx_bytes_rate) + "/s · " + t.request_rate.toFixed(1) + " req/s" +
+    "<br><span class=muted>↓" + bytes(t.rx_bytes) + " ↑" + bytes(t.tx_bytes) + " · " + t.requests + " req</span>";
+}
+
+// sparkline draws requests (and 5xx errors in red) per history bucket.
+function sparkline(h) {
+  const pts = (h && h.points) || [];
+  if (!pts.length) return "<span class=muted>no history yet</span>";
+  const w = 160, ht = 32, step = h.step_seconds * 1000;
+  const from = new Date(h.from).getTime(), span = new Date(h.to).getTime() - from;
+  const peak = Math.max(1, ...pts.map(p => p.requests));
+  const path = key => pts.map((p, i) => (i ? "L" : "M") +
+    ((new Date(p.time).getTime() + step / 2 - from) / span * w).toFixed(1) + " " +
+    (ht - p[key] / peak * (ht - 2) - 1).toFixed(1)).join(" ");
+  const total = pts.reduce((n, p) => n + p.requests, 0), errors = pts.reduce((n, p) => n + p.errors, 0);
+  const p95 = Math.max(...pts.map(p => p.p95_ms));
+  return "<svg class=spark width=" + w + " height=" + ht + "><path stroke=#48c d=\"" + path("requests") +
+    "\"/><path stroke=#b00 d=\"" + path("errors") + "\"/></svg><span class=muted>" + total + " req · " + errors +
+    " 5xx" + (p95 ? " · p95 ≤" + p95 + "ms" : "") + "</span>";
+}
+
+function serviceRow(s, health, traffic, history) {
+  const tags = (s.Source && s.Source !== "api" ? "<span class=tag>" + esc(s.Source) + "</span>" : "") +
+    (s.Maintenance ? "<span class=tag>maintenance</span>" : "") +
+    (s.Canary ? "<span class=tag>canary " + esc(s.Canary.Weight) + "% → " + esc(s.Canary.Upstream) + "</span>" : "") +
+    (s.Switch ? "<span class=tag title=\"switched back if unhealthy until " + esc(new Date(s.Switch.Until).toLocaleTimeString()) + "\">switched from " + esc(s.Switch.From) + "</span>" : "") +
+    (s.Waiting ? "<span class=\"tag warn\" title=\"" + esc(s.Waiting) + "\">waiting</span>" : "") +
+    (s.Schedule ? "<span class=tag title=\"" + esc(s.Schedule.map(r => r.Cron + " " + r.Action).join("; ")) + "\">scheduled</span>" : "") +
+    (s.ForwardProxy ? "<span class=tag>forward proxy</span>" : "");
+  return "<tr><td>" + esc(s.Name) + tags + "</td><td>" + esc(s.Domain) + "</td><td>" + esc(s.ForwardProxy ? "" : s.Upstream) +
+    "</td><td>" + healthCell(health) + "</td><td>" + trafficCell(traffic) + "</td><td>" + sparkline(history) + "</td></tr>";
+}
+
+function changeRow(c) {
+  const what = c.Op + " " + c.Service + (c.Comment ? ": " + c.Comment : "");
+  return "<tr><td>" + ago(c.Time) + "</td><td>v" + esc(c.Version) + "</td><td>" + esc(what) + "</td></tr>";
+}
+
+// history is refetched once a minute, its resolution, not on every refresh.
+let history = {}, historyAt = 0;
+
+async function loadHistory(services) {
+  if (Date.now() - historyAt < 60000) return;
+  const all = await Promise.all(services.map(s =>
+    api("/services/" + encodeURIComponent(s.Name) + "/history?range=24h").catch(() => null)));
+  history = {};
+  services.forEach((s, i) => { history[s.Name] = all[i]; });
+  historyAt = Date.now();
+}
+
+async function load() {
+  try {
+    const [nodes, services, changes] = await Promise.all([api("/nodes"), api("/services"), api("/changes")]);
+    const health = await Promise.all(services.services.map(s =>
+      api("/services/" + encodeURIComponent(s.Name) + "/health").then(h => h.nodes, () => ({}))));
+    const traffic = await Promise.all(services.services.map(s =>
+      api("/services/" + encodeURIComponent(s.Name) + "/stats").catch(() => null)));
+    await loadHistory(services.services);
+    document.getElementById("nodes").innerHTML = (nodes.nodes || []).map(nodeRow).join("");
+    document.getElementById("services").innerHTML = services.services.length
+      ? services.services.map((s, i) => serviceRow(s, health[i], traffic[i], history[s.Name])).join("")
+      : "<tr><td colspan=6 class=muted>no services registered</td></tr>";
+    document.getElementById("changes").innerHTML = changes.changes.slice(-20).reverse().map(changeRow).join("") ||
+      "<tr><td colspan=3 class=muted>no changes yet</td></tr>";
+    document.getElementById("updated").textContent = new Date().toLocaleTimeString();
+    document.getElementById("error").textContent = "";
+    document.getElementById("main").hidden = false;
+  } catch (e) {
+    document.getElementById("error").textContent = e.message;
+  }
+}
+
+load();
+setInterval(() => { if (document.getElementById("login").hidden) load(); }, 5000);
+</script>
+</body></html>
+`
@@ -0,0 +1,92 @@
+// Package depends holds back services until the services they depend on
+// are healthy (see registry.Unready for the part that needs no health).
+package depends
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/envoyage/envoyage/internal/config"
+	"github.com/envoyage/envoyage/internal/registry"
+	"github.com/envoyage/envoyage/internal/stats"
+	"github.com/envoyage/envoyage/internal/supervisor"
+)
+
+// Health is the part of stats.Scraper the Gate reads.
+type Health interface {
+	Health(name string) map[string]stats.NodeHealth
+}
+
+// tick is how often the Gate checks.
+const tick = 5 * time.Second
+
+// Gate sets registry.Service.Waiting while one of a service's dependencies
+// has no healthy host on the home node, and clears it once they all do. A
+// dependency without health stats yet counts as healthy: registering is
+// what most apps' readiness hinges on, and the Docker watcher only
+// registers containers whose healthcheck passes.
+type Gate struct {
+	reg    *registry.Registry
+	health Health
+	log    *slog.Logger
+}
+
+// NewGate creates a Gate. Call Run to start it.
+func NewGate(reg *registry.Registry, h Health, log *slog.Logger) *Gate {
+	return &Gate{reg: reg, health: h, log: log}
+}
+
+// Run checks until ctx is canceled. Call it in a goroutine.
+func (g *Gate) Run(ctx context.Context) {
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			g.check(ctx)
+			supervisor.Beat(ctx)
+		}
+	}
+}
+
+func (g *Gate) check(ctx context.Context) {
+	services, _ := g.reg.Snapshot()
+	for _, svc := range services {
+		if len(svc.DependsOn) == 0 && svc.Waiting == "" {
+			continue
+		}
+		waiting := ""
+		for _, dep := range svc.DependsOn {
+			if g.unhealthy(dep) {
+				waiting = "waiting for " + dep + ": no healthy host"
+				break
+			}
+		}
+		if waiting == svc.Waiting {
+			continue
+		}
+		comment := "depends: " + waiting
+		if waiting == "" {
+			comment = "depends: dependencies healthy"
+		}
+		err := g.reg.Modify(registry.WithComment(ctx, comment), svc.Name, func(s *registry.Service) error {
+			s.Waiting = waiting
+			return nil
+		})
+		if err != nil {
+			g.log.Error("depends: failed to update service", "service", svc.Name, "error", err)
+			continue
+		}
+		g.log.Info("depends: service gate changed", "service", svc.Name, "waiting", waiting)
+	}
+}
+
+// unhealthy reports whether the home node has no healthy host for the
+// named service.
+func (g *Gate) unhealthy(name string) bool {
+	h, ok := g.health.Health(name)[config.HomeNodeID]
+	return ok && h.HealthyHosts == 0
+}
@@ -0,0 +1,255 @@
+// Package dnscheck catches the classic "added the service but forgot the
+// DNS record": it periodically resolves every public service's domain and
+// compares the answer with the edges' addresses.
+//
+// Results are served by GET /dns-check, reported by lint, exported as the
+// envoyage_service_dns_ok gauge, and, with a webhook configured, pushed
+// whenever a domain's status changes.
+package dnscheck
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/envoyage/envoyage/internal/config"
+	"github.com/envoyage/envoyage/internal/metrics"
+	"github.com/envoyage/envoyage/internal/policy"
+	"github.com/envoyage/envoyage/internal/registry"
+	"github.com/envoyage/envoyage/internal/supervisor"
+)
+
+// Statuses of a Result.
+const (
+	// StatusOK means the domain resolves to edge addresses only.
+	StatusOK = "ok"
+	// StatusMismatch means some address is not an edge's, e.g. the record
+	// still points at an old server or straight at home.
+	StatusMismatch = "mismatch"
+	// StatusUnresolved means the domain has no address at all.
+	StatusUnresolved = "unresolved"
+)
+
+// Result is the last check of one service's domain.
+type Result struct {
+	Service   string    `json:"service"`
+	Domain    string    `json:"domain"`
+	Status    string    `json:"status"`
+	Addresses []string  `json:"addresses,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// lookupTimeout caps each DNS query.
+const lookupTimeout = 5 * time.Second
+
+// Checker runs the DNS check.
+type Checker struct {
+	cfg      *config.DNSCheck
+	reg      *registry.Registry
+	policy   *policy.Resolver
+	resolver *net.Resolver
+	log      *slog.Logger
+	ok       *metrics.Vec
+
+	mu      sync.RWMutex
+	results map[string]Result // by service name
+}
+
+// NewChecker creates a Checker. cfg is the whole config, for namespace
+// exposure; cfg.DNSCheck must be set.
+func NewChecker(cfg *config.Config, reg *registry.Registry, m *metrics.Registry, log *slog.Logger) *Checker {
+	resolver := net.DefaultResolver
+	if addr := cfg.DNSCheck.Resolver; addr != "" {
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, addr)
+			},
+		}
+	}
+	return &Checker{
+		cfg:      cfg.DNSCheck,
+		reg:      reg,
+		policy:   policy.NewResolver(cfg),
+		resolver: resolver,
+		log:      log,
+		ok: m.NewVec("envoyage_service_dns_ok",
+			"Whether the service's domain resolves to the edges only (1) or not (0).",
+			metrics.Gauge, "service"),
+		results: make(map[string]Result),
+	}
+}
+
+// Run checks now and then every interval until ctx is canceled.
+func (c *Checker) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		c.check(ctx)
+		supervisor.Beat(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Results returns the last result of every checked service, sorted by
+// service name.
+func (c *Checker) Results() []Result {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	out := make([]Result, 0, len(c.results))
+	for _, r := range c.results {
+		out = append(out, r)
+	}
+	slices.SortFunc(out, func(a, b Result) int { return strings.Compare(a.Service, b.Service) })
+	return out
+}
+
+// Result returns the last result for a service, if it was checked.
+func (c *Checker) Result(service string) (Result, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	r, ok := c.results[service]
+	return r, ok
+}
+
+func (c *Checker) check(ctx context.Context) {
+	edges, err := c.edgeAddresses(ctx)
+	if err != nil {
+		// Without the edges' addresses every domain would look wrong.
+		c.log.Warn("dns check skipped", "error", err)
+		return
+	}
+
+	services, _ := c.reg.Snapshot()
+	checked := make(map[string]bool)
+	for _, svc := range services {
+		eff, err := c.policy.Resolve(svc)
+		if err != nil || eff.Exposure == registry.ExposureLAN || !config.OnEdges(svc.Nodes) || svc.Domain == "" || strings.HasPrefix(svc.Domain, "*") {
+			continue
+		}
+		checked[svc.Name] = true
+		r := c.checkDomain(ctx, svc.Name, svc.Domain, edges)
+
+		c.mu.Lock()
+		prev, seen := c.results[svc.Name]
+		c.results[svc.Name] = r
+		c.mu.Unlock()
+
+		ok := 0.0
+		if r.Status == StatusOK {
+			ok = 1
+		}
+		c.ok.Set(ok, svc.Name)
+
+		// A service that was never ok is news too; one that was and still
+		// is, or a first check that is fine, isn't.
+		if (seen && prev.Status != r.Status) || (!seen && r.Status != StatusOK) {
+			level := slog.LevelWarn
+			if r.Status == StatusOK {
+				level = slog.LevelInfo
+			}
+			c.log.Log(ctx, level, "dns check",
+				"service", r.Service, "domain", r.Domain, "status", r.Status, "addresses", r.Addresses)
+			c.notify(ctx, r)
+		}
+	}
+
+	c.mu.Lock()
+	for name := range c.results {
+		if !checked[name] {
+			delete(c.results, name)
+			c.ok.Delete(name)
+		}
+	}
+	c.mu.Unlock()
+}
+
+// edgeAddresses resolves the configured edge addresses to a set of IPs.
+func (c *Checker) edgeAddresses(ctx context.Context) (map[string]bool, error) {
+	out := make(map[string]bool)
+	for _, a := range c.cfg.EdgeAddresses {
+		if ip := net.ParseIP(a); ip != nil {
+			out[ip.String()] = true
+			continue
+		}
+		ctx, cancel := context.WithTimeout(ctx, lookupTimeout)
+		ips, err := c.resolver.LookupIP(ctx, "ip", a)
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("resolving edge address %s: %w", a, err)
+		}
+		for _, ip := range ips {
+			out[ip.String()] = true
+		}
+	}
+	return out, nil
+}
+
+func (c *Checker) checkDomain(ctx context.Context, service, domain string, edges map[string]bool) Result {
+	r := Result{Service: service, Domain: domain, CheckedAt: time.Now()}
+	ctx, cancel := context.WithTimeout(ctx, lookupTimeout)
+	defer cancel()
+	ips, err := c.resolver.LookupIP(ctx, "ip", domain)
+	if err != nil {
+		r.Status, r.Error = StatusUnresolved, err.Error()
+		return r
+	}
+	r.Status = StatusOK
+	for _, ip := range ips {
+		s := ip.String()
+		r.Addresses = append(r.Addresses, s)
+		if !edges[s] {
+			r.Status = StatusMismatch
+		}
+	}
+	if len(ips) == 0 {
+		r.Status = StatusUnresolved
+	}
+	slices.Sort(r.Addresses)
+	return r
+}
+
+// notify posts r to the webhook, if any.
+func (c *Checker) notify(ctx context.Context, r Result) {
+	if c.cfg.Webhook == "" {
+		return
+	}
+	body, err := json.Marshal(map[string]any{
+		"event":  "dns_check",
+		"result": r,
+	})
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.cfg.Webhook, bytes.NewReader(body))
+	if err != nil {
+		c.log.Warn("dns check webhook", "error", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.log.Warn("dns check webhook", "error", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		c.log.Warn("dns check webhook", "status", resp.Status)
+	}
+}
@@ -0,0 +1,333 @@
+// Package dockertest provides a fake Docker daemon for testing the watcher,
+// and discovery sources built like it, without a real one:
+//
+//	fake := dockertest.NewFake()
+//	w := docker.NewWatcherWithClient(reg, config.Docker{}, fake, metrics.NewRegistry(), log)
+//	go w.Run(ctx)
+//	id := fake.Start(dockertest.Container{
+//		Name:   "jellyfin",
+//		IP:     "172.18.0.5",
+//		Labels: map[string]string{"envoyage.enable": "true", ...},
+//	})
+//	...
+//	fake.Stop(id)
+//
+// Start, Stop, SetHealth, Pause, Unpause, Rename, Connect and Disconnect
+// send the events Docker would. Add and Forget change the
+// containers without one, as when the watcher misses an event and has to
+// find the change by reconciling.
+package dockertest
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"net/netip"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/go-connections/nat"
+)
+
+// Container is a running container as far as the watcher cares.
+type Container struct {
+	// ID is generated by Add or Start if empty.
+	ID   string
+	Name string // without the leading "/"
+
+	// IP is the address on Network, which is IPv6-only if it is an IPv6
+	// address. Empty leaves the container on no network.
+	IP      string
+	Network string // defaults to "envoyage"
+
+	// Published maps container TCP ports to the host ports they are
+	// published on, on every address.
+	Published map[uint16]uint16
+
+	Labels map[string]string
+
+	// Health is the healthcheck status (types.Starting, Healthy or
+	// Unhealthy); empty for a container without a healthcheck.
+	Health string
+
+	Paused bool // set by Pause and Unpause
+}
+
+// Fake is an in-memory Docker daemon implementing docker.Client. It is safe
+// for concurrent use.
+type Fake struct {
+	mu         sync.Mutex
+	containers map[string]Container
+	subs       map[*subscriber]bool
+}
+
+type subscriber struct {
+	events chan events.Message
+	errs   chan error
+	done   <-chan struct{}
+}
+
+// NewFake creates a daemon with no containers.
+func NewFake() *Fake {
+	return &Fake{
+		containers: make(map[string]Container),
+		subs:       make(map[*subscriber]bool),
+	}
+}
+
+// Add makes c a running container without an event, and returns its ID.
+func (f *Fake) Add(c Container) string {
+	if c.ID == "" {
+		id := make([]byte, 32)
+		rand.Read(id)
+		c.ID = hex.EncodeToString(id)
+	}
+	c.Labels = maps.Clone(c.Labels)
+	f.mu.Lock()
+	f.containers[c.ID] = c
+	f.mu.Unlock()
+	return c.ID
+}
+
+// Start adds c and sends its start event, returning its ID.
+func (f *Fake) Start(c Container) string {
+	id := f.Add(c)
+	f.send(events.Message{
+		Type:   events.ContainerEventType,
+		Action: events.ActionStart,
+		Actor:  f.actor(id),
+	})
+	return id
+}
+
+// Stop removes a container and sends its die event, which carries its
+// labels as Docker's does.
+func (f *Fake) Stop(id string) {
+	actor := f.actor(id)
+	f.Forget(id)
+	f.send(events.Message{
+		Type:   events.ContainerEventType,
+		Action: events.ActionDie,
+		Actor:  actor,
+	})
+}
+
+// SetHealth changes a container's healthcheck status and sends the
+// health_status event Docker would.
+func (f *Fake) SetHealth(id, status string) {
+	f.change(id, events.Action(string(events.ActionHealthStatus)+": "+status), func(c *Container) { c.Health = status })
+}
+
+// Pause and Unpause pause and unpause a container, sending the events
+// Docker would.
+func (f *Fake) Pause(id string) {
+	f.change(id, events.ActionPause, func(c *Container) { c.Paused = true })
+}
+
+func (f *Fake) Unpause(id string) {
+	f.change(id, events.ActionUnPause, func(c *Container) { c.Paused = false })
+}
+
+// Rename renames a container and sends its rename event.
+func (f *Fake) Rename(id, name string) {
+	f.change(id, events.ActionRename, func(c *Container) { c.Name = name })
+}
+
+// Connect moves a container to ip on its Network, and
+// Disconnect takes it off; both send the network event Docker would.
+func (f *Fake) Connect(id, ip string) {
+	f.network(id, events.ActionConnect, ip)
+}
+
+func (f *Fake) Disconnect(id string) {
+	f.network(id, events.ActionDisconnect, "")
+}
+
+// change applies fn to a container and sends a container event.
+func (f *Fake) change(id string, action events.Action, fn func(*Container)) {
+	f.mu.Lock()
+	c := f.containers[id]
+	fn(&c)
+	f.containers[id] = c
+	f.mu.Unlock()
+	f.send(events.Message{
+		Type:   events.ContainerEventType,
+		Action: action,
+		Actor:  f.actor(id),
+	})
+}
+
+// network sets a container's IP and sends a network event, whose actor is
+// the network.
+func (f *Fake) network(id string, action events.Action, ip string) {
+	f.mu.Lock()
+	c := f.containers[id]
+	c.IP = ip
+	f.containers[id] = c
+	f.mu.Unlock()
+	f.send(events.Message{
+		Type:   events.NetworkEventType,
+		Action: action,
+		Actor:  events.Actor{ID: "envoyage", Attributes: map[string]string{"container": id, "name": "envoyage", "type": "bridge"}},
+	})
+}
+
+// Forget removes a container without an event.
+func (f *Fake) Forget(id string) {
+	f.mu.Lock()
+	delete(f.containers, id)
+	f.mu.Unlock()
+}
+
+// Fail ends every open event stream with err, as a daemon restart does.
+func (f *Fake) Fail(err error) {
+	f.mu.Lock()
+	subs := f.subs
+	f.subs = make(map[*subscriber]bool)
+	f.mu.Unlock()
+	for s := range subs {
+		select {
+		case s.errs <- err:
+		case <-s.done:
+		}
+	}
+}
+
+// Events implements docker.Client. Options are ignored: every event is a
+// container event.
+func (f *Fake) Events(ctx context.Context, _ events.ListOptions) (<-chan events.Message, <-chan error) {
+	s := &subscriber{
+		events: make(chan events.Message),
+		errs:   make(chan error, 1),
+		done:   ctx.Done(),
+	}
+	f.mu.Lock()
+	f.subs[s] = true
+	f.mu.Unlock()
+	go func() {
+		<-ctx.Done()
+		f.mu.Lock()
+		delete(f.subs, s)
+		f.mu.Unlock()
+	}()
+	return s.events, s.errs
+}
+
+// ContainerList implements docker.Client, listing every container by ID.
+// Options are ignored.
+func (f *Fake) ContainerList(_ context.Context, _ container.ListOptions) ([]types.Container, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := make([]types.Container, 0, len(f.containers))
+	for _, c := range f.containers {
+		out = append(out, types.Container{
+			ID:     c.ID,
+			Names:  []string{"/" + c.Name},
+			Labels: maps.Clone(c.Labels),
+			State:  state(c),
+			NetworkSettings: &types.SummaryNetworkSettings{
+				Networks: c.networks(),
+			},
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out, nil
+}
+
+// ContainerInspect implements docker.Client.
+func (f *Fake) ContainerInspect(_ context.Context, id string) (types.ContainerJSON, error) {
+	f.mu.Lock()
+	c, ok := f.containers[id]
+	f.mu.Unlock()
+	if !ok {
+		return types.ContainerJSON{}, errdefs.NotFound(fmt.Errorf("no such container: %s", id))
+	}
+	networks := c.networks()
+	ports := make(nat.PortMap)
+	for port, hostPort := range c.Published {
+		ports[nat.Port(fmt.Sprintf("%d/tcp", port))] = []nat.PortBinding{{HostIP: "0.0.0.0", HostPort: strconv.Itoa(int(hostPort))}}
+	}
+	st := &types.ContainerState{Status: state(c), Running: true, Paused: c.Paused}
+	if c.Health != "" {
+		st.Health = &types.Health{Status: c.Health}
+	}
+	return types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID:    c.ID,
+			Name:  "/" + c.Name,
+			State: st,
+		},
+		Config: &container.Config{Labels: maps.Clone(c.Labels)},
+		NetworkSettings: &types.NetworkSettings{
+			NetworkSettingsBase: types.NetworkSettingsBase{Ports: ports},
+			Networks:            networks,
+		},
+	}, nil
+}
+
+// networks is a container's network settings.
+func (c Container) networks() map[string]*network.EndpointSettings {
+	networks := make(map[string]*network.EndpointSettings)
+	if c.IP == "" {
+		return networks
+	}
+	ep := &network.EndpointSettings{IPAddress: c.IP}
+	if ip, err := netip.ParseAddr(c.IP); err == nil && ip.Is6() {
+		ep = &network.EndpointSettings{GlobalIPv6Address: c.IP}
+	}
+	name := c.Network
+	if name == "" {
+		name = "envoyage"
+	}
+	networks[name] = ep
+	return networks
+}
+
+// state is a container's State as docker ps shows it.
+func state(c Container) string {
+	if c.Paused {
+		return "paused"
+	}
+	return "running"
+}
+
+// actor describes a container in an event, with its name and labels as
+// attributes.
+func (f *Fake) actor(id string) events.Actor {
+	f.mu.Lock()
+	c := f.containers[id]
+	f.mu.Unlock()
+	attrs := maps.Clone(c.Labels)
+	if attrs == nil {
+		attrs = make(map[string]string)
+	}
+	attrs["name"] = c.Name
+	return events.Actor{ID: id, Attributes: attrs}
+}
+
+// send delivers e to every open stream, waiting for each to take it.
+func (f *Fake) send(e events.Message) {
+	now := time.Now()
+	e.Time, e.TimeNano = now.Unix(), now.UnixNano()
+	f.mu.Lock()
+	subs := make([]*subscriber, 0, len(f.subs))
+	for s := range f.subs {
+		subs = append(subs, s)
+	}
+	f.mu.Unlock()
+	for _, s := range subs {
+		select {
+		case s.events <- e:
+		case <-s.done:
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package dockertest_test
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/envoyage/envoyage/internal/config"
+	"github.com/envoyage/envoyage/internal/docker"
+	"github.com/envoyage/envoyage/internal/docker/dockertest"
+	"github.com/envoyage/envoyage/internal/metrics"
+	"github.com/envoyage/envoyage/internal/registry"
+	"github.com/envoyage/envoyage/internal/registry/registrytest"
+)
+
+// watch runs a watcher on fake for the rest of the test.
+func watch(t *testing.T, fake *dockertest.Fake, cfg config.Docker) *registry.Registry {
+	t.Helper()
+	reg, _ := registrytest.New(t)
+	w := docker.NewWatcherWithClient(reg, cfg, fake, metrics.NewRegistry(), slog.New(slog.DiscardHandler))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- w.Run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("watcher: %v", err)
+		}
+	})
+	registrytest.Wait(t, reg, "watcher connected", func(*registry.Registry) bool { return w.Connected() })
+	return reg
+}
+
+func jellyfin() dockertest.Container {
+	return dockertest.Container{
+		Name: "jellyfin",
+		IP:   "172.18.0.5",
+		Labels: map[string]string{
+			"envoyage.enable": "true",
+			"envoyage.domain": "jellyfin.example.com",
+			"envoyage.port":   "8096",
+		},
+	}
+}
+
+func TestStartAndStop(t *testing.T) {
+	fake := dockertest.NewFake()
+	reg := watch(t, fake, config.Docker{})
+
+	id := fake.Start(jellyfin())
+	svc := registrytest.WaitService(t, reg, "jellyfin")
+	if svc.Source != registry.SourceDocker || svc.Container != id {
+		t.Errorf("source, container = %q, %q; want %q, %q", svc.Source, svc.Container, registry.SourceDocker, id)
+	}
+	if svc.Domain != "jellyfin.example.com" || svc.Upstream != "172.18.0.5:8096" {
+		t.Errorf("domain, upstream = %q, %q", svc.Domain, svc.Upstream)
+	}
+
+	fake.Stop(id)
+	registrytest.WaitRemoved(t, reg, "jellyfin")
+}
+
+func TestReconcileFindsMissedChanges(t *testing.T) {
+	fake := dockertest.NewFake()
+	reg := watch(t, fake, config.Docker{ReconcileInterval: 20 * time.Millisecond})
+
+	id := fake.Add(jellyfin())
+	registrytest.WaitService(t, reg, "jellyfin")
+	if c := registrytest.LastChange(t, reg, "jellyfin"); !strings.Contains(c.Comment, "reconcile") {
+		t.Errorf("change comment = %q, want it found by reconcile", c.Comment)
+	}
+
+	fake.Forget(id)
+	registrytest.WaitRemoved(t, reg, "jellyfin")
+}
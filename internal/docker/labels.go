@@ -0,0 +1,145 @@
+package docker
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Label schema
+//
+// envoyage.schema says which version of the labels a container was written
+// for; without it, it is version 1, the labels documented in this package.
+// When a label changes meaning, LabelSchema goes up and ServiceFromLabels
+// keeps reading the old meaning for containers that declare an older
+// version. Containers declaring a newer version than this control plane
+// knows are refused rather than misread.
+//
+// With docker.strict_labels, the watcher also checks every container's
+// envoyage.* keys against the known ones, so a typo such as envoyage.domian
+// is reported (logged, counted in envoyage_docker_label_problems and listed
+// by GET /diagnostics) instead of silently ignored.
+
+// LabelSchema is the newest label schema version this control plane reads.
+const LabelSchema = 1
+
+// labelSchema declares the label schema version, e.g. "1".
+const labelSchema = "envoyage.schema"
+
+// knownLabels are every envoyage.* key a container may set, besides the
+// envoyage.headers.* and envoyage.http.<group>.* forms.
+var knownLabels = []string{
+	labelEnable, labelDomain, labelPort, labelName, labelSchema,
+	labelExtAuthz, labelBasicAuth, labelChallenge, labelNamespace, labelRateLimit,
+	labelExposure, labelStreaming, labelPrivacy, labelNodes, labelMaxBodySize,
+	labelMaintenance, labelTCPPorts, labelHostRewrite, labelVClusters, labelAliases, labelMount,
+	labelJWTIssuer, labelJWTJWKSURI, labelJWTAudiences,
+	labelHealthCheck, labelHealthCheckSend, labelHealthCheckExpect, labelHealthCheckInterval, labelHealthCheckTimeout,
+	labelConcurrency, labelConcurrencyQueue, labelLBPolicy, labelFailover,
+	labelNetwork, labelUseHostPort, labelDependsOn, labelWasm, labelFilterConfig, labelRouteMetadata,
+	labelShadow, labelShadowPercent,
+	labelClientCertXFCC, labelClientCertHeaders,
+	labelCache, labelCacheBypassCookies, labelCacheBypassHeaders, labelCachePrivateHeaders, labelCacheAuthenticated,
+	labelTLSMinVersion, labelTLSClientCert, labelTLSCertChain, labelTLSPrivateKey,
+}
+
+// LabelProblem is an envoyage.* label of a running container that strict
+// mode flagged.
+type LabelProblem struct {
+	Host      string `json:"host,omitempty"` // docker.hosts name, empty for the local engine
+	Container string `json:"container"`      // name, as docker ps shows it
+	Label     string `json:"label"`
+	Message   string `json:"message"`
+}
+
+// labelSchemaVersion returns the schema version the labels declare.
+func labelSchemaVersion(labels map[string]string) (int, error) {
+	v, ok := labels[labelSchema]
+	if !ok {
+		return 1, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid label %q=%q: must be a version number", labelSchema, v)
+	}
+	if n > LabelSchema {
+		return 0, fmt.Errorf("label %q=%q: this control plane reads up to schema %d", labelSchema, v, LabelSchema)
+	}
+	return n, nil
+}
+
+// checkLabels returns the problems with a container's labels strict mode
+// reports: unknown envoyage.* keys and an unusable schema version. Problems
+// that stop a service from registering are reported by the watcher anyway.
+func checkLabels(host, container string, labels map[string]string) []LabelProblem {
+	var out []LabelProblem
+	if _, err := labelSchemaVersion(labels); err != nil {
+		out = append(out, LabelProblem{Host: host, Container: container, Label: labelSchema, Message: err.Error()})
+	}
+	for k := range labels {
+		if !strings.HasPrefix(k, "envoyage.") || knownLabel(k) {
+			continue
+		}
+		msg := "unknown label"
+		if s := suggestLabel(k); s != "" {
+			msg += fmt.Sprintf("; did you mean %q?", s)
+		}
+		out = append(out, LabelProblem{Host: host, Container: container, Label: k, Message: msg})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Label < out[j].Label })
+	return out
+}
+
+// knownLabel reports whether k is a label ServiceFromLabels or
+// containerServices reads.
+func knownLabel(k string) bool {
+	if rest, ok := strings.CutPrefix(k, labelGroup); ok {
+		group, key, _ := strings.Cut(rest, ".")
+		return group != "" && key != "" && knownLabel("envoyage."+key)
+	}
+	return slices.Contains(knownLabels, k) || strings.HasPrefix(k, labelHeaders)
+}
+
+// suggestLabel returns the known label closest to an unknown one, if it is
+// a likely typo of it.
+func suggestLabel(k string) string {
+	prefix := ""
+	if rest, ok := strings.CutPrefix(k, labelGroup); ok {
+		if group, key, ok := strings.Cut(rest, "."); ok {
+			prefix, k = labelGroup+group+".", "envoyage."+key
+		}
+	}
+	best, bestDist := "", 3 // at most two edits away
+	for _, known := range knownLabels {
+		if d := editDistance(k, known); d < bestDist {
+			best, bestDist = known, d
+		}
+	}
+	if best == "" || prefix == "" {
+		return best
+	}
+	return prefix + strings.TrimPrefix(best, "envoyage.")
+}
+
+// editDistance is the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
@@ -0,0 +1,77 @@
+package docker
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+)
+
+// podmanActionDied is how some Podman versions report events.ActionDie.
+const podmanActionDied events.Action = "died"
+
+// Podman
+//
+// Podman serves the Docker API on its own socket, so the watcher uses the
+// same client against it. What differs:
+//
+//   - The socket is per user when rootless, and DOCKER_HOST is rarely set.
+//     podmanHost looks where Podman puts it.
+//   - Rootless containers on the default network (slirp4netns or pasta)
+//     have no IP the home Envoy can reach, only published ports.
+//     publishedAddr finds those.
+//   - Some Podman versions report a container exiting as "died" on the
+//     compatible event stream, not "die"; handleEvent accepts both.
+
+// podmanHost returns the API address of the local Podman service:
+// CONTAINER_HOST if set, else the first of the rootless and rootful sockets
+// that exists.
+func podmanHost() (string, error) {
+	if h := os.Getenv("CONTAINER_HOST"); h != "" {
+		return h, nil
+	}
+	var candidates []string
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		candidates = append(candidates, filepath.Join(dir, "podman", "podman.sock"))
+	}
+	candidates = append(candidates,
+		filepath.Join("/run/user", strconv.Itoa(os.Getuid()), "podman", "podman.sock"),
+		"/run/podman/podman.sock",
+	)
+	for _, path := range candidates {
+		if _, err := os.Stat(path); err == nil {
+			return "unix://" + path, nil
+		}
+	}
+	return "", fmt.Errorf("no Podman socket found (tried %s); start podman.socket or set docker.host", strings.Join(candidates, ", "))
+}
+
+// publishedAddr returns the host address a container's TCP port is
+// published on. A wildcard host IP is replaced by host.
+func publishedAddr(info types.ContainerJSON, port uint64, host string) (string, bool) {
+	if info.NetworkSettings == nil {
+		return "", false
+	}
+	want := strconv.FormatUint(port, 10) + "/tcp"
+	for p, bindings := range info.NetworkSettings.Ports {
+		if string(p) != want {
+			continue
+		}
+		for _, b := range bindings {
+			if b.HostPort == "" {
+				continue
+			}
+			ip := b.HostIP
+			if ip == "" || ip == "0.0.0.0" || ip == "::" {
+				ip = host
+			}
+			return net.JoinHostPort(ip, b.HostPort), true
+		}
+	}
+	return "", false
+}
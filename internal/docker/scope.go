@@ -0,0 +1,64 @@
+package docker
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/envoyage/envoyage/internal/config"
+)
+
+// labelComposeProject is the Compose project a container belongs to,
+// set by Docker Compose.
+const labelComposeProject = "com.docker.compose.project"
+
+// scope is which containers the watcher may discover: config.Docker's
+// Projects and Networks, and their exclusions. The zero scope allows all.
+type scope struct {
+	projects, excludeProjects []string
+	networks, excludeNetworks []string
+}
+
+func newScope(cfg config.Docker) scope {
+	return scope{
+		projects:        cfg.Projects,
+		excludeProjects: cfg.ExcludeProjects,
+		networks:        cfg.Networks,
+		excludeNetworks: cfg.ExcludeNetworks,
+	}
+}
+
+// check returns why a container with these labels, attached to these
+// networks, is out of scope, or "" if it is in.
+func (s scope) check(labels map[string]string, networks []string) string {
+	project := labels[labelComposeProject]
+	switch {
+	case len(s.projects) > 0 && !slices.Contains(s.projects, project):
+		if project == "" {
+			return "not in a compose project"
+		}
+		return fmt.Sprintf("in compose project %s, not in docker.projects", project)
+	case slices.Contains(s.excludeProjects, project):
+		return fmt.Sprintf("in excluded compose project %s", project)
+	}
+	for _, n := range networks {
+		if slices.Contains(s.excludeNetworks, n) {
+			return fmt.Sprintf("on excluded network %s", n)
+		}
+	}
+	if len(s.networks) > 0 && !slices.ContainsFunc(networks, s.allowsNetwork) {
+		return "on none of docker.networks"
+	}
+	return ""
+}
+
+// allowsNetwork reports whether the container's address on network n may
+// be used.
+func (s scope) allowsNetwork(n string) bool {
+	return len(s.networks) == 0 || slices.Contains(s.networks, n)
+}
+
+// networkNames returns the sorted keys of a container's networks.
+func networkNames[T any](networks map[string]T) []string {
+	return slices.Sorted(maps.Keys(networks))
+}
@@ -0,0 +1,123 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sshDialer returns a dialer reaching the engine of an ssh:// host the way
+// the docker CLI does: every connection runs "docker system dial-stdio"
+// (or podman's) over ssh and talks the API over its stdin and stdout.
+// Authentication is ssh's: the control plane user's keys, agent and
+// ~/.ssh/config. addr is the host's address without the user, for the
+// client's requests and errors.
+func sshDialer(host, engine string) (addr string, dial func(ctx context.Context, network, addr string) (net.Conn, error), err error) {
+	u, err := url.Parse(host)
+	if err != nil {
+		return "", nil, fmt.Errorf("parsing %q: %w", host, err)
+	}
+	if u.Hostname() == "" || strings.Trim(u.Path, "/") != "" {
+		return "", nil, fmt.Errorf("invalid ssh host %q: want ssh://[user@]host[:port]", host)
+	}
+	args := []string{"-o", "BatchMode=yes", "-o", "ConnectTimeout=30"}
+	if u.User != nil {
+		args = append(args, "-l", u.User.Username())
+	}
+	if port := u.Port(); port != "" {
+		args = append(args, "-p", port)
+	}
+	args = append(args, "--", u.Hostname(), engine, "system", "dial-stdio")
+
+	return u.Host, func(ctx context.Context, _, _ string) (net.Conn, error) {
+		// Not CommandContext: ctx only bounds the dial, and the connection
+		// outlives it.
+		cmd := exec.Command("ssh", args...)
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		c := &commandConn{cmd: cmd, stdin: stdin, stdout: stdout}
+		cmd.Stderr = &c.stderr
+		if err := cmd.Start(); err != nil {
+			return nil, fmt.Errorf("running ssh: %w", err)
+		}
+		return c, nil
+	}, nil
+}
+
+// commandConn is a net.Conn over a command's stdin and stdout.
+type commandConn struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+	stderr tailBuffer
+
+	closeOnce sync.Once
+}
+
+func (c *commandConn) Read(p []byte) (int, error) {
+	n, err := c.stdout.Read(p)
+	if err == io.EOF {
+		// The command exited: its last words say why.
+		if msg := c.stderr.String(); msg != "" {
+			err = fmt.Errorf("over ssh: %s", msg)
+		}
+	}
+	return n, err
+}
+
+func (c *commandConn) Write(p []byte) (int, error) { return c.stdin.Write(p) }
+
+func (c *commandConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.stdin.Close()
+		c.cmd.Process.Kill()
+		c.cmd.Wait()
+	})
+	return nil
+}
+
+func (c *commandConn) LocalAddr() net.Addr              { return commandAddr{} }
+func (c *commandConn) RemoteAddr() net.Addr             { return commandAddr{} }
+func (c *commandConn) SetDeadline(time.Time) error      { return nil }
+func (c *commandConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *commandConn) SetWriteDeadline(time.Time) error { return nil }
+
+type commandAddr struct{}
+
+func (commandAddr) Network() string { return "ssh" }
+func (commandAddr) String() string  { return "ssh" }
+
+// tailBuffer keeps the last few hundred bytes written to it, safe for
+// concurrent use.
+type tailBuffer struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf = append(b.buf, p...)
+	if over := len(b.buf) - 512; over > 0 {
+		b.buf = b.buf[over:]
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return strings.TrimSpace(string(b.buf))
+}
@@ -3,6 +3,7 @@
 // The Watcher subscribes to the Docker event stream and translates container
 // lifecycle events into registry mutations. When a container with the right
 // labels starts, it is registered as a service. When it stops, it is removed.
+// Podman works too, through its Docker-compatible API (config docker.engine).
 //
 // Label reference (add to any docker-compose.yml service):
 //
@@ -10,25 +11,115 @@
 //	envoyage.domain: "app.example.com" # required — virtual host domain
 //	envoyage.port:   "8080"            # required — port the app listens on
 //	envoyage.name:   "myapp"           # optional — override service name
+//	envoyage.ext_authz: "true"         # optional — require SSO via ext_authz
+//	envoyage.basic_auth: "alice:{SHA}…,bob:{SHA}…" # optional — htpasswd users
+//	envoyage.challenge: "true"         # optional — anti-abuse challenge at the edge
+//	envoyage.namespace: "family"       # optional — inherit namespace defaults/bounds
+//	envoyage.rate_limit: "50"          # optional — requests/second per node
+//	envoyage.max_body_size: "10m"      # optional — request body cap (k, m, g)
+//	envoyage.exposure:  "lan"          # optional — "public" (default) or "lan"
+//	envoyage.streaming: "true"         # optional — stream large uploads unbuffered
+//	envoyage.headers.response.set.Strict-Transport-Security: "max-age=31536000"
+//	envoyage.headers.request.set.Host: "internal.name" # optional — header rules:
+//	envoyage.headers.response.remove: "Server,X-Powered-By" # <request|response>.<set|add>.<Name>
+//	                                                         # and <request|response>.remove
+//	envoyage.host_rewrite: "auto"      # optional — Host sent to the app: auto or a host
+//	envoyage.virtual_clusters: "api=/api/*,ws=/ws" # optional — per-path stats groups
+//	envoyage.aliases: "photos.example.com=/photos,dav.example.com=files.lan/dav"
+//	                                   # optional — more domains: domain=[host]path
+//	envoyage.jwt.issuer:    "https://auth.example.com"           # optional — require a JWT
+//	envoyage.jwt.jwks_uri:  "https://auth.example.com/jwks.json" # required with jwt.issuer
+//	envoyage.jwt.audiences: "api,mobile"                         # optional — accepted aud values
+//	envoyage.health_check: "tcp"             # optional — probe the port over TCP
+//	envoyage.health_check.send:   "PING\r\n" # optional — bytes to write (Go escapes)
+//	envoyage.health_check.expect: "+PONG"    # optional — reply must contain this
+//	envoyage.health_check.interval: "10s"    # optional — also .timeout (default 2s)
+//	envoyage.lb_policy: "least_request"      # optional — also random or ring_hash
+//	envoyage.shadow: "myapp-next"            # optional — copy requests to this service,
+//	envoyage.shadow.percent: "10"            # all of them by default
+//	envoyage.client_cert.xfcc: "true"        # optional — pass the client cert as XFCC
+//	envoyage.client_cert.headers: "X-Client-Subject=subject,X-Client-URI=uri_san"
+//	                                         # optional — single fields as headers
+//	envoyage.tls.min_version: "1.3"          # optional — own TLS settings on the edges:
+//	envoyage.tls.client_cert: "required"     # none, optional or required
+//	envoyage.tls.cert_chain:  "/etc/envoyage/app.pem" # with .private_key
+//	envoyage.failover: "10.8.0.20:8080"      # optional — the edges' upstream while home is down
+//	envoyage.depends_on: "myapp-api,auth"    # optional — only serve once these are up
+//	envoyage.wasm: '[{"module": "geoblock"}]' # optional — uploaded Wasm modules to run
+//	envoyage.route_metadata: '{"app": {"team": "media"}}' # optional — raw Envoy config:
+//	envoyage.filter_config: '{"<filter>": {"@type": …}}'  # per-filter config, route metadata
+//	envoyage.network: "proxy"                # optional — network whose IP to register
+//	envoyage.use_host_port: "true"           # optional — register the published port instead
+//	envoyage.schema: "1"                     # optional — label schema version, see labels.go
 //
 // If envoyage.name is not set, the name is derived from the Docker Compose
 // service label (com.docker.compose.service) or the container name.
+//
+// A container with a Docker healthcheck is only registered once it reports
+// healthy, so Envoy never routes to an app that is still booting, and its
+// services are removed while it reports unhealthy (unless
+// docker.ignore_health is set). Pausing a container, or disconnecting it
+// from its last network, removes its services until it is unpaused or
+// reconnected; renaming it re-registers it under its new name.
+//
+// docker.projects and docker.networks (and their exclude_ forms) scope
+// discovery on a shared host: a container outside them is never
+// registered, whatever its labels. See scope.go.
+//
+// Besides the local engine, one watcher per docker.hosts entry discovers
+// the containers of another machine over tcp:// or ssh://. Their services
+// remember the host (registry.Service.DockerHost), so each watcher only
+// removes its own, and a name one host's container registered is not taken
+// over by another's. See NewHostWatcher.
+//
+// A container serving several ports registers one service per indexed
+// group instead, Traefik-style. Any label above can be set per group as
+// envoyage.http.<group>.<key>; the container-level ones, except domain,
+// port and name, are defaults for every group:
+//
+//	envoyage.enable: "true"
+//	envoyage.ext_authz: "true"                  # applies to both
+//	envoyage.http.ui.domain:  "app.example.com"
+//	envoyage.http.ui.port:    "8080"            # service "<name>-ui"
+//	envoyage.http.api.domain: "api.example.com"
+//	envoyage.http.api.port:   "9000"            # service "<name>-api"
+//	envoyage.http.api.ext_authz: "false"        # overrides the default
+//
+// Group names can't contain dots.
 package docker
 
 import (
+	"cmp"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"maps"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/events"
 	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
 	dockerclient "github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
 
+	"github.com/envoyage/envoyage/internal/config"
+	"github.com/envoyage/envoyage/internal/metrics"
 	"github.com/envoyage/envoyage/internal/registry"
+	"github.com/envoyage/envoyage/internal/supervisor"
 )
 
 // Label keys the watcher looks for on containers.
@@ -38,31 +129,233 @@ const (
 	labelPort   = "envoyage.port"
 	labelName   = "envoyage.name"
 
+	labelExtAuthz  = "envoyage.ext_authz"
+	labelBasicAuth = "envoyage.basic_auth"
+	labelChallenge = "envoyage.challenge"
+	labelNamespace = "envoyage.namespace"
+	labelRateLimit = "envoyage.rate_limit"
+	labelExposure  = "envoyage.exposure"
+	labelStreaming = "envoyage.streaming"
+	labelPrivacy   = "envoyage.privacy"
+	labelNodes     = "envoyage.nodes"
+
+	// labelMaxBodySize caps request bodies, in bytes or with a k, m or g
+	// suffix (binary, as nginx's client_max_body_size), e.g. 10m.
+	labelMaxBodySize = "envoyage.max_body_size"
+
+	// labelMaintenance, when set, decides maintenance mode instead of the
+	// API and portal, e.g. true while a compose stack is upgraded. Set it
+	// to false to end it: without the label the mode is left as it is.
+	labelMaintenance = "envoyage.maintenance"
+	labelTCPPorts  = "envoyage.tcp_ports"
+	labelHeaders   = "envoyage.headers." // prefix, see parseHeaderLabels
+	labelVClusters = "envoyage.virtual_clusters"
+	labelAliases   = "envoyage.aliases"
+	labelMount     = "envoyage.mount"
+
+	labelJWTIssuer    = "envoyage.jwt.issuer"
+	labelJWTJWKSURI   = "envoyage.jwt.jwks_uri"
+	labelJWTAudiences = "envoyage.jwt.audiences"
+
+	labelHealthCheck         = "envoyage.health_check"
+	labelHealthCheckSend     = "envoyage.health_check.send"
+	labelHealthCheckExpect   = "envoyage.health_check.expect"
+	labelHealthCheckInterval = "envoyage.health_check.interval"
+	labelHealthCheckTimeout  = "envoyage.health_check.timeout"
+
+	labelConcurrency      = "envoyage.concurrency"
+	labelConcurrencyQueue = "envoyage.concurrency.queue"
+
+	// labelLBPolicy balances over the upstream's hosts: round_robin,
+	// least_request, random or ring_hash.
+	labelLBPolicy = "envoyage.lb_policy"
+
+	// labelFailover is a second upstream the edges use while home is
+	// unreachable, as host:port.
+	labelFailover = "envoyage.failover"
+
+	// labelShadow copies the requests to another service, e.g. the
+	// container running the next version; envoyage.shadow.percent of them,
+	// or all.
+	labelShadow        = "envoyage.shadow"
+	labelShadowPercent = "envoyage.shadow.percent"
+
+	// labelGroup prefixes indexed groups, one service each:
+	// envoyage.http.<group>.<key> is envoyage.<key> for that service.
+	labelGroup = "envoyage.http."
+
+	labelClientCertXFCC    = "envoyage.client_cert.xfcc"
+	labelClientCertHeaders = "envoyage.client_cert.headers"
+
+	labelCache               = "envoyage.cache"
+	labelCacheBypassCookies  = "envoyage.cache.bypass_cookies"
+	labelCacheBypassHeaders  = "envoyage.cache.bypass_headers"
+	labelCachePrivateHeaders = "envoyage.cache.private_headers"
+	labelCacheAuthenticated  = "envoyage.cache.authenticated"
+
+	labelTLSMinVersion = "envoyage.tls.min_version"
+	labelTLSClientCert = "envoyage.tls.client_cert"
+	labelTLSCertChain  = "envoyage.tls.cert_chain"
+	labelTLSPrivateKey = "envoyage.tls.private_key"
+
+	// labelFilterConfig and labelRouteMetadata pass raw Envoy config
+	// through, as a JSON object; see registry.Service.FilterConfig.
+	labelFilterConfig  = "envoyage.filter_config"
+	labelRouteMetadata = "envoyage.route_metadata"
+
+	// labelHostRewrite replaces the Host header the app gets: "auto" for
+	// its own address, or a host; see registry.Service.HostRewrite.
+	labelHostRewrite = "envoyage.host_rewrite"
+
+	// labelWasm runs uploaded Wasm modules as filters for the service, as
+	// a JSON array; see registry.ParseWasmFilters.
+	labelWasm = "envoyage.wasm"
+
+	// labelDependsOn names services, by envoyage name, this one is only
+	// served after.
+	labelDependsOn = "envoyage.depends_on"
+
+	// labelUseHostPort registers the container at the port it publishes
+	// on docker.published_host instead of its IP, overriding
+	// config.Docker.UseHostPort.
+	labelUseHostPort = "envoyage.use_host_port"
+
+	// labelNetwork names the network whose address the container is
+	// registered with, overriding config.Docker.Network.
+	labelNetwork = "envoyage.network"
+
 	// Docker Compose sets this automatically on every container it manages.
 	// We use it as a fallback service name when envoyage.name is not set.
 	labelComposeSvc = "com.docker.compose.service"
 )
 
+// Client is the part of the Docker API the watcher uses. Docker's and
+// Podman's clients implement it, and dockertest.Fake does for tests.
+type Client interface {
+	Events(ctx context.Context, options events.ListOptions) (<-chan events.Message, <-chan error)
+	ContainerList(ctx context.Context, options container.ListOptions) ([]types.Container, error)
+	ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error)
+}
+
 // Watcher watches the Docker socket and keeps the registry in sync with
 // running containers that have the appropriate labels.
 type Watcher struct {
-	client *dockerclient.Client
-	reg    *registry.Registry
-	log    *slog.Logger
+	client    Client
+	reg       *registry.Registry
+	engine    string
+	published string // config.Docker.PublishedHost
+	reconcile time.Duration
+	strict    bool // config.Docker.StrictLabels
+	health    bool   // !config.Docker.IgnoreHealth
+	network   string // config.Docker.Network
+	hostPort  bool   // config.Docker.UseHostPort
+	scope     scope
+	log       *slog.Logger
+
+	// For a watcher of one of config.Docker.Hosts: its name, and its
+	// Address and Nodes.
+	host    string
+	address string
+	nodes   []string
+
+	// connected is true while Run is subscribed to a working daemon.
+	connected atomic.Bool
+
+	mu       sync.Mutex
+	problems map[string][]LabelProblem // by container ID, in strict mode
+	problemC *metrics.Vec
 }
 
-// NewWatcher creates a Watcher connected to the local Docker daemon.
+// NewWatcher creates a Watcher connected to the local Docker daemon, or to
+// Podman's Docker-compatible API with cfg.Engine podman (see podman.go).
 // Reads DOCKER_HOST / DOCKER_CERT_PATH / DOCKER_TLS_VERIFY from the environment,
 // with automatic API version negotiation so it works across daemon versions.
-func NewWatcher(reg *registry.Registry, log *slog.Logger) (*Watcher, error) {
-	cli, err := dockerclient.NewClientWithOpts(
+// cfg.Host overrides the address.
+func NewWatcher(reg *registry.Registry, cfg config.Docker, m *metrics.Registry, log *slog.Logger) (*Watcher, error) {
+	opts := []dockerclient.Opt{
 		dockerclient.FromEnv,
 		dockerclient.WithAPIVersionNegotiation(),
-	)
+	}
+	host := cfg.Host
+	if host == "" && cfg.Engine == config.EnginePodman && os.Getenv("DOCKER_HOST") == "" {
+		var err error
+		if host, err = podmanHost(); err != nil {
+			return nil, err
+		}
+	}
+	if host != "" {
+		opts = append(opts, dockerclient.WithHost(host))
+	}
+	cli, err := dockerclient.NewClientWithOpts(opts...)
 	if err != nil {
-		return nil, fmt.Errorf("connecting to Docker daemon: %w", err)
+		return nil, fmt.Errorf("connecting to %s: %w", cfg.Engine, err)
+	}
+	return NewWatcherWithClient(reg, cfg, cli, m, log), nil
+}
+
+// NewHostWatcher creates a Watcher for host, one of cfg.Hosts. Unlike
+// NewWatcher it ignores the DOCKER_* environment, which is the local
+// engine's.
+func NewHostWatcher(reg *registry.Registry, cfg config.Docker, host config.DockerHost, m *metrics.Registry, log *slog.Logger) (*Watcher, error) {
+	opts := []dockerclient.Opt{dockerclient.WithAPIVersionNegotiation()}
+	if strings.HasPrefix(host.Host, "ssh://") {
+		addr, dial, err := sshDialer(host.Host, host.Engine)
+		if err != nil {
+			return nil, err
+		}
+		// The address only names the host in requests; dial ignores it.
+		opts = append(opts, dockerclient.WithHost("http://"+addr), dockerclient.WithDialContext(dial))
+	} else {
+		opts = append(opts, dockerclient.WithHost(host.Host))
+	}
+	if host.CertPath != "" {
+		opts = append(opts, dockerclient.WithTLSClientConfig(
+			filepath.Join(host.CertPath, "ca.pem"),
+			filepath.Join(host.CertPath, "cert.pem"),
+			filepath.Join(host.CertPath, "key.pem"),
+		))
+	}
+	cli, err := dockerclient.NewClientWithOpts(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to docker host %s: %w", host.Name, err)
+	}
+	return NewHostWatcherWithClient(reg, cfg, host, cli, m, log), nil
+}
+
+// NewHostWatcherWithClient creates a Watcher for host using cli, as
+// NewWatcherWithClient does.
+func NewHostWatcherWithClient(reg *registry.Registry, cfg config.Docker, host config.DockerHost, cli Client, m *metrics.Registry, log *slog.Logger) *Watcher {
+	if host.Engine != "" {
+		cfg.Engine = host.Engine
+	}
+	w := NewWatcherWithClient(reg, cfg, cli, m, log.With("docker_host", host.Name))
+	w.host, w.address, w.nodes = host.Name, host.Address, host.Nodes
+	return w
+}
+
+// NewWatcherWithClient creates a Watcher using cli, e.g. a
+// dockertest.Fake. cfg.Host is ignored, and an unset ReconcileInterval is
+// config.Default's.
+func NewWatcherWithClient(reg *registry.Registry, cfg config.Docker, cli Client, m *metrics.Registry, log *slog.Logger) *Watcher {
+	if cfg.ReconcileInterval <= 0 {
+		cfg.ReconcileInterval = config.Default().Docker.ReconcileInterval
+	}
+	return &Watcher{
+		client:    cli,
+		reg:       reg,
+		engine:    cfg.Engine,
+		published: cfg.PublishedHost,
+		reconcile: cfg.ReconcileInterval,
+		strict:    cfg.StrictLabels,
+		health:    !cfg.IgnoreHealth,
+		network:   cfg.Network,
+		hostPort:  cfg.UseHostPort,
+		scope:     newScope(cfg),
+		log:       log,
+		problems:  make(map[string][]LabelProblem),
+		problemC: m.NewVec("envoyage_docker_label_problems",
+			"Malformed envoyage.* labels per running container (docker.strict_labels).", metrics.Gauge, "host", "container"),
 	}
-	return &Watcher{client: cli, reg: reg, log: log}, nil
 }
 
 // Run starts the watcher. It first syncs already-running containers, then
@@ -70,18 +363,28 @@ func NewWatcher(reg *registry.Registry, log *slog.Logger) (*Watcher, error) {
 //
 // Call this in a goroutine alongside the xDS and HTTP servers.
 func (w *Watcher) Run(ctx context.Context) error {
-	w.log.Info("docker watcher starting")
+	w.log.Info("docker watcher starting", "engine", w.engine)
+	defer w.connected.Store(false)
 
 	// Sync containers that were already running when we started.
 	// Handles control plane restarts: existing containers are re-registered
-	// without waiting for a container start event.
-	if err := w.syncExisting(ctx); err != nil {
+	// without waiting for a container start event, and ones that went away
+	// meanwhile are removed.
+	if err := w.sync(ctx, "found at startup"); err != nil {
 		w.log.Warn("initial container sync failed", "error", err)
+	} else {
+		w.connected.Store(true)
 	}
 
-	// Subscribe to container events only.
+	// Events can still be missed, so sync again now and then.
+	ticker := time.NewTicker(w.reconcile)
+	defer ticker.Stop()
+
+	// Subscribe to container events, and network ones for containers
+	// connected to or disconnected from a network.
 	f := filters.NewArgs()
 	f.Add("type", string(events.ContainerEventType))
+	f.Add("type", string(events.NetworkEventType))
 
 	eventCh, errCh := w.client.Events(ctx, events.ListOptions{Filters: f})
 
@@ -96,25 +399,65 @@ func (w *Watcher) Run(ctx context.Context) error {
 			}
 			return fmt.Errorf("docker event stream: %w", err)
 		case event := <-eventCh:
+			w.connected.Store(true)
 			w.handleEvent(ctx, event)
+		case <-ticker.C:
+			if err := w.sync(ctx, "found by reconcile"); err != nil {
+				w.log.Warn("container reconcile failed", "error", err)
+			}
 		}
+		supervisor.Beat(ctx)
 	}
 }
 
-// syncExisting registers all currently running containers with envoyage labels.
-func (w *Watcher) syncExisting(ctx context.Context) error {
+// Host is the name of the docker.hosts entry the watcher watches, empty
+// for the local engine.
+func (w *Watcher) Host() string { return w.host }
+
+// Connected reports whether the watcher has reached the Docker daemon and
+// its event stream is still open.
+func (w *Watcher) Connected() bool { return w.connected.Load() }
+
+// sync converges the registry on the running containers: every one with
+// envoyage labels is registered or updated, and services discovered from
+// containers that are no longer running are removed. Services added
+// through the API are left alone. found says why a container is being
+// registered, for the change history.
+func (w *Watcher) sync(ctx context.Context, found string) error {
 	containers, err := w.client.ContainerList(ctx, container.ListOptions{})
 	if err != nil {
 		return fmt.Errorf("listing containers: %w", err)
 	}
 
+	// Names of every labeled container, registered or not: one whose labels
+	// are broken keeps the service it had.
+	running := make(map[string]bool)
+	ids := make(map[string]bool)
 	registered := 0
 	for _, c := range containers {
 		if c.Labels[labelEnable] != "true" {
 			continue
 		}
+		var networks []string
+		if c.NetworkSettings != nil {
+			networks = networkNames(c.NetworkSettings.Networks)
+		}
+		if reason := w.scope.check(c.Labels, networks); reason != "" {
+			w.unregister(ctx, c.ID, nil, reason)
+			continue
+		}
+		ids[c.ID] = true
+		var containerName string
+		if len(c.Names) > 0 {
+			containerName = c.Names[0]
+		}
+		for name := range containerServices(c.Labels, containerName) {
+			running[name] = true
+		}
+
+		ctx := w.comment(ctx, c.ID, found)
 		if err := w.registerByID(ctx, c.ID); err != nil {
-			w.log.Warn("skipping container during sync",
+			w.log.Warn("container not (fully) registered during sync",
 				"id", shortID(c.ID),
 				"error", err,
 			)
@@ -123,17 +466,65 @@ func (w *Watcher) syncExisting(ctx context.Context) error {
 		registered++
 	}
 
-	w.log.Info("initial sync complete",
+	w.mu.Lock()
+	stale := slices.Collect(maps.Keys(w.problems))
+	w.mu.Unlock()
+	for _, id := range stale {
+		if !ids[id] {
+			w.setProblems(id, "", nil)
+		}
+	}
+
+	removed := 0
+	services, _ := w.reg.Snapshot()
+	for _, svc := range services {
+		if svc.Container == "" || svc.DockerHost != w.host || running[svc.Name] {
+			continue
+		}
+		ctx := w.comment(ctx, svc.Container, "no longer running")
+		if err := w.reg.Remove(ctx, svc.Name); err != nil {
+			w.log.Warn("failed to remove service of a stopped container", "name", svc.Name, "error", err)
+			continue
+		}
+		w.log.Info("docker: service removed", "name", svc.Name, "reason", "container no longer running")
+		removed++
+	}
+
+	// Quiet when a periodic sync finds nothing to do.
+	level := slog.LevelInfo
+	if found != "found at startup" && removed == 0 {
+		level = slog.LevelDebug
+	}
+	w.log.Log(ctx, level, "container sync complete",
 		"scanned", len(containers),
 		"registered", registered,
+		"removed", removed,
 	)
 	return nil
 }
 
-// handleEvent processes a single Docker container event.
+// handleEvent processes a single Docker container or network event.
 func (w *Watcher) handleEvent(ctx context.Context, event events.Message) {
+	if event.Type == events.NetworkEventType {
+		// The actor is the network; the container is an attribute. Its IP
+		// on the network came or went.
+		id := event.Actor.Attributes["container"]
+		if id == "" || (event.Action != events.ActionConnect && event.Action != events.ActionDisconnect) {
+			return
+		}
+		ctx := w.comment(ctx, id, "network "+string(event.Action))
+		if err := w.registerByID(ctx, id); err != nil && !errdefs.IsNotFound(err) {
+			w.log.Warn("failed to update container on network change",
+				"id", shortID(id),
+				"error", err,
+			)
+		}
+		return
+	}
+
 	switch event.Action {
 	case events.ActionStart:
+		ctx := w.comment(ctx, event.Actor.ID, "started")
 		if err := w.registerByID(ctx, event.Actor.ID); err != nil {
 			w.log.Warn("failed to register container on start",
 				"id", shortID(event.Actor.ID),
@@ -141,29 +532,41 @@ func (w *Watcher) handleEvent(ctx context.Context, event events.Message) {
 			)
 		}
 
-	case events.ActionStop, events.ActionDie, events.ActionKill:
+	case events.ActionHealthStatusHealthy, events.ActionHealthStatusUnhealthy, events.ActionHealthStatus,
+		events.ActionPause, events.ActionUnPause, events.ActionRename:
+		// Inspecting tells what changed: registerByID removes the services
+		// of a paused or unhealthy container, and those of a renamed one
+		// that were named after it. Podman sends a bare health_status.
+		ctx := w.comment(ctx, event.Actor.ID, string(event.Action))
+		if err := w.registerByID(ctx, event.Actor.ID); err != nil {
+			w.log.Warn("failed to update container",
+				"id", shortID(event.Actor.ID),
+				"action", string(event.Action),
+				"error", err,
+			)
+		}
+
+	case events.ActionStop, events.ActionDie, events.ActionKill, podmanActionDied:
 		// The container may already be gone by the time we handle this event,
 		// so we use the event actor attributes (set at event time, always
-		// available) rather than inspecting the possibly-gone container.
-		attrs := event.Actor.Attributes
-		if attrs[labelEnable] != "true" {
-			return
-		}
-		name := serviceName(attrs)
-		if name == "" {
+		// available) rather than inspecting the possibly-gone container, and
+		// remove its services by container ID rather than the names its
+		// labels give: another host's container may have registered those.
+		if event.Actor.Attributes[labelEnable] != "true" {
 			return
 		}
-		if err := w.reg.Remove(name); err != nil {
-			// Expected if the container was never registered (e.g. missing labels).
-			w.log.Debug("container not in registry on stop", "name", name)
-		} else {
-			w.log.Info("docker: service removed", "name", name, "action", string(event.Action))
-		}
+		w.setProblems(event.Actor.ID, "", nil)
+		w.unregister(ctx, event.Actor.ID, nil, string(event.Action))
 	}
 }
 
-// registerByID inspects a container by ID, validates its labels, resolves its
-// IP address, and upserts it into the registry.
+// registerByID inspects a container by ID, resolves its IP address, and
+// upserts each service its labels describe into the registry. A service
+// with invalid labels is skipped; the others are still registered, and
+// services the container registered under names it no longer describes,
+// e.g. before a rename, are removed. A paused container, one without a
+// network address or one whose healthcheck doesn't report healthy has all
+// its services removed instead.
 func (w *Watcher) registerByID(ctx context.Context, id string) error {
 	info, err := w.client.ContainerInspect(ctx, id)
 	if err != nil {
@@ -175,19 +578,26 @@ func (w *Watcher) registerByID(ctx context.Context, id string) error {
 	if labels[labelEnable] != "true" {
 		return nil // not opted in
 	}
-
-	// Validate required labels.
-	domain := labels[labelDomain]
-	if domain == "" {
-		return fmt.Errorf("missing required label %q", labelDomain)
+	var networks []string
+	if info.NetworkSettings != nil {
+		networks = networkNames(info.NetworkSettings.Networks)
 	}
-	portStr := labels[labelPort]
-	if portStr == "" {
-		return fmt.Errorf("missing required label %q", labelPort)
+	if reason := w.scope.check(labels, networks); reason != "" {
+		w.setProblems(info.ID, "", nil)
+		w.unregister(ctx, info.ID, nil, reason)
+		return nil
 	}
-	port, err := strconv.ParseUint(portStr, 10, 32)
-	if err != nil {
-		return fmt.Errorf("invalid label %q=%q: %w", labelPort, portStr, err)
+	if w.strict {
+		name := strings.TrimPrefix(info.Name, "/")
+		w.setProblems(info.ID, name, checkLabels(w.host, name, labels))
+	}
+	if info.State != nil && info.State.Paused {
+		w.unregister(ctx, info.ID, nil, "paused")
+		return nil
+	}
+	if status := healthStatus(info); w.health && status != "" && status != types.Healthy {
+		w.unregister(ctx, info.ID, nil, status)
+		return nil
 	}
 
 	// We use the actual IP rather than the Docker DNS name because:
@@ -195,65 +605,753 @@ func (w *Watcher) registerByID(ctx context.Context, id string) error {
 	//   b) IPs are unambiguous across compose projects with identical service names.
 	//   c) In a future phase, the registry stores both the local IP (home Envoy)
 	//      and the WireGuard hop (VPS Envoy) — the IP is the canonical local addr.
-	ip, err := containerIP(info)
-	if err != nil {
-		return fmt.Errorf("resolving IP for %s: %w", shortID(id), err)
+	// A remote host's containers are reached on its address instead, and
+	// with envoyage.use_host_port (or docker.use_host_port) on the ports
+	// they publish, for a home Envoy on the host network.
+	useHostPort := w.hostPort
+	if v := labels[labelUseHostPort]; v != "" {
+		if useHostPort, err = strconv.ParseBool(v); err != nil {
+			return fmt.Errorf("invalid label %q=%q: %w", labelUseHostPort, v, err)
+		}
+	}
+	publishedOn := w.address
+	if publishedOn == "" && useHostPort {
+		publishedOn = w.published
+	}
+	var ip string
+	var ipErr error
+	if publishedOn == "" {
+		ip, ipErr = containerIP(info, cmp.Or(labels[labelNetwork], w.network), w.scope.allowsNetwork)
+		if ipErr != nil && w.engine != config.EnginePodman {
+			w.unregister(ctx, info.ID, nil, "has no network address")
+			return fmt.Errorf("resolving IP for %s: %w", shortID(id), ipErr)
+		}
+	}
+	upstream := func(port uint64) (string, error) {
+		if publishedOn != "" {
+			if addr, ok := publishedAddr(info, port, publishedOn); ok {
+				return addr, nil
+			}
+			return "", fmt.Errorf("port %d of %s is not published on %s", port, shortID(id), hostName(w.host))
+		}
+		if ipErr == nil {
+			return net.JoinHostPort(ip, strconv.FormatUint(port, 10)), nil
+		}
+		// Rootless Podman: only published ports are reachable.
+		if w.engine == config.EnginePodman {
+			if addr, ok := publishedAddr(info, port, w.published); ok {
+				return addr, nil
+			}
+		}
+		return "", fmt.Errorf("resolving IP for %s: %w", shortID(id), ipErr)
 	}
 
-	name := serviceName(labels)
-	if name == "" {
-		name = strings.TrimPrefix(info.Name, "/")
+	services := containerServices(labels, info.Name)
+	names := make([]string, 0, len(services))
+	for name := range services {
+		names = append(names, name)
 	}
+	sort.Strings(names)
 
-	svc := &registry.Service{
-		Name:     name,
-		Domain:   domain,
-		Upstream: fmt.Sprintf("%s:%d", ip, port),
+	var errs []error
+	for _, name := range names {
+		svc, err := ServiceFromLabels(services[name], upstream)
+		if err == nil {
+			svc.Name, svc.Source, svc.Container, svc.DockerHost = name, registry.SourceDocker, info.ID, w.host
+			if svc.Nodes == nil {
+				svc.Nodes = w.nodes
+			}
+			err = w.upsert(ctx, svc, services[name][labelMaintenance] != "")
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("service %q: %w", name, err))
+		}
+	}
+	w.unregister(ctx, info.ID, services, "renamed")
+	return errors.Join(errs...)
+}
+
+// comment adds a change history comment saying what happened to container
+// id, e.g. "docker: container 3f2a9c1b7d0e started", naming the host if it
+// is a remote one.
+func (w *Watcher) comment(ctx context.Context, id, what string) context.Context {
+	source := "docker"
+	if w.host != "" {
+		source += "@" + w.host
+	}
+	return registry.WithComment(ctx, fmt.Sprintf("%s: container %s %s", source, shortID(id), what))
+}
+
+// hostLabel is the host label of a watcher's metrics: "local" for the
+// local engine.
+func hostLabel(host string) string {
+	if host == "" {
+		return "local"
 	}
+	return host
+}
 
-	// Upsert: try Add, fall back to Update on conflict.
-	// Makes registration idempotent across syncExisting + event-driven paths.
-	if err := w.reg.Add(svc); err != nil {
-		if err2 := w.reg.Update(svc); err2 != nil {
-			return fmt.Errorf("upserting %q: %w", name, err2)
+// hostName is how a docker.hosts name shows in messages.
+func hostName(host string) string {
+	if host == "" {
+		return "the local engine"
+	}
+	return "docker host " + host
+}
+
+// healthStatus is the container's healthcheck status (types.Starting,
+// Healthy or Unhealthy), or "" if it has no healthcheck.
+func healthStatus(info types.ContainerJSON) string {
+	if info.ContainerJSONBase == nil || info.State == nil || info.State.Health == nil {
+		return ""
+	}
+	return info.State.Health.Status
+}
+
+// unregister removes the services container id registered, except those
+// in keep, giving its status (e.g. "paused") as the reason.
+func (w *Watcher) unregister(ctx context.Context, id string, keep map[string]map[string]string, status string) {
+	if status == types.Starting {
+		w.log.Debug("docker: waiting for container to be healthy", "id", shortID(id))
+	}
+	ctx = w.comment(ctx, id, status)
+	services, _ := w.reg.Snapshot()
+	for _, svc := range services {
+		if _, ok := keep[svc.Name]; ok || svc.Container != id || svc.DockerHost != w.host {
+			continue
 		}
-		w.log.Info("docker: service updated",
-			"name", name, "domain", domain, "upstream", svc.Upstream)
+		if err := w.reg.Remove(ctx, svc.Name); err != nil {
+			w.log.Warn("failed to remove service of a container", "name", svc.Name, "error", err)
+			continue
+		}
+		w.log.Info("docker: service removed", "name", svc.Name, "reason", "container "+status)
+	}
+}
+
+// setProblems records the label problems of a container, logging them when
+// they change. No problems forget the container.
+func (w *Watcher) setProblems(id, name string, problems []LabelProblem) {
+	w.mu.Lock()
+	old, had := w.problems[id]
+	if len(problems) == 0 {
+		delete(w.problems, id)
 	} else {
+		w.problems[id] = problems
+	}
+	w.mu.Unlock()
+
+	if had && len(problems) == 0 {
+		w.problemC.Delete(hostLabel(w.host), old[0].Container)
+	}
+	if len(problems) == 0 || slices.Equal(old, problems) {
+		return
+	}
+	w.problemC.Set(float64(len(problems)), hostLabel(w.host), name)
+	for _, p := range problems {
+		w.log.Warn("docker: malformed label", "container", p.Container, "label", p.Label, "problem", p.Message)
+	}
+}
+
+// LabelProblems returns the label problems of the running containers,
+// ordered by container name. Only strict mode looks for them.
+func (w *Watcher) LabelProblems() []LabelProblem {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var out []LabelProblem
+	for _, problems := range w.problems {
+		out = append(out, problems...)
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Container < out[j].Container })
+	return out
+}
+
+// upsert stores a service discovered from a container. maintenance is
+// whether its labels set maintenance mode.
+func (w *Watcher) upsert(ctx context.Context, svc *registry.Service, maintenance bool) error {
+	// Upsert keeps registration idempotent across sync and event-driven
+	// paths. Maintenance mode (unless labeled) and share links are set
+	// through the portal or API, and canaries through the API; a container
+	// restart must not reset them.
+	op, err := w.reg.Upsert(ctx, svc.Name, func(existing *registry.Service) error {
+		if existing.Container != "" && existing.DockerHost != svc.DockerHost {
+			return fmt.Errorf("%w: a container on %s registered it", registry.ErrConflict, hostName(existing.DockerHost))
+		}
+		if !maintenance {
+			svc.Maintenance = existing.Maintenance
+		}
+		svc.MaintenancePage = existing.MaintenancePage
+		svc.ShareLinks = existing.ShareLinks
+		svc.Canary = existing.Canary
+		svc.Switch = existing.Switch
+		svc.Mirror = existing.Mirror
+		svc.Waiting = existing.Waiting
+		*existing = *svc
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("upserting %q: %w", svc.Name, err)
+	}
+	switch op {
+	case "add":
 		w.log.Info("docker: service registered",
-			"name", name, "domain", domain, "upstream", svc.Upstream)
+			"name", svc.Name, "domain", svc.Domain, "upstream", svc.Upstream)
+	case "update":
+		w.log.Info("docker: service updated",
+			"name", svc.Name, "domain", svc.Domain, "upstream", svc.Upstream)
 	}
 	return nil
 }
 
-// containerIP returns the IP address of a container, choosing the best network.
+// ServiceFromLabels validates one service's labels (see containerServices)
+// and builds it, apart from its name and container. upstream resolves the
+// container's address for a port. The Kubernetes watcher uses it for
+// Ingress annotations too.
+func ServiceFromLabels(labels map[string]string, upstream func(port uint64) (string, error)) (*registry.Service, error) {
+	if _, err := labelSchemaVersion(labels); err != nil {
+		return nil, err
+	}
+	// Validate required labels. A TCP forward (envoyage.tcp_ports, with
+	// envoyage.port as the port the first one goes to) has no domain.
+	domain := labels[labelDomain]
+	switch {
+	case domain == "" && labels[labelTCPPorts] == "":
+		return nil, fmt.Errorf("missing required label %q", labelDomain)
+	case domain != "":
+		if err := registry.ValidateDomain(domain, true); err != nil {
+			return nil, fmt.Errorf("invalid label %q: %w", labelDomain, err)
+		}
+	}
+	portStr := labels[labelPort]
+	if portStr == "" {
+		return nil, fmt.Errorf("missing required label %q", labelPort)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid label %q=%q: %w", labelPort, portStr, err)
+	}
+	addr, err := upstream(port)
+	if err != nil {
+		return nil, err
+	}
+
+	svc := &registry.Service{
+		Domain:    domain,
+		Upstream:  addr,
+		Namespace: labels[labelNamespace],
+		Exposure:  labels[labelExposure],
+	}
+	if v := labels[labelExtAuthz]; v != "" {
+		svc.ExtAuthz, err = strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid label %q=%q: %w", labelExtAuthz, v, err)
+		}
+	}
+	if v := labels[labelRateLimit]; v != "" {
+		svc.RateLimit, err = strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid label %q=%q: %w", labelRateLimit, v, err)
+		}
+	}
+	if v := labels[labelMaxBodySize]; v != "" {
+		svc.MaxBodyBytes, err = parseByteSize(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid label %q=%q: %w", labelMaxBodySize, v, err)
+		}
+	}
+	if v := labels[labelStreaming]; v != "" {
+		svc.Streaming, err = strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid label %q=%q: %w", labelStreaming, v, err)
+		}
+	}
+	if v := labels[labelMaintenance]; v != "" {
+		svc.Maintenance, err = strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid label %q=%q: %w", labelMaintenance, v, err)
+		}
+	}
+	if v := labels[labelPrivacy]; v != "" {
+		svc.Privacy, err = strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid label %q=%q: %w", labelPrivacy, v, err)
+		}
+	}
+	if v := labels[labelNodes]; v != "" {
+		for _, id := range strings.Split(v, ",") {
+			svc.Nodes = append(svc.Nodes, strings.TrimSpace(id))
+		}
+		if err := registry.ValidateNodes(svc.Nodes); err != nil {
+			return nil, fmt.Errorf("invalid label %q: %w", labelNodes, err)
+		}
+	}
+	if v := labels[labelChallenge]; v != "" {
+		svc.Challenge, err = strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid label %q=%q: %w", labelChallenge, v, err)
+		}
+	}
+	if v := labels[labelBasicAuth]; v != "" {
+		svc.BasicAuth, err = registry.ParseBasicAuth(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid label %q: %w", labelBasicAuth, err)
+		}
+	}
+	if v := labels[labelVClusters]; v != "" {
+		svc.VirtualClusters, err = registry.ParseVirtualClusters(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid label %q: %w", labelVClusters, err)
+		}
+	}
+	if v := labels[labelAliases]; v != "" {
+		svc.Aliases, err = registry.ParseAliases(domain, v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid label %q: %w", labelAliases, err)
+		}
+	}
+	if v := labels[labelMount]; v != "" {
+		if svc.Mount, err = registry.ParseMount(v); err != nil {
+			return nil, fmt.Errorf("invalid label %q: %w", labelMount, err)
+		}
+		if err := registry.ValidateMount(svc.Mount, svc.Aliases); err != nil {
+			return nil, fmt.Errorf("invalid label %q: %w", labelMount, err)
+		}
+	}
+	if svc.Headers, err = parseHeaderLabels(labels); err != nil {
+		return nil, err
+	}
+	if v := labels[labelHostRewrite]; v != "" {
+		svc.HostRewrite = v
+		if err := registry.ValidateHostRewrite(svc); err != nil {
+			return nil, fmt.Errorf("invalid label %q=%q: %w", labelHostRewrite, v, err)
+		}
+	}
+	if labels[labelJWTIssuer] != "" || labels[labelJWTJWKSURI] != "" {
+		svc.JWT = &registry.JWT{
+			Issuer:  labels[labelJWTIssuer],
+			JWKSURI: labels[labelJWTJWKSURI],
+		}
+		for _, aud := range strings.Split(labels[labelJWTAudiences], ",") {
+			if aud = strings.TrimSpace(aud); aud != "" {
+				svc.JWT.Audiences = append(svc.JWT.Audiences, aud)
+			}
+		}
+		if err := registry.ValidateJWT(svc.JWT); err != nil {
+			return nil, fmt.Errorf("invalid envoyage.jwt.* labels: %w", err)
+		}
+	}
+
+	if svc.HealthCheck, err = parseHealthCheckLabels(labels); err != nil {
+		return nil, err
+	}
+	if v, ok := labels[labelLBPolicy]; ok {
+		if err := registry.ValidateLBPolicy(v, nil); err != nil {
+			return nil, fmt.Errorf("invalid label %q=%q: %w", labelLBPolicy, v, err)
+		}
+		svc.LBPolicy = v
+	}
+	if svc.Concurrency, err = parseConcurrencyLabels(labels); err != nil {
+		return nil, err
+	}
+	if v, ok := labels[labelFailover]; ok {
+		if err := registry.ValidateUpstream(v); err != nil {
+			return nil, fmt.Errorf("invalid label %q=%q: %w", labelFailover, v, err)
+		}
+		svc.Failover = v
+	}
+	if v := labels[labelFilterConfig]; v != "" {
+		if err := json.Unmarshal([]byte(v), &svc.FilterConfig); err != nil {
+			return nil, fmt.Errorf("invalid label %q: want a JSON object: %w", labelFilterConfig, err)
+		}
+	}
+	if v := labels[labelRouteMetadata]; v != "" {
+		if err := json.Unmarshal([]byte(v), &svc.RouteMetadata); err != nil {
+			return nil, fmt.Errorf("invalid label %q: want a JSON object: %w", labelRouteMetadata, err)
+		}
+	}
+	if v := labels[labelWasm]; v != "" {
+		if svc.Wasm, err = registry.ParseWasmFilters(v); err != nil {
+			return nil, fmt.Errorf("invalid label %q: %w", labelWasm, err)
+		}
+	}
+	if v := labels[labelDependsOn]; v != "" {
+		for _, name := range strings.Split(v, ",") {
+			svc.DependsOn = append(svc.DependsOn, strings.TrimSpace(name))
+		}
+		if err := registry.ValidateDependsOn("", svc.DependsOn); err != nil {
+			return nil, fmt.Errorf("invalid label %q: %w", labelDependsOn, err)
+		}
+	}
+	if svc.Shadow, err = parseShadowLabels(labels); err != nil {
+		return nil, err
+	}
+	if svc.ClientCert, err = parseClientCertLabels(labels); err != nil {
+		return nil, err
+	}
+	if svc.TLS, err = parseTLSLabels(labels); err != nil {
+		return nil, err
+	}
+	if svc.Cache, err = parseCacheLabels(labels); err != nil {
+		return nil, err
+	}
+	if v := labels[labelTCPPorts]; v != "" {
+		if svc.TCP, err = registry.ParsePortRange(v); err != nil {
+			return nil, fmt.Errorf("invalid label %q: %w", labelTCPPorts, err)
+		}
+		if err := registry.ValidateTCP(svc); err != nil {
+			return nil, fmt.Errorf("invalid label %q: %w", labelTCPPorts, err)
+		}
+	}
+	return svc, nil
+}
+
+// containerIP returns the IP address of a container, choosing the best network
+// of those allow accepts (see docker.networks), or the one pinned, if set
+// (envoyage.network or docker.network).
 //
-// Selection order:
+// Selection order without a pinned network:
 //  1. Any network whose name contains "envoyage" (the dedicated proxy mesh).
 //  2. The first network with a non-empty IP address (compose project network).
-func containerIP(info types.ContainerJSON) (string, error) {
-	networks := info.NetworkSettings.Networks
+//
+// A network's IPv4 address is preferred; on an IPv6-only network, its
+// global IPv6 address is used.
+func containerIP(info types.ContainerJSON, pinned string, allow func(network string) bool) (string, error) {
+	networks := maps.Clone(info.NetworkSettings.Networks)
+	maps.DeleteFunc(networks, func(name string, _ *network.EndpointSettings) bool { return !allow(name) })
 	if len(networks) == 0 {
 		return "", fmt.Errorf("container has no attached networks")
 	}
+	if pinned != "" {
+		if !allow(pinned) {
+			return "", fmt.Errorf("network %q is not in docker.networks", pinned)
+		}
+		ep, ok := networks[pinned]
+		if !ok {
+			return "", fmt.Errorf("container is not attached to network %q", pinned)
+		}
+		if ip := networkIP(ep); ip != "" {
+			return ip, nil
+		}
+		return "", fmt.Errorf("container has no IP address on network %q", pinned)
+	}
 
 	// Prefer our named mesh network.
 	for name, net := range networks {
-		if strings.Contains(strings.ToLower(name), "envoyage") && net.IPAddress != "" {
-			return net.IPAddress, nil
+		if ip := networkIP(net); strings.Contains(strings.ToLower(name), "envoyage") && ip != "" {
+			return ip, nil
 		}
 	}
 
 	// Fall back to first available IP.
 	for _, net := range networks {
-		if net.IPAddress != "" {
-			return net.IPAddress, nil
+		if ip := networkIP(net); ip != "" {
+			return ip, nil
 		}
 	}
 
 	return "", fmt.Errorf("no IP address found in any attached network")
 }
 
+// networkIP returns a container's address on a network, IPv4 if it has one.
+func networkIP(ep *network.EndpointSettings) string {
+	if ep == nil {
+		return ""
+	}
+	if ep.IPAddress != "" {
+		return ep.IPAddress
+	}
+	return ep.GlobalIPv6Address
+}
+
+// parseHeaderLabels collects envoyage.headers.* labels into header rules:
+//
+//	envoyage.headers.<request|response>.set.<Name>: value
+//	envoyage.headers.<request|response>.add.<Name>: value
+//	envoyage.headers.<request|response>.remove: "Name1,Name2"
+//
+// Labels are unordered, so rules are sorted by header name. Returns nil if
+// the container has no header labels.
+func parseHeaderLabels(labels map[string]string) (*registry.HeaderRules, error) {
+	keys := make([]string, 0)
+	for k := range labels {
+		if strings.HasPrefix(k, labelHeaders) {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	sort.Strings(keys)
+
+	rules := &registry.HeaderRules{}
+	for _, k := range keys {
+		dir, rest, _ := strings.Cut(strings.TrimPrefix(k, labelHeaders), ".")
+		var ops *registry.HeaderOps
+		switch dir {
+		case "request":
+			ops = &rules.Request
+		case "response":
+			ops = &rules.Response
+		default:
+			return nil, fmt.Errorf("invalid label %q: expected request or response after %s", k, labelHeaders)
+		}
+
+		op, name, _ := strings.Cut(rest, ".")
+		switch {
+		case op == "remove" && name == "":
+			for _, n := range strings.Split(labels[k], ",") {
+				if n = strings.TrimSpace(n); n != "" {
+					ops.Remove = append(ops.Remove, n)
+				}
+			}
+		case op == "set" && name != "":
+			ops.Set = append(ops.Set, registry.Header{Name: name, Value: labels[k]})
+		case op == "add" && name != "":
+			ops.Add = append(ops.Add, registry.Header{Name: name, Value: labels[k]})
+		default:
+			return nil, fmt.Errorf("invalid label %q: expected set.<Name>, add.<Name> or remove", k)
+		}
+	}
+	if err := registry.ValidateHeaderRules(rules); err != nil {
+		return nil, fmt.Errorf("invalid %s* labels: %w", labelHeaders, err)
+	}
+	return rules, nil
+}
+
+// parseClientCertLabels reads the envoyage.client_cert.* labels. Returns nil
+// if the container has neither.
+func parseClientCertLabels(labels map[string]string) (*registry.ClientCert, error) {
+	xfcc, headers := labels[labelClientCertXFCC], labels[labelClientCertHeaders]
+	if xfcc == "" && headers == "" {
+		return nil, nil
+	}
+	cc := &registry.ClientCert{}
+	if xfcc != "" {
+		var err error
+		if cc.XFCC, err = strconv.ParseBool(xfcc); err != nil {
+			return nil, fmt.Errorf("invalid label %q=%q: %w", labelClientCertXFCC, xfcc, err)
+		}
+	}
+	for _, entry := range strings.Split(headers, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		name, field, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid label %q: entry %q is not Header=field", labelClientCertHeaders, entry)
+		}
+		cc.Headers = append(cc.Headers, registry.ClientCertHeader{Name: strings.TrimSpace(name), Field: strings.TrimSpace(field)})
+	}
+	if !cc.XFCC && len(cc.Headers) == 0 {
+		return nil, nil // xfcc: "false" alone
+	}
+	if err := registry.ValidateClientCert(cc); err != nil {
+		return nil, fmt.Errorf("invalid envoyage.client_cert.* labels: %w", err)
+	}
+	return cc, nil
+}
+
+// parseCacheLabels reads the envoyage.cache* labels. Returns nil unless
+// envoyage.cache is true.
+func parseCacheLabels(labels map[string]string) (*registry.Cache, error) {
+	v := labels[labelCache]
+	if v == "" {
+		return nil, nil
+	}
+	on, err := strconv.ParseBool(v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid label %q=%q: %w", labelCache, v, err)
+	}
+	if !on {
+		return nil, nil
+	}
+	c := &registry.Cache{}
+	for label, dst := range map[string]*[]string{
+		labelCacheBypassCookies:  &c.BypassCookies,
+		labelCacheBypassHeaders:  &c.BypassHeaders,
+		labelCachePrivateHeaders: &c.PrivateHeaders,
+	} {
+		for _, n := range strings.Split(labels[label], ",") {
+			if n = strings.TrimSpace(n); n != "" {
+				*dst = append(*dst, n)
+			}
+		}
+	}
+	if v := labels[labelCacheAuthenticated]; v != "" {
+		if c.Authenticated, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("invalid label %q=%q: %w", labelCacheAuthenticated, v, err)
+		}
+	}
+	if err := registry.ValidateCache(c); err != nil {
+		return nil, fmt.Errorf("invalid envoyage.cache.* labels: %w", err)
+	}
+	return c, nil
+}
+
+// parseHealthCheckLabels reads the envoyage.health_check* labels. Send and
+// expect are unquoted like Go strings, so "\r\n" and "\x00" work. Returns
+// nil if the container has no health check label.
+func parseHealthCheckLabels(labels map[string]string) (*registry.HealthCheck, error) {
+	kind, ok := labels[labelHealthCheck]
+	if !ok {
+		return nil, nil
+	}
+	if kind != "tcp" {
+		return nil, fmt.Errorf("invalid label %q=%q: only \"tcp\" is supported", labelHealthCheck, kind)
+	}
+
+	hc := &registry.HealthCheck{}
+	for label, dst := range map[string]*string{labelHealthCheckSend: &hc.Send, labelHealthCheckExpect: &hc.Expect} {
+		v, ok := labels[label]
+		if !ok {
+			continue
+		}
+		unquoted, err := strconv.Unquote(`"` + strings.ReplaceAll(v, `"`, `\"`) + `"`)
+		if err != nil {
+			return nil, fmt.Errorf("invalid label %q=%q: %w", label, v, err)
+		}
+		*dst = unquoted
+	}
+	for label, dst := range map[string]*time.Duration{labelHealthCheckInterval: &hc.Interval, labelHealthCheckTimeout: &hc.Timeout} {
+		v, ok := labels[label]
+		if !ok {
+			continue
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid label %q=%q: %w", label, v, err)
+		}
+		*dst = d
+	}
+	if err := registry.ValidateHealthCheck(hc); err != nil {
+		return nil, fmt.Errorf("invalid %s* labels: %w", labelHealthCheck, err)
+	}
+	return hc, nil
+}
+
+// parseConcurrencyLabels reads envoyage.concurrency (the max in flight) and
+// envoyage.concurrency.queue. Returns nil if the container has no
+// concurrency label.
+func parseConcurrencyLabels(labels map[string]string) (*registry.Concurrency, error) {
+	v, ok := labels[labelConcurrency]
+	if !ok {
+		return nil, nil
+	}
+	c := &registry.Concurrency{}
+	var err error
+	if c.Max, err = strconv.Atoi(v); err != nil {
+		return nil, fmt.Errorf("invalid label %q=%q: %w", labelConcurrency, v, err)
+	}
+	if v, ok := labels[labelConcurrencyQueue]; ok {
+		if c.Queue, err = strconv.Atoi(v); err != nil {
+			return nil, fmt.Errorf("invalid label %q=%q: %w", labelConcurrencyQueue, v, err)
+		}
+	}
+	if err := registry.ValidateConcurrency(c); err != nil {
+		return nil, fmt.Errorf("invalid %s* labels: %w", labelConcurrency, err)
+	}
+	return c, nil
+}
+
+// parseShadowLabels reads envoyage.shadow (the other service) and
+// envoyage.shadow.percent. Returns nil if the container has no shadow
+// label. The service's name isn't known yet, so lint catches one that
+// shadows itself.
+func parseShadowLabels(labels map[string]string) (*registry.Shadow, error) {
+	v, ok := labels[labelShadow]
+	if !ok {
+		return nil, nil
+	}
+	sh := &registry.Shadow{Service: v, Percent: 100}
+	if v, ok := labels[labelShadowPercent]; ok {
+		var err error
+		if sh.Percent, err = strconv.ParseFloat(v, 64); err != nil {
+			return nil, fmt.Errorf("invalid label %q=%q: %w", labelShadowPercent, v, err)
+		}
+	}
+	if err := registry.ValidateShadow("", sh); err != nil {
+		return nil, fmt.Errorf("invalid %s* labels: %w", labelShadow, err)
+	}
+	return sh, nil
+}
+
+// parseByteSize parses a size of labelMaxBodySize: a whole number of bytes,
+// optionally followed by k, m or g (case-insensitive, optionally with a
+// trailing b) for KiB, MiB or GiB.
+func parseByteSize(v string) (int64, error) {
+	num := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(v)), "b")
+	shift := 0
+	switch {
+	case strings.HasSuffix(num, "k"):
+		shift = 10
+	case strings.HasSuffix(num, "m"):
+		shift = 20
+	case strings.HasSuffix(num, "g"):
+		shift = 30
+	}
+	if shift > 0 {
+		num = num[:len(num)-1]
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil {
+		return 0, errors.New("not a size like 1048576, 512k or 10m")
+	}
+	if n <= 0 || n > math.MaxUint32>>shift {
+		return 0, errors.New("size must be above 0 and below 4g")
+	}
+	return n << shift, nil
+}
+
+// groupOwnLabels are the labels a group doesn't inherit from the container.
+var groupOwnLabels = []string{labelDomain, labelPort, labelName}
+
+// containerServices maps the names of the services a container describes to
+// their labels, in the unindexed envoyage.<key> form ServiceFromLabels
+// reads. Without envoyage.http.<group>.* labels that is one service with
+// the container's labels. With them, each group is a service named
+// <name>-<group> (or its own envoyage.http.<group>.name) that takes every
+// container-level label except domain, port and name as a default.
+func containerServices(labels map[string]string, containerName string) map[string]map[string]string {
+	base := serviceName(labels)
+	if base == "" {
+		base = strings.TrimPrefix(containerName, "/")
+	}
+
+	groups := make(map[string]map[string]string)
+	shared := make(map[string]string)
+	for k, v := range labels {
+		rest, ok := strings.CutPrefix(k, labelGroup)
+		if !ok {
+			if !slices.Contains(groupOwnLabels, k) {
+				shared[k] = v
+			}
+			continue
+		}
+		group, key, _ := strings.Cut(rest, ".")
+		if group == "" || key == "" {
+			continue
+		}
+		if groups[group] == nil {
+			groups[group] = make(map[string]string)
+		}
+		groups[group]["envoyage."+key] = v
+	}
+	if len(groups) == 0 {
+		return map[string]map[string]string{base: labels}
+	}
+
+	out := make(map[string]map[string]string, len(groups))
+	for group, own := range groups {
+		effective := maps.Clone(shared)
+		maps.Copy(effective, own)
+		name := own[labelName]
+		if name == "" {
+			name = base + "-" + group
+		}
+		out[name] = effective
+	}
+	return out
+}
+
 // serviceName derives a stable unique name from a label map.
 //
 //  1. envoyage.name (explicit user override — highest priority)
@@ -276,4 +1374,22 @@ func shortID(id string) string {
 		return id[:12]
 	}
 	return id
-}
\ No newline at end of file
+}
+
+// parseTLSLabels reads the envoyage.tls.* labels. Returns nil if the
+// container has none.
+func parseTLSLabels(labels map[string]string) (*registry.TLSPolicy, error) {
+	t := &registry.TLSPolicy{
+		MinVersion: labels[labelTLSMinVersion],
+		ClientCert: labels[labelTLSClientCert],
+		CertChain:  labels[labelTLSCertChain],
+		PrivateKey: labels[labelTLSPrivateKey],
+	}
+	if *t == (registry.TLSPolicy{}) {
+		return nil, nil
+	}
+	if err := registry.ValidateTLSPolicy(t); err != nil {
+		return nil, fmt.Errorf("invalid envoyage.tls.* labels: %w", err)
+	}
+	return t, nil
+}
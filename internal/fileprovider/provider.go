@@ -0,0 +1,251 @@
+// Package fileprovider loads services from a directory of definition files,
+// for services that aren't containers but shouldn't live only in the API.
+//
+// Each *.yaml, *.yml or *.json file holds one service or a list of them,
+// in the format of POST /services:
+//
+//	# /etc/envoyage/services.d/nas.yaml
+//	- name: nas
+//	  domain: nas.example.com
+//	  upstream: 192.168.1.20:5000
+//	  ext_authz: true
+//	- name: printer
+//	  domain: printer.example.com
+//	  upstream: 192.168.1.30:80
+//	  exposure: lan
+//
+// The directory is polled, and the registry made to match it: services are
+// added or updated when their file changes and removed with it. The files
+// are the source of truth, so a service changed or removed through the API
+// is put back on the next poll. A file that fails to parse keeps the
+// services it had until it is fixed.
+package fileprovider
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/envoyage/envoyage/internal/config"
+	"github.com/envoyage/envoyage/internal/registry"
+	"github.com/envoyage/envoyage/internal/supervisor"
+)
+
+// DecodeFunc turns one service definition, as JSON, into a service.
+type DecodeFunc func(data []byte) (*registry.Service, error)
+
+// Provider syncs the registry with a directory of definition files.
+type Provider struct {
+	dir      string
+	interval time.Duration
+	reg      *registry.Registry
+	decode   DecodeFunc
+	log      *slog.Logger
+
+	// files caches each file's last parse by content hash, so only changed
+	// files are parsed (and their errors logged) again.
+	files map[string]parsedFile
+}
+
+type parsedFile struct {
+	hash     [sha256.Size]byte
+	services []*registry.Service // last successful parse
+	broken   bool                // the current content doesn't parse
+}
+
+// NewProvider creates a Provider for cfg.Directory. decode parses a single
+// definition; the provider splits lists and converts YAML.
+func NewProvider(reg *registry.Registry, cfg *config.Files, decode DecodeFunc, log *slog.Logger) *Provider {
+	return &Provider{
+		dir:      cfg.Directory,
+		interval: cfg.PollInterval,
+		reg:      reg,
+		decode:   decode,
+		log:      log,
+		files:    make(map[string]parsedFile),
+	}
+}
+
+// Run syncs now and then every poll interval until ctx is canceled.
+func (p *Provider) Run(ctx context.Context) {
+	p.log.Info("file provider starting", "directory", p.dir)
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		if err := p.sync(ctx); err != nil {
+			p.log.Warn("file provider sync failed", "error", err)
+		}
+		supervisor.Beat(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sync reparses changed files, upserts every defined service and removes
+// services whose file or definition is gone.
+func (p *Provider) sync(ctx context.Context) error {
+	entries, err := os.ReadDir(p.dir)
+	if err != nil {
+		// Nothing is removed: a missing mount shouldn't take every
+		// service down.
+		return fmt.Errorf("reading %s: %w", p.dir, err)
+	}
+
+	present := make(map[string]bool)
+	for _, e := range entries {
+		switch strings.ToLower(filepath.Ext(e.Name())) {
+		case ".yaml", ".yml", ".json":
+		default:
+			continue
+		}
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		name := e.Name()
+		data, err := os.ReadFile(filepath.Join(p.dir, name))
+		if err != nil {
+			p.log.Warn("reading service file", "file", name, "error", err)
+			if _, ok := p.files[name]; ok {
+				present[name] = true // keep what it had
+			}
+			continue
+		}
+		present[name] = true
+
+		hash := sha256.Sum256(data)
+		prev, ok := p.files[name]
+		if ok && prev.hash == hash {
+			continue
+		}
+		services, err := p.parse(data)
+		if err != nil {
+			p.log.Warn("invalid service file, keeping its previous services", "file", name, "error", err)
+			prev.hash, prev.broken = hash, true
+			p.files[name] = prev
+			continue
+		}
+		for _, svc := range services {
+			svc.Source, svc.File = registry.SourceFile, name
+		}
+		p.files[name] = parsedFile{hash: hash, services: services}
+		p.log.Info("service file loaded", "file", name, "services", len(services))
+	}
+	for name := range p.files {
+		if !present[name] {
+			delete(p.files, name)
+		}
+	}
+
+	// Files in name order, so the first file wins a duplicate name.
+	names := make([]string, 0, len(p.files))
+	for name := range p.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	defined := make(map[string]bool)
+	for _, file := range names {
+		for _, def := range p.files[file].services {
+			if defined[def.Name] {
+				p.log.Warn("service defined twice, ignoring", "name", def.Name, "file", file)
+				continue
+			}
+			defined[def.Name] = true
+			if err := p.upsert(ctx, def); err != nil {
+				p.log.Warn("failed to load service from file", "name", def.Name, "file", file, "error", err)
+			}
+		}
+	}
+
+	services, _ := p.reg.Snapshot()
+	for _, svc := range services {
+		// A broken file also keeps services of its last good version from
+		// before a restart, which are only in the registry.
+		if svc.File == "" || defined[svc.Name] || p.files[svc.File].broken {
+			continue
+		}
+		ctx := registry.WithComment(ctx, "file: "+svc.File+" no longer defines it")
+		if err := p.reg.Remove(ctx, svc.Name); err != nil {
+			p.log.Warn("failed to remove service of a file", "name", svc.Name, "error", err)
+			continue
+		}
+		p.log.Info("file: service removed", "name", svc.Name, "file", svc.File)
+	}
+	return nil
+}
+
+// upsert stores a copy of a definition. As with discovered containers,
+// maintenance, share links and canaries are not part of the definition and
+// survive an update.
+func (p *Provider) upsert(ctx context.Context, def *registry.Service) error {
+	svc := *def
+	ctx = registry.WithComment(ctx, "file: "+svc.File)
+	op, err := p.reg.Upsert(ctx, svc.Name, func(existing *registry.Service) error {
+		svc.Maintenance = existing.Maintenance
+		svc.MaintenancePage = existing.MaintenancePage
+		svc.ShareLinks = existing.ShareLinks
+		svc.Canary = existing.Canary
+		svc.Switch = existing.Switch
+		svc.Mirror = existing.Mirror
+		svc.Waiting = existing.Waiting
+		*existing = svc
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	switch op {
+	case "add":
+		p.log.Info("file: service registered", "name", svc.Name, "domain", svc.Domain, "upstream", svc.Upstream)
+	case "update":
+		p.log.Info("file: service updated", "name", svc.Name, "domain", svc.Domain, "upstream", svc.Upstream)
+	}
+	return nil
+}
+
+// parse decodes a file's services. YAML is a superset of JSON, so both go
+// through the YAML decoder and back to JSON for decode.
+func (p *Provider) parse(data []byte) ([]*registry.Service, error) {
+	var doc any
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	var defs []any
+	switch v := doc.(type) {
+	case nil:
+		return nil, nil // empty file
+	case []any:
+		defs = v
+	default:
+		defs = []any{v}
+	}
+
+	var out []*registry.Service
+	for i, def := range defs {
+		raw, err := json.Marshal(def)
+		if err != nil {
+			return nil, fmt.Errorf("service %d: %w", i+1, err)
+		}
+		svc, err := p.decode(raw)
+		if err != nil {
+			return nil, fmt.Errorf("service %d: %w", i+1, err)
+		}
+		if svc.Name == "" {
+			return nil, fmt.Errorf("service %d: name is required", i+1)
+		}
+		out = append(out, svc)
+	}
+	return out, nil
+}
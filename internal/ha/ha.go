@@ -0,0 +1,191 @@
+// Package ha lets several control plane instances share one store, with
+// one of them, the leader, making all changes (see config.HA).
+//
+// Leadership is an exclusive lock on a file next to the store. The kernel
+// releases it when the leader's process dies, however it dies, so there
+// are no leases to expire and no clocks to trust: a standby that tries the
+// lock gets it as soon as it is free. Before it starts making changes, it
+// reloads the store one last time, so it continues from what the leader
+// wrote.
+//
+// Standbys keep their registry in step by reloading the store when it
+// changes, and refuse changes themselves: the Persister they save through
+// fails with ErrStandby, which rolls the change back.
+package ha
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/envoyage/envoyage/internal/config"
+	"github.com/envoyage/envoyage/internal/registry"
+	"github.com/envoyage/envoyage/internal/store"
+	"github.com/envoyage/envoyage/internal/supervisor"
+)
+
+// ErrStandby is returned for a change made on a standby instance.
+var ErrStandby = errors.New("this instance is a standby")
+
+// Instance is one control plane instance of an HA group.
+type Instance struct {
+	cfg   *config.HA
+	store *store.File
+	reg   *registry.Registry
+	log   *slog.Logger
+
+	lockPath string
+	leader   atomic.Bool
+
+	mu        sync.Mutex
+	lock      *os.File // held while leader
+	loaded    storeStamp
+	onElected []func()
+}
+
+// storeStamp identifies a version of the store file, to reload it only
+// when it changed.
+type storeStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// New creates a standby instance sharing st.
+func New(cfg *config.HA, st *store.File, reg *registry.Registry, log *slog.Logger) *Instance {
+	return &Instance{
+		cfg:      cfg,
+		store:    st,
+		reg:      reg,
+		log:      log.With("ha_id", cfg.ID),
+		lockPath: st.Path() + ".lock",
+	}
+}
+
+// OnElected registers fn to be called once this instance becomes leader,
+// after the final reload, to start what only the leader runs. Must be
+// called before Run.
+func (i *Instance) OnElected(fn func()) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.onElected = append(i.onElected, fn)
+}
+
+// ID returns this instance's ID.
+func (i *Instance) ID() string { return i.cfg.ID }
+
+// IsLeader reports whether this instance is the leader.
+func (i *Instance) IsLeader() bool { return i.leader.Load() }
+
+// Leader returns the ID of the leader, or "" if none holds the lock.
+func (i *Instance) Leader() string {
+	if i.IsLeader() {
+		return i.cfg.ID
+	}
+	data, err := os.ReadFile(i.lockPath)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// Run tries to become leader and, until it does, follows the store, every
+// poll interval. Once leader, the lock is held until the process exits.
+func (i *Instance) Run(ctx context.Context) error {
+	i.log.Info("ha: starting as standby", "lock", i.lockPath)
+	tick := time.NewTicker(i.cfg.PollInterval)
+	defer tick.Stop()
+	for {
+		supervisor.Beat(ctx)
+		if !i.IsLeader() {
+			if err := i.step(ctx); err != nil {
+				i.log.Warn("ha: standby step failed", "error", err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-tick.C:
+		}
+	}
+}
+
+// step tries the lock once, reloading the store either way.
+func (i *Instance) step(ctx context.Context) error {
+	f, err := tryLock(i.lockPath)
+	if err != nil {
+		return fmt.Errorf("trying the lock: %w", err)
+	}
+	if f == nil {
+		return i.reload(ctx, false)
+	}
+	// Leader now, but only once the leader's last write is loaded.
+	if err := i.reload(ctx, true); err != nil {
+		f.Close() // releases the lock
+		return err
+	}
+	if err := f.Truncate(0); err == nil {
+		f.WriteAt([]byte(i.cfg.ID+"\n"), 0)
+	}
+
+	i.mu.Lock()
+	i.lock = f
+	fns := i.onElected
+	i.mu.Unlock()
+	i.leader.Store(true)
+	i.log.Info("ha: elected leader")
+	for _, fn := range fns {
+		fn()
+	}
+	return nil
+}
+
+// reload loads the store into the registry if it changed since the last
+// reload, or always with force.
+func (i *Instance) reload(ctx context.Context, force bool) error {
+	fi, err := os.Stat(i.store.Path())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil // nothing written yet
+	}
+	if err != nil {
+		return fmt.Errorf("reading store: %w", err)
+	}
+	stamp := storeStamp{modTime: fi.ModTime(), size: fi.Size()}
+	if !force && stamp == i.loaded {
+		return nil
+	}
+	services, history, err := i.store.Load()
+	if err != nil {
+		return err
+	}
+	i.loaded = stamp
+	i.reg.Replace(ctx, services, history)
+	i.log.Debug("ha: reloaded store", "services", len(services))
+	return nil
+}
+
+// Save implements registry.Persister, saving to the store on the leader
+// only.
+func (i *Instance) Save(services []*registry.Service, history []registry.Change) error {
+	if err := i.CheckLeader(); err != nil {
+		return err
+	}
+	return i.store.Save(services, history)
+}
+
+// CheckLeader returns nil on the leader, and ErrStandby naming the leader
+// elsewhere, for changes that don't go through the registry.
+func (i *Instance) CheckLeader() error {
+	if i.IsLeader() {
+		return nil
+	}
+	if leader := i.Leader(); leader != "" {
+		return fmt.Errorf("%w; make changes on the leader, %s", ErrStandby, leader)
+	}
+	return ErrStandby
+}
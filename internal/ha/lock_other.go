@@ -0,0 +1,12 @@
+//go:build !unix
+
+package ha
+
+import (
+	"errors"
+	"os"
+)
+
+func tryLock(path string) (*os.File, error) {
+	return nil, errors.New("leader election needs file locks, available on unix only")
+}
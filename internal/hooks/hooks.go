@@ -0,0 +1,407 @@
+// Package hooks runs a user's Starlark script on control plane events, for
+// automation that doesn't belong in the control plane itself: a chat
+// message when an upstream goes down, a ticket when a node rejects its
+// config, a default filled in on every new service.
+//
+// The script defines a function for each event it handles, named on_ and
+// the event, taking the event as a dict:
+//
+//	def on_health_changed(e):
+//	    if not e["healthy"]:
+//	        http_post("https://chat.example.com/hook",
+//	                  json = {"text": "%s is down on %s: %s" % (e["service"], e["node"], e["hint"])})
+//
+// Events and their fields:
+//
+//	service_added, service_changed, service_removed
+//	    service, version, comment, fields (the names of the changed fields)
+//	health_changed
+//	    service, node, healthy, cause, hint (see stats.NodeHealth); a
+//	    service is healthy on a node with no recent failures and a healthy host
+//	nack
+//	    node, error
+//
+// Besides Starlark's own, scripts have json (encode, decode, indent),
+// http_post(url, json=None, body="", headers={}) returning the status
+// code, get(name) returning a service as GET /services/{name} does or None,
+// and patch(name, patch, comment="") applying a JSON merge patch as
+// PATCH /services/{name} does. print goes to the log.
+//
+// Handlers run one at a time, in the order of the events, each within
+// config.Hooks.Timeout. A failing one is logged and the next event goes
+// on. Changes made by a hook are commented "hook on_<event>" and raise no
+// events, so a hook can't set itself off. Hooks run on the HA leader only.
+// Health and nack events come from polling, so a flap shorter than
+// pollInterval (or the stats interval) may go unseen.
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	starlarkjson "go.starlark.net/lib/json"
+	"go.starlark.net/starlark"
+
+	"github.com/envoyage/envoyage/internal/config"
+	"github.com/envoyage/envoyage/internal/registry"
+	"github.com/envoyage/envoyage/internal/stats"
+	"github.com/envoyage/envoyage/internal/supervisor"
+)
+
+// Events.
+const (
+	EventServiceAdded   = "service_added"
+	EventServiceChanged = "service_changed"
+	EventServiceRemoved = "service_removed"
+	EventHealthChanged  = "health_changed"
+	EventNACK           = "nack"
+)
+
+// commentPrefix marks the registry changes made by hooks.
+const commentPrefix = "hook "
+
+// pollInterval is how often health and node sync are checked for changes.
+const pollInterval = 15 * time.Second
+
+// Env is what scripts see of, and change in, the rest of the control plane.
+type Env struct {
+	// Patch applies a JSON merge patch to a service, as the API does.
+	Patch func(ctx context.Context, name string, patch []byte) error
+
+	// Health reports upstream health per node; see stats.Scraper.Health.
+	// Nil leaves out health_changed.
+	Health func(service string) map[string]stats.NodeHealth
+
+	// NodeErrors returns each managed node's latest NACK, "" if none; see
+	// xds.Server.Sync. Nil leaves out nack.
+	NodeErrors func() map[string]string
+}
+
+// Engine runs the script's handlers on events.
+type Engine struct {
+	cfg     *config.Hooks
+	reg     *registry.Registry
+	env     Env
+	log     *slog.Logger
+	globals starlark.StringDict
+	client  *http.Client
+	poke    chan struct{}
+
+	// What the last poll saw, to tell changes. Only Run uses them.
+	version uint64
+	healthy map[string]map[string]bool // service → node → healthy
+	nacks   map[string]string          // node → error
+}
+
+// New loads the script and runs its top level, which defines the
+// handlers.
+func New(cfg *config.Hooks, reg *registry.Registry, env Env, log *slog.Logger) (*Engine, error) {
+	src, err := os.ReadFile(cfg.Script)
+	if err != nil {
+		return nil, fmt.Errorf("reading hook script: %w", err)
+	}
+	e := &Engine{
+		cfg:    cfg,
+		reg:    reg,
+		env:    env,
+		log:    log,
+		client: &http.Client{},
+		poke:   make(chan struct{}, 1),
+	}
+	thread := e.thread(context.Background(), "load")
+	globals, err := starlark.ExecFile(thread, cfg.Script, src, e.builtins())
+	if err != nil {
+		return nil, fmt.Errorf("loading hook script: %w", err)
+	}
+	globals.Freeze()
+	e.globals = globals
+
+	var handlers []string
+	for name, v := range globals {
+		if _, ok := v.(starlark.Callable); ok && strings.HasPrefix(name, "on_") {
+			handlers = append(handlers, name)
+		}
+	}
+	sort.Strings(handlers)
+	log.Info("hook script loaded", "script", cfg.Script, "handlers", handlers)
+	return e, nil
+}
+
+// Poke has Run look for registry changes now. Pass it to
+// registry.Registry.OnChange.
+func (e *Engine) Poke(context.Context) {
+	select {
+	case e.poke <- struct{}{}:
+	default:
+	}
+}
+
+// Run delivers events until ctx is done. Only changes from after it
+// starts are delivered: on an HA takeover, the old leader has had the
+// earlier ones.
+func (e *Engine) Run(ctx context.Context) error {
+	_, e.version = e.reg.Snapshot()
+	e.healthy, e.nacks = nil, nil
+	e.pollHealth(ctx, false)
+	e.pollNACKs(ctx, false)
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		supervisor.Beat(ctx)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-e.poke:
+			e.pollChanges(ctx)
+		case <-ticker.C:
+			e.pollChanges(ctx)
+			e.pollHealth(ctx, true)
+			e.pollNACKs(ctx, true)
+		}
+	}
+}
+
+// pollChanges delivers the registry changes since the last poll.
+func (e *Engine) pollChanges(ctx context.Context) {
+	for _, c := range e.reg.History("") {
+		if c.Version <= e.version {
+			continue
+		}
+		e.version = c.Version
+		if strings.HasPrefix(c.Comment, commentPrefix) {
+			continue
+		}
+		event := map[string]string{"add": EventServiceAdded, "update": EventServiceChanged, "remove": EventServiceRemoved}[c.Op]
+		if event == "" {
+			continue
+		}
+		fields := make([]string, len(c.Diff))
+		for i, f := range c.Diff {
+			fields[i] = f.Field
+		}
+		e.fire(ctx, event, map[string]any{
+			"service": c.Service,
+			"version": c.Version,
+			"comment": c.Comment,
+			"fields":  fields,
+		})
+	}
+}
+
+// pollHealth compares every service's health on every node with the last
+// poll's. Without deliver it only records it.
+func (e *Engine) pollHealth(ctx context.Context, deliver bool) {
+	if e.env.Health == nil {
+		return
+	}
+	services, _ := e.reg.Snapshot()
+	sort.Slice(services, func(i, j int) bool { return services[i].Name < services[j].Name })
+	healthy := make(map[string]map[string]bool, len(services))
+	for _, svc := range services {
+		nodes := e.env.Health(svc.Name)
+		healthy[svc.Name] = make(map[string]bool, len(nodes))
+		ids := make([]string, 0, len(nodes))
+		for id := range nodes {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			h := nodes[id]
+			ok := h.Cause == "" && h.HealthyHosts > 0
+			healthy[svc.Name][id] = ok
+			was, seen := e.healthy[svc.Name][id]
+			if !deliver || !seen || was == ok {
+				continue
+			}
+			e.fire(ctx, EventHealthChanged, map[string]any{
+				"service": svc.Name,
+				"node":    id,
+				"healthy": ok,
+				"cause":   h.Cause,
+				"hint":    h.Hint,
+			})
+		}
+	}
+	e.healthy = healthy
+}
+
+// pollNACKs delivers each node's new NACKs. Without deliver it only
+// records them.
+func (e *Engine) pollNACKs(ctx context.Context, deliver bool) {
+	if e.env.NodeErrors == nil {
+		return
+	}
+	nacks := e.env.NodeErrors()
+	ids := make([]string, 0, len(nacks))
+	for id := range nacks {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		msg := nacks[id]
+		if deliver && msg != "" && msg != e.nacks[id] {
+			e.fire(ctx, EventNACK, map[string]any{"node": id, "error": msg})
+		}
+	}
+	e.nacks = nacks
+}
+
+// fire calls the event's handler, if the script has one.
+func (e *Engine) fire(ctx context.Context, event string, fields map[string]any) {
+	name := "on_" + event
+	fn, ok := e.globals[name].(starlark.Callable)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, e.cfg.Timeout)
+	defer cancel()
+	thread := e.thread(ctx, name)
+	stop := context.AfterFunc(ctx, func() { thread.Cancel(ctx.Err().Error()) })
+	defer stop()
+
+	arg, err := toStarlark(thread, fields)
+	if err == nil {
+		_, err = starlark.Call(thread, fn, starlark.Tuple{arg}, nil)
+	}
+	if err != nil {
+		e.log.Error("hook failed", "handler", name, "error", err)
+	}
+}
+
+type ctxKey struct{}
+
+// thread makes a thread for one handler call, carrying ctx for the
+// builtins.
+func (e *Engine) thread(ctx context.Context, name string) *starlark.Thread {
+	thread := &starlark.Thread{
+		Name: name,
+		Print: func(thread *starlark.Thread, msg string) {
+			e.log.Info("hook: "+msg, "handler", thread.Name)
+		},
+	}
+	thread.SetLocal("ctx", ctx)
+	return thread
+}
+
+func threadContext(thread *starlark.Thread) context.Context {
+	if ctx, ok := thread.Local("ctx").(context.Context); ok {
+		return ctx
+	}
+	return context.Background()
+}
+
+func (e *Engine) builtins() starlark.StringDict {
+	return starlark.StringDict{
+		"json":      starlarkjson.Module,
+		"http_post": starlark.NewBuiltin("http_post", e.httpPost),
+		"get":       starlark.NewBuiltin("get", e.get),
+		"patch":     starlark.NewBuiltin("patch", e.patch),
+	}
+}
+
+// httpPost is http_post(url, json=None, body="", headers={}).
+func (e *Engine) httpPost(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var (
+		url     string
+		js      starlark.Value = starlark.None
+		body    string
+		headers = new(starlark.Dict)
+	)
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "url", &url, "json?", &js, "body?", &body, "headers?", &headers); err != nil {
+		return nil, err
+	}
+	contentType := "text/plain; charset=utf-8"
+	if js != starlark.None {
+		encoded, err := fromStarlark(thread, js)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", b.Name(), err)
+		}
+		body, contentType = string(encoded), "application/json"
+	}
+
+	req, err := http.NewRequestWithContext(threadContext(thread), http.MethodPost, url, strings.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", b.Name(), err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	for _, kv := range headers.Items() {
+		k, ok1 := starlark.AsString(kv[0])
+		v, ok2 := starlark.AsString(kv[1])
+		if !ok1 || !ok2 {
+			return nil, fmt.Errorf("%s: headers must map strings to strings", b.Name())
+		}
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", b.Name(), err)
+	}
+	resp.Body.Close()
+	return starlark.MakeInt(resp.StatusCode), nil
+}
+
+// get is get(name).
+func (e *Engine) get(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var name string
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "name", &name); err != nil {
+		return nil, err
+	}
+	svc, ok := e.reg.Get(name)
+	if !ok {
+		return starlark.None, nil
+	}
+	return toStarlark(thread, svc)
+}
+
+// patch is patch(name, patch, comment="").
+func (e *Engine) patch(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var (
+		name    string
+		patch   *starlark.Dict
+		comment string
+	)
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "name", &name, "patch", &patch, "comment?", &comment); err != nil {
+		return nil, err
+	}
+	encoded, err := fromStarlark(thread, patch)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", b.Name(), err)
+	}
+	c := commentPrefix + thread.Name
+	if comment != "" {
+		c += ": " + comment
+	}
+	ctx := registry.WithComment(threadContext(thread), c)
+	if err := e.env.Patch(ctx, name, encoded); err != nil {
+		return nil, fmt.Errorf("%s %q: %w", b.Name(), name, err)
+	}
+	return starlark.None, nil
+}
+
+// toStarlark converts v to Starlark values through its JSON form.
+func toStarlark(thread *starlark.Thread, v any) (starlark.Value, error) {
+	js, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return starlark.Call(thread, starlarkjson.Module.Members["decode"], starlark.Tuple{starlark.String(js)}, nil)
+}
+
+// fromStarlark encodes v as JSON.
+func fromStarlark(thread *starlark.Thread, v starlark.Value) ([]byte, error) {
+	out, err := starlark.Call(thread, starlarkjson.Module.Members["encode"], starlark.Tuple{v}, nil)
+	if err != nil {
+		return nil, err
+	}
+	s, _ := starlark.AsString(out)
+	return bytes.TrimSpace([]byte(s)), nil
+}
@@ -0,0 +1,329 @@
+// Package kube discovers services from Kubernetes Ingresses, so workloads in
+// a homelab cluster (k3s, say) get the same split-horizon edge as Docker
+// containers.
+//
+// An Ingress opts in with the annotation envoyage.enable: "true". Each rule
+// host becomes a service whose upstream is the backend Service of the
+// rule's "/" path (or its first path, or the Ingress's default backend),
+// at the Service's load balancer IP if it has one and its cluster IP
+// otherwise, so the home Envoy must be able to reach one of them. Every
+// envoyage.* label the Docker watcher reads works as an annotation, except
+// domain and port, which come from the Ingress:
+//
+//	metadata:
+//	  name: gitea
+//	  namespace: apps
+//	  annotations:
+//	    envoyage.enable: "true"
+//	    envoyage.ext_authz: "true"
+//
+// The service is named <namespace>-<ingress> (or envoyage.name). An Ingress
+// with several hosts registers one service per host, named
+// <name>-<host with dots as dashes>.
+package kube
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/envoyage/envoyage/internal/config"
+	"github.com/envoyage/envoyage/internal/docker"
+	"github.com/envoyage/envoyage/internal/registry"
+	"github.com/envoyage/envoyage/internal/supervisor"
+)
+
+const (
+	annotationEnable = "envoyage.enable"
+	annotationName   = "envoyage.name"
+	annotationDomain = "envoyage.domain"
+	annotationPort   = "envoyage.port"
+
+	// As the Docker label: it decides maintenance mode while set.
+	annotationMaintenance = "envoyage.maintenance"
+)
+
+// Watcher keeps the registry in sync with opted-in Ingresses.
+type Watcher struct {
+	client    *client
+	reg       *registry.Registry
+	namespace string
+	resync    time.Duration
+	log       *slog.Logger
+
+	// connected is true while the last list of Ingresses succeeded.
+	connected atomic.Bool
+}
+
+// NewWatcher creates a Watcher for the cluster cfg points at.
+func NewWatcher(reg *registry.Registry, cfg *config.Kubernetes, log *slog.Logger) (*Watcher, error) {
+	c, err := newClient(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to Kubernetes: %w", err)
+	}
+	return &Watcher{client: c, reg: reg, namespace: cfg.Namespace, resync: cfg.ResyncInterval, log: log}, nil
+}
+
+// Run lists Ingresses and syncs the registry, then watches for a change
+// and starts over, until ctx is canceled. A watch ends after the resync
+// interval at the latest, so Services whose address changed are picked up
+// too.
+func (w *Watcher) Run(ctx context.Context) error {
+	w.log.Info("kubernetes watcher starting", "namespace", w.namespace)
+	defer w.connected.Store(false)
+
+	for {
+		version, err := w.sync(ctx)
+		supervisor.Beat(ctx)
+		if err == nil {
+			w.connected.Store(true)
+			err = w.watch(ctx, version)
+		} else {
+			w.connected.Store(false)
+		}
+		if ctx.Err() != nil {
+			w.log.Info("kubernetes watcher stopped")
+			return nil
+		}
+		if err != nil {
+			w.log.Warn("kubernetes watch failed, retrying", "error", err)
+			select {
+			case <-ctx.Done():
+				w.log.Info("kubernetes watcher stopped")
+				return nil
+			case <-time.After(10 * time.Second):
+			}
+		}
+	}
+}
+
+// Connected reports whether the last list of Ingresses succeeded.
+func (w *Watcher) Connected() bool { return w.connected.Load() }
+
+func (w *Watcher) ingressPath() string {
+	if w.namespace == "" {
+		return "/apis/networking.k8s.io/v1/ingresses"
+	}
+	return "/apis/networking.k8s.io/v1/namespaces/" + url.PathEscape(w.namespace) + "/ingresses"
+}
+
+// watch returns once an Ingress changed after version, or when the server
+// ends the watch.
+func (w *Watcher) watch(ctx context.Context, version string) error {
+	resp, err := w.client.get(ctx, w.ingressPath(), url.Values{
+		"watch":           {"1"},
+		"resourceVersion": {version},
+		"timeoutSeconds":  {strconv.Itoa(int(w.resync.Seconds()))},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var ev watchEvent
+		if err := dec.Decode(&ev); err != nil {
+			return nil // canceled, or the server ended the watch; relist
+		}
+		switch ev.Type {
+		case "BOOKMARK":
+			continue
+		case "ERROR":
+			// Usually 410 Gone: version is too old. Relisting fixes it.
+			w.log.Debug("kubernetes watch error event", "object", string(ev.Object))
+		}
+		return nil
+	}
+}
+
+// sync converges the registry on the opted-in Ingresses, like the Docker
+// watcher's sync: every rule host is registered or updated, and services
+// of Ingresses that are gone are removed. It returns the list's resource
+// version to watch from.
+func (w *Watcher) sync(ctx context.Context) (string, error) {
+	var list ingressList
+	if err := w.client.getJSON(ctx, w.ingressPath(), nil, &list); err != nil {
+		return "", fmt.Errorf("listing ingresses: %w", err)
+	}
+
+	// Names of every opted-in Ingress's services, registered or not: one
+	// whose annotations are broken keeps the services it had.
+	current := make(map[string]bool)
+	registered := 0
+	for _, ing := range list.Items {
+		if ing.Metadata.Annotations[annotationEnable] != "true" {
+			continue
+		}
+		key := ing.Metadata.Namespace + "/" + ing.Metadata.Name
+		rules := ingressServices(ing)
+		for name := range rules {
+			current[name] = true
+		}
+
+		ctx := registry.WithComment(ctx, "kubernetes: ingress "+key)
+		if err := w.register(ctx, ing, rules); err != nil {
+			w.log.Warn("ingress not (fully) registered", "ingress", key, "error", err)
+			continue
+		}
+		registered++
+	}
+
+	removed := 0
+	services, _ := w.reg.Snapshot()
+	for _, svc := range services {
+		if svc.Ingress == "" || current[svc.Name] {
+			continue
+		}
+		ctx := registry.WithComment(ctx, "kubernetes: ingress "+svc.Ingress+" gone")
+		if err := w.reg.Remove(ctx, svc.Name); err != nil {
+			w.log.Warn("failed to remove service of a deleted ingress", "name", svc.Name, "error", err)
+			continue
+		}
+		w.log.Info("kubernetes: service removed", "name", svc.Name, "ingress", svc.Ingress)
+		removed++
+	}
+
+	w.log.Debug("ingress sync complete",
+		"scanned", len(list.Items),
+		"registered", registered,
+		"removed", removed,
+	)
+	return list.Metadata.ResourceVersion, nil
+}
+
+// ingressServices maps the names of the services an Ingress describes to
+// their rule.
+func ingressServices(ing ingress) map[string]ingressRule {
+	base := ing.Metadata.Annotations[annotationName]
+	if base == "" {
+		base = ing.Metadata.Namespace + "-" + ing.Metadata.Name
+	}
+	var rules []ingressRule
+	for _, r := range ing.Spec.Rules {
+		if r.Host != "" {
+			rules = append(rules, r)
+		}
+	}
+	out := make(map[string]ingressRule, len(rules))
+	for _, r := range rules {
+		name := base
+		if len(rules) > 1 {
+			name += "-" + strings.ReplaceAll(r.Host, ".", "-")
+		}
+		out[name] = r
+	}
+	return out
+}
+
+// register upserts the services of one Ingress. A rule that can't be
+// resolved is skipped; the others are still registered.
+func (w *Watcher) register(ctx context.Context, ing ingress, rules map[string]ingressRule) error {
+	names := make([]string, 0, len(rules))
+	for name := range rules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []error
+	for _, name := range names {
+		if err := w.registerRule(ctx, ing, name, rules[name]); err != nil {
+			errs = append(errs, fmt.Errorf("service %q: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (w *Watcher) registerRule(ctx context.Context, ing ingress, name string, rule ingressRule) error {
+	backend := ruleBackend(ing, rule)
+	if backend == nil || backend.Service == nil {
+		return fmt.Errorf("host %s has no backend service", rule.Host)
+	}
+
+	var svc service
+	path := "/api/v1/namespaces/" + url.PathEscape(ing.Metadata.Namespace) + "/services/" + url.PathEscape(backend.Service.Name)
+	if err := w.client.getJSON(ctx, path, nil, &svc); err != nil {
+		return fmt.Errorf("looking up backend service: %w", err)
+	}
+	port := backend.Service.Port.Number
+	if port == 0 {
+		for _, p := range svc.Spec.Ports {
+			if p.Name == backend.Service.Port.Name {
+				port = p.Port
+			}
+		}
+		if port == 0 {
+			return fmt.Errorf("backend service %s has no port %q", backend.Service.Name, backend.Service.Port.Name)
+		}
+	}
+	ip := svc.Spec.ClusterIP
+	if lb := svc.Status.LoadBalancer.Ingress; len(lb) > 0 && lb[0].IP != "" {
+		ip = lb[0].IP
+	}
+	if ip == "" || ip == "None" {
+		return fmt.Errorf("backend service %s has no cluster or load balancer IP", backend.Service.Name)
+	}
+
+	labels := maps.Clone(ing.Metadata.Annotations)
+	labels[annotationDomain] = rule.Host
+	labels[annotationPort] = strconv.Itoa(port)
+	s, err := docker.ServiceFromLabels(labels, func(port uint64) (string, error) {
+		return net.JoinHostPort(ip, strconv.FormatUint(port, 10)), nil
+	})
+	if err != nil {
+		return err
+	}
+	s.Name, s.Source, s.Ingress = name, registry.SourceKubernetes, ing.Metadata.Namespace+"/"+ing.Metadata.Name
+
+	// As in the Docker watcher: maintenance (unless annotated), share links
+	// and canaries are not set by annotations and must survive an update.
+	op, err := w.reg.Upsert(ctx, s.Name, func(existing *registry.Service) error {
+		if labels[annotationMaintenance] == "" {
+			s.Maintenance = existing.Maintenance
+		}
+		s.MaintenancePage = existing.MaintenancePage
+		s.ShareLinks = existing.ShareLinks
+		s.Canary = existing.Canary
+		s.Switch = existing.Switch
+		s.Mirror = existing.Mirror
+		s.Waiting = existing.Waiting
+		*existing = *s
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("upserting %q: %w", s.Name, err)
+	}
+	switch op {
+	case "add":
+		w.log.Info("kubernetes: service registered",
+			"name", s.Name, "domain", s.Domain, "upstream", s.Upstream)
+	case "update":
+		w.log.Info("kubernetes: service updated",
+			"name", s.Name, "domain", s.Domain, "upstream", s.Upstream)
+	}
+	return nil
+}
+
+// ruleBackend picks the backend a rule's host is served by: its "/" path,
+// else its first path, else the Ingress's default backend.
+func ruleBackend(ing ingress, rule ingressRule) *ingressBackend {
+	if rule.HTTP != nil && len(rule.HTTP.Paths) > 0 {
+		for _, p := range rule.HTTP.Paths {
+			if p.Path == "" || p.Path == "/" {
+				return &p.Backend
+			}
+		}
+		return &rule.HTTP.Paths[0].Backend
+	}
+	return ing.Spec.DefaultBackend
+}
@@ -0,0 +1,710 @@
+// Package lint flags risky or broken configurations before they bite.
+//
+// Pre-flight and the registry validator reject what Envoy cannot load; lint
+// is for what it loads fine but probably shouldn't: an app on the internet
+// with no login in front of it, a domain another service can never get
+// traffic for, an upstream that only ever fails. Each finding carries a
+// stable code so scripts can filter or baseline them.
+//
+// Lint runs at startup on the config and the stored services, and on demand
+// through GET /lint (envoyagectl lint), where it also sees live upstream
+// health and the DNS check.
+package lint
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/envoyage/envoyage/internal/config"
+	"github.com/envoyage/envoyage/internal/dnscheck"
+	"github.com/envoyage/envoyage/internal/policy"
+	"github.com/envoyage/envoyage/internal/registry"
+	"github.com/envoyage/envoyage/internal/stats"
+)
+
+// Severity ranks findings.
+type Severity string
+
+const (
+	// Error findings break the config: snapshots will fail to build or
+	// Envoy will reject them.
+	Error Severity = "error"
+	// Warning findings work but are likely mistakes or exposures.
+	Warning Severity = "warning"
+	// Info findings are worth knowing but often deliberate.
+	Info Severity = "info"
+)
+
+// Finding codes. They are part of the API: don't rename them.
+const (
+	CodePublicNoAuth         = "public-no-auth"
+	CodePublicOpenProxy      = "public-open-proxy"
+	CodeDuplicateDomain      = "duplicate-domain"
+	CodeDomainOverlap        = "domain-overlap"
+	CodeUpstreamNoPort       = "upstream-no-port"
+	CodeUpstreamLoopback     = "upstream-loopback"
+	CodeUpstreamUnhealthy    = "upstream-unhealthy"
+	CodeExtAuthzUnconfigured = "ext-authz-unconfigured"
+	CodeChallengeUnconfig    = "challenge-unconfigured"
+	CodeCacheUnconfigured    = "cache-unconfigured"
+	CodeCacheUnused          = "cache-unused"
+	CodeClientCertNoMTLS     = "client-cert-no-mtls"
+	CodeTLSPolicyUnused      = "tls-policy-unused"
+	CodeTLSPolicyNoCA        = "tls-policy-no-client-ca"
+	CodeStreamingBodyLimit   = "streaming-body-limit"
+	CodeDNSNotEdge           = "dns-not-edge"
+	CodeInvalidPolicy        = "invalid-policy"
+	CodeAPINoToken           = "api-no-token"
+	CodeNodeNoAdmin          = "node-no-admin"
+	CodeDrainDisabled        = "drain-disabled"
+	CodeNodesUnknown         = "nodes-unknown"
+	CodeNodesUnserved        = "nodes-unserved"
+	CodeEdgeOnlyNoTLS        = "edge-only-no-tls"
+	CodeTCPEdgeOnly          = "tcp-edge-only"
+	CodeTCPPortConflict      = "tcp-port-conflict"
+	CodeCatchAllUnknown      = "catch-all-unknown"
+	CodeCatchAllTLSPolicy    = "catch-all-tls-policy"
+	CodeAffinitySingleHost   = "affinity-single-host"
+	CodeLBPolicySingleHost   = "lb-policy-single-host"
+	CodeShadowUnknown        = "shadow-unknown"
+	CodeOriginUnserved       = "origin-unserved"
+	CodeDependencyWaiting    = "dependency-waiting"
+	CodeWasmModuleMissing    = "wasm-module-missing"
+	CodeHostRewriteEdge      = "host-rewrite-edge-upstream"
+)
+
+// Finding is one lint result.
+type Finding struct {
+	Code     string   `json:"code"`
+	Severity Severity `json:"severity"`
+	Service  string   `json:"service,omitempty"`
+	Node     string   `json:"node,omitempty"`
+	Message  string   `json:"message"`
+	Fix      string   `json:"fix"`
+}
+
+func (f Finding) String() string {
+	subject := ""
+	switch {
+	case f.Service != "":
+		subject = " service " + f.Service + ":"
+	case f.Node != "":
+		subject = " node " + f.Node + ":"
+	}
+	return fmt.Sprintf("%s [%s]%s %s", f.Severity, f.Code, subject, f.Message)
+}
+
+// Health reports live upstream health per node for a service; see
+// stats.Scraper.Health. It may be nil when no stats are available yet.
+type Health func(service string) map[string]stats.NodeHealth
+
+// DNS reports the last DNS check of a service; see dnscheck.Checker.Result.
+// It may be nil when the check is off.
+type DNS func(service string) (dnscheck.Result, bool)
+
+// Wasm reports whether a Wasm module is uploaded; see wasm.Store. It may
+// be nil, which skips the check.
+type Wasm func(module string) bool
+
+// Run lints cfg and services. Findings are sorted by severity, then code,
+// then subject.
+func Run(cfg *config.Config, services []*registry.Service, health Health, dns DNS, wasm Wasm) []Finding {
+	var out []Finding
+	out = append(out, lintConfig(cfg)...)
+	out = append(out, lintServices(cfg, services, health, dns)...)
+	out = append(out, lintWasm(cfg, services, wasm)...)
+
+	rank := map[Severity]int{Error: 0, Warning: 1, Info: 2}
+	sort.SliceStable(out, func(i, j int) bool {
+		a, b := out[i], out[j]
+		if rank[a.Severity] != rank[b.Severity] {
+			return rank[a.Severity] < rank[b.Severity]
+		}
+		if a.Code != b.Code {
+			return a.Code < b.Code
+		}
+		return a.Service+a.Node < b.Service+b.Node
+	})
+	return out
+}
+
+func lintConfig(cfg *config.Config) []Finding {
+	var out []Finding
+	if cfg.API == nil {
+		out = append(out, Finding{
+			Code:     CodeAPINoToken,
+			Severity: Warning,
+			Message:  "the management API accepts requests without a token",
+			Fix:      "set api.token_sha256 (envoyagectl init generates one), or make sure the API port is unreachable from untrusted networks",
+		})
+	}
+	for _, n := range cfg.Nodes {
+		if n.Admin == "" {
+			out = append(out, Finding{
+				Code:     CodeNodeNoAdmin,
+				Severity: Info,
+				Node:     n.ID,
+				Message:  "no admin address, so there are no traffic stats or upstream health for this node",
+				Fix:      "set admin to the node's Envoy admin host:port",
+			})
+		}
+	}
+	if cfg.Drain.Grace == 0 {
+		out = append(out, Finding{
+			Code:     CodeDrainDisabled,
+			Severity: Info,
+			Message:  "removing a service resets requests still in flight to it",
+			Fix:      "set drain.grace, e.g. 30s",
+		})
+	}
+	return out
+}
+
+func lintServices(cfg *config.Config, services []*registry.Service, health Health, dns DNS) []Finding {
+	var out []Finding
+	resolver := policy.NewResolver(cfg)
+
+	byDomain := make(map[string][]string)
+	for _, svc := range services {
+		if svc.TCP != nil {
+			continue // no domain
+		}
+		for _, d := range append([]string{svc.Domain}, aliasDomains(svc)...) {
+			d = strings.ToLower(d)
+			byDomain[d] = append(byDomain[d], svc.Name)
+		}
+
+		eff, err := resolver.Resolve(svc)
+		if err != nil {
+			out = append(out, Finding{
+				Code:     CodeInvalidPolicy,
+				Severity: Error,
+				Service:  svc.Name,
+				Message:  err.Error(),
+				Fix:      "fix the service's namespace, limits or exposure, or the namespace bounds",
+			})
+			continue
+		}
+		// A TCP forward is public by design (a game server); what protects
+		// it is the app's own. A redirect or static service has nothing to
+		// protect.
+		public := eff.Exposure != registry.ExposureLAN && config.OnEdges(svc.Nodes) && svc.TCP == nil && !svc.AnsweredByEnvoy()
+		authed := len(svc.BasicAuth) > 0 || svc.JWT != nil || svc.ExtAuthz
+		switch {
+		case public && !authed && svc.ForwardProxy != nil:
+			out = append(out, Finding{
+				Code:     CodePublicOpenProxy,
+				Severity: Warning,
+				Service:  svc.Name,
+				Message:  "forward proxy is reachable from the internet without auth; anyone can reach its allowed LAN destinations",
+				Fix:      "add basic_auth, jwt or ext_authz, or set exposure to lan",
+			})
+		case public && !authed:
+			out = append(out, Finding{
+				Code:     CodePublicNoAuth,
+				Severity: Warning,
+				Service:  svc.Name,
+				Message:  fmt.Sprintf("%s is public with no authentication", svc.Domain),
+				Fix:      "add basic_auth, jwt or ext_authz, or set exposure to lan if it is only for home use",
+			})
+		}
+
+		out = append(out, lintNodes(cfg, svc, eff)...)
+		out = append(out, lintOrigins(cfg, svc, eff)...)
+		if svc.HostRewrite != "" && (len(svc.Origins) > 0 || svc.Failover != "") {
+			// Edges keep Host for home, also on the routes to these.
+			out = append(out, Finding{
+				Code:     CodeHostRewriteEdge,
+				Severity: Warning,
+				Service:  svc.Name,
+				Message:  "rewrites Host at home, but the edges reach its origins and failover with the client's Host",
+				Fix:      "have the edge copies and failover accept the service's domain too",
+			})
+		}
+
+		if svc.ExtAuthz && cfg.ExtAuthz == nil {
+			out = append(out, Finding{
+				Code:     CodeExtAuthzUnconfigured,
+				Severity: Error,
+				Service:  svc.Name,
+				Message:  "uses ext_authz but no ext_authz section is configured",
+				Fix:      "configure ext_authz or turn it off for the service",
+			})
+		}
+		if svc.Challenge && cfg.Challenge == nil {
+			out = append(out, Finding{
+				Code:     CodeChallengeUnconfig,
+				Severity: Error,
+				Service:  svc.Name,
+				Message:  "uses the challenge but no challenge section is configured",
+				Fix:      "configure challenge or turn it off for the service",
+			})
+		}
+
+		if svc.Cache != nil {
+			auth := len(svc.BasicAuth) > 0 || svc.JWT != nil
+			switch {
+			case cfg.Cache == nil:
+				out = append(out, Finding{
+					Code:     CodeCacheUnconfigured,
+					Severity: Error,
+					Service:  svc.Name,
+					Message:  "uses the cache but no cache section is configured",
+					Fix:      "configure cache or turn it off for the service",
+				})
+			case svc.ExtAuthz:
+				out = append(out, Finding{
+					Code:     CodeCacheUnused,
+					Severity: Warning,
+					Service:  svc.Name,
+					Message:  "is behind ext_authz, which the edges don't check, so it is never cached",
+					Fix:      "turn the cache off for the service, or protect it with basic auth or JWT instead",
+				})
+			case auth && !svc.Cache.Authenticated:
+				out = append(out, Finding{
+					Code:     CodeCacheUnused,
+					Severity: Warning,
+					Service:  svc.Name,
+					Message:  "requires a login, so it is not cached unless its pages are the same for every user",
+					Fix:      "set cache.authenticated if they are, or turn the cache off",
+				})
+			}
+		}
+
+		if svc.ClientCert != nil && (cfg.TLS == nil || cfg.TLS.ClientCA == "") {
+			out = append(out, Finding{
+				Code:     CodeClientCertNoMTLS,
+				Severity: Warning,
+				Service:  svc.Name,
+				Message:  "forwards client certificate identity but the edges don't verify client certificates",
+				Fix:      "configure tls with client_ca, or remove client_cert from the service",
+			})
+		}
+
+		if svc.Streaming && eff.MaxBodyBytes > 0 {
+			out = append(out, Finding{
+				Code:     CodeStreamingBodyLimit,
+				Severity: Warning,
+				Service:  svc.Name,
+				Message:  fmt.Sprintf("streams uploads, so its max body size of %d bytes is not enforced", eff.MaxBodyBytes),
+				Fix:      "limit upload sizes in the app, or turn streaming off",
+			})
+		}
+
+		if svc.TLS != nil {
+			switch {
+			case cfg.TLS == nil:
+				out = append(out, Finding{
+					Code:     CodeTLSPolicyUnused,
+					Severity: Warning,
+					Service:  svc.Name,
+					Message:  "has its own TLS settings but the edges don't serve HTTPS",
+					Fix:      "configure tls, or remove tls from the service",
+				})
+			case cfg.TLS.ClientCA == "" && (svc.TLS.ClientCert == registry.ClientCertOptional || svc.TLS.ClientCert == registry.ClientCertRequired):
+				out = append(out, Finding{
+					Code:     CodeTLSPolicyNoCA,
+					Severity: Error,
+					Service:  svc.Name,
+					Message:  fmt.Sprintf("asks for client certificates (%s) but tls.client_ca is not set; the edges' config can't be built", svc.TLS.ClientCert),
+					Fix:      "set tls.client_ca, or set the service's client_cert to none",
+				})
+			}
+		}
+
+		if svc.ForwardProxy == nil && !svc.AnsweredByEnvoy() {
+			out = append(out, lintUpstream(svc)...)
+		}
+		if dns != nil {
+			if r, ok := dns(svc.Name); ok && r.Status != dnscheck.StatusOK {
+				msg := fmt.Sprintf("%s does not resolve (%s)", r.Domain, r.Error)
+				if r.Status == dnscheck.StatusMismatch {
+					msg = fmt.Sprintf("%s resolves to %s, not only to the edges", r.Domain, strings.Join(r.Addresses, ", "))
+				}
+				out = append(out, Finding{
+					Code:     CodeDNSNotEdge,
+					Severity: Warning,
+					Service:  svc.Name,
+					Message:  msg,
+					Fix:      "point the domain's A/AAAA records (or a CNAME) at the edges",
+				})
+			}
+		}
+		if health != nil {
+			out = append(out, lintHealth(svc, health(svc.Name))...)
+		}
+	}
+
+	out = append(out, lintDomains(byDomain)...)
+	out = append(out, lintTCPPorts(cfg, services)...)
+	out = append(out, lintCatchAll(cfg, services)...)
+	out = append(out, lintShadows(services)...)
+	out = append(out, lintDependencies(services)...)
+	return out
+}
+
+// lintOrigins finds edge copies of a service (see registry.Origin) that no
+// edge uses: on a node that isn't in the config or doesn't serve the
+// service.
+func lintOrigins(cfg *config.Config, svc *registry.Service, eff policy.Effective) []Finding {
+	var out []Finding
+	for _, o := range svc.Origins {
+		var why string
+		switch {
+		case !slices.ContainsFunc(cfg.Nodes, func(n config.Node) bool { return n.ID == o.Node }):
+			why = "isn't in the config"
+		case eff.Exposure == registry.ExposureLAN:
+			why = "doesn't serve LAN-only services"
+		case len(svc.Nodes) > 0 && !slices.Contains(svc.Nodes, o.Node):
+			why = "isn't in the service's nodes"
+		default:
+			continue
+		}
+		out = append(out, Finding{
+			Code:     CodeOriginUnserved,
+			Severity: Warning,
+			Service:  svc.Name,
+			Message:  fmt.Sprintf("has a copy on node %q, which %s, so it is never used", o.Node, why),
+			Fix:      "remove the origin, or serve the service on that edge",
+		})
+	}
+	return out
+}
+
+// lintShadows finds shadows the home node leaves out (see xds/mirror.go):
+// of another service that isn't an HTTP service with an upstream, or of
+// the service itself.
+func lintShadows(services []*registry.Service) []Finding {
+	var out []Finding
+	for _, svc := range services {
+		sh := svc.Shadow
+		if sh == nil {
+			continue
+		}
+		i := slices.IndexFunc(services, func(other *registry.Service) bool { return other.Name == sh.Service })
+		if sh.Service != svc.Name && i >= 0 && services[i].TCP == nil && services[i].ForwardProxy == nil && !services[i].AnsweredByEnvoy() {
+			continue
+		}
+		out = append(out, Finding{
+			Code:     CodeShadowUnknown,
+			Severity: Warning,
+			Service:  svc.Name,
+			Message:  fmt.Sprintf("shadows %q, which is not another HTTP service with an upstream, so no requests are copied", sh.Service),
+			Fix:      "add the service, or shadow another one",
+		})
+	}
+	return out
+}
+
+// lintDependencies finds services left out of the snapshots because their
+// dependencies aren't ready (see registry.Unready).
+func lintDependencies(services []*registry.Service) []Finding {
+	unready := registry.Unready(services)
+	var out []Finding
+	for _, svc := range services {
+		reason, ok := unready[svc.Name]
+		if !ok {
+			continue
+		}
+		out = append(out, Finding{
+			Code:     CodeDependencyWaiting,
+			Severity: Warning,
+			Service:  svc.Name,
+			Message:  "not served: " + reason,
+			Fix:      "start the dependencies, or remove them from depends_on",
+		})
+	}
+	return out
+}
+
+// lintWasm finds Wasm filters whose module isn't uploaded, which are left
+// out of the snapshots (see xds/wasm.go).
+func lintWasm(cfg *config.Config, services []*registry.Service, uploaded Wasm) []Finding {
+	if uploaded == nil {
+		return nil
+	}
+	var out []Finding
+	for _, f := range cfg.Wasm.Filters {
+		if !uploaded(f.Module) {
+			out = append(out, Finding{
+				Code:     CodeWasmModuleMissing,
+				Severity: Warning,
+				Message:  fmt.Sprintf("wasm.filters runs module %s, which isn't uploaded, so no service runs it", f.Module),
+				Fix:      "upload it with PUT /wasm/" + f.Module + ", or remove it from wasm.filters",
+			})
+		}
+	}
+	for _, svc := range services {
+		for _, f := range svc.Wasm {
+			if uploaded(f.Module) {
+				continue
+			}
+			out = append(out, Finding{
+				Code:     CodeWasmModuleMissing,
+				Severity: Warning,
+				Service:  svc.Name,
+				Message:  fmt.Sprintf("wasm module %s isn't uploaded, so the service is served without it", f.Module),
+				Fix:      "upload it with PUT /wasm/" + f.Module + ", or remove it from wasm",
+			})
+		}
+	}
+	return out
+}
+
+// lintCatchAll checks the service of a catch_all service action, which
+// answers not_found where it can't be served (see xds/catchall.go).
+func lintCatchAll(cfg *config.Config, services []*registry.Service) []Finding {
+	ca := cfg.CatchAll
+	if ca == nil || ca.Action != config.CatchAllService {
+		return nil
+	}
+	i := slices.IndexFunc(services, func(svc *registry.Service) bool { return svc.Name == ca.Service })
+	switch {
+	case i < 0 || services[i].TCP != nil:
+		return []Finding{{
+			Code:     CodeCatchAllUnknown,
+			Severity: Warning,
+			Message:  fmt.Sprintf("catch_all.service %q is not an HTTP service, so unknown hosts get a 404", ca.Service),
+			Fix:      "add the service, or point catch_all at another one",
+		}}
+	case cfg.TLS != nil && services[i].TLS != nil:
+		return []Finding{{
+			Code:     CodeCatchAllTLSPolicy,
+			Severity: Warning,
+			Service:  ca.Service,
+			Message:  "is the catch_all service but has its own TLS settings, which unknown hosts can't be held to, so the edges answer them 404",
+			Fix:      "point catch_all at a service without tls settings, or redirect to this one's domain",
+		}}
+	}
+	return nil
+}
+
+// lintTCPPorts finds TCP forwards whose ports are taken, by the nodes'
+// HTTP(S) listeners or by another TCP service earlier by name. The later
+// one is left out of the snapshots (see xds/tcp.go).
+func lintTCPPorts(cfg *config.Config, services []*registry.Service) []Finding {
+	owner := map[uint32]string{10000: "the HTTP listener"}
+	if cfg.TLS != nil {
+		owner[cfg.TLS.Port] = "the HTTPS listener"
+	}
+	for _, n := range cfg.Nodes {
+		if n.HTTPPort != 0 {
+			owner[n.HTTPPort] = "node " + n.ID + "'s HTTP listener"
+		}
+		if n.HTTPSPort != 0 {
+			owner[n.HTTPSPort] = "node " + n.ID + "'s HTTPS listener"
+		}
+	}
+
+	tcp := slices.DeleteFunc(slices.Clone(services), func(svc *registry.Service) bool { return svc.TCP == nil })
+	slices.SortFunc(tcp, func(a, b *registry.Service) int { return strings.Compare(a.Name, b.Name) })
+	var out []Finding
+	for _, svc := range tcp {
+		ports := svc.TCP.Ports()
+		i := slices.IndexFunc(ports, func(p uint32) bool { return owner[p] != "" })
+		if i >= 0 {
+			out = append(out, Finding{
+				Code:     CodeTCPPortConflict,
+				Severity: Error,
+				Service:  svc.Name,
+				Message:  fmt.Sprintf("port %d is taken by %s, so no node forwards any of %s", ports[i], owner[ports[i]], svc.TCP),
+				Fix:      "move the service's tcp ports",
+			})
+			continue
+		}
+		for _, p := range ports {
+			owner[p] = "service " + svc.Name
+		}
+	}
+	return out
+}
+
+func aliasDomains(svc *registry.Service) []string {
+	var out []string
+	for _, a := range svc.Aliases {
+		out = append(out, a.Domain)
+	}
+	return out
+}
+
+func lintUpstream(svc *registry.Service) []Finding {
+	host, port, err := net.SplitHostPort(svc.Upstream)
+	if err != nil || port == "" {
+		return []Finding{{
+			Code:     CodeUpstreamNoPort,
+			Severity: Error,
+			Service:  svc.Name,
+			Message:  fmt.Sprintf("upstream %q is not host:port", svc.Upstream),
+			Fix:      "include the app's port, e.g. " + svc.Upstream + ":8080",
+		}}
+	}
+	loopback := strings.EqualFold(host, "localhost")
+	if ip, err := netip.ParseAddr(host); err == nil && ip.IsLoopback() {
+		loopback = true
+	}
+	if loopback {
+		return []Finding{{
+			Code:     CodeUpstreamLoopback,
+			Severity: Warning,
+			Service:  svc.Name,
+			Message:  fmt.Sprintf("upstream %q is a loopback address, which is the Envoy container itself, not the app", svc.Upstream),
+			Fix:      "use the app's container name or LAN IP",
+		}}
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		switch {
+		case svc.Affinity != nil:
+			return []Finding{{
+				Code:     CodeAffinitySingleHost,
+				Severity: Info,
+				Service:  svc.Name,
+				Message:  fmt.Sprintf("upstream %q is a single address, so affinity has only one host to keep clients on", svc.Upstream),
+				Fix:      "use a hostname that resolves to every replica, e.g. the Compose service name",
+			}}
+		case svc.LBPolicy != "":
+			return []Finding{{
+				Code:     CodeLBPolicySingleHost,
+				Severity: Info,
+				Service:  svc.Name,
+				Message:  fmt.Sprintf("upstream %q is a single address, so lb_policy %s has only one host to balance over", svc.Upstream, svc.LBPolicy),
+				Fix:      "use a hostname that resolves to every replica, e.g. the Compose service name",
+			}}
+		}
+	}
+	return nil
+}
+
+// lintHealth flags services whose upstream is failing on some node. Only
+// nodes with at least one scrape count; a service nobody has visited yet
+// has no stats and is not flagged.
+func lintHealth(svc *registry.Service, nodes map[string]stats.NodeHealth) []Finding {
+	ids := make([]string, 0, len(nodes))
+	for id := range nodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var out []Finding
+	for _, id := range ids {
+		h := nodes[id]
+		if h.Cause == "" {
+			continue
+		}
+		out = append(out, Finding{
+			Code:     CodeUpstreamUnhealthy,
+			Severity: Warning,
+			Service:  svc.Name,
+			Node:     id,
+			Message:  fmt.Sprintf("upstream failing on %s: %s", id, h.Cause),
+			Fix:      h.Hint,
+		})
+	}
+	return out
+}
+
+// lintDomains flags domains served by more than one service, and explicit
+// domains that carve a hole out of another service's wildcard.
+func lintDomains(byDomain map[string][]string) []Finding {
+	domains := make([]string, 0, len(byDomain))
+	for d := range byDomain {
+		domains = append(domains, d)
+	}
+	sort.Strings(domains)
+
+	var out []Finding
+	for _, d := range domains {
+		names := byDomain[d]
+		if len(names) > 1 {
+			for _, name := range names {
+				out = append(out, Finding{
+					Code:     CodeDuplicateDomain,
+					Severity: Error,
+					Service:  name,
+					Message:  fmt.Sprintf("%s is also the domain of %s; Envoy rejects duplicate domains", d, strings.Join(others(names, name), ", ")),
+					Fix:      "give each service its own domain",
+				})
+			}
+		}
+
+		suffix, ok := strings.CutPrefix(d, "*")
+		if !ok {
+			continue
+		}
+		for _, other := range domains {
+			if other == d || !strings.HasSuffix(other, suffix) {
+				continue
+			}
+			for _, name := range byDomain[d] {
+				out = append(out, Finding{
+					Code:     CodeDomainOverlap,
+					Severity: Warning,
+					Service:  name,
+					Message:  fmt.Sprintf("wildcard %s also matches %s, which goes to %s instead", d, other, strings.Join(byDomain[other], ", ")),
+					Fix:      "check that the more specific service is meant to take that name",
+				})
+			}
+		}
+	}
+	return out
+}
+
+func others(names []string, skip string) []string {
+	var out []string
+	for _, n := range names {
+		if n != skip {
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+// lintNodes checks a service's placement (see registry.Service.Nodes).
+func lintNodes(cfg *config.Config, svc *registry.Service, eff policy.Effective) []Finding {
+	if len(svc.Nodes) == 0 {
+		return nil
+	}
+	var out []Finding
+	for _, id := range svc.Nodes {
+		if !slices.ContainsFunc(cfg.Nodes, func(n config.Node) bool { return n.ID == id }) {
+			out = append(out, Finding{
+				Code:     CodeNodesUnknown,
+				Severity: Warning,
+				Service:  svc.Name,
+				Message:  fmt.Sprintf("is placed on node %q, which isn't in the config", id),
+				Fix:      "fix the node ID in the service's nodes, or add the node to the config",
+			})
+		}
+	}
+	home := slices.Contains(svc.Nodes, config.HomeNodeID)
+	switch {
+	case svc.TCP != nil && !home:
+		out = append(out, Finding{
+			Code:     CodeTCPEdgeOnly,
+			Severity: Info,
+			Service:  svc.Name,
+			Message:  "is placed on the edges only, but a TCP forward can't be hidden from the LAN: the home node forwards it to everyone",
+			Fix:      "add " + config.HomeNodeID + " to the service's nodes to say so, or firewall the ports on the home host",
+		})
+	case eff.Exposure == registry.ExposureLAN && !home:
+		out = append(out, Finding{
+			Code:     CodeNodesUnserved,
+			Severity: Warning,
+			Service:  svc.Name,
+			Message:  "is LAN-only but not placed on the home node, so no node serves it",
+			Fix:      "add " + config.HomeNodeID + " to the service's nodes, or set exposure to public",
+		})
+	case !home && cfg.TLS == nil:
+		out = append(out, Finding{
+			Code:     CodeEdgeOnlyNoTLS,
+			Severity: Error,
+			Service:  svc.Name,
+			Message:  "is edge-only, but without tls the home node can't tell the edges' requests from LAN clients', so no node serves it",
+			Fix:      "configure tls (its edge_secret marks the edges' requests), or add " + config.HomeNodeID + " to the service's nodes",
+		})
+	}
+	return out
+}
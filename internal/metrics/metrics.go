@@ -0,0 +1,171 @@
+// Package metrics exposes control plane metrics in the Prometheus text format.
+//
+// This is deliberately tiny — a map of labeled float64 values per metric
+// family — rather than a dependency on the Prometheus client library. The
+// control plane only needs counters and gauges, and most values are copies
+// of numbers Envoy already computed.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Kind is the Prometheus metric type.
+type Kind string
+
+const (
+	Counter Kind = "counter"
+	Gauge   Kind = "gauge"
+)
+
+// Registry holds all metric families exposed on /metrics.
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*Vec
+}
+
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*Vec)}
+}
+
+// Vec is one metric family: a name, a fixed set of label names, and a value
+// per distinct combination of label values.
+type Vec struct {
+	name   string
+	help   string
+	kind   Kind
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]*sample
+}
+
+type sample struct {
+	labelValues []string
+	value       float64
+}
+
+// NewVec registers a metric family. Registering the same name twice returns
+// the existing family, so packages can declare their metrics independently.
+func (r *Registry) NewVec(name, help string, kind Kind, labels ...string) *Vec {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if v, ok := r.families[name]; ok {
+		return v
+	}
+	v := &Vec{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		values: make(map[string]*sample),
+	}
+	r.families[name] = v
+	return v
+}
+
+// Set sets the value for the given label values (in declaration order).
+func (v *Vec) Set(value float64, labelValues ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.with(labelValues).value = value
+}
+
+// Add adds delta to the value for the given label values.
+func (v *Vec) Add(delta float64, labelValues ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.with(labelValues).value += delta
+}
+
+// Inc adds one to the value for the given label values.
+func (v *Vec) Inc(labelValues ...string) {
+	v.Add(1, labelValues...)
+}
+
+// Delete drops the series for the given label values, e.g. when a service
+// is removed and its last-known values would otherwise linger forever.
+func (v *Vec) Delete(labelValues ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	delete(v.values, strings.Join(labelValues, "\xff"))
+}
+
+// with returns the sample for labelValues, creating it if needed.
+// The caller must hold v.mu.
+func (v *Vec) with(labelValues []string) *sample {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", v.name, len(v.labels), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+	s, ok := v.values[key]
+	if !ok {
+		s = &sample{labelValues: append([]string(nil), labelValues...)}
+		v.values[key] = s
+	}
+	return s
+}
+
+// Expose writes every family in the Prometheus text exposition format,
+// sorted by name and label values so output is stable between scrapes.
+func (r *Registry) Expose(w io.Writer) {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	r.mu.Unlock()
+	sort.Strings(names)
+
+	for _, name := range names {
+		r.mu.Lock()
+		v := r.families[name]
+		r.mu.Unlock()
+		v.expose(w)
+	}
+}
+
+func (v *Vec) expose(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", v.name, v.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", v.name, v.kind)
+
+	keys := make([]string, 0, len(v.values))
+	for k := range v.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		s := v.values[k]
+		fmt.Fprintf(w, "%s%s %g\n", v.name, formatLabels(v.labels, s.labelValues), s.value)
+	}
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	parts := make([]string, len(names))
+	for i, n := range names {
+		parts[i] = fmt.Sprintf("%s=%q", n, values[i])
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// Handler serves the registry on /metrics.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		r.Expose(w)
+	})
+}
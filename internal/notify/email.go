@@ -0,0 +1,120 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/envoyage/envoyage/internal/config"
+	"github.com/envoyage/envoyage/internal/webhook"
+)
+
+// email sends a plain-text mail with the title as its subject. SMTP
+// replies in the 5xx range give up at once; 4xx ones and network errors
+// are tried again.
+type email struct {
+	cfg config.Email
+}
+
+func (t *email) String() string { return "email " + t.addr() }
+
+func (t *email) Delivery() config.Delivery { return t.cfg.Delivery }
+
+func (t *email) addr() string { return net.JoinHostPort(t.cfg.Host, strconv.Itoa(t.cfg.Port)) }
+
+func (t *email) Send(ctx context.Context, id string, e webhook.Event) (retry bool, err error) {
+	err = t.mail(ctx, id, e)
+	var reply *textproto.Error
+	if errors.As(err, &reply) {
+		return reply.Code < 500, err
+	}
+	return err != nil, err
+}
+
+// mail is smtp.SendMail, bounded by ctx.
+func (t *email) mail(ctx context.Context, id string, e webhook.Event) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", t.addr())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	c, err := smtp.NewClient(conn, t.cfg.Host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: t.cfg.Host}); err != nil {
+			return err
+		}
+	}
+	if t.cfg.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", t.cfg.Username, t.cfg.Password, t.cfg.Host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(t.cfg.From); err != nil {
+		return err
+	}
+	for _, to := range t.cfg.To {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(t.message(id, e)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// message renders e as a mail, headers and body.
+func (t *email) message(id string, e webhook.Event) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", t.cfg.From)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(t.cfg.To, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", e.Title()))
+	fmt.Fprintf(&b, "Date: %s\r\n", e.Time.Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <%s@envoyage>\r\n", id)
+	fmt.Fprintf(&b, "X-Envoyage-Event: %s\r\n", e.Event)
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	b.WriteString(e.Text + "\r\n")
+	for _, kv := range [][2]string{
+		{"Node", e.Node},
+		{"Service", e.Service},
+		{"Error", e.Error},
+		{"Cause", e.Cause},
+		{"Hint", e.Hint},
+	} {
+		if kv[1] != "" {
+			fmt.Fprintf(&b, "\r\n%s: %s", kv[0], kv[1])
+		}
+	}
+	if c := e.Certificate; c != nil {
+		fmt.Fprintf(&b, "\r\nCertificate: %s\r\nNames: %s\r\nNot after: %s", c.File, strings.Join(c.DNSNames, ", "), c.NotAfter.Format(time.RFC3339))
+	}
+	b.WriteString("\r\n")
+	return b.Bytes()
+}
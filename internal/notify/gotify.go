@@ -0,0 +1,51 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/envoyage/envoyage/internal/config"
+	"github.com/envoyage/envoyage/internal/webhook"
+)
+
+// gotify posts a message as a Gotify application, at priority 8 for alerts
+// and 4 for the rest unless the config sets one. The event rides along in
+// the message's extras.
+type gotify struct {
+	cfg    config.Gotify
+	client *http.Client
+}
+
+func (t *gotify) String() string { return "gotify " + webhook.Redact(t.cfg.URL) }
+
+func (t *gotify) Delivery() config.Delivery { return t.cfg.Delivery }
+
+func (t *gotify) Send(ctx context.Context, id string, e webhook.Event) (retry bool, err error) {
+	priority := t.cfg.Priority
+	if priority == 0 {
+		priority = 4
+		if e.Alert() {
+			priority = 8
+		}
+	}
+	body, err := json.Marshal(map[string]any{
+		"title":    e.Title(),
+		"message":  e.Text,
+		"priority": priority,
+		"extras":   map[string]any{"envoyage::event": e},
+	})
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		strings.TrimSuffix(t.cfg.URL, "/")+"/message", bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Gotify-Key", t.cfg.Token)
+	return webhook.Post(t.client, req)
+}
@@ -0,0 +1,32 @@
+// Package notify sends the webhook notifier's events to ntfy topics
+// (ntfy.go), Gotify (gotify.go) and e-mail (email.go), for people rather
+// than automation: by default only config.AlertEvents, the ones that need
+// someone's attention. Each is a webhook.Target, so it gets its own queue
+// and is retried as a webhook is; see package webhook.
+package notify
+
+import (
+	"net/http"
+
+	"github.com/envoyage/envoyage/internal/config"
+	"github.com/envoyage/envoyage/internal/webhook"
+)
+
+// Targets returns the targets cfg lists, none for a nil cfg.
+func Targets(cfg *config.Notify) []webhook.Target {
+	if cfg == nil {
+		return nil
+	}
+	var out []webhook.Target
+	client := &http.Client{}
+	for _, c := range cfg.Ntfy {
+		out = append(out, &ntfy{cfg: c, client: client})
+	}
+	for _, c := range cfg.Gotify {
+		out = append(out, &gotify{cfg: c, client: client})
+	}
+	for _, c := range cfg.Email {
+		out = append(out, &email{cfg: c})
+	}
+	return out
+}
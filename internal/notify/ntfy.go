@@ -0,0 +1,61 @@
+package notify
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/envoyage/envoyage/internal/config"
+	"github.com/envoyage/envoyage/internal/webhook"
+)
+
+// ntfy publishes the summary line to a topic, with the title and a tag
+// for the event, at high priority for alerts and default priority for the
+// rest unless the config sets one.
+type ntfy struct {
+	cfg    config.Ntfy
+	client *http.Client
+}
+
+func (t *ntfy) String() string { return "ntfy " + strings.TrimSuffix(t.cfg.URL, "/") + "/…" }
+
+func (t *ntfy) Delivery() config.Delivery { return t.cfg.Delivery }
+
+func (t *ntfy) Send(ctx context.Context, id string, e webhook.Event) (retry bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		strings.TrimSuffix(t.cfg.URL, "/")+"/"+t.cfg.Topic, strings.NewReader(e.Text))
+	if err != nil {
+		return false, err
+	}
+	priority := t.cfg.Priority
+	if priority == 0 {
+		priority = 3
+		if e.Alert() {
+			priority = 4
+		}
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	req.Header.Set("Title", e.Title())
+	req.Header.Set("Priority", strconv.Itoa(priority))
+	req.Header.Set("Tags", ntfyTag(e))
+	if t.cfg.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+t.cfg.Token)
+	}
+	return webhook.Post(t.client, req)
+}
+
+// ntfyTag is the tag ntfy shows an event with: an emoji shortcode, then
+// the event.
+func ntfyTag(e webhook.Event) string {
+	emoji := "information_source"
+	switch e.Event {
+	case config.WebhookNACK, config.WebhookUpstreamUnhealthy, config.WebhookNodeDisconnected:
+		emoji = "rotating_light"
+	case config.WebhookCertExpiring:
+		emoji = "warning"
+	case config.WebhookNodeConnected, config.WebhookUpstreamHealthy, config.WebhookCertRenewed:
+		emoji = "white_check_mark"
+	}
+	return emoji + "," + e.Event
+}
@@ -0,0 +1,96 @@
+// Package policy resolves a service's effective limits from its own settings
+// and its namespace's defaults and bounds.
+//
+// Namespaces live in the config file and are owned by whoever runs the
+// control plane; services come from Docker labels and the API and are owned
+// by whoever deploys the app. The Resolver is where the two meet: a service
+// inherits what it leaves unset and is rejected if it asks for more than its
+// namespace allows.
+package policy
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/envoyage/envoyage/internal/config"
+	"github.com/envoyage/envoyage/internal/registry"
+)
+
+// Effective is a service's resolved settings.
+type Effective struct {
+	RateLimit    int   // requests/second per node; 0 = unlimited
+	MaxBodyBytes int64 // 0 = unlimited
+	Exposure     string
+}
+
+// Resolver applies namespace policy to services.
+type Resolver struct {
+	namespaces map[string]config.Namespace
+}
+
+func NewResolver(cfg *config.Config) *Resolver {
+	return &Resolver{namespaces: cfg.Namespaces}
+}
+
+// Resolve merges the service's settings with its namespace's defaults and
+// checks them against the namespace's bounds.
+func (r *Resolver) Resolve(svc *registry.Service) (Effective, error) {
+	eff := Effective{
+		RateLimit:    svc.RateLimit,
+		MaxBodyBytes: svc.MaxBodyBytes,
+		Exposure:     svc.Exposure,
+	}
+	if eff.Exposure != "" && eff.Exposure != registry.ExposurePublic && eff.Exposure != registry.ExposureLAN {
+		return Effective{}, fmt.Errorf("unknown exposure %q", eff.Exposure)
+	}
+	if eff.RateLimit < 0 || eff.MaxBodyBytes < 0 {
+		return Effective{}, fmt.Errorf("limits must not be negative")
+	}
+
+	if svc.Namespace != "" {
+		ns, ok := r.namespaces[svc.Namespace]
+		if !ok {
+			return Effective{}, fmt.Errorf("unknown namespace %q", svc.Namespace)
+		}
+		if eff.RateLimit == 0 {
+			eff.RateLimit = ns.Defaults.RateLimit
+		}
+		if eff.MaxBodyBytes == 0 {
+			eff.MaxBodyBytes = ns.Defaults.MaxBodyBytes
+		}
+		if eff.Exposure == "" {
+			eff.Exposure = ns.Defaults.Exposure
+		}
+		if err := checkBounds(eff, ns.Bounds); err != nil {
+			return Effective{}, fmt.Errorf("namespace %q: %w", svc.Namespace, err)
+		}
+	}
+
+	if eff.Exposure == "" {
+		eff.Exposure = registry.ExposurePublic
+	}
+	return eff, nil
+}
+
+// Check is Resolve for use as a registry validator.
+func (r *Resolver) Check(svc *registry.Service) error {
+	_, err := r.Resolve(svc)
+	return err
+}
+
+func checkBounds(eff Effective, b config.ServiceBounds) error {
+	if b.MaxRateLimit > 0 && eff.RateLimit > b.MaxRateLimit {
+		return fmt.Errorf("rate limit %d exceeds the maximum of %d", eff.RateLimit, b.MaxRateLimit)
+	}
+	if b.MaxBodyBytes > 0 && eff.MaxBodyBytes > b.MaxBodyBytes {
+		return fmt.Errorf("max body size %d exceeds the maximum of %d", eff.MaxBodyBytes, b.MaxBodyBytes)
+	}
+	exp := eff.Exposure
+	if exp == "" {
+		exp = registry.ExposurePublic
+	}
+	if len(b.AllowedExposure) > 0 && !slices.Contains(b.AllowedExposure, exp) {
+		return fmt.Errorf("exposure %q is not allowed (allowed: %v)", exp, b.AllowedExposure)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package portal
+
+// page is the portal UI: a single static page that keeps the user's token in
+// localStorage and talks to /portal/api/ with it.
+const page = `<!doctype html>
+<html><head><meta charset="utf-8"><meta name="viewport" content="width=device-width,initial-scale=1">
+<title>Envoyage portal</title>
+<style>
+body{font-family:system-ui,sans-serif;max-width:48em;margin:2em auto;padding:0 1em;color:#333}
+.svc{border:1px solid #ddd;border-radius:6px;padding:1em;margin:1em 0}
+.svc h2{margin:0 0 .3em;font-size:1.1em}
+.muted{color:#888;font-size:.9em}
+table{border-collapse:collapse;margin:.5em 0}td,th{padding:.2em .8em .2em 0;text-align:left}
+input[type=text]{width:100%}
+code{word-break:break-all}
+</style>
+</head><body>
+<h1>Envoyage portal</h1>
+<div id="login">
+  <p>Paste the access token you were given.</p>
+  <input id="token" type="password" autocomplete="off"> <button onclick="login()">Sign in</button>
+  <p id="error" style="color:#b00"></p>
+</div>
+<div id="main" hidden>
+  <p class="muted">Signed in as <b id="user"></b> · <a href="#" onclick="logout()">sign out</a></p>
+  <div id="services"></div>
+</div>
+<script>
+let token = localStorage.getItem("envoyage_portal_token") || "";
+
+async function api(method, path, body) {
+  const r = await fetch("/portal/api" + path, {
+    method, headers: {"Authorization": "Bearer " + token, "Content-Type": "application/json"},
+    body: body === undefined ? undefined : JSON.stringify(body),
+  });
+  if (r.status === 401) { logout(); throw new Error("not signed in"); }
+  if (!r.ok) throw new Error(await r.text());
+  return r.status === 204 ? null : r.json();
+}
+
+function login() {
+  token = document.getElementById("token").value.trim();
+  localStorage.setItem("envoyage_portal_token", token);
+  load();
+}
+
+function logout() {
+  token = "";
+  localStorage.removeItem("envoyage_portal_token");
+  document.getElementById("main").hidden = true;
+  document.getElementById("login").hidden = false;
+}
+
+function bytes(n) {
+  const u = ["B", "KiB", "MiB", "GiB", "TiB"];
+  let i = 0;
+  while (n >= 1024 && i < u.length - 1) { n /= 1024; i++; }
+  return n.toFixed(i ? 1 : 0) + " " + u[i];
+}
+
+function esc(s) {
+  const d = document.createElement("div");
+  d.textContent = s;
+  return d.innerHTML;
+}
+
+function render(data) {
+  document.getElementById("user").textContent = data.user;
+  const root = document.getElementById("services");
+  if (!data.services.length) { root.innerHTML = "<p>You have no services yet.</p>"; return; }
+  root.innerHTML = data.services.map(s => {
+    const traffic = Object.entries(s.traffic).map(([node, t]) =>
+      "<tr><td>" + esc(node) + "</td><td>" + bytes(t.rx_bytes) + "</td><td>" + bytes(t.tx_bytes) + "</td></tr>").join("");
+    const shares = s.shares.map(l =>
+      "<li><code>" + esc(l.url) + "</code><br><span class=muted>expires " + new Date(l.expires).toLocaleString() +
+      " · by " + esc(l.created_by) + "</span> <button onclick=\"revoke('" + s.name + "','" + l.id + "')\">revoke</button></li>").join("");
+    const traces = (s.traces || []).map(t =>
+      "<tr><td>" + new Date(t.time).toLocaleString() + "</td><td>" + esc(t.method + " " + t.path) + "</td><td>" + t.status +
+      "</td><td>" + t.duration_ms + " ms</td><td>" + (t.url ? "<a href=\"" + esc(t.url) + "\" target=_blank>" + esc(t.trace_id.slice(0, 8)) + "</a>" : esc(t.trace_id.slice(0, 8))) +
+      "</td></tr>").join("");
+    return "<div class=svc><h2>" + esc(s.name) + "</h2><div class=muted>" + esc(s.domain) + " · " + esc(s.namespace) + "</div>" +
+      "<p><label><input type=checkbox " + (s.maintenance ? "checked" : "") +
+      " onchange=\"maintenance('" + s.name + "', this.checked)\"> maintenance mode</label></p>" +
+      (traffic ? "<table><tr><th>node</th><th>received</th><th>sent</th></tr>" + traffic + "</table>" : "<p class=muted>no traffic data yet</p>") +
+      (traces ? "<p>Recent slow or failed requests:</p><table><tr><th>time</th><th>request</th><th>status</th><th>took</th><th>trace</th></tr>" + traces + "</table>" : "") +
+      "<p>Share links:</p><ul>" + (shares || "<li class=muted>none</li>") + "</ul>" +
+      "<select id=\"ttl-" + s.name + "\"><option>1h</option><option selected>24h</option><option>168h</option></select> " +
+      "<button onclick=\"share('" + s.name + "')\">create share link</button></div>";
+  }).join("");
+}
+
+async function load() {
+  try {
+    render(await api("GET", "/services"));
+    document.getElementById("login").hidden = true;
+    document.getElementById("main").hidden = false;
+  } catch (e) {
+    document.getElementById("error").textContent = e.message;
+  }
+}
+
+async function maintenance(name, enabled) {
+  try { await api("PUT", "/services/" + name + "/maintenance", {enabled}); } catch (e) { alert(e.message); }
+  load();
+}
+
+async function share(name) {
+  const ttl = document.getElementById("ttl-" + name).value;
+  try { await api("POST", "/services/" + name + "/shares", {ttl}); } catch (e) { alert(e.message); }
+  load();
+}
+
+async function revoke(name, id) {
+  try { await api("DELETE", "/services/" + name + "/shares/" + id); } catch (e) { alert(e.message); }
+  load();
+}
+
+if (token) load();
+</script>
+</body></html>
+`
@@ -0,0 +1,325 @@
+// Package portal is the self-service portal for namespace members.
+//
+// Family members and friends who run an app or two on the home server should
+// be able to take it down for maintenance or share it with someone without
+// asking the admin — and without being able to touch anyone else's routes.
+// The portal gives each configured user a bearer token scoped to their
+// namespaces (config.Portal). Through it they can list only their services,
+// toggle maintenance mode, see per-node traffic (and, with Envoy tracing,
+// links to recent slow or failed requests' traces) and manage share links.
+//
+// The portal is mounted under /portal/ on the management API. It never
+// exposes the rest of the API: the token only works on these routes.
+package portal
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/envoyage/envoyage/internal/config"
+	"github.com/envoyage/envoyage/internal/registry"
+	"github.com/envoyage/envoyage/internal/stats"
+	"github.com/envoyage/envoyage/internal/tracing"
+)
+
+// Stats is the part of stats.Scraper the portal reads traffic from.
+type Stats interface {
+	Service(name string) map[string]map[string]uint64
+}
+
+// Traces is the part of tracing.Exemplars the portal lists traces from.
+type Traces interface {
+	Recent(service string) []tracing.Exemplar
+}
+
+// Portal serves the portal page and its API.
+type Portal struct {
+	cfg    *config.Portal
+	reg    *registry.Registry
+	stats  Stats
+	traces Traces // nil unless Envoy tracing is on
+	log    *slog.Logger
+	now    func() time.Time
+}
+
+// New creates a portal from validated config.
+func New(cfg *config.Portal, reg *registry.Registry, st Stats, log *slog.Logger) *Portal {
+	return &Portal{cfg: cfg, reg: reg, stats: st, log: log, now: time.Now}
+}
+
+// ShowTraces lists each service's recent slow and failed requests, linked
+// to the tracing backend, next to its traffic.
+func (p *Portal) ShowTraces(t Traces) {
+	p.traces = t
+}
+
+// Register adds the portal's routes to mux.
+func (p *Portal) Register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /portal/{$}", p.handlePage)
+	mux.HandleFunc("GET /portal/api/services", p.authed(p.handleList))
+	mux.HandleFunc("PUT /portal/api/services/{name}/maintenance", p.authed(p.handleMaintenance))
+	mux.HandleFunc("POST /portal/api/services/{name}/shares", p.authed(p.handleCreateShare))
+	mux.HandleFunc("DELETE /portal/api/services/{name}/shares/{id}", p.authed(p.handleRevokeShare))
+}
+
+type handler func(w http.ResponseWriter, r *http.Request, user *config.PortalUser)
+
+// authed resolves the bearer token to a user before calling h.
+func (p *Portal) authed(h handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			http.Error(w, "missing bearer token", http.StatusUnauthorized)
+			return
+		}
+		sum := sha256.Sum256([]byte(token))
+		got := hex.EncodeToString(sum[:])
+
+		var user *config.PortalUser
+		for i := range p.cfg.Users {
+			if subtle.ConstantTimeCompare([]byte(got), []byte(p.cfg.Users[i].TokenSHA256)) == 1 {
+				user = &p.cfg.Users[i]
+			}
+		}
+		if user == nil {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		h(w, r, user)
+	}
+}
+
+// owned returns the named service if it is in one of the user's namespaces.
+// Services outside them are reported as not found, not forbidden, so the
+// portal doesn't reveal what else is registered.
+func (p *Portal) owned(user *config.PortalUser, name string) (*registry.Service, bool) {
+	svc, ok := p.reg.Get(name)
+	if !ok || !slices.Contains(user.Namespaces, svc.Namespace) {
+		return nil, false
+	}
+	return svc, true
+}
+
+type serviceView struct {
+	Name        string                       `json:"name"`
+	Domain      string                       `json:"domain"`
+	Namespace   string                       `json:"namespace"`
+	Maintenance bool                         `json:"maintenance"`
+	Shares      []shareView                  `json:"shares"`
+	Traffic     map[string]map[string]uint64 `json:"traffic"` // node → rx_bytes/tx_bytes
+	Traces      []tracing.Exemplar           `json:"traces,omitempty"`
+}
+
+type shareView struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Expires   time.Time `json:"expires"`
+	CreatedBy string    `json:"created_by"`
+}
+
+func (p *Portal) view(svc *registry.Service) serviceView {
+	v := serviceView{
+		Name:        svc.Name,
+		Domain:      svc.Domain,
+		Namespace:   svc.Namespace,
+		Maintenance: svc.Maintenance,
+		Shares:      []shareView{},
+		Traffic:     make(map[string]map[string]uint64),
+	}
+	for _, l := range svc.ActiveShareLinks(p.now()) {
+		v.Shares = append(v.Shares, shareView{ID: l.ID, URL: shareURL(svc, l), Expires: l.Expires, CreatedBy: l.CreatedBy})
+	}
+	for node, st := range p.stats.Service(svc.Name) {
+		v.Traffic[node] = map[string]uint64{
+			"rx_bytes": st[stats.StatRxBytes],
+			"tx_bytes": st[stats.StatTxBytes],
+		}
+	}
+	if p.traces != nil {
+		v.Traces = p.traces.Recent(svc.Name)
+	}
+	return v
+}
+
+func (p *Portal) handleList(w http.ResponseWriter, r *http.Request, user *config.PortalUser) {
+	services, _ := p.reg.Snapshot()
+	out := []serviceView{}
+	for _, svc := range services {
+		if slices.Contains(user.Namespaces, svc.Namespace) {
+			out = append(out, p.view(svc))
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	writeJSON(w, http.StatusOK, map[string]any{"user": user.Name, "services": out})
+}
+
+func (p *Portal) handleMaintenance(w http.ResponseWriter, r *http.Request, user *config.PortalUser) {
+	name := r.PathValue("name")
+	if _, ok := p.owned(user, name); !ok {
+		http.Error(w, fmt.Sprintf("service %q not found", name), http.StatusNotFound)
+		return
+	}
+	var req struct {
+		Enabled bool `json:"enabled"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+
+	verb := "off"
+	if req.Enabled {
+		verb = "on"
+	}
+	ctx := p.comment(r.Context(), user, "maintenance "+verb)
+	if err := p.reg.Modify(ctx, name, func(svc *registry.Service) error {
+		svc.Maintenance = req.Enabled
+		return nil
+	}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	p.log.Info("portal: maintenance mode changed", "user", user.Name, "service", name, "enabled", req.Enabled)
+	p.writeService(w, http.StatusOK, name)
+}
+
+func (p *Portal) handleCreateShare(w http.ResponseWriter, r *http.Request, user *config.PortalUser) {
+	name := r.PathValue("name")
+	svc, ok := p.owned(user, name)
+	if !ok {
+		http.Error(w, fmt.Sprintf("service %q not found", name), http.StatusNotFound)
+		return
+	}
+	if svc.ForwardProxy != nil {
+		http.Error(w, "forward proxy services cannot be shared", http.StatusBadRequest)
+		return
+	}
+	var req struct {
+		TTL string `json:"ttl"` // Go duration, e.g. "24h"
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	ttl, err := time.ParseDuration(req.TTL)
+	if err != nil || ttl <= 0 {
+		http.Error(w, "ttl must be a positive duration such as \"24h\"", http.StatusBadRequest)
+		return
+	}
+	if ttl > p.cfg.MaxShareTTL {
+		http.Error(w, fmt.Sprintf("ttl may be at most %s", p.cfg.MaxShareTTL), http.StatusBadRequest)
+		return
+	}
+
+	link, err := newShareLink(user.Name, p.now().Add(ttl))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ctx := p.comment(r.Context(), user, "share link "+link.ID+" created, valid "+ttl.String())
+	if err := p.reg.Modify(ctx, name, func(svc *registry.Service) error {
+		// Expired links are dropped here rather than by a sweeper; the
+		// xDS layer already ignores them.
+		svc.ShareLinks = append(svc.ActiveShareLinks(p.now()), link)
+		return nil
+	}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	p.log.Info("portal: share link created", "user", user.Name, "service", name, "id", link.ID, "expires", link.Expires)
+	writeJSON(w, http.StatusCreated, shareView{ID: link.ID, URL: shareURL(svc, link), Expires: link.Expires, CreatedBy: link.CreatedBy})
+}
+
+func (p *Portal) handleRevokeShare(w http.ResponseWriter, r *http.Request, user *config.PortalUser) {
+	name, id := r.PathValue("name"), r.PathValue("id")
+	if _, ok := p.owned(user, name); !ok {
+		http.Error(w, fmt.Sprintf("service %q not found", name), http.StatusNotFound)
+		return
+	}
+
+	ctx := p.comment(r.Context(), user, "share link "+id+" revoked")
+	err := p.reg.Modify(ctx, name, func(svc *registry.Service) error {
+		var kept []registry.ShareLink
+		for _, l := range svc.ShareLinks {
+			if l.ID != id {
+				kept = append(kept, l)
+			}
+		}
+		if len(kept) == len(svc.ShareLinks) {
+			return errShareNotFound
+		}
+		svc.ShareLinks = kept
+		return nil
+	})
+	if errors.Is(err, errShareNotFound) {
+		http.Error(w, fmt.Sprintf("share link %q not found", id), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	p.log.Info("portal: share link revoked", "user", user.Name, "service", name, "id", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+var errShareNotFound = errors.New("share link not found")
+
+// comment tags a portal change in the registry history with who made it.
+func (p *Portal) comment(ctx context.Context, user *config.PortalUser, what string) context.Context {
+	return registry.WithComment(ctx, "portal: "+user.Name+": "+what)
+}
+
+func (p *Portal) writeService(w http.ResponseWriter, status int, name string) {
+	svc, ok := p.reg.Get(name)
+	if !ok {
+		http.Error(w, fmt.Sprintf("service %q not found", name), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, status, p.view(svc))
+}
+
+func (p *Portal) handlePage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(page))
+}
+
+func newShareLink(createdBy string, expires time.Time) (registry.ShareLink, error) {
+	id := make([]byte, 4)
+	token := make([]byte, 24)
+	if _, err := rand.Read(id); err != nil {
+		return registry.ShareLink{}, fmt.Errorf("generating share link: %w", err)
+	}
+	if _, err := rand.Read(token); err != nil {
+		return registry.ShareLink{}, fmt.Errorf("generating share link: %w", err)
+	}
+	return registry.ShareLink{
+		ID:        hex.EncodeToString(id),
+		Token:     base64.RawURLEncoding.EncodeToString(token),
+		Expires:   expires.UTC().Truncate(time.Second),
+		CreatedBy: createdBy,
+	}, nil
+}
+
+func shareURL(svc *registry.Service, l registry.ShareLink) string {
+	return "https://" + svc.Domain + "/?" + registry.ShareQueryParam + "=" + l.Token
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
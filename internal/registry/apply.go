@@ -0,0 +1,127 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Desired is a full desired state for one source's services, for Apply.
+type Desired struct {
+	// Source owns the services: its services missing from Services are
+	// removed. Services of other sources are left alone unless Services
+	// names them, in which case the ownership policy decides.
+	Source string
+
+	Services []*Service
+
+	// Keep, if set, is called with each stored service and its
+	// replacement, to carry over what the desired state doesn't describe
+	// (maintenance mode, share links, ...).
+	Keep func(old, next *Service)
+
+	// DryRun computes the changes without making them.
+	DryRun bool
+}
+
+// Apply makes the registry match d in a single version, so Envoys never
+// see a state halfway between the two. Every service is validated and
+// checked against the ownership policy first; if any fails nothing is
+// changed and the errors are returned together. It returns the changes as
+// they are (or, for a dry run, would be) recorded in the history, adds and
+// updates by name and then removals.
+func (r *Registry) Apply(ctx context.Context, d Desired) (changes []Change, err error) {
+	ctx, span := startSpan(ctx, "registry.Apply", "")
+	defer func() { endSpan(span, err) }()
+
+	desired := make(map[string]*Service, len(d.Services))
+	for _, svc := range d.Services {
+		if desired[svc.Name] != nil {
+			return nil, fmt.Errorf("%w %q: listed twice", ErrInvalid, svc.Name)
+		}
+		desired[svc.Name] = svc
+	}
+	names := make([]string, 0, len(desired))
+	for name := range desired {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	r.mu.Lock()
+	version := r.version + 1
+
+	var errs []error
+	for _, name := range names {
+		next := desired[name]
+		old, exists := r.services[name]
+		if exists {
+			if d.Keep != nil {
+				d.Keep(old, next)
+			}
+			if err := r.ownership.allows(old, next); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+		}
+		if r.validate != nil {
+			if err := r.validate(next); err != nil {
+				errs = append(errs, fmt.Errorf("%w %q: %v", ErrInvalid, name, err))
+				continue
+			}
+		}
+		switch {
+		case !exists:
+			changes = append(changes, newChange(ctx, "add", version, nil, next))
+		case len(diffServices(old, next)) > 0:
+			changes = append(changes, newChange(ctx, "update", version, old, next))
+		}
+	}
+	var removed []string
+	for name, old := range r.services {
+		if desired[name] == nil && SourceOf(old) == d.Source {
+			removed = append(removed, name)
+		}
+	}
+	sort.Strings(removed)
+	for _, name := range removed {
+		changes = append(changes, newChange(ctx, "remove", version, r.services[name], nil))
+	}
+
+	if len(errs) > 0 {
+		r.mu.Unlock()
+		return nil, errors.Join(errs...)
+	}
+	if d.DryRun || len(changes) == 0 {
+		r.mu.Unlock()
+		return changes, nil
+	}
+
+	prevServices := make(map[string]*Service, len(r.services))
+	for name, svc := range r.services {
+		prevServices[name] = svc
+	}
+	prevHistory := r.history
+	for _, c := range changes {
+		if c.Op == "remove" {
+			delete(r.services, c.Service)
+		} else {
+			r.services[c.Service] = desired[c.Service]
+		}
+		r.appendHistory(c)
+	}
+	if err := r.save(); err != nil {
+		r.services = prevServices
+		r.history = prevHistory
+		r.mu.Unlock()
+		return nil, err
+	}
+	r.version = version
+	cb := r.onChange
+	r.mu.Unlock()
+
+	if cb != nil {
+		cb(ctx)
+	}
+	return changes, nil
+}
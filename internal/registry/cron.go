@@ -0,0 +1,144 @@
+package registry
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cron is a parsed five-field cron expression: minute, hour, day of month,
+// month and day of week (0 or 7 is Sunday). Fields take *, a value, a range
+// a-b, a step */n or a-b/n, and comma-separated lists of those. As in cron,
+// when both day fields are restricted a day matching either one matches.
+type Cron struct {
+	minute, hour, dom, month, dow uint64 // bit i set if value i matches
+	anyDom, anyDow                bool   // the day field starts with *
+}
+
+var cronFields = []struct {
+	name        string
+	first, last int
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// ParseCron parses a five-field cron expression.
+func ParseCron(s string) (*Cron, error) {
+	fields := strings.Fields(s)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("cron %q: want 5 fields (minute hour day-of-month month day-of-week), got %d", s, len(fields))
+	}
+	var bits [5]uint64
+	for i, f := range fields {
+		b, err := parseCronField(f, cronFields[i].first, cronFields[i].last)
+		if err != nil {
+			return nil, fmt.Errorf("cron %q: %s: %w", s, cronFields[i].name, err)
+		}
+		bits[i] = b
+	}
+	c := &Cron{minute: bits[0], hour: bits[1], dom: bits[2], month: bits[3], dow: bits[4]}
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1 // 7 is Sunday too
+	}
+	c.anyDom = strings.HasPrefix(fields[2], "*")
+	c.anyDow = strings.HasPrefix(fields[4], "*")
+	return c, nil
+}
+
+func parseCronField(f string, first, last int) (uint64, error) {
+	var bits uint64
+	for part := range strings.SplitSeq(f, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepStr)
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid step %q", stepStr)
+			}
+			step = n
+		}
+		lo, hi := first, last
+		switch {
+		case rng == "*":
+		case strings.Contains(rng, "-"):
+			a, b, _ := strings.Cut(rng, "-")
+			var err error
+			if lo, err = cronValue(a, first, last); err != nil {
+				return 0, err
+			}
+			if hi, err = cronValue(b, first, last); err != nil {
+				return 0, err
+			}
+			if lo > hi {
+				return 0, fmt.Errorf("invalid range %q", rng)
+			}
+		default:
+			v, err := cronValue(rng, first, last)
+			if err != nil {
+				return 0, err
+			}
+			lo = v
+			if !hasStep {
+				hi = v
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+func cronValue(s string, first, last int) (int, error) {
+	v, err := strconv.Atoi(s)
+	if err != nil || v < first || v > last {
+		return 0, fmt.Errorf("%q is not a number from %d to %d", s, first, last)
+	}
+	return v, nil
+}
+
+func (c *Cron) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<t.Day()) != 0
+	dow := c.dow&(1<<int(t.Weekday())) != 0
+	if c.anyDom || c.anyDow {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Next returns the first minute after t that c matches, in t's location,
+// or the zero time if there is none within five years (e.g. February 30).
+func (c *Cron) Next(t time.Time) time.Time {
+	loc := t.Location()
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	// Each step moves to the start of the next month, day, hour or minute;
+	// the After checks keep it moving across DST changes.
+	advance := func(next time.Time, fallback time.Duration) time.Time {
+		if !next.After(t) {
+			return t.Add(fallback).Truncate(time.Minute)
+		}
+		return next
+	}
+	for t.Before(limit) {
+		y, m, d := t.Date()
+		switch {
+		case c.month&(1<<int(m)) == 0:
+			t = advance(time.Date(y, m+1, 1, 0, 0, 0, 0, loc), 24*time.Hour)
+		case !c.dayMatches(t):
+			t = advance(time.Date(y, m, d+1, 0, 0, 0, 0, loc), time.Hour)
+		case c.hour&(1<<t.Hour()) == 0:
+			t = advance(time.Date(y, m, d, t.Hour()+1, 0, 0, 0, loc), time.Minute)
+		case c.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,60 @@
+package registry
+
+// Dependencies
+//
+// A service with DependsOn is left out of every snapshot until each
+// service it names is registered and served itself, so a stack that is
+// starting up doesn't send visitors to a frontend whose backend isn't there
+// yet. Registration is checked here, when snapshots are built; whether a
+// registered dependency is healthy is depends.Gate's to judge, and it says
+// so in Waiting.
+
+// Unready returns, by name, why each of services that depends on others
+// can't be served yet: a dependency is not registered, is unready itself
+// (which includes a dependency cycle), or the service is Waiting.
+func Unready(services []*Service) map[string]string {
+	byName := make(map[string]*Service, len(services))
+	for _, svc := range services {
+		byName[svc.Name] = svc
+	}
+	out := make(map[string]string)
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := make(map[string]int, len(services))
+	var visit func(svc *Service) string
+	visit = func(svc *Service) string {
+		if state[svc.Name] == done {
+			return out[svc.Name]
+		}
+		state[svc.Name] = visiting
+		var reason string
+		if len(svc.DependsOn) > 0 {
+			reason = svc.Waiting
+		}
+		for _, name := range svc.DependsOn {
+			if reason != "" {
+				break
+			}
+			dep, ok := byName[name]
+			switch {
+			case !ok:
+				reason = "waiting for " + name + ": not registered"
+			case state[name] == visiting:
+				reason = "dependency cycle through " + name
+			case visit(dep) != "":
+				reason = "waiting for " + name
+			}
+		}
+		state[svc.Name] = done
+		if reason != "" {
+			out[svc.Name] = reason
+		}
+		return reason
+	}
+	for _, svc := range services {
+		visit(svc)
+	}
+	return out
+}
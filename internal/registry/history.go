@@ -0,0 +1,182 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// maxHistory bounds the change history kept (and persisted) by the registry.
+const maxHistory = 1000
+
+// Change records one registry mutation.
+type Change struct {
+	Version uint64    // registry version after the change
+	Time    time.Time // when it was applied
+	Op      string    // "add", "update" or "remove"
+	Service string
+
+	// Comment is the free-text reason given by whoever made the change,
+	// e.g. "switching Jellyfin to new box". See WithComment.
+	Comment string
+
+	// RequestID is the management API request that made the change, if
+	// one did. See WithRequestID.
+	RequestID string `json:",omitempty"`
+
+	// Diff lists the fields that changed. An add lists every set field with
+	// a nil From; a remove every set field with a nil To.
+	Diff []FieldChange
+}
+
+// FieldChange is a single field's old and new value.
+type FieldChange struct {
+	Field string
+	From  any
+	To    any
+}
+
+type commentKey struct{}
+
+// WithComment attaches a change comment to ctx; the next mutation made with
+// it records the comment in the history.
+func WithComment(ctx context.Context, comment string) context.Context {
+	if comment == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, commentKey{}, comment)
+}
+
+func commentFrom(ctx context.Context) string {
+	c, _ := ctx.Value(commentKey{}).(string)
+	return c
+}
+
+type requestIDKey struct{}
+
+// WithRequestID attaches the ID of the API request being served to ctx;
+// the changes made with it record the ID in the history, and the rebuilds
+// they cause log it.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestIDFrom returns the request ID attached to ctx, or "".
+func RequestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// History returns recorded changes, oldest first. A non-empty service
+// limits them to that service.
+func (r *Registry) History(service string) []Change {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	out := make([]Change, 0, len(r.history))
+	for _, c := range r.history {
+		if service == "" || c.Service == service {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// record appends a change to the history. Caller holds the write lock and
+// must pass the version the change will carry. It returns a function that
+// undoes the append, for rolling back a failed save.
+func (r *Registry) record(ctx context.Context, op string, version uint64, before, after *Service) (undo func()) {
+	prev := r.history
+	r.appendHistory(newChange(ctx, op, version, before, after))
+	return func() { r.history = prev }
+}
+
+// newChange describes a mutation. Either service may be nil.
+func newChange(ctx context.Context, op string, version uint64, before, after *Service) Change {
+	c := Change{
+		Version:   version,
+		Time:      time.Now().UTC(),
+		Op:        op,
+		Comment:   commentFrom(ctx),
+		RequestID: RequestIDFrom(ctx),
+		Diff:      diffServices(before, after),
+	}
+	if after != nil {
+		c.Service = after.Name
+	} else {
+		c.Service = before.Name
+	}
+	return c
+}
+
+// appendHistory adds c to the history, dropping the oldest changes beyond
+// maxHistory. Caller holds the write lock.
+func (r *Registry) appendHistory(c Change) {
+	h := append(r.history, c)
+	if len(h) > maxHistory {
+		h = append([]Change(nil), h[len(h)-maxHistory:]...)
+	}
+	r.history = h
+}
+
+// diffServices compares two services field by field, using their JSON form
+// so nested values (header rules, JWT) compare and print naturally. Either
+// may be nil. Zero-valued fields are omitted on both sides.
+func diffServices(before, after *Service) []FieldChange {
+	a, b := serviceFields(before), serviceFields(after)
+
+	keys := make(map[string]bool, len(a)+len(b))
+	for k := range a {
+		keys[k] = true
+	}
+	for k := range b {
+		keys[k] = true
+	}
+
+	var out []FieldChange
+	for k := range keys {
+		if !reflect.DeepEqual(a[k], b[k]) {
+			out = append(out, FieldChange{Field: k, From: a[k], To: b[k]})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Field < out[j].Field })
+	return out
+}
+
+func serviceFields(svc *Service) map[string]any {
+	if svc == nil {
+		return nil
+	}
+	data, err := json.Marshal(svc)
+	if err != nil {
+		return nil
+	}
+	var m map[string]any
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil
+	}
+	for k, v := range m {
+		if isZero(v) {
+			delete(m, k)
+		}
+	}
+	return m
+}
+
+func isZero(v any) bool {
+	switch v := v.(type) {
+	case nil:
+		return true
+	case bool:
+		return !v
+	case float64:
+		return v == 0
+	case string:
+		return v == ""
+	case []any:
+		return len(v) == 0
+	}
+	return false
+}
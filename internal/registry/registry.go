@@ -1,8 +1,18 @@
 package registry
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"strconv"
 	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Service represents a single routable application.
@@ -15,19 +25,793 @@ type Service struct {
 	Name     string // unique identifier, e.g. "nextcloud"
 	Domain   string // FQDN for virtual-host matching, e.g. "cloud.example.com"
 	Upstream string // host:port of the actual app, e.g. "web-a:5678"
+
+	// Aliases serve the same upstream under more domains, each mapped to a
+	// path and Host of its own. See ValidateAliases.
+	Aliases []Alias
+
+	// Mount, if set, serves the service under a path of its domain rather
+	// than at its root. See Mount.
+	Mount *Mount
+
+	// ExtAuthz requires every request to pass the configured external auth
+	// service (SSO) before it reaches the upstream.
+	ExtAuthz bool
+
+	// BasicAuth is an htpasswd-style user list ("user:{SHA}hash" entries).
+	// Non-empty enables HTTP basic auth for the service. See ParseBasicAuth.
+	BasicAuth []string
+
+	// VirtualClusters group request paths into named endpoint groups so Envoy
+	// keeps latency/error stats per group, not just per domain.
+	VirtualClusters []VirtualCluster
+
+	// JWT, if set, requires every request to carry a valid bearer token from
+	// the given issuer. See ValidateJWT.
+	JWT *JWT
+
+	// Challenge makes the edge show suspicious clients a proof-of-work page
+	// before forwarding their requests home.
+	Challenge bool
+
+	// Headers modifies request and response headers for the service.
+	// See ValidateHeaderRules.
+	Headers *HeaderRules
+
+	// HostRewrite replaces the Host header the home node sends upstream,
+	// for apps that expect their own: HostRewriteAuto sends the upstream's
+	// host, anything else is sent as it is. Edges pass Host unchanged, as
+	// home picks the service by it. See ValidateHostRewrite.
+	HostRewrite string
+
+	// ForwardProxy, if set, makes the service a dynamic forward proxy: each
+	// request names its destination in the ForwardProxyHeader header and is
+	// forwarded there from the home node if the destination is allowed.
+	// Upstream is unused. See ValidateForwardProxy.
+	ForwardProxy *ForwardProxy
+
+	// Redirect, if set, makes the service answer every request with a
+	// redirect instead of proxying it, e.g. for a vanity domain or an old
+	// hostname. Every node answers it itself, so it needs no backend and
+	// Upstream is unused. See ValidateRedirect.
+	Redirect *Redirect
+
+	// Static, if set, makes the service answer with fixed content instead
+	// of proxying, e.g. a placeholder page for a domain whose app doesn't
+	// exist yet, or its robots.txt. Like Redirect, every node answers it
+	// itself and Upstream is unused. See ValidateStatic.
+	Static *Static
+
+	// TCP, if set, makes the service a plain TCP forward of a port range
+	// instead of an HTTP service, e.g. for a game server. It has no Domain,
+	// and Upstream's port is where the range's first port goes. See
+	// ValidateTCP.
+	TCP *TCPForward
+
+	// Namespace groups the service with others sharing defaults and bounds
+	// for the settings below (see config.Namespace). Empty means none.
+	Namespace string
+
+	// RateLimit caps requests per second, per node. 0 inherits the
+	// namespace default (or no limit outside a namespace).
+	RateLimit int
+
+	// MaxBodyBytes caps request body size. 0 inherits as RateLimit does.
+	MaxBodyBytes int64
+
+	// Streaming passes request bodies through both Envoys as they arrive,
+	// for multi-GB uploads: nothing buffers them (so MaxBodyBytes is not
+	// enforced), the route timeout gives way to an idle timeout, and
+	// requests are never retried.
+	Streaming bool
+
+	// Privacy keeps personal data of the service's visitors out of what the
+	// control plane stores about its requests (see config.Privacy).
+	Privacy bool
+
+	// Cache, if set, lets the edges cache the service's responses (see
+	// config.Cache). See Cache for what is never cached.
+	Cache *Cache
+
+	// Exposure is ExposurePublic or ExposureLAN. Empty inherits, and
+	// defaults to ExposurePublic.
+	Exposure string
+
+	// Failover, if set, is a second upstream ("host:port", reached from the
+	// edges) the edges send requests to while home is unreachable, e.g. a
+	// cloud replica or a static maintenance backend. Home is preferred
+	// again once it answers.
+	Failover string
+
+	// Origins are copies of the service running on edge nodes themselves,
+	// e.g. a status page container on the VPS. Such an edge sends requests
+	// to its copy first, and through the tunnel home only while the copy
+	// fails its probes. See ValidateOrigins.
+	Origins []Origin
+
+	// Nodes, if set, limits the service to these nodes (by ID): it is left
+	// out of the other edges' snapshots, and leaving out the home node makes
+	// it edge-only, hidden from LAN clients. Empty serves it on every node
+	// its exposure allows.
+	Nodes []string
+
+	// Maintenance answers every request with a 503 maintenance page instead
+	// of forwarding it.
+	Maintenance bool
+
+	// MaintenancePage, if set, replaces the default maintenance page. It
+	// is kept while maintenance mode is off, for the next time.
+	MaintenancePage *MaintenancePage
+
+	// ShareLinks grant temporary access past the service's authentication.
+	ShareLinks []ShareLink
+
+	// Canary, if set, sends part of the traffic to a second upstream on
+	// the home node. See ValidateCanary.
+	Canary *Canary
+
+	// Switch, if set, is a blue/green switch of Upstream that is rolled
+	// back if the service turns unhealthy before it ends. Like Canary, it
+	// is runtime state kept when the definition is replaced.
+	Switch *Switch
+
+	// Schedule changes how the service is served at set times, e.g. into
+	// maintenance nightly. It is part of the definition: the rules are
+	// applied when snapshots are built, not stored in Maintenance or
+	// Exposure. See ScheduleRule.
+	Schedule []ScheduleRule
+
+	// Mirror, if set, copies a sample of the requests to an analysis tool
+	// until it expires. Like Canary, it is runtime state kept when the
+	// definition is replaced. See ValidateMirror.
+	Mirror *Mirror
+
+	// Shadow, if set, copies a sample of the requests to another service,
+	// e.g. the next version of the app, as part of the definition. See
+	// ValidateShadow.
+	Shadow *Shadow
+
+	// DependsOn names services that must be registered and ready before
+	// this one is served, e.g. an app's API for its frontend. See
+	// Unready.
+	DependsOn []string
+
+	// Waiting, if set, says which dependency the service waits for while
+	// that one is registered but unhealthy (see depends.Gate). Like
+	// Canary, it is runtime state kept when the definition is replaced.
+	Waiting string
+
+	// HealthCheck, if set, has the home node probe the upstream over raw
+	// TCP and take it out of rotation while the probe fails. See
+	// ValidateHealthCheck.
+	HealthCheck *HealthCheck
+
+	// Concurrency, if set, caps the requests the home node has in flight
+	// to the upstream, queueing the next ones. See ValidateConcurrency.
+	Concurrency *Concurrency
+
+	// Affinity, if set, keeps each client on one of the upstream's hosts,
+	// for apps that keep sessions in memory. See ValidateAffinity.
+	Affinity *Affinity
+
+	// LBPolicy is how the home node balances requests over the hosts
+	// Upstream resolves to: one of LBPolicies, empty for round robin. See
+	// ValidateLBPolicy.
+	LBPolicy string
+
+	// DNS, if set, overrides how the home node resolves Upstream. See
+	// ValidateDNS.
+	DNS *DNS
+
+	// ClientCert, if set, passes the identity from a verified client
+	// certificate (see config.TLS) on to the upstream. See
+	// ValidateClientCert.
+	ClientCert *ClientCert
+
+	// TLS, if set, gives the service's domain its own TLS settings on the
+	// edges' HTTPS listener. See ValidateTLSPolicy.
+	TLS *TLSPolicy
+
+	// Wasm runs uploaded Wasm modules as HTTP filters for the service, in
+	// order, after the ones config.Wasm runs for every service. See
+	// ValidateWasm.
+	Wasm []WasmFilter
+
+	// FilterConfig and RouteMetadata are raw Envoy config, as JSON, for
+	// features the control plane doesn't model: typed_per_filter_config
+	// for the service's virtual host by filter name, and filter_metadata
+	// for its routes by namespace. See xds.ValidatePassthrough.
+	FilterConfig  map[string]json.RawMessage
+	RouteMetadata map[string]json.RawMessage
+
+	// Source is who registered the service: SourceAPI, SourceFile,
+	// SourceKubernetes or SourceDocker. See Ownership and SourceOf.
+	Source string
+
+	// Container is the ID of the Docker container the service was
+	// discovered from, empty for services added through the API. The
+	// Docker watcher's reconcile only removes services it discovered.
+	Container string
+
+	// DockerHost is the docker.hosts entry the container runs on, empty
+	// for the local engine. Each host's watcher only removes its own.
+	DockerHost string
+
+	// Ingress is the "namespace/name" of the Kubernetes Ingress the service
+	// was discovered from, like Container for the Kubernetes watcher.
+	Ingress string
+
+	// File is the name of the definition file the service was loaded from
+	// by the file provider, like Container for the Docker watcher.
+	File string
+}
+
+// Cache says which of a service's responses the edges may cache. Beyond
+// Cache-Control, requests that may get a response meant for one user skip
+// the cache, and responses that look like one are not stored: otherwise the
+// next visitor could be served someone else's page.
+type Cache struct {
+	// BypassCookies skips the cache for requests carrying any of these
+	// cookies, e.g. the app's session cookie.
+	BypassCookies []string
+
+	// BypassHeaders skips the cache for requests carrying any of these
+	// headers. Authorization always does, unless Authenticated.
+	BypassHeaders []string
+
+	// PrivateHeaders keeps responses carrying any of these headers out of
+	// the cache. Set-Cookie always does.
+	PrivateHeaders []string
+
+	// Authenticated allows caching a service behind basic auth or JWT,
+	// for apps that show every user the same pages. Without it, services
+	// with either are not cached. Services behind ext_authz never are:
+	// the edges don't check it, so they could serve its pages to anyone.
+	Authenticated bool
+}
+
+// TLSPolicy overrides the edges' TLS settings (config.TLS) for one
+// service's domain, which is then served over HTTPS only: the plain HTTP
+// listener and the shared HTTPS settings redirect to it.
+type TLSPolicy struct {
+	// MinVersion is "1.2" or "1.3". Empty keeps Envoy's default, 1.2.
+	MinVersion string
+
+	// ClientCert is "optional", "required" or "none", overriding
+	// config.TLS.RequireClientCert. Empty inherits it.
+	ClientCert string
+
+	// CertChain and PrivateKey are the domain's own certificate, as paths
+	// on the edge hosts. Empty uses the config's.
+	CertChain  string
+	PrivateKey string
+}
+
+// TLS client certificate modes for TLSPolicy.ClientCert.
+const (
+	ClientCertNone     = "none"
+	ClientCertOptional = "optional"
+	ClientCertRequired = "required"
+)
+
+// ClientCert says how a service's upstream learns who the client is when
+// the client presented a verified certificate at the edge. Without one, the
+// headers are absent; they are never passed through from the client.
+type ClientCert struct {
+	// XFCC sets X-Forwarded-Client-Cert in Envoy's format:
+	// Hash=<sha256>;Subject="<subject>";URI=<uri san>;DNS=<dns san>.
+	XFCC bool
+
+	// Headers set single certificate fields, e.g. X-Client-Subject from
+	// "subject".
+	Headers []ClientCertHeader
+}
+
+// ClientCertHeader sets a header to one field of the client certificate.
+type ClientCertHeader struct {
+	Name  string
+	Field string // one of ClientCertFields
+}
+
+// ClientCertFields are the certificate fields ClientCertHeader can carry.
+var ClientCertFields = []string{"subject", "uri_san", "dns_san", "fingerprint", "serial"}
+
+// HealthCheck is an active TCP probe of a service's upstream, for apps that
+// don't speak HTTP or have no health endpoint. With no Send and no Expect it
+// only checks that the port accepts connections; otherwise it writes Send
+// and passes if the reply contains Expect, e.g. "PING\r\n" and "+PONG" for
+// Redis.
+type HealthCheck struct {
+	Interval time.Duration // between probes; 0 means 10s
+	Timeout  time.Duration // for one probe; 0 means 2s
+	Send     string
+	Expect   string
+}
+
+// Concurrency is a service's concurrent request limit, for an app that can
+// only handle a few requests at a time, like a single-process Python app:
+// rather than piling onto it and timing out, requests beyond Max wait their
+// turn in the home node. Beyond Max+Queue they are answered 503 at once.
+// Waiting counts against the request's timeout.
+type Concurrency struct {
+	Max   int // requests in flight to the upstream, at least 1
+	Queue int // requests waiting for one of them to finish
+}
+
+// Load balancing policies.
+const (
+	LBRoundRobin   = "round_robin"
+	LBLeastRequest = "least_request"
+	LBRandom       = "random"
+	LBRingHash     = "ring_hash"
+)
+
+// LBPolicies lists the load balancing policies, for error messages.
+var LBPolicies = []string{LBRoundRobin, LBLeastRequest, LBRandom, LBRingHash}
+
+// DNS resolution types, named after Envoy's cluster types.
+const (
+	DNSStrict  = "strict_dns"
+	DNSLogical = "logical_dns"
+	DNSStatic  = "static"
+)
+
+// DNSTypes lists the DNS resolution types, for error messages.
+var DNSTypes = []string{DNSStrict, DNSLogical, DNSStatic}
+
+// DNS is how the home node resolves a service's upstream. By default an IP
+// address is used as it is (static) and a hostname is re-resolved every
+// dns.refresh_rate, balancing over every address it returns (strict_dns).
+// logical_dns connects to the first address only, for a hostname with many
+// addresses that change often, such as a CDN's.
+type DNS struct {
+	Type        string        // one of DNSTypes; empty picks by upstream
+	RefreshRate time.Duration // 0 uses dns.refresh_rate
+}
+
+// Affinity modes.
+const (
+	AffinityCookie = "cookie"
+	AffinityHeader = "header"
+)
+
+// Affinity balances requests over the hosts Upstream resolves to, e.g. the
+// replicas of a scaled Compose service, by a hash of the client's session
+// rather than round robin, so a client keeps reaching the same replica.
+// When the replicas change, only the sessions of the ones added or removed
+// move.
+type Affinity struct {
+	// Mode is AffinityCookie, hashing Cookie, which the home node sets on
+	// a client's first response if it has none, or AffinityHeader,
+	// hashing Header, e.g. one the app's clients send with a user ID.
+	Mode string
+
+	// Cookie is the cookie's name; empty means "envoyage_affinity".
+	Cookie string
+	// TTL is the cookie's lifetime; 0 makes it a session cookie.
+	TTL time.Duration
+
+	Header string
+
+	// Maglev balances with Maglev rather than a hash ring: a more even
+	// spread and faster lookups, at the cost of more sessions moving
+	// when replicas change.
+	Maglev bool
+}
+
+// Canary is a weighted split between a service's Upstream (stable) and a
+// new version of it.
+type Canary struct {
+	Upstream string // host:port of the new version
+	Weight   int    // percent of requests sent to it, 0-100
+
+	// Analysis, if set, moves Weight automatically: forward while the
+	// canary does as well as stable, back to 0 (and off) when it doesn't.
+	// Nil leaves Weight to be changed by hand.
+	Analysis *CanaryAnalysis
+}
+
+// CanaryAnalysis sets the thresholds for automatic canary promotion. Each
+// Interval, the canary's error rate and latency are compared with stable's
+// over the same window; if both are within bounds Weight grows by Step,
+// reaching 100 promotes the canary to Upstream.
+type CanaryAnalysis struct {
+	Step     int           // percentage points added per passing interval
+	Interval time.Duration // length of each comparison window
+
+	// MinRequests is how many requests the canary must have served in a
+	// window before it is judged; quieter windows are extended.
+	MinRequests uint64
+
+	// MaxErrorRateIncrease is how far the canary's 5xx rate may exceed
+	// stable's, as a fraction (0.01 = one percentage point).
+	MaxErrorRateIncrease float64
+
+	// MaxLatencyRatio is how many times stable's p95 latency the canary's
+	// may be. 0 skips the latency check.
+	MaxLatencyRatio float64
+}
+
+// Origin is a service's copy on an edge node.
+type Origin struct {
+	Node     string // the edge's node ID
+	Upstream string // host:port, as the edge reaches it
+}
+
+// Switch is a blue/green switchover being watched: Upstream went from From
+// to To at At, and goes back if the service turns unhealthy before Until.
+type Switch struct {
+	From  string
+	To    string
+	At    time.Time
+	Until time.Time
+}
+
+// ShareQueryParam carries a share link's token: whoever has the URL
+// https://<domain>/?envoyage_share=<token> gets in.
+const ShareQueryParam = "envoyage_share"
+
+// ShareLink is a temporary link to a service that skips its basic auth, JWT,
+// SSO and challenge checks until it expires.
+type ShareLink struct {
+	ID        string // short identifier shown in listings and used to revoke
+	Token     string // secret carried in the URL and then in a cookie
+	Expires   time.Time
+	CreatedBy string
+}
+
+// MaxPageBytes bounds the HTML pages Envoy answers itself with.
+const MaxPageBytes = 64 << 10
+
+// MaintenancePage is a service's own maintenance response.
+type MaintenancePage struct {
+	Body       string        // HTML; empty keeps the default page
+	RetryAfter time.Duration // sent as Retry-After; 0 keeps the default, 5m
+}
+
+// Mirror copies requests to a service, like an IDS (zeek, suricata) at
+// home, for intrusion analysis. The home node sends the copies, with the
+// Host suffixed "-shadow", and doesn't wait for or look at the replies, so
+// the tool can't slow down or break the service. Only HTTP services can be
+// mirrored: Envoy can't copy a TCP forward's stream.
+type Mirror struct {
+	Target  string    // host:port the copies are sent to
+	Percent float64   // share of requests copied, above 0 and at most 100
+	Expires time.Time // when mirroring stops by itself
+}
+
+// Shadow copies requests to another registered service, to try a new
+// version of an app on real traffic: the home node sends the copies to the
+// other service's upstream, with the Host suffixed "-shadow", and drops its
+// replies, so users only ever see the service's own. Unlike Mirror it
+// belongs to the definition and doesn't expire. The copies are real
+// requests: a shadow that writes to the same database as the service
+// writes twice.
+type Shadow struct {
+	Service string  // the service the copies go to
+	Percent float64 // share of requests copied, above 0 and at most 100
+}
+
+// WasmFilter runs an uploaded Wasm module (see package wasm) as an HTTP
+// filter. A module that isn't uploaded (yet) is left out, and reported by
+// lint.
+type WasmFilter struct {
+	Module   string // name the module was uploaded under
+	RootID   string // the plugin's root context, for modules with several
+	Config   string // handed to the plugin as its configuration
+	Edge     bool   // run on the edges instead of the home node
+	FailOpen bool   // let requests through while the plugin is broken
+}
+
+// AnsweredByEnvoy reports whether the nodes answer the service's requests
+// themselves, as a redirect or static service: it has no upstream and no
+// cluster.
+func (s *Service) AnsweredByEnvoy() bool {
+	return s.Redirect != nil || s.Static != nil
+}
+
+// ActiveMirror returns the service's mirror if it has not expired at now.
+func (s *Service) ActiveMirror(now time.Time) *Mirror {
+	if s.Mirror == nil || !now.Before(s.Mirror.Expires) {
+		return nil
+	}
+	return s.Mirror
+}
+
+// ActiveShareLinks returns the links that have not expired at now.
+func (s *Service) ActiveShareLinks(now time.Time) []ShareLink {
+	var out []ShareLink
+	for _, l := range s.ShareLinks {
+		if now.Before(l.Expires) {
+			out = append(out, l)
+		}
+	}
+	return out
+}
+
+// ScheduleRule puts a service in a state for Duration every time Cron
+// matches, in the control plane's time zone: e.g. {"0 2 * * *", 4h,
+// ScheduleMaintenance} for maintenance from 02:00 to 06:00, or
+// {"0 23 * * *", 19h, ScheduleLAN} to expose a service publicly only from
+// 18:00 to 23:00.
+type ScheduleRule struct {
+	Cron     string
+	Duration time.Duration
+	Action   string // one of ScheduleActions
+}
+
+// Schedule actions.
+const (
+	ScheduleMaintenance = "maintenance" // as if in maintenance mode
+	ScheduleLAN         = "lan"         // as if ExposureLAN
+)
+
+// ScheduleActions lists the valid ScheduleRule actions.
+var ScheduleActions = []string{ScheduleMaintenance, ScheduleLAN}
+
+// active returns when the rule's current run ends, or the zero time if it
+// isn't running at now. With runs overlapping, the last one started counts.
+func (r ScheduleRule) active(now time.Time) time.Time {
+	c, err := ParseCron(r.Cron)
+	if err != nil {
+		return time.Time{}
+	}
+	var end time.Time
+	for start := c.Next(now.Add(-r.Duration)); !start.IsZero() && !start.After(now); start = c.Next(start) {
+		end = start.Add(r.Duration)
+	}
+	return end
+}
+
+// Scheduled returns the service as its schedule has it at now: s itself if
+// no rule is running, else a copy with the running rules applied.
+func (s *Service) Scheduled(now time.Time) *Service {
+	var out *Service
+	for _, r := range s.Schedule {
+		if r.active(now).IsZero() {
+			continue
+		}
+		if out == nil {
+			c := *s
+			out = &c
+		}
+		switch r.Action {
+		case ScheduleMaintenance:
+			out.Maintenance = true
+		case ScheduleLAN:
+			out.Exposure = ExposureLAN
+		}
+	}
+	if out == nil {
+		return s
+	}
+	return out
+}
+
+// NextScheduleChange returns when the next of the service's schedule rules
+// starts or ends after now, or the zero time if it has none.
+func (s *Service) NextScheduleChange(now time.Time) time.Time {
+	var next time.Time
+	for _, r := range s.Schedule {
+		c, err := ParseCron(r.Cron)
+		if err != nil {
+			continue
+		}
+		for _, t := range []time.Time{r.active(now), c.Next(now)} {
+			if !t.IsZero() && (next.IsZero() || t.Before(next)) {
+				next = t
+			}
+		}
+	}
+	return next
+}
+
+// Exposure values.
+const (
+	ExposurePublic = "public" // served on every node
+	ExposureLAN    = "lan"    // served by the home node only
+)
+
+// ForwardProxyHeader carries a forward proxy request's destination, as
+// "host" or "host:port".
+const ForwardProxyHeader = "X-Envoyage-Destination"
+
+// ForwardProxy lists the destinations a forward proxy service may reach.
+type ForwardProxy struct {
+	// Allow entries are "host", "host:port", "*.suffix" or "*.suffix:port".
+	// Without a port any port is allowed. IP addresses are matched as
+	// written; nothing is resolved before matching.
+	Allow []string
+}
+
+// HostRewriteAuto, as Service.HostRewrite, sends the host name of the
+// upstream host each request goes to.
+const HostRewriteAuto = "auto"
+
+// Redirect statuses a redirect service may answer with.
+var RedirectStatuses = []int{301, 302, 307, 308}
+
+// Redirect is where a redirect service sends its visitors.
+type Redirect struct {
+	// URL is the absolute http(s) URL redirected to.
+	URL string
+
+	// Status is one of RedirectStatuses, 302 if 0: temporary, so a
+	// mistake isn't cached by browsers for good.
+	Status int
+
+	// PreservePath appends the request's path and query to URL's path,
+	// e.g. old.example.com/a?b to new.example.com/a?b, rather than sending
+	// every request to URL itself.
+	PreservePath bool
+}
+
+// Static is the content a static service answers with.
+type Static struct {
+	// Status is the status of every response but Files', 200 if 0.
+	Status int
+
+	// ContentType is Body's, "text/html; charset=utf-8" if empty.
+	ContentType string
+
+	// Body answers every request, at most MaxPageBytes.
+	Body string
+
+	// Files answer requests for their exact path instead, with a 200.
+	Files []StaticFile
+}
+
+// StaticFile is a file of a static service, e.g. /robots.txt or
+// /.well-known/security.txt.
+type StaticFile struct {
+	Path        string // absolute, without a query
+	ContentType string // guessed from Path's extension if empty
+	Body        string // at most MaxPageBytes
+}
+
+// TCPForward is the port range of a TCP service. Every edge listens on
+// each port and forwards it over the tunnel to the same port of the home
+// node, which forwards port FirstPort+i to Upstream's port+i.
+type TCPForward struct {
+	FirstPort uint32
+	LastPort  uint32 // inclusive; equal to FirstPort for a single port
+}
+
+// MaxTCPPorts bounds the ports of one TCP service; each is a listener and a
+// cluster on every node.
+const MaxTCPPorts = 100
+
+// Ports returns the range's ports in order.
+func (t *TCPForward) Ports() []uint32 {
+	out := make([]uint32, 0, t.LastPort-t.FirstPort+1)
+	for p := t.FirstPort; p <= t.LastPort; p++ {
+		out = append(out, p)
+	}
+	return out
 }
 
-// Registry is a thread-safe, in-memory store for services.
-// Will be backed by SQLite and populated by Docker discovery in a later phase.
+// String formats the range as ParsePortRange reads it: "27015-27020", or
+// "25565" for a single port.
+func (t *TCPForward) String() string {
+	if t.FirstPort == t.LastPort {
+		return strconv.FormatUint(uint64(t.FirstPort), 10)
+	}
+	return fmt.Sprintf("%d-%d", t.FirstPort, t.LastPort)
+}
+
+// HeaderRules are header changes applied between clients and the upstream.
+type HeaderRules struct {
+	Request  HeaderOps // applied to requests before they reach the upstream
+	Response HeaderOps // applied to responses before they reach the client
+}
+
+// HeaderOps is one direction's header changes. Set replaces existing values,
+// Add appends another value, Remove drops the header entirely.
+type HeaderOps struct {
+	Set    []Header
+	Add    []Header
+	Remove []string
+}
+
+// Header is a single header name and value.
+type Header struct {
+	Name  string
+	Value string
+}
+
+// JWT describes the tokens a service accepts.
+type JWT struct {
+	Issuer    string   // expected "iss" claim
+	JWKSURI   string   // URL of the issuer's signing keys (JWKS)
+	Audiences []string // accepted "aud" values; empty accepts any audience
+}
+
+// Alias is another domain of a service, e.g. photos.example.com for the
+// app's /photos section.
+type Alias struct {
+	Domain string
+
+	// PathPrefix is put in front of the request path: with "/photos",
+	// /album/1 reaches the upstream as /photos/album/1. Empty keeps paths.
+	PathPrefix string
+
+	// Host replaces the Host header sent upstream. Empty passes Domain.
+	Host string
+}
+
+// Mount serves a service under a path of its domain, for apps that can't
+// be told they live there: requests under PathPrefix reach the upstream
+// under UpstreamPath instead, and the paths in its redirects and cookies
+// are mapped back. See ValidateMount.
+type Mount struct {
+	// PathPrefix is the public path, e.g. "/grafana".
+	PathPrefix string
+
+	// UpstreamPath is where the upstream serves the app, e.g. "/" or
+	// "/app". Empty means "/".
+	UpstreamPath string
+}
+
+// VirtualCluster is a named path pattern within a service, e.g. "api" for
+// "/api/*". A trailing "*" makes the pattern a prefix match; otherwise the
+// path must match exactly (query strings are ignored).
+type VirtualCluster struct {
+	Name    string
+	Pattern string
+}
+
+// Registry is a thread-safe, in-memory store for services. With a Persister
+// set, every mutation is also written through to disk.
 type Registry struct {
 	mu       sync.RWMutex
 	services map[string]*Service
 	version  uint64
 
 	// onChange is called after every mutation, outside the write lock.
-	// The xDS server hooks into this to push fresh snapshots to all Envoys.
-	// Only one callback is supported — intentional, keeps the coupling simple.
-	onChange func()
+	// The xDS server hooks into this to push fresh snapshots to all Envoys,
+	// and the event hooks to see changes promptly. See OnChange.
+	onChange func(context.Context)
+
+	// validate, if set, vets every service passed to Add and Update.
+	validate func(*Service) error
+
+	// persist, if set, receives the full service list after every mutation.
+	persist Persister
+
+	// ownership decides whether a source may replace another's service.
+	ownership Ownership
+
+	// history holds the most recent changes, oldest first. See History.
+	history []Change
+}
+
+// Persister saves the registry's contents. Save is called with the write lock
+// held; if it fails the mutation is rolled back and the error returned.
+type Persister interface {
+	Save(services []*Service, history []Change) error
+}
+
+// ErrInvalid wraps errors from the validator set with SetValidator.
+var ErrInvalid = errors.New("invalid service")
+
+// ErrExists is returned by Add for a name that is taken.
+var ErrExists = errors.New("already exists")
+
+// ErrNotFound is returned for a name that isn't registered.
+var ErrNotFound = errors.New("not found")
+
+type dryRunKey struct{}
+
+// WithDryRun marks ctx so that Add, Remove, Update, Modify and Upsert made
+// with it check the change, and return what they would, without making it:
+// nothing is stored, recorded or persisted, and OnChange isn't called.
+func WithDryRun(ctx context.Context) context.Context {
+	return context.WithValue(ctx, dryRunKey{}, true)
+}
+
+func isDryRun(ctx context.Context) bool {
+	dry, _ := ctx.Value(dryRunKey{}).(bool)
+	return dry
 }
 
 func New() *Registry {
@@ -36,22 +820,140 @@ func New() *Registry {
 	}
 }
 
-// OnChange registers the function to be called after each registry mutation.
-func (r *Registry) OnChange(fn func()) {
+// OnChange registers a function to be called after each registry mutation,
+// after any registered before it. It receives the mutation's context, so
+// work it does (snapshot rebuilds) shows up in the same trace.
+func (r *Registry) OnChange(fn func(context.Context)) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	if prev := r.onChange; prev != nil {
+		r.onChange = func(ctx context.Context) {
+			prev(ctx)
+			fn(ctx)
+		}
+		return
+	}
 	r.onChange = fn
 }
 
-func (r *Registry) Add(svc *Service) error {
+// SetValidator registers a check that Add and Update run before storing a
+// service, for rules that depend on configuration the registry doesn't have.
+func (r *Registry) SetValidator(fn func(*Service) error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.validate = fn
+}
+
+// SetOwnership sets the policy for services registered by more than one
+// source. Update, Modify and Upsert refuse a change of source it doesn't
+// allow with ErrConflict.
+func (r *Registry) SetOwnership(o Ownership) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ownership = o
+}
+
+// SetPersister registers where mutations are written through to.
+func (r *Registry) SetPersister(p Persister) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.persist = p
+}
+
+// Restore loads previously persisted services and history without
+// validating, persisting or notifying. Call it before OnChange is wired up.
+func (r *Registry) Restore(services []*Service, history []Change) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, svc := range services {
+		r.services[svc.Name] = svc
+	}
+	r.history = history
+	// Continue numbering after the last recorded change, so versions in the
+	// history stay unique across restarts.
+	for _, c := range history {
+		r.version = max(r.version, c.Version)
+	}
+	r.version++
+}
+
+// Replace swaps the registry's contents for services and history another
+// instance persisted, and notifies like a mutation. Nothing is validated
+// or persisted. The version becomes the last change's, the version the
+// other instance is at.
+func (r *Registry) Replace(ctx context.Context, services []*Service, history []Change) {
+	r.mu.Lock()
+	r.services = make(map[string]*Service, len(services))
+	for _, svc := range services {
+		r.services[svc.Name] = svc
+	}
+	r.history = history
+	if len(history) > 0 {
+		r.version = history[len(history)-1].Version
+	}
+	cb := r.onChange
+	r.mu.Unlock()
+
+	if cb != nil {
+		cb(ctx)
+	}
+}
+
+// save writes the current contents through to the persister. Caller holds
+// the write lock.
+func (r *Registry) save() error {
+	if r.persist == nil {
+		return nil
+	}
+	out := make([]*Service, 0, len(r.services))
+	for _, svc := range r.services {
+		out = append(out, svc)
+	}
+	if err := r.persist.Save(out, r.history); err != nil {
+		return fmt.Errorf("persisting registry: %w", err)
+	}
+	return nil
+}
+
+func (r *Registry) check(svc *Service) error {
+	r.mu.RLock()
+	fn := r.validate
+	r.mu.RUnlock()
+	if fn == nil {
+		return nil
+	}
+	if err := fn(svc); err != nil {
+		return fmt.Errorf("%w %q: %v", ErrInvalid, svc.Name, err)
+	}
+	return nil
+}
+
+func (r *Registry) Add(ctx context.Context, svc *Service) (err error) {
+	ctx, span := startSpan(ctx, "registry.Add", svc.Name)
+	defer func() { endSpan(span, err) }()
+
+	if err := r.check(svc); err != nil {
+		return err
+	}
 	r.mu.Lock()
 
-	if _, exists := r.services[svc.Name]; exists {
+	if old, exists := r.services[svc.Name]; exists {
 		r.mu.Unlock()
-		return fmt.Errorf("service %q already exists", svc.Name)
+		return fmt.Errorf("service %q %w (registered by %s)", svc.Name, ErrExists, SourceOf(old))
+	}
+	if isDryRun(ctx) {
+		r.mu.Unlock()
+		return nil
 	}
 
 	r.services[svc.Name] = svc
+	undo := r.record(ctx, "add", r.version+1, nil, svc)
+	if err := r.save(); err != nil {
+		delete(r.services, svc.Name)
+		undo()
+		r.mu.Unlock()
+		return err
+	}
 	r.version++
 	cb := r.onChange
 	r.mu.Unlock()
@@ -60,51 +962,219 @@ func (r *Registry) Add(svc *Service) error {
 	// onChange triggers a snapshot rebuild which needs a read lock —
 	// calling it under the write lock would deadlock.
 	if cb != nil {
-		cb()
+		cb(ctx)
 	}
 	return nil
 }
 
-func (r *Registry) Remove(name string) error {
+func (r *Registry) Remove(ctx context.Context, name string) (err error) {
+	ctx, span := startSpan(ctx, "registry.Remove", name)
+	defer func() { endSpan(span, err) }()
+
 	r.mu.Lock()
 
-	if _, exists := r.services[name]; !exists {
+	old, exists := r.services[name]
+	if !exists {
 		r.mu.Unlock()
-		return fmt.Errorf("service %q not found", name)
+		return fmt.Errorf("service %q %w", name, ErrNotFound)
+	}
+	if isDryRun(ctx) {
+		r.mu.Unlock()
+		return nil
 	}
 
 	delete(r.services, name)
+	undo := r.record(ctx, "remove", r.version+1, old, nil)
+	if err := r.save(); err != nil {
+		r.services[name] = old
+		undo()
+		r.mu.Unlock()
+		return err
+	}
 	r.version++
 	cb := r.onChange
 	r.mu.Unlock()
 
 	if cb != nil {
-		cb()
+		cb(ctx)
 	}
 	return nil
 }
 
 // Update replaces an existing service. Useful when Docker labels change
 // or an agent re-registers with a different upstream.
-func (r *Registry) Update(svc *Service) error {
+func (r *Registry) Update(ctx context.Context, svc *Service) (err error) {
+	ctx, span := startSpan(ctx, "registry.Update", svc.Name)
+	defer func() { endSpan(span, err) }()
+
+	if err := r.check(svc); err != nil {
+		return err
+	}
 	r.mu.Lock()
 
-	if _, exists := r.services[svc.Name]; !exists {
+	old, exists := r.services[svc.Name]
+	if !exists {
+		r.mu.Unlock()
+		return fmt.Errorf("service %q %w", svc.Name, ErrNotFound)
+	}
+	if err := r.ownership.allows(old, svc); err != nil {
 		r.mu.Unlock()
-		return fmt.Errorf("service %q not found", svc.Name)
+		return err
+	}
+	if isDryRun(ctx) {
+		r.mu.Unlock()
+		return nil
 	}
 
 	r.services[svc.Name] = svc
+	undo := func() {}
+	if len(diffServices(old, svc)) > 0 {
+		// Re-registrations that change nothing (e.g. the Docker watcher's
+		// startup sync) would only bury real changes.
+		undo = r.record(ctx, "update", r.version+1, old, svc)
+	}
+	if err := r.save(); err != nil {
+		r.services[svc.Name] = old
+		undo()
+		r.mu.Unlock()
+		return err
+	}
+	r.version++
+	cb := r.onChange
+	r.mu.Unlock()
+
+	if cb != nil {
+		cb(ctx)
+	}
+	return nil
+}
+
+// Modify applies fn to a copy of the named service and stores the result,
+// atomically: nothing else can change the service in between. Use it for
+// partial changes instead of Get followed by Update. The copy shares slices
+// with the stored service, so fn must replace them rather than edit them.
+func (r *Registry) Modify(ctx context.Context, name string, fn func(*Service) error) (err error) {
+	ctx, span := startSpan(ctx, "registry.Modify", name)
+	defer func() { endSpan(span, err) }()
+
+	r.mu.Lock()
+	old, exists := r.services[name]
+	if !exists {
+		r.mu.Unlock()
+		return fmt.Errorf("service %q %w", name, ErrNotFound)
+	}
+	svc := *old
+	if err := fn(&svc); err != nil {
+		r.mu.Unlock()
+		return err
+	}
+	svc.Name = name
+	if err := r.ownership.allows(old, &svc); err != nil {
+		r.mu.Unlock()
+		return err
+	}
+	if r.validate != nil {
+		if err := r.validate(&svc); err != nil {
+			r.mu.Unlock()
+			return fmt.Errorf("%w %q: %v", ErrInvalid, name, err)
+		}
+	}
+	if isDryRun(ctx) {
+		r.mu.Unlock()
+		return nil
+	}
+
+	r.services[name] = &svc
+	undo := func() {}
+	if len(diffServices(old, &svc)) > 0 {
+		undo = r.record(ctx, "update", r.version+1, old, &svc)
+	}
+	if err := r.save(); err != nil {
+		r.services[name] = old
+		undo()
+		r.mu.Unlock()
+		return err
+	}
 	r.version++
 	cb := r.onChange
 	r.mu.Unlock()
 
 	if cb != nil {
-		cb()
+		cb(ctx)
 	}
 	return nil
 }
 
+// Upsert creates or replaces the named service, atomically. fn fills in a
+// copy of the stored service, or a zero Service if there is none. op is
+// what happened, as in the change history: "add", "update", or "" if the
+// result equals the stored service, in which case nothing is saved or
+// rebuilt, so converging repeatedly is cheap. Use it where the caller has
+// the desired state and doesn't care whether the service exists yet.
+func (r *Registry) Upsert(ctx context.Context, name string, fn func(*Service) error) (op string, err error) {
+	ctx, span := startSpan(ctx, "registry.Upsert", name)
+	defer func() { endSpan(span, err) }()
+
+	r.mu.Lock()
+	old, exists := r.services[name]
+	var svc Service
+	if exists {
+		svc = *old
+	}
+	if err := fn(&svc); err != nil {
+		r.mu.Unlock()
+		return "", err
+	}
+	svc.Name = name
+	if exists {
+		if err := r.ownership.allows(old, &svc); err != nil {
+			r.mu.Unlock()
+			return "", err
+		}
+	}
+	if r.validate != nil {
+		if err := r.validate(&svc); err != nil {
+			r.mu.Unlock()
+			return "", fmt.Errorf("%w %q: %v", ErrInvalid, name, err)
+		}
+	}
+
+	switch {
+	case !exists:
+		op = "add"
+	case len(diffServices(old, &svc)) > 0:
+		op = "update"
+	default:
+		// Already as desired: no new version, no rebuild.
+		r.mu.Unlock()
+		return "", nil
+	}
+	if isDryRun(ctx) {
+		r.mu.Unlock()
+		return op, nil
+	}
+	undo := r.record(ctx, op, r.version+1, old, &svc)
+	r.services[name] = &svc
+	if err := r.save(); err != nil {
+		if exists {
+			r.services[name] = old
+		} else {
+			delete(r.services, name)
+		}
+		undo()
+		r.mu.Unlock()
+		return "", err
+	}
+	r.version++
+	cb := r.onChange
+	r.mu.Unlock()
+
+	if cb != nil {
+		cb(ctx)
+	}
+	return op, nil
+}
+
 // Snapshot returns a copy of all services and the current version counter.
 // The version is monotonically increasing and used for xDS snapshot versioning.
 func (r *Registry) Snapshot() ([]*Service, uint64) {
@@ -118,3 +1188,30 @@ func (r *Registry) Snapshot() ([]*Service, uint64) {
 	}
 	return out, r.version
 }
+
+// Get returns a copy of the named service.
+func (r *Registry) Get(name string) (*Service, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	svc, ok := r.services[name]
+	if !ok {
+		return nil, false
+	}
+	cp := *svc
+	return &cp, true
+}
+
+var tracer = otel.Tracer("github.com/envoyage/envoyage/internal/registry")
+
+func startSpan(ctx context.Context, op, service string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, op, trace.WithAttributes(attribute.String("envoyage.service", service)))
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,172 @@
+// Package registrytest provides an in-memory store and helpers for testing
+// code that reads or changes the registry: discovery sources, API
+// handlers, hooks and other integrations.
+//
+//	reg, st := registrytest.New(t, registrytest.Service("web", "web.example.com", "10.0.0.5:80"))
+//	// ... exercise the code under test ...
+//	svc := registrytest.WaitService(t, reg, "api")
+//	if st.Saves() == 0 { ... }
+package registrytest
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/envoyage/envoyage/internal/registry"
+)
+
+// WaitTimeout bounds how long the Wait helpers wait.
+var WaitTimeout = 5 * time.Second
+
+// Store is an in-memory registry.Persister, standing in for store.File.
+// It keeps copies, so later changes to the registry don't show in what was
+// saved.
+type Store struct {
+	mu       sync.Mutex
+	services []*registry.Service
+	history  []registry.Change
+	saves    int
+	err      error
+}
+
+// NewStore creates a store holding services, as if saved earlier.
+func NewStore(services ...*registry.Service) *Store {
+	return &Store{services: clone(services)}
+}
+
+// Save implements registry.Persister. It fails with the error set with
+// SetErr, if any, which rolls the mutation back.
+func (s *Store) Save(services []*registry.Service, history []registry.Change) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.services = clone(services)
+	s.history = append([]registry.Change(nil), history...)
+	s.saves++
+	return nil
+}
+
+// Load returns what was saved last, as store.File.Load does, for
+// registry.Registry.Restore: a restart.
+func (s *Store) Load() ([]*registry.Service, []registry.Change, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return clone(s.services), append([]registry.Change(nil), s.history...), nil
+}
+
+// Saves returns how many times Save succeeded.
+func (s *Store) Saves() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.saves
+}
+
+// SetErr makes Save fail with err, or succeed again with nil, like a full
+// disk.
+func (s *Store) SetErr(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+// clone deep-copies services through their JSON form, which is how they
+// are stored.
+func clone(services []*registry.Service) []*registry.Service {
+	data, err := json.Marshal(services)
+	if err != nil {
+		panic(err)
+	}
+	var out []*registry.Service
+	if err := json.Unmarshal(data, &out); err != nil {
+		panic(err)
+	}
+	return out
+}
+
+// New creates a registry writing through to a fresh Store, with services
+// added through the API, and returns both. It fails tb if one is invalid.
+func New(tb testing.TB, services ...*registry.Service) (*registry.Registry, *Store) {
+	tb.Helper()
+	reg := registry.New()
+	st := NewStore()
+	reg.SetPersister(st)
+	for _, svc := range services {
+		if err := reg.Add(context.Background(), svc); err != nil {
+			tb.Fatalf("adding service %q: %v", svc.Name, err)
+		}
+	}
+	return reg, st
+}
+
+// Service returns a minimal valid HTTP service registered through the API.
+func Service(name, domain, upstream string) *registry.Service {
+	return &registry.Service{
+		Name:     name,
+		Domain:   domain,
+		Upstream: upstream,
+		Source:   registry.SourceAPI,
+	}
+}
+
+// MustGet returns the named service, failing tb if it isn't registered.
+func MustGet(tb testing.TB, reg *registry.Registry, name string) *registry.Service {
+	tb.Helper()
+	svc, ok := reg.Get(name)
+	if !ok {
+		tb.Fatalf("service %q is not registered", name)
+	}
+	return svc
+}
+
+// WaitService waits for the named service to be registered, for changes
+// made in the background, e.g. by a watcher, and returns it. It fails tb
+// after WaitTimeout.
+func WaitService(tb testing.TB, reg *registry.Registry, name string) *registry.Service {
+	tb.Helper()
+	var svc *registry.Service
+	Wait(tb, reg, "service "+name+" registered", func(reg *registry.Registry) bool {
+		var ok bool
+		svc, ok = reg.Get(name)
+		return ok
+	})
+	return svc
+}
+
+// WaitRemoved waits for the named service to be gone, failing tb after
+// WaitTimeout.
+func WaitRemoved(tb testing.TB, reg *registry.Registry, name string) {
+	tb.Helper()
+	Wait(tb, reg, "service "+name+" removed", func(reg *registry.Registry) bool {
+		_, ok := reg.Get(name)
+		return !ok
+	})
+}
+
+// Wait polls cond until it holds, failing tb with what if it doesn't within
+// WaitTimeout.
+func Wait(tb testing.TB, reg *registry.Registry, what string, cond func(*registry.Registry) bool) {
+	tb.Helper()
+	deadline := time.Now().Add(WaitTimeout)
+	for !cond(reg) {
+		if time.Now().After(deadline) {
+			tb.Fatalf("timed out after %s waiting for %s", WaitTimeout, what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// LastChange returns the newest change to the named service, failing tb if
+// there is none.
+func LastChange(tb testing.TB, reg *registry.Registry, name string) registry.Change {
+	tb.Helper()
+	changes := reg.History(name)
+	if len(changes) == 0 {
+		tb.Fatalf("no changes to service %q", name)
+	}
+	return changes[len(changes)-1]
+}
@@ -0,0 +1,62 @@
+package registrytest_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/envoyage/envoyage/internal/registry"
+	"github.com/envoyage/envoyage/internal/registry/registrytest"
+)
+
+func TestStoreWritesThrough(t *testing.T) {
+	reg, st := registrytest.New(t, registrytest.Service("web", "web.example.com", "10.0.0.5:80"))
+	if st.Saves() != 1 {
+		t.Fatalf("saves = %d, want 1", st.Saves())
+	}
+
+	// A change to the registry after the save doesn't reach what was saved.
+	svc := registrytest.MustGet(t, reg, "web")
+	svc.Upstream = "10.0.0.6:80"
+	if err := reg.Update(context.Background(), svc); err != nil {
+		t.Fatal(err)
+	}
+	svc.Upstream = "10.0.0.7:80"
+
+	// A restart restores what was saved last.
+	services, history, err := st.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restarted := registry.New()
+	restarted.Restore(services, history)
+	if got := registrytest.MustGet(t, restarted, "web").Upstream; got != "10.0.0.6:80" {
+		t.Errorf("restored upstream = %q, want 10.0.0.6:80", got)
+	}
+	if got := registrytest.LastChange(t, restarted, "web").Op; got != "update" {
+		t.Errorf("last change = %q, want update", got)
+	}
+}
+
+func TestStoreErrRollsBack(t *testing.T) {
+	reg, st := registrytest.New(t)
+	full := errors.New("disk full")
+	st.SetErr(full)
+	if err := reg.Add(context.Background(), registrytest.Service("web", "web.example.com", "10.0.0.5:80")); !errors.Is(err, full) {
+		t.Fatalf("Add = %v, want %v", err, full)
+	}
+	if _, ok := reg.Get("web"); ok {
+		t.Error("service registered although saving it failed")
+	}
+
+	st.SetErr(nil)
+	if err := reg.Add(context.Background(), registrytest.Service("web", "web.example.com", "10.0.0.5:80")); err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.Remove(context.Background(), "web"); err != nil {
+		t.Fatal(err)
+	}
+	if st.Saves() != 2 {
+		t.Errorf("saves = %d, want 2", st.Saves())
+	}
+}
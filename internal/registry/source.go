@@ -0,0 +1,77 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// Sources a service can be registered by, stored in Service.Source.
+const (
+	SourceAPI        = "api"
+	SourceFile       = "file"
+	SourceKubernetes = "kubernetes"
+	SourceDocker     = "docker"
+)
+
+// Conflict policies: what happens when a source registers a service name
+// another source already owns.
+const (
+	// ConflictPrecedence lets a source take over services of sources that
+	// come after it in Ownership.Precedence, and refuses the others.
+	ConflictPrecedence = "precedence"
+	// ConflictFirst keeps a service with the source that registered it
+	// until it is removed.
+	ConflictFirst = "first"
+	// ConflictLast lets every source take over, so the last write wins.
+	ConflictLast = "last"
+)
+
+// ErrConflict is returned when the ownership policy refuses to let a
+// source replace another source's service.
+var ErrConflict = errors.New("service is owned by another source")
+
+// Ownership decides which source keeps a service name that several
+// register. The zero value lets the last write win.
+type Ownership struct {
+	Policy string
+
+	// Precedence lists sources from strongest to weakest, for
+	// ConflictPrecedence. Sources not listed are weaker than all others.
+	Precedence []string
+}
+
+// SourceOf returns the source that owns svc. Services stored before
+// sources were recorded, and those built without one, belong to the API.
+func SourceOf(svc *Service) string {
+	if svc.Source == "" {
+		return SourceAPI
+	}
+	return svc.Source
+}
+
+// allows returns ErrConflict if next, registered by its source, may not
+// replace old.
+func (o Ownership) allows(old, next *Service) error {
+	have, want := SourceOf(old), SourceOf(next)
+	if have == want {
+		return nil
+	}
+	switch o.Policy {
+	case ConflictFirst:
+	case ConflictPrecedence:
+		if rank(o.Precedence, want) <= rank(o.Precedence, have) {
+			return nil
+		}
+	default:
+		return nil
+	}
+	return fmt.Errorf("%w: %q is registered by %s, which %s does not override", ErrConflict, old.Name, have, want)
+}
+
+func rank(precedence []string, source string) int {
+	if i := slices.Index(precedence, source); i >= 0 {
+		return i
+	}
+	return len(precedence)
+}
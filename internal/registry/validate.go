@@ -0,0 +1,959 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// ParseBasicAuth parses an htpasswd-style user list as accepted by the
+// envoyage.basic_auth label and the management API: entries of the form
+// "user:{SHA}base64hash", separated by commas or newlines.
+//
+// Only the {SHA} scheme is accepted because it is the only one Envoy's
+// basic_auth filter understands. Generate entries with:
+//
+//	htpasswd -nbs alice 's3cret'
+func ParseBasicAuth(s string) ([]string, error) {
+	var users []string
+	seen := make(map[string]bool)
+
+	for _, entry := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == '\n' }) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		user, hash, ok := strings.Cut(entry, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("basic auth entry %q: expected user:{SHA}hash", entry)
+		}
+		b64, ok := strings.CutPrefix(hash, "{SHA}")
+		if !ok {
+			return nil, fmt.Errorf("basic auth entry for %q: only {SHA} hashes are supported", user)
+		}
+		if raw, err := base64.StdEncoding.DecodeString(b64); err != nil || len(raw) != 20 {
+			return nil, fmt.Errorf("basic auth entry for %q: malformed SHA1 hash", user)
+		}
+		if seen[user] {
+			return nil, fmt.Errorf("basic auth: duplicate user %q", user)
+		}
+		seen[user] = true
+		users = append(users, user+":"+hash)
+	}
+	return users, nil
+}
+
+// virtualClusterName restricts names to characters that are safe inside an
+// Envoy stat name (vhost.<svc>.vcluster.<name>.*).
+var virtualClusterName = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// ParseVirtualClusters parses the envoyage.virtual_clusters label format:
+// comma-separated name=pattern pairs, e.g. "api=/api/*,ws=/ws".
+func ParseVirtualClusters(s string) ([]VirtualCluster, error) {
+	var out []VirtualCluster
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, pattern, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("virtual cluster %q: expected name=pattern", entry)
+		}
+		out = append(out, VirtualCluster{
+			Name:    strings.TrimSpace(name),
+			Pattern: strings.TrimSpace(pattern),
+		})
+	}
+	if err := ValidateVirtualClusters(out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ValidateVirtualClusters checks names and patterns of virtual clusters.
+func ValidateVirtualClusters(vcs []VirtualCluster) error {
+	seen := make(map[string]bool)
+	for _, vc := range vcs {
+		if !virtualClusterName.MatchString(vc.Name) {
+			return fmt.Errorf("virtual cluster name %q: only letters, digits, '_' and '-' are allowed", vc.Name)
+		}
+		if seen[vc.Name] {
+			return fmt.Errorf("duplicate virtual cluster %q", vc.Name)
+		}
+		seen[vc.Name] = true
+		if !strings.HasPrefix(vc.Pattern, "/") {
+			return fmt.Errorf("virtual cluster %q: pattern %q must start with '/'", vc.Name, vc.Pattern)
+		}
+		if i := strings.IndexByte(vc.Pattern, '*'); i >= 0 && i != len(vc.Pattern)-1 {
+			return fmt.Errorf("virtual cluster %q: '*' is only allowed at the end of a pattern", vc.Name)
+		}
+	}
+	return nil
+}
+
+// ValidateNodes checks a service's node list.
+func ValidateNodes(nodes []string) error {
+	seen := make(map[string]bool)
+	for _, id := range nodes {
+		if strings.TrimSpace(id) == "" {
+			return fmt.Errorf("empty node ID")
+		}
+		if seen[id] {
+			return fmt.Errorf("duplicate node %q", id)
+		}
+		seen[id] = true
+	}
+	return nil
+}
+
+// ValidateOrigins checks a service's edge copies: one upstream per node.
+func ValidateOrigins(origins []Origin) error {
+	seen := make(map[string]bool)
+	for _, o := range origins {
+		if strings.TrimSpace(o.Node) == "" {
+			return fmt.Errorf("empty node ID")
+		}
+		if seen[o.Node] {
+			return fmt.Errorf("duplicate node %q", o.Node)
+		}
+		seen[o.Node] = true
+		if err := ValidateUpstream(o.Upstream); err != nil {
+			return fmt.Errorf("node %q: %w", o.Node, err)
+		}
+	}
+	return nil
+}
+
+// ValidateJWT checks a service's JWT requirement. A nil requirement is valid.
+func ValidateJWT(j *JWT) error {
+	if j == nil {
+		return nil
+	}
+	if j.Issuer == "" {
+		return fmt.Errorf("jwt: issuer is required")
+	}
+	u, err := url.Parse(j.JWKSURI)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("jwt: jwks_uri %q must be an absolute http(s) URL", j.JWKSURI)
+	}
+	for _, aud := range j.Audiences {
+		if aud == "" {
+			return fmt.Errorf("jwt: empty audience")
+		}
+	}
+	return nil
+}
+
+// headerName accepts RFC 7230 token characters.
+var headerName = regexp.MustCompile("^[!#$%&'*+.^_`|~0-9A-Za-z-]+$")
+
+// ValidateHeaderRules checks header names. Pseudo-headers cannot be touched,
+// and Host may only be set on requests (it becomes a host rewrite).
+// A nil rule set is valid.
+func ValidateHeaderRules(h *HeaderRules) error {
+	if h == nil {
+		return nil
+	}
+	check := func(dir, op, name string, hostOK bool) error {
+		if !headerName.MatchString(name) {
+			return fmt.Errorf("%s header %s: invalid name %q", dir, op, name)
+		}
+		if strings.EqualFold(name, "host") && !hostOK {
+			return fmt.Errorf("%s header %s: host can only be set on requests", dir, op)
+		}
+		return nil
+	}
+	for _, d := range []struct {
+		dir string
+		ops HeaderOps
+	}{{"request", h.Request}, {"response", h.Response}} {
+		for _, hdr := range d.ops.Set {
+			if err := check(d.dir, "set", hdr.Name, d.dir == "request"); err != nil {
+				return err
+			}
+		}
+		for _, hdr := range d.ops.Add {
+			if err := check(d.dir, "add", hdr.Name, false); err != nil {
+				return err
+			}
+		}
+		for _, name := range d.ops.Remove {
+			if err := check(d.dir, "remove", name, false); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+var hostLabelRe = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?$`)
+
+// ValidateDomain checks that domain is a host name as in RFC 1123:
+// dot-separated labels of letters, digits and inner hyphens, at most 63
+// characters each and 253 in all. A leading "*." wildcard is accepted if
+// wildcard is set.
+func ValidateDomain(domain string, wildcard bool) error {
+	host := domain
+	if rest, ok := strings.CutPrefix(host, "*."); ok && wildcard {
+		host = rest
+	}
+	if host == "" || len(host) > 253 {
+		return fmt.Errorf("invalid domain %q", domain)
+	}
+	for _, label := range strings.Split(host, ".") {
+		if len(label) > 63 || !hostLabelRe.MatchString(label) {
+			return fmt.Errorf("invalid domain %q", domain)
+		}
+	}
+	return nil
+}
+
+// ValidateUpstream checks that addr is host:port, with a host name or IP
+// address and a port from 1 to 65535.
+func ValidateUpstream(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("upstream %q must be host:port", addr)
+	}
+	if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+		return fmt.Errorf("upstream %q: invalid port", addr)
+	}
+	if net.ParseIP(host) == nil && ValidateDomain(host, false) != nil {
+		return fmt.Errorf("upstream %q: invalid host", addr)
+	}
+	return nil
+}
+
+// ParseAliases parses the envoyage.aliases label format: comma-separated
+// domain=[host]path entries, e.g.
+// "photos.example.com=/photos,dav.example.com=files.internal/remote.php/dav".
+// A bare domain keeps path and Host. domain is the service's own.
+func ParseAliases(domain, s string) ([]Alias, error) {
+	var out []Alias
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		domain, target, _ := strings.Cut(entry, "=")
+		a := Alias{Domain: strings.TrimSpace(domain)}
+		target = strings.TrimSpace(target)
+		if i := strings.IndexByte(target, '/'); i >= 0 {
+			a.Host, a.PathPrefix = target[:i], target[i:]
+		} else {
+			a.Host = target
+		}
+		if a.PathPrefix == "/" {
+			a.PathPrefix = ""
+		}
+		out = append(out, a)
+	}
+	if err := ValidateAliases(domain, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ValidateAliases checks a service's aliases against each other and its
+// own domain.
+func ValidateAliases(domain string, aliases []Alias) error {
+	seen := map[string]bool{strings.ToLower(domain): true}
+	for _, a := range aliases {
+		d := strings.ToLower(a.Domain)
+		if err := ValidateDomain(a.Domain, false); err != nil {
+			return fmt.Errorf("aliases: %w", err)
+		}
+		if seen[d] {
+			return fmt.Errorf("aliases: domain %q is used twice", a.Domain)
+		}
+		seen[d] = true
+		if a.PathPrefix != "" && (!strings.HasPrefix(a.PathPrefix, "/") || strings.ContainsAny(a.PathPrefix, "?# ")) {
+			return fmt.Errorf("aliases: %s: path_prefix %q must be a path starting with /", a.Domain, a.PathPrefix)
+		}
+		if strings.ContainsAny(a.Host, "/ ") {
+			return fmt.Errorf("aliases: %s: invalid host %q", a.Domain, a.Host)
+		}
+	}
+	return nil
+}
+
+// mountPath matches the paths a Mount accepts: "/" or segments of URL path
+// characters, without a trailing slash. They end up in Envoy route matches
+// and in a Lua string, so nothing that needs escaping.
+var mountPath = regexp.MustCompile(`^(/|(/[A-Za-z0-9._~!$&'()*+,;=:@%-]+)+)$`)
+
+// ParseMount parses the envoyage.mount label format: the public path
+// prefix, optionally followed by "=" and the upstream's base path, e.g.
+// "/grafana" or "/wiki=/app".
+func ParseMount(s string) (*Mount, error) {
+	prefix, upstream, _ := strings.Cut(s, "=")
+	m := &Mount{PathPrefix: strings.TrimSpace(prefix), UpstreamPath: strings.TrimSpace(upstream)}
+	if err := ValidateMount(m, nil); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ValidateMount checks a service's mount against its aliases. A nil mount
+// is valid.
+//
+// Aliases can't map to a path of their own under a mount: their requests
+// would reach the upstream under two base paths, and only one can be
+// mapped back.
+func ValidateMount(m *Mount, aliases []Alias) error {
+	if m == nil {
+		return nil
+	}
+	switch {
+	case m.PathPrefix == "":
+		return fmt.Errorf("mount: path_prefix is required")
+	case m.PathPrefix == "/" || !mountPath.MatchString(m.PathPrefix):
+		return fmt.Errorf("mount: path_prefix %q must be a path below / without a trailing slash, e.g. /grafana", m.PathPrefix)
+	case m.UpstreamPath != "" && !mountPath.MatchString(m.UpstreamPath):
+		return fmt.Errorf("mount: upstream_path %q must be a path without a trailing slash, e.g. /app", m.UpstreamPath)
+	}
+	for _, a := range aliases {
+		if a.PathPrefix != "" {
+			return fmt.Errorf("mount: alias %s has a path_prefix, which a mounted service can't have", a.Domain)
+		}
+	}
+	return nil
+}
+
+// ValidateCache checks a service's cache rules. A nil cache is valid.
+func ValidateCache(c *Cache) error {
+	if c == nil {
+		return nil
+	}
+	// Cookie names are tokens, like header names.
+	for _, name := range c.BypassCookies {
+		if !headerName.MatchString(name) {
+			return fmt.Errorf("cache: invalid cookie name %q", name)
+		}
+	}
+	for _, name := range append(slices.Clone(c.BypassHeaders), c.PrivateHeaders...) {
+		if !headerName.MatchString(name) {
+			return fmt.Errorf("cache: invalid header name %q", name)
+		}
+	}
+	return nil
+}
+
+// ParsePortRange reads a TCP port range, "27015-27020" or a single
+// "25565".
+func ParsePortRange(s string) (*TCPForward, error) {
+	first, last, isRange := strings.Cut(strings.TrimSpace(s), "-")
+	if !isRange {
+		last = first
+	}
+	a, err := strconv.ParseUint(strings.TrimSpace(first), 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port range %q", s)
+	}
+	b, err := strconv.ParseUint(strings.TrimSpace(last), 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port range %q", s)
+	}
+	return &TCPForward{FirstPort: uint32(a), LastPort: uint32(b)}, nil
+}
+
+// ValidateTCP checks a TCP service: its port range, and that it sets
+// nothing that only means something for HTTP. A service without TCP is
+// valid.
+func ValidateTCP(svc *Service) error {
+	t := svc.TCP
+	if t == nil {
+		return nil
+	}
+	switch {
+	case t.FirstPort == 0 || t.LastPort < t.FirstPort:
+		return fmt.Errorf("tcp: invalid port range %s", t)
+	case t.LastPort-t.FirstPort >= MaxTCPPorts:
+		return fmt.Errorf("tcp: %s is more than %d ports", t, MaxTCPPorts)
+	}
+	if svc.Upstream == "" {
+		return fmt.Errorf("tcp: upstream is required")
+	}
+	if _, port, err := net.SplitHostPort(svc.Upstream); err == nil {
+		if p, err := strconv.ParseUint(port, 10, 16); err == nil && p+uint64(t.LastPort-t.FirstPort) > 65535 {
+			return fmt.Errorf("tcp: upstream ports from %d run past 65535", p)
+		}
+	}
+
+	var http []string
+	for field, set := range map[string]bool{
+		"domain":           svc.Domain != "",
+		"aliases":          len(svc.Aliases) > 0,
+		"mount":            svc.Mount != nil,
+		"ext_authz":        svc.ExtAuthz,
+		"basic_auth":       len(svc.BasicAuth) > 0,
+		"virtual_clusters": len(svc.VirtualClusters) > 0,
+		"jwt":              svc.JWT != nil,
+		"challenge":        svc.Challenge,
+		"headers":          svc.Headers != nil,
+		"host_rewrite":     svc.HostRewrite != "",
+		"forward_proxy":    svc.ForwardProxy != nil,
+		"concurrency":      svc.Concurrency != nil,
+		"affinity":         svc.Affinity != nil,
+		"lb_policy":        svc.LBPolicy != "",
+		"shadow":           svc.Shadow != nil,
+		"failover":         svc.Failover != "",
+		"origins":          len(svc.Origins) > 0,
+		"wasm":             len(svc.Wasm) > 0,
+		"filter_config":    len(svc.FilterConfig) > 0,
+		"route_metadata":   len(svc.RouteMetadata) > 0,
+		"rate_limit":       svc.RateLimit != 0,
+		"max_body_bytes":   svc.MaxBodyBytes != 0,
+		"streaming":        svc.Streaming,
+		"cache":            svc.Cache != nil,
+		"client_cert":      svc.ClientCert != nil,
+		"tls":              svc.TLS != nil,
+	} {
+		if set {
+			http = append(http, field)
+		}
+	}
+	if len(http) > 0 {
+		slices.Sort(http)
+		return fmt.Errorf("tcp: can't be combined with %s, which are for HTTP services", strings.Join(http, ", "))
+	}
+	return nil
+}
+
+// ValidateRedirect checks a redirect service: its target, status, and that
+// it sets nothing that needs an upstream. A service without Redirect is
+// valid.
+func ValidateRedirect(svc *Service) error {
+	r := svc.Redirect
+	if r == nil {
+		return nil
+	}
+	u, err := url.Parse(r.URL)
+	switch {
+	case err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "":
+		return fmt.Errorf("redirect: url must be an absolute http:// or https:// URL")
+	case u.Fragment != "":
+		return fmt.Errorf("redirect: url can't have a fragment")
+	case r.PreservePath && u.RawQuery != "":
+		return fmt.Errorf("redirect: url can't have a query when preserve_path keeps the request's")
+	case r.Status != 0 && !slices.Contains(RedirectStatuses, r.Status):
+		return fmt.Errorf("redirect: status must be 301, 302, 307 or 308")
+	case svc.TCP != nil:
+		return fmt.Errorf("redirect: a TCP forward can't be a redirect")
+	}
+
+	if fields := upstreamFields(svc); len(fields) > 0 {
+		return fmt.Errorf("redirect: can't be combined with %s, which are for services with an upstream", strings.Join(fields, ", "))
+	}
+	return nil
+}
+
+// ValidateStatic checks a static service: its status, content types and
+// files, and that it sets nothing that needs an upstream. A service
+// without Static is valid.
+func ValidateStatic(svc *Service) error {
+	st := svc.Static
+	if st == nil {
+		return nil
+	}
+	switch {
+	case st.Status != 0 && (st.Status < 200 || st.Status > 599):
+		return fmt.Errorf("static: status must be between 200 and 599")
+	case len(st.Body) > MaxPageBytes:
+		return fmt.Errorf("static: body is over %d KiB", MaxPageBytes>>10)
+	case svc.TCP != nil:
+		return fmt.Errorf("static: a TCP forward can't be static")
+	case svc.Redirect != nil:
+		return fmt.Errorf("static: can't be combined with redirect")
+	}
+	if err := validateContentType(st.ContentType); err != nil {
+		return fmt.Errorf("static: %w", err)
+	}
+	seen := make(map[string]bool, len(st.Files))
+	for _, f := range st.Files {
+		switch {
+		case !strings.HasPrefix(f.Path, "/") || strings.ContainsAny(f.Path, "?#") || strings.ContainsFunc(f.Path, unicode.IsSpace):
+			return fmt.Errorf("static: file path %q must be an absolute path without a query", f.Path)
+		case seen[f.Path]:
+			return fmt.Errorf("static: file %s is listed twice", f.Path)
+		case len(f.Body) > MaxPageBytes:
+			return fmt.Errorf("static: file %s is over %d KiB", f.Path, MaxPageBytes>>10)
+		}
+		if err := validateContentType(f.ContentType); err != nil {
+			return fmt.Errorf("static: file %s: %w", f.Path, err)
+		}
+		seen[f.Path] = true
+	}
+	if fields := upstreamFields(svc); len(fields) > 0 {
+		return fmt.Errorf("static: can't be combined with %s, which are for services with an upstream", strings.Join(fields, ", "))
+	}
+	return nil
+}
+
+// validateContentType checks a Content-Type to send. An empty one is
+// valid.
+func validateContentType(ct string) error {
+	if ct == "" {
+		return nil
+	}
+	if _, _, err := mime.ParseMediaType(ct); err != nil {
+		return fmt.Errorf("content type %q is invalid", ct)
+	}
+	return nil
+}
+
+// upstreamFields returns the API names of the fields svc sets that only
+// make sense with an upstream, sorted, for the services Envoy answers
+// itself.
+func upstreamFields(svc *Service) []string {
+	var fields []string
+	for field, set := range map[string]bool{
+		"upstream":         svc.Upstream != "",
+		"aliases":          len(svc.Aliases) > 0,
+		"mount":            svc.Mount != nil,
+		"ext_authz":        svc.ExtAuthz,
+		"basic_auth":       len(svc.BasicAuth) > 0,
+		"virtual_clusters": len(svc.VirtualClusters) > 0,
+		"jwt":              svc.JWT != nil,
+		"headers":          svc.Headers != nil,
+		"host_rewrite":     svc.HostRewrite != "",
+		"forward_proxy":    svc.ForwardProxy != nil,
+		"health_check":     svc.HealthCheck != nil,
+		"concurrency":      svc.Concurrency != nil,
+		"affinity":         svc.Affinity != nil,
+		"lb_policy":        svc.LBPolicy != "",
+		"dns":              svc.DNS != nil,
+		"shadow":           svc.Shadow != nil,
+		"failover":         svc.Failover != "",
+		"origins":          len(svc.Origins) > 0,
+		"wasm":             len(svc.Wasm) > 0,
+		"max_body_bytes":   svc.MaxBodyBytes != 0,
+		"streaming":        svc.Streaming,
+		"cache":            svc.Cache != nil,
+		"client_cert":      svc.ClientCert != nil,
+	} {
+		if set {
+			fields = append(fields, field)
+		}
+	}
+	slices.Sort(fields)
+	return fields
+}
+
+// ValidateHostRewrite checks a service's host rewrite: HostRewriteAuto or a
+// host, with an optional port, and nothing else that sets Host.
+func ValidateHostRewrite(svc *Service) error {
+	h := svc.HostRewrite
+	if h == "" {
+		return nil
+	}
+	switch {
+	case h != HostRewriteAuto && (strings.ContainsAny(h, "/?#@,") || strings.ContainsFunc(h, unicode.IsSpace)):
+		return fmt.Errorf("host_rewrite: invalid host %q: want %q or a host, with an optional port", h, HostRewriteAuto)
+	case svc.ForwardProxy != nil:
+		return fmt.Errorf("host_rewrite: forward proxies send each request to the host it names")
+	case svc.Headers != nil && slices.ContainsFunc(svc.Headers.Request.Set, func(hd Header) bool { return strings.EqualFold(hd.Name, "host") }):
+		return fmt.Errorf("host_rewrite: can't be combined with a Host header rule, which sets it too")
+	}
+	return nil
+}
+
+// ValidateForwardProxy checks a forward proxy's allowlist. A nil proxy is
+// valid.
+func ValidateForwardProxy(fp *ForwardProxy) error {
+	if fp == nil {
+		return nil
+	}
+	if len(fp.Allow) == 0 {
+		return fmt.Errorf("forward_proxy: allow must list at least one destination")
+	}
+	for _, entry := range fp.Allow {
+		if _, _, _, err := ParseForwardProxyAllow(entry); err != nil {
+			return fmt.Errorf("forward_proxy: %w", err)
+		}
+	}
+	return nil
+}
+
+// ValidateCanary checks a canary split and its analysis thresholds. A nil
+// canary is valid.
+func ValidateCanary(c *Canary) error {
+	if c == nil {
+		return nil
+	}
+	if err := ValidateUpstream(c.Upstream); err != nil {
+		return fmt.Errorf("canary: %w", err)
+	}
+	if c.Weight < 0 || c.Weight > 100 {
+		return fmt.Errorf("canary: weight must be between 0 and 100")
+	}
+	a := c.Analysis
+	if a == nil {
+		return nil
+	}
+	if a.Step < 1 || a.Step > 100 {
+		return fmt.Errorf("canary: analysis step must be between 1 and 100")
+	}
+	if a.Interval < 10*time.Second {
+		return fmt.Errorf("canary: analysis interval must be at least 10s")
+	}
+	if a.MaxErrorRateIncrease < 0 || a.MaxErrorRateIncrease > 1 {
+		return fmt.Errorf("canary: max error rate increase must be between 0 and 1")
+	}
+	if a.MaxLatencyRatio != 0 && a.MaxLatencyRatio < 1 {
+		return fmt.Errorf("canary: max latency ratio must be 0 (off) or at least 1")
+	}
+	return nil
+}
+
+// ValidateMaintenancePage checks a maintenance page. A nil one is valid.
+func ValidateMaintenancePage(p *MaintenancePage) error {
+	if p == nil {
+		return nil
+	}
+	if len(p.Body) > MaxPageBytes {
+		return fmt.Errorf("maintenance: page is over %d KiB", MaxPageBytes>>10)
+	}
+	if p.RetryAfter < 0 || p.RetryAfter%time.Second != 0 {
+		return fmt.Errorf("maintenance: retry_after must be a whole number of seconds")
+	}
+	return nil
+}
+
+// MaxScheduleDuration bounds how long a schedule rule lasts each time.
+const MaxScheduleDuration = 7 * 24 * time.Hour
+
+// ValidateSchedule checks a service's schedule rules; tcp is whether the
+// service is a TCP forward, which has no maintenance page.
+func ValidateSchedule(rules []ScheduleRule, tcp bool) error {
+	for i, r := range rules {
+		c, err := ParseCron(r.Cron)
+		if err != nil {
+			return fmt.Errorf("schedule[%d]: %w", i, err)
+		}
+		if c.Next(time.Now()).IsZero() {
+			return fmt.Errorf("schedule[%d]: cron %q never matches", i, r.Cron)
+		}
+		if r.Duration < time.Minute || r.Duration > MaxScheduleDuration {
+			return fmt.Errorf("schedule[%d]: duration must be from 1m to %s", i, MaxScheduleDuration)
+		}
+		if !slices.Contains(ScheduleActions, r.Action) {
+			return fmt.Errorf("schedule[%d]: action must be one of %s", i, strings.Join(ScheduleActions, ", "))
+		}
+		if r.Action == ScheduleMaintenance && tcp {
+			return fmt.Errorf("schedule[%d]: TCP forwards have no maintenance page", i)
+		}
+	}
+	return nil
+}
+
+// ValidateMirror checks a request mirror. A nil one is valid.
+func ValidateMirror(m *Mirror) error {
+	if m == nil {
+		return nil
+	}
+	if err := ValidateUpstream(m.Target); err != nil {
+		return fmt.Errorf("mirror: target: %w", err)
+	}
+	if m.Percent <= 0 || m.Percent > 100 {
+		return fmt.Errorf("mirror: percent must be above 0 and at most 100")
+	}
+	if m.Expires.IsZero() {
+		return fmt.Errorf("mirror: an expiry is required")
+	}
+	return nil
+}
+
+// ValidateShadow checks the shadow of the service named name, if known.
+// Whether the other service exists is up to lint: it may be registered
+// later. A nil shadow is valid.
+func ValidateShadow(name string, s *Shadow) error {
+	if s == nil {
+		return nil
+	}
+	if s.Service == "" {
+		return fmt.Errorf("shadow: service is required")
+	}
+	if s.Service == name {
+		return fmt.Errorf("shadow: a service can't shadow itself")
+	}
+	if s.Percent <= 0 || s.Percent > 100 {
+		return fmt.Errorf("shadow: percent must be above 0 and at most 100")
+	}
+	return nil
+}
+
+// ValidateDependsOn checks the dependencies of the service named name.
+// Whether they exist is up to lint, as for ValidateShadow.
+func ValidateDependsOn(name string, deps []string) error {
+	seen := make(map[string]bool)
+	for _, dep := range deps {
+		switch {
+		case strings.TrimSpace(dep) == "":
+			return fmt.Errorf("empty service name")
+		case dep == name:
+			return fmt.Errorf("a service can't depend on itself")
+		case seen[dep]:
+			return fmt.Errorf("duplicate dependency %q", dep)
+		}
+		seen[dep] = true
+	}
+	return nil
+}
+
+// ValidateWasm checks a service's Wasm filters. Whether their modules are
+// uploaded is up to lint, as they may be uploaded after the service is
+// registered.
+func ValidateWasm(filters []WasmFilter) error {
+	type key struct {
+		module, rootID, config string
+		edge                   bool
+	}
+	seen := make(map[key]bool)
+	for _, f := range filters {
+		if strings.TrimSpace(f.Module) == "" {
+			return fmt.Errorf("wasm: module is required")
+		}
+		k := key{f.Module, f.RootID, f.Config, f.Edge}
+		if seen[k] {
+			return fmt.Errorf("wasm: module %q listed twice with the same config and node", f.Module)
+		}
+		seen[k] = true
+	}
+	return nil
+}
+
+// WasmConfig is the text a Wasm plugin gets for raw, a config as
+// accepted by the management API and the envoyage.wasm label: a JSON
+// string as is, any other JSON value compacted.
+func WasmConfig(raw json.RawMessage) (string, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return "", nil
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s, nil
+	}
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, raw); err != nil {
+		return "", fmt.Errorf("wasm: config: %w", err)
+	}
+	return compact.String(), nil
+}
+
+// ParseWasmFilters reads Wasm filters as the envoyage.wasm label holds
+// them: a JSON array of objects in the management API's form, e.g.
+// [{"module": "geoblock", "config": {"allow": ["DE"]}, "edge": true}].
+func ParseWasmFilters(s string) ([]WasmFilter, error) {
+	var raw []struct {
+		Module   string          `json:"module"`
+		RootID   string          `json:"root_id"`
+		Config   json.RawMessage `json:"config"`
+		Edge     bool            `json:"edge"`
+		FailOpen bool            `json:"fail_open"`
+	}
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&raw); err != nil {
+		return nil, fmt.Errorf("want a JSON array of filters: %w", err)
+	}
+	filters := make([]WasmFilter, len(raw))
+	for i, f := range raw {
+		config, err := WasmConfig(f.Config)
+		if err != nil {
+			return nil, err
+		}
+		filters[i] = WasmFilter{Module: f.Module, RootID: f.RootID, Config: config, Edge: f.Edge, FailOpen: f.FailOpen}
+	}
+	if err := ValidateWasm(filters); err != nil {
+		return nil, err
+	}
+	return filters, nil
+}
+
+// ValidateHealthCheck checks probe timing. A nil health check is valid.
+func ValidateHealthCheck(hc *HealthCheck) error {
+	if hc == nil {
+		return nil
+	}
+	if hc.Interval != 0 && hc.Interval < time.Second {
+		return fmt.Errorf("health_check: interval must be at least 1s")
+	}
+	if hc.Timeout < 0 {
+		return fmt.Errorf("health_check: timeout must not be negative")
+	}
+	if hc.Interval != 0 && hc.Timeout >= hc.Interval {
+		return fmt.Errorf("health_check: timeout must be shorter than the interval")
+	}
+	return nil
+}
+
+// ValidateConcurrency checks a concurrency limit. A nil one is valid.
+func ValidateConcurrency(c *Concurrency) error {
+	if c == nil {
+		return nil
+	}
+	if c.Max < 1 {
+		return fmt.Errorf("concurrency: max must be at least 1")
+	}
+	if c.Queue < 0 {
+		return fmt.Errorf("concurrency: queue must not be negative")
+	}
+	return nil
+}
+
+// ValidateAffinity checks a session affinity. A nil one is valid.
+func ValidateAffinity(a *Affinity) error {
+	if a == nil {
+		return nil
+	}
+	switch a.Mode {
+	case AffinityCookie:
+		if a.Header != "" {
+			return fmt.Errorf("affinity: header is for mode %s", AffinityHeader)
+		}
+		if a.Cookie != "" && !headerName.MatchString(a.Cookie) {
+			return fmt.Errorf("affinity: invalid cookie name %q", a.Cookie)
+		}
+		if a.TTL < 0 {
+			return fmt.Errorf("affinity: ttl must not be negative")
+		}
+	case AffinityHeader:
+		if a.Cookie != "" || a.TTL != 0 {
+			return fmt.Errorf("affinity: cookie and ttl are for mode %s", AffinityCookie)
+		}
+		if !headerName.MatchString(a.Header) {
+			return fmt.Errorf("affinity: header must be a header name")
+		}
+	default:
+		return fmt.Errorf("affinity: mode must be %s or %s", AffinityCookie, AffinityHeader)
+	}
+	return nil
+}
+
+// ValidateLBPolicy checks a service's load balancing policy against its
+// affinity, which balances by hash itself: only a ring hash agrees with
+// it, and only when it doesn't ask for Maglev.
+func ValidateLBPolicy(policy string, a *Affinity) error {
+	if policy == "" {
+		return nil
+	}
+	if !slices.Contains(LBPolicies, policy) {
+		return fmt.Errorf("lb_policy: must be one of %s", strings.Join(LBPolicies, ", "))
+	}
+	if a != nil && (policy != LBRingHash || a.Maglev) {
+		return fmt.Errorf("lb_policy: %s conflicts with affinity, which balances by hash", policy)
+	}
+	return nil
+}
+
+// ValidateDNS checks a service's DNS resolution against its upstream: only
+// an IP address can be static, and there is nothing to refresh then. A nil
+// one is valid.
+func ValidateDNS(d *DNS, upstream string) error {
+	if d == nil {
+		return nil
+	}
+	if d.Type != "" && !slices.Contains(DNSTypes, d.Type) {
+		return fmt.Errorf("dns: type must be one of %s", strings.Join(DNSTypes, ", "))
+	}
+	host, _, err := net.SplitHostPort(upstream)
+	if err != nil {
+		host = upstream
+	}
+	_, ipErr := netip.ParseAddr(host)
+	static := d.Type == DNSStatic || d.Type == "" && ipErr == nil
+	switch {
+	case d.Type == DNSStatic && ipErr != nil:
+		return fmt.Errorf("dns: a static upstream must be an IP address, not %q", host)
+	case d.RefreshRate < 0:
+		return fmt.Errorf("dns: refresh_rate can't be negative")
+	case d.RefreshRate > 0 && static:
+		return fmt.Errorf("dns: an IP address upstream is not resolved, so it has no refresh_rate")
+	case d.RefreshRate > 0 && d.RefreshRate < time.Second:
+		return fmt.Errorf("dns: refresh_rate must be at least 1s")
+	}
+	return nil
+}
+
+// ValidateClientCert checks that a client certificate forwarding sets
+// something and that its headers are valid. A nil one is valid.
+func ValidateClientCert(cc *ClientCert) error {
+	if cc == nil {
+		return nil
+	}
+	if !cc.XFCC && len(cc.Headers) == 0 {
+		return fmt.Errorf("client_cert: set xfcc or at least one header")
+	}
+	for _, h := range cc.Headers {
+		if !headerName.MatchString(h.Name) || strings.EqualFold(h.Name, "host") {
+			return fmt.Errorf("client_cert: invalid header name %q", h.Name)
+		}
+		if cc.XFCC && strings.EqualFold(h.Name, "x-forwarded-client-cert") {
+			return fmt.Errorf("client_cert: header %q is already set by xfcc", h.Name)
+		}
+		if !slices.Contains(ClientCertFields, h.Field) {
+			return fmt.Errorf("client_cert: header %q: unknown field %q (want one of %s)", h.Name, h.Field, strings.Join(ClientCertFields, ", "))
+		}
+	}
+	return nil
+}
+
+// ValidateTLSPolicy checks a service's TLS settings. A nil policy is valid.
+func ValidateTLSPolicy(t *TLSPolicy) error {
+	if t == nil {
+		return nil
+	}
+	switch t.MinVersion {
+	case "", "1.2", "1.3":
+	default:
+		return fmt.Errorf("tls: min_version must be 1.2 or 1.3")
+	}
+	switch t.ClientCert {
+	case "", ClientCertNone, ClientCertOptional, ClientCertRequired:
+	default:
+		return fmt.Errorf("tls: client_cert must be %s, %s or %s", ClientCertNone, ClientCertOptional, ClientCertRequired)
+	}
+	if (t.CertChain == "") != (t.PrivateKey == "") {
+		return fmt.Errorf("tls: cert_chain and private_key go together")
+	}
+	return nil
+}
+
+// ParseForwardProxyAllow splits an allowlist entry into host and port. For
+// a "*." entry, wildcard is set and host is the part after "*."; port is 0
+// when any port is allowed.
+func ParseForwardProxyAllow(entry string) (host string, port int, wildcard bool, err error) {
+	host = entry
+	if h, p, ok := strings.Cut(entry, ":"); ok {
+		host = h
+		port, err = strconv.Atoi(p)
+		if err != nil || port < 1 || port > 65535 {
+			return "", 0, false, fmt.Errorf("allow entry %q: invalid port", entry)
+		}
+	}
+	if rest, ok := strings.CutPrefix(host, "*."); ok {
+		host, wildcard = rest, true
+	}
+	if host == "" {
+		return "", 0, false, fmt.Errorf("allow entry %q: empty host", entry)
+	}
+	for _, label := range strings.Split(host, ".") {
+		if !hostLabelRe.MatchString(label) {
+			return "", 0, false, fmt.Errorf("allow entry %q: invalid host name", entry)
+		}
+	}
+	return strings.ToLower(host), port, wildcard, nil
+}
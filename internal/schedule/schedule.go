@@ -0,0 +1,365 @@
+// Package schedule runs one-time registry changes at a set time, e.g. a
+// disruptive upstream move at 03:00, when hardly anyone is using it.
+//
+// Jobs are kept in a JSON file, written atomically after every change to
+// the list, so they survive restarts. A job that comes due while the
+// control plane is down runs when it is back, unless it is more than the
+// job's window late: then it is marked missed instead, since a change meant
+// for a quiet hour shouldn't land at the busiest one. Finished jobs are
+// kept, newest last, for a while so the outcome can be checked in the
+// morning.
+package schedule
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/envoyage/envoyage/internal/supervisor"
+)
+
+// ErrNotFound is returned for an unknown job ID.
+var ErrNotFound = errors.New("scheduled job not found")
+
+// ErrFinished is returned when cancelling a job that already ran.
+var ErrFinished = errors.New("scheduled job already finished")
+
+// Job states.
+const (
+	StatePending = "pending"
+	StateRunning = "running"
+	StateDone    = "done"
+	StateFailed  = "failed"
+	StateMissed  = "missed"
+)
+
+// Ops a job can make.
+const (
+	OpPut    = "put"    // add or replace Service with the definition in Body
+	OpPatch  = "patch"  // apply the JSON merge patch in Body to Service
+	OpDelete = "delete" // remove Service
+)
+
+// DefaultWindow is how late a job may run if Window is unset.
+const DefaultWindow = time.Hour
+
+// maxFinished bounds the finished jobs kept.
+const maxFinished = 100
+
+// Job is one scheduled change.
+type Job struct {
+	ID      string          `json:"id"`
+	At      time.Time       `json:"at"`
+	Op      string          `json:"op"`
+	Service string          `json:"service"`
+	Body    json.RawMessage `json:"body,omitempty"`
+	Comment string          `json:"comment,omitempty"`
+
+	// Window is how late the job may still run, e.g. after a restart.
+	Window time.Duration `json:"window,omitempty"`
+
+	Created time.Time `json:"created"`
+	State   string    `json:"state"`
+	Ran     time.Time `json:"ran,omitzero"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// active reports whether the job hasn't finished.
+func (j Job) active() bool { return j.State == StatePending || j.State == StateRunning }
+
+// ApplyFunc makes a job's change.
+type ApplyFunc func(ctx context.Context, job Job) error
+
+// Scheduler holds the jobs and runs them when due.
+type Scheduler struct {
+	path  string // "" keeps jobs in memory only
+	apply ApplyFunc
+	log   *slog.Logger
+
+	mu      sync.Mutex
+	jobs    []Job
+	running bool
+	wake    chan struct{}
+}
+
+// New creates a scheduler keeping its jobs in path, loading any already
+// there.
+func New(path string, apply ApplyFunc, log *slog.Logger) (*Scheduler, error) {
+	s := &Scheduler{path: path, apply: apply, log: log, wake: make(chan struct{}, 1)}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Add schedules job, assigning its ID, and returns it.
+func (s *Scheduler) Add(job Job) (Job, error) {
+	switch job.Op {
+	case OpPut, OpPatch, OpDelete:
+	default:
+		return Job{}, fmt.Errorf("unknown op %q", job.Op)
+	}
+	if job.At.IsZero() {
+		return Job{}, errors.New("no time given")
+	}
+	if job.Window <= 0 {
+		job.Window = DefaultWindow
+	}
+	id := make([]byte, 6)
+	if _, err := rand.Read(id); err != nil {
+		return Job{}, fmt.Errorf("generating job id: %w", err)
+	}
+	job.ID = hex.EncodeToString(id)
+	job.At = job.At.UTC()
+	job.Created = time.Now().UTC()
+	job.State = StatePending
+	job.Ran, job.Error = time.Time{}, ""
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev := s.jobs
+	s.jobs = append(append([]Job(nil), s.jobs...), job)
+	if err := s.save(); err != nil {
+		s.jobs = prev
+		return Job{}, err
+	}
+	s.poke()
+	return job, nil
+}
+
+// List returns every job: pending ones in the order they will run, then
+// finished ones. A scheduler that isn't running, like an HA standby's,
+// reads them from the file first, since another instance runs them.
+func (s *Scheduler) List() ([]Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.running {
+		if err := s.loadLocked(); err != nil {
+			return nil, err
+		}
+	}
+	out := append([]Job(nil), s.jobs...)
+	sort.SliceStable(out, func(i, j int) bool {
+		pi, pj := out[i].active(), out[j].active()
+		if pi != pj {
+			return pi
+		}
+		if pi {
+			return out[i].At.Before(out[j].At)
+		}
+		return out[i].Ran.Before(out[j].Ran)
+	})
+	return out, nil
+}
+
+// Cancel removes a pending job.
+func (s *Scheduler) Cancel(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, job := range s.jobs {
+		if job.ID != id {
+			continue
+		}
+		if job.State != StatePending {
+			return fmt.Errorf("%w: %s is %s", ErrFinished, id, job.State)
+		}
+		prev := s.jobs
+		s.jobs = append(append([]Job(nil), s.jobs[:i]...), s.jobs[i+1:]...)
+		if err := s.save(); err != nil {
+			s.jobs = prev
+			return err
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrNotFound, id)
+}
+
+// Run runs jobs as they come due until ctx is done. It reloads the file
+// first, to take over the jobs of an HA leader that went down.
+func (s *Scheduler) Run(ctx context.Context) error {
+	s.mu.Lock()
+	err := s.loadLocked()
+	s.running = err == nil
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		s.mu.Lock()
+		s.running = false
+		s.mu.Unlock()
+	}()
+
+	for {
+		supervisor.Beat(ctx)
+		next := s.runDue(ctx)
+
+		// Wake up at least every minute to beat, and for a clock that jumped.
+		wait := time.Minute
+		if !next.IsZero() {
+			wait = min(wait, max(time.Until(next), 0))
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-s.wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// runDue runs the jobs that are due, oldest first, and returns when the
+// next one is, or zero if none is pending.
+func (s *Scheduler) runDue(ctx context.Context) time.Time {
+	for {
+		now := time.Now()
+		s.mu.Lock()
+		i := s.nextLocked()
+		if i < 0 {
+			s.mu.Unlock()
+			return time.Time{}
+		}
+		job := s.jobs[i]
+		if job.At.After(now) {
+			s.mu.Unlock()
+			return job.At
+		}
+		// Only in memory: if the process dies now, it runs again.
+		s.jobs[i].State = StateRunning
+		s.mu.Unlock()
+
+		if now.Sub(job.At) > job.Window {
+			job.State = StateMissed
+			job.Error = fmt.Sprintf("%s late, past its %s window", now.Sub(job.At).Round(time.Second), job.Window)
+			s.log.Warn("scheduled job missed", "id", job.ID, "op", job.Op, "service", job.Service, "at", job.At)
+		} else if err := s.apply(ctx, job); err != nil {
+			job.State = StateFailed
+			job.Error = err.Error()
+			s.log.Error("scheduled job failed", "id", job.ID, "op", job.Op, "service", job.Service, "error", err)
+		} else {
+			job.State = StateDone
+			s.log.Info("scheduled job done", "id", job.ID, "op", job.Op, "service", job.Service)
+		}
+		job.Ran = now.UTC()
+
+		s.mu.Lock()
+		s.finishLocked(job)
+		if err := s.save(); err != nil {
+			// The change is made; at worst the job runs again after a
+			// restart, which puts and merge patches tolerate and a
+			// repeated delete fails harmlessly.
+			s.log.Error("saving scheduled jobs failed", "error", err)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// nextLocked returns the index of the pending job due first, or -1.
+func (s *Scheduler) nextLocked() int {
+	next := -1
+	for i, job := range s.jobs {
+		if job.State == StatePending && (next < 0 || job.At.Before(s.jobs[next].At)) {
+			next = i
+		}
+	}
+	return next
+}
+
+// finishLocked replaces the job with its finished form and drops the
+// oldest finished jobs beyond maxFinished.
+func (s *Scheduler) finishLocked(done Job) {
+	jobs := make([]Job, 0, len(s.jobs))
+	finished := []Job{done}
+	for _, job := range s.jobs {
+		switch {
+		case job.ID == done.ID:
+		case job.active():
+			jobs = append(jobs, job)
+		default:
+			finished = append(finished, job)
+		}
+	}
+	sort.SliceStable(finished, func(i, j int) bool { return finished[i].Ran.Before(finished[j].Ran) })
+	if len(finished) > maxFinished {
+		finished = finished[len(finished)-maxFinished:]
+	}
+	s.jobs = append(jobs, finished...)
+}
+
+func (s *Scheduler) poke() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Scheduler) load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.loadLocked()
+}
+
+func (s *Scheduler) loadLocked() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		s.jobs = nil
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading scheduled jobs: %w", err)
+	}
+	var jobs []Job
+	if err := json.Unmarshal(data, &jobs); err != nil {
+		return fmt.Errorf("parsing scheduled jobs %s: %w", s.path, err)
+	}
+	for i := range jobs {
+		if jobs[i].State == StateRunning {
+			// Written while it ran; it didn't finish.
+			jobs[i].State = StatePending
+		}
+	}
+	s.jobs = jobs
+	return nil
+}
+
+// save writes the jobs to the file. Caller holds mu.
+func (s *Scheduler) save() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.jobs, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding scheduled jobs: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("writing scheduled jobs: %w", err)
+	}
+	defer os.Remove(tmp.Name()) // no-op after a successful rename
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing scheduled jobs: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("writing scheduled jobs: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("writing scheduled jobs: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package stats
+
+import "time"
+
+// Failure causes reported by Health, most specific first.
+const (
+	CauseDNS            = "dns_failure"
+	CauseConnectTimeout = "connect_timeout"
+	CauseRefused        = "connect_refused"
+	CauseReset          = "reset"
+	CauseNoHealthy      = "no_healthy_upstream"
+	CauseProbeFailed    = "health_check_failed"
+)
+
+// causeHints turn a cause into something to go and check. On edge nodes the
+// upstream is the home Envoy, so the same causes point at the tunnel instead
+// of the app.
+var causeHints = map[string]string{
+	CauseDNS:            "upstream hostname does not resolve (container stopped, wrong name, or not on a shared network)",
+	CauseConnectTimeout: "upstream host does not answer (firewall, wrong IP, or tunnel down)",
+	CauseRefused:        "upstream host is reachable but nothing listens on the port (app down or wrong port)",
+	CauseReset:          "upstream accepted the request but closed the connection (app crash, protocol mismatch, or timeout in the app)",
+	CauseNoHealthy:      "no upstream host available (DNS returned nothing or all hosts are unhealthy)",
+	CauseProbeFailed:    "the TCP health check fails (app not listening, or its reply doesn't contain the expected bytes)",
+}
+
+// NodeHealth is one node's view of a service's upstream.
+type NodeHealth struct {
+	// Totals are the failure counters since the Envoy started, by cause.
+	Totals map[string]uint64 `json:"totals"`
+	// Recent are the failures seen between the last two scrapes, by cause.
+	Recent map[string]uint64 `json:"recent"`
+
+	// Cause is the dominant recent failure, or empty if there were none.
+	Cause string `json:"cause,omitempty"`
+	Hint  string `json:"hint,omitempty"`
+
+	// HealthyHosts is the number of resolved upstream hosts Envoy considers
+	// healthy; 0 means every request for this service fails.
+	HealthyHosts uint64    `json:"healthy_hosts"`
+	ScrapedAt    time.Time `json:"scraped_at"`
+
+	// Probe is the active health check's record, on nodes that run one.
+	Probe *ProbeHealth `json:"probe,omitempty"`
+}
+
+// ProbeHealth counts active health check results.
+type ProbeHealth struct {
+	Attempts uint64 `json:"attempts"`
+	Failures uint64 `json:"failures"`
+	// RecentAttempts and RecentFailures are between the last two scrapes.
+	RecentAttempts uint64 `json:"recent_attempts"`
+	RecentFailures uint64 `json:"recent_failures"`
+}
+
+// Health classifies the upstream failures of one service on every node that
+// has served it, keyed by node ID.
+func (s *Scraper) Health(name string) map[string]NodeHealth {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	out := make(map[string]NodeHealth)
+	for node, services := range s.latest {
+		cur, ok := services[name]
+		if !ok {
+			continue
+		}
+		prev := s.previous[node][name] // nil on the first scrape: no recent window yet
+
+		h := NodeHealth{
+			Totals:       classify(cur),
+			Recent:       make(map[string]uint64),
+			HealthyHosts: cur[StatMembersHealthy],
+			ScrapedAt:    s.scraped[node],
+		}
+		if prev != nil {
+			before := classify(prev)
+			for cause, n := range h.Totals {
+				// Counters reset when Envoy restarts; treat that as "all new".
+				if n >= before[cause] {
+					h.Recent[cause] = n - before[cause]
+				} else {
+					h.Recent[cause] = n
+				}
+			}
+		}
+		h.Probe = probeHealth(cur, prev)
+		h.Cause = dominant(h.Recent)
+		if h.Cause == "" && h.Probe != nil && h.Probe.RecentFailures > 0 &&
+			h.Probe.RecentFailures == h.Probe.RecentAttempts {
+			h.Cause = CauseProbeFailed
+		}
+		if h.Cause == "" && h.HealthyHosts == 0 {
+			h.Cause = CauseNoHealthy
+		}
+		h.Hint = causeHints[h.Cause]
+		out[node] = h
+	}
+	return out
+}
+
+// HomeReachable reports whether an edge node's probes reach home, judged
+// by its service clusters (see config.Fallback). known is false if the node
+// doesn't probe or hasn't been scraped yet.
+func (s *Scraper) HomeReachable(node string) (reachable, known bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, st := range s.latest[node] {
+		if st[StatHCAttempt] == 0 {
+			continue
+		}
+		known = true
+		if st[StatMembersHealthy] > 0 {
+			return true, true
+		}
+	}
+	return false, known
+}
+
+// probeHealth reads the health check counters; nil if the node doesn't
+// probe the service.
+func probeHealth(cur, prev map[string]uint64) *ProbeHealth {
+	if cur[StatHCAttempt] == 0 {
+		return nil
+	}
+	p := &ProbeHealth{Attempts: cur[StatHCAttempt], Failures: cur[StatHCFailure]}
+	if prev != nil && p.Attempts >= prev[StatHCAttempt] && p.Failures >= prev[StatHCFailure] {
+		p.RecentAttempts = p.Attempts - prev[StatHCAttempt]
+		p.RecentFailures = p.Failures - prev[StatHCFailure]
+	}
+	return p
+}
+
+// classify maps raw Envoy counters onto failure causes.
+//
+// Envoy counts a connect timeout under both connect_fail and connect_timeout,
+// so refused (or otherwise failed) connects are the difference.
+func classify(st map[string]uint64) map[string]uint64 {
+	refused := uint64(0)
+	if st[StatConnectFail] > st[StatConnectTimeout] {
+		refused = st[StatConnectFail] - st[StatConnectTimeout]
+	}
+	return map[string]uint64{
+		CauseDNS:            st[StatDNSFailure],
+		CauseConnectTimeout: st[StatConnectTimeout],
+		CauseRefused:        refused,
+		CauseReset:          st[StatRxReset] + st[StatRemoteReset],
+		CauseNoHealthy:      st[StatNoneHealthy],
+	}
+}
+
+// causeOrder breaks ties in dominant: a DNS failure explains the connect
+// errors that follow it, not the other way round.
+var causeOrder = []string{CauseDNS, CauseConnectTimeout, CauseRefused, CauseReset, CauseNoHealthy}
+
+func dominant(counts map[string]uint64) string {
+	best, bestN := "", uint64(0)
+	for _, c := range causeOrder {
+		if counts[c] > bestN {
+			best, bestN = c, counts[c]
+		}
+	}
+	return best
+}
@@ -0,0 +1,315 @@
+// Package stats pulls per-service traffic counters from the Envoy admin API.
+//
+// Every service gets its own Envoy cluster (cluster_<name>) on every node, so
+// Envoy's per-cluster counters already are per-service counters. On the edge
+// node those clusters all lead through the tunnel to the home Envoy, which
+// makes the edge numbers a direct measure of tunnel bandwidth per app.
+//
+// The Scraper polls each node's admin /stats endpoint on an interval, or
+// takes the stats the Envoys stream to it with Envoy's metrics service (see
+// sink.go), keeps a short series of each service's counters per node and
+// republishes the values as control plane metrics labeled by service and
+// node, so one Prometheus scrape of the control plane covers the whole fleet.
+package stats
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/envoyage/envoyage/internal/metrics"
+	"github.com/envoyage/envoyage/internal/supervisor"
+)
+
+// clusterPrefix is the naming convention used by xds.SnapshotBuilder for
+// per-service clusters.
+const clusterPrefix = "cluster_"
+
+// Counters scraped per service cluster, keyed by Envoy stat suffix.
+const (
+	StatRxBytes = "upstream_cx_rx_bytes_total" // bytes received from the upstream (responses)
+	StatTxBytes = "upstream_cx_tx_bytes_total" // bytes sent to the upstream (requests)
+)
+
+// Upstream failure counters and gauges, see health.go.
+const (
+	StatConnectFail    = "upstream_cx_connect_fail"    // all failed connection attempts
+	StatConnectTimeout = "upstream_cx_connect_timeout" // attempts that hit connect_timeout
+	StatNoneHealthy    = "upstream_cx_none_healthy"    // requests with no host to send to
+	StatRxReset        = "upstream_rq_rx_reset"        // upstream reset the stream mid-request
+	StatRemoteReset    = "upstream_cx_destroy_remote_with_active_rq"
+	StatDNSAttempt     = "update_attempt"     // STRICT_DNS resolutions started
+	StatDNSFailure     = "update_failure"     // STRICT_DNS resolution failures
+	StatMembersHealthy = "membership_healthy" // gauge: resolved, healthy hosts
+)
+
+// Request outcome counters and latency, used by canary analysis.
+const (
+	StatRqCompleted = "upstream_rq_completed" // requests with a response (or reset)
+	StatRq5xx       = "upstream_rq_5xx"
+
+	// StatRqTimeP95 is not an Envoy stat: it is the cumulative p95 of the
+	// upstream_rq_time histogram, in milliseconds.
+	StatRqTimeP95 = "upstream_rq_time_p95"
+	statRqTime    = "upstream_rq_time"
+)
+
+// Active health check counters, for services with a health check (home node
+// only). Failures include network failures.
+const (
+	StatHCAttempt = "health_check.attempt"
+	StatHCSuccess = "health_check.success"
+	StatHCFailure = "health_check.failure"
+)
+
+// CanarySuffix marks a service's canary cluster (cluster_<name>~canary), so
+// its stats appear under the service name plus this suffix.
+const CanarySuffix = "~canary"
+
+// LocalSuffix marks the cluster of a service's copy on an edge
+// (cluster_<name>~local, see registry.Origin), like CanarySuffix.
+const LocalSuffix = "~local"
+
+// scraped lists every stat suffix the scraper collects.
+var scraped = []string{
+	StatRxBytes,
+	StatTxBytes,
+	StatConnectFail,
+	StatConnectTimeout,
+	StatNoneHealthy,
+	StatRxReset,
+	StatRemoteReset,
+	StatDNSAttempt,
+	StatDNSFailure,
+	StatMembersHealthy,
+	StatRqCompleted,
+	StatRq5xx,
+	statRqTime,
+	StatHCAttempt,
+	StatHCSuccess,
+	StatHCFailure,
+}
+
+// Targets returns the admin address of every node to scrape, keyed by node ID.
+// It is called on every poll so nodes can come and go at runtime.
+type Targets func() map[string]string
+
+// Scraper periodically collects per-service counters from every node.
+type Scraper struct {
+	targets  Targets
+	interval time.Duration
+	client   *http.Client
+	log      *slog.Logger
+
+	rxBytes     *metrics.Vec
+	txBytes     *metrics.Vec
+	requests    *metrics.Vec
+	errors      *metrics.Vec
+	dnsAttempts *metrics.Vec
+	dnsFailures *metrics.Vec
+
+	mu          sync.RWMutex
+	latest      map[string]map[string]map[string]uint64 // node → service → stat → value
+	previous    map[string]map[string]map[string]uint64 // the scrape before latest
+	scraped     map[string]time.Time                    // node → time of latest
+	scrapedPrev map[string]time.Time                    // node → time of previous
+	series      map[string]map[string]*ring             // node → service → recent samples
+	seriesLen   int
+}
+
+// NewScraper creates a Scraper that publishes into m and keeps the last
+// series samples of every service per node.
+func NewScraper(targets Targets, interval time.Duration, series int, m *metrics.Registry, log *slog.Logger) *Scraper {
+	return &Scraper{
+		targets:  targets,
+		interval: interval,
+		client:   &http.Client{Timeout: 5 * time.Second},
+		log:      log,
+		rxBytes: m.NewVec("envoyage_service_rx_bytes_total",
+			"Bytes received from the service's upstream (response direction), per node.",
+			metrics.Counter, "service", "node"),
+		txBytes: m.NewVec("envoyage_service_tx_bytes_total",
+			"Bytes sent to the service's upstream (request direction), per node.",
+			metrics.Counter, "service", "node"),
+		requests: m.NewVec("envoyage_service_requests_total",
+			"Requests to the service's upstream that completed, per node.",
+			metrics.Counter, "service", "node"),
+		errors: m.NewVec("envoyage_service_5xx_total",
+			"Requests to the service's upstream answered with a 5xx, per node.",
+			metrics.Counter, "service", "node"),
+		dnsAttempts: m.NewVec("envoyage_service_dns_resolutions_total",
+			"DNS resolutions of the service's upstream hostname, per node.",
+			metrics.Counter, "service", "node"),
+		dnsFailures: m.NewVec("envoyage_service_dns_failures_total",
+			"Failed DNS resolutions of the service's upstream hostname, per node.",
+			metrics.Counter, "service", "node"),
+		latest:      make(map[string]map[string]map[string]uint64),
+		previous:    make(map[string]map[string]map[string]uint64),
+		scraped:     make(map[string]time.Time),
+		scrapedPrev: make(map[string]time.Time),
+		series:      make(map[string]map[string]*ring),
+		seriesLen:   series,
+	}
+}
+
+// Run polls until ctx is canceled. Call it in a goroutine.
+func (s *Scraper) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		s.scrapeAll(ctx)
+		supervisor.Beat(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Service returns the latest counters for one service, keyed by node ID and
+// then by stat suffix. Nodes that have never served the service are absent.
+func (s *Scraper) Service(name string) map[string]map[string]uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	out := make(map[string]map[string]uint64)
+	for node, services := range s.latest {
+		if st, ok := services[name]; ok {
+			cp := make(map[string]uint64, len(st))
+			for k, v := range st {
+				cp[k] = v
+			}
+			out[node] = cp
+		}
+	}
+	return out
+}
+
+func (s *Scraper) scrapeAll(ctx context.Context) {
+	for node, addr := range s.targets() {
+		services, err := s.scrape(ctx, addr)
+		if err != nil {
+			// Envoys restart and tunnels drop; keep the last values and retry
+			// on the next tick rather than flapping the metrics to zero.
+			s.log.Debug("stats scrape failed", "node", node, "admin", addr, "error", err)
+			continue
+		}
+
+		s.record(node, services, time.Now())
+	}
+}
+
+// record makes one node's counters, by service and then stat, the latest.
+func (s *Scraper) record(node string, services map[string]map[string]uint64, at time.Time) {
+	s.mu.Lock()
+	s.previous[node] = s.latest[node]
+	s.latest[node] = services
+	s.scrapedPrev[node] = s.scraped[node]
+	s.scraped[node] = at
+	s.appendSeries(node, services, at)
+	s.mu.Unlock()
+
+	for svc, st := range services {
+		s.rxBytes.Set(float64(st[StatRxBytes]), svc, node)
+		s.txBytes.Set(float64(st[StatTxBytes]), svc, node)
+		s.requests.Set(float64(st[StatRqCompleted]), svc, node)
+		s.errors.Set(float64(st[StatRq5xx]), svc, node)
+		s.dnsAttempts.Set(float64(st[StatDNSAttempt]), svc, node)
+		s.dnsFailures.Set(float64(st[StatDNSFailure]), svc, node)
+	}
+}
+
+// scrape fetches the per-service cluster stats from one Envoy admin endpoint.
+func (s *Scraper) scrape(ctx context.Context, addr string) (map[string]map[string]uint64, error) {
+	quoted := make([]string, len(scraped))
+	for i, st := range scraped {
+		quoted[i] = regexp.QuoteMeta(st)
+	}
+	filter := fmt.Sprintf(`^cluster\.%s[^.]+\.(%s)$`, clusterPrefix, strings.Join(quoted, "|"))
+	u := fmt.Sprintf("http://%s/stats?format=json&filter=%s", addr, url.QueryEscape(filter))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("admin returned %s", resp.Status)
+	}
+
+	// Envoy's JSON stats format: {"stats":[{"name":"...","value":N}, ...]}.
+	// Histograms come as one extra entry holding computed quantiles.
+	var body struct {
+		Stats []struct {
+			Name       string  `json:"name"`
+			Value      *uint64 `json:"value"`
+			Histograms *struct {
+				SupportedQuantiles []float64 `json:"supported_quantiles"`
+				ComputedQuantiles  []struct {
+					Name   string `json:"name"`
+					Values []struct {
+						Cumulative *float64 `json:"cumulative"`
+					} `json:"values"`
+				} `json:"computed_quantiles"`
+			} `json:"histograms"`
+		} `json:"stats"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("decoding stats: %w", err)
+	}
+
+	out := make(map[string]map[string]uint64)
+	set := func(svc, stat string, v uint64) {
+		if out[svc] == nil {
+			out[svc] = make(map[string]uint64)
+		}
+		out[svc][stat] = v
+	}
+	for _, st := range body.Stats {
+		if h := st.Histograms; h != nil {
+			p95 := slices.Index(h.SupportedQuantiles, 95)
+			for _, q := range h.ComputedQuantiles {
+				svc, stat, ok := parseClusterStat(q.Name)
+				if !ok || stat != statRqTime || p95 < 0 || p95 >= len(q.Values) || q.Values[p95].Cumulative == nil {
+					continue
+				}
+				set(svc, StatRqTimeP95, uint64(*q.Values[p95].Cumulative))
+			}
+			continue
+		}
+		if st.Value == nil {
+			continue
+		}
+		if svc, stat, ok := parseClusterStat(st.Name); ok {
+			set(svc, stat, *st.Value)
+		}
+	}
+	return out, nil
+}
+
+// parseClusterStat splits "cluster.cluster_<svc>.<stat>" into service and stat.
+func parseClusterStat(name string) (svc, stat string, ok bool) {
+	rest, ok := strings.CutPrefix(name, "cluster."+clusterPrefix)
+	if !ok {
+		return "", "", false
+	}
+	i := strings.IndexByte(rest, '.')
+	if i < 0 {
+		return "", "", false
+	}
+	return rest[:i], rest[i+1:], true
+}
@@ -0,0 +1,94 @@
+package stats
+
+import (
+	"strings"
+	"time"
+)
+
+// Sample is a service's counters on one node at one scrape, canary and
+// edge copy included. The counters are totals since the Envoy started.
+type Sample struct {
+	Time     time.Time `json:"time"`
+	Requests uint64    `json:"requests"`
+	Errors   uint64    `json:"errors"`
+	RxBytes  uint64    `json:"rx_bytes"`
+	TxBytes  uint64    `json:"tx_bytes"`
+	P95      uint64    `json:"p95_ms"`
+}
+
+// ring holds the most recent samples, overwriting the oldest.
+type ring struct {
+	samples []Sample
+	next    int // where the next sample goes
+	full    bool
+}
+
+func (r *ring) add(s Sample) {
+	r.samples[r.next] = s
+	r.next = (r.next + 1) % len(r.samples)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// all returns the samples, oldest first.
+func (r *ring) all() []Sample {
+	if !r.full {
+		return append([]Sample(nil), r.samples[:r.next]...)
+	}
+	return append(append([]Sample(nil), r.samples[r.next:]...), r.samples[:r.next]...)
+}
+
+// appendSeries adds a sample of every service on node. Services the node
+// no longer has lose their series. s.mu must be held.
+func (s *Scraper) appendSeries(node string, services map[string]map[string]uint64, at time.Time) {
+	if s.seriesLen <= 0 {
+		return
+	}
+	samples := make(map[string]Sample)
+	for cluster, st := range services {
+		name := strings.TrimSuffix(strings.TrimSuffix(cluster, CanarySuffix), LocalSuffix)
+		p := samples[name]
+		p.Time = at
+		p.Requests += st[StatRqCompleted]
+		p.Errors += st[StatRq5xx]
+		p.RxBytes += st[StatRxBytes]
+		p.TxBytes += st[StatTxBytes]
+		p.P95 = max(p.P95, st[StatRqTimeP95])
+		samples[name] = p
+	}
+
+	series := s.series[node]
+	if series == nil {
+		series = make(map[string]*ring)
+		s.series[node] = series
+	}
+	for name := range series {
+		if _, ok := samples[name]; !ok {
+			delete(series, name)
+		}
+	}
+	for name, p := range samples {
+		r := series[name]
+		if r == nil {
+			r = &ring{samples: make([]Sample, s.seriesLen)}
+			series[name] = r
+		}
+		r.add(p)
+	}
+}
+
+// Series returns a service's recent samples on every node that has served
+// it, oldest first, keyed by node ID.
+func (s *Scraper) Series(name string) map[string][]Sample {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	out := make(map[string][]Sample)
+	for node, series := range s.series {
+		if r, ok := series[name]; ok {
+			out[node] = r.all()
+		}
+	}
+	return out
+}
@@ -0,0 +1,105 @@
+package stats
+
+import (
+	"errors"
+	"io"
+	"math"
+	"time"
+
+	metricsv3 "github.com/envoyproxy/go-control-plane/envoy/service/metrics/v3"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/grpc"
+)
+
+// Metrics service sink
+//
+// With stats.source metrics_service, Envoys don't get scraped: they stream
+// all their stats to the control plane over the xDS cluster, every
+// stats_flush_interval, and the sink keeps the per-service counters of a
+// message as if they had been scraped. Envoy flushes every 5s unless told
+// otherwise, so messages closer together than most of the interval are
+// dropped, keeping Health's recent window as long as a scrape's: the
+// counters are totals, nothing is lost.
+
+// sink is the metrics service. Envoy sends its identifier on the first
+// message of a stream only.
+type sink struct {
+	metricsv3.UnimplementedMetricsServiceServer
+	s *Scraper
+}
+
+// Register adds the metrics service to a gRPC server.
+func (s *Scraper) Register(g *grpc.Server) {
+	metricsv3.RegisterMetricsServiceServer(g, &sink{s: s})
+}
+
+// StreamMetrics implements the metrics service.
+func (k *sink) StreamMetrics(stream metricsv3.MetricsService_StreamMetricsServer) error {
+	var node string
+	for {
+		msg, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return stream.SendAndClose(&metricsv3.StreamMetricsResponse{})
+		}
+		if err != nil {
+			return err
+		}
+		if id := msg.GetIdentifier(); id != nil {
+			node = id.GetNode().GetId()
+		}
+		if node == "" {
+			continue
+		}
+		now := time.Now()
+		k.s.mu.RLock()
+		last := k.s.scraped[node]
+		k.s.mu.RUnlock()
+		if now.Sub(last) < k.s.interval*3/4 {
+			continue
+		}
+		k.s.record(node, clusterStats(msg.GetEnvoyMetrics()), now)
+	}
+}
+
+// clusterStats picks the scraped stats of the service clusters out of a
+// metrics service message, as scrape does out of the admin's.
+func clusterStats(families []*dto.MetricFamily) map[string]map[string]uint64 {
+	wanted := make(map[string]bool, len(scraped))
+	for _, st := range scraped {
+		wanted[st] = true
+	}
+	out := make(map[string]map[string]uint64)
+	set := func(svc, stat string, v float64) {
+		if math.IsNaN(v) || v < 0 {
+			return
+		}
+		if out[svc] == nil {
+			out[svc] = make(map[string]uint64)
+		}
+		out[svc][stat] = uint64(v)
+	}
+	for _, f := range families {
+		svc, stat, ok := parseClusterStat(f.GetName())
+		if !ok || !wanted[stat] || len(f.GetMetric()) == 0 {
+			continue
+		}
+		m := f.GetMetric()[0]
+		switch f.GetType() {
+		case dto.MetricType_COUNTER:
+			set(svc, stat, m.GetCounter().GetValue())
+		case dto.MetricType_GAUGE:
+			set(svc, stat, m.GetGauge().GetValue())
+		case dto.MetricType_SUMMARY:
+			// Histograms come as summaries, with Envoy's quantiles.
+			if stat != statRqTime {
+				continue
+			}
+			for _, q := range m.GetSummary().GetQuantile() {
+				if q.GetQuantile() == 0.95 {
+					set(svc, StatRqTimeP95, q.GetValue())
+				}
+			}
+		}
+	}
+	return out
+}
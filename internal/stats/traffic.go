@@ -0,0 +1,99 @@
+package stats
+
+import "time"
+
+// Traffic is a service's requests and bytes, as counted by its clusters.
+// Canary traffic and that of an edge's own copy are included.
+type Traffic struct {
+	// Totals since the Envoy started.
+	Requests uint64 `json:"requests"`
+	Errors   uint64 `json:"errors"`   // requests answered with a 5xx
+	RxBytes  uint64 `json:"rx_bytes"` // from the upstream: responses
+	TxBytes  uint64 `json:"tx_bytes"` // to the upstream: requests
+
+	// Rates per second between the last two scrapes; 0 before the second.
+	RequestRate float64 `json:"request_rate"`
+	ErrorRate   float64 `json:"error_rate"`
+	RxRate      float64 `json:"rx_bytes_rate"`
+	TxRate      float64 `json:"tx_bytes_rate"`
+
+	// P95 is the p95 upstream latency since the Envoy started, in
+	// milliseconds; 0 if unknown.
+	P95 uint64 `json:"p95_ms"`
+
+	ScrapedAt time.Time `json:"scraped_at,omitzero"`
+}
+
+// Traffic returns one service's traffic on every node that has served it,
+// keyed by node ID.
+func (s *Scraper) Traffic(name string) map[string]Traffic {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	out := make(map[string]Traffic)
+	for node, services := range s.latest {
+		t := Traffic{ScrapedAt: s.scraped[node]}
+		var (
+			seen    bool
+			elapsed = s.scraped[node].Sub(s.scrapedPrev[node]).Seconds()
+		)
+		for _, cluster := range []string{name, name + CanarySuffix, name + LocalSuffix} {
+			cur, ok := services[cluster]
+			if !ok {
+				continue
+			}
+			seen = true
+			t.Requests += cur[StatRqCompleted]
+			t.Errors += cur[StatRq5xx]
+			t.RxBytes += cur[StatRxBytes]
+			t.TxBytes += cur[StatTxBytes]
+			t.P95 = max(t.P95, cur[StatRqTimeP95])
+
+			prev, ok := s.previous[node][cluster]
+			if !ok || s.scrapedPrev[node].IsZero() || elapsed <= 0 {
+				continue
+			}
+			rate := func(stat string) float64 {
+				// Counters reset when Envoy restarts; treat that as "all new".
+				d := cur[stat]
+				if d >= prev[stat] {
+					d -= prev[stat]
+				}
+				return float64(d) / elapsed
+			}
+			t.RequestRate += rate(StatRqCompleted)
+			t.ErrorRate += rate(StatRq5xx)
+			t.RxRate += rate(StatRxBytes)
+			t.TxRate += rate(StatTxBytes)
+		}
+		if seen {
+			out[node] = t
+		}
+	}
+	return out
+}
+
+// Busiest sums up a service's traffic across nodes. A public request is
+// counted by the edge and again by home, so each figure is the highest
+// node's rather than a sum: home sees every request, LAN ones included,
+// and an edge's bytes are what the service costs the tunnel.
+func Busiest(nodes map[string]Traffic) Traffic {
+	var t Traffic
+	for _, n := range nodes {
+		if n.Requests > t.Requests {
+			t.Requests, t.Errors = n.Requests, n.Errors
+		}
+		if n.RequestRate > t.RequestRate {
+			t.RequestRate, t.ErrorRate = n.RequestRate, n.ErrorRate
+		}
+		t.RxBytes = max(t.RxBytes, n.RxBytes)
+		t.TxBytes = max(t.TxBytes, n.TxBytes)
+		t.RxRate = max(t.RxRate, n.RxRate)
+		t.TxRate = max(t.TxRate, n.TxRate)
+		t.P95 = max(t.P95, n.P95)
+		if n.ScrapedAt.After(t.ScrapedAt) {
+			t.ScrapedAt = n.ScrapedAt
+		}
+	}
+	return t
+}
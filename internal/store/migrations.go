@@ -0,0 +1,77 @@
+package store
+
+// Migration upgrades the store document by one schema version.
+//
+// Migrations operate on the raw JSON object rather than on registry types:
+// the Go types always describe the latest schema, so they cannot be used to
+// read an old one. To change the stored format, append a migration here —
+// never edit one that has shipped.
+type Migration struct {
+	Version     int // schema version after this migration
+	Description string
+	apply       func(doc map[string]any) error
+}
+
+var migrations = []Migration{
+	{
+		Version:     1,
+		Description: "initial schema: list of services",
+		apply: func(doc map[string]any) error {
+			if _, ok := doc["services"]; !ok {
+				doc["services"] = []any{}
+			}
+			return nil
+		},
+	},
+	{
+		Version:     2,
+		Description: "add change history",
+		apply: func(doc map[string]any) error {
+			if _, ok := doc["changes"]; !ok {
+				doc["changes"] = []any{}
+			}
+			return nil
+		},
+	},
+	{
+		Version:     3,
+		Description: "record which source registered each service",
+		apply: func(doc map[string]any) error {
+			services, _ := doc["services"].([]any)
+			for _, s := range services {
+				svc, ok := s.(map[string]any)
+				if !ok {
+					continue
+				}
+				source := "api"
+				switch {
+				case svc["Container"] != nil && svc["Container"] != "":
+					source = "docker"
+				case svc["Ingress"] != nil && svc["Ingress"] != "":
+					source = "kubernetes"
+				case svc["File"] != nil && svc["File"] != "":
+					source = "file"
+				}
+				svc["Source"] = source
+			}
+			return nil
+		},
+	},
+}
+
+// LatestVersion is the schema version this build reads and writes.
+func LatestVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// pending returns the migrations needed to bring a document at version from
+// up to LatestVersion.
+func pending(from int) []Migration {
+	var out []Migration
+	for _, m := range migrations {
+		if m.Version > from {
+			out = append(out, m)
+		}
+	}
+	return out
+}
@@ -0,0 +1,217 @@
+// Package store persists the service registry to disk.
+//
+// The store is a single JSON document, written atomically (temp file +
+// rename) after every registry change:
+//
+//	{"schema_version": 3, "services": [...], "changes": [...]}
+//
+// The document carries its schema version so that a newer control plane can
+// recognize data written by an older one and migrate it (see migrations.go),
+// and so an older control plane refuses to start on data it doesn't
+// understand instead of silently dropping fields. Every migration is preceded
+// by a backup copy of the file.
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/envoyage/envoyage/internal/registry"
+)
+
+// ErrNeedsMigration is returned by Load when the file's schema is older than
+// this build's.
+var ErrNeedsMigration = errors.New("store schema is out of date")
+
+// ErrTooNew is returned when the file was written by a newer release.
+var ErrTooNew = errors.New("store schema is newer than this release")
+
+// File is a JSON file store.
+type File struct {
+	path string
+}
+
+func Open(path string) *File {
+	return &File{path: path}
+}
+
+func (f *File) Path() string { return f.path }
+
+type document struct {
+	SchemaVersion int                 `json:"schema_version"`
+	Services      []*registry.Service `json:"services"`
+	Changes       []registry.Change   `json:"changes"`
+}
+
+// Status describes the file's schema relative to this build.
+type Status struct {
+	Path    string
+	Exists  bool
+	Version int         // schema version of the file; 0 if it doesn't exist
+	Latest  int         // schema version this build writes
+	Pending []Migration // migrations Migrate would apply, in order
+}
+
+// Status reads the file's schema version without loading its services.
+func (f *File) Status() (Status, error) {
+	st := Status{Path: f.path, Latest: LatestVersion()}
+	raw, err := f.readRaw()
+	if errors.Is(err, os.ErrNotExist) {
+		return st, nil
+	}
+	if err != nil {
+		return st, err
+	}
+	st.Exists = true
+	st.Version = schemaVersion(raw)
+	st.Pending = pending(st.Version)
+	return st, nil
+}
+
+// Load returns the stored services and change history. A missing file is an
+// empty registry.
+func (f *File) Load() ([]*registry.Service, []registry.Change, error) {
+	data, err := os.ReadFile(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading store: %w", err)
+	}
+
+	var doc document
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, nil, fmt.Errorf("parsing store %s: %w", f.path, err)
+	}
+	switch latest := LatestVersion(); {
+	case doc.SchemaVersion < latest:
+		return nil, nil, fmt.Errorf("%w: %s is at version %d, this release needs %d", ErrNeedsMigration, f.path, doc.SchemaVersion, latest)
+	case doc.SchemaVersion > latest:
+		return nil, nil, fmt.Errorf("%w: %s is at version %d, this release supports up to %d", ErrTooNew, f.path, doc.SchemaVersion, latest)
+	}
+	return doc.Services, doc.Changes, nil
+}
+
+// Save replaces the stored services and history. It implements
+// registry.Persister.
+func (f *File) Save(services []*registry.Service, history []registry.Change) error {
+	sorted := append([]*registry.Service(nil), services...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+
+	doc := document{SchemaVersion: LatestVersion(), Services: sorted, Changes: history}
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding store: %w", err)
+	}
+	return f.writeAtomic(data)
+}
+
+// Migrate upgrades the file to the latest schema. The original is copied to
+// a backup first; its path is returned (empty if nothing was migrated).
+func (f *File) Migrate() (backup string, applied []Migration, err error) {
+	raw, err := f.readRaw()
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil, f.Save(nil, nil)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	from := schemaVersion(raw)
+	if from > LatestVersion() {
+		return "", nil, fmt.Errorf("%w: %s is at version %d", ErrTooNew, f.path, from)
+	}
+	todo := pending(from)
+	if len(todo) == 0 {
+		return "", nil, nil
+	}
+
+	if backup, err = f.backup(from); err != nil {
+		return "", nil, err
+	}
+	for _, m := range todo {
+		if err := m.apply(raw); err != nil {
+			return backup, applied, fmt.Errorf("migration %d (%s): %w", m.Version, m.Description, err)
+		}
+		raw["schema_version"] = m.Version
+		applied = append(applied, m)
+	}
+
+	data, err := json.MarshalIndent(raw, "", "  ")
+	if err != nil {
+		return backup, applied, fmt.Errorf("encoding migrated store: %w", err)
+	}
+	return backup, applied, f.writeAtomic(data)
+}
+
+// readRaw loads the file as a generic JSON object, the form migrations work
+// on: they must not depend on today's Go types.
+func (f *File) readRaw() (map[string]any, error) {
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("parsing store %s: %w", f.path, err)
+	}
+	return raw, nil
+}
+
+// backup copies the file next to itself as <name>.v<version>.<time>.bak.
+func (f *File) backup(version int) (string, error) {
+	dst := fmt.Sprintf("%s.v%d.%s.bak", f.path, version, time.Now().UTC().Format("20060102T150405Z"))
+
+	in, err := os.Open(f.path)
+	if err != nil {
+		return "", fmt.Errorf("backing up store: %w", err)
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return "", fmt.Errorf("backing up store: %w", err)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return "", fmt.Errorf("backing up store: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		return "", fmt.Errorf("backing up store: %w", err)
+	}
+	return dst, nil
+}
+
+func (f *File) writeAtomic(data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("writing store: %w", err)
+	}
+	defer os.Remove(tmp.Name()) // no-op after a successful rename
+
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing store: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing store: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("writing store: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), f.path); err != nil {
+		return fmt.Errorf("writing store: %w", err)
+	}
+	return nil
+}
+
+func schemaVersion(raw map[string]any) int {
+	v, _ := raw["schema_version"].(float64)
+	return int(v)
+}
@@ -0,0 +1,244 @@
+// Package supervisor keeps the control plane's background loops running.
+//
+// Each subsystem (the Docker and Kubernetes watchers, the file provider,
+// the stats scraper, ...) is a Run(ctx) loop started in its own goroutine.
+// Before, one that returned with an error, panicked or hung on a dead
+// connection stayed that way, and the control plane kept serving stale
+// state without saying so. The Supervisor restarts a loop that:
+//
+//   - returns (or panics) while the control plane is still running, after
+//     a backoff, or
+//   - stops making progress: a loop reports progress by calling Beat with
+//     the context it was given, once per iteration, and one that hasn't
+//     for its stall timeout is canceled and started again.
+//
+// Restarts are logged and counted in envoyage_subsystem_restarts_total;
+// envoyage_subsystem_up is 0 while a subsystem is down or wedged.
+package supervisor
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/envoyage/envoyage/internal/metrics"
+)
+
+// Restart reasons, the reason label of envoyage_subsystem_restarts_total.
+const (
+	ReasonExited  = "exited"  // Run returned before shutdown
+	ReasonPanic   = "panic"   // Run panicked
+	ReasonStalled = "stalled" // no Beat for the stall timeout
+)
+
+// Backoff between restarts of a subsystem that keeps failing.
+const (
+	minBackoff = time.Second
+	maxBackoff = time.Minute
+)
+
+// stopGrace is how long a wedged subsystem gets to return after it is
+// canceled. One that doesn't is abandoned and started afresh; a goroutine
+// stuck for good can't be stopped from outside.
+const stopGrace = 10 * time.Second
+
+type beatKey struct{}
+
+// Beat reports that the subsystem running with ctx made progress. It does
+// nothing for a context that doesn't come from a Supervisor, so loops can
+// call it unconditionally.
+func Beat(ctx context.Context) {
+	if last, ok := ctx.Value(beatKey{}).(*atomic.Int64); ok {
+		last.Store(time.Now().UnixNano())
+	}
+}
+
+// Status is a subsystem's state, for GET /readyz.
+type Status struct {
+	Up           bool      `json:"up"`
+	Restarts     int       `json:"restarts"`
+	LastProgress time.Time `json:"last_progress"`
+	LastError    string    `json:"last_error,omitempty"`
+}
+
+// Supervisor runs subsystems and restarts them when they fail.
+type Supervisor struct {
+	log      *slog.Logger
+	restarts *metrics.Vec
+	up       *metrics.Vec
+
+	mu    sync.Mutex
+	tasks map[string]*task
+}
+
+type task struct {
+	name  string
+	stall time.Duration
+	run   func(context.Context) error
+
+	// lastBeat is the current run's last Beat, in unix nanoseconds. Each
+	// run has its own, so an abandoned one can't pass for progress.
+	lastBeat atomic.Pointer[atomic.Int64]
+
+	mu       sync.Mutex
+	up       bool
+	restarts int
+	lastErr  string
+}
+
+// New creates a Supervisor that publishes into m.
+func New(m *metrics.Registry, log *slog.Logger) *Supervisor {
+	return &Supervisor{
+		log: log,
+		restarts: m.NewVec("envoyage_subsystem_restarts_total",
+			"Restarts of a control plane subsystem by the supervisor, by reason.",
+			metrics.Counter, "subsystem", "reason"),
+		up: m.NewVec("envoyage_subsystem_up",
+			"Whether the subsystem is running and making progress (1) or not (0).",
+			metrics.Gauge, "subsystem"),
+		tasks: make(map[string]*task),
+	}
+}
+
+// Go runs fn under supervision until ctx is canceled. fn must return once
+// its context is canceled. stall is how long fn may go without a Beat
+// before it is considered wedged; 0 only restarts it when it returns.
+func (s *Supervisor) Go(ctx context.Context, name string, stall time.Duration, fn func(context.Context) error) {
+	t := &task{name: name, stall: stall, run: fn}
+	s.mu.Lock()
+	s.tasks[name] = t
+	s.mu.Unlock()
+	go s.supervise(ctx, t)
+}
+
+// Status returns the state of every subsystem, by name.
+func (s *Supervisor) Status() map[string]Status {
+	s.mu.Lock()
+	names := make([]string, 0, len(s.tasks))
+	for name := range s.tasks {
+		names = append(names, name)
+	}
+	s.mu.Unlock()
+	sort.Strings(names)
+
+	out := make(map[string]Status, len(names))
+	for _, name := range names {
+		s.mu.Lock()
+		t := s.tasks[name]
+		s.mu.Unlock()
+		t.mu.Lock()
+		st := Status{Up: t.up, Restarts: t.restarts, LastError: t.lastErr}
+		t.mu.Unlock()
+		if last := t.lastBeat.Load(); last != nil {
+			st.LastProgress = time.Unix(0, last.Load())
+		}
+		out[name] = st
+	}
+	return out
+}
+
+func (s *Supervisor) supervise(ctx context.Context, t *task) {
+	backoff := minBackoff
+	for {
+		started := time.Now()
+		reason, err := s.runOnce(ctx, t)
+		if ctx.Err() != nil {
+			s.setUp(t, false, "")
+			return
+		}
+
+		msg := reason
+		if err != nil {
+			msg = err.Error()
+		}
+		s.setUp(t, false, msg)
+		t.mu.Lock()
+		t.restarts++
+		t.mu.Unlock()
+		s.restarts.Inc(t.name, reason)
+
+		// A subsystem that ran fine for a while starts over quickly; one
+		// that fails right away backs off.
+		if time.Since(started) > maxBackoff {
+			backoff = minBackoff
+		}
+		s.log.Error("subsystem failed, restarting", "subsystem", t.name, "reason", reason, "error", err, "in", backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// runOnce runs the subsystem until it returns, panics or stalls, and says
+// which.
+func (s *Supervisor) runOnce(ctx context.Context, t *task) (reason string, err error) {
+	last := new(atomic.Int64)
+	last.Store(time.Now().UnixNano())
+	t.lastBeat.Store(last)
+	runCtx, cancel := context.WithCancel(context.WithValue(ctx, beatKey{}, last))
+	defer cancel()
+
+	s.setUp(t, true, "")
+
+	done := make(chan error, 1)
+	panicked := make(chan any, 1)
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				s.log.Error("subsystem panicked", "subsystem", t.name, "panic", p, "stack", string(debug.Stack()))
+				panicked <- p
+			}
+		}()
+		done <- t.run(runCtx)
+	}()
+
+	var check <-chan time.Time
+	if t.stall > 0 {
+		ticker := time.NewTicker(min(t.stall/4, time.Minute))
+		defer ticker.Stop()
+		check = ticker.C
+	}
+	for {
+		select {
+		case err := <-done:
+			return ReasonExited, err
+		case p := <-panicked:
+			return ReasonPanic, fmt.Errorf("panic: %v", p)
+		case <-check:
+			idle := time.Since(time.Unix(0, last.Load()))
+			if idle < t.stall {
+				continue
+			}
+			cancel()
+			select {
+			case <-done:
+			case <-panicked:
+			case <-time.After(stopGrace):
+				s.log.Error("wedged subsystem did not stop, abandoning it", "subsystem", t.name)
+			}
+			return ReasonStalled, fmt.Errorf("no progress for %s", idle.Round(time.Second))
+		}
+	}
+}
+
+func (s *Supervisor) setUp(t *task, up bool, lastErr string) {
+	t.mu.Lock()
+	t.up = up
+	if lastErr != "" {
+		t.lastErr = lastErr
+	}
+	t.mu.Unlock()
+	v := 0.0
+	if up {
+		v = 1
+	}
+	s.up.Set(v, t.name)
+}
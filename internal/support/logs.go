@@ -0,0 +1,48 @@
+package support
+
+import (
+	"bytes"
+	"sync"
+)
+
+// LogRing keeps the most recent log lines in memory for bundles. Use it as
+// an extra writer for the control plane's log handler.
+type LogRing struct {
+	mu    sync.Mutex
+	lines [][]byte
+	next  int
+	full  bool
+}
+
+// NewLogRing keeps the last size lines.
+func NewLogRing(size int) *LogRing {
+	return &LogRing{lines: make([][]byte, size)}
+}
+
+// Write stores p, which slog handlers write one record at a time.
+func (l *LogRing) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines[l.next] = bytes.Clone(p)
+	l.next = (l.next + 1) % len(l.lines)
+	if l.next == 0 {
+		l.full = true
+	}
+	return len(p), nil
+}
+
+// Bytes returns the kept lines, oldest first.
+func (l *LogRing) Bytes() []byte {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var buf bytes.Buffer
+	if l.full {
+		for _, line := range l.lines[l.next:] {
+			buf.Write(line)
+		}
+	}
+	for _, line := range l.lines[:l.next] {
+		buf.Write(line)
+	}
+	return buf.Bytes()
+}
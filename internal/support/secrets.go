@@ -0,0 +1,87 @@
+package support
+
+import (
+	"strings"
+
+	"github.com/envoyage/envoyage/internal/config"
+	"github.com/envoyage/envoyage/internal/registry"
+)
+
+// Secrets lists the secret values in the config and the registry, including
+// ones only left in the change history (a revoked share link, an old
+// password), for NewBundle to redact wherever they appear.
+func Secrets(cfg *config.Config, services []*registry.Service, history []registry.Change) []string {
+	var out []string
+	if cfg.API != nil {
+		out = append(out, cfg.API.TokenSHA256)
+	}
+	if cfg.Portal != nil {
+		for _, u := range cfg.Portal.Users {
+			out = append(out, u.TokenSHA256)
+		}
+	}
+	if cfg.Challenge != nil {
+		out = append(out, cfg.Challenge.Secret)
+	}
+	if cfg.TLS != nil {
+		out = append(out, cfg.TLS.EdgeSecret)
+	}
+	// Slack and ntfy webhook URLs are secrets themselves.
+	for _, w := range cfg.Webhooks {
+		out = append(out, w.URL, w.Secret)
+		for _, v := range w.Headers {
+			out = append(out, v)
+		}
+	}
+	if n := cfg.Notify; n != nil {
+		// So are public ntfy topics.
+		for _, t := range n.Ntfy {
+			out = append(out, t.Topic, t.Token)
+		}
+		for _, g := range n.Gotify {
+			out = append(out, g.Token)
+		}
+		for _, e := range n.Email {
+			out = append(out, e.Password)
+		}
+	}
+
+	for _, svc := range services {
+		for _, entry := range svc.BasicAuth {
+			out = append(out, basicAuthSecret(entry))
+		}
+		for _, l := range svc.ShareLinks {
+			out = append(out, l.Token)
+		}
+	}
+
+	// History diffs hold services in their JSON form.
+	for _, c := range history {
+		for _, d := range c.Diff {
+			for _, v := range []any{d.From, d.To} {
+				list, _ := v.([]any)
+				for _, item := range list {
+					switch d.Field {
+					case "BasicAuth":
+						if entry, ok := item.(string); ok {
+							out = append(out, basicAuthSecret(entry))
+						}
+					case "ShareLinks":
+						if link, ok := item.(map[string]any); ok {
+							token, _ := link["Token"].(string)
+							out = append(out, token)
+						}
+					}
+				}
+			}
+		}
+	}
+	return out
+}
+
+// basicAuthSecret is the password hash of a "user:hash" entry; the user
+// name stays readable.
+func basicAuthSecret(entry string) string {
+	_, hash, _ := strings.Cut(entry, ":")
+	return hash
+}
@@ -0,0 +1,138 @@
+// Package support builds support bundles: one archive of everything worth
+// attaching to a bug report (config, registry, node status, snapshots,
+// diagnostics and recent logs), with secrets redacted.
+//
+// A bundle is composed of named files, each produced by its own source, so
+// adding to it is one more Add call. A source that fails doesn't fail the
+// bundle: its error goes into errors.txt and the rest is still written.
+package support
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+)
+
+// Redacted replaces every secret in a bundle.
+const Redacted = "REDACTED"
+
+// minSecretLen keeps short values (an empty password, a one-letter token)
+// from redacting unrelated text.
+const minSecretLen = 6
+
+// Bundle collects the files of a support bundle.
+type Bundle struct {
+	dir    string // top-level directory inside the archive
+	now    time.Time
+	redact *strings.Replacer
+	files  []file
+	errs   []string
+}
+
+type file struct {
+	name string
+	data []byte
+}
+
+// NewBundle starts a bundle whose files are redacted of secrets.
+func NewBundle(secrets []string) *Bundle {
+	now := time.Now().UTC().Truncate(time.Second)
+	return &Bundle{
+		dir:    "envoyage-support-" + now.Format("20060102-150405"),
+		now:    now,
+		redact: Redactor(secrets),
+	}
+}
+
+// Redactor returns a replacer of secrets with Redacted, for redacting
+// outside a bundle.
+func Redactor(secrets []string) *strings.Replacer {
+	var pairs []string
+	for _, s := range secrets {
+		if len(s) >= minSecretLen {
+			pairs = append(pairs, s, Redacted)
+		}
+	}
+	return strings.NewReplacer(pairs...)
+}
+
+// Name is the archive's file name.
+func (b *Bundle) Name() string {
+	return b.dir + ".tar.gz"
+}
+
+// Add adds the file produced by src, and records in errors.txt why it
+// couldn't be. A source may return data along with an error, e.g. the body
+// of a failing readiness check; it is kept.
+func (b *Bundle) Add(name string, src func() ([]byte, error)) {
+	data, err := src()
+	if err != nil {
+		b.errs = append(b.errs, fmt.Sprintf("%s: %v", name, err))
+	}
+	if data == nil {
+		return
+	}
+	b.files = append(b.files, file{name: name, data: []byte(b.redact.Replace(string(data)))})
+}
+
+// API is a source that fetches path from the management API in process,
+// so a bundle file reads exactly like the endpoint it came from.
+func API(h http.Handler, path string) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code/100 != 2 {
+			return rec.Body.Bytes(), fmt.Errorf("GET %s: %s", path, http.StatusText(rec.Code))
+		}
+		return rec.Body.Bytes(), nil
+	}
+}
+
+// WriteTo writes the bundle as a gzipped tarball.
+func (b *Bundle) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	zw := gzip.NewWriter(cw)
+	tw := tar.NewWriter(zw)
+
+	files := b.files
+	if len(b.errs) > 0 {
+		files = append(files[:len(files):len(files)], file{name: "errors.txt", data: []byte(strings.Join(b.errs, "\n") + "\n")})
+	}
+	for _, f := range files {
+		hdr := &tar.Header{
+			Name:    b.dir + "/" + f.name,
+			Mode:    0o644,
+			Size:    int64(len(f.data)),
+			ModTime: b.now,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return cw.n, fmt.Errorf("writing %s: %w", f.name, err)
+		}
+		if _, err := tw.Write(f.data); err != nil {
+			return cw.n, fmt.Errorf("writing %s: %w", f.name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return cw.n, err
+	}
+	if err := zw.Close(); err != nil {
+		return cw.n, err
+	}
+	return cw.n, nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,155 @@
+package tracing
+
+import (
+	"cmp"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	accesslogdata "github.com/envoyproxy/go-control-plane/envoy/data/accesslog/v3"
+	alsv3 "github.com/envoyproxy/go-control-plane/envoy/service/accesslog/v3"
+	"google.golang.org/grpc"
+
+	"github.com/envoyage/envoyage/internal/config"
+)
+
+// exemplarsPerService is how many recent exemplars are kept per service.
+const exemplarsPerService = 20
+
+// Exemplar is one failed or slow traced request.
+type Exemplar struct {
+	TraceID    string    `json:"trace_id"`
+	URL        string    `json:"url,omitempty"` // into the tracing backend; empty without trace_url
+	Time       time.Time `json:"time"`
+	Node       string    `json:"node"`
+	Client     string    `json:"client,omitempty"` // downstream address; scrubbed in privacy mode
+	User       string    `json:"user,omitempty"`   // as vouched for by the auth service
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Status     uint32    `json:"status"`
+	DurationMS int64     `json:"duration_ms"`
+	Reason     string    `json:"reason"` // "error" or "slow"
+}
+
+// Exemplars receives the exemplar access log that every Envoy streams to
+// the control plane when Envoy tracing is on (see xds), and keeps the most
+// recent ones per service. A request crossing edge and home is logged by
+// both; it is kept once, as first seen.
+type Exemplars struct {
+	alsv3.UnimplementedAccessLogServiceServer
+
+	cfg     *config.EnvoyTracing
+	privacy *Privacy
+
+	mu        sync.Mutex
+	byService map[string][]Exemplar // oldest first
+}
+
+// NewExemplars creates an empty exemplar store. privacy may be nil.
+func NewExemplars(cfg *config.EnvoyTracing, privacy *Privacy) *Exemplars {
+	return &Exemplars{cfg: cfg, privacy: privacy, byService: make(map[string][]Exemplar)}
+}
+
+// Register adds the access log service to a gRPC server.
+func (e *Exemplars) Register(g *grpc.Server) {
+	alsv3.RegisterAccessLogServiceServer(g, e)
+}
+
+// StreamAccessLogs implements the access log service. Envoy sends its
+// identifier on the first message of a stream only.
+func (e *Exemplars) StreamAccessLogs(stream alsv3.AccessLogService_StreamAccessLogsServer) error {
+	var node string
+	for {
+		msg, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return stream.SendAndClose(&alsv3.StreamAccessLogsResponse{})
+		}
+		if err != nil {
+			return err
+		}
+		if id := msg.GetIdentifier(); id != nil {
+			node = id.GetNode().GetId()
+		}
+		for _, entry := range msg.GetHttpLogs().GetLogEntry() {
+			e.record(node, entry)
+		}
+	}
+}
+
+// Recent returns a service's exemplars, newest first.
+func (e *Exemplars) Recent(service string) []Exemplar {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	kept := e.byService[service]
+	out := make([]Exemplar, len(kept))
+	for i, ex := range kept {
+		out[len(kept)-1-i] = ex
+	}
+	return out
+}
+
+func (e *Exemplars) record(node string, entry *accesslogdata.HTTPAccessLogEntry) {
+	common := entry.GetCommonProperties()
+	service, ok := strings.CutPrefix(common.GetUpstreamCluster(), "cluster_")
+	if !ok {
+		return
+	}
+	headers := entry.GetRequest().GetRequestHeaders()
+	traceID, ok := sampledTraceID(headers["traceparent"])
+	if !ok {
+		return
+	}
+
+	ex := Exemplar{
+		TraceID: traceID,
+		Time:    common.GetStartTime().AsTime(),
+		Node:    node,
+		Client:  common.GetDownstreamRemoteAddress().GetSocketAddress().GetAddress(),
+		User:    cmp.Or(headers["remote-user"], headers["x-auth-request-user"]),
+		Method:  entry.GetRequest().GetRequestMethod().String(),
+		Path:    entry.GetRequest().GetPath(),
+		Status:  entry.GetResponse().GetResponseCode().GetValue(),
+		Reason:  "slow",
+	}
+	if d := common.GetTimeToLastDownstreamTxByte(); d != nil {
+		ex.DurationMS = d.AsDuration().Milliseconds()
+	}
+	if ex.Status >= 500 || ex.Status == 0 {
+		ex.Reason = "error"
+	}
+	e.privacy.scrub(service, &ex)
+	if e.cfg.TraceURL != "" {
+		ex.URL = strings.ReplaceAll(e.cfg.TraceURL, "{trace_id}", traceID)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	kept := e.byService[service]
+	for _, k := range kept {
+		if k.TraceID == traceID {
+			return
+		}
+	}
+	if len(kept) == exemplarsPerService {
+		kept = kept[1:]
+	}
+	e.byService[service] = append(kept, ex)
+}
+
+// sampledTraceID extracts the trace ID from a W3C traceparent header
+// ("00-<trace id>-<parent id>-<flags>"). Unsampled traces were never
+// exported, so a link to them would lead nowhere.
+func sampledTraceID(traceparent string) (string, bool) {
+	parts := strings.Split(traceparent, "-")
+	if len(parts) < 4 || len(parts[1]) != 32 || len(parts[3]) != 2 {
+		return "", false
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil || flags&0x01 == 0 {
+		return "", false
+	}
+	return parts[1], true
+}
@@ -0,0 +1,70 @@
+package tracing
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/envoyage/envoyage/internal/config"
+)
+
+// Privacy scrubs the exemplars of services in privacy mode (see
+// config.Privacy) before they are kept.
+type Privacy struct {
+	cfg     config.Privacy
+	private func(service string) bool
+
+	// key makes client hashes impossible to reverse by hashing every
+	// address, and unlinkable across restarts.
+	key []byte
+}
+
+// NewPrivacy returns the privacy mode for cfg, which may be nil. private
+// reports whether a service set privacy itself.
+func NewPrivacy(cfg *config.Privacy, private func(service string) bool) (*Privacy, error) {
+	p := &Privacy{cfg: config.Privacy{ClientIP: config.ClientIPTruncate}, private: private}
+	if cfg != nil {
+		p.cfg = *cfg
+	}
+	if p.cfg.ClientIP == config.ClientIPHash {
+		p.key = make([]byte, 32)
+		if _, err := rand.Read(p.key); err != nil {
+			return nil, fmt.Errorf("generating client hash key: %w", err)
+		}
+	}
+	return p, nil
+}
+
+// scrub removes the personal data of ex if service is in privacy mode.
+func (p *Privacy) scrub(service string, ex *Exemplar) {
+	if p == nil || !p.cfg.All && (p.private == nil || !p.private(service)) {
+		return
+	}
+	ex.Path, _, _ = strings.Cut(ex.Path, "?")
+	ex.User = ""
+	if ex.Client != "" {
+		ex.Client = p.client(ex.Client)
+	}
+}
+
+func (p *Privacy) client(addr string) string {
+	if p.cfg.ClientIP == config.ClientIPHash {
+		mac := hmac.New(sha256.New, p.key)
+		mac.Write([]byte(addr))
+		return hex.EncodeToString(mac.Sum(nil)[:8])
+	}
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return ""
+	}
+	bits := 48
+	if ip.Is4() || ip.Is4In6() {
+		ip, bits = ip.Unmap(), 24
+	}
+	prefix, _ := ip.Prefix(bits)
+	return prefix.Addr().String()
+}
@@ -0,0 +1,46 @@
+// Package tracing sets up OpenTelemetry for the control plane process.
+//
+// Spans are created with the global tracer provider (otel.Tracer) throughout
+// the code base. Until Setup installs an exporter that provider is a no-op,
+// so instrumented code costs nothing when tracing is off.
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// ServiceName identifies the control plane in traces.
+const ServiceName = "envoyage-controlplane"
+
+// Setup installs an OTLP/HTTP exporter to endpoint (host:port) as the global
+// tracer provider. An empty endpoint leaves tracing disabled. The returned
+// function flushes and stops the exporter; it is never nil.
+func Setup(ctx context.Context, endpoint string) (shutdown func(context.Context) error, err error) {
+	if endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exp, err := otlptracehttp.New(ctx,
+		otlptracehttp.WithEndpoint(endpoint),
+		otlptracehttp.WithInsecure(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("creating OTLP exporter: %w", err)
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(ServiceName))),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return tp.Shutdown, nil
+}
@@ -0,0 +1,133 @@
+package tsdb
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/envoyage/envoyage/internal/registry"
+	"github.com/envoyage/envoyage/internal/stats"
+	"github.com/envoyage/envoyage/internal/supervisor"
+)
+
+// Stats is the part of stats.Scraper the recorder samples.
+type Stats interface {
+	Service(name string) map[string]map[string]uint64
+}
+
+// counters are one node's cumulative counters for one cluster.
+type counters struct {
+	requests, errors uint64
+}
+
+// Recorder samples every service's counters once a step and appends the
+// difference to the DB.
+//
+// A public request is counted by the edge and again by home, so a service's
+// numbers are the busiest node's rather than a sum: home sees every
+// request, LAN ones included.
+type Recorder struct {
+	db    *DB
+	reg   *registry.Registry
+	stats Stats
+	step  time.Duration
+	log   *slog.Logger
+
+	// prev holds the counters of the last sample, by cluster and then node.
+	prev map[string]map[string]counters
+}
+
+// NewRecorder creates a Recorder that samples st every step.
+func NewRecorder(db *DB, reg *registry.Registry, st Stats, step time.Duration, log *slog.Logger) *Recorder {
+	return &Recorder{db: db, reg: reg, stats: st, step: step, log: log, prev: make(map[string]map[string]counters)}
+}
+
+// Run samples at every multiple of the step until ctx is canceled.
+func (r *Recorder) Run(ctx context.Context) {
+	for {
+		next := time.Now().Truncate(r.step).Add(r.step)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(next)):
+		}
+		if err := r.db.Append(r.sample(next.Add(-r.step))); err != nil {
+			r.log.Warn("recording history failed", "error", err)
+		}
+		supervisor.Beat(ctx)
+	}
+}
+
+// sample returns each service's traffic since the previous sample, stamped
+// with start. Services seen for the first time have no previous counters
+// and are left out.
+func (r *Recorder) sample(start time.Time) map[string]Point {
+	services, _ := r.reg.Snapshot()
+	out := make(map[string]Point)
+	seen := make(map[string]bool)
+	for _, svc := range services {
+		// The canary's and the edge copies' requests are the service's too.
+		byNode := make(map[string]Point)
+		for _, cluster := range []string{svc.Name, svc.Name + stats.CanarySuffix, svc.Name + stats.LocalSuffix} {
+			seen[cluster] = true
+			for node, d := range r.delta(cluster) {
+				p := byNode[node]
+				p.Requests += d.Requests
+				p.Errors += d.Errors
+				p.P95 = max(p.P95, d.P95)
+				byNode[node] = p
+			}
+		}
+		if len(byNode) == 0 {
+			continue
+		}
+		p := Point{Time: start}
+		for _, n := range byNode {
+			if n.Requests > p.Requests {
+				p.Requests, p.Errors = n.Requests, n.Errors
+			}
+			p.P95 = max(p.P95, n.P95)
+		}
+		out[svc.Name] = p
+	}
+	for cluster := range r.prev {
+		if !seen[cluster] {
+			delete(r.prev, cluster)
+		}
+	}
+	return out
+}
+
+// delta returns, per node, a cluster's counters since the previous sample
+// and its current p95.
+func (r *Recorder) delta(cluster string) map[string]Point {
+	out := make(map[string]Point)
+	cur := r.stats.Service(cluster)
+	prev := r.prev[cluster]
+	next := make(map[string]counters, len(cur))
+	for node, st := range cur {
+		c := counters{requests: st[stats.StatRqCompleted], errors: st[stats.StatRq5xx]}
+		next[node] = c
+		before, ok := prev[node]
+		if !ok {
+			continue
+		}
+		out[node] = Point{
+			Requests: since(c.requests, before.requests),
+			Errors:   since(c.errors, before.errors),
+			P95:      st[stats.StatRqTimeP95],
+		}
+	}
+	if len(next) > 0 {
+		r.prev[cluster] = next
+	}
+	return out
+}
+
+// since is the increase of a counter, which resets when Envoy restarts.
+func since(cur, prev uint64) uint64 {
+	if cur < prev {
+		return cur
+	}
+	return cur - prev
+}
@@ -0,0 +1,308 @@
+// Package tsdb keeps a small history of per-service traffic: requests,
+// 5xx errors and p95 latency at a fixed step, for a configurable
+// retention. It is not a Prometheus replacement, just enough for the
+// dashboard to chart the last days without one.
+//
+// Samples live in memory and, with a directory, in one append-only file per
+// UTC day:
+//
+//	history/2026-01-02.jsonl
+//	{"t":1767312000,"s":"gitea","rq":120,"err":2,"p95":85}
+//
+// Expired days are deleted whole, so a write is always a small append and
+// nothing is ever rewritten. A line cut short by a crash is skipped on load.
+package tsdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// segmentLayout names a day's file, without its extension.
+const segmentLayout = "2006-01-02"
+
+const segmentExt = ".jsonl"
+
+// Point is one service's traffic over a step, or over a bucket of steps in
+// a query.
+type Point struct {
+	Time     time.Time `json:"time"` // start of the step
+	Requests uint64    `json:"requests"`
+	Errors   uint64    `json:"errors"` // requests answered with a 5xx
+	// P95 is the p95 upstream latency Envoy reports, in milliseconds; 0
+	// if unknown. A bucket has the highest of its steps.
+	P95 uint64 `json:"p95_ms"`
+}
+
+// record is a Point as stored on disk.
+type record struct {
+	Time     int64  `json:"t"`
+	Service  string `json:"s"`
+	Requests uint64 `json:"rq"`
+	Errors   uint64 `json:"err"`
+	P95      uint64 `json:"p95"`
+}
+
+// DB is the store. It is safe for concurrent use.
+type DB struct {
+	dir       string // empty keeps samples in memory only
+	retention time.Duration
+	now       func() time.Time
+
+	mu      sync.RWMutex
+	series  map[string][]Point // by service, oldest first
+	segment *os.File           // the current day's file, open for appends
+	day     string             // the current day, in segmentLayout
+}
+
+// Open loads the samples in dir that are within retention and deletes
+// older files. An empty dir keeps samples in memory only.
+func Open(dir string, retention time.Duration) (*DB, error) {
+	db := &DB{
+		dir:       dir,
+		retention: retention,
+		now:       time.Now,
+		series:    make(map[string][]Point),
+	}
+	if dir == "" {
+		return db, nil
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating history directory: %w", err)
+	}
+	if err := db.prune(); err != nil {
+		return nil, err
+	}
+
+	days, err := db.segments()
+	if err != nil {
+		return nil, err
+	}
+	cutoff := db.now().Add(-retention)
+	for _, day := range days {
+		if err := db.load(day, cutoff); err != nil {
+			return nil, err
+		}
+	}
+	for name, points := range db.series {
+		sort.Slice(points, func(i, j int) bool { return points[i].Time.Before(points[j].Time) })
+		db.series[name] = points
+	}
+	return db, nil
+}
+
+// Close closes the current day's file.
+func (db *DB) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.segment == nil {
+		return nil
+	}
+	err := db.segment.Close()
+	db.segment = nil
+	return err
+}
+
+// Append stores one step of every service's traffic, keyed by service
+// name; each Point's Time is the step's start.
+func (db *DB) Append(points map[string]Point) error {
+	if len(points) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(points))
+	for name := range points {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	cutoff := db.now().Add(-db.retention)
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, name := range names {
+		p := points[name]
+		p.Time = p.Time.UTC()
+		db.series[name] = append(trim(db.series[name], cutoff), p)
+		enc.Encode(record{Time: p.Time.Unix(), Service: name, Requests: p.Requests, Errors: p.Errors, P95: p.P95})
+	}
+	for name, series := range db.series {
+		if _, ok := points[name]; !ok {
+			if series = trim(series, cutoff); len(series) == 0 {
+				delete(db.series, name) // a removed service, aged out
+			} else {
+				db.series[name] = series
+			}
+		}
+	}
+
+	if db.dir == "" {
+		return nil
+	}
+	f, err := db.current()
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("writing history: %w", err)
+	}
+	return nil
+}
+
+// Query returns a service's traffic between from and to in buckets of
+// step, aligned to multiples of step: requests and errors are summed, p95
+// is the highest. Buckets without samples are left out.
+func (db *DB) Query(service string, from, to time.Time, step time.Duration) []Point {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	points := db.series[service]
+	i := sort.Search(len(points), func(i int) bool { return !points[i].Time.Before(from) })
+	out := []Point{}
+	for ; i < len(points) && points[i].Time.Before(to); i++ {
+		p := points[i]
+		start := p.Time.Truncate(step)
+		if n := len(out); n > 0 && out[n-1].Time.Equal(start) {
+			out[n-1].Requests += p.Requests
+			out[n-1].Errors += p.Errors
+			out[n-1].P95 = max(out[n-1].P95, p.P95)
+			continue
+		}
+		p.Time = start
+		out = append(out, p)
+	}
+	return out
+}
+
+// current returns the day's file, switching to a new one (and deleting
+// expired ones) when the day changed. The caller holds mu.
+func (db *DB) current() (*os.File, error) {
+	day := db.now().UTC().Format(segmentLayout)
+	if db.segment != nil && db.day == day {
+		return db.segment, nil
+	}
+	if db.segment != nil {
+		db.segment.Close()
+		db.segment = nil
+	}
+	if err := db.prune(); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(db.dir, day+segmentExt), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("opening history file: %w", err)
+	}
+	if err := endLine(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	db.segment, db.day = f, day
+	return f, nil
+}
+
+// segments lists the days that have a file, oldest first.
+func (db *DB) segments() ([]string, error) {
+	entries, err := os.ReadDir(db.dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading history directory: %w", err)
+	}
+	var days []string
+	for _, e := range entries {
+		day, ok := strings.CutSuffix(e.Name(), segmentExt)
+		if !ok || e.IsDir() {
+			continue
+		}
+		if _, err := time.Parse(segmentLayout, day); err != nil {
+			continue
+		}
+		days = append(days, day)
+	}
+	sort.Strings(days)
+	return days, nil
+}
+
+// prune deletes the files of days that ended before the retention.
+func (db *DB) prune() error {
+	days, err := db.segments()
+	if err != nil {
+		return err
+	}
+	cutoff := db.now().Add(-db.retention)
+	for _, day := range days {
+		start, _ := time.Parse(segmentLayout, day)
+		if start.Add(24 * time.Hour).After(cutoff) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(db.dir, day+segmentExt)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("removing expired history: %w", err)
+		}
+	}
+	return nil
+}
+
+// load reads a day's file into memory, skipping samples before cutoff and
+// lines that don't parse.
+func (db *DB) load(day string, cutoff time.Time) error {
+	f, err := os.Open(filepath.Join(db.dir, day+segmentExt))
+	if err != nil {
+		return fmt.Errorf("reading history: %w", err)
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var r record
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil || r.Service == "" {
+			continue
+		}
+		t := time.Unix(r.Time, 0).UTC()
+		if t.Before(cutoff) {
+			continue
+		}
+		db.series[r.Service] = append(db.series[r.Service], Point{Time: t, Requests: r.Requests, Errors: r.Errors, P95: r.P95})
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("reading history %s: %w", day, err)
+	}
+	return nil
+}
+
+// endLine terminates a line cut short by a crash, so the next record
+// doesn't run into it.
+func endLine(f *os.File) error {
+	info, err := f.Stat()
+	if err != nil || info.Size() == 0 {
+		return err
+	}
+	r, err := os.Open(f.Name())
+	if err != nil {
+		return fmt.Errorf("reading history file: %w", err)
+	}
+	defer r.Close()
+	last := make([]byte, 1)
+	if _, err := r.ReadAt(last, info.Size()-1); err != nil {
+		return fmt.Errorf("reading history file: %w", err)
+	}
+	if last[0] != '\n' {
+		if _, err := f.Write([]byte{'\n'}); err != nil {
+			return fmt.Errorf("writing history: %w", err)
+		}
+	}
+	return nil
+}
+
+// trim drops the points before cutoff.
+func trim(points []Point, cutoff time.Time) []Point {
+	i := sort.Search(len(points), func(i int) bool { return !points[i].Time.Before(cutoff) })
+	return points[i:]
+}
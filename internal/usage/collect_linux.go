@@ -0,0 +1,160 @@
+package usage
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Collector samples the host the agent runs on. In a container, mount the
+// host's /proc and root filesystem read-only and point Proc and Disk at them,
+// and use the host network so the tunnel interface is visible.
+type Collector struct {
+	Proc   string // procfs mount, usually /proc
+	Disk   string // any path on the filesystem to report
+	Tunnel string // tunnel interface name, e.g. wg0 or tailscale0; empty for none
+
+	// CPU time counters from the previous sample; CPU usage is the busy
+	// share of the time between two samples.
+	prevBusy, prevTotal uint64
+}
+
+// Collect takes a sample. The first one reports CPU as 0: there is no
+// previous sample to compare with yet.
+func (c *Collector) Collect() (Report, error) {
+	var r Report
+	var err error
+	if r.CPU, err = c.cpu(); err != nil {
+		return Report{}, err
+	}
+	if r.MemoryUsed, r.MemoryTotal, err = c.memory(); err != nil {
+		return Report{}, err
+	}
+
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(c.Disk, &st); err != nil {
+		return Report{}, fmt.Errorf("statfs %s: %w", c.Disk, err)
+	}
+	r.DiskTotal = st.Blocks * uint64(st.Bsize)
+	r.DiskUsed = (st.Blocks - st.Bfree) * uint64(st.Bsize)
+
+	if c.Tunnel != "" {
+		if r.Tunnel, err = c.tunnel(); err != nil {
+			return Report{}, err
+		}
+	}
+	return r, nil
+}
+
+// cpu reads the aggregate line of /proc/stat:
+// "cpu user nice system idle iowait irq softirq steal ...".
+func (c *Collector) cpu() (float64, error) {
+	path := filepath.Join(c.Proc, "stat")
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	if !sc.Scan() {
+		return 0, fmt.Errorf("%s: empty", path)
+	}
+	fields := strings.Fields(sc.Text())
+	if len(fields) < 5 || fields[0] != "cpu" {
+		return 0, fmt.Errorf("%s: unexpected first line %q", path, sc.Text())
+	}
+	var total, idle uint64
+	for i, f := range fields[1:] {
+		if i >= 8 {
+			break // guest time is already counted in user and nice
+		}
+		n, err := strconv.ParseUint(f, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", path, err)
+		}
+		total += n
+		if i == 3 || i == 4 { // idle, iowait
+			idle += n
+		}
+	}
+	busy := total - idle
+
+	prevBusy, prevTotal := c.prevBusy, c.prevTotal
+	c.prevBusy, c.prevTotal = busy, total
+	if prevTotal == 0 || total <= prevTotal || busy < prevBusy {
+		return 0, nil
+	}
+	return min(float64(busy-prevBusy)/float64(total-prevTotal), 1), nil
+}
+
+// memory reads MemTotal and MemAvailable from /proc/meminfo (in KiB).
+func (c *Collector) memory() (used, total uint64, err error) {
+	path := filepath.Join(c.Proc, "meminfo")
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	var available uint64
+	var haveTotal, haveAvailable bool
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		key, rest, ok := strings.Cut(sc.Text(), ":")
+		if !ok || (key != "MemTotal" && key != "MemAvailable") {
+			continue
+		}
+		fields := strings.Fields(rest)
+		if len(fields) == 0 {
+			continue
+		}
+		kib, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("%s: %s: %w", path, key, err)
+		}
+		if key == "MemTotal" {
+			total, haveTotal = kib*1024, true
+		} else {
+			available, haveAvailable = kib*1024, true
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return 0, 0, fmt.Errorf("%s: %w", path, err)
+	}
+	if !haveTotal || !haveAvailable {
+		return 0, 0, fmt.Errorf("%s: MemTotal or MemAvailable missing", path)
+	}
+	return total - min(available, total), total, nil
+}
+
+// tunnel reads the interface's line of /proc/net/dev:
+// "  wg0: rx_bytes rx_packets ... (8 rx fields) tx_bytes ...".
+func (c *Collector) tunnel() (*Tunnel, error) {
+	path := filepath.Join(c.Proc, "net", "dev")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		name, rest, ok := strings.Cut(line, ":")
+		if !ok || strings.TrimSpace(name) != c.Tunnel {
+			continue
+		}
+		fields := strings.Fields(rest)
+		if len(fields) < 9 {
+			return nil, fmt.Errorf("%s: short line for %s", path, c.Tunnel)
+		}
+		rx, err1 := strconv.ParseUint(fields[0], 10, 64)
+		tx, err2 := strconv.ParseUint(fields[8], 10, 64)
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("%s: bad counters for %s", path, c.Tunnel)
+		}
+		return &Tunnel{Interface: c.Tunnel, RxBytes: rx, TxBytes: tx}, nil
+	}
+	return nil, fmt.Errorf("interface %s not found in %s (is the agent on the host network?)", c.Tunnel, path)
+}
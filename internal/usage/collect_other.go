@@ -0,0 +1,17 @@
+//go:build !linux
+
+package usage
+
+import "errors"
+
+// Collector samples the host the agent runs on. Only Linux is supported.
+type Collector struct {
+	Proc   string
+	Disk   string
+	Tunnel string
+}
+
+// Collect always fails outside Linux.
+func (c *Collector) Collect() (Report, error) {
+	return Report{}, errors.New("collecting host usage is only supported on Linux")
+}
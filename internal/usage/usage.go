@@ -0,0 +1,153 @@
+// Package usage tracks the host resources of each node.
+//
+// Every node can run envoyage-agent next to its Envoy. The agent samples the
+// host's CPU, memory, disk and tunnel interface (see Collector) and reports
+// them to the control plane at POST /nodes/{id}/usage. The control plane
+// keeps the latest report per node in a Store, lists it in GET /nodes and
+// republishes it as metrics, so a VPS running out of memory or bandwidth
+// shows up in the same place as its routes.
+package usage
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/envoyage/envoyage/internal/metrics"
+)
+
+// Report is one sample of a node's host.
+type Report struct {
+	// Time is when the control plane received the report; agents' clocks
+	// are not trusted.
+	Time time.Time `json:"time"`
+
+	// CPU is the fraction of all cores busy since the previous sample, 0-1.
+	CPU float64 `json:"cpu"`
+
+	MemoryUsed  uint64 `json:"memory_used_bytes"` // total minus available
+	MemoryTotal uint64 `json:"memory_total_bytes"`
+	DiskUsed    uint64 `json:"disk_used_bytes"` // of the filesystem the agent watches
+	DiskTotal   uint64 `json:"disk_total_bytes"`
+
+	// Tunnel is the traffic through the tunnel interface (e.g. wg0); nil if
+	// the agent watches none.
+	Tunnel *Tunnel `json:"tunnel,omitempty"`
+}
+
+// Tunnel holds an interface's byte counters since it came up.
+type Tunnel struct {
+	Interface string `json:"interface"`
+	RxBytes   uint64 `json:"rx_bytes"`
+	TxBytes   uint64 `json:"tx_bytes"`
+}
+
+// Validate rejects reports that can't be right.
+func (r *Report) Validate() error {
+	switch {
+	case r.CPU < 0 || r.CPU > 1:
+		return errors.New("cpu must be between 0 and 1")
+	case r.MemoryUsed > r.MemoryTotal:
+		return errors.New("memory used exceeds total")
+	case r.DiskUsed > r.DiskTotal:
+		return errors.New("disk used exceeds total")
+	case r.Tunnel != nil && r.Tunnel.Interface == "":
+		return errors.New("tunnel interface is required")
+	}
+	return nil
+}
+
+// Store keeps the latest report of every node.
+type Store struct {
+	now func() time.Time
+
+	cpu         *metrics.Vec
+	memoryUsed  *metrics.Vec
+	memoryTotal *metrics.Vec
+	diskUsed    *metrics.Vec
+	diskTotal   *metrics.Vec
+	tunnelRx    *metrics.Vec
+	tunnelTx    *metrics.Vec
+
+	mu     sync.RWMutex
+	latest map[string]Report
+}
+
+// NewStore creates an empty Store that publishes into m.
+func NewStore(m *metrics.Registry) *Store {
+	return &Store{
+		now: time.Now,
+		cpu: m.NewVec("envoyage_node_cpu_ratio",
+			"Fraction of the node host's CPU in use, as last reported by its agent.",
+			metrics.Gauge, "node"),
+		memoryUsed: m.NewVec("envoyage_node_memory_used_bytes",
+			"Memory in use on the node host (total minus available).",
+			metrics.Gauge, "node"),
+		memoryTotal: m.NewVec("envoyage_node_memory_total_bytes",
+			"Memory of the node host.",
+			metrics.Gauge, "node"),
+		diskUsed: m.NewVec("envoyage_node_disk_used_bytes",
+			"Disk space in use on the filesystem the node's agent watches.",
+			metrics.Gauge, "node"),
+		diskTotal: m.NewVec("envoyage_node_disk_total_bytes",
+			"Size of the filesystem the node's agent watches.",
+			metrics.Gauge, "node"),
+		tunnelRx: m.NewVec("envoyage_node_tunnel_rx_bytes_total",
+			"Bytes received on the node's tunnel interface.",
+			metrics.Counter, "node", "interface"),
+		tunnelTx: m.NewVec("envoyage_node_tunnel_tx_bytes_total",
+			"Bytes sent on the node's tunnel interface.",
+			metrics.Counter, "node", "interface"),
+		latest: make(map[string]Report),
+	}
+}
+
+// Record stores a node's report, stamped with the time it arrived.
+func (s *Store) Record(node string, r Report) {
+	r.Time = s.now()
+
+	s.mu.Lock()
+	prev, hadPrev := s.latest[node]
+	s.latest[node] = r
+	s.mu.Unlock()
+
+	s.cpu.Set(r.CPU, node)
+	s.memoryUsed.Set(float64(r.MemoryUsed), node)
+	s.memoryTotal.Set(float64(r.MemoryTotal), node)
+	s.diskUsed.Set(float64(r.DiskUsed), node)
+	s.diskTotal.Set(float64(r.DiskTotal), node)
+	if hadPrev && prev.Tunnel != nil && (r.Tunnel == nil || r.Tunnel.Interface != prev.Tunnel.Interface) {
+		s.tunnelRx.Delete(node, prev.Tunnel.Interface)
+		s.tunnelTx.Delete(node, prev.Tunnel.Interface)
+	}
+	if t := r.Tunnel; t != nil {
+		s.tunnelRx.Set(float64(t.RxBytes), node, t.Interface)
+		s.tunnelTx.Set(float64(t.TxBytes), node, t.Interface)
+	}
+}
+
+// Latest returns a node's most recent report.
+func (s *Store) Latest(node string) (Report, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	r, ok := s.latest[node]
+	return r, ok
+}
+
+// Forget drops a node's report and metrics, for nodes that are removed.
+func (s *Store) Forget(node string) {
+	s.mu.Lock()
+	r, ok := s.latest[node]
+	delete(s.latest, node)
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+	for _, v := range []*metrics.Vec{s.cpu, s.memoryUsed, s.memoryTotal, s.diskUsed, s.diskTotal} {
+		v.Delete(node)
+	}
+	if r.Tunnel != nil {
+		s.tunnelRx.Delete(node, r.Tunnel.Interface)
+		s.tunnelTx.Delete(node, r.Tunnel.Interface)
+	}
+}
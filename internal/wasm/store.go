@@ -0,0 +1,244 @@
+// Package wasm keeps the Wasm filter modules uploaded to the control plane
+// with PUT /wasm/{name}, for services (registry.Service.Wasm) and the
+// config (config.Wasm.Filters) to run as HTTP filters.
+//
+// Modules are kept in a directory, one <name>.wasm file each, written
+// atomically, so they survive restarts. The instances of an HA pair may
+// share it, but each only reads it when it starts. Each module is known by its name and by the SHA-256 of
+// its code: Envoy fetches large modules by the latter (see xds/wasm.go),
+// so a module replaced under the same name is never mixed up with the one
+// it replaces.
+package wasm
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned for an unknown module.
+var ErrNotFound = errors.New("wasm module not found")
+
+// ErrInvalid wraps an upload that isn't a Wasm module, or a bad name.
+var ErrInvalid = errors.New("invalid wasm module")
+
+// magic starts every Wasm binary module: "\0asm", then version 1.
+var magic = []byte{0x00, 'a', 's', 'm', 0x01, 0x00, 0x00, 0x00}
+
+// nameRe is what a module may be called: it ends up in file and filter
+// names.
+var nameRe = regexp.MustCompile(`^[a-z0-9]([a-z0-9_-]{0,62}[a-z0-9])?$`)
+
+// Module describes an uploaded module.
+type Module struct {
+	Name     string    `json:"name"`
+	SHA256   string    `json:"sha256"`
+	Size     int       `json:"size"`
+	Uploaded time.Time `json:"uploaded"`
+}
+
+type entry struct {
+	Module
+	code []byte
+}
+
+// Store holds the uploaded modules.
+type Store struct {
+	dir string // "" keeps modules in memory only
+
+	mu       sync.RWMutex
+	modules  map[string]*entry
+	onChange []func(context.Context)
+}
+
+// Open returns a store keeping its modules in dir, loading any already
+// there. The directory is created if needed.
+func Open(dir string) (*Store, error) {
+	s := &Store{dir: dir, modules: make(map[string]*entry)}
+	if dir == "" {
+		return s, nil
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating wasm directory: %w", err)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.wasm"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range files {
+		name := strings.TrimSuffix(filepath.Base(path), ".wasm")
+		if !nameRe.MatchString(name) {
+			continue
+		}
+		code, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading wasm module: %w", err)
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading wasm module: %w", err)
+		}
+		s.modules[name] = newEntry(name, code, fi.ModTime())
+	}
+	return s, nil
+}
+
+func newEntry(name string, code []byte, uploaded time.Time) *entry {
+	sum := sha256.Sum256(code)
+	return &entry{
+		Module: Module{Name: name, SHA256: hex.EncodeToString(sum[:]), Size: len(code), Uploaded: uploaded.UTC()},
+		code:   code,
+	}
+}
+
+// ValidateName checks a module name.
+func ValidateName(name string) error {
+	if !nameRe.MatchString(name) {
+		return fmt.Errorf("%w: name must be lowercase letters, digits, hyphens and underscores, at most 64", ErrInvalid)
+	}
+	return nil
+}
+
+// OnChange registers fn to be called after every upload or removal.
+func (s *Store) OnChange(fn func(context.Context)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onChange = append(s.onChange, fn)
+}
+
+// Put adds the module, or replaces the one of the same name.
+func (s *Store) Put(ctx context.Context, name string, code []byte) (Module, error) {
+	if err := ValidateName(name); err != nil {
+		return Module{}, err
+	}
+	if !bytes.HasPrefix(code, magic) {
+		return Module{}, fmt.Errorf("%w: not a Wasm binary module", ErrInvalid)
+	}
+	e := newEntry(name, bytes.Clone(code), time.Now())
+
+	s.mu.Lock()
+	if err := s.write(name, e.code); err != nil {
+		s.mu.Unlock()
+		return Module{}, err
+	}
+	s.modules[name] = e
+	s.mu.Unlock()
+
+	s.changed(ctx)
+	return e.Module, nil
+}
+
+// Delete removes the module.
+func (s *Store) Delete(ctx context.Context, name string) error {
+	s.mu.Lock()
+	if _, ok := s.modules[name]; !ok {
+		s.mu.Unlock()
+		return fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	if s.dir != "" {
+		if err := os.Remove(filepath.Join(s.dir, name+".wasm")); err != nil && !errors.Is(err, os.ErrNotExist) {
+			s.mu.Unlock()
+			return fmt.Errorf("removing wasm module: %w", err)
+		}
+	}
+	delete(s.modules, name)
+	s.mu.Unlock()
+
+	s.changed(ctx)
+	return nil
+}
+
+// Get returns the module called name.
+func (s *Store) Get(name string) (Module, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e, ok := s.modules[name]
+	if !ok {
+		return Module{}, false
+	}
+	return e.Module, true
+}
+
+// Has reports whether a module called name is uploaded.
+func (s *Store) Has(name string) bool {
+	_, ok := s.Get(name)
+	return ok
+}
+
+// Lookup returns the module called name, and its code.
+func (s *Store) Lookup(name string) (Module, []byte, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e, ok := s.modules[name]
+	if !ok {
+		return Module{}, nil, false
+	}
+	return e.Module, e.code, true
+}
+
+// CodeBySum returns the code of the module whose SHA-256 is sum, in hex.
+func (s *Store) CodeBySum(sum string) ([]byte, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, e := range s.modules {
+		if e.SHA256 == sum {
+			return e.code, true
+		}
+	}
+	return nil, false
+}
+
+// List returns every module, by name.
+func (s *Store) List() []Module {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make([]Module, 0, len(s.modules))
+	for _, e := range s.modules {
+		out = append(out, e.Module)
+	}
+	slices.SortFunc(out, func(a, b Module) int { return strings.Compare(a.Name, b.Name) })
+	return out
+}
+
+func (s *Store) changed(ctx context.Context) {
+	s.mu.RLock()
+	fns := s.onChange
+	s.mu.RUnlock()
+	for _, fn := range fns {
+		fn(ctx)
+	}
+}
+
+// write saves a module's code to its file. Caller holds mu.
+func (s *Store) write(name string, code []byte) error {
+	if s.dir == "" {
+		return nil
+	}
+	path := filepath.Join(s.dir, name+".wasm")
+	tmp, err := os.CreateTemp(s.dir, name+".wasm.tmp-*")
+	if err != nil {
+		return fmt.Errorf("writing wasm module: %w", err)
+	}
+	defer os.Remove(tmp.Name()) // no-op after a successful rename
+	if _, err := tmp.Write(code); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing wasm module: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("writing wasm module: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("writing wasm module: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,612 @@
+// Package webhook POSTs a notice to configured URLs when something happens
+// that the people running the control plane want to hear about, without
+// writing a hook script: a service added, changed or removed, a node
+// rejecting its config (a NACK) or losing its ADS stream, an upstream going
+// unhealthy on a node (see stats.NodeHealth), or a TLS certificate renewed
+// or about to expire. The same events go to the other Targets the notifier
+// is given: package notify has ntfy, Gotify and e-mail.
+//
+// A delivery's body is the event as JSON, {"text": ...} for Slack and
+// Mattermost, or the summary line alone for ntfy; see config.Webhook. It
+// carries the headers
+//
+//	X-Envoyage-Event      the event, e.g. service_added
+//	X-Envoyage-Delivery   an ID, the same for every try of the delivery
+//	X-Envoyage-Timestamp  the Unix time of the try
+//	X-Envoyage-Signature  sha256=<hex>, with a secret configured
+//
+// The signature is the HMAC-SHA256, keyed with the secret, of the
+// timestamp, a ".", and the body; a receiver recomputes it and rejects old
+// timestamps to stop replays. A delivery that fails with a network error,
+// a 429 or a 5xx is tried again, backing off, up to the webhook's
+// attempts; other statuses give up at once.
+//
+// Each webhook or target delivers in order from a queue of its own, so a
+// slow one doesn't hold up the others; a queue that fills up drops new
+// events. The notifier runs on the HA leader only and, like the hook
+// engine, tells everything but registry changes by polling, so a flap
+// shorter than pollInterval may go unseen. It only sees certificate files
+// the control plane can read: mount them at the same paths as on the
+// Envoys.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/envoyage/envoyage/internal/config"
+	"github.com/envoyage/envoyage/internal/registry"
+	"github.com/envoyage/envoyage/internal/stats"
+	"github.com/envoyage/envoyage/internal/supervisor"
+)
+
+const (
+	// pollInterval is how often nodes, health and certificates are
+	// checked.
+	pollInterval = 15 * time.Second
+
+	// queueSize bounds the events waiting for one webhook or target.
+	queueSize = 100
+
+	// The backoff between tries of a delivery.
+	minBackoff = time.Second
+	maxBackoff = time.Minute
+)
+
+// Event is what a webhook is told, as its JSON body.
+type Event struct {
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+
+	// Text is a one-line summary, e.g. "service web changed: Upstream".
+	Text string `json:"text"`
+
+	Service string   `json:"service,omitempty"`
+	Version uint64   `json:"version,omitempty"` // registry version after the change
+	Comment string   `json:"comment,omitempty"`
+	Fields  []string `json:"fields,omitempty"` // the changed fields
+
+	Node  string `json:"node,omitempty"`
+	Error string `json:"error,omitempty"` // the NACK
+
+	// Cause and Hint explain upstream_unhealthy; see stats.NodeHealth.
+	Cause string `json:"cause,omitempty"`
+	Hint  string `json:"hint,omitempty"`
+
+	Certificate *Certificate `json:"certificate,omitempty"`
+}
+
+// Title names the event for targets that show one, e.g. "envoyage: node
+// disconnected".
+func (e Event) Title() string {
+	return "envoyage: " + strings.ReplaceAll(e.Event, "_", " ")
+}
+
+// Alert reports whether e needs someone's attention; see
+// config.AlertEvents.
+func (e Event) Alert() bool {
+	return slices.Contains(config.AlertEvents, e.Event)
+}
+
+// Certificate describes a renewed or expiring certificate.
+type Certificate struct {
+	File     string    `json:"file"`
+	Subject  string    `json:"subject"`
+	DNSNames []string  `json:"dns_names,omitempty"`
+	Serial   string    `json:"serial"`
+	NotAfter time.Time `json:"not_after"`
+}
+
+// NodeState is what the notifier watches of a node.
+type NodeState struct {
+	Connected bool
+	Error     string // the latest NACK, "" if none
+}
+
+// Env is what the notifier sees of the rest of the control plane.
+type Env struct {
+	// Nodes returns the state of every managed node; see xds.Server.Sync.
+	// Nil leaves out nack and the node events.
+	Nodes func() map[string]NodeState
+
+	// Health reports upstream health per node; see stats.Scraper.Health.
+	// Nil leaves out the upstream events.
+	Health func(service string) map[string]stats.NodeHealth
+}
+
+// Target is somewhere besides the webhooks that events go.
+type Target interface {
+	// Send makes one try at delivering e, with id the same for every try,
+	// reporting whether a failure is worth another.
+	Send(ctx context.Context, id string, e Event) (retry bool, err error)
+
+	// Delivery is the events the target is sent and how hard each is
+	// tried.
+	Delivery() config.Delivery
+
+	// String names the target in the log, without secrets.
+	String() string
+}
+
+// Notifier delivers events to the webhooks and targets.
+type Notifier struct {
+	cfg        *config.Config
+	certExpiry time.Duration
+	reg        *registry.Registry
+	env        Env
+	log        *slog.Logger
+	client     *http.Client
+	hooks      []*hook
+	poke       chan struct{}
+
+	// What the last poll saw, to tell changes. Only Run uses them.
+	version uint64
+	nodes   map[string]NodeState
+	healthy map[string]map[string]bool // service → node → healthy
+	certs   map[string]string          // file → serial
+	expiry  map[string]bool            // serials warned about
+}
+
+// hook is one webhook or target and its queue.
+type hook struct {
+	target Target
+	cfg    config.Delivery
+	queue  chan delivery
+}
+
+type delivery struct {
+	id    string
+	event Event
+}
+
+// New returns a notifier for cfg.Webhooks and targets.
+func New(cfg *config.Config, reg *registry.Registry, env Env, log *slog.Logger, targets ...Target) *Notifier {
+	n := &Notifier{
+		cfg:        cfg,
+		certExpiry: config.DefaultCertExpiry,
+		reg:        reg,
+		env:        env,
+		log:        log,
+		client:     &http.Client{},
+		poke:       make(chan struct{}, 1),
+	}
+	if cfg.Notify != nil {
+		n.certExpiry = cfg.Notify.CertExpiry
+	}
+	for _, w := range cfg.Webhooks {
+		targets = append(targets, &endpoint{cfg: w, client: n.client})
+	}
+	for _, t := range targets {
+		n.hooks = append(n.hooks, &hook{target: t, cfg: t.Delivery(), queue: make(chan delivery, queueSize)})
+	}
+	return n
+}
+
+// Poke has Run look for registry changes now. Pass it to
+// registry.Registry.OnChange.
+func (n *Notifier) Poke(context.Context) {
+	select {
+	case n.poke <- struct{}{}:
+	default:
+	}
+}
+
+// Run watches for events and delivers them until ctx is done. Only events
+// from after it starts are delivered, but for certificates already close
+// to expiry: on an HA takeover, the old leader has sent the earlier ones.
+func (n *Notifier) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	for _, h := range n.hooks {
+		go n.deliver(ctx, h)
+	}
+
+	_, n.version = n.reg.Snapshot()
+	n.nodes, n.healthy, n.certs, n.expiry = nil, nil, nil, make(map[string]bool)
+	n.pollNodes(false)
+	n.pollHealth(false)
+	n.pollCerts(false)
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		supervisor.Beat(ctx)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-n.poke:
+			n.pollChanges()
+		case <-ticker.C:
+			n.pollChanges()
+			n.pollNodes(true)
+			n.pollHealth(true)
+			n.pollCerts(true)
+		}
+	}
+}
+
+// pollChanges sends the registry changes since the last poll.
+func (n *Notifier) pollChanges() {
+	for _, c := range n.reg.History("") {
+		if c.Version <= n.version {
+			continue
+		}
+		n.version = c.Version
+		e := Event{Service: c.Service, Version: c.Version, Comment: c.Comment, Time: c.Time}
+		switch c.Op {
+		case "add":
+			e.Event = config.WebhookServiceAdded
+			e.Text = fmt.Sprintf("service %s added", c.Service)
+			if to := fieldValue(c.Diff, "Domain"); to != "" {
+				e.Text += ": " + to
+				if up := fieldValue(c.Diff, "Upstream"); up != "" {
+					e.Text += " → " + up
+				}
+			}
+		case "update":
+			e.Event = config.WebhookServiceChanged
+			for _, f := range c.Diff {
+				e.Fields = append(e.Fields, f.Field)
+			}
+			e.Text = fmt.Sprintf("service %s changed: %s", c.Service, strings.Join(e.Fields, ", "))
+		case "remove":
+			e.Event = config.WebhookServiceRemoved
+			e.Text = fmt.Sprintf("service %s removed", c.Service)
+		default:
+			continue
+		}
+		if c.Comment != "" {
+			e.Text += " (" + c.Comment + ")"
+		}
+		n.send(e)
+	}
+}
+
+// fieldValue is the new value of a field in a change, as a string, or "".
+func fieldValue(diff []registry.FieldChange, field string) string {
+	for _, f := range diff {
+		if f.Field == field {
+			if s, ok := f.To.(string); ok {
+				return s
+			}
+		}
+	}
+	return ""
+}
+
+// pollNodes sends each node's new NACKs and connection changes. Without
+// deliver it only records them.
+func (n *Notifier) pollNodes(deliver bool) {
+	if n.env.Nodes == nil {
+		return
+	}
+	nodes := n.env.Nodes()
+	ids := make([]string, 0, len(nodes))
+	for id := range nodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		st := nodes[id]
+		was, seen := n.nodes[id]
+		if !deliver || !seen {
+			continue
+		}
+		if st.Error != "" && st.Error != was.Error {
+			n.send(Event{
+				Event: config.WebhookNACK,
+				Time:  time.Now().UTC(),
+				Text:  fmt.Sprintf("node %s rejected its config: %s", id, st.Error),
+				Node:  id,
+				Error: st.Error,
+			})
+		}
+		switch {
+		case was.Connected && !st.Connected:
+			n.send(Event{
+				Event: config.WebhookNodeDisconnected,
+				Time:  time.Now().UTC(),
+				Text:  fmt.Sprintf("node %s disconnected", id),
+				Node:  id,
+			})
+		case !was.Connected && st.Connected:
+			n.send(Event{
+				Event: config.WebhookNodeConnected,
+				Time:  time.Now().UTC(),
+				Text:  fmt.Sprintf("node %s connected", id),
+				Node:  id,
+			})
+		}
+	}
+	n.nodes = nodes
+}
+
+// pollHealth compares every service's health on every node with the last
+// poll's, as the hook engine does. Without deliver it only records it.
+func (n *Notifier) pollHealth(deliver bool) {
+	if n.env.Health == nil {
+		return
+	}
+	services, _ := n.reg.Snapshot()
+	sort.Slice(services, func(i, j int) bool { return services[i].Name < services[j].Name })
+	healthy := make(map[string]map[string]bool, len(services))
+	for _, svc := range services {
+		nodes := n.env.Health(svc.Name)
+		healthy[svc.Name] = make(map[string]bool, len(nodes))
+		ids := make([]string, 0, len(nodes))
+		for id := range nodes {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			h := nodes[id]
+			ok := h.Cause == "" && h.HealthyHosts > 0
+			healthy[svc.Name][id] = ok
+			was, seen := n.healthy[svc.Name][id]
+			if !deliver || !seen || was == ok {
+				continue
+			}
+			e := Event{Time: time.Now().UTC(), Service: svc.Name, Node: id}
+			if ok {
+				e.Event = config.WebhookUpstreamHealthy
+				e.Text = fmt.Sprintf("service %s is healthy again on %s", svc.Name, id)
+			} else {
+				e.Event = config.WebhookUpstreamUnhealthy
+				e.Cause, e.Hint = h.Cause, h.Hint
+				e.Text = fmt.Sprintf("service %s is unhealthy on %s", svc.Name, id)
+				if h.Hint != "" {
+					e.Text += ": " + h.Hint
+				}
+			}
+			n.send(e)
+		}
+	}
+	n.healthy = healthy
+}
+
+// pollCerts checks the edges' default certificate and the services' own:
+// it sends those that changed, by serial number, and warns once about
+// each that expires within the notify section's cert_expiry. Without
+// deliver it only records the serials; expiry warnings go out either way.
+// Files that can't be read or parsed are skipped.
+func (n *Notifier) pollCerts(deliver bool) {
+	var files []string
+	if n.cfg.TLS != nil {
+		files = append(files, n.cfg.TLS.CertChain)
+	}
+	services, _ := n.reg.Snapshot()
+	for _, svc := range services {
+		if svc.TLS != nil && svc.TLS.CertChain != "" {
+			files = append(files, svc.TLS.CertChain)
+		}
+	}
+	slices.Sort(files)
+	files = slices.Compact(files)
+
+	certs := make(map[string]string, len(files))
+	for _, file := range files {
+		c, err := readCert(file)
+		if err != nil {
+			continue
+		}
+		certs[file] = c.Serial
+		if prev, seen := n.certs[file]; deliver && seen && prev != c.Serial {
+			n.send(Event{
+				Event:       config.WebhookCertRenewed,
+				Time:        time.Now().UTC(),
+				Text:        fmt.Sprintf("certificate %s renewed for %s, valid until %s", file, c.Subject, c.NotAfter.Format(time.DateOnly)),
+				Certificate: c,
+			})
+		}
+		if left := time.Until(c.NotAfter); left < n.certExpiry && !n.expiry[c.Serial] {
+			n.expiry[c.Serial] = true
+			text := fmt.Sprintf("certificate %s for %s expires on %s", file, c.Subject, c.NotAfter.Format(time.DateOnly))
+			if left <= 0 {
+				text = fmt.Sprintf("certificate %s for %s expired on %s", file, c.Subject, c.NotAfter.Format(time.DateOnly))
+			}
+			n.send(Event{
+				Event:       config.WebhookCertExpiring,
+				Time:        time.Now().UTC(),
+				Text:        text,
+				Certificate: c,
+			})
+		}
+	}
+	n.certs = certs
+}
+
+// readCert describes the first certificate in a PEM file.
+func readCert(file string) (*Certificate, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("no certificate")
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		subject := cert.Subject.CommonName
+		if subject == "" && len(cert.DNSNames) > 0 {
+			subject = cert.DNSNames[0]
+		}
+		return &Certificate{
+			File:     file,
+			Subject:  subject,
+			DNSNames: cert.DNSNames,
+			Serial:   cert.SerialNumber.Text(16),
+			NotAfter: cert.NotAfter.UTC(),
+		}, nil
+	}
+}
+
+// send queues e for the webhooks and targets that subscribe to it.
+func (n *Notifier) send(e Event) {
+	d := delivery{id: newID(), event: e}
+	for _, h := range n.hooks {
+		if len(h.cfg.Events) > 0 && !slices.Contains(h.cfg.Events, e.Event) {
+			continue
+		}
+		select {
+		case h.queue <- d:
+		default:
+			n.log.Warn("notification queue full, dropping event", "to", h.target.String(), "event", e.Event)
+		}
+	}
+}
+
+// deliver sends h's queued events, one at a time, until ctx is done.
+func (n *Notifier) deliver(ctx context.Context, h *hook) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case d := <-h.queue:
+			n.post(ctx, h, d)
+		}
+	}
+}
+
+// post tries d until it is accepted, fails for good or runs out of
+// attempts.
+func (n *Notifier) post(ctx context.Context, h *hook, d delivery) {
+	backoff := minBackoff
+	for attempt := 1; ; attempt++ {
+		tryCtx, cancel := context.WithTimeout(ctx, h.cfg.Timeout)
+		retry, err := h.target.Send(tryCtx, d.id, d.event)
+		cancel()
+		if err == nil {
+			return
+		}
+		if !retry || attempt >= h.cfg.Attempts {
+			n.log.Warn("notification failed", "to", h.target.String(), "event", d.event.Event, "attempts", attempt, "error", err)
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, maxBackoff)
+	}
+}
+
+// endpoint is a webhook as a Target.
+type endpoint struct {
+	cfg    config.Webhook
+	client *http.Client
+}
+
+func (h *endpoint) String() string { return "webhook " + Redact(h.cfg.URL) }
+
+func (h *endpoint) Delivery() config.Delivery {
+	return config.Delivery{Events: h.cfg.Events, Attempts: h.cfg.Attempts, Timeout: h.cfg.Timeout}
+}
+
+// Send makes one try of a delivery.
+func (h *endpoint) Send(ctx context.Context, id string, e Event) (retry bool, err error) {
+	body, contentType, err := encode(h.cfg.Format, e)
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	for k, v := range h.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-Envoyage-Event", e.Event)
+	req.Header.Set("X-Envoyage-Delivery", id)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("X-Envoyage-Timestamp", timestamp)
+	if h.cfg.Secret != "" {
+		req.Header.Set("X-Envoyage-Signature", "sha256="+Sign(h.cfg.Secret, timestamp, body))
+	}
+	return Post(h.client, req)
+}
+
+// Post sends req, reporting whether a failure is worth another try: a
+// network error, a 429 or a 5xx. Targets posting to HTTP APIs use it too.
+func Post(client *http.Client, req *http.Request) (retry bool, err error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("status %s", resp.Status)
+	default:
+		return false, fmt.Errorf("status %s", resp.Status)
+	}
+}
+
+// Sign is the hex HMAC-SHA256 of a delivery, keyed with secret, as in the
+// X-Envoyage-Signature header.
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// encode renders e in format.
+func encode(format string, e Event) (body []byte, contentType string, err error) {
+	switch format {
+	case config.WebhookFormatSlack:
+		body, err = json.Marshal(map[string]string{"text": e.Text})
+		return body, "application/json", err
+	case config.WebhookFormatText:
+		return []byte(e.Text), "text/plain; charset=utf-8", nil
+	default:
+		body, err = json.Marshal(e)
+		return body, "application/json", err
+	}
+}
+
+// Redact leaves the path and query out of a URL for the log: for Slack
+// and ntfy, they are the secret.
+func Redact(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "(invalid url)"
+	}
+	return u.Scheme + "://" + u.Host + "/…"
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
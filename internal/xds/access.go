@@ -0,0 +1,209 @@
+package xds
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	hcm "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	matcher "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+
+	"github.com/envoyage/envoyage/internal/registry"
+)
+
+// Maintenance mode and share links
+//
+// Both are set per service from the self-service portal and rendered purely
+// as routes, so every node handles them locally: the edge answers the
+// maintenance page without a trip home, and a share link works on whichever
+// node the visitor reaches.
+
+// shareCookieName carries a share link's token after the first visit.
+const shareCookieName = "envoyage_share"
+
+const maintenancePage = `<!doctype html>
+<html><head><meta charset="utf-8"><title>Down for maintenance</title></head>
+<body style="font-family:sans-serif;max-width:32em;margin:4em auto">
+<h1>Down for maintenance</h1>
+<p>This service is being worked on and will be back shortly.</p>
+</body></html>
+`
+
+// defaultRetryAfter is the Retry-After of a maintenance page that doesn't
+// set one.
+const defaultRetryAfter = 5 * time.Minute
+
+// makeMaintenanceRoutes replaces the virtual host's routes with a 503 page,
+// the service's own if it has one.
+func makeMaintenanceRoutes(vh *route.VirtualHost, page *registry.MaintenancePage) {
+	body, retryAfter := maintenancePage, defaultRetryAfter
+	if page != nil && page.Body != "" {
+		body = page.Body
+	}
+	if page != nil && page.RetryAfter > 0 {
+		retryAfter = page.RetryAfter
+	}
+	vh.Routes = []*route.Route{{
+		Match: &route.RouteMatch{
+			PathSpecifier: &route.RouteMatch_Prefix{Prefix: "/"},
+		},
+		Action: &route.Route_DirectResponse{
+			DirectResponse: &route.DirectResponseAction{
+				Status: 503,
+				Body: &core.DataSource{
+					Specifier: &core.DataSource_InlineString{InlineString: body},
+				},
+			},
+		},
+		ResponseHeadersToAdd: []*core.HeaderValueOption{
+			headerOption(registry.Header{Name: "Content-Type", Value: "text/html; charset=utf-8"}, core.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD),
+			headerOption(registry.Header{Name: "Retry-After", Value: strconv.Itoa(int(retryAfter.Seconds()))}, core.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD),
+		},
+	}}
+}
+
+// authFilterNames are the filters a share link lets visitors skip.
+var authFilterNames = map[string]bool{
+	basicAuthFilterName: true,
+	jwtFilterName:       true,
+	extAuthzFilterName:  true,
+	challengeFilterName: true,
+}
+
+// applyShareLinks adds two routes per active share link in front of each
+// of a service's routes to its upstream: one also matching the token in the
+// query string, which sets it as a cookie, and one also matching the cookie
+// on later requests. Both disable whichever auth filters are in the chain,
+// and drop the identity headers the auth service would have set. vhosts
+// must be index-aligned with services; filters is the node's complete
+// filter list.
+func applyShareLinks(services []*registry.Service, vhosts []*route.VirtualHost, filters []*hcm.HttpFilter, now time.Time) error {
+	var authFilters []string
+	for _, f := range filters {
+		if authFilterNames[f.Name] {
+			authFilters = append(authFilters, f.Name)
+		}
+	}
+
+	for i, svc := range services {
+		// Maintenance pages have no one to share with, and forward proxies
+		// route on a header the share routes would not check.
+		if svc.Maintenance || svc.ForwardProxy != nil || svc.AnsweredByEnvoy() {
+			continue
+		}
+		links := svc.ActiveShareLinks(now)
+		if len(links) == 0 {
+			continue
+		}
+
+		var routes []*route.Route
+		for _, r := range vhosts[i].Routes {
+			if _, ok := r.Action.(*route.Route_Route); !ok {
+				routes = append(routes, r)
+				continue
+			}
+			for _, l := range links {
+				byQuery := proto.Clone(r).(*route.Route)
+				byQuery.Match.QueryParameters = append(byQuery.Match.QueryParameters, &route.QueryParameterMatcher{
+					Name: registry.ShareQueryParam,
+					QueryParameterMatchSpecifier: &route.QueryParameterMatcher_StringMatch{
+						StringMatch: &matcher.StringMatcher{
+							MatchPattern: &matcher.StringMatcher_Exact{Exact: l.Token},
+						},
+					},
+				})
+				cookie := fmt.Sprintf("%s=%s; Path=/; Max-Age=%d; HttpOnly; Secure; SameSite=Lax",
+					shareCookieName, l.Token, int(l.Expires.Sub(now).Seconds()))
+				byQuery.ResponseHeadersToAdd = append(byQuery.ResponseHeadersToAdd,
+					headerOption(registry.Header{Name: "Set-Cookie", Value: cookie}, core.HeaderValueOption_APPEND_IF_EXISTS_OR_ADD))
+
+				byCookie := proto.Clone(r).(*route.Route)
+				byCookie.Match.Headers = append(byCookie.Match.Headers, &route.HeaderMatcher{
+					Name: "cookie",
+					HeaderMatchSpecifier: &route.HeaderMatcher_StringMatch{
+						StringMatch: &matcher.StringMatcher{
+							MatchPattern: &matcher.StringMatcher_SafeRegex{
+								SafeRegex: &matcher.RegexMatcher{
+									Regex: `(^|;\s*)` + shareCookieName + "=" + regexp.QuoteMeta(l.Token) + `(;|$)`,
+								},
+							},
+						},
+					},
+				})
+
+				for _, sr := range []*route.Route{byQuery, byCookie} {
+					if err := disableFilters(sr, authFilters); err != nil {
+						return fmt.Errorf("service %q: %w", svc.Name, err)
+					}
+					sr.RequestHeadersToRemove = append(sr.RequestHeadersToRemove, extAuthzIdentityHeaders...)
+				}
+				routes = append(routes, byQuery, byCookie)
+			}
+			routes = append(routes, r)
+		}
+		vhosts[i].Routes = routes
+	}
+	return nil
+}
+
+// disableFilters turns the named filters off for one route, overriding
+// whatever the virtual host enables.
+func disableFilters(r *route.Route, names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	disabled, err := anypb.New(&route.FilterConfig{Disabled: true})
+	if err != nil {
+		return fmt.Errorf("marshaling disabled filter config: %w", err)
+	}
+	if r.TypedPerFilterConfig == nil {
+		r.TypedPerFilterConfig = make(map[string]*anypb.Any)
+	}
+	for _, name := range names {
+		r.TypedPerFilterConfig[name] = disabled
+	}
+	return nil
+}
+
+// scheduleExpiry arranges a rebuild for when the next share link or
+// mirror expires, or a schedule rule starts or ends, so the change happens
+// on time rather than at the next unrelated one. Called with rebuildMu
+// held.
+func (s *Server) scheduleExpiry(services []*registry.Service) {
+	now := time.Now()
+	var next time.Time
+	earlier := func(t time.Time) {
+		if next.IsZero() || t.Before(next) {
+			next = t
+		}
+	}
+	for _, svc := range services {
+		for _, l := range svc.ActiveShareLinks(now) {
+			earlier(l.Expires)
+		}
+		if m := svc.ActiveMirror(now); m != nil {
+			earlier(m.Expires)
+		}
+		if t := svc.NextScheduleChange(now); !t.IsZero() {
+			earlier(t)
+		}
+	}
+
+	if s.expiryTimer != nil {
+		s.expiryTimer.Stop()
+		s.expiryTimer = nil
+	}
+	if next.IsZero() {
+		return
+	}
+	s.expiryTimer = time.AfterFunc(time.Until(next), func() {
+		if err := s.timedRebuild(); err != nil {
+			s.log.Error("failed to rebuild for an expiry or schedule change", "error", err)
+		}
+	})
+}
@@ -0,0 +1,68 @@
+package xds
+
+import (
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	"github.com/envoyage/envoyage/internal/registry"
+)
+
+// Session affinity
+//
+// registry.Affinity switches the service's cluster on the home node, the
+// one that balances over the upstream's hosts, to a consistent hash load
+// balancer, and has every forwarding route hash the session cookie or
+// header. Envoy generates the cookie when a request has none and sets it
+// on the response. A canary split is still random per request: the hash
+// only picks the host within the cluster the split chose, so a client
+// stays on one stable replica and one canary replica. The edges forward
+// to the home node unhashed.
+
+// defaultAffinityCookie names the cookie when Affinity.Cookie is empty.
+const defaultAffinityCookie = "envoyage_affinity"
+
+// applyAffinityCluster has c balance by the hash of the routes' hash
+// policy.
+func applyAffinityCluster(c *cluster.Cluster, a *registry.Affinity) {
+	if a == nil {
+		return
+	}
+	c.LbPolicy = cluster.Cluster_RING_HASH
+	if a.Maglev {
+		c.LbPolicy = cluster.Cluster_MAGLEV
+	}
+}
+
+// applyAffinityRoutes adds the service's hash policy to every forwarding
+// route of its virtual host.
+func applyAffinityRoutes(vh *route.VirtualHost, a *registry.Affinity) {
+	if a == nil {
+		return
+	}
+	policy := &route.RouteAction_HashPolicy{Terminal: true}
+	switch a.Mode {
+	case registry.AffinityCookie:
+		name := a.Cookie
+		if name == "" {
+			name = defaultAffinityCookie
+		}
+		policy.PolicySpecifier = &route.RouteAction_HashPolicy_Cookie_{
+			Cookie: &route.RouteAction_HashPolicy_Cookie{
+				Name: name,
+				Ttl:  durationpb.New(a.TTL),
+				Path: "/",
+			},
+		}
+	case registry.AffinityHeader:
+		policy.PolicySpecifier = &route.RouteAction_HashPolicy_Header_{
+			Header: &route.RouteAction_HashPolicy_Header{HeaderName: a.Header},
+		}
+	}
+	for _, r := range vh.Routes {
+		if action, ok := r.Action.(*route.Route_Route); ok {
+			action.Route.HashPolicy = append(action.Route.HashPolicy, proto.Clone(policy).(*route.RouteAction_HashPolicy))
+		}
+	}
+}
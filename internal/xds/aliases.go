@@ -0,0 +1,69 @@
+package xds
+
+import (
+	"regexp"
+	"strings"
+
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	matcher "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/envoyage/envoyage/internal/registry"
+)
+
+// Aliases
+//
+// An alias is one more domain on the service's own virtual host, so every
+// per-service setting (auth, limits, share links, ...) covers it too. On
+// the home node a route per alias, in front of the service's, matches the
+// alias by :authority and rewrites the path and Host; edges only need the
+// domain, since they pass requests to home unchanged.
+
+// applyAliases adds a service's aliases to its freshly made virtual host.
+// rewrite is false on edges and for forward proxies, whose routes are not
+// a single upstream.
+func applyAliases(vh *route.VirtualHost, aliases []registry.Alias, rewrite bool) {
+	if len(aliases) == 0 {
+		return
+	}
+	for _, a := range aliases {
+		vh.Domains = append(vh.Domains, a.Domain)
+	}
+	if !rewrite || len(vh.Routes) == 0 {
+		return
+	}
+
+	base := vh.Routes[0]
+	var routes []*route.Route
+	for _, a := range aliases {
+		r := proto.Clone(base).(*route.Route)
+		r.Match.Headers = append(r.Match.Headers, &route.HeaderMatcher{
+			Name: ":authority",
+			HeaderMatchSpecifier: &route.HeaderMatcher_StringMatch{
+				StringMatch: &matcher.StringMatcher{
+					MatchPattern: &matcher.StringMatcher_SafeRegex{
+						SafeRegex: &matcher.RegexMatcher{Regex: `(?i)^` + regexp.QuoteMeta(a.Domain) + `(:[0-9]+)?$`},
+					},
+				},
+			},
+		})
+		action := r.GetRoute()
+		if a.PathPrefix != "" {
+			action.PrefixRewrite = strings.TrimSuffix(a.PathPrefix, "/") + "/"
+		}
+		if a.Host != "" {
+			action.HostRewriteSpecifier = &route.RouteAction_HostRewriteLiteral{HostRewriteLiteral: a.Host}
+		}
+		routes = append(routes, r)
+	}
+	vh.Routes = append(routes, vh.Routes...)
+}
+
+// serviceDomains is the service's domain followed by its aliases'.
+func serviceDomains(svc *registry.Service) []string {
+	out := []string{svc.Domain}
+	for _, a := range svc.Aliases {
+		out = append(out, a.Domain)
+	}
+	return out
+}
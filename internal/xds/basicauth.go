@@ -0,0 +1,89 @@
+package xds
+
+import (
+	"fmt"
+	"strings"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	basicauthv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/basic_auth/v3"
+	hcm "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	"google.golang.org/protobuf/types/known/anypb"
+
+	"github.com/envoyage/envoyage/internal/registry"
+)
+
+// Basic auth
+//
+// Quick-and-dirty protection for services that don't warrant SSO. Each
+// service carries its own htpasswd user list; the basic_auth filter is
+// present in the HCM but disabled by default, and enabled per virtual host
+// with that service's users.
+//
+// Unlike ext_authz this needs nothing but the request itself, so it is
+// enforced on every node whose Envoy supports per-route user lists: the edge
+// rejects bad credentials before they cross the tunnel, and the home node
+// enforces them again for LAN clients. The home node is the enforcement point
+// of last resort — if its profile cannot express per-service users, the build
+// fails rather than serving the service unprotected.
+
+const basicAuthFilterName = "envoy.filters.http.basic_auth"
+
+// applyBasicAuth enables basic auth on the virtual hosts of services with a
+// user list and returns the (default-disabled) filter to put in the HCM.
+// vhosts must be index-aligned with services. Returns nil if no service on
+// this node uses basic auth.
+func applyBasicAuth(node Node, isEdge bool, services []*registry.Service, vhosts []*route.VirtualHost) (*hcm.HttpFilter, error) {
+	var filter *hcm.HttpFilter
+
+	for i, svc := range services {
+		if len(svc.BasicAuth) == 0 {
+			continue
+		}
+		if !node.Profile.supports(featureBasicAuthPerRoute) {
+			if isEdge {
+				continue // home still enforces
+			}
+			return nil, fmt.Errorf("service %q uses basic auth, which profile %s cannot express", svc.Name, node.Profile.Name)
+		}
+
+		if filter == nil {
+			var err error
+			if filter, err = makeBasicAuthFilter(); err != nil {
+				return nil, err
+			}
+		}
+
+		perRoute, err := anypb.New(&basicauthv3.BasicAuthPerRoute{
+			Users: &core.DataSource{
+				Specifier: &core.DataSource_InlineString{
+					InlineString: strings.Join(svc.BasicAuth, "\n"),
+				},
+			},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("marshaling basic auth users for %q: %w", svc.Name, err)
+		}
+		// Wrapping in FilterConfig turns the default-disabled filter on.
+		enabled, err := anypb.New(&route.FilterConfig{Config: perRoute})
+		if err != nil {
+			return nil, fmt.Errorf("marshaling basic auth filter config for %q: %w", svc.Name, err)
+		}
+		setPerFilterConfig(vhosts[i], basicAuthFilterName, enabled)
+	}
+	return filter, nil
+}
+
+// makeBasicAuthFilter returns the basic_auth filter with no global users,
+// disabled unless a virtual host turns it on.
+func makeBasicAuthFilter() (*hcm.HttpFilter, error) {
+	cfg, err := anypb.New(&basicauthv3.BasicAuth{})
+	if err != nil {
+		return nil, fmt.Errorf("marshaling basic auth config: %w", err)
+	}
+	return &hcm.HttpFilter{
+		Name:       basicAuthFilterName,
+		ConfigType: &hcm.HttpFilter_TypedConfig{TypedConfig: cfg},
+		Disabled:   true,
+	}, nil
+}
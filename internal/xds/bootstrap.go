@@ -0,0 +1,123 @@
+package xds
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"time"
+
+	bootstrap "github.com/envoyproxy/go-control-plane/envoy/config/bootstrap/v3"
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	metricsv3 "github.com/envoyproxy/go-control-plane/envoy/config/metrics/v3"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// defaultAdminPort is the admin port of generated bootstraps when the node
+// has no admin address configured.
+const defaultAdminPort = 9901
+
+// BootstrapOptions are the per-deployment parts of a generated bootstrap.
+type BootstrapOptions struct {
+	// XDSAddress is where the node reaches the control plane (host:port).
+	XDSAddress string
+
+	// AdminPort is the port Envoy's admin interface listens on. Zero takes
+	// the port of the node's Admin address, or 9901.
+	AdminPort uint32
+
+	// MetricsInterval, if set, has the node stream its stats to the control
+	// plane's metrics service that often (config.StatsSourceMetricsService).
+	MetricsInterval time.Duration
+}
+
+// DynamicBootstrap returns the bootstrap a node needs to start: its node ID,
+// an ADS connection to the control plane and an admin listener. Everything
+// else it gets over xDS. This is the generated form of envoy/bootstrap-*.yaml.
+func DynamicBootstrap(node Node, opts BootstrapOptions) (*bootstrap.Bootstrap, error) {
+	host, portStr, err := net.SplitHostPort(opts.XDSAddress)
+	if err != nil {
+		return nil, fmt.Errorf("xds address: %w", err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("xds address: invalid port %q", portStr)
+	}
+
+	adminPort := opts.AdminPort
+	if adminPort == 0 {
+		adminPort = defaultAdminPort
+		if _, p, err := net.SplitHostPort(node.Admin); err == nil {
+			if n, err := strconv.ParseUint(p, 10, 16); err == nil {
+				adminPort = uint32(n)
+			}
+		}
+	}
+
+	// ADS is gRPC, so the xDS cluster must speak HTTP/2.
+	xds := makeCluster(xdsClusterName, net.JoinHostPort(host, strconv.FormatUint(port, 10)))
+	if err := useHTTP2(xds); err != nil {
+		return nil, fmt.Errorf("xds cluster: %w", err)
+	}
+
+	ads := &core.ConfigSource{
+		ResourceApiVersion:    core.ApiVersion_V3,
+		ConfigSourceSpecifier: &core.ConfigSource_Ads{Ads: &core.AggregatedConfigSource{}},
+	}
+	bs := &bootstrap.Bootstrap{
+		Node: &core.Node{
+			Id:      node.ID,
+			Cluster: "envoyage",
+		},
+		DynamicResources: &bootstrap.Bootstrap_DynamicResources{
+			AdsConfig: &core.ApiConfigSource{
+				ApiType:             core.ApiConfigSource_GRPC,
+				TransportApiVersion: core.ApiVersion_V3,
+				GrpcServices: []*core.GrpcService{{
+					TargetSpecifier: &core.GrpcService_EnvoyGrpc_{
+						EnvoyGrpc: &core.GrpcService_EnvoyGrpc{ClusterName: xdsClusterName},
+					},
+				}},
+			},
+			LdsConfig: ads,
+			CdsConfig: ads,
+		},
+		StaticResources: &bootstrap.Bootstrap_StaticResources{
+			Clusters: []*cluster.Cluster{xds},
+		},
+		Admin: &bootstrap.Admin{
+			Address: adminAddress(node.IPFamily, adminPort),
+		},
+	}
+	if opts.MetricsInterval > 0 {
+		sink, err := anypb.New(&metricsv3.MetricsServiceConfig{
+			TransportApiVersion: core.ApiVersion_V3,
+			GrpcService: &core.GrpcService{
+				TargetSpecifier: &core.GrpcService_EnvoyGrpc_{
+					EnvoyGrpc: &core.GrpcService_EnvoyGrpc{ClusterName: xdsClusterName},
+				},
+			},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("metrics service sink: %w", err)
+		}
+		bs.StatsSinks = []*metricsv3.StatsSink{{
+			Name:       "envoy.stat_sinks.metrics_service",
+			ConfigType: &metricsv3.StatsSink_TypedConfig{TypedConfig: sink},
+		}}
+		bs.StatsFlushInterval = durationpb.New(opts.MetricsInterval)
+	}
+	return bs, nil
+}
+
+// Bootstrap returns the generated bootstrap for a managed node.
+func (s *Server) Bootstrap(nodeID string, opts BootstrapOptions) (*bootstrap.Bootstrap, error) {
+	nodes := s.Nodes()
+	i := slices.IndexFunc(nodes, func(n Node) bool { return n.ID == nodeID })
+	if i < 0 {
+		return nil, fmt.Errorf("node %q: %w", nodeID, ErrNodeNotFound)
+	}
+	return DynamicBootstrap(nodes[i], opts)
+}
@@ -0,0 +1,226 @@
+package xds
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	asyncfilesv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/common/async_files/v3"
+	cachev3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/cache/v3"
+	luav3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/lua/v3"
+	hcm "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	fscachev3 "github.com/envoyproxy/go-control-plane/envoy/extensions/http/cache/file_system_http_cache/v3"
+	matcher "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/envoyage/envoyage/internal/config"
+	"github.com/envoyage/envoyage/internal/registry"
+)
+
+// Edge cache
+//
+// The cache filter runs on the edges only, after every auth filter, so a
+// cached page is only served to requests that would have been let through.
+// It is off by default and turned on per virtual host for services with a
+// Cache. Three things keep one user's response from reaching another:
+//
+//   - services whose auth the edge doesn't enforce are never cached: those
+//     behind ext_authz, which only home checks, and those behind basic
+//     auth on a profile that can't express it. Services behind basic auth
+//     or JWT are cached only if Cache.Authenticated says their pages are
+//     the same for everyone.
+//   - requests carrying a bypass cookie or header skip the cache, through
+//     a clone of each route with the filter disabled. Authorization is one,
+//     unless Authenticated.
+//   - responses carrying a private header (Set-Cookie, always) get
+//     "private" added to their Cache-Control by a Lua filter that runs
+//     before the cache sees them, so they are never stored.
+
+const cacheFilterName = "envoy.filters.http.cache"
+
+// cachePrivateScript marks responses carrying any of the listed headers
+// private, formatted with the lowercased names as a Lua list.
+const cachePrivateScript = `local private = {%s}
+
+function envoy_on_response(handle)
+  local headers = handle:headers()
+  for _, name in ipairs(private) do
+    if headers:get(name) then
+      local cc = headers:get("cache-control")
+      if not cc then
+        headers:add("cache-control", "private")
+      elseif not cc:lower():find("private", 1, true) and not cc:lower():find("no-store", 1, true) then
+        headers:replace("cache-control", cc .. ", private")
+      end
+      return
+    end
+  end
+end
+`
+
+// applyCache turns the cache on for the virtual hosts of services that may
+// be cached on node and returns the filters that implement it: the cache
+// and, after it, the Lua filter marking private responses. Edge only.
+// vhosts must be index-aligned with services and complete: routes added
+// later don't get the bypass. Returns nil if no service is cached.
+func applyCache(node Node, cfg *config.Cache, services []*registry.Service, vhosts []*route.VirtualHost) ([]*hcm.HttpFilter, error) {
+	enabled, err := anypb.New(&route.FilterConfig{})
+	if err != nil {
+		return nil, fmt.Errorf("marshaling cache filter config: %w", err)
+	}
+	cached := false
+	for i, svc := range services {
+		if svc.Cache == nil {
+			continue
+		}
+		if cfg == nil {
+			return nil, fmt.Errorf("service %q uses the cache but none is configured", svc.Name)
+		}
+		if !cacheable(node, svc) {
+			continue
+		}
+		setPerFilterConfig(vhosts[i], cacheFilterName, enabled)
+		if err := applyCacheRules(vhosts[i], svc.Cache); err != nil {
+			return nil, fmt.Errorf("service %q: %w", svc.Name, err)
+		}
+		cached = true
+	}
+	if !cached {
+		return nil, nil
+	}
+
+	store, err := anypb.New(&fscachev3.FileSystemHttpCacheConfig{
+		ManagerConfig: &asyncfilesv3.AsyncFileManagerConfig{
+			ManagerType: &asyncfilesv3.AsyncFileManagerConfig_ThreadPool_{
+				ThreadPool: &asyncfilesv3.AsyncFileManagerConfig_ThreadPool{},
+			},
+		},
+		CachePath:         cfg.Directory,
+		MaxCacheSizeBytes: wrapperspb.UInt64(uint64(cfg.MaxSize)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("marshaling cache storage config: %w", err)
+	}
+	filterCfg, err := anypb.New(&cachev3.CacheConfig{
+		TypedConfig: store,
+		// Vary is refused unless listed; compression is the only
+		// variation worth a separate entry.
+		AllowedVaryHeaders: []*matcher.StringMatcher{{
+			MatchPattern: &matcher.StringMatcher_Exact{Exact: "accept-encoding"},
+			IgnoreCase:   true,
+		}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("marshaling cache filter: %w", err)
+	}
+	lua, err := anypb.New(&luav3.Lua{})
+	if err != nil {
+		return nil, fmt.Errorf("marshaling lua filter: %w", err)
+	}
+	return []*hcm.HttpFilter{
+		{
+			Name:       cacheFilterName,
+			ConfigType: &hcm.HttpFilter_TypedConfig{TypedConfig: filterCfg},
+			Disabled:   true,
+		},
+		{
+			Name:       luaFilterName,
+			ConfigType: &hcm.HttpFilter_TypedConfig{TypedConfig: lua},
+		},
+	}, nil
+}
+
+// cacheable reports whether node enforces all of svc's auth itself, so its
+// cache can't hand a page to someone home would have turned away.
+func cacheable(node Node, svc *registry.Service) bool {
+	authenticated := len(svc.BasicAuth) > 0 || svc.JWT != nil
+	switch {
+	case svc.ExtAuthz, svc.ForwardProxy != nil:
+		return false
+	case authenticated && !svc.Cache.Authenticated:
+		return false
+	case len(svc.BasicAuth) > 0 && !node.Profile.supports(featureBasicAuthPerRoute):
+		return false
+	}
+	return true
+}
+
+// applyCacheRules puts a bypass clone in front of every route of vh for
+// each way a request can skip the cache, and has the routes themselves
+// mark private responses.
+func applyCacheRules(vh *route.VirtualHost, c *registry.Cache) error {
+	var bypass []*route.HeaderMatcher
+	if len(c.BypassCookies) > 0 {
+		names := make([]string, len(c.BypassCookies))
+		for i, name := range c.BypassCookies {
+			names[i] = regexp.QuoteMeta(name)
+		}
+		bypass = append(bypass, &route.HeaderMatcher{
+			Name: "cookie",
+			HeaderMatchSpecifier: &route.HeaderMatcher_StringMatch{
+				StringMatch: &matcher.StringMatcher{
+					MatchPattern: &matcher.StringMatcher_SafeRegex{
+						SafeRegex: &matcher.RegexMatcher{Regex: `(^|;\s*)(` + strings.Join(names, "|") + `)=`},
+					},
+				},
+			},
+		})
+	}
+	headers := c.BypassHeaders
+	if !c.Authenticated {
+		headers = append([]string{"authorization"}, headers...)
+	}
+	for _, name := range headers {
+		bypass = append(bypass, &route.HeaderMatcher{
+			Name:                 strings.ToLower(name),
+			HeaderMatchSpecifier: &route.HeaderMatcher_PresentMatch{PresentMatch: true},
+		})
+	}
+
+	private := []string{strconv.Quote("set-cookie")}
+	for _, name := range c.PrivateHeaders {
+		if !strings.EqualFold(name, "set-cookie") {
+			private = append(private, strconv.Quote(strings.ToLower(name)))
+		}
+	}
+	script, err := anypb.New(&luav3.LuaPerRoute{
+		Override: &luav3.LuaPerRoute_SourceCode{
+			SourceCode: &core.DataSource{
+				Specifier: &core.DataSource_InlineString{
+					InlineString: fmt.Sprintf(cachePrivateScript, strings.Join(private, ", ")),
+				},
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("marshaling cache script: %w", err)
+	}
+
+	out := make([]*route.Route, 0, (len(bypass)+1)*len(vh.Routes))
+	for _, r := range vh.Routes {
+		if _, ok := r.Action.(*route.Route_Route); !ok {
+			out = append(out, r)
+			continue
+		}
+		for _, m := range bypass {
+			clone := proto.Clone(r).(*route.Route)
+			clone.Match.Headers = append(clone.Match.Headers, m)
+			if err := disableFilters(clone, []string{cacheFilterName}); err != nil {
+				return err
+			}
+			out = append(out, clone)
+		}
+		if r.TypedPerFilterConfig == nil {
+			r.TypedPerFilterConfig = make(map[string]*anypb.Any)
+		}
+		r.TypedPerFilterConfig[luaFilterName] = script
+		out = append(out, r)
+	}
+	vh.Routes = out
+	return nil
+}
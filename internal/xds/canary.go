@@ -0,0 +1,51 @@
+package xds
+
+import (
+	"fmt"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/envoyage/envoyage/internal/registry"
+)
+
+// canarySuffix names a service's canary cluster; it must match
+// stats.CanarySuffix so the canary's stats can be told apart.
+const canarySuffix = "~canary"
+
+func canaryClusterName(svc *registry.Service) string {
+	return fmt.Sprintf("cluster_%s%s", svc.Name, canarySuffix)
+}
+
+// applyCanary splits the virtual host's forwarding route between the stable
+// cluster and a canary cluster by the canary's weight, and returns the
+// canary cluster. Only the home node splits: edges send everything home
+// either way. Returns nil if the service has no canary.
+func applyCanary(vh *route.VirtualHost, svc *registry.Service, stableCluster string) *cluster.Cluster {
+	c := svc.Canary
+	if c == nil || svc.ForwardProxy != nil || svc.Maintenance {
+		return nil
+	}
+	name := canaryClusterName(svc)
+	for _, r := range vh.Routes {
+		action, ok := r.Action.(*route.Route_Route)
+		if !ok || action.Route.GetCluster() != stableCluster {
+			continue
+		}
+		action.Route.ClusterSpecifier = &route.RouteAction_WeightedClusters{
+			WeightedClusters: &route.WeightedCluster{
+				Clusters: []*route.WeightedCluster_ClusterWeight{
+					{Name: stableCluster, Weight: wrapperspb.UInt32(uint32(100 - c.Weight))},
+					{Name: name, Weight: wrapperspb.UInt32(uint32(c.Weight))},
+				},
+			},
+		}
+	}
+	canary := makeCluster(name, c.Upstream)
+	applyHealthCheck(canary, svc.HealthCheck)
+	applyConcurrency(canary, svc.Concurrency)
+	applyLBPolicy(canary, svc.LBPolicy)
+	applyAffinityCluster(canary, svc.Affinity)
+	return canary
+}
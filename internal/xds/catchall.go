@@ -0,0 +1,81 @@
+package xds
+
+import (
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/envoyage/envoyage/internal/config"
+	"github.com/envoyage/envoyage/internal/registry"
+)
+
+// Catch-all virtual host
+//
+// config.CatchAll adds a virtual host for the domain "*" to local_routes,
+// which Envoy picks only when no exact or wildcard domain matches. For the
+// service action it is a copy of that service's virtual host as built for
+// the node, so its auth, limits and placement apply as for its own domain:
+// an edge forwards the request home with its Host unchanged, and the home
+// node's catch-all serves it. Where the node doesn't serve the service, or
+// an edge serves it from a TLS policy chain of its own (see https.go), the
+// catch-all answers not_found instead. Lint reports a missing service and
+// a TLS policy.
+
+const catchAllPage = `<!doctype html>
+<html><head><meta charset="utf-8"><title>Not found</title></head>
+<body style="font-family:sans-serif;max-width:32em;margin:4em auto;color:#333">
+<h1>Not found</h1>
+<p>There is no site at this address.</p>
+</body></html>
+`
+
+// catchAllHost builds the catch-all virtual host, or returns nil without
+// config.CatchAll. vhosts must be index-aligned with services and
+// complete, but not yet split by TLS policy.
+func catchAllHost(isEdge bool, cfg *config.Config, services []*registry.Service, vhosts []*route.VirtualHost) *route.VirtualHost {
+	ca := cfg.CatchAll
+	if ca == nil {
+		return nil
+	}
+	vh := &route.VirtualHost{Name: "catch_all", Domains: []string{"*"}}
+	switch ca.Action {
+	case config.CatchAllRedirect:
+		vh.Routes = []*route.Route{redirectRoute(ca.Redirect, route.RedirectAction_FOUND, false)}
+		return vh
+	case config.CatchAllService:
+		for i, svc := range services {
+			if svc.Name != ca.Service || (isEdge && cfg.TLS != nil && svc.TLS != nil) {
+				continue
+			}
+			vh = proto.Clone(vhosts[i]).(*route.VirtualHost)
+			vh.Name, vh.Domains = "catch_all", []string{"*"}
+			return vh
+		}
+	}
+
+	body := ca.Body
+	switch {
+	case body != "":
+	case cfg.ErrorPages != nil && cfg.ErrorPages.NotFound != "":
+		body = cfg.ErrorPages.NotFound
+	default:
+		body = catchAllPage
+	}
+	vh.Routes = []*route.Route{{
+		Match: &route.RouteMatch{
+			PathSpecifier: &route.RouteMatch_Prefix{Prefix: "/"},
+		},
+		Action: &route.Route_DirectResponse{
+			DirectResponse: &route.DirectResponseAction{
+				Status: 404,
+				Body: &core.DataSource{
+					Specifier: &core.DataSource_InlineString{InlineString: body},
+				},
+			},
+		},
+		ResponseHeadersToAdd: []*core.HeaderValueOption{
+			headerOption(registry.Header{Name: "Content-Type", Value: "text/html; charset=utf-8"}, core.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD),
+		},
+	}}
+	return vh
+}
@@ -0,0 +1,85 @@
+package xds
+
+import (
+	"fmt"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	extauthzv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/ext_authz/v3"
+	hcm "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	"github.com/envoyage/envoyage/internal/registry"
+)
+
+// Anti-abuse challenge
+//
+// A second ext_authz filter, this one on edge nodes only, asks the control
+// plane's built-in challenge service (package challenge) whether a request
+// may pass. Scraper floods are stopped on the VPS, before they cost tunnel
+// bandwidth or home CPU; LAN clients never see a challenge.
+//
+// The check goes over gRPC to the same xds_cluster the Envoy already uses for
+// ADS, so the edge needs no extra cluster or route to the control plane. If
+// the control plane is unreachable the filter fails open: an outage of the
+// control plane must not take every opted-in site down with it.
+
+const (
+	challengeFilterName = "envoyage.challenge"
+
+	// xdsClusterName is the static cluster in every node's bootstrap that
+	// points at the control plane. See envoy/bootstrap-*.yaml.
+	xdsClusterName = "xds_cluster"
+)
+
+// applyChallenge returns the challenge filter for an edge node and disables
+// it on the virtual hosts of services that do not opt in. vhosts must be
+// index-aligned with services. Returns nil if no service opts in.
+func (b *SnapshotBuilder) applyChallenge(services []*registry.Service, vhosts []*route.VirtualHost) (*hcm.HttpFilter, error) {
+	needed := false
+	for _, svc := range services {
+		if svc.Challenge {
+			needed = true
+			if b.cfg.Challenge == nil {
+				return nil, fmt.Errorf("service %q requires a challenge but none is configured", svc.Name)
+			}
+		}
+	}
+	if !needed {
+		return nil, nil
+	}
+
+	cfg, err := anypb.New(&extauthzv3.ExtAuthz{
+		TransportApiVersion: core.ApiVersion_V3,
+		Services: &extauthzv3.ExtAuthz_GrpcService{
+			GrpcService: &core.GrpcService{
+				TargetSpecifier: &core.GrpcService_EnvoyGrpc_{
+					EnvoyGrpc: &core.GrpcService_EnvoyGrpc{ClusterName: xdsClusterName},
+				},
+				Timeout: durationpb.New(b.cfg.Challenge.Timeout),
+			},
+		},
+		FailureModeAllow: true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("marshaling challenge config: %w", err)
+	}
+
+	disabled, err := anypb.New(&extauthzv3.ExtAuthzPerRoute{
+		Override: &extauthzv3.ExtAuthzPerRoute_Disabled{Disabled: true},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("marshaling challenge per-route config: %w", err)
+	}
+	for i, svc := range services {
+		if !svc.Challenge {
+			setPerFilterConfig(vhosts[i], challengeFilterName, disabled)
+		}
+	}
+
+	return &hcm.HttpFilter{
+		Name:       challengeFilterName,
+		ConfigType: &hcm.HttpFilter_TypedConfig{TypedConfig: cfg},
+	}, nil
+}
@@ -0,0 +1,157 @@
+package xds
+
+import (
+	"fmt"
+	"strings"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	matcher "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/envoyage/envoyage/internal/config"
+	"github.com/envoyage/envoyage/internal/registry"
+)
+
+// Client certificate identity
+//
+// TLS ends at the edge, but the app is behind the home node, so the
+// identity has to cross the tunnel as headers. The edge verifies the
+// certificate and sets one internal header per field; the home node turns
+// those into the headers the service asked for. Each node only acts on what
+// it can vouch for:
+//
+//   - The edge sets the internal headers only on routes that match a
+//     validated certificate, and strips them from every other request.
+//   - The home node also serves LAN clients, who could send the internal
+//     headers themselves, so it only reads them from requests carrying the
+//     edge secret. Everything else has the service's identity headers
+//     stripped, and the internal headers never reach the app.
+//
+// Both are done by cloning each route of the service with the extra match
+// in front of the original, as share links do.
+
+const (
+	// edgeSecretHeader carries config.TLS.EdgeSecret from edge to home.
+	edgeSecretHeader = "x-envoyage-edge-secret"
+	// clientCertHeaderPrefix names the internal header of each field.
+	clientCertHeaderPrefix = "x-envoyage-client-"
+	// xfccHeader is the header registry.ClientCert.XFCC sets.
+	xfccHeader = "x-forwarded-client-cert"
+)
+
+// clientCertFormat is the Envoy formatter for each registry.ClientCertFields
+// entry, evaluated by the edge.
+var clientCertFormat = map[string]string{
+	"subject":     "%DOWNSTREAM_PEER_SUBJECT%",
+	"uri_san":     "%DOWNSTREAM_PEER_URI_SAN%",
+	"dns_san":     "%DOWNSTREAM_PEER_DNS_SAN%",
+	"fingerprint": "%DOWNSTREAM_PEER_FINGERPRINT_256%",
+	"serial":      "%DOWNSTREAM_PEER_SERIAL%",
+}
+
+func clientCertHeader(field string) string {
+	return clientCertHeaderPrefix + strings.ReplaceAll(field, "_", "-")
+}
+
+// fromEdge reads a field's internal header on the home node.
+func fromEdge(field string) string {
+	return "%REQ(" + clientCertHeader(field) + ")%"
+}
+
+// applyClientCert sets up identity forwarding for services with a
+// ClientCert. vhosts must be index-aligned with services and complete: the
+// routes present now are the ones cloned. tls may be nil, in which case the
+// edge forwards nothing but the home node still strips forged headers.
+func applyClientCert(isEdge bool, tls *config.TLS, services []*registry.Service, vhosts []*route.VirtualHost) {
+	var internal []string
+	for _, f := range registry.ClientCertFields {
+		internal = append(internal, clientCertHeader(f))
+	}
+
+	for i, svc := range services {
+		cc := svc.ClientCert
+		if cc == nil {
+			continue
+		}
+		vh := vhosts[i]
+
+		if isEdge {
+			if tls == nil || tls.ClientCA == "" {
+				continue
+			}
+			// Route-level removal comes before the clone's additions, and
+			// before the virtual host's headers are evaluated.
+			var set []*core.HeaderValueOption
+			for _, f := range registry.ClientCertFields {
+				set = append(set, headerOption(registry.Header{Name: clientCertHeader(f), Value: clientCertFormat[f]}, core.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD))
+			}
+			vh.Routes = cloneRoutes(vh.Routes, internal, func(r *route.Route) {
+				r.Match.TlsContext = &route.RouteMatch_TlsContextMatchOptions{
+					Presented: wrapperspb.Bool(true),
+					Validated: wrapperspb.Bool(true),
+				}
+				r.RequestHeadersToAdd = append(r.RequestHeadersToAdd, set...)
+			})
+			vh.RequestHeadersToAdd = append(vh.RequestHeadersToAdd,
+				headerOption(registry.Header{Name: edgeSecretHeader, Value: tls.EdgeSecret}, core.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD))
+			continue
+		}
+
+		var outputs []string
+		var set []*core.HeaderValueOption
+		if cc.XFCC {
+			outputs = append(outputs, xfccHeader)
+			value := fmt.Sprintf(`Hash=%s;Subject="%s";URI=%s;DNS=%s`,
+				fromEdge("fingerprint"), fromEdge("subject"), fromEdge("uri_san"), fromEdge("dns_san"))
+			set = append(set, headerOption(registry.Header{Name: xfccHeader, Value: value}, core.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD))
+		}
+		for _, h := range cc.Headers {
+			outputs = append(outputs, h.Name)
+			set = append(set, headerOption(registry.Header{Name: h.Name, Value: fromEdge(h.Field)}, core.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD))
+		}
+
+		if tls == nil {
+			for _, r := range vh.Routes {
+				r.RequestHeadersToRemove = append(r.RequestHeadersToRemove, outputs...)
+			}
+		} else {
+			vh.Routes = cloneRoutes(vh.Routes, outputs, func(r *route.Route) {
+				r.Match.Headers = append(r.Match.Headers,
+					&route.HeaderMatcher{
+						Name: edgeSecretHeader,
+						HeaderMatchSpecifier: &route.HeaderMatcher_StringMatch{
+							StringMatch: &matcher.StringMatcher{
+								MatchPattern: &matcher.StringMatcher_Exact{Exact: tls.EdgeSecret},
+							},
+						},
+					},
+					&route.HeaderMatcher{
+						Name:                 clientCertHeader("fingerprint"),
+						HeaderMatchSpecifier: &route.HeaderMatcher_PresentMatch{PresentMatch: true},
+					})
+				r.RequestHeadersToAdd = append(r.RequestHeadersToAdd, set...)
+			})
+		}
+		// Evaluated after the routes, so the clones have read them first.
+		vh.RequestHeadersToRemove = append(vh.RequestHeadersToRemove, internal...)
+		vh.RequestHeadersToRemove = append(vh.RequestHeadersToRemove, edgeSecretHeader)
+	}
+}
+
+// cloneRoutes makes every route strip the headers in remove, and puts in
+// front of each a clone adjusted by fn.
+func cloneRoutes(routes []*route.Route, remove []string, fn func(*route.Route)) []*route.Route {
+	out := make([]*route.Route, 0, 2*len(routes))
+	for _, r := range routes {
+		r.RequestHeadersToRemove = append(r.RequestHeadersToRemove, remove...)
+		clone := proto.Clone(r).(*route.Route)
+		if clone.Match == nil {
+			clone.Match = &route.RouteMatch{}
+		}
+		fn(clone)
+		out = append(out, clone, r)
+	}
+	return out
+}
@@ -0,0 +1,36 @@
+package xds
+
+import (
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/envoyage/envoyage/internal/registry"
+)
+
+// Concurrency limits
+//
+// registry.Concurrency maps onto the cluster's circuit breaker on the home
+// node, the one node whose cluster talks to the app: max_requests (HTTP/2)
+// and max_connections (HTTP/1.1, one request per connection) cap what is in
+// flight, and max_pending_requests is the queue in front of it. A queued
+// request waits for a free slot within its route timeout; past the queue
+// Envoy answers 503 with x-envoy-overloaded at once, and counts it in the
+// cluster's upstream_rq_pending_overflow stat. A request also waits in the
+// queue while its connection is being opened, so the queue holds at least
+// one. The edges pass requests on to the home node unlimited.
+
+// applyConcurrency sets the service's concurrency limit on its cluster.
+func applyConcurrency(c *cluster.Cluster, conc *registry.Concurrency) {
+	if conc == nil {
+		return
+	}
+	c.CircuitBreakers = &cluster.CircuitBreakers{
+		Thresholds: []*cluster.CircuitBreakers_Thresholds{{
+			Priority:           core.RoutingPriority_DEFAULT,
+			MaxConnections:     wrapperspb.UInt32(uint32(conc.Max)),
+			MaxRequests:        wrapperspb.UInt32(uint32(conc.Max)),
+			MaxPendingRequests: wrapperspb.UInt32(uint32(max(conc.Queue, 1))),
+		}},
+	}
+}
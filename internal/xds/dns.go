@@ -0,0 +1,125 @@
+package xds
+
+import (
+	"fmt"
+	"net/netip"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	caresv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/network/dns_resolver/cares/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	"github.com/envoyage/envoyage/internal/config"
+	"github.com/envoyage/envoyage/internal/registry"
+)
+
+const caresResolverName = "envoy.network.dns_resolvers.cares"
+
+var dnsLookupFamilies = map[string]cluster.Cluster_DnsLookupFamily{
+	"auto":         cluster.Cluster_AUTO,
+	"v4_only":      cluster.Cluster_V4_ONLY,
+	"v6_only":      cluster.Cluster_V6_ONLY,
+	"v4_preferred": cluster.Cluster_V4_PREFERRED,
+	"all":          cluster.Cluster_ALL,
+}
+
+// dnsClusterTypes maps registry.DNS types to Envoy's.
+var dnsClusterTypes = map[string]cluster.Cluster_DiscoveryType{
+	registry.DNSStrict:  cluster.Cluster_STRICT_DNS,
+	registry.DNSLogical: cluster.Cluster_LOGICAL_DNS,
+	registry.DNSStatic:  cluster.Cluster_STATIC,
+}
+
+// applyServiceDNS applies a service's own DNS settings to its cluster on
+// the home node. Its refresh rate, if any, is kept by applyDNS.
+func applyServiceDNS(c *cluster.Cluster, d *registry.DNS) {
+	if d == nil {
+		return
+	}
+	if typ, ok := dnsClusterTypes[d.Type]; ok {
+		c.ClusterDiscoveryType = &cluster.Cluster_Type{Type: typ}
+	}
+	if d.RefreshRate > 0 {
+		c.DnsRefreshRate = durationpb.New(d.RefreshRate)
+	}
+}
+
+// applyDNS sets the configured resolution behaviour on every STRICT_DNS
+// and LOGICAL_DNS cluster, keeping a service's own refresh rate. It is
+// applied on the home node only: the edge resolves nothing but the tunnel
+// address, and a LAN resolver is not reachable from there.
+//
+// Failures show up per service as the cluster's update_failure counter,
+// which the stats scraper exports and uses to classify unhealthy services.
+func applyDNS(clusters []types.Resource, cfg *config.DNS) error {
+	if cfg == nil {
+		return nil
+	}
+
+	resolver, err := caresResolver(cfg)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range clusters {
+		c, ok := r.(*cluster.Cluster)
+		if !ok || c.GetType() != cluster.Cluster_STRICT_DNS && c.GetType() != cluster.Cluster_LOGICAL_DNS {
+			continue
+		}
+		if c.DnsRefreshRate == nil {
+			c.DnsRefreshRate = durationpb.New(cfg.RefreshRate)
+		}
+		c.RespectDnsTtl = cfg.RespectTTL
+		c.DnsFailureRefreshRate = &cluster.Cluster_RefreshRate{
+			BaseInterval: durationpb.New(cfg.FailureRefreshBase),
+			MaxInterval:  durationpb.New(cfg.FailureRefreshMax),
+		}
+		c.DnsLookupFamily = dnsLookupFamilies[cfg.LookupFamily]
+		c.TypedDnsResolverConfig = resolver
+	}
+	return nil
+}
+
+// caresResolver returns the resolver config for cfg.Resolvers, or nil to use
+// the system resolver.
+func caresResolver(cfg *config.DNS) (*core.TypedExtensionConfig, error) {
+	if cfg == nil || len(cfg.Resolvers) == 0 {
+		return nil, nil
+	}
+	cares := &caresv3.CaresDnsResolverConfig{}
+	for _, r := range cfg.Resolvers {
+		addr, err := resolverAddress(r)
+		if err != nil {
+			return nil, err
+		}
+		cares.Resolvers = append(cares.Resolvers, addr)
+	}
+	typed, err := anypb.New(cares)
+	if err != nil {
+		return nil, fmt.Errorf("marshaling dns resolver config: %w", err)
+	}
+	return &core.TypedExtensionConfig{Name: caresResolverName, TypedConfig: typed}, nil
+}
+
+// resolverAddress parses "ip" or "ip:port" into a UDP address.
+func resolverAddress(s string) (*core.Address, error) {
+	ap, err := netip.ParseAddrPort(s)
+	if err != nil {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid dns resolver %q", s)
+		}
+		ap = netip.AddrPortFrom(addr, 53)
+	}
+	return &core.Address{
+		Address: &core.Address_SocketAddress{
+			SocketAddress: &core.SocketAddress{
+				Protocol:      core.SocketAddress_UDP,
+				Address:       ap.Addr().String(),
+				PortSpecifier: &core.SocketAddress_PortValue{PortValue: uint32(ap.Port())},
+			},
+		},
+	}, nil
+}
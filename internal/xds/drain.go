@@ -0,0 +1,151 @@
+package xds
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+
+	"github.com/envoyage/envoyage/internal/registry"
+)
+
+// Draining removed services
+//
+// Removing a service used to drop its route and cluster in the same push.
+// Envoy tears down a removed cluster's connection pools straight away, so
+// requests still in flight to it (a slow upload, a long poll) were reset.
+//
+// Instead, a removed service's route goes first — new requests get a 404 —
+// while its cluster stays for config.Drain.Grace, after which one more
+// rebuild removes it. Re-adding the service within the grace period simply
+// ends the drain.
+//
+// This covers removal only. Listener-level changes are drained by Envoy
+// itself (--drain-time-s), and an upstream change keeps the cluster name, so
+// Envoy drains the old hosts' connections on its own.
+
+// drainState tracks which services are draining. Guarded by Server.rebuildMu.
+type drainState struct {
+	live     map[string]*registry.Service // services in the last pushed snapshots
+	draining map[string]drainingService
+}
+
+type drainingService struct {
+	svc   *registry.Service
+	until time.Time
+}
+
+// plan works out which services drain in a rebuild of services. It doesn't
+// change the state; commit does that once the rebuild has been pushed, so a
+// rebuild that fails pre-flight doesn't lose track of a removal.
+func (d *drainState) plan(services []*registry.Service, grace time.Duration, now time.Time) (next map[string]drainingService, draining []*registry.Service) {
+	current := make(map[string]bool, len(services))
+	for _, svc := range services {
+		current[svc.Name] = true
+	}
+
+	next = make(map[string]drainingService)
+	for name, ds := range d.draining {
+		if !current[name] && now.Before(ds.until) {
+			next[name] = ds
+		}
+	}
+	if grace > 0 {
+		for name, svc := range d.live {
+			if _, ok := next[name]; !ok && !current[name] {
+				next[name] = drainingService{svc: svc, until: now.Add(grace)}
+			}
+		}
+	}
+
+	for _, ds := range next {
+		draining = append(draining, ds.svc)
+	}
+	return next, draining
+}
+
+// commit records a pushed rebuild and returns the drains it started.
+func (d *drainState) commit(services []*registry.Service, next map[string]drainingService) (started []drainingService) {
+	for name, ds := range next {
+		if _, ok := d.draining[name]; !ok {
+			started = append(started, ds)
+		}
+	}
+	d.live = make(map[string]*registry.Service, len(services))
+	for _, svc := range services {
+		d.live[svc.Name] = svc
+	}
+	d.draining = next
+	return started
+}
+
+// scheduleDrainExpiry rebuilds once the given drains have run out.
+func (s *Server) scheduleDrainExpiry(started []drainingService) {
+	for _, ds := range started {
+		time.AfterFunc(time.Until(ds.until), func() {
+			if err := s.timedRebuild(); err != nil {
+				s.log.Error("failed to remove drained cluster", "service", ds.svc.Name, "error", err)
+				return
+			}
+			s.log.Info("drained service removed", "service", ds.svc.Name)
+		})
+	}
+}
+
+// timedRebuild rebuilds because time passed (a drain or share link ran
+// out) rather than because the registry changed.
+func (s *Server) timedRebuild() error {
+	s.rebuildMu.Lock()
+	s.timerSeq++
+	s.rebuildMu.Unlock()
+	return s.rebuildSnapshots(context.Background())
+}
+
+// snapshotVersion is the version label for a rebuild at registry version v.
+// Timed rebuilds don't change the registry version, so they get a suffix to
+// make Envoy see a new snapshot.
+func snapshotVersion(v, timerSeq uint64) string {
+	if timerSeq == 0 {
+		return fmt.Sprintf("v%d", v)
+	}
+	return fmt.Sprintf("v%d.%d", v, timerSeq)
+}
+
+// drainingClusters returns clusters for the draining services this node
+// served. services are the node's visible services, to skip any name that
+// is live again.
+func (b *SnapshotBuilder) drainingClusters(node Node, isEdge bool, services, draining []*registry.Service) []types.Resource {
+	live := make(map[string]bool, len(services))
+	for _, svc := range services {
+		live[svc.Name] = true
+	}
+
+	var out []types.Resource
+	for _, svc := range draining {
+		if live[svc.Name] || svc.TCP != nil || svc.AnsweredByEnvoy() {
+			continue
+		}
+		eff, err := b.policy.Resolve(svc)
+		if err != nil || !b.serves(node, isEdge, svc, eff) {
+			continue
+		}
+		name := fmt.Sprintf("cluster_%s", svc.Name)
+		if svc.ForwardProxy != nil && !isEdge {
+			c, err := makeForwardProxyCluster(name, b.cfg.DNS)
+			if err != nil {
+				continue
+			}
+			out = append(out, c)
+			continue
+		}
+		upstream := svc.Upstream
+		if isEdge {
+			upstream = b.cfg.HomeIngress
+		} else if svc.Canary != nil && svc.ForwardProxy == nil && !svc.Maintenance {
+			out = append(out, makeCluster(canaryClusterName(svc), svc.Canary.Upstream))
+		}
+		out = append(out, makeCluster(name, upstream))
+	}
+	return out
+}
@@ -0,0 +1,71 @@
+package xds
+
+import (
+	accesslogv3 "github.com/envoyproxy/go-control-plane/envoy/config/accesslog/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	hcm "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+
+	"github.com/envoyage/envoyage/internal/config"
+)
+
+// Error pages
+//
+// config.ErrorPages replaces the bodies of the errors Envoy answers itself
+// with the operator's HTML, on every node, through the listeners' local
+// reply config: not_found for a request no route matches (the NR response
+// flag), unavailable for one whose upstream failed, was overloaded or
+// timed out. The status is kept, and replies from the apps pass through
+// unchanged. So an app down behind a reachable home gets the home node's
+// unavailable page, which the edge forwards as it is; home itself being
+// unreachable gets the edge's, or its fallback page if it has one. The
+// catch-all's not_found action (see catchall.go) answers with not_found
+// too.
+
+// unavailableFlags are the response flags of the upstream failures the
+// unavailable page covers: no healthy host, connection failure, reset or
+// overflow, retries exhausted, and timeout.
+var unavailableFlags = []string{"UH", "UF", "UC", "UO", "URX", "UT"}
+
+// makeLocalReply returns the node's local reply config, or nil if Envoy's
+// default bodies are kept.
+func makeLocalReply(isEdge bool, cfg *config.Config) *hcm.LocalReplyConfig {
+	var mappers []*hcm.ResponseMapper
+	// First, as Envoy uses the first mapper that matches.
+	if isEdge && cfg.Fallback != nil {
+		mappers = append(mappers, fallbackMapper(cfg.Fallback))
+	}
+	if p := cfg.ErrorPages; p != nil {
+		if p.NotFound != "" {
+			mappers = append(mappers, htmlMapper([]string{"NR"}, p.NotFound))
+		}
+		if p.Unavailable != "" {
+			mappers = append(mappers, htmlMapper(unavailableFlags, p.Unavailable))
+		}
+	}
+	if len(mappers) == 0 {
+		return nil
+	}
+	return &hcm.LocalReplyConfig{Mappers: mappers}
+}
+
+// htmlMapper replaces the body of local replies with any of flags with an
+// HTML page.
+func htmlMapper(flags []string, body string) *hcm.ResponseMapper {
+	return &hcm.ResponseMapper{
+		Filter: &accesslogv3.AccessLogFilter{
+			FilterSpecifier: &accesslogv3.AccessLogFilter_ResponseFlagFilter{
+				ResponseFlagFilter: &accesslogv3.ResponseFlagFilter{Flags: flags},
+			},
+		},
+		Body: &core.DataSource{Specifier: &core.DataSource_InlineString{InlineString: body}},
+		// The body is passed through as is; only the content type is set.
+		BodyFormatOverride: &core.SubstitutionFormatString{
+			Format: &core.SubstitutionFormatString_TextFormatSource{
+				TextFormatSource: &core.DataSource{
+					Specifier: &core.DataSource_InlineString{InlineString: "%LOCAL_REPLY_BODY%"},
+				},
+			},
+			ContentType: "text/html; charset=utf-8",
+		},
+	}
+}
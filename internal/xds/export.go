@@ -0,0 +1,187 @@
+package xds
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	listener "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	cachev3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// Snapshot export and import
+//
+// ExportSnapshot writes the snapshot a node is being served to a file, as
+// xDS resources rather than a bootstrap: attached to a bug report it shows
+// exactly what the node was told, and ImportSnapshot can push it back
+// later, to the same node, unchanged. An imported snapshot pins the node:
+// registry changes keep being built and validated for it, but not pushed,
+// until ReleaseSnapshot hands it back to the live registry. That is how a
+// known-good config is replayed during an incident while the registry is
+// being fixed.
+
+// ErrRedacted is returned by ImportSnapshot for an export whose secrets
+// were redacted, which would push the placeholders instead.
+var ErrRedacted = errors.New("snapshot is redacted")
+
+// ErrNotPinned is returned by ReleaseSnapshot for a node that is served the
+// live snapshot already.
+var ErrNotPinned = errors.New("node is not pinned")
+
+// SnapshotFile is an exported snapshot. Resources are in Envoy's JSON form
+// (proto field names), ordered by name.
+type SnapshotFile struct {
+	Node     string    `json:"node"`
+	Version  string    `json:"version"`
+	Exported time.Time `json:"exported"`
+
+	// Redacted marks an export with its secrets replaced, for sharing. It
+	// can't be imported.
+	Redacted bool `json:"redacted,omitempty"`
+
+	Clusters  []json.RawMessage `json:"clusters"`
+	Routes    []json.RawMessage `json:"routes"`
+	Listeners []json.RawMessage `json:"listeners"`
+}
+
+// ExportSnapshot returns the snapshot currently held for nodeID.
+func (s *Server) ExportSnapshot(nodeID string) (*SnapshotFile, error) {
+	snap, err := s.cache.GetSnapshot(nodeID)
+	if err != nil {
+		return nil, fmt.Errorf("no snapshot for node %q: %w", nodeID, err)
+	}
+	f := &SnapshotFile{
+		Node:     nodeID,
+		Version:  snap.GetVersion(resource.ListenerType),
+		Exported: time.Now().UTC().Truncate(time.Second),
+	}
+	for _, t := range []struct {
+		typ resource.Type
+		out *[]json.RawMessage
+	}{
+		{resource.ClusterType, &f.Clusters},
+		{resource.RouteType, &f.Routes},
+		{resource.ListenerType, &f.Listeners},
+	} {
+		resources := snap.GetResources(t.typ)
+		*t.out = []json.RawMessage{}
+		for _, name := range sortedNames(resources) {
+			js, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(resources[name])
+			if err != nil {
+				return nil, fmt.Errorf("marshaling %q: %w", name, err)
+			}
+			*t.out = append(*t.out, js)
+		}
+	}
+	return f, nil
+}
+
+// ImportSnapshot pins nodeID to an exported snapshot of it, after the same
+// consistency check and pre-flight validation as a build. It returns the
+// version the snapshot is pushed as.
+func (s *Server) ImportSnapshot(ctx context.Context, nodeID string, f *SnapshotFile) (string, error) {
+	switch {
+	case f.Redacted:
+		return "", ErrRedacted
+	case f.Node != nodeID:
+		return "", fmt.Errorf("snapshot is of node %q, not %q", f.Node, nodeID)
+	}
+	if !s.managed(nodeID) {
+		return "", fmt.Errorf("node %q: %w", nodeID, ErrNodeNotFound)
+	}
+
+	clusters, err := decodeResources(f.Clusters, func() proto.Message { return &cluster.Cluster{} })
+	if err != nil {
+		return "", fmt.Errorf("clusters: %w", err)
+	}
+	routes, err := decodeResources(f.Routes, func() proto.Message { return &route.RouteConfiguration{} })
+	if err != nil {
+		return "", fmt.Errorf("routes: %w", err)
+	}
+	listeners, err := decodeResources(f.Listeners, func() proto.Message { return &listener.Listener{} })
+	if err != nil {
+		return "", fmt.Errorf("listeners: %w", err)
+	}
+
+	// A version of its own, so Envoy takes it even over the snapshot it
+	// was exported from.
+	version := fmt.Sprintf("%s+import.%d", f.Version, time.Now().Unix())
+	snap, err := cachev3.NewSnapshot(version, map[resource.Type][]types.Resource{
+		resource.ClusterType:  clusters,
+		resource.RouteType:    routes,
+		resource.ListenerType: listeners,
+	})
+	if err != nil {
+		return "", fmt.Errorf("creating snapshot: %w", err)
+	}
+	if err := snap.Consistent(); err != nil {
+		return "", fmt.Errorf("snapshot consistency check failed: %w", err)
+	}
+
+	s.rebuildMu.Lock()
+	defer s.rebuildMu.Unlock()
+	if s.preflight != nil {
+		if err := s.preflight.check(ctx, nodeID, snap); err != nil {
+			return "", fmt.Errorf("snapshot failed pre-flight: %w", err)
+		}
+	}
+	if err := s.cache.SetSnapshot(ctx, nodeID, snap); err != nil {
+		return "", fmt.Errorf("setting snapshot for node %q: %w", nodeID, err)
+	}
+	s.pinMu.Lock()
+	s.pinned[nodeID] = version
+	s.pinMu.Unlock()
+	s.log.Warn("node pinned to imported snapshot", "node", nodeID, "version", version)
+	return version, nil
+}
+
+// ReleaseSnapshot unpins nodeID and pushes it the live snapshot.
+func (s *Server) ReleaseSnapshot(ctx context.Context, nodeID string) error {
+	s.pinMu.Lock()
+	_, ok := s.pinned[nodeID]
+	delete(s.pinned, nodeID)
+	s.pinMu.Unlock()
+	if !ok {
+		return fmt.Errorf("node %q: %w", nodeID, ErrNotPinned)
+	}
+	s.log.Info("node released from imported snapshot", "node", nodeID)
+	return s.rebuildFor(ctx, nodeID)
+}
+
+// pinnedVersion returns the version of the imported snapshot nodeID is
+// pinned to, if any.
+func (s *Server) pinnedVersion(nodeID string) (string, bool) {
+	s.pinMu.Lock()
+	defer s.pinMu.Unlock()
+	v, ok := s.pinned[nodeID]
+	return v, ok
+}
+
+func (s *Server) managed(nodeID string) bool {
+	for _, n := range s.Nodes() {
+		if n.ID == nodeID {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeResources(raw []json.RawMessage, newMsg func() proto.Message) ([]types.Resource, error) {
+	out := make([]types.Resource, len(raw))
+	for i, js := range raw {
+		m := newMsg()
+		if err := protojson.Unmarshal(js, m); err != nil {
+			return nil, fmt.Errorf("resource %d: %w", i, err)
+		}
+		out[i] = m
+	}
+	return out, nil
+}
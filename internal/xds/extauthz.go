@@ -0,0 +1,171 @@
+package xds
+
+import (
+	"fmt"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	extauthzv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/ext_authz/v3"
+	hcm "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	matcher "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	"github.com/envoyage/envoyage/internal/config"
+	"github.com/envoyage/envoyage/internal/registry"
+)
+
+// External authorization (SSO)
+//
+// Services with ExtAuthz set are gated by an HTTP auth service such as
+// Authelia or oauth2-proxy. Envoy's ext_authz filter sends a check request
+// for every incoming request; a 2xx lets it through, anything else is
+// returned to the client as-is (typically a redirect to the login portal).
+//
+// The filter is only emitted on the home node. The auth service runs at home
+// and every edge request is forwarded through the home Envoy anyway, so
+// checking there covers both the public and the LAN path with a single
+// auth cluster — the edge never needs to reach Authelia directly.
+//
+// The filter sits in the shared HCM and is switched off per virtual host for
+// services that do not opt in. That way a new service is only unprotected if
+// it explicitly says so, never because a route was missed.
+
+const (
+	extAuthzClusterName = "ext_authz"
+	extAuthzFilterName  = "envoy.filters.http.ext_authz"
+)
+
+// Headers forwarded to the auth service in check requests. Cookies carry the
+// SSO session; the X-Forwarded-* set tells the portal where to redirect back.
+var extAuthzRequestHeaders = []string{
+	"cookie",
+	"authorization",
+	"proxy-authorization",
+	"accept",
+	"x-forwarded-for",
+	"x-forwarded-proto",
+	"x-forwarded-host",
+	"x-forwarded-uri",
+	"x-forwarded-method",
+}
+
+// Headers copied from an allowing auth response onto the upstream request,
+// so apps can trust the authenticated identity (Authelia's Remote-*,
+// oauth2-proxy's X-Auth-Request-*).
+var extAuthzUpstreamHeaderPrefixes = []string{
+	"remote-",
+	"x-auth-request-",
+}
+
+// extAuthzIdentityHeaders are the headers of extAuthzUpstreamHeaderPrefixes
+// that Authelia and oauth2-proxy set. Routes that skip the auth service
+// remove them, so a client can't send its own.
+var extAuthzIdentityHeaders = []string{
+	"remote-user", "remote-groups", "remote-name", "remote-email",
+	"x-auth-request-user", "x-auth-request-email", "x-auth-request-preferred-username",
+	"x-auth-request-groups", "x-auth-request-access-token",
+}
+
+// applyExtAuthz returns the ext_authz filter and auth cluster needed for the
+// given services, and disables the filter on the virtual hosts of services
+// that do not opt in. vhosts must be index-aligned with services.
+// Returns nil, nil, nil if no service requires ext_authz.
+func (b *SnapshotBuilder) applyExtAuthz(services []*registry.Service, vhosts []*route.VirtualHost) (*hcm.HttpFilter, *cluster.Cluster, error) {
+	needed := false
+	for _, svc := range services {
+		if svc.ExtAuthz {
+			needed = true
+			if b.cfg.ExtAuthz == nil {
+				return nil, nil, fmt.Errorf("service %q requires ext_authz but none is configured", svc.Name)
+			}
+		}
+	}
+	if !needed {
+		return nil, nil, nil
+	}
+
+	filter, err := makeExtAuthzFilter(b.cfg.ExtAuthz)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i, svc := range services {
+		if svc.ExtAuthz {
+			continue
+		}
+		if err := disableExtAuthz(vhosts[i]); err != nil {
+			return nil, nil, err
+		}
+	}
+	return filter, makeCluster(extAuthzClusterName, b.cfg.ExtAuthz.Upstream), nil
+}
+
+// makeExtAuthzFilter builds the ext_authz HTTP filter pointing at the
+// configured auth service.
+func makeExtAuthzFilter(cfg *config.ExtAuthz) (*hcm.HttpFilter, error) {
+	var allowed []*matcher.StringMatcher
+	for _, h := range extAuthzRequestHeaders {
+		allowed = append(allowed, &matcher.StringMatcher{
+			MatchPattern: &matcher.StringMatcher_Exact{Exact: h},
+		})
+	}
+	var upstream []*matcher.StringMatcher
+	for _, p := range extAuthzUpstreamHeaderPrefixes {
+		upstream = append(upstream, &matcher.StringMatcher{
+			MatchPattern: &matcher.StringMatcher_Prefix{Prefix: p},
+			IgnoreCase:   true,
+		})
+	}
+
+	authz := &extauthzv3.ExtAuthz{
+		TransportApiVersion: core.ApiVersion_V3,
+		Services: &extauthzv3.ExtAuthz_HttpService{
+			HttpService: &extauthzv3.HttpService{
+				ServerUri: &core.HttpUri{
+					Uri: "http://" + cfg.Upstream,
+					HttpUpstreamType: &core.HttpUri_Cluster{
+						Cluster: extAuthzClusterName,
+					},
+					Timeout: durationpb.New(cfg.Timeout),
+				},
+				PathPrefix: cfg.PathPrefix,
+				AuthorizationRequest: &extauthzv3.AuthorizationRequest{
+					AllowedHeaders: &matcher.ListStringMatcher{Patterns: allowed},
+				},
+				AuthorizationResponse: &extauthzv3.AuthorizationResponse{
+					AllowedUpstreamHeaders: &matcher.ListStringMatcher{Patterns: upstream},
+				},
+			},
+		},
+	}
+
+	authzAny, err := anypb.New(authz)
+	if err != nil {
+		return nil, fmt.Errorf("marshaling ext_authz config: %w", err)
+	}
+	return &hcm.HttpFilter{
+		Name:       extAuthzFilterName,
+		ConfigType: &hcm.HttpFilter_TypedConfig{TypedConfig: authzAny},
+	}, nil
+}
+
+// disableExtAuthz switches the ext_authz filter off for one virtual host.
+func disableExtAuthz(vh *route.VirtualHost) error {
+	perRoute, err := anypb.New(&extauthzv3.ExtAuthzPerRoute{
+		Override: &extauthzv3.ExtAuthzPerRoute_Disabled{Disabled: true},
+	})
+	if err != nil {
+		return fmt.Errorf("marshaling ext_authz per-route config: %w", err)
+	}
+	setPerFilterConfig(vh, extAuthzFilterName, perRoute)
+	return nil
+}
+
+// setPerFilterConfig attaches filter-specific config to a virtual host.
+func setPerFilterConfig(vh *route.VirtualHost, filterName string, cfg *anypb.Any) {
+	if vh.TypedPerFilterConfig == nil {
+		vh.TypedPerFilterConfig = make(map[string]*anypb.Any)
+	}
+	vh.TypedPerFilterConfig[filterName] = cfg
+}
@@ -0,0 +1,33 @@
+package xds
+
+import (
+	"net/netip"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+)
+
+// applyFailover adds a service's failover upstream to its edge cluster, as
+// a second priority: Envoy only sends requests there while home, priority
+// 0, fails its probes (see applyOriginHealthCheck, which must have been
+// applied), and moves them back once a probe passes. The failover is probed
+// too, so with both down the fallback page is still served.
+func applyFailover(c *cluster.Cluster, failover string) {
+	if failover == "" {
+		return
+	}
+	host, port := splitHostPort(failover)
+	if _, err := netip.ParseAddr(host); err != nil {
+		// A static cluster can't resolve the hostname; strict DNS takes
+		// home's address as it is.
+		c.ClusterDiscoveryType = &cluster.Cluster_Type{Type: cluster.Cluster_STRICT_DNS}
+	}
+	c.LoadAssignment.Endpoints = append(c.LoadAssignment.Endpoints, &endpoint.LocalityLbEndpoints{
+		Priority: 1,
+		LbEndpoints: []*endpoint.LbEndpoint{{
+			HostIdentifier: &endpoint.LbEndpoint_Endpoint{
+				Endpoint: &endpoint.Endpoint{Address: makeAddress(host, port)},
+			},
+		}},
+	})
+}
@@ -0,0 +1,66 @@
+package xds
+
+import (
+	"time"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	hcm "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/envoyage/envoyage/internal/config"
+	"github.com/envoyage/envoyage/internal/registry"
+)
+
+const fallbackPage = `<!doctype html>
+<html><head><meta charset="utf-8"><title>Temporarily unavailable</title></head>
+<body style="font-family:sans-serif;max-width:32em;margin:4em auto;color:#333">
+<h1>Temporarily unavailable</h1>
+<p>This service can't be reached right now. Please try again in a few minutes.</p>
+</body></html>
+`
+
+// originProbeTimeout caps a single probe of home; shorter intervals use the
+// interval instead.
+const originProbeTimeout = 2 * time.Second
+
+// defaultOriginProbeInterval is how often edges probe home for a service
+// with a failover, and their copies of services, when fallback, which sets
+// its own interval, is off.
+const defaultOriginProbeInterval = 5 * time.Second
+
+// applyOriginHealthCheck has an edge cluster probe home over TCP every
+// interval. With the panic threshold at 0, a cluster whose only host failed
+// its probes sends nothing at all, so requests fail at once with "no
+// healthy upstream" instead of waiting out the connect timeout;
+// makeFallbackReply turns that into the fallback page.
+func applyOriginHealthCheck(c *cluster.Cluster, interval time.Duration) {
+	c.HealthChecks = []*core.HealthCheck{{
+		Interval:           durationpb.New(interval),
+		Timeout:            durationpb.New(min(interval, originProbeTimeout)),
+		UnhealthyThreshold: wrapperspb.UInt32(2),
+		HealthyThreshold:   wrapperspb.UInt32(1),
+		HealthChecker:      &core.HealthCheck_TcpHealthCheck_{TcpHealthCheck: &core.HealthCheck_TcpHealthCheck{}},
+	}}
+	c.CommonLbConfig = &cluster.Cluster_CommonLbConfig{
+		HealthyPanicThreshold: &typev3.Percent{Value: 0},
+	}
+}
+
+// fallbackMapper replaces the replies Envoy generates when it can't reach
+// home (no healthy upstream, or the connection failed) with the fallback
+// page. Errors from the apps themselves pass through unchanged.
+func fallbackMapper(fb *config.Fallback) *hcm.ResponseMapper {
+	body := fb.Body
+	if body == "" {
+		body = fallbackPage
+	}
+	m := htmlMapper([]string{"UH", "UF"}, body)
+	m.StatusCode = wrapperspb.UInt32(uint32(fb.Status))
+	m.HeadersToAdd = []*core.HeaderValueOption{
+		headerOption(registry.Header{Name: "Retry-After", Value: "60"}, core.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD),
+	}
+	return m
+}
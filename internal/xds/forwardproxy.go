@@ -0,0 +1,192 @@
+package xds
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	dfpclusterv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/clusters/dynamic_forward_proxy/v3"
+	dfpcommonv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/common/dynamic_forward_proxy/v3"
+	dfpv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/dynamic_forward_proxy/v3"
+	hcm "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	matcher "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	"github.com/envoyage/envoyage/internal/config"
+	"github.com/envoyage/envoyage/internal/registry"
+)
+
+// Forward proxy services
+//
+// A forward proxy service (registry.ForwardProxy) has no fixed upstream. The
+// client names the destination in the X-Envoyage-Destination header, e.g.
+//
+//	curl -H 'X-Envoyage-Destination: printer.lan:631' https://proxy.example.com/
+//
+// and the home node resolves and connects to it on the fly with Envoy's
+// dynamic forward proxy. Only destinations on the service's allowlist are
+// routed; everything else gets a 403 before any DNS lookup happens.
+//
+// Edge nodes treat the service like any other and pass the header through;
+// only the home node, which is on the LAN, knows it is a proxy.
+
+const (
+	dfpFilterName      = "envoy.filters.http.dynamic_forward_proxy"
+	dfpClusterTypeName = "envoy.clusters.dynamic_forward_proxy"
+
+	// dfpCacheName is shared by the filter and every forward proxy cluster;
+	// Envoy requires their cache configs to be identical.
+	dfpCacheName = "envoyage_forward_proxy"
+)
+
+// dfpCacheConfig is the DNS cache behind every forward proxy. It follows the
+// dns section of the config, so LAN names resolve the same way here as for
+// ordinary upstreams.
+func dfpCacheConfig(dns *config.DNS) (*dfpcommonv3.DnsCacheConfig, error) {
+	cache := &dfpcommonv3.DnsCacheConfig{
+		Name:            dfpCacheName,
+		DnsLookupFamily: cluster.Cluster_V4_PREFERRED,
+		HostTtl:         durationpb.New(5 * time.Minute),
+	}
+	if dns == nil {
+		return cache, nil
+	}
+	resolver, err := caresResolver(dns)
+	if err != nil {
+		return nil, err
+	}
+	cache.DnsLookupFamily = dnsLookupFamilies[dns.LookupFamily]
+	cache.DnsRefreshRate = durationpb.New(dns.RefreshRate)
+	cache.DnsFailureRefreshRate = &cluster.Cluster_RefreshRate{
+		BaseInterval: durationpb.New(dns.FailureRefreshBase),
+		MaxInterval:  durationpb.New(dns.FailureRefreshMax),
+	}
+	cache.TypedDnsResolverConfig = resolver
+	return cache, nil
+}
+
+// makeForwardProxyCluster returns the cluster a forward proxy service routes
+// to. It keeps the cluster_<service> name so stats stay per service.
+func makeForwardProxyCluster(name string, dns *config.DNS) (*cluster.Cluster, error) {
+	cache, err := dfpCacheConfig(dns)
+	if err != nil {
+		return nil, err
+	}
+	typed, err := anypb.New(&dfpclusterv3.ClusterConfig{
+		ClusterImplementationSpecifier: &dfpclusterv3.ClusterConfig_DnsCacheConfig{DnsCacheConfig: cache},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("marshaling forward proxy cluster %q: %w", name, err)
+	}
+	return &cluster.Cluster{
+		Name: name,
+		ClusterDiscoveryType: &cluster.Cluster_ClusterType{
+			ClusterType: &cluster.Cluster_CustomClusterType{Name: dfpClusterTypeName, TypedConfig: typed},
+		},
+		LbPolicy:       cluster.Cluster_CLUSTER_PROVIDED,
+		ConnectTimeout: durationpb.New(5 * time.Second),
+	}, nil
+}
+
+// makeForwardProxyRoutes replaces the virtual host's route with one that
+// forwards allowed destinations and a catch-all 403.
+func makeForwardProxyRoutes(vh *route.VirtualHost, fp *registry.ForwardProxy, clusterName string) error {
+	allowed, err := forwardProxyAllowRegex(fp.Allow)
+	if err != nil {
+		return err
+	}
+	perRoute, err := anypb.New(&dfpv3.PerRouteConfig{
+		HostRewriteSpecifier: &dfpv3.PerRouteConfig_HostRewriteHeader{HostRewriteHeader: strings.ToLower(registry.ForwardProxyHeader)},
+	})
+	if err != nil {
+		return fmt.Errorf("marshaling forward proxy route config: %w", err)
+	}
+
+	vh.Routes = []*route.Route{
+		{
+			Match: &route.RouteMatch{
+				PathSpecifier: &route.RouteMatch_Prefix{Prefix: "/"},
+				Headers: []*route.HeaderMatcher{{
+					Name: strings.ToLower(registry.ForwardProxyHeader),
+					HeaderMatchSpecifier: &route.HeaderMatcher_StringMatch{
+						StringMatch: &matcher.StringMatcher{
+							MatchPattern: &matcher.StringMatcher_SafeRegex{
+								SafeRegex: &matcher.RegexMatcher{Regex: allowed},
+							},
+						},
+					},
+				}},
+			},
+			Action: &route.Route_Route{
+				Route: &route.RouteAction{
+					ClusterSpecifier: &route.RouteAction_Cluster{Cluster: clusterName},
+				},
+			},
+			TypedPerFilterConfig: map[string]*anypb.Any{dfpFilterName: perRoute},
+		},
+		{
+			Match: &route.RouteMatch{
+				PathSpecifier: &route.RouteMatch_Prefix{Prefix: "/"},
+			},
+			Action: &route.Route_DirectResponse{
+				DirectResponse: &route.DirectResponseAction{
+					Status: 403,
+					Body: &core.DataSource{
+						Specifier: &core.DataSource_InlineString{
+							InlineString: "destination missing or not allowed; set " + registry.ForwardProxyHeader + "\n",
+						},
+					},
+				},
+			},
+		},
+	}
+	return nil
+}
+
+// forwardProxyAllowRegex turns an allowlist into one case-insensitive RE2
+// regex over the destination header.
+func forwardProxyAllowRegex(allow []string) (string, error) {
+	alts := make([]string, 0, len(allow))
+	for _, entry := range allow {
+		host, port, wildcard, err := registry.ParseForwardProxyAllow(entry)
+		if err != nil {
+			return "", err
+		}
+		alt := regexp.QuoteMeta(host)
+		if wildcard {
+			alt = `(?:[a-z0-9-]+\.)+` + alt
+		}
+		if port > 0 {
+			alt += ":" + strconv.Itoa(port)
+		} else {
+			alt += `(?::[0-9]+)?`
+		}
+		alts = append(alts, alt)
+	}
+	return "(?i)^(?:" + strings.Join(alts, "|") + ")$", nil
+}
+
+// makeForwardProxyFilter returns the HCM filter that resolves destinations
+// for forward proxy routes. It does nothing for other routes.
+func makeForwardProxyFilter(dns *config.DNS) (*hcm.HttpFilter, error) {
+	cache, err := dfpCacheConfig(dns)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := anypb.New(&dfpv3.FilterConfig{
+		ImplementationSpecifier: &dfpv3.FilterConfig_DnsCacheConfig{DnsCacheConfig: cache},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("marshaling forward proxy filter: %w", err)
+	}
+	return &hcm.HttpFilter{
+		Name:       dfpFilterName,
+		ConfigType: &hcm.HttpFilter_TypedConfig{TypedConfig: cfg},
+	}, nil
+}
@@ -0,0 +1,57 @@
+package xds
+
+import (
+	"strings"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+
+	"github.com/envoyage/envoyage/internal/registry"
+)
+
+// applyHeaderRules renders a service's header rules onto the routes of its
+// virtual host.
+//
+// Rules are applied on the home node only. Every request, LAN or public,
+// passes the home Envoy on its way to the app, and every response passes it
+// on the way back, so applying them once there gives the same result on both
+// paths — and an "add" never runs twice. It also keeps the edge from
+// rewriting Host, which the home Envoy still needs for routing.
+//
+// Envoy refuses to touch Host through request_headers_to_add, so a Host "set"
+// rule becomes a host rewrite on the route action instead.
+func applyHeaderRules(vh *route.VirtualHost, rules *registry.HeaderRules) {
+	if rules == nil {
+		return
+	}
+	for _, r := range vh.Routes {
+		for _, h := range rules.Request.Set {
+			if strings.EqualFold(h.Name, "host") {
+				if action, ok := r.Action.(*route.Route_Route); ok {
+					action.Route.HostRewriteSpecifier = &route.RouteAction_HostRewriteLiteral{HostRewriteLiteral: h.Value}
+				}
+				continue
+			}
+			r.RequestHeadersToAdd = append(r.RequestHeadersToAdd, headerOption(h, core.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD))
+		}
+		for _, h := range rules.Request.Add {
+			r.RequestHeadersToAdd = append(r.RequestHeadersToAdd, headerOption(h, core.HeaderValueOption_APPEND_IF_EXISTS_OR_ADD))
+		}
+		r.RequestHeadersToRemove = append(r.RequestHeadersToRemove, rules.Request.Remove...)
+
+		for _, h := range rules.Response.Set {
+			r.ResponseHeadersToAdd = append(r.ResponseHeadersToAdd, headerOption(h, core.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD))
+		}
+		for _, h := range rules.Response.Add {
+			r.ResponseHeadersToAdd = append(r.ResponseHeadersToAdd, headerOption(h, core.HeaderValueOption_APPEND_IF_EXISTS_OR_ADD))
+		}
+		r.ResponseHeadersToRemove = append(r.ResponseHeadersToRemove, rules.Response.Remove...)
+	}
+}
+
+func headerOption(h registry.Header, action core.HeaderValueOption_HeaderAppendAction) *core.HeaderValueOption {
+	return &core.HeaderValueOption{
+		Header:       &core.HeaderValue{Key: h.Name, Value: h.Value},
+		AppendAction: action,
+	}
+}
@@ -0,0 +1,54 @@
+package xds
+
+import (
+	"time"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/envoyage/envoyage/internal/registry"
+)
+
+// Health check defaults; see registry.HealthCheck.
+const (
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultHealthCheckTimeout  = 2 * time.Second
+
+	// Three failed probes take the upstream out of rotation, two passing
+	// ones put it back, so one dropped packet doesn't flap it.
+	unhealthyThreshold = 3
+	healthyThreshold   = 2
+)
+
+// applyHealthCheck adds the service's TCP probe to its cluster. Only the
+// home node probes: an edge's upstream is the home Envoy, whose health says
+// nothing about the app.
+func applyHealthCheck(c *cluster.Cluster, hc *registry.HealthCheck) {
+	if hc == nil {
+		return
+	}
+	interval, timeout := hc.Interval, hc.Timeout
+	if interval == 0 {
+		interval = defaultHealthCheckInterval
+	}
+	if timeout == 0 {
+		timeout = defaultHealthCheckTimeout
+	}
+
+	tcp := &core.HealthCheck_TcpHealthCheck{}
+	if hc.Send != "" {
+		tcp.Send = &core.HealthCheck_Payload{Payload: &core.HealthCheck_Payload_Binary{Binary: []byte(hc.Send)}}
+	}
+	if hc.Expect != "" {
+		tcp.Receive = []*core.HealthCheck_Payload{{Payload: &core.HealthCheck_Payload_Binary{Binary: []byte(hc.Expect)}}}
+	}
+	c.HealthChecks = []*core.HealthCheck{{
+		Interval:           durationpb.New(interval),
+		Timeout:            durationpb.New(timeout),
+		UnhealthyThreshold: wrapperspb.UInt32(unhealthyThreshold),
+		HealthyThreshold:   wrapperspb.UInt32(healthyThreshold),
+		HealthChecker:      &core.HealthCheck_TcpHealthCheck_{TcpHealthCheck: tcp},
+	}}
+}
@@ -0,0 +1,57 @@
+package xds
+
+import (
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/envoyage/envoyage/internal/registry"
+)
+
+// Host rewrite
+//
+// registry.Service.HostRewrite is applied on the home node only, like the
+// header rules (headers.go): the edge → home hop keeps the client's Host,
+// which home picks the service's virtual host by, and home rewrites it on
+// the way to the app. An alias with a Host of its own keeps it.
+//
+// "auto" sends the host name of the upstream host Envoy picked. Envoy only
+// knows one for DNS clusters; a STATIC cluster's endpoints (an IP
+// upstream, as Docker registers) are given their address as one, so the
+// app sees the address it was reached at.
+
+// applyHostRewrite sets the service's host rewrite on its virtual host's
+// routes to the upstream. clusters are the service's own.
+func applyHostRewrite(vh *route.VirtualHost, clusters []types.Resource, rewrite string) {
+	if rewrite == "" {
+		return
+	}
+	for _, r := range vh.Routes {
+		action, ok := r.Action.(*route.Route_Route)
+		if !ok || action.Route.HostRewriteSpecifier != nil {
+			continue
+		}
+		if rewrite == registry.HostRewriteAuto {
+			action.Route.HostRewriteSpecifier = &route.RouteAction_AutoHostRewrite{AutoHostRewrite: wrapperspb.Bool(true)}
+		} else {
+			action.Route.HostRewriteSpecifier = &route.RouteAction_HostRewriteLiteral{HostRewriteLiteral: rewrite}
+		}
+	}
+	if rewrite != registry.HostRewriteAuto {
+		return
+	}
+	for _, res := range clusters {
+		c, ok := res.(*cluster.Cluster)
+		if !ok || c.GetType() != cluster.Cluster_STATIC {
+			continue
+		}
+		for _, locality := range c.GetLoadAssignment().GetEndpoints() {
+			for _, lb := range locality.GetLbEndpoints() {
+				if ep := lb.GetEndpoint(); ep != nil && ep.Hostname == "" {
+					ep.Hostname = ep.GetAddress().GetSocketAddress().GetAddress()
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package xds
+
+import (
+	"fmt"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	listener "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	hcm "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	quicv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/quic/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/wellknown"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/envoyage/envoyage/internal/config"
+	"github.com/envoyage/envoyage/internal/registry"
+)
+
+// HTTP/3 on the edges
+//
+// With config.TLS.HTTP3 the edges also take QUIC on the HTTPS port number,
+// over UDP, with the filter chains of the HTTPS listener (https.go) on the
+// QUIC transport, so TLS policies hold the same way. Clients only try
+// HTTP/3 once told it is there, so the services' responses carry an
+// Alt-Svc header pointing at the advertised port; on a staging node, at
+// its own. Envoy checks no client certificates over QUIC: a service whose
+// policy asks for them gets no chain and isn't advertised, and clients
+// keep using TCP for it.
+
+// altSvcHeader advertises HTTP/3.
+const altSvcHeader = "alt-svc"
+
+// offersHTTP3 reports whether svc is served over QUIC.
+func offersHTTP3(svc *registry.Service) bool {
+	return svc.TLS == nil || svc.TLS.ClientCert == "" || svc.TLS.ClientCert == registry.ClientCertNone
+}
+
+// applyAltSvc advertises HTTP/3 on port in the virtual hosts of the
+// services that offer it. vhosts must be index-aligned with services.
+func applyAltSvc(h *config.HTTP3, port uint32, services []*registry.Service, vhosts []*route.VirtualHost) {
+	value := fmt.Sprintf(`h3=":%d"; ma=%d`, port, int64(h.MaxAge/time.Second))
+	for i, svc := range services {
+		if !offersHTTP3(svc) {
+			continue
+		}
+		vhosts[i].ResponseHeadersToAdd = append(vhosts[i].ResponseHeadersToAdd,
+			headerOption(registry.Header{Name: altSvcHeader, Value: value}, core.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD))
+	}
+}
+
+// makeHTTP3Listener builds the edges' QUIC listener on UDP port. hcmFor
+// builds the HTTP connection manager for a route config, as for
+// makeHTTPSListener.
+func makeHTTP3Listener(cfg *config.TLS, port uint32, services []*registry.Service, hcmFor func(routeConfigName string) (*listener.Filter, error)) (*listener.Listener, error) {
+	var chains []*listener.FilterChain
+	for _, svc := range services {
+		if svc.TLS == nil || !offersHTTP3(svc) {
+			continue
+		}
+		chain, err := makeQUICChain(cfg, svc.TLS, tlsRouteConfigName(svc), hcmFor)
+		if err != nil {
+			return nil, fmt.Errorf("service %q: %w", svc.Name, err)
+		}
+		chain.Name = svc.Name
+		chain.FilterChainMatch = &listener.FilterChainMatch{ServerNames: serviceDomains(svc)}
+		chains = append(chains, chain)
+	}
+	chain, err := makeQUICChain(cfg, nil, "local_routes", hcmFor)
+	if err != nil {
+		return nil, err
+	}
+	chain.Name = "default"
+	chains = append(chains, chain)
+
+	return &listener.Listener{
+		Name: "listener_http3",
+		Address: &core.Address{
+			Address: &core.Address_SocketAddress{
+				SocketAddress: &core.SocketAddress{
+					Protocol:      core.SocketAddress_UDP,
+					Address:       "0.0.0.0",
+					PortSpecifier: &core.SocketAddress_PortValue{PortValue: port},
+				},
+			},
+		},
+		UdpListenerConfig: &listener.UdpListenerConfig{
+			QuicOptions: &listener.QuicProtocolOptions{},
+			DownstreamSocketConfig: &core.UdpSocketConfig{
+				PreferGro: wrapperspb.Bool(true),
+			},
+		},
+		FilterChains: chains,
+	}, nil
+}
+
+func makeQUICChain(cfg *config.TLS, policy *registry.TLSPolicy, routeConfigName string, hcmFor func(string) (*listener.Filter, error)) (*listener.FilterChain, error) {
+	ctx, err := downstreamTLSContext(cfg, policy)
+	if err != nil {
+		return nil, err
+	}
+	// QUIC negotiates h3 itself.
+	ctx.CommonTlsContext.AlpnProtocols = nil
+	transport, err := anypb.New(&quicv3.QuicDownstreamTransport{DownstreamTlsContext: ctx})
+	if err != nil {
+		return nil, fmt.Errorf("marshaling quic transport: %w", err)
+	}
+	hcmFilter, err := hcmFor(routeConfigName)
+	if err != nil {
+		return nil, err
+	}
+	if hcmFilter, err = asHTTP3(hcmFilter); err != nil {
+		return nil, err
+	}
+	return &listener.FilterChain{
+		Filters: []*listener.Filter{hcmFilter},
+		TransportSocket: &core.TransportSocket{
+			Name:       wellknown.TransportSocketQuic,
+			ConfigType: &core.TransportSocket_TypedConfig{TypedConfig: transport},
+		},
+	}, nil
+}
+
+// asHTTP3 switches an HTTP connection manager filter to the HTTP/3 codec.
+func asHTTP3(f *listener.Filter) (*listener.Filter, error) {
+	var conn hcm.HttpConnectionManager
+	if err := f.GetTypedConfig().UnmarshalTo(&conn); err != nil {
+		return nil, fmt.Errorf("unmarshaling HCM: %w", err)
+	}
+	conn.CodecType = hcm.HttpConnectionManager_HTTP3
+	conn.Http3ProtocolOptions = &core.Http3ProtocolOptions{}
+	typed, err := anypb.New(&conn)
+	if err != nil {
+		return nil, fmt.Errorf("marshaling HCM: %w", err)
+	}
+	return &listener.Filter{
+		Name:       f.Name,
+		ConfigType: &listener.Filter_TypedConfig{TypedConfig: typed},
+	}, nil
+}
@@ -0,0 +1,189 @@
+package xds
+
+import (
+	"fmt"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	listener "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	tlsinspectorv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/listener/tls_inspector/v3"
+	tlsv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/wellknown"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/envoyage/envoyage/internal/config"
+	"github.com/envoyage/envoyage/internal/registry"
+)
+
+// HTTPS on the edges
+//
+// The HTTPS listener has a default filter chain with config.TLS's settings
+// that serves every service, and one chain per service with a TLS policy,
+// picked by SNI. A policy chain gets its own route config holding only that
+// service's virtual host, and in the shared route config the service only
+// redirects to HTTPS. So a client can't get past a stricter policy by
+// sending one name in SNI and another in Host, or by using plain HTTP: both
+// end in a redirect that lands on the right chain.
+
+// tlsRouteConfigName names the route config of a service's policy chain.
+func tlsRouteConfigName(svc *registry.Service) string {
+	return "tls_routes_" + svc.Name
+}
+
+// splitTLSPolicies moves the virtual host of every service with a TLS
+// policy into a route config of its own, leaving an HTTPS redirect in its
+// place in vhosts. vhosts must be index-aligned with services and final.
+func splitTLSPolicies(services []*registry.Service, vhosts []*route.VirtualHost) []*route.RouteConfiguration {
+	var out []*route.RouteConfiguration
+	for i, svc := range services {
+		if svc.TLS == nil {
+			continue
+		}
+		vh := vhosts[i]
+		out = append(out, makeRouteConfig(tlsRouteConfigName(svc), []*route.VirtualHost{vh}))
+		vhosts[i] = &route.VirtualHost{
+			Name:    vh.Name,
+			Domains: vh.Domains,
+			Routes: []*route.Route{{
+				Match: &route.RouteMatch{
+					PathSpecifier: &route.RouteMatch_Prefix{Prefix: "/"},
+				},
+				Action: &route.Route_Redirect{
+					Redirect: &route.RedirectAction{
+						SchemeRewriteSpecifier: &route.RedirectAction_HttpsRedirect{HttpsRedirect: true},
+					},
+				},
+			}},
+		}
+	}
+	return out
+}
+
+// makeHTTPSListener builds the edges' HTTPS listener on port. hcmFor
+// builds the HTTP connection manager for a route config.
+func makeHTTPSListener(cfg *config.TLS, port uint32, services []*registry.Service, hcmFor func(routeConfigName string) (*listener.Filter, error)) (*listener.Listener, error) {
+	inspector, err := anypb.New(&tlsinspectorv3.TlsInspector{})
+	if err != nil {
+		return nil, fmt.Errorf("marshaling tls inspector: %w", err)
+	}
+
+	var chains []*listener.FilterChain
+	for _, svc := range services {
+		if svc.TLS == nil {
+			continue
+		}
+		chain, err := makeTLSChain(cfg, svc.TLS, tlsRouteConfigName(svc), hcmFor)
+		if err != nil {
+			return nil, fmt.Errorf("service %q: %w", svc.Name, err)
+		}
+		chain.Name = svc.Name
+		chain.FilterChainMatch = &listener.FilterChainMatch{ServerNames: serviceDomains(svc)}
+		chains = append(chains, chain)
+	}
+	// Last and without a match: used for every other server name.
+	chain, err := makeTLSChain(cfg, nil, "local_routes", hcmFor)
+	if err != nil {
+		return nil, err
+	}
+	chain.Name = "default"
+	chains = append(chains, chain)
+
+	return &listener.Listener{
+		Name:    "listener_https",
+		Address: makeAddress("0.0.0.0", port),
+		ListenerFilters: []*listener.ListenerFilter{{
+			Name:       wellknown.TlsInspector,
+			ConfigType: &listener.ListenerFilter_TypedConfig{TypedConfig: inspector},
+		}},
+		FilterChains: chains,
+	}, nil
+}
+
+func makeTLSChain(cfg *config.TLS, policy *registry.TLSPolicy, routeConfigName string, hcmFor func(string) (*listener.Filter, error)) (*listener.FilterChain, error) {
+	socket, err := makeDownstreamTLS(cfg, policy)
+	if err != nil {
+		return nil, err
+	}
+	hcmFilter, err := hcmFor(routeConfigName)
+	if err != nil {
+		return nil, err
+	}
+	return &listener.FilterChain{
+		Filters:         []*listener.Filter{hcmFilter},
+		TransportSocket: socket,
+	}, nil
+}
+
+// makeDownstreamTLS is the transport socket of an HTTPS filter chain: the
+// config's settings, overridden by policy if it is not nil.
+func makeDownstreamTLS(cfg *config.TLS, policy *registry.TLSPolicy) (*core.TransportSocket, error) {
+	ctx, err := downstreamTLSContext(cfg, policy)
+	if err != nil {
+		return nil, err
+	}
+	typed, err := anypb.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("marshaling downstream tls context: %w", err)
+	}
+	return &core.TransportSocket{
+		Name:       tlsTransportSocketID,
+		ConfigType: &core.TransportSocket_TypedConfig{TypedConfig: typed},
+	}, nil
+}
+
+// downstreamTLSContext is the TLS context of makeDownstreamTLS.
+func downstreamTLSContext(cfg *config.TLS, policy *registry.TLSPolicy) (*tlsv3.DownstreamTlsContext, error) {
+	file := func(path string) *core.DataSource {
+		return &core.DataSource{Specifier: &core.DataSource_Filename{Filename: path}}
+	}
+
+	certChain, privateKey := cfg.CertChain, cfg.PrivateKey
+	clientCert := registry.ClientCertNone
+	switch {
+	case cfg.RequireClientCert:
+		clientCert = registry.ClientCertRequired
+	case cfg.ClientCA != "":
+		clientCert = registry.ClientCertOptional
+	}
+	var params *tlsv3.TlsParameters
+	if policy != nil {
+		if policy.CertChain != "" {
+			certChain, privateKey = policy.CertChain, policy.PrivateKey
+		}
+		if policy.ClientCert != "" {
+			clientCert = policy.ClientCert
+		}
+		switch policy.MinVersion {
+		case "1.2":
+			params = &tlsv3.TlsParameters{TlsMinimumProtocolVersion: tlsv3.TlsParameters_TLSv1_2}
+		case "1.3":
+			params = &tlsv3.TlsParameters{TlsMinimumProtocolVersion: tlsv3.TlsParameters_TLSv1_3}
+		}
+	}
+
+	ctx := &tlsv3.DownstreamTlsContext{
+		CommonTlsContext: &tlsv3.CommonTlsContext{
+			TlsParams: params,
+			TlsCertificates: []*tlsv3.TlsCertificate{{
+				CertificateChain: file(certChain),
+				PrivateKey:       file(privateKey),
+			}},
+			AlpnProtocols: []string{"h2", "http/1.1"},
+		},
+	}
+	if clientCert != registry.ClientCertNone {
+		if cfg.ClientCA == "" {
+			return nil, fmt.Errorf("client certificates are %s but tls.client_ca is not set", clientCert)
+		}
+		ctx.CommonTlsContext.ValidationContextType = &tlsv3.CommonTlsContext_ValidationContext{
+			ValidationContext: &tlsv3.CertificateValidationContext{TrustedCa: file(cfg.ClientCA)},
+		}
+		ctx.RequireClientCertificate = wrapperspb.Bool(clientCert == registry.ClientCertRequired)
+		// A resumed session is never re-validated, so routes matching a
+		// validated certificate would not match it.
+		ctx.DisableStatefulSessionResumption = true
+		ctx.SessionTicketKeysType = &tlsv3.DownstreamTlsContext_DisableStatelessSessionResumption{DisableStatelessSessionResumption: true}
+	}
+	return ctx, nil
+}
@@ -0,0 +1,54 @@
+package xds
+
+import (
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	listener "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/envoyage/envoyage/internal/config"
+)
+
+// IPv6 listeners
+//
+// Listeners are built bound to 0.0.0.0. A node's config.Node.IPFamily moves
+// them to :: for ipv6, or for dual keeps them and adds :: on the same port
+// as an additional address. Envoy binds :: IPv6-only, so the two sockets
+// don't conflict, and IPv4 clients keep their own addresses in the access
+// log and X-Forwarded-For rather than IPv4-mapped ones.
+
+// anyIPv6 is the IPv6 wildcard address.
+const anyIPv6 = "::"
+
+// applyIPFamily binds listeners to the addresses of family.
+func applyIPFamily(listeners []types.Resource, family string) {
+	if family == "" || family == config.IPFamilyIPv4 {
+		return
+	}
+	for _, r := range listeners {
+		l, ok := r.(*listener.Listener)
+		if !ok {
+			continue
+		}
+		sa := l.GetAddress().GetSocketAddress()
+		if sa == nil {
+			continue
+		}
+		if family == config.IPFamilyIPv6 {
+			sa.Address = anyIPv6
+			continue
+		}
+		addr := proto.Clone(l.Address).(*core.Address)
+		addr.GetSocketAddress().Address = anyIPv6
+		l.AdditionalAddresses = append(l.AdditionalAddresses, &listener.AdditionalAddress{Address: addr})
+	}
+}
+
+// adminAddress is where a node's admin interface listens: on IPv6 for an
+// ipv6 node, else on IPv4, which the control plane reaches a dual one on.
+func adminAddress(family string, port uint32) *core.Address {
+	if family == config.IPFamilyIPv6 {
+		return makeAddress(anyIPv6, port)
+	}
+	return makeAddress("0.0.0.0", port)
+}
@@ -0,0 +1,139 @@
+package xds
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	jwtauthnv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/jwt_authn/v3"
+	hcm "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	tlsv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	"github.com/envoyage/envoyage/internal/registry"
+)
+
+// JWT validation
+//
+// APIs that already speak OAuth can have Envoy check bearer tokens instead of
+// doing it in every app. Each service with a JWT requirement becomes one
+// jwt_authn provider (keyed by service name) plus a requirement of the same
+// name; the service's virtual host selects that requirement. Virtual hosts
+// without a selection are not checked at all.
+//
+// Validation needs only the token and the issuer's public keys, so it runs on
+// every node: the edge drops bad tokens before they use the tunnel, and the
+// home node checks again for LAN clients. The token is forwarded upstream so
+// the home node — and the app — still see it.
+//
+// Each node fetches the JWKS itself through a dedicated jwks_<service>
+// cluster, so issuers must be reachable from every node.
+
+const (
+	jwtFilterName        = "envoy.filters.http.jwt_authn"
+	jwksClusterPrefix    = "jwks_"
+	jwksFetchTimeout     = 5 * time.Second
+	jwksCacheDuration    = 10 * time.Minute
+	tlsTransportSocketID = "envoy.transport_sockets.tls"
+)
+
+// applyJWT returns the jwt_authn filter and the JWKS clusters needed by the
+// given services, and selects each service's requirement on its virtual host.
+// vhosts must be index-aligned with services. Returns nil, nil, nil if no
+// service requires a JWT.
+func applyJWT(services []*registry.Service, vhosts []*route.VirtualHost) (*hcm.HttpFilter, []*cluster.Cluster, error) {
+	providers := make(map[string]*jwtauthnv3.JwtProvider)
+	requirements := make(map[string]*jwtauthnv3.JwtRequirement)
+	var clusters []*cluster.Cluster
+
+	for i, svc := range services {
+		if svc.JWT == nil {
+			continue
+		}
+		jwksCluster, err := makeURLCluster(jwksClusterPrefix+svc.Name, svc.JWT.JWKSURI)
+		if err != nil {
+			return nil, nil, fmt.Errorf("service %q: %w", svc.Name, err)
+		}
+		clusters = append(clusters, jwksCluster)
+
+		providers[svc.Name] = &jwtauthnv3.JwtProvider{
+			Issuer:    svc.JWT.Issuer,
+			Audiences: svc.JWT.Audiences,
+			Forward:   true,
+			JwksSourceSpecifier: &jwtauthnv3.JwtProvider_RemoteJwks{
+				RemoteJwks: &jwtauthnv3.RemoteJwks{
+					HttpUri: &core.HttpUri{
+						Uri:              svc.JWT.JWKSURI,
+						HttpUpstreamType: &core.HttpUri_Cluster{Cluster: jwksCluster.Name},
+						Timeout:          durationpb.New(jwksFetchTimeout),
+					},
+					CacheDuration: durationpb.New(jwksCacheDuration),
+					// Fetch keys when the config arrives rather than on the
+					// first request, so a slow issuer doesn't stall traffic.
+					AsyncFetch: &jwtauthnv3.JwksAsyncFetch{},
+				},
+			},
+		}
+		requirements[svc.Name] = &jwtauthnv3.JwtRequirement{
+			RequiresType: &jwtauthnv3.JwtRequirement_ProviderName{ProviderName: svc.Name},
+		}
+
+		perRoute, err := anypb.New(&jwtauthnv3.PerRouteConfig{
+			RequirementSpecifier: &jwtauthnv3.PerRouteConfig_RequirementName{RequirementName: svc.Name},
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("marshaling jwt per-route config for %q: %w", svc.Name, err)
+		}
+		setPerFilterConfig(vhosts[i], jwtFilterName, perRoute)
+	}
+	if len(providers) == 0 {
+		return nil, nil, nil
+	}
+
+	cfg, err := anypb.New(&jwtauthnv3.JwtAuthentication{
+		Providers:      providers,
+		RequirementMap: requirements,
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("marshaling jwt_authn config: %w", err)
+	}
+	return &hcm.HttpFilter{
+		Name:       jwtFilterName,
+		ConfigType: &hcm.HttpFilter_TypedConfig{TypedConfig: cfg},
+	}, clusters, nil
+}
+
+// makeURLCluster builds a cluster for fetching from rawURL, e.g. a
+// service's JWKS, with TLS (and SNI) for https URLs.
+func makeURLCluster(name, rawURL string) (*cluster.Cluster, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %q: %w", rawURL, err)
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	c := makeCluster(name, net.JoinHostPort(u.Hostname(), port))
+	if u.Scheme != "https" {
+		return c, nil
+	}
+
+	tlsCtx, err := anypb.New(&tlsv3.UpstreamTlsContext{Sni: u.Hostname()})
+	if err != nil {
+		return nil, fmt.Errorf("marshaling upstream tls context: %w", err)
+	}
+	c.TransportSocket = &core.TransportSocket{
+		Name:       tlsTransportSocketID,
+		ConfigType: &core.TransportSocket_TypedConfig{TypedConfig: tlsCtx},
+	}
+	return c, nil
+}
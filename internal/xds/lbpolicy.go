@@ -0,0 +1,25 @@
+package xds
+
+import (
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+
+	"github.com/envoyage/envoyage/internal/registry"
+)
+
+// lbPolicies maps registry.Service.LBPolicy to Envoy's. A ring hash with
+// no affinity has no hash policy to go by, so Envoy hashes each request at
+// random: it only keeps clients in place with registry.Affinity.
+var lbPolicies = map[string]cluster.Cluster_LbPolicy{
+	registry.LBRoundRobin:   cluster.Cluster_ROUND_ROBIN,
+	registry.LBLeastRequest: cluster.Cluster_LEAST_REQUEST,
+	registry.LBRandom:       cluster.Cluster_RANDOM,
+	registry.LBRingHash:     cluster.Cluster_RING_HASH,
+}
+
+// applyLBPolicy sets the service's load balancing policy on its cluster.
+// Only the home node's clusters have more than one host to balance over.
+func applyLBPolicy(c *cluster.Cluster, policy string) {
+	if p, ok := lbPolicies[policy]; ok {
+		c.LbPolicy = p
+	}
+}
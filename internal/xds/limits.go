@@ -0,0 +1,119 @@
+package xds
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	bufferv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/buffer/v3"
+	localratelimitv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/local_ratelimit/v3"
+	hcm "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/envoyage/envoyage/internal/policy"
+	"github.com/envoyage/envoyage/internal/registry"
+)
+
+// Rate and body size limits
+//
+// Both come from policy.Effective, i.e. after namespace defaults and bounds
+// have been applied. Each node enforces its own token bucket, so a service
+// with rate_limit 50 may see up to 50 req/s through the edge plus 50 req/s
+// from the LAN; the edge bucket is what protects home from the internet.
+//
+// The buffer filter enforces the body limit by buffering the whole request
+// and answering 413 once it grows past the limit. That suits small APIs; it
+// is not meant for multi-GB uploads, so streaming services skip it (see
+// streaming.go).
+
+const (
+	localRateLimitFilterName = "envoy.filters.http.local_ratelimit"
+	bufferFilterName         = "envoy.filters.http.buffer"
+)
+
+// applyLimits configures rate and body limits on the virtual hosts of
+// services that have them and returns the HCM filters needed. services,
+// effective and vhosts must be index-aligned.
+func applyLimits(services []*registry.Service, effective []policy.Effective, vhosts []*route.VirtualHost) ([]*hcm.HttpFilter, error) {
+	var rateLimited, bodyLimited bool
+
+	for i, svc := range services {
+		eff := effective[i]
+		if eff.RateLimit > 0 {
+			rateLimited = true
+			cfg, err := anypb.New(&localratelimitv3.LocalRateLimit{
+				StatPrefix: "rate_limit_" + svc.Name,
+				TokenBucket: &typev3.TokenBucket{
+					MaxTokens:     uint32(eff.RateLimit),
+					TokensPerFill: wrapperspb.UInt32(uint32(eff.RateLimit)),
+					FillInterval:  durationpb.New(time.Second),
+				},
+				FilterEnabled:  fullPercent(),
+				FilterEnforced: fullPercent(),
+			})
+			if err != nil {
+				return nil, fmt.Errorf("marshaling rate limit for %q: %w", svc.Name, err)
+			}
+			setPerFilterConfig(vhosts[i], localRateLimitFilterName, cfg)
+		}
+
+		if eff.MaxBodyBytes > 0 && !svc.Streaming {
+			if eff.MaxBodyBytes > math.MaxUint32 {
+				return nil, fmt.Errorf("service %q: max body size %d is larger than Envoy can buffer", svc.Name, eff.MaxBodyBytes)
+			}
+			bodyLimited = true
+			perRoute, err := anypb.New(&bufferv3.BufferPerRoute{
+				Override: &bufferv3.BufferPerRoute_Buffer{
+					Buffer: &bufferv3.Buffer{MaxRequestBytes: wrapperspb.UInt32(uint32(eff.MaxBodyBytes))},
+				},
+			})
+			if err != nil {
+				return nil, fmt.Errorf("marshaling body limit for %q: %w", svc.Name, err)
+			}
+			enabled, err := anypb.New(&route.FilterConfig{Config: perRoute})
+			if err != nil {
+				return nil, fmt.Errorf("marshaling body limit filter config for %q: %w", svc.Name, err)
+			}
+			setPerFilterConfig(vhosts[i], bufferFilterName, enabled)
+		}
+	}
+
+	var filters []*hcm.HttpFilter
+	if rateLimited {
+		// No token bucket at the HCM level: only virtual hosts with their
+		// own bucket are limited.
+		cfg, err := anypb.New(&localratelimitv3.LocalRateLimit{StatPrefix: "rate_limit"})
+		if err != nil {
+			return nil, fmt.Errorf("marshaling rate limit filter: %w", err)
+		}
+		filters = append(filters, &hcm.HttpFilter{
+			Name:       localRateLimitFilterName,
+			ConfigType: &hcm.HttpFilter_TypedConfig{TypedConfig: cfg},
+		})
+	}
+	if bodyLimited {
+		// max_request_bytes is required but never used: the filter is off
+		// unless a virtual host enables it with its own limit.
+		cfg, err := anypb.New(&bufferv3.Buffer{MaxRequestBytes: wrapperspb.UInt32(1)})
+		if err != nil {
+			return nil, fmt.Errorf("marshaling buffer filter: %w", err)
+		}
+		filters = append(filters, &hcm.HttpFilter{
+			Name:       bufferFilterName,
+			ConfigType: &hcm.HttpFilter_TypedConfig{TypedConfig: cfg},
+			Disabled:   true,
+		})
+	}
+	return filters, nil
+}
+
+func fullPercent() *core.RuntimeFractionalPercent {
+	return &core.RuntimeFractionalPercent{
+		DefaultValue: &typev3.FractionalPercent{Numerator: 100, Denominator: typev3.FractionalPercent_HUNDRED},
+	}
+}
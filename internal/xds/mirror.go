@@ -0,0 +1,73 @@
+package xds
+
+import (
+	"math"
+	"time"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+
+	"github.com/envoyage/envoyage/internal/registry"
+)
+
+// Request mirroring
+//
+// A service's registry.Mirror has the home node, which sees the requests
+// from the LAN and the edges alike, copy a sample of them to the analysis
+// tool's cluster. Envoy sends the copy alongside the original and drops
+// the reply. The mirror cluster is named apart from the service's, so its
+// stats stay out of the service's. An expired mirror is left out; the
+// server rebuilds when it expires (see scheduleExpiry).
+//
+// A registry.Shadow copies them the same way to the other service's own
+// cluster, so the copies show in its stats. A shadow of a service the home
+// node doesn't have, or that has no cluster of its own (a forward proxy),
+// is left out; lint reports it.
+
+func mirrorClusterName(svc *registry.Service) string {
+	return "mirror_" + svc.Name
+}
+
+// applyMirror adds the service's active mirror to every forwarding route
+// of its virtual host and returns the mirror cluster, or nil if there is
+// none.
+func applyMirror(vh *route.VirtualHost, svc *registry.Service, now time.Time) *cluster.Cluster {
+	m := svc.ActiveMirror(now)
+	if m == nil || svc.ForwardProxy != nil || svc.AnsweredByEnvoy() || svc.Maintenance {
+		return nil
+	}
+	name := mirrorClusterName(svc)
+	addMirrorPolicy(vh, name, m.Percent)
+	return makeCluster(name, m.Target)
+}
+
+// applyShadow adds the service's shadow to every forwarding route of its
+// virtual host. clusters are the names of the services with a cluster of
+// their own in the snapshot.
+func applyShadow(vh *route.VirtualHost, svc *registry.Service, clusters map[string]bool) {
+	sh := svc.Shadow
+	if sh == nil || svc.ForwardProxy != nil || svc.Maintenance || sh.Service == svc.Name || !clusters[sh.Service] {
+		return
+	}
+	addMirrorPolicy(vh, "cluster_"+sh.Service, sh.Percent)
+}
+
+func addMirrorPolicy(vh *route.VirtualHost, clusterName string, percent float64) {
+	for _, r := range vh.Routes {
+		action, ok := r.Action.(*route.Route_Route)
+		if !ok {
+			continue
+		}
+		action.Route.RequestMirrorPolicies = append(action.Route.RequestMirrorPolicies, &route.RouteAction_RequestMirrorPolicy{
+			Cluster: clusterName,
+			RuntimeFraction: &core.RuntimeFractionalPercent{
+				DefaultValue: &typev3.FractionalPercent{
+					Numerator:   uint32(math.Round(percent * 10000)),
+					Denominator: typev3.FractionalPercent_MILLION,
+				},
+			},
+		})
+	}
+}
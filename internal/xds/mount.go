@@ -0,0 +1,185 @@
+package xds
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	luav3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/lua/v3"
+	hcm "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	"google.golang.org/protobuf/types/known/anypb"
+
+	"github.com/envoyage/envoyage/internal/registry"
+)
+
+// Mounts
+//
+// A mounted service is served under a path of its domain, e.g.
+// example.com/grafana/, while the upstream serves the app at its own base
+// path, usually "/". On the home node every route of the service's virtual
+// host moves under the mount's prefix and swaps it for the base path on
+// the way in; "/" and the bare prefix redirect to the mount. Edges pass
+// requests home unchanged and need nothing.
+//
+// An app that doesn't know about the prefix also answers with its own
+// paths: a redirect to /login, a session cookie with Path=/. A Lua filter,
+// enabled per route with the mount's paths, maps the Location header and
+// the Path attribute of every Set-Cookie back under the prefix. Absolute
+// Locations are only mapped when they point at the domain the request was
+// for; anything else is left alone.
+
+const luaFilterName = "envoy.filters.http.lua"
+
+// mountScript is the Lua filter's code for one mount, formatted with the
+// public prefix and the upstream base path, the latter ending in "/".
+const mountScript = `local prefix, base = %s, %s
+
+-- mount maps an upstream path to its public one, or returns nil for a
+-- path outside the base.
+local function mount(path)
+  if path:sub(1, #base) == base then
+    return prefix .. path:sub(#base)
+  end
+  if path .. "/" == base then
+    return prefix
+  end
+  return nil
+end
+
+local function relocate(handle, location)
+  if location:sub(1, 1) == "/" and location:sub(2, 2) ~= "/" then
+    local path, rest = location:match("^([^?#]*)(.*)$")
+    local mapped = mount(path)
+    return mapped and mapped .. rest
+  end
+  local scheme, authority, path, rest = location:match("^(https?://)([^/?#]+)([^?#]*)(.*)$")
+  if not authority then
+    return nil
+  end
+  local meta = handle:streamInfo():dynamicMetadata():get("envoyage.mount")
+  if not meta or authority:lower() ~= (meta.authority or ""):lower() then
+    return nil
+  end
+  if path == "" then
+    path = "/"
+  end
+  local mapped = mount(path)
+  return mapped and scheme .. authority .. mapped .. rest
+end
+
+local function recookie(cookie)
+  return (cookie:gsub("([;%%s][Pp][Aa][Tt][Hh]%%s*=%%s*)([^;]*)", function(attr, path)
+    local mapped = mount(path)
+    return mapped and attr .. mapped
+  end))
+end
+
+function envoy_on_request(handle)
+  handle:streamInfo():dynamicMetadata():set("envoyage.mount", "authority", handle:headers():get(":authority"))
+end
+
+function envoy_on_response(handle)
+  local headers = handle:headers()
+  local location = headers:get("location")
+  if location then
+    local mapped = relocate(handle, location)
+    if mapped then
+      headers:replace("location", mapped)
+    end
+  end
+  local n = headers:getNumValues("set-cookie")
+  if n > 0 then
+    local cookies = {}
+    for i = 0, n - 1 do
+      cookies[#cookies + 1] = recookie(headers:getAtIndex("set-cookie", i))
+    end
+    headers:remove("set-cookie")
+    for _, cookie in ipairs(cookies) do
+      headers:add("set-cookie", cookie)
+    end
+  end
+end
+`
+
+// applyMounts moves the routes of mounted services under their prefix and
+// returns the Lua filter that maps their responses back, or nil if no
+// service is mounted. Home node only. vhosts must be index-aligned with
+// services and complete: routes added later are not mounted.
+func applyMounts(services []*registry.Service, vhosts []*route.VirtualHost) (*hcm.HttpFilter, error) {
+	mounted := false
+	for i, svc := range services {
+		if svc.Mount == nil || svc.ForwardProxy != nil {
+			continue
+		}
+		if err := applyMount(vhosts[i], svc.Mount); err != nil {
+			return nil, fmt.Errorf("service %q: %w", svc.Name, err)
+		}
+		mounted = true
+	}
+	if !mounted {
+		return nil, nil
+	}
+
+	// No default code: the filter only runs on routes that set theirs.
+	cfg, err := anypb.New(&luav3.Lua{})
+	if err != nil {
+		return nil, fmt.Errorf("marshaling lua filter: %w", err)
+	}
+	return &hcm.HttpFilter{
+		Name:       luaFilterName,
+		ConfigType: &hcm.HttpFilter_TypedConfig{TypedConfig: cfg},
+	}, nil
+}
+
+func applyMount(vh *route.VirtualHost, m *registry.Mount) error {
+	prefix := strings.TrimSuffix(m.PathPrefix, "/")
+	base := strings.TrimSuffix(m.UpstreamPath, "/") + "/"
+
+	script, err := anypb.New(&luav3.LuaPerRoute{
+		Override: &luav3.LuaPerRoute_SourceCode{
+			SourceCode: &core.DataSource{
+				Specifier: &core.DataSource_InlineString{
+					InlineString: fmt.Sprintf(mountScript, strconv.Quote(prefix), strconv.Quote(base)),
+				},
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("marshaling mount script: %w", err)
+	}
+
+	for _, r := range vh.Routes {
+		// Every route envoyage makes matches a path prefix, "/" so far.
+		match, ok := r.GetMatch().GetPathSpecifier().(*route.RouteMatch_Prefix)
+		if !ok {
+			continue
+		}
+		rest := strings.TrimPrefix(match.Prefix, "/")
+		match.Prefix = prefix + "/" + rest
+		action, ok := r.Action.(*route.Route_Route)
+		if !ok {
+			continue
+		}
+		action.Route.PrefixRewrite = base + rest
+		if r.TypedPerFilterConfig == nil {
+			r.TypedPerFilterConfig = make(map[string]*anypb.Any)
+		}
+		r.TypedPerFilterConfig[luaFilterName] = script
+	}
+
+	redirect := func(path string) *route.Route {
+		return &route.Route{
+			Match: &route.RouteMatch{PathSpecifier: &route.RouteMatch_Path{Path: path}},
+			Action: &route.Route_Redirect{
+				Redirect: &route.RedirectAction{
+					PathRewriteSpecifier: &route.RedirectAction_PathRedirect{PathRedirect: prefix + "/"},
+					ResponseCode:         route.RedirectAction_FOUND,
+				},
+			},
+		}
+	}
+	vh.Routes = append([]*route.Route{redirect("/"), redirect(prefix)}, vh.Routes...)
+	return nil
+}
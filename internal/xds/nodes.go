@@ -0,0 +1,96 @@
+package xds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// Runtime node registration
+//
+// Nodes normally come from the config file. A new edge (say a second VPS in
+// another region) can also be registered through the API with AddNode: it
+// gets a snapshot straight away and from then on every rebuild includes it.
+// Registered nodes live in memory only; add them to the config to keep them
+// across restarts.
+
+var (
+	// ErrNodeExists is returned by AddNode for an ID that is already managed.
+	ErrNodeExists = errors.New("node already exists")
+
+	// ErrNodeNotFound is returned by RemoveNode for an unknown ID.
+	ErrNodeNotFound = errors.New("node not found")
+
+	// ErrStaticNode is returned by RemoveNode for a node from the config.
+	ErrStaticNode = errors.New("node is defined in the config file")
+)
+
+// AddNode starts serving snapshots to a new node. The node is built like any
+// other; if its profile cannot express the current services, or pre-flight
+// fails, it is not added and nothing is pushed.
+func (s *Server) AddNode(ctx context.Context, n Node) error {
+	if n.ID == "" {
+		return fmt.Errorf("node id is required")
+	}
+	if s.preflight != nil && n.ID == s.preflight.cfg.NodeID {
+		return fmt.Errorf("node %q is the validation node: %w", n.ID, ErrNodeExists)
+	}
+	n.Dynamic = true
+
+	s.nodesMu.Lock()
+	if slices.ContainsFunc(s.nodes, func(x Node) bool { return x.ID == n.ID }) {
+		s.nodesMu.Unlock()
+		return fmt.Errorf("node %q: %w", n.ID, ErrNodeExists)
+	}
+	s.nodes = append(s.nodes, n)
+	s.nodesMu.Unlock()
+
+	if err := s.rebuildFor(ctx, n.ID); err != nil {
+		s.dropNode(n.ID)
+		return fmt.Errorf("adding node %q: %w", n.ID, err)
+	}
+	s.log.Info("node registered", "node", n.ID, "profile", n.Profile.Name)
+	return nil
+}
+
+// RemoveNode stops serving snapshots to a node registered with AddNode. An
+// Envoy still connected as that node keeps its last config but gets no
+// further updates.
+func (s *Server) RemoveNode(id string) error {
+	s.nodesMu.RLock()
+	i := slices.IndexFunc(s.nodes, func(x Node) bool { return x.ID == id })
+	static := i >= 0 && !s.nodes[i].Dynamic
+	s.nodesMu.RUnlock()
+
+	switch {
+	case i < 0:
+		return fmt.Errorf("node %q: %w", id, ErrNodeNotFound)
+	case static:
+		return fmt.Errorf("node %q: %w", id, ErrStaticNode)
+	}
+	if !s.dropNode(id) {
+		return fmt.Errorf("node %q: %w", id, ErrNodeNotFound)
+	}
+	s.log.Info("node removed", "node", id)
+	return nil
+}
+
+// dropNode removes a node from the list and its snapshot from the cache. It
+// reports whether the node was there.
+func (s *Server) dropNode(id string) bool {
+	s.nodesMu.Lock()
+	n := len(s.nodes)
+	s.nodes = slices.DeleteFunc(s.nodes, func(x Node) bool { return x.ID == id })
+	removed := len(s.nodes) < n
+	s.nodesMu.Unlock()
+
+	if removed {
+		s.cache.ClearSnapshot(id)
+		s.pinMu.Lock()
+		delete(s.pinned, id)
+		s.pinMu.Unlock()
+		s.forgetBuild(id)
+	}
+	return removed
+}
@@ -0,0 +1,84 @@
+package xds
+
+import (
+	"fmt"
+	"time"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	aggregatev3 "github.com/envoyproxy/go-control-plane/envoy/extensions/clusters/aggregate/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	"github.com/envoyage/envoyage/internal/registry"
+)
+
+// Edge copies
+//
+// An edge with its own copy of a service (registry.Origin) routes it to an
+// aggregate cluster of two: the copy's cluster, probed like home is for
+// fallback, then the usual cluster through the tunnel. Envoy sends requests
+// to the first cluster with healthy hosts, so home only gets them while the
+// copy is down. The copy's cluster is named with localSuffix so its stats
+// count as the service's.
+
+// localSuffix names the cluster of a service's copy on an edge; it must
+// match stats.LocalSuffix.
+const localSuffix = "~local"
+
+// originsSuffix names the aggregate cluster edges with a copy route to.
+const originsSuffix = "~origins"
+
+const aggregateClusterTypeName = "envoy.clusters.aggregate"
+
+// probeInterval is how often edges probe home and their copies of services.
+func (b *SnapshotBuilder) probeInterval() time.Duration {
+	if b.cfg.Fallback != nil {
+		return b.cfg.Fallback.ProbeInterval
+	}
+	return defaultOriginProbeInterval
+}
+
+// applyOrigin points the virtual host's routes to homeCluster at an
+// aggregate of the node's copy of the service and homeCluster, and returns
+// the clusters it needs. It does nothing if the node has no copy, or
+// nothing to forward.
+func (b *SnapshotBuilder) applyOrigin(vh *route.VirtualHost, node Node, svc *registry.Service, homeCluster string) ([]types.Resource, error) {
+	if svc.ForwardProxy != nil || svc.Maintenance {
+		return nil, nil
+	}
+	var upstream string
+	for _, o := range svc.Origins {
+		if o.Node == node.ID {
+			upstream = o.Upstream
+		}
+	}
+	if upstream == "" {
+		return nil, nil
+	}
+
+	local := makeCluster(homeCluster+localSuffix, upstream)
+	applyOriginHealthCheck(local, b.probeInterval())
+
+	name := homeCluster + originsSuffix
+	typed, err := anypb.New(&aggregatev3.ClusterConfig{Clusters: []string{local.Name, homeCluster}})
+	if err != nil {
+		return nil, fmt.Errorf("marshaling aggregate cluster %q: %w", name, err)
+	}
+	aggregate := &cluster.Cluster{
+		Name: name,
+		ClusterDiscoveryType: &cluster.Cluster_ClusterType{
+			ClusterType: &cluster.Cluster_CustomClusterType{Name: aggregateClusterTypeName, TypedConfig: typed},
+		},
+		LbPolicy:       cluster.Cluster_CLUSTER_PROVIDED,
+		ConnectTimeout: durationpb.New(5 * time.Second),
+	}
+
+	for _, r := range vh.Routes {
+		if action, ok := r.Action.(*route.Route_Route); ok && action.Route.GetCluster() == homeCluster {
+			action.Route.ClusterSpecifier = &route.RouteAction_Cluster{Cluster: name}
+		}
+	}
+	return []types.Resource{local, aggregate}, nil
+}
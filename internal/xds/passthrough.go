@@ -0,0 +1,107 @@
+package xds
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	"github.com/envoyage/envoyage/internal/registry"
+)
+
+// Passthrough
+//
+// A service's registry.Service.FilterConfig and RouteMetadata are raw
+// Envoy config for what the control plane doesn't model, e.g. per-route
+// settings of a filter added through a profile, or values for
+// %METADATA(ROUTE:...)% in access logs:
+//
+//   - FilterConfig becomes the typed_per_filter_config of the service's
+//     virtual host. Per-route config the control plane sets for the same
+//     filter, e.g. ext_authz turned off for share links, still wins.
+//   - RouteMetadata becomes the filter_metadata of each of its routes.
+//
+// They are applied after everything else, on every node serving the
+// service. Only parsing is checked, by ValidatePassthrough when the
+// service is registered: an @type must be one of the Envoy types the
+// control plane is built with, and a config Envoy rejects anyway is NACKed,
+// leaving the node on its previous snapshot (see GET /nodes).
+
+// ValidatePassthrough checks that a service's FilterConfig and
+// RouteMetadata parse.
+func ValidatePassthrough(svc *registry.Service) error {
+	if _, err := filterConfig(svc.FilterConfig); err != nil {
+		return err
+	}
+	if _, err := routeMetadata(svc.RouteMetadata); err != nil {
+		return err
+	}
+	return nil
+}
+
+// applyPassthrough adds the service's raw config to its virtual host.
+func applyPassthrough(vh *route.VirtualHost, svc *registry.Service) error {
+	configs, err := filterConfig(svc.FilterConfig)
+	if err != nil {
+		return err
+	}
+	if len(configs) > 0 {
+		if vh.TypedPerFilterConfig == nil {
+			vh.TypedPerFilterConfig = make(map[string]*anypb.Any, len(configs))
+		}
+		maps.Copy(vh.TypedPerFilterConfig, configs)
+	}
+	md, err := routeMetadata(svc.RouteMetadata)
+	if err != nil || md == nil {
+		return err
+	}
+	for _, r := range vh.Routes {
+		r.Metadata = md
+	}
+	return nil
+}
+
+// filterConfig parses typed_per_filter_config entries, each a JSON object
+// with an "@type".
+func filterConfig(raw map[string]json.RawMessage) (map[string]*anypb.Any, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	out := make(map[string]*anypb.Any, len(raw))
+	for _, name := range slices.Sorted(maps.Keys(raw)) {
+		if name == "" {
+			return nil, fmt.Errorf("filter_config: empty filter name")
+		}
+		a := new(anypb.Any)
+		if err := protojson.Unmarshal(raw[name], a); err != nil {
+			return nil, fmt.Errorf("filter_config %q: %w", name, err)
+		}
+		out[name] = a
+	}
+	return out, nil
+}
+
+// routeMetadata parses filter_metadata namespaces, each a JSON object.
+func routeMetadata(raw map[string]json.RawMessage) (*core.Metadata, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	md := &core.Metadata{FilterMetadata: make(map[string]*structpb.Struct, len(raw))}
+	for _, ns := range slices.Sorted(maps.Keys(raw)) {
+		if ns == "" {
+			return nil, fmt.Errorf("route_metadata: empty namespace")
+		}
+		s := new(structpb.Struct)
+		if err := protojson.Unmarshal(raw[ns], s); err != nil {
+			return nil, fmt.Errorf("route_metadata %q: %w", ns, err)
+		}
+		md.FilterMetadata[ns] = s
+	}
+	return md, nil
+}
@@ -0,0 +1,90 @@
+package xds
+
+import (
+	"slices"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	matcher "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+
+	"github.com/envoyage/envoyage/internal/config"
+	"github.com/envoyage/envoyage/internal/policy"
+	"github.com/envoyage/envoyage/internal/registry"
+)
+
+// Service placement
+//
+// registry.Service.Nodes limits a service to some nodes. The edges it
+// doesn't list simply leave it out; a staging node serves what any edge
+// does. The home node can't: every edge forwards to it. Left off the home
+// node, a service stays in its snapshot but only for requests carrying the
+// edge secret (config.TLS), which the edges add for it and LAN clients
+// don't have, so they get a 404 as for an unknown path. Without tls there
+// is no secret, so the home node leaves the service out altogether and it
+// is served nowhere; lint flags that. TCP forwards carry no headers, so the
+// home node serves them to everyone: they can't be edge-only.
+
+// servedOn reports whether svc has a place in node's snapshot.
+func servedOn(node Node, svc *registry.Service) bool {
+	switch {
+	case len(svc.Nodes) == 0:
+		return true
+	case node.Staging:
+		return config.OnEdges(svc.Nodes)
+	case node.ID == homeEnvoyNodeID:
+		return true // see edgeOnly
+	}
+	return slices.Contains(svc.Nodes, node.ID)
+}
+
+// serves reports whether node's snapshot includes svc, by exposure and
+// placement.
+func (b *SnapshotBuilder) serves(node Node, isEdge bool, svc *registry.Service, eff policy.Effective) bool {
+	switch {
+	case isEdge && eff.Exposure == registry.ExposureLAN:
+		return false
+	case !isEdge && edgeOnly(svc) && b.cfg.TLS == nil && svc.TCP == nil:
+		return false
+	}
+	return servedOn(node, svc)
+}
+
+// edgeOnly reports whether svc leaves out the home node.
+func edgeOnly(svc *registry.Service) bool {
+	return len(svc.Nodes) > 0 && !slices.Contains(svc.Nodes, homeEnvoyNodeID)
+}
+
+// applyPlacement limits the home node's routes of edge-only services to
+// requests from the edges, and has the edges send the secret for them.
+// vhosts must be index-aligned with services and complete.
+func applyPlacement(isEdge bool, tls *config.TLS, services []*registry.Service, vhosts []*route.VirtualHost) {
+	if tls == nil {
+		return
+	}
+	for i, svc := range services {
+		if !edgeOnly(svc) {
+			continue
+		}
+		vh := vhosts[i]
+		if isEdge {
+			if !slices.ContainsFunc(vh.RequestHeadersToAdd, func(h *core.HeaderValueOption) bool { return h.GetHeader().GetKey() == edgeSecretHeader }) {
+				vh.RequestHeadersToAdd = append(vh.RequestHeadersToAdd,
+					headerOption(registry.Header{Name: edgeSecretHeader, Value: tls.EdgeSecret}, core.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD))
+			}
+			continue
+		}
+		for _, r := range vh.Routes {
+			r.Match.Headers = append(r.Match.Headers, &route.HeaderMatcher{
+				Name: edgeSecretHeader,
+				HeaderMatchSpecifier: &route.HeaderMatcher_StringMatch{
+					StringMatch: &matcher.StringMatcher{
+						MatchPattern: &matcher.StringMatcher_Exact{Exact: tls.EdgeSecret},
+					},
+				},
+			})
+		}
+		if !slices.Contains(vh.RequestHeadersToRemove, edgeSecretHeader) {
+			vh.RequestHeadersToRemove = append(vh.RequestHeadersToRemove, edgeSecretHeader)
+		}
+	}
+}
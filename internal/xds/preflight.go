@@ -0,0 +1,163 @@
+package xds
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	cachev3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	discoverygrpc "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+
+	"github.com/envoyage/envoyage/internal/config"
+)
+
+// preflight pushes candidate snapshots to a validation Envoy before they go
+// to production nodes.
+//
+// Snapshot.Consistent only checks references between resources; it cannot
+// tell whether Envoy will actually accept them. A filter config the node's
+// Envoy doesn't understand, a listener that fails to bind, an invalid regex —
+// all of these only surface as a NACK, by which point the production node is
+// stuck on its old config and keeps NACKing every later push too. A spare
+// Envoy (ideally on the oldest version in the fleet) hits those errors first.
+//
+// Each candidate is relabeled with a unique version so the validation Envoy
+// always receives it, even when two nodes' snapshots share a version.
+type preflight struct {
+	cfg   *config.Validation
+	cache cachev3.SnapshotCache
+	log   *slog.Logger
+
+	run sync.Mutex // serializes checks: the validation Envoy holds one snapshot
+
+	mu      sync.Mutex
+	streams map[int64]bool // open ADS streams from the validation Envoy
+	seq     uint64
+	pending *pendingCheck
+}
+
+type pendingCheck struct {
+	version string
+	waiting map[string]bool // type URLs not yet ACKed
+	done    chan error
+}
+
+func newPreflight(cfg *config.Validation, cache cachev3.SnapshotCache, log *slog.Logger) *preflight {
+	return &preflight{
+		cfg:     cfg,
+		cache:   cache,
+		log:     log,
+		streams: make(map[int64]bool),
+	}
+}
+
+// check pushes snap (built for node) to the validation Envoy and waits until
+// every resource type in it is ACKed. Returns an error on NACK or timeout.
+func (p *preflight) check(ctx context.Context, node string, snap *cachev3.Snapshot) error {
+	_, span := tracer.Start(ctx, "xds.preflight", trace.WithAttributes(attribute.String("envoyage.node", node)))
+	defer span.End()
+
+	p.run.Lock()
+	defer p.run.Unlock()
+
+	p.mu.Lock()
+	connected := len(p.streams) > 0
+	p.seq++
+	version := fmt.Sprintf("preflight-%d", p.seq)
+	p.mu.Unlock()
+
+	if !connected {
+		if p.cfg.Required {
+			return fmt.Errorf("validation envoy %q is not connected", p.cfg.NodeID)
+		}
+		p.log.Warn("validation envoy not connected, pushing unvalidated snapshot",
+			"node", node, "validator", p.cfg.NodeID)
+		return nil
+	}
+
+	candidate := *snap
+	pc := &pendingCheck{
+		version: version,
+		waiting: make(map[string]bool),
+		done:    make(chan error, 1),
+	}
+	for i := range candidate.Resources {
+		candidate.Resources[i].Version = version
+		if len(candidate.Resources[i].Items) == 0 {
+			continue
+		}
+		typeURL, err := cachev3.GetResponseTypeURL(types.ResponseType(i))
+		if err != nil {
+			return err
+		}
+		pc.waiting[typeURL] = true
+	}
+	if len(pc.waiting) == 0 {
+		return nil
+	}
+
+	p.mu.Lock()
+	p.pending = pc
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		p.pending = nil
+		p.mu.Unlock()
+	}()
+
+	if err := p.cache.SetSnapshot(ctx, p.cfg.NodeID, &candidate); err != nil {
+		return fmt.Errorf("pushing to validation envoy: %w", err)
+	}
+
+	select {
+	case err := <-pc.done:
+		if err != nil {
+			return fmt.Errorf("validation envoy rejected snapshot for %q: %w", node, err)
+		}
+		return nil
+	case <-time.After(p.cfg.Timeout):
+		return fmt.Errorf("validation envoy did not accept snapshot for %q within %s", node, p.cfg.Timeout)
+	}
+}
+
+// observe handles a discovery request from the validation Envoy.
+func (p *preflight) observe(streamID int64, req *discoverygrpc.DiscoveryRequest) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.streams[streamID] = true
+	pc := p.pending
+	if pc == nil {
+		return
+	}
+	if detail := req.GetErrorDetail(); detail != nil {
+		pc.finish(fmt.Errorf("%s: %s", req.GetTypeUrl(), detail.GetMessage()))
+		return
+	}
+	if req.GetVersionInfo() == pc.version && pc.waiting[req.GetTypeUrl()] {
+		delete(pc.waiting, req.GetTypeUrl())
+		if len(pc.waiting) == 0 {
+			pc.finish(nil)
+		}
+	}
+}
+
+func (p *preflight) streamClosed(streamID int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.streams, streamID)
+}
+
+// finish reports the result once; later calls are ignored.
+func (pc *pendingCheck) finish(err error) {
+	select {
+	case pc.done <- err:
+	default:
+	}
+}
@@ -0,0 +1,218 @@
+package xds
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	cachev3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/envoyage/envoyage/internal/registry"
+)
+
+// Previews
+//
+// Preview builds every node's snapshot from a registry state that doesn't
+// exist yet and compares it, resource by resource, with the snapshot the
+// node holds now, so a change's blast radius shows before it is made: a
+// new upstream changes one cluster, a new domain the route configurations
+// and, with TLS, the HTTPS listener of every edge. Nothing is pushed or
+// pre-flight checked; a build that fails shows as the node's error.
+
+// ResourceChange is a resource added to, changed in or removed from a
+// node's snapshot.
+type ResourceChange struct {
+	Type string `json:"type"` // "cluster", "route" or "listener"
+	Name string `json:"name"`
+
+	// Diff is a changed resource's YAML, as in a static bootstrap, as a
+	// line diff: "-" for the old lines, "+" for the new, "@@" before each
+	// hunk.
+	Diff string `json:"diff,omitempty"`
+}
+
+// NodePreview is how a node's snapshot would change.
+type NodePreview struct {
+	Node    string           `json:"node"`
+	Added   []ResourceChange `json:"added"`
+	Changed []ResourceChange `json:"changed"`
+	Removed []ResourceChange `json:"removed"`
+
+	// Pinned is set for a node pinned to an imported snapshot: it is
+	// compared with that snapshot, and keeps it after the change.
+	Pinned bool   `json:"pinned,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// previewTypes are the resource types compared, with their names in a
+// ResourceChange.
+var previewTypes = []struct {
+	typ, name string
+}{
+	{resource.ClusterType, "cluster"},
+	{resource.RouteType, "route"},
+	{resource.ListenerType, "listener"},
+}
+
+// Preview returns how each node's snapshot would change if the registry
+// held services, in the order of Nodes. Services removed from the current
+// state drain as they would in a rebuild.
+func (s *Server) Preview(services []*registry.Service) []NodePreview {
+	s.rebuildMu.Lock()
+	_, draining := s.drain.plan(services, s.drainGrace, time.Now())
+	s.rebuildMu.Unlock()
+
+	nodes := s.Nodes()
+	out := make([]NodePreview, 0, len(nodes))
+	for _, node := range nodes {
+		p := NodePreview{Node: node.ID}
+		_, p.Pinned = s.pinnedVersion(node.ID)
+		next, err := s.builder.Build(node, services, draining, "preview")
+		if err != nil {
+			p.Error = err.Error()
+			out = append(out, p)
+			continue
+		}
+		// A node that has no snapshot yet gets everything added.
+		var current cachev3.ResourceSnapshot
+		if snap, err := s.cache.GetSnapshot(node.ID); err == nil {
+			current = snap
+		}
+		if err := p.compare(current, next); err != nil {
+			p.Error = err.Error()
+		}
+		out = append(out, p)
+	}
+	return out
+}
+
+// compare fills in the resources that differ between from and to.
+func (p *NodePreview) compare(from, to cachev3.ResourceSnapshot) error {
+	p.Added, p.Changed, p.Removed = []ResourceChange{}, []ResourceChange{}, []ResourceChange{}
+	for _, t := range previewTypes {
+		var old map[string]types.Resource
+		if from != nil {
+			old = from.GetResources(t.typ)
+		}
+		next := to.GetResources(t.typ)
+		for _, name := range sortedNames(next) {
+			prev, ok := old[name]
+			if !ok {
+				p.Added = append(p.Added, ResourceChange{Type: t.name, Name: name})
+				continue
+			}
+			if proto.Equal(prev, next[name]) {
+				continue
+			}
+			diff, err := resourceDiff(prev, next[name])
+			if err != nil {
+				return fmt.Errorf("%s %q: %w", t.name, name, err)
+			}
+			p.Changed = append(p.Changed, ResourceChange{Type: t.name, Name: name, Diff: diff})
+		}
+		for _, name := range sortedNames(old) {
+			if _, ok := next[name]; !ok {
+				p.Removed = append(p.Removed, ResourceChange{Type: t.name, Name: name})
+			}
+		}
+	}
+	return nil
+}
+
+// resourceDiff renders two versions of a resource as YAML and diffs them.
+func resourceDiff(from, to types.Resource) (string, error) {
+	a, err := MarshalYAML(from)
+	if err != nil {
+		return "", err
+	}
+	b, err := MarshalYAML(to)
+	if err != nil {
+		return "", err
+	}
+	return lineDiff(string(a), string(b)), nil
+}
+
+// diffContext is how many unchanged lines lineDiff shows around a change.
+const diffContext = 2
+
+// lineDiff is a unified diff of two texts, without file headers, from a
+// longest common subsequence of their lines. Resources are at most a few
+// thousand lines, so the quadratic table is fine.
+func lineDiff(from, to string) string {
+	a := strings.Split(strings.TrimSuffix(from, "\n"), "\n")
+	b := strings.Split(strings.TrimSuffix(to, "\n"), "\n")
+
+	// lcs[i][j] is the length of the longest common subsequence of a[i:]
+	// and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	// Walk the table into one edit per line: ' ', '-' or '+'.
+	type edit struct {
+		op   byte
+		line string
+	}
+	var edits []edit
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			edits = append(edits, edit{' ', a[i]})
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			edits = append(edits, edit{'-', a[i]})
+			i++
+		default:
+			edits = append(edits, edit{'+', b[j]})
+			j++
+		}
+	}
+
+	// Print the changed lines with diffContext lines around them, merging
+	// hunks that touch.
+	var out strings.Builder
+	lineA := 0 // line of a at edits[k], 0-based
+	end := -1  // last edit printed
+	for k := 0; k < len(edits); k++ {
+		if edits[k].op == ' ' {
+			lineA++
+			continue
+		}
+		start := max(k-diffContext, end+1)
+		if start > end+1 || end < 0 {
+			fmt.Fprintf(&out, "@@ line %d @@\n", lineA-(k-start)+1)
+		}
+		// Extend the hunk while changes are within reach of each other.
+		stop := k
+		for n := k; n < len(edits) && n <= stop+2*diffContext; n++ {
+			if edits[n].op != ' ' {
+				stop = n
+			}
+		}
+		stop = min(stop+diffContext, len(edits)-1)
+		for n := start; n <= stop; n++ {
+			fmt.Fprintf(&out, "%c %s\n", edits[n].op, edits[n].line)
+			if n >= k && edits[n].op != '+' {
+				lineA++
+			}
+		}
+		end = stop
+		k = stop
+	}
+	return out.String()
+}
@@ -0,0 +1,111 @@
+package xds
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Profile pins resource generation to a range of Envoy 1.x minor versions.
+//
+// Envoy adds filters and fields in minor releases and deprecates (then
+// removes) others. A fleet is rarely on one version — the ARM NAS at home may
+// be stuck on an older Envoy while the VPS runs the latest image — so each
+// node is assigned a profile and the SnapshotBuilder asks the profile before
+// emitting anything version-dependent:
+//
+//   - features newer than the profile's oldest supported minor are not
+//     emitted (or the build fails if the service cannot be served safely
+//     without them)
+//   - fields deprecated within the profile's range keep using the old form
+//     until the whole range has moved past the deprecation
+//
+// The typed_config URLs we emit are always the v3 ones; they are stable across
+// every range listed here, which is why there is no per-profile URL table.
+type Profile struct {
+	Name string
+
+	// MinMinor and MaxMinor bound the Envoy 1.x minor versions this profile
+	// targets. MaxMinor == 0 means "and everything newer".
+	MinMinor uint32
+	MaxMinor uint32
+}
+
+// Profiles lists the known generation profiles, oldest first.
+// The last entry is the default.
+var Profiles = []Profile{
+	{Name: "envoy-1.26", MinMinor: 26, MaxMinor: 28},
+	{Name: "envoy-1.29", MinMinor: 29, MaxMinor: 31},
+	{Name: "envoy-1.32", MinMinor: 32},
+}
+
+// DefaultProfile is used for nodes that do not select one explicitly.
+var DefaultProfile = Profiles[len(Profiles)-1]
+
+// LookupProfile returns the profile with the given name. An empty name
+// selects DefaultProfile.
+func LookupProfile(name string) (Profile, error) {
+	if name == "" {
+		return DefaultProfile, nil
+	}
+	for _, p := range Profiles {
+		if p.Name == name {
+			return p, nil
+		}
+	}
+	names := make([]string, len(Profiles))
+	for i, p := range Profiles {
+		names[i] = p.Name
+	}
+	return Profile{}, fmt.Errorf("unknown profile %q (known: %s)", name, strings.Join(names, ", "))
+}
+
+// Covers reports whether an Envoy 1.<minor> falls inside the profile's range.
+func (p Profile) Covers(minor uint32) bool {
+	return minor >= p.MinMinor && (p.MaxMinor == 0 || minor <= p.MaxMinor)
+}
+
+// feature is an Envoy capability whose availability depends on the version.
+type feature int
+
+const (
+	featureBasicAuthPerRoute feature = iota // basic_auth filter with per-route user lists
+	featureWasmFailurePolicy                // failure_policy of Wasm plugins, replacing fail_open
+)
+
+// featureMinMinor records the first Envoy 1.x minor release that supports each
+// feature. Entries are added as the SnapshotBuilder starts emitting them.
+var featureMinMinor = map[feature]uint32{
+	featureBasicAuthPerRoute: 31,
+	featureWasmFailurePolicy: 32,
+}
+
+// supports reports whether every Envoy version in the profile's range has f.
+func (p Profile) supports(f feature) bool {
+	return p.MinMinor >= featureMinMinor[f]
+}
+
+// Node is one Envoy instance managed by the control plane.
+type Node struct {
+	ID      string
+	Profile Profile
+
+	// Admin is the node's Envoy admin address (host:port) as reachable from
+	// the control plane, or empty if the control plane cannot reach it.
+	Admin string
+
+	// Dynamic is set for nodes registered through the API rather than the
+	// config file. Only those can be removed again at runtime.
+	Dynamic bool
+
+	// Staging nodes get the edges' snapshot on their own ports and tag
+	// their responses; see staging.go.
+	Staging bool
+
+	// HTTPPort and HTTPSPort override the listener ports; 0 keeps the
+	// default for the node's role.
+	HTTPPort  uint32
+	HTTPSPort uint32
+
+	// IPFamily is config.Node.IPFamily; see ipfamily.go.
+	IPFamily string
+}
@@ -0,0 +1,69 @@
+package xds
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+
+	"github.com/envoyage/envoyage/internal/registry"
+)
+
+// Redirect services
+//
+// A service with registry.Service.Redirect has a virtual host like any
+// other, so exposure, placement, rate limits and TLS policies apply, but
+// its one route answers with a redirect rather than going to a cluster.
+// Every node answers it itself: an edge doesn't forward it home, so the
+// target is reached even while home is down, and there is no cluster, not
+// even a draining one.
+
+// redirectCodes maps registry.RedirectStatuses to Envoy's codes.
+var redirectCodes = map[int]route.RedirectAction_RedirectResponseCode{
+	301: route.RedirectAction_MOVED_PERMANENTLY,
+	302: route.RedirectAction_FOUND,
+	307: route.RedirectAction_TEMPORARY_REDIRECT,
+	308: route.RedirectAction_PERMANENT_REDIRECT,
+}
+
+// makeRedirectRoutes replaces the virtual host's routes with the
+// service's redirect.
+func makeRedirectRoutes(vh *route.VirtualHost, r *registry.Redirect) {
+	status := r.Status
+	if status == 0 {
+		status = 302
+	}
+	vh.Routes = []*route.Route{redirectRoute(r.URL, redirectCodes[status], r.PreservePath)}
+}
+
+// redirectRoute redirects every request to target, an absolute URL
+// (checked by the caller's validation). preservePath appends the
+// request's path and query to target's path; otherwise both are dropped
+// for target's own.
+func redirectRoute(target string, code route.RedirectAction_RedirectResponseCode, preservePath bool) *route.Route {
+	u, _ := url.Parse(target)
+	redirect := &route.RedirectAction{
+		SchemeRewriteSpecifier: &route.RedirectAction_SchemeRedirect{SchemeRedirect: u.Scheme},
+		HostRedirect:           u.Hostname(),
+		ResponseCode:           code,
+	}
+	switch {
+	case !preservePath:
+		redirect.PathRewriteSpecifier = &route.RedirectAction_PathRedirect{PathRedirect: u.RequestURI()}
+		redirect.StripQuery = u.RawQuery == ""
+	case strings.Trim(u.Path, "/") != "":
+		// The route matches "/", which the rewrite replaces: the prefix
+		// needs its slash so /a becomes /base/a, not /basea.
+		redirect.PathRewriteSpecifier = &route.RedirectAction_PrefixRewrite{PrefixRewrite: strings.TrimSuffix(u.Path, "/") + "/"}
+	}
+	if p, err := strconv.ParseUint(u.Port(), 10, 32); err == nil {
+		redirect.PortRedirect = uint32(p)
+	}
+	return &route.Route{
+		Match: &route.RouteMatch{
+			PathSpecifier: &route.RouteMatch_Prefix{Prefix: "/"},
+		},
+		Action: &route.Route_Redirect{Redirect: redirect},
+	}
+}
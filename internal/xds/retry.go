@@ -0,0 +1,151 @@
+package xds
+
+import (
+	"context"
+	"time"
+
+	"github.com/envoyage/envoyage/internal/metrics"
+)
+
+// Build failures
+//
+// Each node's snapshot is built, and pre-flight checked, on its own: a node
+// whose build fails keeps the last snapshot it was pushed, and the others
+// get theirs. A build that fails for reasons of the moment (a certificate
+// being renewed, the validation Envoy restarting) would otherwise leave the
+// node stale until the registry next changes, so while any node is failing
+// the server rebuilds by itself, backing off from minRetryDelay to
+// maxRetryDelay. The failure shows in the node's SyncStatus and in the
+// envoyage_node_build_ok and envoyage_node_build_failures_total metrics.
+
+const (
+	minRetryDelay = time.Second
+	maxRetryDelay = 5 * time.Minute
+)
+
+// buildFailure is a node's run of failed builds.
+type buildFailure struct {
+	version   string // the latest one that failed
+	err       error
+	since     time.Time
+	count     int
+	nextRetry time.Time
+}
+
+// buildMetrics are the build metrics, once exposed.
+type buildMetrics struct {
+	ok, failures *metrics.Vec
+}
+
+// ExposeMetrics registers the nodes' build metrics with m.
+func (s *Server) ExposeMetrics(m *metrics.Registry) {
+	bm := &buildMetrics{
+		ok: m.NewVec("envoyage_node_build_ok",
+			"Whether the node's latest snapshot was built and pushed (1) or it keeps an older one (0).",
+			metrics.Gauge, "node"),
+		failures: m.NewVec("envoyage_node_build_failures_total",
+			"Snapshots that couldn't be built or pushed to the node, including retries.",
+			metrics.Counter, "node"),
+	}
+	s.failedMu.Lock()
+	defer s.failedMu.Unlock()
+	s.buildMetrics = bm
+	for _, n := range s.Nodes() {
+		_, failed := s.failed[n.ID]
+		bm.ok.Set(boolGauge(!failed), n.ID)
+	}
+}
+
+// recordBuild records the outcome of building version for a node.
+func (s *Server) recordBuild(nodeID, version string, err error) {
+	s.failedMu.Lock()
+	defer s.failedMu.Unlock()
+	if bm := s.buildMetrics; bm != nil {
+		bm.ok.Set(boolGauge(err == nil), nodeID)
+		if err != nil {
+			bm.failures.Inc(nodeID)
+		}
+	}
+	if err == nil {
+		if f, ok := s.failed[nodeID]; ok {
+			delete(s.failed, nodeID)
+			s.log.Info("node snapshot built again", "node", nodeID, "version", version, "failures", f.count)
+		}
+		return
+	}
+	f := s.failed[nodeID]
+	if f == nil {
+		f = &buildFailure{since: time.Now()}
+		s.failed[nodeID] = f
+	}
+	f.version, f.err = version, err
+	f.count++
+}
+
+// forgetBuild drops a removed node's failures and metrics.
+func (s *Server) forgetBuild(nodeID string) {
+	s.failedMu.Lock()
+	defer s.failedMu.Unlock()
+	delete(s.failed, nodeID)
+	if bm := s.buildMetrics; bm != nil {
+		bm.ok.Delete(nodeID)
+		bm.failures.Delete(nodeID)
+	}
+}
+
+// scheduleRetry rebuilds after a delay while any node is failing, replacing
+// the rebuild scheduled before. Caller holds rebuildMu.
+func (s *Server) scheduleRetry() {
+	if s.retryTimer != nil {
+		s.retryTimer.Stop()
+		s.retryTimer = nil
+	}
+	s.failedMu.Lock()
+	defer s.failedMu.Unlock()
+	count := 0
+	for _, f := range s.failed {
+		count = max(count, f.count)
+	}
+	if count == 0 {
+		return
+	}
+	delay := retryDelay(count)
+	next := time.Now().Add(delay)
+	for _, f := range s.failed {
+		f.nextRetry = next
+	}
+	s.retryTimer = time.AfterFunc(delay, func() {
+		if err := s.rebuildSnapshots(context.Background()); err != nil {
+			s.log.Warn("retried xDS build failed", "error", err)
+		}
+	})
+}
+
+// retryDelay is the delay before the retry after count failures in a row.
+func retryDelay(count int) time.Duration {
+	d := minRetryDelay
+	for i := 1; i < count && d < maxRetryDelay; i++ {
+		d *= 2
+	}
+	return min(d, maxRetryDelay)
+}
+
+// buildFailureOf returns a copy of a node's build failure, or nil if its
+// latest build succeeded.
+func (s *Server) buildFailureOf(nodeID string) *buildFailure {
+	s.failedMu.Lock()
+	defer s.failedMu.Unlock()
+	f, ok := s.failed[nodeID]
+	if !ok {
+		return nil
+	}
+	out := *f
+	return &out
+}
+
+func boolGauge(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -2,13 +2,18 @@ package xds
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	cachev3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
 	serverv3 "github.com/envoyproxy/go-control-plane/pkg/server/v3"
 
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	clusterservice "github.com/envoyproxy/go-control-plane/envoy/service/cluster/v3"
 	discoverygrpc "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
 	endpointservice "github.com/envoyproxy/go-control-plane/envoy/service/endpoint/v3"
@@ -16,11 +21,19 @@ import (
 	routeservice "github.com/envoyproxy/go-control-plane/envoy/service/route/v3"
 	secretservice "github.com/envoyproxy/go-control-plane/envoy/service/secret/v3"
 
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
 
+	"github.com/envoyage/envoyage/internal/config"
 	"github.com/envoyage/envoyage/internal/registry"
+	"github.com/envoyage/envoyage/internal/wasm"
 )
 
+var tracer = otel.Tracer("github.com/envoyage/envoyage/internal/xds")
+
 // Server is the xDS control plane server.
 //
 // Architecture:
@@ -47,28 +60,84 @@ type Server struct {
 	cache   cachev3.SnapshotCache
 	builder *SnapshotBuilder
 	reg     *registry.Registry
-	nodeIDs []string
 	log     *slog.Logger
+
+	// nodes are the Envoys served snapshots: those in the config plus any
+	// registered at runtime (see AddNode).
+	nodesMu sync.RWMutex
+	nodes   []Node
+
+	// extra registers additional gRPC services (e.g. the challenge
+	// ext_authz service) on the xDS listener.
+	extra []func(*grpc.Server)
+
+	// preflight validates snapshots before they are pushed; nil if no
+	// validation node is configured.
+	preflight *preflight
+
+	// streamNodes maps open ADS streams to node IDs. Envoy only sends its
+	// node on the first request of a stream.
+	streamMu    sync.Mutex
+	streamNodes map[int64]string
+	sync        map[string]*nodeSync // by node ID, see Sync
+
+	// rebuildMu serializes rebuilds, so each one reads the registry and
+	// drain state after the previous push.
+	rebuildMu   sync.Mutex
+	drain       drainState
+	drainGrace  time.Duration
+	timerSeq    uint64      // rebuilds triggered by timers, see timedRebuild
+	expiryTimer *time.Timer // next share link or mirror expiry
+	retryTimer  *time.Timer // next rebuild for failed nodes, see retry.go
+
+	// failed holds the nodes whose latest build failed; see retry.go.
+	failedMu     sync.Mutex
+	failed       map[string]*buildFailure
+	buildMetrics *buildMetrics
+
+	// pinned maps nodes served an imported snapshot to its version; see
+	// ImportSnapshot. Rebuilds skip them.
+	pinMu  sync.Mutex
+	pinned map[string]string
+
+	// contentVersions names snapshots after their contents rather than the
+	// registry version; see useContentVersion.
+	contentVersions bool
+
+	// seeded and listening back the readiness probe.
+	seeded    atomic.Bool
+	listening atomic.Bool
 }
 
 // NewServer creates an xDS server wired to the given registry.
 //
-// nodeIDs lists every Envoy instance the control plane manages.
+// nodes lists every Envoy instance the control plane manages.
 // Each node must set a matching node.id in its Envoy bootstrap config.
-func NewServer(reg *registry.Registry, nodeIDs []string, log *slog.Logger) *Server {
+func NewServer(reg *registry.Registry, nodes []Node, cfg *config.Config, log *slog.Logger) *Server {
 	s := &Server{
 		// IDHash maps node.id strings directly to cache keys.
 		// NodeHash would allow more complex grouping — not needed yet.
 		cache:   cachev3.NewSnapshotCache(true, cachev3.IDHash{}, nil),
-		builder: NewSnapshotBuilder(),
+		builder: NewSnapshotBuilder(cfg),
 		reg:     reg,
-		nodeIDs: nodeIDs,
+		nodes:   nodes,
 		log:     log,
+
+		streamNodes: make(map[int64]string),
+		sync:        make(map[string]*nodeSync),
+		pinned:      make(map[string]string),
+		failed:      make(map[string]*buildFailure),
+		drainGrace:  cfg.Drain.Grace,
+
+		contentVersions: cfg.HA != nil,
+	}
+	if cfg.Validation != nil {
+		s.preflight = newPreflight(cfg.Validation, s.cache, log)
 	}
 
 	// Wire up: every registry mutation → rebuild all per-node snapshots.
-	reg.OnChange(func() {
-		if err := s.rebuildSnapshots(); err != nil {
+	reg.OnChange(func(ctx context.Context) {
+		if err := s.rebuildSnapshots(ctx); err != nil {
 			log.Error("failed to rebuild xDS snapshots", "error", err)
 		}
 	})
@@ -80,34 +149,160 @@ func NewServer(reg *registry.Registry, nodeIDs []string, log *slog.Logger) *Serv
 // tailored snapshot into the cache for every registered node.
 //
 // go-control-plane handles the downstream gRPC streaming to connected Envoys.
-func (s *Server) rebuildSnapshots() error {
+func (s *Server) rebuildSnapshots(ctx context.Context) (err error) {
+	s.rebuildMu.Lock()
+	defer s.rebuildMu.Unlock()
+
 	services, version := s.reg.Snapshot()
+	nextDrain, draining := s.drain.plan(services, s.drainGrace, time.Now())
+	snapVersion := snapshotVersion(version, s.timerSeq)
 
-	for _, nodeID := range s.nodeIDs {
-		snap, err := s.builder.Build(nodeID, services, version)
+	ctx, span := tracer.Start(ctx, "xds.rebuild", trace.WithAttributes(
+		attribute.Int64("envoyage.version", int64(version)),
+		attribute.Int("envoyage.services", len(services)),
+	))
+	defer func() {
 		if err != nil {
-			return fmt.Errorf("building snapshot v%d for node %q: %w", version, nodeID, err)
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
 		}
+		span.End()
+	}()
+
+	nodes := s.Nodes()
 
-		if err := s.cache.SetSnapshot(context.Background(), nodeID, snap); err != nil {
-			return fmt.Errorf("setting snapshot v%d for node %q: %w", version, nodeID, err)
+	// Each node is built (and validated) on its own: one that fails keeps
+	// its last snapshot, and is retried, while the others get theirs. See
+	// retry.go.
+	var errs []error
+	pushed := 0
+	for _, node := range nodes {
+		snap, err := s.buildNode(ctx, node, services, draining, snapVersion)
+		if err == nil {
+			if _, ok := s.pinnedVersion(node.ID); !ok {
+				if err = s.cache.SetSnapshot(ctx, node.ID, snap); err != nil {
+					err = fmt.Errorf("setting snapshot %s for node %q: %w", snapVersion, node.ID, err)
+				} else {
+					pushed++
+				}
+			}
+		}
+		s.recordBuild(node.ID, snapVersion, err)
+		if err != nil {
+			errs = append(errs, err)
 		}
 	}
 
-	s.log.Info("pushed xDS snapshots",
-		   "version", version,
-	    "services", len(services),
-		   "nodes", len(s.nodeIDs),
-	)
-	return nil
+	s.scheduleDrainExpiry(s.drain.commit(services, nextDrain))
+	s.scheduleExpiry(services)
+	s.scheduleRetry()
+
+	attrs := []any{
+		"version", snapVersion,
+		"services", len(services),
+		"draining", len(draining),
+		"nodes", pushed,
+		"failed", len(errs),
+	}
+	if id := registry.RequestIDFrom(ctx); id != "" {
+		attrs = append(attrs, "request_id", id)
+	}
+	s.log.Info("pushed xDS snapshots", attrs...)
+	return errors.Join(errs...)
+}
+
+// buildNode builds, and checks, one node's snapshot.
+func (s *Server) buildNode(ctx context.Context, node Node, services, draining []*registry.Service, snapVersion string) (*cachev3.Snapshot, error) {
+	_, buildSpan := tracer.Start(ctx, "xds.build", trace.WithAttributes(attribute.String("envoyage.node", node.ID)))
+	snap, err := s.builder.Build(node, services, draining, snapVersion)
+	buildSpan.End()
+	if err != nil {
+		return nil, fmt.Errorf("building snapshot %s for node %q: %w", snapVersion, node.ID, err)
+	}
+	if s.contentVersions {
+		if err := useContentVersion(snap); err != nil {
+			return nil, fmt.Errorf("snapshot %s for node %q: %w", snapVersion, node.ID, err)
+		}
+	}
+	if s.preflight != nil {
+		if err := s.preflight.check(ctx, node.ID, snap); err != nil {
+			return nil, fmt.Errorf("snapshot %s failed pre-flight: %w", snapVersion, err)
+		}
+	}
+	return snap, nil
+}
+
+// Nodes returns every managed node together with its generation profile.
+func (s *Server) Nodes() []Node {
+	s.nodesMu.RLock()
+	defer s.nodesMu.RUnlock()
+	out := make([]Node, len(s.nodes))
+	copy(out, s.nodes)
+	return out
+}
+
+// Snapshot returns the snapshot currently held for nodeID.
+func (s *Server) Snapshot(nodeID string) (cachev3.ResourceSnapshot, error) {
+	snap, err := s.cache.GetSnapshot(nodeID)
+	if err != nil {
+		return nil, fmt.Errorf("no snapshot for node %q: %w", nodeID, err)
+	}
+	return snap, nil
+}
+
+// StaticConfig renders the snapshot currently held for nodeID as a static
+// Envoy bootstrap in YAML. See StaticBootstrap for the break-glass use case.
+func (s *Server) StaticConfig(nodeID string) ([]byte, error) {
+	snap, err := s.cache.GetSnapshot(nodeID)
+	if err != nil {
+		return nil, fmt.Errorf("no snapshot for node %q: %w", nodeID, err)
+	}
+	var wasmCode func(string) ([]byte, bool)
+	if s.builder.wasm != nil {
+		wasmCode = s.builder.wasm.CodeBySum
+	}
+	bs, err := StaticBootstrap(nodeID, snap, wasmCode)
+	if err != nil {
+		return nil, fmt.Errorf("converting snapshot for node %q: %w", nodeID, err)
+	}
+	return MarshalYAML(bs)
 }
 
 // Seed pushes an initial empty snapshot for every node so that Envoy has
-// something to load immediately on connect and does not stall.
+// something to load immediately on connect and does not stall. It fails
+// only if no node got one; nodes that failed are retried (see retry.go).
 func (s *Server) Seed() error {
-	return s.rebuildSnapshots()
+	if err := s.rebuildSnapshots(context.Background()); err != nil {
+		s.failedMu.Lock()
+		none := len(s.failed) == len(s.Nodes())
+		s.failedMu.Unlock()
+		if none {
+			return err
+		}
+		s.log.Warn("some nodes have no snapshot yet", "error", err)
+	}
+	s.seeded.Store(true)
+	return nil
+}
+
+// rebuildFor rebuilds every node's snapshot and returns nodeID's build
+// error, if any. Other nodes' failures are retried as usual.
+func (s *Server) rebuildFor(ctx context.Context, nodeID string) error {
+	if err := s.rebuildSnapshots(ctx); err != nil {
+		if f := s.buildFailureOf(nodeID); f != nil {
+			return f.err
+		}
+		s.log.Warn("failed to rebuild other nodes' snapshots", "error", err)
+	}
+	return nil
 }
 
+// Seeded reports whether Seed has succeeded.
+func (s *Server) Seeded() bool { return s.seeded.Load() }
+
+// Listening reports whether the gRPC listener is accepting connections.
+func (s *Server) Listening() bool { return s.listening.Load() }
+
 // Serve starts the gRPC server on the given address (e.g. ":9090").
 //
 // All xDS service types (LDS, RDS, CDS, EDS, SDS) are registered and
@@ -116,10 +311,16 @@ func (s *Server) Seed() error {
 // Without ADS, race conditions can cause Envoy to NACK a listener that
 // references a cluster that hasn't been delivered yet.
 func (s *Server) Serve(ctx context.Context, addr string) error {
-	xdsServer := serverv3.NewServer(ctx, s.cache, nil)
+	xdsServer := serverv3.NewServer(ctx, s.cache, serverv3.CallbackFuncs{
+		StreamRequestFunc: s.onStreamRequest,
+		StreamClosedFunc:  s.onStreamClosed,
+	})
 
 	grpcServer := grpc.NewServer()
 	registerXDSServices(grpcServer, xdsServer)
+	for _, register := range s.extra {
+		register(grpcServer)
+	}
 
 	lis, err := net.Listen("tcp", addr)
 	if err != nil {
@@ -127,16 +328,38 @@ func (s *Server) Serve(ctx context.Context, addr string) error {
 	}
 
 	s.log.Info("xDS server listening", "addr", addr)
+	s.listening.Store(true)
+	defer s.listening.Store(false)
 
 	go func() {
 		<-ctx.Done()
 		s.log.Info("shutting down xDS server")
+		s.listening.Store(false)
 		grpcServer.GracefulStop()
 	}()
 
 	return grpcServer.Serve(lis)
 }
 
+// AddGRPCService registers an extra gRPC service on the xDS listener, so
+// Envoys can reach it through the control plane cluster they already have.
+// Must be called before Serve.
+func (s *Server) AddGRPCService(register func(*grpc.Server)) {
+	s.extra = append(s.extra, register)
+}
+
+// UseWasm lets snapshots run the Wasm modules in st (see wasm.go), and
+// rebuilds them whenever one is uploaded or removed. Must be called before
+// Seed.
+func (s *Server) UseWasm(st *wasm.Store) {
+	s.builder.wasm = st
+	st.OnChange(func(ctx context.Context) {
+		if err := s.rebuildSnapshots(ctx); err != nil {
+			s.log.Error("failed to rebuild xDS snapshots", "error", err)
+		}
+	})
+}
+
 // registerXDSServices registers all resource-type handlers on the gRPC server.
 // The ADS handler is the critical one — it aggregates all types on one stream.
 func registerXDSServices(grpcServer *grpc.Server, xdsServer serverv3.Server) {
@@ -147,3 +370,69 @@ func registerXDSServices(grpcServer *grpc.Server, xdsServer serverv3.Server) {
 	routeservice.RegisterRouteDiscoveryServiceServer(grpcServer, xdsServer)
 	secretservice.RegisterSecretDiscoveryServiceServer(grpcServer, xdsServer)
 }
+
+// onStreamRequest routes requests from the validation Envoy to the
+// pre-flight checker and checks every other node's version.
+func (s *Server) onStreamRequest(streamID int64, req *discoverygrpc.DiscoveryRequest) error {
+	s.streamMu.Lock()
+	if id := req.GetNode().GetId(); id != "" {
+		if _, known := s.streamNodes[streamID]; !known {
+			s.observeStream(id, 1)
+		}
+		s.streamNodes[streamID] = id
+	}
+	nodeID := s.streamNodes[streamID]
+	if nodeID != "" {
+		s.observeSync(nodeID, req)
+	}
+	s.streamMu.Unlock()
+
+	if s.preflight != nil && nodeID == s.preflight.cfg.NodeID {
+		s.preflight.observe(streamID, req)
+		return nil
+	}
+	return s.checkNodeVersion(streamID, req)
+}
+
+func (s *Server) onStreamClosed(streamID int64, _ *core.Node) {
+	s.streamMu.Lock()
+	if id, ok := s.streamNodes[streamID]; ok {
+		s.observeStream(id, -1)
+	}
+	delete(s.streamNodes, streamID)
+	s.streamMu.Unlock()
+
+	if s.preflight != nil {
+		s.preflight.streamClosed(streamID)
+	}
+}
+
+// checkNodeVersion warns when a connecting Envoy reports a version outside the
+// range of the profile assigned to it. The snapshot is still served — the
+// profile may be deliberately conservative — but a mismatch usually means the
+// node was upgraded (or downgraded) without updating the config.
+//
+// Envoy only sends its node metadata on the first request of a stream, so
+// this fires once per connection.
+func (s *Server) checkNodeVersion(streamID int64, req *discoverygrpc.DiscoveryRequest) error {
+	n := req.GetNode()
+	v := n.GetUserAgentBuildVersion().GetVersion()
+	if v == nil {
+		return nil
+	}
+	for _, node := range s.Nodes() {
+		if node.ID != n.GetId() {
+			continue
+		}
+		if v.GetMajorNumber() != 1 || !node.Profile.Covers(v.GetMinorNumber()) {
+			s.log.Warn("envoy version outside assigned profile",
+				"node", node.ID,
+				"profile", node.Profile.Name,
+				"version", fmt.Sprintf("%d.%d.%d", v.GetMajorNumber(), v.GetMinorNumber(), v.GetPatch()),
+			)
+		}
+		return nil
+	}
+	s.log.Warn("unknown node connected", "node", n.GetId(), "stream", streamID)
+	return nil
+}
@@ -0,0 +1,53 @@
+package xds_test
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/envoyage/envoyage/internal/config"
+	"github.com/envoyage/envoyage/internal/registry"
+	"github.com/envoyage/envoyage/internal/registry/registrytest"
+	"github.com/envoyage/envoyage/internal/xds/xdstest"
+)
+
+// A node whose snapshot can't be built keeps its last one, and the other
+// nodes still get theirs, whichever is built first.
+func TestRebuildIsolatesNodeFailures(t *testing.T) {
+	for _, edgeFirst := range []bool{false, true} {
+		cfg := config.Default()
+		cfg.TLS = &config.TLS{
+			CertChain:  "/etc/envoyage/tls/fullchain.pem",
+			PrivateKey: "/etc/envoyage/tls/privkey.pem",
+			EdgeSecret: "edge-secret",
+		}
+		if edgeFirst {
+			slices.Reverse(cfg.Nodes)
+		}
+		reg, _ := registrytest.New(t, registrytest.Service("web", "web.example.com", "10.0.0.5:80"))
+		s := xdstest.NewServer(t, reg, cfg)
+		edge := "envoyage-envoy-vps"
+		before := xdstest.Snapshot(t, s, edge)
+
+		// Client certificates without tls.client_ca only fail the edges:
+		// home has no HTTPS listener.
+		api := registrytest.Service("api", "api.example.com", "10.0.0.6:80")
+		api.TLS = &registry.TLSPolicy{ClientCert: registry.ClientCertRequired}
+		if err := reg.Add(context.Background(), api); err != nil {
+			t.Fatal(err)
+		}
+
+		xdstest.VirtualHost(t, xdstest.Snapshot(t, s, config.HomeNodeID), "api.example.com")
+		after := xdstest.Snapshot(t, s, edge)
+		if after != before {
+			t.Errorf("edge first %v: the edge got a new snapshot although its build failed", edgeFirst)
+		}
+		xdstest.NoVirtualHost(t, after, "api.example.com")
+		if st := s.Sync(edge); st.BuildError == "" || st.BuildFailures == 0 {
+			t.Errorf("edge first %v: the edge's sync status doesn't show the failed build: %+v", edgeFirst, st)
+		}
+		if st := s.Sync(config.HomeNodeID); st.BuildError != "" {
+			t.Errorf("edge first %v: home's sync status shows the edge's build error: %s", edgeFirst, st.BuildError)
+		}
+	}
+}
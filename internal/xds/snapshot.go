@@ -2,8 +2,14 @@ package xds
 
 import (
 	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
+	accesslogv3 "github.com/envoyproxy/go-control-plane/envoy/config/accesslog/v3"
 	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
 	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
@@ -11,24 +17,24 @@ import (
 	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
 	routerv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/router/v3"
 	hcm "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	httpv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/upstreams/http/v3"
 	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
 	cachev3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
 	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
 	"github.com/envoyproxy/go-control-plane/pkg/wellknown"
 	"google.golang.org/protobuf/types/known/anypb"
 	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 
+	"github.com/envoyage/envoyage/internal/config"
+	"github.com/envoyage/envoyage/internal/policy"
 	"github.com/envoyage/envoyage/internal/registry"
+	"github.com/envoyage/envoyage/internal/wasm"
 )
 
 // homeEnvoyNodeID is the canonical identifier for the home Envoy instance.
 // Must match node.id in envoy/bootstrap-home.yaml.
-const homeEnvoyNodeID = "envoyage-envoy-home"
-
-// homeEnvoyIngress is the address the VPS Envoy uses to reach the home Envoy.
-// In Docker Compose this is the service name + listener port.
-// In production this will be the WireGuard IP of the home node.
-const homeEnvoyIngress = "envoy-home:10000"
+const homeEnvoyNodeID = config.HomeNodeID
 
 // SnapshotBuilder translates the service registry into per-node xDS snapshots.
 //
@@ -49,8 +55,9 @@ const homeEnvoyIngress = "envoy-home:10000"
 // Both nodes share the same virtual host / domain configuration — only the
 // cluster endpoint differs. This means:
 //   - Domain-based routing works identically on both sides.
-//   - In production, swapping homeEnvoyIngress to a WireGuard IP is the only
-//     change needed to make the VPS Envoy work over the real tunnel.
+//   - In production, setting config.HomeIngress to the home node's WireGuard
+//     (or Tailscale) address is the only change needed to make the VPS Envoy
+//     work over the real tunnel.
 //
 // Envoy xDS resource hierarchy (reminder):
 //
@@ -59,29 +66,88 @@ const homeEnvoyIngress = "envoy-home:10000"
 //	       └─ Cluster (CDS)  — upstream settings (timeout, LB policy)
 //	            └─ Endpoint (EDS) — actual IP:port to connect to
 //	                  └─ Secret (SDS) — TLS certificates
-type SnapshotBuilder struct{}
+type SnapshotBuilder struct {
+	cfg    *config.Config
+	policy *policy.Resolver
+	wasm   *wasm.Store // uploaded Wasm modules; nil if none can be
+}
 
-func NewSnapshotBuilder() *SnapshotBuilder {
-	return &SnapshotBuilder{}
+func NewSnapshotBuilder(cfg *config.Config) *SnapshotBuilder {
+	return &SnapshotBuilder{cfg: cfg, policy: policy.NewResolver(cfg)}
 }
 
 // Build creates a complete xDS snapshot for a specific Envoy node.
 //
-// The nodeID parameter drives the Split-Horizon decision: home nodes get
-// direct container upstreams, edge nodes get the home Envoy as their upstream.
+// The node's ID drives the Split-Horizon decision: home nodes get direct
+// container upstreams, edge nodes get the home Envoy as their upstream.
+// The node's Profile decides which version-dependent features may be emitted.
+//
+// draining lists recently removed services: they get their cluster but no
+// route, so requests already in flight can finish (see drain.go).
 //
 // A snapshot is an atomic, versioned bundle of all resource types. Pushing a
 // new snapshot makes go-control-plane diff it against the previous one and
 // stream only the changed resources to the connected Envoy.
-func (b *SnapshotBuilder) Build(nodeID string, services []*registry.Service, version uint64) (*cachev3.Snapshot, error) {
+func (b *SnapshotBuilder) Build(node Node, services, draining []*registry.Service, version string) (*cachev3.Snapshot, error) {
 	var (
 		clusters  []types.Resource
 		routes    []*route.VirtualHost
 		listeners []types.Resource
+		filters   []*hcm.HttpFilter
+
+		forwardProxy bool // some service is a forward proxy on this node
 	)
 
-	versionStr := fmt.Sprintf("v%d", version)
-	isEdge := nodeID != homeEnvoyNodeID
+	isEdge := node.ID != homeEnvoyNodeID || node.Staging
+
+	// In name order, so the same services always build the same snapshot
+	// whatever order the registry hands them over in.
+	services = slices.SortedFunc(slices.Values(services), func(a, b *registry.Service) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	// As their schedules have them now; scheduleExpiry rebuilds when that
+	// changes.
+	now := time.Now()
+	for i, svc := range services {
+		services[i] = svc.Scheduled(now)
+	}
+
+	// Services waiting for their dependencies are left out until those
+	// are ready; a change to either rebuilds.
+	if unready := registry.Unready(services); len(unready) > 0 {
+		services = slices.DeleteFunc(services, func(svc *registry.Service) bool {
+			_, ok := unready[svc.Name]
+			return ok
+		})
+	}
+
+	// Resolve namespace policy and drop LAN-only services from edge nodes,
+	// and services placed on other nodes (see placement.go). From here on
+	// services and effective are index-aligned.
+	var (
+		visible   []*registry.Service
+		effective []policy.Effective
+		tcp       []*registry.Service // TCP forwards, see tcp.go
+	)
+	for _, svc := range services {
+		eff, err := b.policy.Resolve(svc)
+		if err != nil {
+			return nil, fmt.Errorf("service %q: %w", svc.Name, err)
+		}
+		if !b.serves(node, isEdge, svc, eff) {
+			continue
+		}
+		if svc.TCP != nil {
+			if !node.Staging {
+				tcp = append(tcp, svc)
+			}
+			continue
+		}
+		visible = append(visible, svc)
+		effective = append(effective, eff)
+	}
+	services = visible
 
 	for _, svc := range services {
 		clusterName := fmt.Sprintf("cluster_%s", svc.Name)
@@ -91,33 +157,293 @@ func (b *SnapshotBuilder) Build(nodeID string, services []*registry.Service, ver
 		// Edge (VPS):
 		//   All traffic → home Envoy's ingress port. The home Envoy carries out
 		//   the actual per-service routing based on the Host header it receives.
-		//   In production, homeEnvoyIngress will be the WireGuard peer IP.
+		//   In production, HomeIngress is the home node's tunnel address.
 		//
 		// Home:
 		//   Traffic → real app container. svc.Upstream is "host:port" as
 		//   registered via Docker discovery or the management API.
 		upstream := svc.Upstream
 		if isEdge {
-			upstream = homeEnvoyIngress
+			upstream = b.cfg.HomeIngress
 		}
 
-		clusters = append(clusters, makeCluster(clusterName, upstream))
-		routes = append(routes, makeVirtualHost(svc.Name, svc.Domain, clusterName))
+		vh := makeVirtualHost(svc.Name, svc.Domain, clusterName)
+		if svc.AnsweredByEnvoy() {
+			// Answered here, with no cluster; see redirect.go and
+			// staticcontent.go.
+			if svc.Redirect != nil {
+				makeRedirectRoutes(vh, svc.Redirect)
+			} else {
+				makeStaticRoutes(vh, svc.Static)
+			}
+			if svc.Maintenance {
+				makeMaintenanceRoutes(vh, svc.MaintenancePage)
+			}
+			routes = append(routes, vh)
+			continue
+		}
+		applyAliases(vh, svc.Aliases, !isEdge && svc.ForwardProxy == nil)
+		own := len(clusters)
+		if svc.ForwardProxy != nil && !isEdge {
+			// Forward proxies resolve their destination per request, see
+			// forwardproxy.go.
+			c, err := makeForwardProxyCluster(clusterName, b.cfg.DNS)
+			if err != nil {
+				return nil, err
+			}
+			if err := makeForwardProxyRoutes(vh, svc.ForwardProxy, clusterName); err != nil {
+				return nil, fmt.Errorf("service %q: %w", svc.Name, err)
+			}
+			clusters = append(clusters, c)
+			forwardProxy = true
+		} else {
+			c := makeCluster(clusterName, upstream)
+			switch {
+			case !isEdge:
+				applyHealthCheck(c, svc.HealthCheck)
+				applyConcurrency(c, svc.Concurrency)
+				applyLBPolicy(c, svc.LBPolicy)
+				applyAffinityCluster(c, svc.Affinity)
+				applyServiceDNS(c, svc.DNS)
+			case b.cfg.Fallback != nil || svc.Failover != "":
+				applyOriginHealthCheck(c, b.probeInterval())
+				applyFailover(c, svc.Failover)
+			}
+			clusters = append(clusters, c)
+		}
+		if svc.Maintenance {
+			makeMaintenanceRoutes(vh, svc.MaintenancePage)
+		}
+		if !isEdge {
+			if c := applyCanary(vh, svc, clusterName); c != nil {
+				clusters = append(clusters, c)
+			}
+			applyHostRewrite(vh, clusters[own:], svc.HostRewrite)
+		} else {
+			cs, err := b.applyOrigin(vh, node, svc, clusterName)
+			if err != nil {
+				return nil, err
+			}
+			clusters = append(clusters, cs...)
+		}
+		vh.VirtualClusters = makeVirtualClusters(svc.VirtualClusters)
+		if !isEdge {
+			applyHeaderRules(vh, svc.Headers)
+		}
+		if svc.Streaming {
+			applyStreaming(vh)
+		}
+		routes = append(routes, vh)
 	}
 
+	clusters = append(clusters, b.drainingClusters(node, isEdge, services, draining)...)
+
+	// Anti-abuse challenge — edge only, and first so floods stop early.
+	if isEdge {
+		challengeFilter, err := b.applyChallenge(services, routes)
+		if err != nil {
+			return nil, err
+		}
+		if challengeFilter != nil {
+			filters = append(filters, challengeFilter)
+		}
+	}
+
+	limitFilters, err := applyLimits(services, effective, routes)
+	if err != nil {
+		return nil, err
+	}
+	filters = append(filters, limitFilters...)
+
+	basicAuth, err := applyBasicAuth(node, isEdge, services, routes)
+	if err != nil {
+		return nil, err
+	}
+	if basicAuth != nil {
+		filters = append(filters, basicAuth)
+	}
+
+	jwtFilter, jwksClusters, err := applyJWT(services, routes)
+	if err != nil {
+		return nil, err
+	}
+	if jwtFilter != nil {
+		filters = append(filters, jwtFilter)
+		for _, c := range jwksClusters {
+			clusters = append(clusters, c)
+		}
+	}
+
+	// SSO gate — home node only, see extauthz.go.
+	if !isEdge {
+		authzFilter, authzCluster, err := b.applyExtAuthz(services, routes)
+		if err != nil {
+			return nil, err
+		}
+		if authzFilter != nil {
+			filters = append(filters, authzFilter)
+			clusters = append(clusters, authzCluster)
+		}
+	}
+
+	// Wasm plugins after the auth filters; see wasm.go.
+	wasmFilters, wasmCluster, err := b.applyWasm(node, isEdge, services, routes)
+	if err != nil {
+		return nil, err
+	}
+	filters = append(filters, wasmFilters...)
+	if wasmCluster != nil {
+		clusters = append(clusters, wasmCluster)
+	}
+
+	// Last before the router: destinations are only resolved for requests
+	// that got past every auth filter.
+	if forwardProxy {
+		dfpFilter, err := makeForwardProxyFilter(b.cfg.DNS)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, dfpFilter)
+	}
+
+	if err := applyShareLinks(services, routes, filters, time.Now()); err != nil {
+		return nil, err
+	}
+	applyClientCert(isEdge, b.cfg.TLS, services, routes)
+
+	// The edge cache goes after every auth filter; see cache.go.
+	if isEdge {
+		cacheFilters, err := applyCache(node, b.cfg.Cache, services, routes)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, cacheFilters...)
+	}
+
+	// Mounts last, so they cover every route added above; see mount.go.
+	if !isEdge {
+		mountFilter, err := applyMounts(services, routes)
+		if err != nil {
+			return nil, err
+		}
+		if mountFilter != nil {
+			filters = append(filters, mountFilter)
+		}
+	}
+	// After every route is in place, to cover them all.
+	if !isEdge {
+		ownCluster := make(map[string]bool, len(services))
+		for _, svc := range services {
+			ownCluster[svc.Name] = svc.ForwardProxy == nil && !svc.AnsweredByEnvoy()
+		}
+		for i, svc := range services {
+			applyAffinityRoutes(routes[i], svc.Affinity)
+			applyShadow(routes[i], svc, ownCluster)
+			if c := applyMirror(routes[i], svc, now); c != nil {
+				clusters = append(clusters, c)
+			}
+		}
+	}
+	// After every route is in place, to gate them all.
+	applyPlacement(isEdge, b.cfg.TLS, services, routes)
+	// Raw config last, over what the control plane set; see passthrough.go.
+	for i, svc := range services {
+		if err := applyPassthrough(routes[i], svc); err != nil {
+			return nil, fmt.Errorf("service %q: %w", svc.Name, err)
+		}
+	}
+	catchAll := catchAllHost(isEdge, b.cfg, services, routes)
+
+	// Services with their own TLS settings are served from their own
+	// route config on the edges; see https.go.
+	var tlsRouteConfigs []*route.RouteConfiguration
+	if isEdge && b.cfg.TLS != nil {
+		// Before the split, so policy route configs advertise it too; see
+		// http3.go.
+		if h := b.cfg.TLS.HTTP3; h != nil {
+			port := h.AdvertisedPort
+			if node.Staging {
+				_, port = listenerPorts(node, b.cfg.TLS)
+			}
+			applyAltSvc(h, port, services, routes)
+		}
+		tlsRouteConfigs = splitTLSPolicies(services, routes)
+	}
+
+	if catchAll != nil {
+		routes = append(routes, catchAll)
+	}
 	routeConfig := makeRouteConfig("local_routes", routes)
 
-	httpListener, err := makeHTTPListener("listener_http", 10000, "local_routes")
+	tracing, otelCluster, err := makeTracing(node, b.cfg.Tracing.Envoy)
+	if err != nil {
+		return nil, err
+	}
+	if otelCluster != nil {
+		clusters = append(clusters, otelCluster)
+	}
+
+	exemplarLog, err := makeExemplarLog(b.cfg.Tracing.Envoy)
+	if err != nil {
+		return nil, err
+	}
+
+	localReply := makeLocalReply(isEdge, b.cfg)
+
+	httpPort, httpsPort := listenerPorts(node, b.cfg.TLS)
+	httpListener, err := makeHTTPListener("listener_http", httpPort, "local_routes", filters, tracing, exemplarLog, localReply)
 	if err != nil {
 		return nil, fmt.Errorf("building listener: %w", err)
 	}
 	listeners = append(listeners, httpListener)
 
+	// HTTPS on the edges, with the same filters; see https.go.
+	routeConfigs := []types.Resource{routeConfig}
+	if isEdge && b.cfg.TLS != nil {
+		httpsListener, err := makeHTTPSListener(b.cfg.TLS, httpsPort, services, func(routeConfigName string) (*listener.Filter, error) {
+			return makeHCMFilter(routeConfigName, filters, tracing, exemplarLog, localReply)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("building https listener: %w", err)
+		}
+		listeners = append(listeners, httpsListener)
+		if b.cfg.TLS.HTTP3 != nil {
+			http3Listener, err := makeHTTP3Listener(b.cfg.TLS, httpsPort, services, func(routeConfigName string) (*listener.Filter, error) {
+				return makeHCMFilter(routeConfigName, filters, tracing, exemplarLog, localReply)
+			})
+			if err != nil {
+				return nil, fmt.Errorf("building http3 listener: %w", err)
+			}
+			listeners = append(listeners, http3Listener)
+		}
+		for _, rc := range tlsRouteConfigs {
+			routeConfigs = append(routeConfigs, rc)
+		}
+	}
+	tcpClusters, tcpListeners, err := b.tcpForwards(isEdge, tcp, httpPort, httpsPort)
+	if err != nil {
+		return nil, err
+	}
+	clusters = append(clusters, tcpClusters...)
+	listeners = append(listeners, tcpListeners...)
+	applyIPFamily(listeners, node.IPFamily)
+
+	if node.Staging {
+		applyStaging(node, routeConfig)
+		applyStaging(node, tlsRouteConfigs...)
+	}
+
+	if !isEdge {
+		if err := applyDNS(clusters, b.cfg.DNS); err != nil {
+			return nil, err
+		}
+	}
+
 	snap, err := cachev3.NewSnapshot(
-		versionStr,
+		version,
 		map[resource.Type][]types.Resource{
 			resource.ClusterType:  clusters,
-			resource.RouteType:    {routeConfig},
+			resource.RouteType:    routeConfigs,
 			resource.ListenerType: listeners,
 		},
 	)
@@ -138,14 +464,20 @@ func (b *SnapshotBuilder) Build(nodeID string, services []*registry.Service, ver
 //
 // STRICT_DNS: Envoy resolves the hostname on first use and periodically
 // thereafter. Works well with Docker Compose service names (Docker's embedded
-// DNS handles them) and with WireGuard peer hostnames in production.
+// DNS handles them) and with WireGuard peer hostnames in production. An IP
+// address, as the Docker watcher registers, has nothing to resolve and makes
+// a STATIC cluster instead.
 func makeCluster(name, upstream string) *cluster.Cluster {
 	host, port := splitHostPort(upstream)
+	typ := cluster.Cluster_STRICT_DNS
+	if _, err := netip.ParseAddr(host); err == nil {
+		typ = cluster.Cluster_STATIC
+	}
 
 	return &cluster.Cluster{
 		Name: name,
 		ClusterDiscoveryType: &cluster.Cluster_Type{
-			Type: cluster.Cluster_STRICT_DNS,
+			Type: typ,
 		},
 		ConnectTimeout: durationpb.New(5 * time.Second),
 		LoadAssignment: &endpoint.ClusterLoadAssignment{
@@ -163,6 +495,26 @@ func makeCluster(name, upstream string) *cluster.Cluster {
 	}
 }
 
+// useHTTP2 makes a cluster talk HTTP/2 to its upstream, as gRPC needs.
+func useHTTP2(c *cluster.Cluster) error {
+	h2, err := anypb.New(&httpv3.HttpProtocolOptions{
+		UpstreamProtocolOptions: &httpv3.HttpProtocolOptions_ExplicitHttpConfig_{
+			ExplicitHttpConfig: &httpv3.HttpProtocolOptions_ExplicitHttpConfig{
+				ProtocolConfig: &httpv3.HttpProtocolOptions_ExplicitHttpConfig_Http2ProtocolOptions{
+					Http2ProtocolOptions: &core.Http2ProtocolOptions{},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("marshaling protocol options: %w", err)
+	}
+	c.TypedExtensionProtocolOptions = map[string]*anypb.Any{
+		"envoy.extensions.upstreams.http.v3.HttpProtocolOptions": h2,
+	}
+	return nil
+}
+
 // makeVirtualHost creates a VirtualHost that matches requests by Host header
 // and forwards them to the named cluster.
 func makeVirtualHost(name, domain, clusterName string) *route.VirtualHost {
@@ -188,16 +540,35 @@ func makeRouteConfig(name string, virtualHosts []*route.VirtualHost) *route.Rout
 	return &route.RouteConfiguration{
 		Name:         name,
 		VirtualHosts: virtualHosts,
+		// Up from Envoy's 4 KiB, for operators' maintenance and catch-all
+		// pages.
+		MaxDirectResponseBodySizeBytes: wrapperspb.UInt32(registry.MaxPageBytes),
 	}
 }
 
 // makeHTTPListener creates an Envoy Listener with an HTTP connection manager.
 //
-// Filter chain: Listener → FilterChain → HCM (network filter) → Router (HTTP filter)
+// Filter chain: Listener → FilterChain → HCM (network filter) → [filters...] → Router (HTTP filter)
 //
 // HCM parses HTTP/1.1 and HTTP/2 and delegates routing decisions to the Router
-// filter, which consults the RDS route config delivered via ADS.
-func makeHTTPListener(name string, port uint32, routeConfigName string) (*listener.Listener, error) {
+// filter, which consults the RDS route config delivered via ADS. Any extra
+// HTTP filters (auth etc.) run in order before the router.
+func makeHTTPListener(name string, port uint32, routeConfigName string, filters []*hcm.HttpFilter, tracing *hcm.HttpConnectionManager_Tracing, accessLog *accesslogv3.AccessLog, localReply *hcm.LocalReplyConfig) (*listener.Listener, error) {
+	hcmFilter, err := makeHCMFilter(routeConfigName, filters, tracing, accessLog, localReply)
+	if err != nil {
+		return nil, err
+	}
+	return &listener.Listener{
+		Name:    name,
+		Address: makeAddress("0.0.0.0", port),
+		FilterChains: []*listener.FilterChain{{
+			Filters: []*listener.Filter{hcmFilter},
+		}},
+	}, nil
+}
+
+// makeHCMFilter builds the HTTP connection manager of a filter chain.
+func makeHCMFilter(routeConfigName string, filters []*hcm.HttpFilter, tracing *hcm.HttpConnectionManager_Tracing, accessLog *accesslogv3.AccessLog, localReply *hcm.LocalReplyConfig) (*listener.Filter, error) {
 	routerAny, err := anypb.New(&routerv3.Router{})
 	if err != nil {
 		return nil, fmt.Errorf("marshaling router config: %w", err)
@@ -216,40 +587,28 @@ func makeHTTPListener(name string, port uint32, routeConfigName string) (*listen
 				RouteConfigName: routeConfigName,
 			},
 		},
-		HttpFilters: []*hcm.HttpFilter{{
+		HttpFilters: append(slices.Clip(filters), &hcm.HttpFilter{
 			Name: wellknown.Router,
 			ConfigType: &hcm.HttpFilter_TypedConfig{
 				TypedConfig: routerAny,
 			},
-		}},
+		}),
+		Tracing:          tracing,
+		LocalReplyConfig: localReply,
+	}
+	if accessLog != nil {
+		httpConnMgr.AccessLog = []*accesslogv3.AccessLog{accessLog}
 	}
 
 	hcmAny, err := anypb.New(httpConnMgr)
 	if err != nil {
 		return nil, fmt.Errorf("marshaling HCM: %w", err)
 	}
-
-	return &listener.Listener{
-		Name: name,
-		Address: &core.Address{
-			Address: &core.Address_SocketAddress{
-				SocketAddress: &core.SocketAddress{
-					Protocol: core.SocketAddress_TCP,
-					Address:  "0.0.0.0",
-					PortSpecifier: &core.SocketAddress_PortValue{
-						PortValue: port,
-					},
-				},
-			},
+	return &listener.Filter{
+		Name: wellknown.HTTPConnectionManager,
+		ConfigType: &listener.Filter_TypedConfig{
+			TypedConfig: hcmAny,
 		},
-		FilterChains: []*listener.FilterChain{{
-			Filters: []*listener.Filter{{
-				Name: wellknown.HTTPConnectionManager,
-				ConfigType: &listener.Filter_TypedConfig{
-					TypedConfig: hcmAny,
-				},
-			}},
-		}},
 	}, nil
 }
 
@@ -267,18 +626,13 @@ func makeAddress(host string, port uint32) *core.Address {
 	}
 }
 
-// splitHostPort parses "host:port" into components.
-// Returns port 0 if no port separator is found.
+// splitHostPort parses "host:port" into components, unbracketing an IPv6
+// address. Returns port 0 if no port separator is found.
 func splitHostPort(upstream string) (string, uint32) {
-	for i := len(upstream) - 1; i >= 0; i-- {
-		if upstream[i] == ':' {
-			host := upstream[:i]
-			var port uint32
-			for _, c := range upstream[i+1:] {
-				port = port*10 + uint32(c-'0')
-			}
-			return host, port
-		}
+	host, port, err := net.SplitHostPort(upstream)
+	if err != nil {
+		return upstream, 0
 	}
-	return upstream, 0
+	p, _ := strconv.ParseUint(port, 10, 32)
+	return host, uint32(p)
 }
@@ -0,0 +1,51 @@
+package xds
+
+import (
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+
+	"github.com/envoyage/envoyage/internal/config"
+	"github.com/envoyage/envoyage/internal/registry"
+)
+
+// Staging edges
+//
+// A staging node is built exactly like an edge, so whatever it serves is
+// what the edges would, but listens on its own ports. Pointing a hosts-file
+// entry (and the test port) at it shows a change end to end before real
+// users see it. Every response names the node in stagingHeader, to tell at a
+// glance which one answered.
+
+const (
+	stagingHeader = "x-envoyage-staging"
+
+	stagingHTTPPort  = 18000
+	stagingHTTPSPort = 18443
+)
+
+// listenerPorts returns the node's HTTP and HTTPS ports. tls may be nil,
+// in which case the HTTPS port is unused.
+func listenerPorts(node Node, tls *config.TLS) (httpPort, httpsPort uint32) {
+	httpPort, httpsPort = 10000, 0
+	if tls != nil {
+		httpsPort = tls.Port
+	}
+	if node.Staging {
+		httpPort, httpsPort = stagingHTTPPort, stagingHTTPSPort
+	}
+	if node.HTTPPort != 0 {
+		httpPort = node.HTTPPort
+	}
+	if node.HTTPSPort != 0 {
+		httpsPort = node.HTTPSPort
+	}
+	return httpPort, httpsPort
+}
+
+// applyStaging tags every response from the route configs with the node.
+func applyStaging(node Node, rcs ...*route.RouteConfiguration) {
+	for _, rc := range rcs {
+		rc.ResponseHeadersToAdd = append(rc.ResponseHeadersToAdd,
+			headerOption(registry.Header{Name: stagingHeader, Value: node.ID}, core.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD))
+	}
+}
@@ -0,0 +1,262 @@
+package xds
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	accesslogv3 "github.com/envoyproxy/go-control-plane/envoy/config/accesslog/v3"
+	bootstrap "github.com/envoyproxy/go-control-plane/envoy/config/bootstrap/v3"
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	listener "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	grpcalsv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/access_loggers/grpc/v3"
+	wasmfilterv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/wasm/v3"
+	hcm "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	cachev3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/wellknown"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"gopkg.in/yaml.v3"
+)
+
+// Break-glass static export
+//
+// If the control plane dies, Envoy keeps serving its last-known config until
+// it restarts — after that it comes up empty. StaticBootstrap turns the
+// snapshot a node is currently being served into a self-contained bootstrap
+// with everything under static_resources and no dynamic_resources at all, so
+// an operator can drop it onto the Envoy and keep traffic flowing while the
+// control plane is being fixed.
+//
+// The conversion works on the snapshot rather than on the registry so that it
+// always matches exactly what the node was last told — whatever the
+// SnapshotBuilder emits, the static export follows without extra code.
+//
+// Only what calls the control plane itself is left out: the bootstrap has
+// no xds_cluster to reach it by, and it is down anyway. That is the edge
+// challenge, so an exported edge serves challenged services without one,
+// and the access log of trace exemplars. Wasm modules Envoy fetches from
+// the management API (see wasm.go) are put inline instead, and the
+// wasm_modules cluster left out with them; a filter whose module isn't to
+// be had any more is left out too, rather than failing every request.
+
+// StaticBootstrap converts a node's xDS snapshot into a fully static Envoy
+// bootstrap. Listeners that reference routes via RDS get the route
+// configuration inlined into their HTTP connection manager.
+//
+// wasmCode looks up a Wasm module's code by its SHA-256, for the modules
+// Envoy would fetch; nil if there is no module store.
+//
+// The result has no admin block; operators who rely on the admin interface
+// should keep the admin section of their existing bootstrap.
+func StaticBootstrap(nodeID string, snap cachev3.ResourceSnapshot, wasmCode func(sha256 string) ([]byte, bool)) (*bootstrap.Bootstrap, error) {
+	routes := make(map[string]*route.RouteConfiguration)
+	for name, res := range snap.GetResources(resource.RouteType) {
+		rc, ok := res.(*route.RouteConfiguration)
+		if !ok {
+			return nil, fmt.Errorf("route %q has unexpected type %T", name, res)
+		}
+		routes[name] = rc
+	}
+
+	static := &bootstrap.Bootstrap_StaticResources{}
+
+	for _, name := range sortedNames(snap.GetResources(resource.ClusterType)) {
+		c, ok := snap.GetResources(resource.ClusterType)[name].(*cluster.Cluster)
+		if !ok {
+			return nil, fmt.Errorf("cluster %q has unexpected type", name)
+		}
+		if name == wasmModuleCluster {
+			continue
+		}
+		static.Clusters = append(static.Clusters, c)
+	}
+
+	for _, name := range sortedNames(snap.GetResources(resource.ListenerType)) {
+		l, ok := snap.GetResources(resource.ListenerType)[name].(*listener.Listener)
+		if !ok {
+			return nil, fmt.Errorf("listener %q has unexpected type", name)
+		}
+		inlined, err := inlineRoutes(l, routes, wasmCode)
+		if err != nil {
+			return nil, fmt.Errorf("listener %q: %w", name, err)
+		}
+		static.Listeners = append(static.Listeners, inlined)
+	}
+
+	return &bootstrap.Bootstrap{
+		Node: &core.Node{
+			Id:      nodeID,
+			Cluster: "envoyage",
+		},
+		StaticResources: static,
+	}, nil
+}
+
+// controlPlaneFilters are the HTTP filters that call the control plane
+// over xdsClusterName.
+var controlPlaneFilters = map[string]bool{
+	challengeFilterName: true,
+}
+
+// inlineRoutes returns a copy of the listener in which every HTTP connection
+// manager that uses RDS carries its route configuration inline instead, and
+// none calls the control plane (see controlPlaneFilters) or fetches from it
+// (see staticWasm).
+// The listener in the snapshot is never modified — it may still be served.
+func inlineRoutes(l *listener.Listener, routes map[string]*route.RouteConfiguration, wasmCode func(string) ([]byte, bool)) (*listener.Listener, error) {
+	out := proto.Clone(l).(*listener.Listener)
+
+	for _, fc := range out.GetFilterChains() {
+		for _, f := range fc.GetFilters() {
+			if f.GetName() != wellknown.HTTPConnectionManager {
+				continue
+			}
+			mgr := &hcm.HttpConnectionManager{}
+			if err := f.GetTypedConfig().UnmarshalTo(mgr); err != nil {
+				return nil, fmt.Errorf("unmarshaling HCM: %w", err)
+			}
+			var dropped []string
+			filters := mgr.HttpFilters[:0]
+			for _, hf := range mgr.HttpFilters {
+				keep := !controlPlaneFilters[hf.GetName()]
+				if keep {
+					var err error
+					if keep, err = staticWasm(hf, wasmCode); err != nil {
+						return nil, err
+					}
+				}
+				if !keep {
+					dropped = append(dropped, hf.GetName())
+					continue
+				}
+				filters = append(filters, hf)
+			}
+			mgr.HttpFilters = filters
+			mgr.AccessLog = slices.DeleteFunc(mgr.AccessLog, isExemplarLog)
+			rc := mgr.GetRouteConfig()
+			if rds := mgr.GetRds(); rds != nil {
+				var ok bool
+				if rc, ok = routes[rds.GetRouteConfigName()]; !ok {
+					return nil, fmt.Errorf("route config %q not in snapshot", rds.GetRouteConfigName())
+				}
+			}
+			if rc != nil {
+				if len(dropped) > 0 {
+					rc = withoutFilterConfig(rc, dropped)
+				}
+				mgr.RouteSpecifier = &hcm.HttpConnectionManager_RouteConfig{RouteConfig: rc}
+			}
+
+			mgrAny, err := anypb.New(mgr)
+			if err != nil {
+				return nil, fmt.Errorf("marshaling HCM: %w", err)
+			}
+			f.ConfigType = &listener.Filter_TypedConfig{TypedConfig: mgrAny}
+		}
+	}
+	return out, nil
+}
+
+// staticWasm puts the code of a Wasm filter whose module Envoy fetches from
+// the management API inline, looked up with wasmCode. It reports false if
+// the code isn't to be had, for the filter to be left out.
+func staticWasm(hf *hcm.HttpFilter, wasmCode func(string) ([]byte, bool)) (bool, error) {
+	if !strings.HasPrefix(hf.GetName(), wasmFilterPrefix) {
+		return true, nil
+	}
+	var w wasmfilterv3.Wasm
+	if err := hf.GetTypedConfig().UnmarshalTo(&w); err != nil {
+		return false, fmt.Errorf("unmarshaling wasm filter %q: %w", hf.GetName(), err)
+	}
+	vm := w.GetConfig().GetVmConfig()
+	remote := vm.GetCode().GetRemote()
+	if remote == nil {
+		return true, nil
+	}
+	if wasmCode == nil {
+		return false, nil
+	}
+	code, ok := wasmCode(remote.GetSha256())
+	if !ok {
+		return false, nil
+	}
+	vm.Code = inlineWasmCode(code)
+	cfg, err := anypb.New(&w)
+	if err != nil {
+		return false, fmt.Errorf("marshaling wasm filter %q: %w", hf.GetName(), err)
+	}
+	hf.ConfigType = &hcm.HttpFilter_TypedConfig{TypedConfig: cfg}
+	return true, nil
+}
+
+// isExemplarLog reports whether al streams trace exemplars to the control
+// plane; see makeExemplarLog.
+func isExemplarLog(al *accesslogv3.AccessLog) bool {
+	var grpcCfg grpcalsv3.HttpGrpcAccessLogConfig
+	if al.GetName() != grpcAccessLoggerName || al.GetTypedConfig().UnmarshalTo(&grpcCfg) != nil {
+		return false
+	}
+	return grpcCfg.GetCommonConfig().GetLogName() == ExemplarLogName
+}
+
+// withoutFilterConfig returns a copy of rc without the per-filter config of
+// the filters called names.
+func withoutFilterConfig(rc *route.RouteConfiguration, names []string) *route.RouteConfiguration {
+	out := proto.Clone(rc).(*route.RouteConfiguration)
+	for _, vh := range out.GetVirtualHosts() {
+		for _, name := range names {
+			delete(vh.TypedPerFilterConfig, name)
+			for _, r := range vh.GetRoutes() {
+				delete(r.TypedPerFilterConfig, name)
+			}
+		}
+	}
+	return out
+}
+
+// MarshalYAML renders a protobuf message as YAML in the shape Envoy expects
+// for bootstrap files (proto field names, "@type" on Any fields).
+//
+// protojson does the heavy lifting; the JSON is then re-encoded as YAML so the
+// output can be diffed and hand-edited like the bootstrap files in envoy/.
+func MarshalYAML(m proto.Message) ([]byte, error) {
+	js, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(m)
+	if err != nil {
+		return nil, fmt.Errorf("marshaling to JSON: %w", err)
+	}
+	var tree any
+	if err := json.Unmarshal(js, &tree); err != nil {
+		return nil, fmt.Errorf("decoding JSON: %w", err)
+	}
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(tree); err != nil {
+		return nil, fmt.Errorf("encoding YAML: %w", err)
+	}
+	if err := enc.Close(); err != nil {
+		return nil, fmt.Errorf("encoding YAML: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// sortedNames returns the keys of a resource map in stable order so that two
+// exports of the same snapshot are byte-identical.
+func sortedNames(resources map[string]types.Resource) []string {
+	names := make([]string, 0, len(resources))
+	for name := range resources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,109 @@
+package xds_test
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	bootstrap "github.com/envoyproxy/go-control-plane/envoy/config/bootstrap/v3"
+	wasmfilterv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/wasm/v3"
+	hcm "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	wasmv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/wasm/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/wellknown"
+
+	"github.com/envoyage/envoyage/internal/config"
+	"github.com/envoyage/envoyage/internal/registry/registrytest"
+	"github.com/envoyage/envoyage/internal/wasm"
+	"github.com/envoyage/envoyage/internal/xds"
+	"github.com/envoyage/envoyage/internal/xds/xdstest"
+)
+
+// The static export can't have Envoy fetch Wasm modules from the control
+// plane it stands in for: it puts their code inline, or leaves the filter
+// out if it has none to put there.
+func TestStaticBootstrapInlinesRemoteWasm(t *testing.T) {
+	cfg := config.Default()
+	cfg.Wasm.URL = "http://10.8.0.1:8080"
+	cfg.Wasm.InlineMax = 8
+	cfg.Wasm.Filters = []config.WasmFilter{{Module: "guard"}}
+	reg, _ := registrytest.New(t, registrytest.Service("web", "web.example.com", "10.0.0.5:80"))
+	s := xdstest.NewServer(t, reg, cfg)
+	st, err := wasm.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.UseWasm(st)
+	code := append([]byte("\x00asm\x01\x00\x00\x00"), make([]byte, 32)...)
+	if _, err := st.Put(context.Background(), "guard", code); err != nil {
+		t.Fatal(err)
+	}
+
+	snap := xdstest.Snapshot(t, s, config.HomeNodeID)
+	xdstest.Cluster(t, snap, "wasm_modules")
+
+	bs, err := xds.StaticBootstrap(config.HomeNodeID, snap, st.CodeBySum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range bs.GetStaticResources().GetClusters() {
+		if c.GetName() == "wasm_modules" {
+			t.Error("the export has the wasm_modules cluster")
+		}
+	}
+	plugins := staticWasmPlugins(t, bs)
+	if len(plugins) == 0 {
+		t.Fatal("the export has no Wasm filter")
+	}
+	for _, p := range plugins {
+		got := p.GetVmConfig().GetCode().GetLocal().GetInlineBytes()
+		if !bytes.Equal(got, code) {
+			t.Errorf("filter %q: code not inline: %v", p.GetName(), p.GetVmConfig().GetCode())
+		}
+	}
+	yml, err := s.StaticConfig(config.HomeNodeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(yml), "/wasm/modules/") {
+		t.Error("the exported YAML still fetches a module from the control plane")
+	}
+
+	bs, err = xds.StaticBootstrap(config.HomeNodeID, snap, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plugins := staticWasmPlugins(t, bs); len(plugins) > 0 {
+		t.Errorf("without the module's code the export kept %d Wasm filters", len(plugins))
+	}
+}
+
+// staticWasmPlugins returns the Wasm filters' plugins in bs's listeners.
+func staticWasmPlugins(tb testing.TB, bs *bootstrap.Bootstrap) []*wasmv3.PluginConfig {
+	tb.Helper()
+	var plugins []*wasmv3.PluginConfig
+	for _, l := range bs.GetStaticResources().GetListeners() {
+		for _, fc := range l.GetFilterChains() {
+			for _, f := range fc.GetFilters() {
+				if f.GetName() != wellknown.HTTPConnectionManager {
+					continue
+				}
+				var mgr hcm.HttpConnectionManager
+				if err := f.GetTypedConfig().UnmarshalTo(&mgr); err != nil {
+					tb.Fatal(err)
+				}
+				for _, hf := range mgr.GetHttpFilters() {
+					if !strings.HasPrefix(hf.GetName(), "envoyage.wasm.") {
+						continue
+					}
+					var w wasmfilterv3.Wasm
+					if err := hf.GetTypedConfig().UnmarshalTo(&w); err != nil {
+						tb.Fatal(err)
+					}
+					plugins = append(plugins, w.GetConfig())
+				}
+			}
+		}
+	}
+	return plugins
+}
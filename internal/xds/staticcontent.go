@@ -0,0 +1,67 @@
+package xds
+
+import (
+	"mime"
+	"path"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+
+	"github.com/envoyage/envoyage/internal/registry"
+)
+
+// Static services
+//
+// A service with registry.Service.Static answers from its virtual host's
+// routes, as a redirect service does (see redirect.go): a direct response
+// per file, matching its exact path, then one for every other path. Every
+// node answers it itself, so a placeholder page is up even while home is
+// down.
+
+const (
+	staticContentType     = "text/html; charset=utf-8"
+	staticFileContentType = "text/plain; charset=utf-8"
+)
+
+// makeStaticRoutes replaces the virtual host's routes with the service's
+// content.
+func makeStaticRoutes(vh *route.VirtualHost, st *registry.Static) {
+	vh.Routes = make([]*route.Route, 0, len(st.Files)+1)
+	for _, f := range st.Files {
+		ct := f.ContentType
+		if ct == "" {
+			ct = mime.TypeByExtension(path.Ext(f.Path))
+		}
+		if ct == "" {
+			ct = staticFileContentType
+		}
+		vh.Routes = append(vh.Routes, staticRoute(&route.RouteMatch{
+			PathSpecifier: &route.RouteMatch_Path{Path: f.Path},
+		}, 200, ct, f.Body))
+	}
+	status, ct := st.Status, st.ContentType
+	if status == 0 {
+		status = 200
+	}
+	if ct == "" {
+		ct = staticContentType
+	}
+	vh.Routes = append(vh.Routes, staticRoute(&route.RouteMatch{
+		PathSpecifier: &route.RouteMatch_Prefix{Prefix: "/"},
+	}, status, ct, st.Body))
+}
+
+// staticRoute answers the requests match matches with body.
+func staticRoute(match *route.RouteMatch, status int, contentType, body string) *route.Route {
+	action := &route.DirectResponseAction{Status: uint32(status)}
+	if body != "" {
+		action.Body = &core.DataSource{Specifier: &core.DataSource_InlineString{InlineString: body}}
+	}
+	return &route.Route{
+		Match:  match,
+		Action: &route.Route_DirectResponse{DirectResponse: action},
+		ResponseHeadersToAdd: []*core.HeaderValueOption{
+			headerOption(registry.Header{Name: "Content-Type", Value: contentType}, core.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD),
+		},
+	}
+}
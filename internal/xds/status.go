@@ -0,0 +1,122 @@
+package xds
+
+import (
+	"time"
+
+	discoverygrpc "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+)
+
+// SyncStatus is how far a node has caught up with its snapshot.
+type SyncStatus struct {
+	// Connected is true while the node has an open ADS stream.
+	Connected bool `json:"connected"`
+	// Pushed is the version of the snapshot held for the node; empty
+	// before the first build.
+	Pushed string `json:"pushed"`
+	// Acked is the listener version the node has accepted; empty if none
+	// yet. Listeners are sent last over ADS, so they are the type to lag.
+	Acked string `json:"acked"`
+	// Pinned is set while the node is served an imported snapshot instead
+	// of the live one; see ImportSnapshot.
+	Pinned bool `json:"pinned,omitempty"`
+	// InSync is true while connected, once every subscribed type has
+	// accepted Pushed, unless a later snapshot failed to build.
+	InSync bool `json:"in_sync"`
+	// Error is the node's most recent rejection (NACK), cleared when it
+	// accepts a later version.
+	Error    string    `json:"error,omitempty"`
+	LastSeen time.Time `json:"last_seen,omitzero"`
+
+	// BuildError is why the node's latest snapshot, FailedVersion, couldn't
+	// be built or pushed, so it is still served Pushed. BuildFailures
+	// counts the failures in a row since FailingSince; the next retry is
+	// at NextRetry. All are cleared by a successful build.
+	BuildError    string    `json:"build_error,omitempty"`
+	FailedVersion string    `json:"failed_version,omitempty"`
+	BuildFailures int       `json:"build_failures,omitempty"`
+	FailingSince  time.Time `json:"failing_since,omitzero"`
+	NextRetry     time.Time `json:"next_retry,omitzero"`
+}
+
+// nodeSync is what the ADS callbacks have seen from one node.
+type nodeSync struct {
+	streams  int
+	acked    map[string]string // type URL → version
+	nack     string
+	lastSeen time.Time
+}
+
+// syncFor returns the node's sync record, creating it. Caller holds
+// streamMu.
+func (s *Server) syncFor(nodeID string) *nodeSync {
+	ns := s.sync[nodeID]
+	if ns == nil {
+		ns = &nodeSync{acked: make(map[string]string)}
+		s.sync[nodeID] = ns
+	}
+	return ns
+}
+
+// observeStream counts a node's ADS streams opening (+1) and closing (-1).
+// A new stream starts from scratch, so what was accepted is forgotten.
+// Caller holds streamMu.
+func (s *Server) observeStream(nodeID string, delta int) {
+	ns := s.syncFor(nodeID)
+	ns.streams += delta
+	if delta > 0 {
+		clear(ns.acked)
+	}
+}
+
+// observeSync records an ACK or NACK. Caller holds streamMu.
+func (s *Server) observeSync(nodeID string, req *discoverygrpc.DiscoveryRequest) {
+	ns := s.syncFor(nodeID)
+	ns.lastSeen = time.Now()
+	if d := req.GetErrorDetail(); d != nil {
+		ns.nack = d.GetMessage()
+		return
+	}
+	if v := req.GetVersionInfo(); v != "" {
+		ns.acked[req.GetTypeUrl()] = v
+		ns.nack = ""
+	} else if _, ok := ns.acked[req.GetTypeUrl()]; !ok {
+		// First subscription to the type: nothing accepted yet.
+		ns.acked[req.GetTypeUrl()] = ""
+	}
+}
+
+// Sync returns the sync status of a managed node.
+func (s *Server) Sync(nodeID string) SyncStatus {
+	var st SyncStatus
+	if snap, err := s.cache.GetSnapshot(nodeID); err == nil {
+		st.Pushed = snap.GetVersion(resource.ListenerType)
+	}
+	_, st.Pinned = s.pinnedVersion(nodeID)
+	if f := s.buildFailureOf(nodeID); f != nil {
+		st.BuildError = f.err.Error()
+		st.FailedVersion = f.version
+		st.BuildFailures = f.count
+		st.FailingSince = f.since
+		st.NextRetry = f.nextRetry
+	}
+
+	s.streamMu.Lock()
+	defer s.streamMu.Unlock()
+	ns := s.sync[nodeID]
+	if ns == nil {
+		return st
+	}
+	st.Connected = ns.streams > 0
+	st.Error = ns.nack
+	st.LastSeen = ns.lastSeen
+
+	st.Acked = ns.acked[resource.ListenerType]
+	st.InSync = st.Connected && st.Pushed != "" && len(ns.acked) > 0 && st.BuildError == ""
+	for _, v := range ns.acked {
+		if v != st.Pushed {
+			st.InSync = false
+		}
+	}
+	return st
+}
@@ -0,0 +1,37 @@
+package xds
+
+import (
+	"time"
+
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// Streaming uploads
+//
+// Envoy streams bodies unless something needs the whole request: the
+// buffer filter (the body limit, skipped for streaming services in
+// applyLimits) or a retry, which keeps the body to replay it. What breaks a
+// multi-GB upload is the default 15s route timeout, counted from the end of
+// the request. Streaming services get no route timeout and an idle timeout
+// instead, on both nodes, and never a retry policy, so a failed upload is
+// not replayed halfway through.
+
+// streamIdleTimeout ends a streaming request that moved no data for this
+// long.
+const streamIdleTimeout = 5 * time.Minute
+
+// applyStreaming sets up the routes of a streaming service. Run it before
+// routes are cloned (share links, client certificates) so the clones match.
+func applyStreaming(vh *route.VirtualHost) {
+	vh.RetryPolicy = nil
+	for _, r := range vh.Routes {
+		action, ok := r.Action.(*route.Route_Route)
+		if !ok {
+			continue
+		}
+		action.Route.Timeout = durationpb.New(0)
+		action.Route.IdleTimeout = durationpb.New(streamIdleTimeout)
+		action.Route.RetryPolicy = nil
+	}
+}
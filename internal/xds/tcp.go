@@ -0,0 +1,98 @@
+package xds
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	listener "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	tcpproxy "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/tcp_proxy/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/wellknown"
+	"google.golang.org/protobuf/types/known/anypb"
+
+	"github.com/envoyage/envoyage/internal/registry"
+)
+
+// TCP forwards
+//
+// A service with a TCP port range (registry.TCPForward) gets one listener
+// and one cluster per port, on every node that serves it, named
+// "tcp_<service>_<port>" so each port has its own stats. Like HTTP, it
+// crosses the tunnel through the home node: the edges forward port P to
+// port P of the home ingress host, and the home node forwards it to the
+// upstream, offset as the range is. So the home Envoy has to be reachable
+// on those ports too, e.g. published from its container.
+//
+// A staging node shares a host with an edge, so it can't bind the same
+// ports and serves no TCP forwards. Ports already taken on the node, by
+// its HTTP(S) listeners or a service earlier by name, leave the later
+// service out whole rather than part of its range; lint reports it.
+
+// tcpName names the listener and cluster of one port of a TCP service.
+func tcpName(svc *registry.Service, port uint32) string {
+	return fmt.Sprintf("tcp_%s_%d", svc.Name, port)
+}
+
+// tcpForwards builds the listeners and clusters of the node's TCP
+// services. reserved are the ports the node's other listeners use.
+func (b *SnapshotBuilder) tcpForwards(isEdge bool, services []*registry.Service, reserved ...uint32) (clusters, listeners []types.Resource, err error) {
+	services = slices.Clone(services)
+	slices.SortFunc(services, func(a, b *registry.Service) int { return strings.Compare(a.Name, b.Name) })
+
+	used := make(map[uint32]bool)
+	for _, p := range reserved {
+		used[p] = true
+	}
+	for _, svc := range services {
+		ports := svc.TCP.Ports()
+		if slices.ContainsFunc(ports, func(p uint32) bool { return used[p] }) {
+			continue
+		}
+		host, base := splitHostPort(svc.Upstream)
+		for i, port := range ports {
+			name := tcpName(svc, port)
+			var c *cluster.Cluster
+			if isEdge {
+				ingress, _ := splitHostPort(b.cfg.HomeIngress)
+				c = makeCluster(name, net.JoinHostPort(ingress, strconv.FormatUint(uint64(port), 10)))
+			} else {
+				c = makeCluster(name, net.JoinHostPort(host, strconv.FormatUint(uint64(base)+uint64(i), 10)))
+				applyHealthCheck(c, svc.HealthCheck)
+				applyServiceDNS(c, svc.DNS)
+			}
+			l, err := makeTCPListener(name, port, name)
+			if err != nil {
+				return nil, nil, fmt.Errorf("service %q: %w", svc.Name, err)
+			}
+			clusters = append(clusters, c)
+			listeners = append(listeners, l)
+			used[port] = true
+		}
+	}
+	return clusters, listeners, nil
+}
+
+// makeTCPListener forwards connections to port to a cluster as they are.
+func makeTCPListener(name string, port uint32, clusterName string) (*listener.Listener, error) {
+	proxy, err := anypb.New(&tcpproxy.TcpProxy{
+		StatPrefix:       name,
+		ClusterSpecifier: &tcpproxy.TcpProxy_Cluster{Cluster: clusterName},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("marshaling tcp proxy: %w", err)
+	}
+	return &listener.Listener{
+		Name:    "listener_" + name,
+		Address: makeAddress("0.0.0.0", port),
+		FilterChains: []*listener.FilterChain{{
+			Filters: []*listener.Filter{{
+				Name:       wellknown.TCPProxy,
+				ConfigType: &listener.Filter_TypedConfig{TypedConfig: proxy},
+			}},
+		}},
+	}, nil
+}
@@ -0,0 +1,123 @@
+package xds
+
+import (
+	"fmt"
+
+	accesslogv3 "github.com/envoyproxy/go-control-plane/envoy/config/accesslog/v3"
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	tracev3 "github.com/envoyproxy/go-control-plane/envoy/config/trace/v3"
+	grpcalsv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/access_loggers/grpc/v3"
+	hcm "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"google.golang.org/protobuf/types/known/anypb"
+
+	"github.com/envoyage/envoyage/internal/config"
+)
+
+const (
+	otelClusterName = "otel_collector"
+	otelTracerName  = "envoy.tracers.opentelemetry"
+)
+
+// makeTracing returns the HCM tracing config and the collector cluster for a
+// node, or nil, nil if Envoy tracing is off. Spans carry the node ID as their
+// service name, so edge and home hops are told apart in the trace view.
+func makeTracing(node Node, cfg *config.EnvoyTracing) (*hcm.HttpConnectionManager_Tracing, *cluster.Cluster, error) {
+	if cfg == nil {
+		return nil, nil, nil
+	}
+
+	otelCfg, err := anypb.New(&tracev3.OpenTelemetryConfig{
+		GrpcService: &core.GrpcService{
+			TargetSpecifier: &core.GrpcService_EnvoyGrpc_{
+				EnvoyGrpc: &core.GrpcService_EnvoyGrpc{ClusterName: otelClusterName},
+			},
+		},
+		ServiceName: node.ID,
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("marshaling opentelemetry tracer config: %w", err)
+	}
+	tracing := &hcm.HttpConnectionManager_Tracing{
+		RandomSampling: &typev3.Percent{Value: cfg.SamplePercent},
+		Provider: &tracev3.Tracing_Http{
+			Name:       otelTracerName,
+			ConfigType: &tracev3.Tracing_Http_TypedConfig{TypedConfig: otelCfg},
+		},
+	}
+
+	// OTLP/gRPC needs HTTP/2 to the collector.
+	c := makeCluster(otelClusterName, cfg.Collector)
+	if err := useHTTP2(c); err != nil {
+		return nil, nil, fmt.Errorf("collector cluster: %w", err)
+	}
+	return tracing, c, nil
+}
+
+const (
+	grpcAccessLoggerName = "envoy.access_loggers.http_grpc"
+
+	// ExemplarLogName identifies the access log stream that carries trace
+	// exemplars to the control plane.
+	ExemplarLogName = "envoyage_exemplars"
+)
+
+// makeExemplarLog returns an access log that streams failed and slow
+// requests, with their traceparent header and user, to the control plane over the
+// xDS cluster. The control plane keeps the recent ones per service as links
+// into the tracing backend. Nil if Envoy tracing is off.
+func makeExemplarLog(cfg *config.EnvoyTracing) (*accesslogv3.AccessLog, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	grpcCfg, err := anypb.New(&grpcalsv3.HttpGrpcAccessLogConfig{
+		CommonConfig: &grpcalsv3.CommonGrpcAccessLogConfig{
+			LogName: ExemplarLogName,
+			GrpcService: &core.GrpcService{
+				TargetSpecifier: &core.GrpcService_EnvoyGrpc_{
+					EnvoyGrpc: &core.GrpcService_EnvoyGrpc{ClusterName: xdsClusterName},
+				},
+			},
+			TransportApiVersion: core.ApiVersion_V3,
+		},
+		// The user headers are set by the auth service (see
+		// extAuthzUpstreamHeaderPrefixes).
+		AdditionalRequestHeadersToLog: []string{"traceparent", "remote-user", "x-auth-request-user"},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("marshaling exemplar access log config: %w", err)
+	}
+
+	return &accesslogv3.AccessLog{
+		Name: grpcAccessLoggerName,
+		Filter: &accesslogv3.AccessLogFilter{
+			FilterSpecifier: &accesslogv3.AccessLogFilter_OrFilter{
+				OrFilter: &accesslogv3.OrFilter{
+					Filters: []*accesslogv3.AccessLogFilter{
+						{FilterSpecifier: &accesslogv3.AccessLogFilter_StatusCodeFilter{
+							StatusCodeFilter: &accesslogv3.StatusCodeFilter{
+								Comparison: &accesslogv3.ComparisonFilter{
+									Op:    accesslogv3.ComparisonFilter_GE,
+									Value: &core.RuntimeUInt32{DefaultValue: 500, RuntimeKey: "envoyage.exemplars.min_status"},
+								},
+							},
+						}},
+						{FilterSpecifier: &accesslogv3.AccessLogFilter_DurationFilter{
+							DurationFilter: &accesslogv3.DurationFilter{
+								Comparison: &accesslogv3.ComparisonFilter{
+									Op: accesslogv3.ComparisonFilter_GE,
+									Value: &core.RuntimeUInt32{
+										DefaultValue: uint32(cfg.SlowThreshold.Milliseconds()),
+										RuntimeKey:   "envoyage.exemplars.slow_ms",
+									},
+								},
+							},
+						}},
+					},
+				},
+			},
+		},
+		ConfigType: &accesslogv3.AccessLog_TypedConfig{TypedConfig: grpcCfg},
+	}, nil
+}
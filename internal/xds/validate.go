@@ -0,0 +1,31 @@
+package xds
+
+import (
+	"context"
+
+	"github.com/envoyage/envoyage/internal/registry"
+)
+
+// NodeCheck is the outcome of building one node's snapshot in Validate.
+type NodeCheck struct {
+	Node string
+	Err  error // nil if the snapshot built and passed every check
+}
+
+// Validate builds every node's snapshot from services, with the checks of a
+// rebuild (Snapshot.Consistent and, if configured, the pre-flight Envoy),
+// and pushes nothing. Services draining elsewhere are left out: it checks
+// the state services describe, not the way there. The results are in the
+// order of Nodes.
+func (s *Server) Validate(ctx context.Context, services []*registry.Service) []NodeCheck {
+	_, version := s.reg.Snapshot()
+	snapVersion := snapshotVersion(version, 0) + "+validate"
+
+	nodes := s.Nodes()
+	out := make([]NodeCheck, 0, len(nodes))
+	for _, node := range nodes {
+		_, err := s.buildNode(ctx, node, services, nil, snapVersion)
+		out = append(out, NodeCheck{Node: node.ID, Err: err})
+	}
+	return out
+}
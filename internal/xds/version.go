@@ -0,0 +1,47 @@
+package xds
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	cachev3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// snapshotTypes are the resource types of a built snapshot.
+var snapshotTypes = []resource.Type{resource.ClusterType, resource.RouteType, resource.ListenerType}
+
+// useContentVersion renames snap after a hash of its resources, for HA
+// (see config.HA): every instance, and every restart, gives the same config
+// the same version, so an Envoy reconnecting to another instance is already
+// in sync. Resources are hashed in their JSON form, which, unlike the wire
+// form, doesn't depend on map order; compacting it removes the whitespace
+// protojson varies on purpose.
+func useContentVersion(snap *cachev3.Snapshot) error {
+	h := sha256.New()
+	var buf bytes.Buffer
+	for _, typ := range snapshotTypes {
+		resources := snap.GetResources(typ)
+		for _, name := range sortedNames(resources) {
+			js, err := protojson.Marshal(resources[name])
+			if err != nil {
+				return fmt.Errorf("hashing %q: %w", name, err)
+			}
+			buf.Reset()
+			if err := json.Compact(&buf, js); err != nil {
+				return fmt.Errorf("hashing %q: %w", name, err)
+			}
+			fmt.Fprintf(h, "%s\x00%s\x00", typ, name)
+			h.Write(buf.Bytes())
+		}
+	}
+	version := "h" + hex.EncodeToString(h.Sum(nil)[:8])
+	for i := range snap.Resources {
+		snap.Resources[i].Version = version
+	}
+	return nil
+}
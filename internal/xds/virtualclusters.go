@@ -0,0 +1,50 @@
+package xds
+
+import (
+	"regexp"
+	"strings"
+
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	matcher "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+
+	"github.com/envoyage/envoyage/internal/registry"
+)
+
+// makeVirtualClusters renders a service's named path patterns as Envoy
+// virtual clusters. Envoy then keeps request count, status code and latency
+// stats under vhost.<service>.vcluster.<name>.* for every request whose path
+// matches; the first matching pattern wins, so order is preserved.
+//
+// Virtual clusters are purely observational and emitted on every node: the
+// edge numbers include tunnel latency, the home numbers don't.
+func makeVirtualClusters(vcs []registry.VirtualCluster) []*route.VirtualCluster {
+	if len(vcs) == 0 {
+		return nil
+	}
+	out := make([]*route.VirtualCluster, 0, len(vcs))
+	for _, vc := range vcs {
+		out = append(out, &route.VirtualCluster{
+			Name: vc.Name,
+			Headers: []*route.HeaderMatcher{{
+				Name: ":path",
+				HeaderMatchSpecifier: &route.HeaderMatcher_StringMatch{
+					StringMatch: &matcher.StringMatcher{
+						MatchPattern: &matcher.StringMatcher_SafeRegex{
+							SafeRegex: &matcher.RegexMatcher{Regex: pathPatternRegex(vc.Pattern)},
+						},
+					},
+				},
+			}},
+		})
+	}
+	return out
+}
+
+// pathPatternRegex translates "/api/*" (prefix) or "/ws" (exact) into a RE2
+// regex over the :path header, which includes the query string.
+func pathPatternRegex(pattern string) string {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return "^" + regexp.QuoteMeta(prefix) + ".*"
+	}
+	return "^" + regexp.QuoteMeta(pattern) + `(\?.*)?$`
+}
@@ -0,0 +1,207 @@
+package xds
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	wasmfilterv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/wasm/v3"
+	hcm "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	wasmv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/wasm/v3"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/envoyage/envoyage/internal/config"
+	"github.com/envoyage/envoyage/internal/registry"
+	"github.com/envoyage/envoyage/internal/wasm"
+)
+
+// Wasm filters
+//
+// Modules uploaded with PUT /wasm/{name} run as HTTP filters, after the
+// auth filters so plugins only see requests that got past them:
+//
+//   - config.Wasm.Filters run for every service, in order.
+//   - A service's registry.Service.Wasm run for that service only: the
+//     filter is in the HCM but disabled, and enabled on its virtual host.
+//     Services listing the same module with the same settings share one
+//     filter, placed where the first of them (by name) lists it.
+//
+// A filter runs on the home node, or on the edges if it sets Edge. Modules
+// that aren't uploaded are left out (lint reports them), so a typo doesn't
+// take every other service down with it.
+//
+// The module's code is sent inline with the listener, unless
+// config.Wasm.URL is set and the module is larger than InlineMax: then
+// Envoy fetches it from GET /wasm/modules/{sha256} on the management API
+// and checks it against the hash, so a module replaced under the same
+// name changes the listener and is fetched anew.
+
+const (
+	wasmFilterPrefix  = "envoyage.wasm."
+	wasmModuleCluster = "wasm_modules"
+	wasmRuntime       = "envoy.wasm.runtime.v8"
+	wasmFetchTimeout  = 30 * time.Second
+)
+
+// wasmKey is what makes two Wasm filters the same filter.
+type wasmKey struct {
+	module, rootID, config string
+	failOpen               bool
+}
+
+// filterName names the filter after its module, and a hash of the rest.
+func (k wasmKey) filterName() string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%s\x00%t", k.rootID, k.config, k.failOpen)))
+	return wasmFilterPrefix + k.module + "." + hex.EncodeToString(sum[:4])
+}
+
+// applyWasm returns the Wasm filters to put in the HCM, and the cluster
+// modules are fetched over, if any, enabling the services' own filters on
+// their virtual hosts. vhosts must be index-aligned with services.
+func (b *SnapshotBuilder) applyWasm(node Node, isEdge bool, services []*registry.Service, vhosts []*route.VirtualHost) ([]*hcm.HttpFilter, *cluster.Cluster, error) {
+	if b.wasm == nil {
+		return nil, nil, nil
+	}
+	var (
+		filters []*hcm.HttpFilter
+		remote  bool
+		global  = make(map[wasmKey]bool)
+		added   = make(map[wasmKey]bool)
+	)
+	add := func(f registry.WasmFilter, disabled bool) (wasmKey, bool, error) {
+		k := wasmKey{f.Module, f.RootID, f.Config, f.FailOpen}
+		if added[k] {
+			return k, true, nil
+		}
+		mod, code, ok := b.wasm.Lookup(f.Module)
+		if !ok {
+			return k, false, nil
+		}
+		filter, fetched, err := b.makeWasmFilter(node, k, mod, code, disabled)
+		if err != nil {
+			return k, false, err
+		}
+		filters = append(filters, filter)
+		remote = remote || fetched
+		added[k] = true
+		return k, true, nil
+	}
+
+	for _, f := range b.cfg.Wasm.Filters {
+		if f.Edge != isEdge {
+			continue
+		}
+		k, _, err := add(wasmFilterFrom(f), false)
+		if err != nil {
+			return nil, nil, err
+		}
+		global[k] = true
+	}
+	var enabled *anypb.Any
+	for i, svc := range services {
+		for _, f := range svc.Wasm {
+			if f.Edge != isEdge {
+				continue
+			}
+			k, ok, err := add(f, true)
+			if err != nil {
+				return nil, nil, fmt.Errorf("service %q: %w", svc.Name, err)
+			}
+			if !ok || global[k] {
+				continue
+			}
+			if enabled == nil {
+				// An empty FilterConfig turns the default-disabled filter
+				// on.
+				if enabled, err = anypb.New(&route.FilterConfig{}); err != nil {
+					return nil, nil, fmt.Errorf("marshaling wasm filter config: %w", err)
+				}
+			}
+			setPerFilterConfig(vhosts[i], k.filterName(), enabled)
+		}
+	}
+	if !remote {
+		return filters, nil, nil
+	}
+	c, err := makeURLCluster(wasmModuleCluster, b.cfg.Wasm.URL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("wasm.url: %w", err)
+	}
+	return filters, c, nil
+}
+
+// makeWasmFilter returns the filter running mod, and whether Envoy
+// fetches its code from the management API.
+func (b *SnapshotBuilder) makeWasmFilter(node Node, k wasmKey, mod wasm.Module, code []byte, disabled bool) (*hcm.HttpFilter, bool, error) {
+	source, remote := b.wasmCode(mod, code)
+	plugin := &wasmv3.PluginConfig{
+		Name:   k.filterName(),
+		RootId: k.rootID,
+		Vm: &wasmv3.PluginConfig_VmConfig{VmConfig: &wasmv3.VmConfig{
+			VmId:    mod.Name,
+			Runtime: wasmRuntime,
+			Code:    source,
+		}},
+	}
+	if k.config != "" {
+		var err error
+		if plugin.Configuration, err = anypb.New(wrapperspb.String(k.config)); err != nil {
+			return nil, false, fmt.Errorf("marshaling wasm plugin config: %w", err)
+		}
+	}
+	switch {
+	case !node.Profile.supports(featureWasmFailurePolicy):
+		plugin.FailOpen = k.failOpen // deprecated, but the only form before failure_policy
+	case k.failOpen:
+		plugin.FailurePolicy = wasmv3.FailurePolicy_FAIL_OPEN
+	default:
+		plugin.FailurePolicy = wasmv3.FailurePolicy_FAIL_CLOSED
+	}
+	cfg, err := anypb.New(&wasmfilterv3.Wasm{Config: plugin})
+	if err != nil {
+		return nil, false, fmt.Errorf("marshaling wasm filter: %w", err)
+	}
+	return &hcm.HttpFilter{
+		Name:       k.filterName(),
+		ConfigType: &hcm.HttpFilter_TypedConfig{TypedConfig: cfg},
+		Disabled:   disabled,
+	}, remote, nil
+}
+
+// wasmCode is where Envoy gets a module's code from: inline, or fetched
+// from the management API if it is too large for that.
+func (b *SnapshotBuilder) wasmCode(mod wasm.Module, code []byte) (*core.AsyncDataSource, bool) {
+	w := b.cfg.Wasm
+	if w.URL == "" || int64(mod.Size) <= w.InlineMax {
+		return inlineWasmCode(code), false
+	}
+	return &core.AsyncDataSource{Specifier: &core.AsyncDataSource_Remote{
+		Remote: &core.RemoteDataSource{
+			HttpUri: &core.HttpUri{
+				Uri:              strings.TrimSuffix(w.URL, "/") + "/wasm/modules/" + mod.SHA256,
+				HttpUpstreamType: &core.HttpUri_Cluster{Cluster: wasmModuleCluster},
+				Timeout:          durationpb.New(wasmFetchTimeout),
+			},
+			Sha256: mod.SHA256,
+		},
+	}}, true
+}
+
+// inlineWasmCode sends a module's code inline.
+func inlineWasmCode(code []byte) *core.AsyncDataSource {
+	return &core.AsyncDataSource{Specifier: &core.AsyncDataSource_Local{
+		Local: &core.DataSource{Specifier: &core.DataSource_InlineBytes{InlineBytes: code}},
+	}}
+}
+
+// wasmFilterFrom converts a filter of the config.
+func wasmFilterFrom(f config.WasmFilter) registry.WasmFilter {
+	return registry.WasmFilter{Module: f.Module, RootID: f.RootID, Config: f.Config, Edge: f.Edge, FailOpen: f.FailOpen}
+}
@@ -0,0 +1,141 @@
+package xdstest
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	cachev3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/envoyage/envoyage/internal/xds"
+)
+
+// Golden files
+//
+// A golden file holds a snapshot as Render prints it, checked in next to
+// the test, usually under testdata/. Golden compares a snapshot with its
+// file, so a change to the SnapshotBuilder shows up as a diff of what the
+// Envoys are told:
+//
+//	snap := xdstest.Build(t, nil, xdstest.Home(), svc)
+//	xdstest.Golden(t, snap, "testdata/home.yaml")
+//
+// After an intended change, rewrite the files with
+//
+//	go test ./... -update-golden
+//
+// and review them with git diff like any other change.
+
+var updateGolden = flag.Bool("update-golden", false, "rewrite the xdstest golden files instead of comparing with them")
+
+// Render prints snap's clusters, route configurations and listeners as
+// YAML, in Envoy's form (proto field names, "@type" on Any fields), each
+// kind ordered by name. The version is left out: it changes with every
+// resource. The same snapshot always renders the same bytes.
+func Render(snap cachev3.ResourceSnapshot) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, kind := range []struct {
+		typ, key string
+	}{
+		{resource.ClusterType, "clusters"},
+		{resource.RouteType, "routes"},
+		{resource.ListenerType, "listeners"},
+	} {
+		resources := snap.GetResources(kind.typ)
+		if len(resources) == 0 {
+			fmt.Fprintf(&buf, "%s: []\n", kind.key)
+			continue
+		}
+		fmt.Fprintf(&buf, "%s:\n", kind.key)
+		for _, name := range Names(snap, kind.typ) {
+			m, ok := resources[name].(proto.Message)
+			if !ok {
+				return nil, fmt.Errorf("%s %q is a %T", typeName(kind.typ), name, resources[name])
+			}
+			out, err := xds.MarshalYAML(m)
+			if err != nil {
+				return nil, fmt.Errorf("rendering %s %q: %w", typeName(kind.typ), name, err)
+			}
+			// Indent each resource as an item of the kind's list.
+			for i, line := range strings.Split(strings.TrimSuffix(string(out), "\n"), "\n") {
+				prefix := "    "
+				if i == 0 {
+					prefix = "  - "
+				}
+				buf.WriteString(prefix + line + "\n")
+			}
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// Golden fails tb if snap doesn't render as the golden file at path, showing
+// where they differ. With -update-golden it writes the file instead,
+// creating its directory.
+func Golden(tb testing.TB, snap cachev3.ResourceSnapshot, path string) {
+	tb.Helper()
+	got, err := Render(snap)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if *updateGolden {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			tb.Fatalf("updating golden file: %v", err)
+		}
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			tb.Fatalf("updating golden file: %v", err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		tb.Fatalf("reading golden file (run with -update-golden to create it): %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		tb.Fatalf("snapshot differs from %s (run with -update-golden to accept it):\n%s", path, diff(string(want), string(got)))
+	}
+}
+
+// diffContext is how many unchanged lines diff shows around a change.
+const diffContext = 3
+
+// diff describes how got differs from want: the lines of want from the
+// first difference to the last, with "-", against those of got, with "+",
+// and a few unchanged lines around them. Good enough to find the change in
+// a snapshot; git diff on the rewritten file shows it precisely.
+func diff(want, got string) string {
+	w := strings.Split(want, "\n")
+	g := strings.Split(got, "\n")
+	start := 0
+	for start < len(w) && start < len(g) && w[start] == g[start] {
+		start++
+	}
+	endW, endG := len(w), len(g)
+	for endW > start && endG > start && w[endW-1] == g[endG-1] {
+		endW--
+		endG--
+	}
+
+	var b strings.Builder
+	from := max(start-diffContext, 0)
+	fmt.Fprintf(&b, "@@ line %d @@\n", from+1)
+	for _, line := range w[from:start] {
+		b.WriteString("  " + line + "\n")
+	}
+	for _, line := range w[start:endW] {
+		b.WriteString("- " + line + "\n")
+	}
+	for _, line := range g[start:endG] {
+		b.WriteString("+ " + line + "\n")
+	}
+	for _, line := range w[endW:min(endW+diffContext, len(w))] {
+		b.WriteString("  " + line + "\n")
+	}
+	return b.String()
+}
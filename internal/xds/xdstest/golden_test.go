@@ -0,0 +1,46 @@
+package xdstest_test
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+
+	"github.com/envoyage/envoyage/internal/registry"
+	"github.com/envoyage/envoyage/internal/registry/registrytest"
+	"github.com/envoyage/envoyage/internal/xds"
+	"github.com/envoyage/envoyage/internal/xds/xdstest"
+)
+
+func TestGolden(t *testing.T) {
+	svc := registrytest.Service("web", "web.example.com", "10.0.0.5:80")
+	for _, tc := range []struct {
+		node xds.Node
+		file string
+	}{
+		{xdstest.Home(), "testdata/home.yaml"},
+		{xdstest.Edge("envoyage-envoy-vps"), "testdata/edge.yaml"},
+	} {
+		t.Run(tc.node.ID, func(t *testing.T) {
+			xdstest.Golden(t, xdstest.Build(t, nil, tc.node, svc), tc.file)
+		})
+	}
+}
+
+func TestRenderIsStable(t *testing.T) {
+	services := []*registry.Service{
+		registrytest.Service("web", "web.example.com", "10.0.0.5:80"),
+		registrytest.Service("api", "api.example.com", "10.0.0.6:8080"),
+	}
+	first, err := xdstest.Render(xdstest.Build(t, nil, xdstest.Home(), services...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Reverse(services)
+	second, err := xdstest.Render(xdstest.Build(t, nil, xdstest.Home(), services...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first, second) {
+		t.Error("the same services render differently in another order")
+	}
+}
@@ -0,0 +1,220 @@
+// Package xdstest helps test what reaches the Envoys without one: it builds
+// snapshots, or runs an xds.Server without its gRPC side, and finds the
+// resources in them to check.
+//
+//	snap := xdstest.Build(t, nil, xdstest.Edge("envoyage-envoy-vps"), svc)
+//	vh := xdstest.VirtualHost(t, snap, "web.example.com")
+//	xdstest.NoCluster(t, snap, "mirror_web")
+//
+// Every snapshot is checked for consistency and each resource validated,
+// as Envoy would, so a test fails on a config Envoy would reject. Golden
+// compares a whole snapshot with a checked-in YAML file instead.
+package xdstest
+
+import (
+	"log/slog"
+	"slices"
+	"sort"
+	"testing"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	listener "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	cachev3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+
+	"github.com/envoyage/envoyage/internal/config"
+	"github.com/envoyage/envoyage/internal/registry"
+	"github.com/envoyage/envoyage/internal/xds"
+)
+
+// Home returns the home node on the newest profile.
+func Home() xds.Node {
+	return xds.Node{ID: config.HomeNodeID, Profile: xds.DefaultProfile}
+}
+
+// Edge returns an edge node on the newest profile.
+func Edge(id string) xds.Node {
+	return xds.Node{ID: id, Profile: xds.DefaultProfile}
+}
+
+// Build builds node's snapshot of services with cfg, or config.Default if
+// nil, and checks it.
+func Build(tb testing.TB, cfg *config.Config, node xds.Node, services ...*registry.Service) cachev3.ResourceSnapshot {
+	tb.Helper()
+	if cfg == nil {
+		cfg = config.Default()
+	}
+	snap, err := xds.NewSnapshotBuilder(cfg).Build(node, services, nil, "test")
+	if err != nil {
+		tb.Fatalf("building snapshot for node %q: %v", node.ID, err)
+	}
+	Check(tb, snap)
+	return snap
+}
+
+// NewServer creates an xDS server for cfg's nodes, or config.Default's if
+// cfg is nil, and seeds it. It rebuilds the snapshots on every change to
+// reg before the change returns, so Snapshot sees it right away.
+func NewServer(tb testing.TB, reg *registry.Registry, cfg *config.Config) *xds.Server {
+	tb.Helper()
+	if cfg == nil {
+		cfg = config.Default()
+	}
+	nodes := make([]xds.Node, 0, len(cfg.Nodes))
+	for _, n := range cfg.Nodes {
+		p, err := xds.LookupProfile(n.Profile)
+		if err != nil {
+			tb.Fatalf("node %q: %v", n.ID, err)
+		}
+		nodes = append(nodes, xds.Node{
+			ID:        n.ID,
+			Profile:   p,
+			Admin:     n.Admin,
+			Staging:   n.Role == config.NodeRoleStaging,
+			HTTPPort:  n.HTTPPort,
+			HTTPSPort: n.HTTPSPort,
+			IPFamily:  n.IPFamily,
+		})
+	}
+	s := xds.NewServer(reg, nodes, cfg, slog.New(slog.DiscardHandler))
+	if err := s.Seed(); err != nil {
+		tb.Fatalf("seeding xDS server: %v", err)
+	}
+	return s
+}
+
+// Snapshot returns the snapshot s holds for nodeID, checked.
+func Snapshot(tb testing.TB, s *xds.Server, nodeID string) cachev3.ResourceSnapshot {
+	tb.Helper()
+	snap, err := s.Snapshot(nodeID)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	Check(tb, snap)
+	return snap
+}
+
+type validator interface{ ValidateAll() error }
+
+// Check fails tb if snap references resources it doesn't have or one of
+// its resources is invalid.
+func Check(tb testing.TB, snap cachev3.ResourceSnapshot) {
+	tb.Helper()
+	if s, ok := snap.(*cachev3.Snapshot); ok {
+		if err := s.Consistent(); err != nil {
+			tb.Fatalf("inconsistent snapshot: %v", err)
+		}
+	}
+	for _, typ := range []string{resource.ClusterType, resource.RouteType, resource.ListenerType, resource.SecretType} {
+		for name, r := range snap.GetResources(typ) {
+			if v, ok := r.(validator); ok {
+				if err := v.ValidateAll(); err != nil {
+					tb.Fatalf("invalid %s %q: %v", typeName(typ), name, err)
+				}
+			}
+		}
+	}
+}
+
+// Names returns the names of snap's resources of a type, e.g.
+// resource.ClusterType, sorted.
+func Names(snap cachev3.ResourceSnapshot, typ string) []string {
+	resources := snap.GetResources(typ)
+	names := make([]string, 0, len(resources))
+	for name := range resources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Cluster returns the named cluster, failing tb if there is none.
+func Cluster(tb testing.TB, snap cachev3.ResourceSnapshot, name string) *cluster.Cluster {
+	tb.Helper()
+	return find[*cluster.Cluster](tb, snap, resource.ClusterType, name)
+}
+
+// Listener returns the named listener, failing tb if there is none.
+func Listener(tb testing.TB, snap cachev3.ResourceSnapshot, name string) *listener.Listener {
+	tb.Helper()
+	return find[*listener.Listener](tb, snap, resource.ListenerType, name)
+}
+
+// RouteConfig returns the named route configuration, failing tb if there
+// is none.
+func RouteConfig(tb testing.TB, snap cachev3.ResourceSnapshot, name string) *route.RouteConfiguration {
+	tb.Helper()
+	return find[*route.RouteConfiguration](tb, snap, resource.RouteType, name)
+}
+
+// NoCluster fails tb if snap has the named cluster.
+func NoCluster(tb testing.TB, snap cachev3.ResourceSnapshot, name string) {
+	tb.Helper()
+	if _, ok := snap.GetResources(resource.ClusterType)[name]; ok {
+		tb.Fatalf("unexpected cluster %q", name)
+	}
+}
+
+// VirtualHost returns the virtual host serving domain, failing tb if no
+// route configuration has one. A domain of the catch-all's, "*", doesn't
+// count.
+func VirtualHost(tb testing.TB, snap cachev3.ResourceSnapshot, domain string) *route.VirtualHost {
+	tb.Helper()
+	vh := virtualHost(snap, domain)
+	if vh == nil {
+		tb.Fatalf("no virtual host for %q; have %v", domain, Names(snap, resource.RouteType))
+	}
+	return vh
+}
+
+// NoVirtualHost fails tb if a virtual host serves domain.
+func NoVirtualHost(tb testing.TB, snap cachev3.ResourceSnapshot, domain string) {
+	tb.Helper()
+	if vh := virtualHost(snap, domain); vh != nil {
+		tb.Fatalf("unexpected virtual host %q for %q", vh.GetName(), domain)
+	}
+}
+
+func virtualHost(snap cachev3.ResourceSnapshot, domain string) *route.VirtualHost {
+	for _, name := range Names(snap, resource.RouteType) {
+		rc, ok := snap.GetResources(resource.RouteType)[name].(*route.RouteConfiguration)
+		if !ok {
+			continue
+		}
+		for _, vh := range rc.GetVirtualHosts() {
+			if slices.Contains(vh.GetDomains(), domain) {
+				return vh
+			}
+		}
+	}
+	return nil
+}
+
+func find[T types.Resource](tb testing.TB, snap cachev3.ResourceSnapshot, typ, name string) T {
+	tb.Helper()
+	r, ok := snap.GetResources(typ)[name]
+	if !ok {
+		tb.Fatalf("no %s %q; have %v", typeName(typ), name, Names(snap, typ))
+	}
+	out, ok := r.(T)
+	if !ok {
+		tb.Fatalf("%s %q is a %T", typeName(typ), name, r)
+	}
+	return out
+}
+
+func typeName(typ string) string {
+	switch typ {
+	case resource.ClusterType:
+		return "cluster"
+	case resource.RouteType:
+		return "route configuration"
+	case resource.ListenerType:
+		return "listener"
+	case resource.SecretType:
+		return "secret"
+	}
+	return typ
+}
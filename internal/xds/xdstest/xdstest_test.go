@@ -0,0 +1,39 @@
+package xdstest_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+
+	"github.com/envoyage/envoyage/internal/config"
+	"github.com/envoyage/envoyage/internal/registry/registrytest"
+	"github.com/envoyage/envoyage/internal/xds/xdstest"
+)
+
+func TestServerFollowsRegistry(t *testing.T) {
+	reg, _ := registrytest.New(t, registrytest.Service("web", "web.example.com", "10.0.0.5:80"))
+	s := xdstest.NewServer(t, reg, nil)
+
+	for _, n := range config.Default().Nodes {
+		snap := xdstest.Snapshot(t, s, n.ID)
+		xdstest.VirtualHost(t, snap, "web.example.com")
+	}
+	if len(xdstest.Names(xdstest.Snapshot(t, s, config.HomeNodeID), resource.ClusterType)) == 0 {
+		t.Error("home snapshot has no clusters")
+	}
+
+	if err := reg.Remove(context.Background(), "web"); err != nil {
+		t.Fatal(err)
+	}
+	xdstest.NoVirtualHost(t, xdstest.Snapshot(t, s, config.HomeNodeID), "web.example.com")
+}
+
+func TestBuild(t *testing.T) {
+	svc := registrytest.Service("web", "web.example.com", "10.0.0.5:80")
+	home := xdstest.Build(t, nil, xdstest.Home(), svc)
+	xdstest.VirtualHost(t, home, "web.example.com")
+
+	edge := xdstest.Build(t, nil, xdstest.Edge("envoyage-envoy-vps"), svc)
+	xdstest.VirtualHost(t, edge, "web.example.com")
+}